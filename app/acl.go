@@ -0,0 +1,61 @@
+package main
+
+import (
+	"expvar"
+	"net/netip"
+)
+
+// aclMetrics counts allowed and refused clients per ACL as <name>.allowed and <name>.refused
+var aclMetrics = expvar.NewMap("acl")
+
+// ACL is a named list of client networks allowed to use a feature of the server
+type ACL struct {
+	Name  string
+	Allow []netip.Prefix
+	// Stats records which prefix matched, nil disables recording
+	Stats *FirewallStats
+}
+
+// NewACL creates an ACL from a comma separated list of prefixes, registering
+// them with stats when it is not nil
+func NewACL(name, prefixes string, stats *FirewallStats) (*ACL, error) {
+	allow, err := parsePrefixes(prefixes)
+	if err != nil {
+		return nil, err
+	}
+	a := &ACL{Name: name, Allow: allow, Stats: stats}
+	if stats != nil {
+		for _, p := range allow {
+			stats.Register(a.rule(p))
+		}
+	}
+	return a, nil
+}
+
+func (a *ACL) rule(p netip.Prefix) Rule {
+	return Rule{List: "acl-" + a.Name, Pattern: p.String()}
+}
+
+// allows reports whether client is in the ACL, a nil ACL allows everybody
+func (a *ACL) allows(client netip.Addr) bool {
+	if a == nil {
+		return true
+	}
+	client = client.Unmap()
+	// The most specific prefix is the one credited with the match
+	var match netip.Prefix
+	for _, p := range a.Allow {
+		if p.Contains(client) && (!match.IsValid() || p.Bits() > match.Bits()) {
+			match = p
+		}
+	}
+	if !match.IsValid() {
+		aclMetrics.Add(a.Name+".refused", 1)
+		return false
+	}
+	aclMetrics.Add(a.Name+".allowed", 1)
+	if a.Stats != nil {
+		a.Stats.Hit(a.rule(match))
+	}
+	return true
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"net/netip"
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+// aclCount returns the current value of an ACL counter
+func aclCount(name string) int64 {
+	if v, ok := aclMetrics.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestServerACLs(t *testing.T) {
+	s := newTestServer(t, dnstest.StartUDPServer(t, answerA("192.0.2.1")).Addr)
+	s.LocalZones = NewLocalZones("")
+	stats := NewFirewallStats()
+	var err error
+	if s.QueryACL, err = NewACL("query", "10.0.0.0/8, 2001:db8::/32", stats); err != nil {
+		t.Fatal(err)
+	}
+	if s.RecursionACL, err = NewACL("recursion", "10.0.0.0/8,10.1.0.0/16", stats); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		client    string
+		name      string
+		qtype     dnsmessage.Type
+		rcode     dnsmessage.RCode
+		recursion bool
+	}{
+		{"192.0.2.9", "example.com", dnsmessage.TypeA, dnsmessage.RCodeRefused, false},
+		{"192.0.2.9", "1.168.192.in-addr.arpa", dnsmessage.TypePTR, dnsmessage.RCodeRefused, false},
+		{"2001:db8::1", "example.com", dnsmessage.TypeA, dnsmessage.RCodeRefused, false},
+		{"2001:db8::1", "1.168.192.in-addr.arpa", dnsmessage.TypePTR, dnsmessage.RCodeNameError, false},
+		{"::ffff:10.1.2.3", "example.com", dnsmessage.TypeA, dnsmessage.RCodeSuccess, true},
+	}
+	for _, tt := range tests {
+		query := &dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: 7, RecursionDesired: true},
+			Questions: []dnsmessage.Question{question(tt.name, tt.qtype)},
+		}
+		client := netip.AddrPortFrom(netip.MustParseAddr(tt.client), 53000)
+		resp := s.Handle(context.Background(), &QueryContext{Client: client, Transport: "udp", Query: query})
+		if resp.RCode != tt.rcode || resp.RecursionAvailable != tt.recursion {
+			t.Errorf("%s %s: expected %s with RA=%v, got %s", tt.client, tt.name, tt.rcode, tt.recursion, resp)
+		}
+	}
+
+	if got := aclCount("query.refused"); got < 2 {
+		t.Errorf("Expected refused queries to be counted, got %d", got)
+	}
+	if got := aclCount("recursion.refused"); got < 2 {
+		t.Errorf("Expected refused recursion to be counted, got %d", got)
+	}
+	for _, h := range stats.Snapshot() {
+		want := uint64(0)
+		switch h.Rule {
+		case Rule{List: "acl-query", Pattern: "10.0.0.0/8"}:
+			want = 1
+		case Rule{List: "acl-query", Pattern: "2001:db8::/32"}:
+			want = 2
+		case Rule{List: "acl-recursion", Pattern: "10.1.0.0/16"}:
+			want = 1
+		}
+		if h.Hits != want {
+			t.Errorf("%s %s: expected %d hits, got %d", h.List, h.Pattern, want, h.Hits)
+		}
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// runtimeMetrics are gauges of the server whose admin API was set up last,
+// read when /debug/vars is served
+var runtimeMetrics = expvar.NewMap("runtime")
+
+// topMetrics are the clients and domains with the most queries to the server
+// whose admin API was set up last, topMetricsSize of each
+var topMetrics = expvar.NewMap("top")
+
+const topMetricsSize = 10
+
+// AdminHandler serves the admin HTTP API, the metrics in expvar format on
+// /debug/vars and the profiles of net/http/pprof on /debug/pprof/. It is
+// meant to listen on a trusted address only, nothing in it is authenticated.
+func (s *Server) AdminHandler() http.Handler {
+	s.publishRuntimeMetrics()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /firewall/rules", s.handleFirewallRules)
+	mux.HandleFunc("POST /reload", s.handleReload)
+	mux.HandleFunc("GET /cache/export", s.handleCacheExport)
+	mux.HandleFunc("POST /cache/import", s.handleCacheImport)
+	mux.HandleFunc("DELETE /cache", s.handleCacheFlush)
+	mux.HandleFunc("GET /config", s.handleConfig)
+	mux.HandleFunc("GET /top-domains", s.handleTopDomains)
+	mux.HandleFunc("GET /top", s.handleTop)
+	mux.HandleFunc("GET /truncation", s.handleTruncation)
+	mux.HandleFunc("GET /debug/state", s.handleStateDump)
+	mux.HandleFunc("GET /trace", s.handleTrace)
+	mux.HandleFunc("GET /nxdomain-storms", s.handleStorms)
+	mux.HandleFunc("GET /modes", s.handleModes)
+	mux.HandleFunc("PUT /modes/read-only", s.handleReadOnly)
+	mux.HandleFunc("DELETE /modes/read-only", s.handleReadOnly)
+	mux.HandleFunc("PUT /modes/maintenance", s.handleMaintenance)
+	mux.HandleFunc("DELETE /modes/maintenance", s.handleMaintenance)
+	mux.HandleFunc("PUT /modes/blocking", s.handleBlocking)
+	mux.HandleFunc("DELETE /modes/blocking", s.handleBlocking)
+	mux.Handle("GET /debug/vars", expvar.Handler())
+	mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+	mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("POST /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// publishRuntimeMetrics has the runtime metrics read from s: the goroutines,
+// the queries being answered, the lookups waiting on upstreams and the
+// entries and memory of the cache, and the top metrics
+func (s *Server) publishRuntimeMetrics() {
+	runtimeMetrics.Set("goroutines", expvar.Func(func() any { return runtime.NumGoroutine() }))
+	runtimeMetrics.Set("queries_in_flight", expvar.Func(func() any { return s.answering.Load() }))
+	runtimeMetrics.Set("tcp_connections", expvar.Func(func() any { return s.tcpConns.Load() }))
+	runtimeMetrics.Set("lookups_in_flight", expvar.Func(func() any { return s.active().inflight.InFlight() }))
+	runtimeMetrics.Set("cache_entries", expvar.Func(func() any {
+		if cache := s.active().Cache; cache != nil {
+			return cache.Len()
+		}
+		return 0
+	}))
+	runtimeMetrics.Set("cache_bytes", expvar.Func(func() any {
+		if cache := s.active().Cache; cache != nil {
+			return cache.Bytes()
+		}
+		return 0
+	}))
+	topMetrics.Set("clients", expvar.Func(func() any { return s.active().QueryStats.Report(topMetricsSize).Clients }))
+	topMetrics.Set("domains", expvar.Func(func() any { return s.active().QueryStats.Report(topMetricsSize).Domains }))
+}
+
+// handleFirewallRules lists the blocklist and ACL rules with their hit counters. The
+// optional filters are list=<name>, unused=true for rules that never matched
+// and idle=<duration> for rules that did not match within that duration.
+func (s *Server) handleFirewallRules(w http.ResponseWriter, r *http.Request) {
+	stats := s.active().FirewallStats
+	if stats == nil {
+		http.Error(w, "firewall statistics are disabled", http.StatusNotFound)
+		return
+	}
+	list := r.URL.Query().Get("list")
+	unused := r.URL.Query().Get("unused") == "true"
+	var idleSince time.Time
+	if idle := r.URL.Query().Get("idle"); idle != "" {
+		d, err := time.ParseDuration(idle)
+		if err != nil {
+			http.Error(w, "invalid idle duration: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		idleSince = stats.now().Add(-d)
+	}
+
+	rules := []RuleHits{}
+	for _, h := range stats.Snapshot() {
+		switch {
+		case list != "" && h.List != list:
+		case unused && h.Hits > 0:
+		case !idleSince.IsZero() && h.LastHit != nil && h.LastHit.After(idleSince):
+		default:
+			rules = append(rules, h)
+		}
+	}
+	writeJSON(w, rules)
+}
+
+// handleReload re-reads the configuration, like SIGHUP does
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if s.Reload == nil {
+		http.Error(w, "reloading is disabled", http.StatusNotFound)
+		return
+	}
+	if s.refuseReadOnly(w) {
+		return
+	}
+	if err := s.Reload(); err != nil {
+		http.Error(w, "reload failed, keeping the current configuration: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	writeJSON(w, map[string]string{"status": "reloaded"})
+}
+
+// handleCacheExport streams the cache in the export format, see cacheLine
+func (s *Server) handleCacheExport(w http.ResponseWriter, r *http.Request) {
+	cache := s.active().Cache
+	if cache == nil {
+		http.Error(w, "the cache is disabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	if _, err := cache.Export(w); err != nil {
+		log.Printf("Failed to export the cache: %v", err)
+	}
+}
+
+// handleCacheImport adds the entries of an export in the request body to the cache
+func (s *Server) handleCacheImport(w http.ResponseWriter, r *http.Request) {
+	cache := s.active().Cache
+	if cache == nil {
+		http.Error(w, "the cache is disabled", http.StatusNotFound)
+		return
+	}
+	if s.refuseReadOnly(w) {
+		return
+	}
+	n, err := cache.Import(r.Body)
+	if err != nil {
+		http.Error(w, "invalid cache export: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, map[string]int{"imported": n})
+}
+
+// handleCacheFlush removes the entries for the name=<name> parameter from the
+// caches of the server and its views, or every entry without it
+func (s *Server) handleCacheFlush(w http.ResponseWriter, r *http.Request) {
+	cache := s.active().Cache
+	if cache == nil {
+		http.Error(w, "the cache is disabled", http.StatusNotFound)
+		return
+	}
+	if s.refuseReadOnly(w) {
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if name != "" {
+		if _, err := dnsmessage.CanonicalName(name); err != nil {
+			http.Error(w, "invalid name: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	n := cache.Flush(name)
+	for _, v := range s.active().Views {
+		if v.Server.Cache != nil {
+			n += v.Server.Cache.Flush(name)
+		}
+	}
+	log.Printf("Flushed %d cache entries through the admin API", n)
+	writeJSON(w, map[string]int{"flushed": n})
+}
+
+// secretOptions are the options whose values the config dump leaves out
+var secretOptions = map[string]bool{"cookie-secret": true, "tsig-key": true}
+
+// handleConfig serves the options in effect by their config file keys, with
+// secrets redacted
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	running := s.active().options
+	if running == nil {
+		http.Error(w, "the server was not built from options", http.StatusNotFound)
+		return
+	}
+	o := &options{}
+	fs := newFlagSet(o)
+	*o = *running
+	config := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if secretOptions[f.Name] && value != "" {
+			value = "REDACTED"
+		}
+		config[f.Name] = value
+	})
+	writeJSON(w, config)
+}
+
+// handleTopDomains lists the names queried most, the n=<count> parameter
+// most, 10 by default
+func (s *Server) handleTopDomains(w http.ResponseWriter, r *http.Request) {
+	if n, ok := topCount(w, r); ok {
+		writeJSON(w, s.active().QueryStats.Top(n))
+	}
+}
+
+// handleTop reports the names, clients and second level domains with the
+// most queries within the -stats-retention window, the n=<count> parameter
+// most of each, 10 by default
+func (s *Server) handleTop(w http.ResponseWriter, r *http.Request) {
+	if n, ok := topCount(w, r); ok {
+		writeJSON(w, s.active().QueryStats.Report(n))
+	}
+}
+
+// topCount returns the n=<count> parameter of r, answering with an error
+// when it is invalid
+func topCount(w http.ResponseWriter, r *http.Request) (int, bool) {
+	n := 10
+	if count := r.URL.Query().Get("n"); count != "" {
+		var err error
+		if n, err = strconv.Atoi(count); err != nil || n <= 0 {
+			http.Error(w, "invalid count: "+count, http.StatusBadRequest)
+			return 0, false
+		}
+	}
+	return n, true
+}
+
+// handleTruncation reports the client networks and domains with the most
+// truncated UDP answers, with advice on the UDP size and TCP reachability
+func (s *Server) handleTruncation(w http.ResponseWriter, r *http.Request) {
+	truncation := s.active().Truncation
+	if truncation == nil {
+		http.Error(w, "truncation statistics are disabled", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, truncation.Report())
+}
+
+// handleTrace resolves name=<name>, of type=<type> (A by default), from the
+// root servers down like the trace subcommand and serves every step. It uses
+// the iterator of -iterate, or one with the default settings when forwarding.
+func (s *Server) handleTrace(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "missing name", http.StatusBadRequest)
+		return
+	}
+	question := dnsmessage.Question{Name: canonicalName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	if qtype := r.URL.Query().Get("type"); qtype != "" {
+		var err error
+		if question.Type, err = dnsmessage.ParseType(strings.ToUpper(qtype)); err != nil {
+			http.Error(w, "invalid type: "+qtype, http.StatusBadRequest)
+			return
+		}
+	}
+	it := s.active().Iterator
+	if it == nil {
+		it = NewIterator()
+	}
+	writeJSON(w, traceResolution(r.Context(), it, question))
+}
+
+// handleStateDump serves a snapshot of the runtime state, like SIGUSR1 writes
+func (s *Server) handleStateDump(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.StateDump())
+}
+
+// handleStorms lists the zones under an NXDOMAIN storm with their rate of
+// NXDOMAIN answers per second
+func (s *Server) handleStorms(w http.ResponseWriter, r *http.Request) {
+	storms := s.active().Storms
+	if storms == nil {
+		http.Error(w, "NXDOMAIN storm detection is disabled", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, storms.Storms())
+}
+
+// modesState is the state of the runtime toggles served by /modes
+type modesState struct {
+	ReadOnly    bool              `json:"read_only"`
+	Maintenance *maintenanceState `json:"maintenance"`
+	Blocking    bool              `json:"blocking"`
+}
+
+// maintenanceState is a maintenance mode in the admin API, also the body
+// switching one on
+type maintenanceState struct {
+	RCode  string `json:"rcode,omitempty"`
+	MaxTTL uint32 `json:"max_ttl,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// handleModes shows whether read-only and maintenance mode and blocking are on
+func (s *Server) handleModes(w http.ResponseWriter, r *http.Request) {
+	modes := s.active().Modes
+	state := modesState{ReadOnly: modes.ReadOnly(), Blocking: modes.Blocking()}
+	if m := modes.Maintenance(); m != nil {
+		state.Maintenance = &maintenanceState{RCode: m.RCode.String(), MaxTTL: m.MaxTTL, Reason: m.Reason}
+	}
+	writeJSON(w, state)
+}
+
+// handleReadOnly switches read-only mode on with PUT and off with DELETE
+func (s *Server) handleReadOnly(w http.ResponseWriter, r *http.Request) {
+	modes := s.active().Modes
+	if modes == nil {
+		http.Error(w, "runtime modes are disabled", http.StatusNotFound)
+		return
+	}
+	modes.SetReadOnly(r.Method == http.MethodPut)
+	s.handleModes(w, r)
+}
+
+// handleBlocking resumes blocking with PUT and pauses it with DELETE
+func (s *Server) handleBlocking(w http.ResponseWriter, r *http.Request) {
+	modes := s.active().Modes
+	if modes == nil {
+		http.Error(w, "runtime modes are disabled", http.StatusNotFound)
+		return
+	}
+	modes.SetBlocking(r.Method == http.MethodPut)
+	s.handleModes(w, r)
+}
+
+// handleMaintenance switches maintenance mode off with DELETE and on with PUT,
+// with the settings of the options unless the body holds a maintenanceState.
+// An rcode of NOERROR answers as usual with the TTLs capped.
+func (s *Server) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	modes := s.active().Modes
+	if modes == nil {
+		http.Error(w, "runtime modes are disabled", http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		modes.SetMaintenance(nil)
+		s.handleModes(w, r)
+		return
+	}
+	mode := modes.defaultMaintenance()
+	mode.Reason = "switched on through the admin API"
+	var body maintenanceState
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "invalid maintenance mode: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body != (maintenanceState{}) {
+		var err error
+		if mode, err = ParseMaintenance(body.RCode, body.MaxTTL); err != nil {
+			http.Error(w, "invalid maintenance mode: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		mode.Reason = body.Reason
+	}
+	modes.SetMaintenance(&mode)
+	s.handleModes(w, r)
+}
+
+// refuseReadOnly answers requests changing state with 409 Conflict in
+// read-only mode, reporting whether it did
+func (s *Server) refuseReadOnly(w http.ResponseWriter) bool {
+	if !s.active().Modes.ReadOnly() {
+		return false
+	}
+	http.Error(w, "refused in read-only mode", http.StatusConflict)
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("Failed to write admin response: %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+func TestAdminFlushesTheCache(t *testing.T) {
+	cache := NewCache(10)
+	for _, q := range []dnsmessage.Question{
+		question("www.example.com", dnsmessage.TypeA),
+		question("www.example.com", dnsmessage.TypeAAAA),
+		question("mail.example.com", dnsmessage.TypeA),
+	} {
+		cache.Put(q, &dnsmessage.Message{Answers: []dnsmessage.Resource{aRecord(q.Name, "192.0.2.1")}})
+	}
+	admin := (&Server{Cache: cache}).AdminHandler()
+
+	rec := httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest("DELETE", "/cache?name=WWW.example.com.", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"flushed": 2`) {
+		t.Fatalf("Expected both entries for the name to be flushed, got %d %s", rec.Code, rec.Body)
+	}
+	if _, ok := cache.Get(question("mail.example.com", dnsmessage.TypeA)); !ok {
+		t.Error("Expected the entries for other names to be kept")
+	}
+	rec = httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest("DELETE", "/cache", nil))
+	if rec.Code != http.StatusOK || cache.Len() != 0 {
+		t.Errorf("Expected the whole cache to be flushed, got %d with %d entries left", rec.Code, cache.Len())
+	}
+}
+
+func TestAdminServesTheConfig(t *testing.T) {
+	opts, err := loadOptions([]string{"-resolver", "192.0.2.53:53", "-cookie-secret", "000102030405060708090a0b0c0d0e0f"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := buildServer(opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	s.AdminHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/config", nil))
+	var config map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &config); err != nil {
+		t.Fatalf("Expected a JSON object, got %d %s", rec.Code, rec.Body)
+	}
+	if config["resolver"] != "192.0.2.53:53" || config["cache-size"] != "10000" {
+		t.Errorf("Expected the options in effect by their keys, got %v", config)
+	}
+	if config["cookie-secret"] != "REDACTED" || config["tsig-key"] != "" {
+		t.Errorf("Expected set secrets to be redacted, got %q and %q", config["cookie-secret"], config["tsig-key"])
+	}
+}
+
+func TestAdminListsTopDomains(t *testing.T) {
+	s := newTestServer(t, dnstest.StartUDPServer(t, answerA("192.0.2.1")).Addr)
+	s.QueryStats = NewQueryStats(0)
+	for _, name := range []string{"a.example", "b.example", "B.example.", "c.example", "c.example", "c.example"} {
+		handle(s, testQuery(name))
+	}
+	rec := httptest.NewRecorder()
+	s.AdminHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/top-domains?n=2", nil))
+	var top []NameCount
+	if err := json.Unmarshal(rec.Body.Bytes(), &top); err != nil {
+		t.Fatalf("Expected a JSON list, got %d %s", rec.Code, rec.Body)
+	}
+	want := []NameCount{{"c.example.", 3}, {"b.example.", 2}}
+	if len(top) != 2 || top[0] != want[0] || top[1] != want[1] {
+		t.Errorf("Expected %v, got %v", want, top)
+	}
+
+	rec = httptest.NewRecorder()
+	s.AdminHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/top?n=1", nil))
+	var report QueryReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Expected a JSON report, got %d %s", rec.Code, rec.Body)
+	}
+	if len(report.Clients) != 1 || report.Clients[0].Queries != 6 || len(report.Domains) != 1 || report.Domains[0] != (NameCount{"c.example.", 3}) {
+		t.Errorf("Expected the top client and domain, got %+v", report)
+	}
+
+	rec = httptest.NewRecorder()
+	s.AdminHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/top-domains?n=none", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid count to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestAdminPausesBlocking(t *testing.T) {
+	s := newTestServer(t, dnstest.StartUDPServer(t, answerA("192.0.2.1")).Addr)
+	s.Firewall = NewFirewall(NewFirewallStats(), writeBlocklist(t, "ads.txt", "ads.example\n"))
+	s.Modes = &Modes{}
+	admin := s.AdminHandler()
+
+	if resp := handle(s, testQuery("ads.example")); resp.RCode != dnsmessage.RCodeNameError {
+		t.Fatalf("Expected ads.example to be blocked, got %s", resp)
+	}
+	rec := httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest("DELETE", "/modes/blocking", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"blocking": false`) {
+		t.Fatalf("Expected blocking to be paused, got %d %s", rec.Code, rec.Body)
+	}
+	if resp := handle(s, testQuery("ads.example")); resp.RCode != dnsmessage.RCodeSuccess || len(resp.Answers) != 1 {
+		t.Errorf("Expected ads.example to resolve while blocking is paused, got %s", resp)
+	}
+	admin.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/modes/blocking", nil))
+	if resp := handle(s, testQuery("ads.example")); resp.RCode != dnsmessage.RCodeNameError {
+		t.Errorf("Expected ads.example to be blocked again, got %s", resp)
+	}
+}
+
+func TestAdminServesRuntimeDebugEndpoints(t *testing.T) {
+	cache := NewCache(10)
+	cache.Put(question("www.example.com", dnsmessage.TypeA), &dnsmessage.Message{Answers: []dnsmessage.Resource{aRecord("www.example.com", "192.0.2.1")}})
+	admin := (&Server{Cache: cache}).AdminHandler()
+
+	rec := httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/vars", nil))
+	var vars struct {
+		Runtime map[string]int `json:"runtime"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &vars); err != nil {
+		t.Fatalf("Expected the metrics in JSON, got %d %s", rec.Code, rec.Body)
+	}
+	if vars.Runtime["goroutines"] == 0 || vars.Runtime["cache_entries"] != 1 || vars.Runtime["queries_in_flight"] != 0 {
+		t.Errorf("Expected the runtime gauges of the server, got %v", vars.Runtime)
+	}
+
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/goroutine?debug=1", "/debug/pprof/heap", "/debug/pprof/cmdline"} {
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: expected a profile, got %d %s", path, rec.Code, rec.Body)
+		}
+	}
+}
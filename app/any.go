@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// AnyPolicy decides how queries for QTYPE ANY are answered over UDP, where
+// the complete answer mostly serves amplification attacks
+// (https://www.rfc-editor.org/rfc/rfc8482)
+type AnyPolicy string
+
+const (
+	// AnyFull answers with every RRset of the name
+	AnyFull AnyPolicy = "full"
+	// AnyHINFO answers names holding records with a single synthesized HINFO
+	// record, as https://www.rfc-editor.org/rfc/rfc8482#section-4.2 suggests
+	AnyHINFO AnyPolicy = "hinfo"
+	// AnyRRset answers with one of the RRsets of the name and its signatures
+	// (https://www.rfc-editor.org/rfc/rfc8482#section-4.1)
+	AnyRRset AnyPolicy = "rrset"
+)
+
+// ParseAnyPolicy validates an ANY policy name
+func ParseAnyPolicy(s string) (AnyPolicy, error) {
+	switch p := AnyPolicy(s); p {
+	case AnyFull, AnyHINFO, AnyRRset:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown ANY policy %q (expected full, hinfo or rrset)", s)
+}
+
+// minimize returns the answer to an ANY question reduced according to p.
+// Answers without records at the name, NXDOMAIN and NODATA, are left alone,
+// as are CNAME answers. resp may be cached, it is not modified.
+func (p AnyPolicy) minimize(question dnsmessage.Question, resp *dnsmessage.Message) *dnsmessage.Message {
+	if question.Type != dnsmessage.TypeANY || p == AnyFull || p == "" || resp.RCode != dnsmessage.RCodeSuccess {
+		return resp
+	}
+	name := canonicalName(question.Name)
+	var first *dnsmessage.Resource
+	for i := range resp.Answers {
+		rr := &resp.Answers[i]
+		if canonicalName(rr.Name) != name || rr.Type == dnsmessage.TypeRRSIG {
+			continue
+		}
+		if rr.Type == dnsmessage.TypeCNAME {
+			return resp
+		}
+		if first == nil {
+			first = rr
+		}
+	}
+	if first == nil {
+		return resp
+	}
+
+	minimized := *resp
+	minimized.Answers = nil
+	minimized.Additionals = nil
+	switch p {
+	case AnyHINFO:
+		hinfo := dnsmessage.Resource{Name: first.Name, Type: dnsmessage.TypeHINFO, Class: first.Class, TTL: first.TTL, Data: &dnsmessage.HINFO{CPU: "RFC8482"}}
+		for _, rr := range resp.Answers {
+			if canonicalName(rr.Name) == name {
+				hinfo.TTL = min(hinfo.TTL, rr.TTL)
+			}
+		}
+		minimized.Answers = []dnsmessage.Resource{hinfo}
+	case AnyRRset:
+		for _, rr := range resp.Answers {
+			if canonicalName(rr.Name) != name {
+				continue
+			}
+			if rr.Type == first.Type {
+				minimized.Answers = append(minimized.Answers, rr)
+			} else if sig, ok := rr.Data.(*dnsmessage.RRSIG); ok && sig.TypeCovered == first.Type {
+				minimized.Answers = append(minimized.Answers, rr)
+			}
+		}
+	}
+	return &minimized
+}
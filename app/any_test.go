@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+func TestAnyPolicy(t *testing.T) {
+	s := newTestServer(t, dnstest.StartUDPServer(t, func(query *dnsmessage.Message) *dnsmessage.Message {
+		resp := answerA("192.0.2.1")(query)
+		resp.Answers = append(resp.Answers,
+			aRecord(query.Questions[0].Name, "192.0.2.2"),
+			dnsmessage.Resource{Name: query.Questions[0].Name, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET, TTL: 30, Data: &dnsmessage.TXT{Text: []string{"v=spf1 -all"}}},
+		)
+		return resp
+	}).Addr)
+	query := func() *dnsmessage.Message {
+		q := testQuery("www.example")
+		q.Questions[0].Type = dnsmessage.TypeANY
+		return q
+	}
+
+	s.AnyPolicy = AnyHINFO
+	reply := handle(s, query())
+	if len(reply.Answers) != 1 || reply.Answers[0].Type != dnsmessage.TypeHINFO || reply.Answers[0].TTL != 30 {
+		t.Errorf("Expected a single HINFO record with the lowest TTL, got %s", reply)
+	}
+	tcp := s.Handle(context.Background(), &QueryContext{Client: testClient, Transport: "tcp", Query: query()})
+	if len(tcp.Answers) != 3 {
+		t.Errorf("Expected the full answer over TCP, got %s", tcp)
+	}
+
+	s.AnyPolicy = AnyRRset
+	reply = handle(s, query())
+	if len(reply.Answers) != 2 || reply.Answers[0].Type != dnsmessage.TypeA || reply.Answers[1].Type != dnsmessage.TypeA {
+		t.Errorf("Expected the A RRset alone, got %s", reply)
+	}
+
+	s.AnyPolicy = AnyFull
+	if reply = handle(s, query()); len(reply.Answers) != 3 {
+		t.Errorf("Expected every record, got %s", reply)
+	}
+}
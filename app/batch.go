@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// batchParallelism bounds the questions of a batch resolved at the same time
+const batchParallelism = 16
+
+// BatchResult is the outcome of one question of LookupBatch
+type BatchResult struct {
+	Question dnsmessage.Question
+	// Response holds the answer, nil when Err is set
+	Response *dnsmessage.Message
+	Err      error
+}
+
+// LookupBatch resolves many questions concurrently, for tools enumerating
+// names like certificate SAN checks or host discovery. The questions share the
+// deadline of ctx, questions asked more than once are resolved once and at
+// most batchParallelism are resolved at a time. Results are in the order of
+// questions. Questions are answered like those of a client allowed recursion.
+func (s *Server) LookupBatch(ctx context.Context, questions []dnsmessage.Question) []BatchResult {
+	srv := s.active()
+	results := make([]BatchResult, len(questions))
+	// first maps each distinct question to the index resolving it
+	first := make(map[cacheKey]int)
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, batchParallelism)
+	for i, q := range questions {
+		results[i].Question = q
+		normalized, err := normalizeQuestions([]dnsmessage.Question{q})
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		key := cacheKeyOf(normalized[0])
+		if _, ok := first[key]; ok {
+			continue
+		}
+		first[key] = i
+		wg.Add(1)
+		go func(i int, question dnsmessage.Question) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				results[i].Err = ctx.Err()
+				return
+			}
+			results[i].Response, results[i].Err = srv.lookupQuestion(ctx, question)
+		}(i, normalized[0])
+	}
+	wg.Wait()
+
+	for i, q := range questions {
+		if results[i].Response != nil || results[i].Err != nil {
+			continue
+		}
+		normalized, _ := normalizeQuestions([]dnsmessage.Question{q})
+		j := first[cacheKeyOf(normalized[0])]
+		// Each result has a response of its own, to be changed by the caller
+		results[i].Response, results[i].Err = copyMessage(results[j].Response), results[j].Err
+	}
+	return results
+}
+
+// lookupQuestion answers a single normalized question locally or by
+// resolving it, following CNAMEs like handle does
+func (s *Server) lookupQuestion(ctx context.Context, question dnsmessage.Question) (*dnsmessage.Message, error) {
+	resp := s.answerLocally(ctx, question)
+	if resp == nil {
+		var err error
+		if resp, err = s.resolve(ctx, question, true, nil); err != nil {
+			return nil, err
+		}
+	}
+	return s.chaseCNAMEs(ctx, question, resp, true, true, nil)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+func TestLookupBatch(t *testing.T) {
+	var queries atomic.Int32
+	s := newTestServer(t, dnstest.StartUDPServer(t, func(query *dnsmessage.Message) *dnsmessage.Message {
+		queries.Add(1)
+		return answerA("192.0.2.1")(query)
+	}).Addr)
+	questions := []dnsmessage.Question{
+		question("a.example", dnsmessage.TypeA),
+		question("b.example", dnsmessage.TypeA),
+		question("A.Example.", dnsmessage.TypeA),
+		question("bad..example", dnsmessage.TypeA),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	results := s.LookupBatch(ctx, questions)
+	if len(results) != len(questions) {
+		t.Fatalf("Expected %d results, got %d", len(questions), len(results))
+	}
+	for i, r := range results[:3] {
+		if r.Err != nil || len(r.Response.Answers) != 1 || r.Question != questions[i] {
+			t.Errorf("Question %d: expected an answer, got %+v", i, r)
+		}
+	}
+	if results[3].Err == nil {
+		t.Error("Expected an invalid name to fail")
+	}
+	if got := queries.Load(); got != 2 {
+		t.Errorf("Expected duplicate questions to be resolved once, got %d upstream queries", got)
+	}
+	if results[0].Response == results[2].Response {
+		t.Error("Expected duplicate questions to get responses of their own")
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// errOverBudget is returned for an upstream whose budget is spent, the query
+	// was not sent and the upstream is otherwise healthy
+	errOverBudget = errors.New("upstream budget exhausted")
+	// errBudgetExhausted is returned when every upstream is over its budget
+	errBudgetExhausted = errors.New("all upstream budgets exhausted")
+)
+
+// budgetMetrics counts queries not sent per upstream as <addr>.over
+var budgetMetrics = expvar.NewMap("upstream_budget")
+
+// tokenBucket earns rate tokens per second up to burst
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket creates a full bucket
+func newTokenBucket(rate, burst float64, now time.Time) tokenBucket {
+	return tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+// refill adds the tokens earned since the last refill
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.burst)
+	b.last = now
+}
+
+// Budget caps the queries per second and the bytes per second, both directions,
+// exchanged with an upstream. The buckets hold at most one second worth of
+// each, so short bursts are absorbed. Zero rates are unlimited.
+type Budget struct {
+	QPS       float64
+	Bandwidth float64
+
+	mu      sync.Mutex
+	queries tokenBucket
+	bytes   tokenBucket
+	now     func() time.Time
+}
+
+// NewBudget creates a full budget, it returns nil when both rates are unlimited
+func NewBudget(qps, bandwidth float64) *Budget {
+	if qps <= 0 && bandwidth <= 0 {
+		return nil
+	}
+	now := time.Now()
+	return &Budget{
+		QPS:       qps,
+		Bandwidth: bandwidth,
+		queries:   newTokenBucket(qps, max(qps, 1), now),
+		bytes:     newTokenBucket(bandwidth, bandwidth, now),
+		now:       time.Now,
+	}
+}
+
+// Allow spends a query if the budget has one left and bandwidth isn't overdrawn.
+// A nil budget always allows.
+func (b *Budget) Allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	b.queries.refill(now)
+	b.bytes.refill(now)
+	if b.QPS > 0 && b.queries.tokens < 1 {
+		return false
+	}
+	if b.Bandwidth > 0 && b.bytes.tokens <= 0 {
+		return false
+	}
+	if b.QPS > 0 {
+		b.queries.tokens--
+	}
+	return true
+}
+
+// Charge spends n bytes of bandwidth. Message sizes are only known once they
+// are exchanged, so the budget may be overdrawn and has to recover before the
+// next query is allowed.
+func (b *Budget) Charge(n int) {
+	if b == nil || b.Bandwidth <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bytes.tokens -= float64(n)
+}
+
+// upstreamLimits is a limit applying to every upstream with per upstream overrides
+type upstreamLimits struct {
+	Default float64
+	PerAddr map[string]float64
+}
+
+// parseUpstreamLimits parses a comma separated list of a default limit and
+// <ip>:<port>=<limit> overrides, e.g. "50,9.9.9.9:53=10"
+func parseUpstreamLimits(s string) (upstreamLimits, error) {
+	limits := upstreamLimits{PerAddr: make(map[string]float64)}
+	for _, item := range splitList(s) {
+		addr, value, override := strings.Cut(item, "=")
+		if !override {
+			value = addr
+		}
+		limit, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || limit < 0 {
+			return limits, fmt.Errorf("invalid limit %q", item)
+		}
+		if override {
+			limits.PerAddr[strings.TrimSpace(addr)] = limit
+		} else {
+			limits.Default = limit
+		}
+	}
+	return limits, nil
+}
+
+// For returns the limit of the upstream at addr
+func (l upstreamLimits) For(addr string) float64 {
+	if limit, ok := l.PerAddr[addr]; ok {
+		return limit
+	}
+	return l.Default
+}
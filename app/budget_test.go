@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+func newTestBudget(qps, bandwidth float64) (*Budget, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	b := NewBudget(qps, bandwidth)
+	b.now = clock.Now
+	b.queries.last, b.bytes.last = clock.now, clock.now
+	return b, clock
+}
+
+func TestBudgetQPS(t *testing.T) {
+	b, clock := newTestBudget(2, 0)
+	if !b.Allow() || !b.Allow() {
+		t.Fatal("Expected a burst of one second worth of queries")
+	}
+	if b.Allow() {
+		t.Fatal("Expected the third query within the second to be refused")
+	}
+	clock.Advance(500 * time.Millisecond)
+	if !b.Allow() || b.Allow() {
+		t.Error("Expected one query to be earned back after half a second")
+	}
+	clock.Advance(time.Hour)
+	if !b.Allow() || !b.Allow() || b.Allow() {
+		t.Error("Expected the burst to be capped at one second worth of queries")
+	}
+	var unlimited *Budget
+	if !unlimited.Allow() {
+		t.Error("Expected a nil budget to allow everything")
+	}
+}
+
+func TestBudgetBandwidth(t *testing.T) {
+	b, clock := newTestBudget(0, 1000)
+	if !b.Allow() {
+		t.Fatal("Expected the first query to be allowed")
+	}
+	b.Charge(1500)
+	if b.Allow() {
+		t.Fatal("Expected an overdrawn budget to refuse queries")
+	}
+	clock.Advance(time.Second)
+	if !b.Allow() {
+		t.Error("Expected the budget to recover once the overdraft is paid back")
+	}
+}
+
+func TestParseUpstreamLimits(t *testing.T) {
+	limits, err := parseUpstreamLimits("50, 9.9.9.9:53=10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits.For("1.1.1.1:53") != 50 || limits.For("9.9.9.9:53") != 10 {
+		t.Errorf("Unexpected limits %+v", limits)
+	}
+	if _, err := parseUpstreamLimits("9.9.9.9:53=fast"); err == nil {
+		t.Error("Expected an invalid limit to be rejected")
+	}
+}
+
+func TestForwarderSpillsOverBudget(t *testing.T) {
+	var limitedQueries atomic.Int32
+	limited := dnstest.StartUDPServer(t, func(q *dnsmessage.Message) *dnsmessage.Message {
+		limitedQueries.Add(1)
+		return answerA("192.0.2.1")(q)
+	}).Addr
+	spill := dnstest.StartUDPServer(t, answerA("192.0.2.2")).Addr
+	f, err := NewForwarder(limited + "," + spill)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Upstreams[0].Budget, _ = newTestBudget(1, 0)
+
+	for i, want := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.2"} {
+		resp, err := f.Exchange(context.Background(), testQuery("example.com"))
+		if err != nil {
+			t.Fatalf("Exchange %d failed: %v", i, err)
+		}
+		if got := resp.Answers[0].Data.String(); got != want {
+			t.Errorf("Exchange %d: expected %s, got %s", i, want, got)
+		}
+	}
+	if n := limitedQueries.Load(); n != 1 {
+		t.Errorf("Expected the limited upstream to get 1 query, got %d", n)
+	}
+	if !f.Upstreams[0].Health.Alive() {
+		t.Error("Being over budget must not count against the upstream health")
+	}
+
+	f.Upstreams[1].Budget, _ = newTestBudget(1, 0)
+	f.Upstreams[1].Budget.Allow()
+	if _, err := f.Exchange(context.Background(), testQuery("example.com")); !errors.Is(err, errBudgetExhausted) {
+		t.Errorf("Expected the exhausted budgets to be reported, got %v", err)
+	}
+}
+
+func TestServerServesStaleOverBudget(t *testing.T) {
+	s := newTestServer(t, dnstest.StartUDPServer(t, answerA("192.0.2.1")).Addr)
+	var clock *fakeClock
+	s.Cache, clock = newTestCache(10)
+	s.Cache.StaleFor = time.Hour
+	budget, budgetClock := newTestBudget(1, 0)
+	s.Forwarder.Upstreams[0].Budget = budget
+
+	if resp := handle(s, testQuery("example.com")); len(resp.Answers) != 1 {
+		t.Fatalf("Expected an answer to cache, got %s", resp)
+	}
+	// The answer has a TTL of 60 seconds and the budget is spent
+	clock.Advance(2 * time.Minute)
+	resp := handle(s, testQuery("example.com"))
+	if resp.RCode != dnsmessage.RCodeSuccess || len(resp.Answers) != 1 || resp.Answers[0].TTL != staleTTL {
+		t.Fatalf("Expected the stale answer with TTL %d, got %s", staleTTL, resp)
+	}
+
+	// Without budget and past the stale window there is nothing left to answer with
+	clock.Advance(2 * time.Hour)
+	if resp := handle(s, testQuery("example.com")); resp.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf("Expected SERVFAIL past the stale window, got %s", resp)
+	}
+
+	budgetClock.Advance(time.Second)
+	if resp := handle(s, testQuery("example.com")); len(resp.Answers) != 1 || resp.Answers[0].TTL != 60 {
+		t.Errorf("Expected a fresh answer once the budget recovered, got %s", resp)
+	}
+}
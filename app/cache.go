@@ -0,0 +1,493 @@
+package main
+
+import (
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// maxNegativeTTL caps how long negative answers are cached, the upper bound
+// suggested by https://www.rfc-editor.org/rfc/rfc2308#section-5
+const maxNegativeTTL = 3 * time.Hour
+
+// staleTTL is the TTL of stale answers, as recommended by
+// https://www.rfc-editor.org/rfc/rfc8767#section-4
+const staleTTL = 30
+
+// cacheKey identifies a cached response
+type cacheKey struct {
+	Name  string
+	Type  dnsmessage.Type
+	Class dnsmessage.Class
+	// Subnet is the client subnet of answers only valid for it, the zero
+	// prefix for answers valid for every client
+	Subnet netip.Prefix
+}
+
+func cacheKeyOf(q dnsmessage.Question) cacheKey {
+	return cacheKey{Name: strings.ToLower(q.Name), Type: q.Type, Class: q.Class}
+}
+
+// cacheEntry is a response stored in the cache. Negative entries (NXDOMAIN and
+// NODATA) have no answers and keep the SOA of the authority section, with the
+// DNSSEC records proving the denial.
+type cacheEntry struct {
+	RCode dnsmessage.RCode
+	// AuthenticData is set for responses the validator found secure
+	AuthenticData bool
+	Answers       []dnsmessage.Resource
+	Authorities   []dnsmessage.Resource
+	Additionals   []dnsmessage.Resource
+	Negative      bool
+	// Source is where the response came from, such as the upstream
+	Source  string
+	Stored  time.Time
+	Expires time.Time
+	// Hits counts the answers served from the entry
+	Hits int
+	// Prefetching is set once a refresh of the entry has been started
+	Prefetching bool
+	// size is the estimated memory of the entry, set when it is stored
+	size int
+}
+
+const (
+	// cacheEntryOverhead estimates the memory an entry takes besides its
+	// records: the entry, its key and their share of the map and the policy
+	cacheEntryOverhead = 256
+	// cacheRecordOverhead estimates the memory a record takes besides its
+	// owner name and wire form
+	cacheRecordOverhead = 64
+)
+
+// Cache stores upstream responses keyed by (name, type, class) for their TTL
+type Cache struct {
+	mu         sync.Mutex
+	entries    map[cacheKey]*cacheEntry
+	maxEntries int
+	policy     EvictionPolicy
+	now        func() time.Time
+
+	// StaleFor keeps expired entries around for that long so they can be
+	// served by GetStale when the upstreams can't be asked, 0 disables it
+	StaleFor time.Duration
+	// PrefetchHits makes entries answered that many times refreshed shortly
+	// before they expire, see prefetchDue. 0 disables prefetching.
+	PrefetchHits int
+	// MaxBytes bounds the estimated memory of the entries, beyond it the
+	// entries chosen by the policy are evicted. 0 leaves it unbounded.
+	MaxBytes int
+	// Hooks observe the cache, set them before it is used
+	Hooks CacheHooks
+
+	// bytes is the estimated memory of the entries
+	bytes int
+	// sweepEvery is the interval of the janitor, done stops it
+	sweepEvery time.Duration
+	done       chan struct{}
+	once       sync.Once
+}
+
+// NewCache creates a cache holding at most maxEntries responses, evicting the
+// entries expiring first when it is full
+func NewCache(maxEntries int) *Cache {
+	policy, _ := NewEvictionPolicy("ttl")
+	return NewCacheWithPolicy(maxEntries, policy)
+}
+
+// NewCacheWithPolicy creates a cache holding at most maxEntries responses,
+// policy chooses the entries to evict when it is full
+func NewCacheWithPolicy(maxEntries int, policy EvictionPolicy) *Cache {
+	return &Cache{
+		entries:    make(map[cacheKey]*cacheEntry),
+		maxEntries: maxEntries,
+		policy:     policy,
+		now:        time.Now,
+	}
+}
+
+// Policy returns the name of the eviction policy
+func (c *Cache) Policy() string {
+	return c.policy.Name()
+}
+
+// Len returns the number of entries, including expired ones not yet removed
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// Bytes returns the estimated memory of the entries
+func (c *Cache) Bytes() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bytes
+}
+
+// startJanitor removes the entries expired for longer than StaleFor every
+// interval until Close. Without it they are only removed when asked for or
+// to make room, and a cache of names never asked again keeps its memory.
+func (c *Cache) startJanitor(interval time.Duration) {
+	c.sweepEvery, c.done = interval, make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.sweep()
+			case <-c.done:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the janitor
+func (c *Cache) Close() {
+	if c != nil && c.done != nil {
+		c.once.Do(func() { close(c.done) })
+	}
+}
+
+// sweep removes the entries expired for longer than StaleFor and returns how
+// many it removed
+func (c *Cache) sweep() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	removed := 0
+	for key, entry := range c.entries {
+		if !now.Before(entry.Expires.Add(c.StaleFor)) {
+			c.removeLocked(key)
+			if c.Hooks.Expire != nil {
+				c.Hooks.Expire(key)
+			}
+			removed++
+		}
+	}
+	return removed
+}
+
+// Flush removes the entries for name, every type, class and subnet, or all of
+// them when name is empty, and returns how many it removed
+func (c *Cache) Flush(name string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	all := name == ""
+	name = canonicalName(name)
+	removed := 0
+	for key := range c.entries {
+		if all || key.Name == name {
+			c.removeLocked(key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// CacheSummary counts the entries of a cache by kind
+type CacheSummary struct {
+	Entries    int    `json:"entries"`
+	MaxEntries int    `json:"max_entries"`
+	Bytes      int    `json:"bytes"`
+	MaxBytes   int    `json:"max_bytes"`
+	Policy     string `json:"policy"`
+	Positive   int    `json:"positive"`
+	Negative   int    `json:"negative"`
+	// Expired entries are only kept to be served stale
+	Expired int `json:"expired"`
+}
+
+// Summary counts the entries of the cache
+func (c *Cache) Summary() CacheSummary {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	summary := CacheSummary{Entries: len(c.entries), MaxEntries: c.maxEntries, Bytes: c.bytes, MaxBytes: c.MaxBytes, Policy: c.policy.Name()}
+	now := c.now()
+	for _, entry := range c.entries {
+		switch {
+		case !now.Before(entry.Expires):
+			summary.Expired++
+		case entry.Negative:
+			summary.Negative++
+		default:
+			summary.Positive++
+		}
+	}
+	return summary
+}
+
+// Get returns the cached response for q with TTLs decreased by the time spent in the cache
+func (c *Cache) Get(q dnsmessage.Question) (*dnsmessage.Message, bool) {
+	resp, _, ok := c.GetFor(q, netip.Prefix{})
+	return resp, ok
+}
+
+// GetFor returns the cached response for q asked on behalf of the clients in
+// subnet: one stored for the subnet or a network containing it, or one valid
+// for every client. source is where the response was stored from.
+func (c *Cache) GetFor(q dnsmessage.Question, subnet netip.Prefix) (resp *dnsmessage.Message, source string, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := cacheKeyOf(q)
+	for bits := subnet.Bits(); subnet.IsValid() && bits > 0; bits-- {
+		scoped := key
+		scoped.Subnet = netip.PrefixFrom(subnet.Addr(), bits).Masked()
+		if resp, source, ok := c.getLocked(scoped); ok {
+			return resp, source, true
+		}
+	}
+	if resp, source, ok = c.getLocked(key); !ok {
+		c.miss(key)
+	}
+	return resp, source, ok
+}
+
+func (c *Cache) getLocked(key cacheKey) (*dnsmessage.Message, string, bool) {
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, "", false
+	}
+	now := c.now()
+	if !now.Before(entry.Expires) {
+		if !now.Before(entry.Expires.Add(c.StaleFor)) {
+			c.removeLocked(key)
+		}
+		return nil, "", false
+	}
+
+	c.policy.Accessed(key)
+	entry.Hits++
+	if c.Hooks.Hit != nil {
+		c.Hooks.Hit(key)
+	}
+	elapsed := uint32(now.Sub(entry.Stored) / time.Second)
+	return entry.message(elapsed), entry.Source, true
+}
+
+// GetStale returns an expired response for q that is still within StaleFor,
+// with every TTL set to staleTTL. Fresh entries are returned by Get instead.
+func (c *Cache) GetStale(q dnsmessage.Question) (*dnsmessage.Message, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[cacheKeyOf(q)]
+	if !ok {
+		return nil, false
+	}
+	now := c.now()
+	if now.Before(entry.Expires) || !now.Before(entry.Expires.Add(c.StaleFor)) {
+		return nil, false
+	}
+	resp := entry.message(0)
+	for _, section := range [][]dnsmessage.Resource{resp.Answers, resp.Authorities, resp.Additionals} {
+		for i := range section {
+			section[i].TTL = staleTTL
+		}
+	}
+	return resp, true
+}
+
+// message builds the response of the entry with TTLs decreased by elapsed seconds
+func (e *cacheEntry) message(elapsed uint32) *dnsmessage.Message {
+	return &dnsmessage.Message{
+		Header:      dnsmessage.Header{Response: true, RCode: e.RCode, AuthenticData: e.AuthenticData},
+		Answers:     agedRecords(e.Answers, elapsed),
+		Authorities: agedRecords(e.Authorities, elapsed),
+		Additionals: agedRecords(e.Additionals, elapsed),
+	}
+}
+
+func agedRecords(records []dnsmessage.Resource, elapsed uint32) []dnsmessage.Resource {
+	if len(records) == 0 {
+		return nil
+	}
+	aged := make([]dnsmessage.Resource, len(records))
+	for i, r := range records {
+		if r.TTL > elapsed {
+			r.TTL -= elapsed
+		} else {
+			r.TTL = 0
+		}
+		aged[i] = r
+	}
+	return aged
+}
+
+// Put stores resp as the answer to q. Responses that can't be cached, such as
+// server failures or negative answers without an SOA, are ignored.
+func (c *Cache) Put(q dnsmessage.Question, resp *dnsmessage.Message) {
+	c.PutFor(q, netip.Prefix{}, "", resp)
+}
+
+// PutFor stores resp as the answer to q for the clients in subnet only, or for
+// every client with the zero prefix. source tells where resp came from.
+func (c *Cache) PutFor(q dnsmessage.Question, subnet netip.Prefix, source string, resp *dnsmessage.Message) {
+	if c.maxEntries <= 0 || resp.Truncated {
+		return
+	}
+	ttl, negative, ok := cacheTTL(resp)
+	if !ok || ttl <= 0 {
+		return
+	}
+
+	now := c.now()
+	entry := &cacheEntry{
+		RCode:         resp.RCode,
+		AuthenticData: resp.AuthenticData,
+		Answers:       resp.Answers,
+		Negative:      negative,
+		Source:        source,
+		Stored:        now,
+		Expires:       now.Add(ttl),
+	}
+	if negative {
+		// Only the SOA is needed to answer negatively (https://www.rfc-editor.org/rfc/rfc2308#section-6),
+		// its TTL and that of the proofs can't outlive the entry
+		for _, r := range resp.Authorities {
+			if t := coveredType(r); t == dnsmessage.TypeSOA || t == dnsmessage.TypeNSEC || t == dnsmessage.TypeNSEC3 {
+				r.TTL = min(r.TTL, uint32(ttl/time.Second))
+				entry.Authorities = append(entry.Authorities, r)
+			}
+		}
+	} else {
+		entry.Authorities = resp.Authorities
+		for _, r := range resp.Additionals {
+			if r.Type != dnsmessage.TypeOPT {
+				entry.Additionals = append(entry.Additionals, r)
+			}
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := cacheKeyOf(q)
+	key.Subnet = subnet
+	c.storeLocked(key, entry, now)
+}
+
+func (c *Cache) miss(key cacheKey) {
+	if c.Hooks.Miss != nil {
+		c.Hooks.Miss(key)
+	}
+}
+
+// storeLocked adds or replaces the entry under key, evicting entries while
+// the cache is full or over MaxBytes. Entries larger than MaxBytes on their
+// own are not stored.
+func (c *Cache) storeLocked(key cacheKey, entry *cacheEntry, now time.Time) {
+	entry.size = entrySize(key, entry)
+	if c.MaxBytes > 0 && entry.size > c.MaxBytes {
+		return
+	}
+	if old, exists := c.entries[key]; exists {
+		c.bytes -= old.size
+	} else if len(c.entries) >= c.maxEntries {
+		c.evictLocked(now)
+	}
+	c.entries[key] = entry
+	c.bytes += entry.size
+	c.policy.Added(key, entry)
+	for c.MaxBytes > 0 && c.bytes > c.MaxBytes && c.evictLocked(now) {
+	}
+}
+
+func (c *Cache) removeLocked(key cacheKey) {
+	if entry, ok := c.entries[key]; ok {
+		c.bytes -= entry.size
+	}
+	delete(c.entries, key)
+	c.policy.Removed(key)
+}
+
+// evictLocked makes room for a new entry, preferring expired ones over the
+// victim of the policy, and reports whether it evicted one
+func (c *Cache) evictLocked(now time.Time) bool {
+	for key, entry := range c.entries {
+		if !now.Before(entry.Expires) {
+			c.removeLocked(key)
+			if c.Hooks.Evict != nil {
+				c.Hooks.Evict(key, true)
+			}
+			return true
+		}
+	}
+	victim, ok := c.policy.Victim()
+	if !ok {
+		return false
+	}
+	c.removeLocked(victim)
+	if c.Hooks.Evict != nil {
+		c.Hooks.Evict(victim, false)
+	}
+	return true
+}
+
+// entrySize estimates the memory entry takes under key from the wire form of
+// its records
+func entrySize(key cacheKey, entry *cacheEntry) int {
+	size := cacheEntryOverhead + len(key.Name) + len(entry.Source)
+	records := &dnsmessage.Message{Answers: entry.Answers, Authorities: entry.Authorities, Additionals: entry.Additionals}
+	for _, section := range [...][]dnsmessage.Resource{entry.Answers, entry.Authorities, entry.Additionals} {
+		for _, rr := range section {
+			size += cacheRecordOverhead + len(rr.Name)
+		}
+	}
+	buf := replyBuffers.Get().(*[]byte)
+	defer replyBuffers.Put(buf)
+	if wire, err := records.AppendTo((*buf)[:0]); err == nil {
+		size += len(wire)
+	}
+	return size
+}
+
+// cacheTTL returns how long resp may be cached and whether it is a negative answer
+func cacheTTL(resp *dnsmessage.Message) (time.Duration, bool, bool) {
+	switch resp.RCode {
+	case dnsmessage.RCodeSuccess:
+		if len(resp.Answers) == 0 {
+			ttl, ok := negativeTTL(resp)
+			return ttl, true, ok
+		}
+		minTTL := resp.Answers[0].TTL
+		for _, r := range resp.Answers[1:] {
+			minTTL = min(minTTL, r.TTL)
+		}
+		return time.Duration(minTTL) * time.Second, false, true
+	case dnsmessage.RCodeNameError:
+		ttl, ok := negativeTTL(resp)
+		return ttl, true, ok
+	}
+	return 0, false, false
+}
+
+// negativeTTL derives the negative caching TTL from the SOA in the authority
+// section: the minimum of the SOA TTL and its MINIMUM field. Without an SOA the
+// answer must not be cached (https://www.rfc-editor.org/rfc/rfc2308#section-5).
+func negativeTTL(resp *dnsmessage.Message) (time.Duration, bool) {
+	for _, r := range resp.Authorities {
+		soa, ok := r.Data.(*dnsmessage.SOA)
+		if !ok {
+			continue
+		}
+		ttl := time.Duration(min(r.TTL, soa.Minimum)) * time.Second
+		return min(ttl, maxNegativeTTL), true
+	}
+	return 0, false
+}
+
+// negativeSOA returns the SOA record rr as it goes into negative answers, with
+// its TTL capped by its MINIMUM field so that is how long they are cached
+// (https://www.rfc-editor.org/rfc/rfc2308#section-3)
+func negativeSOA(rr dnsmessage.Resource) dnsmessage.Resource {
+	if soa, ok := rr.Data.(*dnsmessage.SOA); ok {
+		rr.TTL = min(rr.TTL, soa.Minimum)
+	}
+	return rr
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+// fakeClock is a controllable time source for TTL tests
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func newTestCache(maxEntries int) (*Cache, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	c := NewCache(maxEntries)
+	c.now = clock.Now
+	return c, clock
+}
+
+func soaRecord(zone string, ttl, minimum uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Name: zone, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: ttl,
+		Data: &dnsmessage.SOA{MName: "ns." + zone, RName: "hostmaster." + zone, Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400, Minimum: minimum},
+	}
+}
+
+func question(name string, t dnsmessage.Type) dnsmessage.Question {
+	return dnsmessage.Question{Name: name, Type: t, Class: dnsmessage.ClassINET}
+}
+
+func TestCachePositiveAging(t *testing.T) {
+	c, clock := newTestCache(10)
+	q := question("www.example.com", dnsmessage.TypeA)
+	c.Put(q, &dnsmessage.Message{Answers: []dnsmessage.Resource{
+		{Name: "www.example.com", Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60, Data: &dnsmessage.A{Addr: netip.MustParseAddr("192.0.2.1")}},
+	}})
+
+	clock.Advance(20 * time.Second)
+	resp, ok := c.Get(question("WWW.Example.com", dnsmessage.TypeA))
+	if !ok {
+		t.Fatal("Expected a case insensitive cache hit")
+	}
+	if resp.Answers[0].TTL != 40 {
+		t.Errorf("Expected TTL to be aged to 40, got %d", resp.Answers[0].TTL)
+	}
+
+	clock.Advance(40 * time.Second)
+	if _, ok := c.Get(q); ok {
+		t.Error("Expected entry to expire with its TTL")
+	}
+}
+
+func TestCacheNegative(t *testing.T) {
+	c, clock := newTestCache(10)
+
+	nx := question("nope.example.com", dnsmessage.TypeA)
+	c.Put(nx, &dnsmessage.Message{
+		Header:      dnsmessage.Header{RCode: dnsmessage.RCodeNameError},
+		Authorities: []dnsmessage.Resource{soaRecord("example.com", 3600, 300)},
+	})
+	nodata := question("www.example.com", dnsmessage.TypeAAAA)
+	c.Put(nodata, &dnsmessage.Message{
+		Authorities: []dnsmessage.Resource{soaRecord("example.com", 120, 900)},
+	})
+	noSOA := question("other.example.com", dnsmessage.TypeA)
+	c.Put(noSOA, &dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeNameError}})
+	servfail := question("broken.example.com", dnsmessage.TypeA)
+	c.Put(servfail, &dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeServerFailure}})
+
+	resp, ok := c.Get(nx)
+	if !ok || resp.RCode != dnsmessage.RCodeNameError || len(resp.Authorities) != 1 {
+		t.Fatalf("Expected cached NXDOMAIN with SOA, got %v %+v", ok, resp)
+	}
+	if resp, ok := c.Get(nodata); !ok || resp.RCode != dnsmessage.RCodeSuccess || len(resp.Answers) != 0 {
+		t.Fatalf("Expected cached NODATA, got %v %+v", ok, resp)
+	}
+	if _, ok := c.Get(noSOA); ok {
+		t.Error("Negative answers without SOA must not be cached")
+	}
+	if _, ok := c.Get(servfail); ok {
+		t.Error("SERVFAIL must not be cached")
+	}
+
+	// NODATA is bounded by the SOA TTL (120), NXDOMAIN by the SOA MINIMUM (300)
+	clock.Advance(121 * time.Second)
+	if _, ok := c.Get(nodata); ok {
+		t.Error("Expected NODATA to expire after the SOA TTL")
+	}
+	// The SOA TTL is capped by the negative TTL so clients don't cache longer
+	if resp, ok := c.Get(nx); !ok || resp.Authorities[0].TTL != 300-121 {
+		t.Errorf("Expected NXDOMAIN to still be cached with an aged and capped SOA, got %v %+v", ok, resp)
+	}
+	clock.Advance(180 * time.Second)
+	if _, ok := c.Get(nx); ok {
+		t.Error("Expected NXDOMAIN to expire after the SOA MINIMUM")
+	}
+}
+
+func TestCacheEvictsWhenFull(t *testing.T) {
+	c, _ := newTestCache(2)
+	for i, name := range []string{"a.example", "b.example", "c.example"} {
+		c.Put(question(name, dnsmessage.TypeA), &dnsmessage.Message{Answers: []dnsmessage.Resource{
+			{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: uint32(100 + i), Data: &dnsmessage.A{Addr: netip.MustParseAddr("192.0.2.1")}},
+		}})
+	}
+	if c.Len() != 2 {
+		t.Fatalf("Expected cache to be capped at 2 entries, got %d", c.Len())
+	}
+	if _, ok := c.Get(question("a.example", dnsmessage.TypeA)); ok {
+		t.Error("Expected the entry expiring soonest to be evicted")
+	}
+}
+
+func TestServerAnswersNXDOMAINFromCache(t *testing.T) {
+	var queries atomic.Int32
+	upstream := dnstest.StartUDPServer(t, func(q *dnsmessage.Message) *dnsmessage.Message {
+		queries.Add(1)
+		return &dnsmessage.Message{
+			Header:      dnsmessage.Header{ID: q.ID, Response: true, RCode: dnsmessage.RCodeNameError},
+			Questions:   q.Questions,
+			Authorities: []dnsmessage.Resource{soaRecord("example.com", 3600, 300)},
+		}
+	}).Addr
+	s := newTestServer(t, upstream)
+	s.Cache = NewCache(10)
+
+	for i := 0; i < 3; i++ {
+		resp := handle(s, testQuery("missing.example.com"))
+		if resp.RCode != dnsmessage.RCodeNameError || len(resp.Authorities) != 1 {
+			t.Fatalf("Expected NXDOMAIN with SOA, got %s", resp)
+		}
+	}
+	if n := queries.Load(); n != 1 {
+		t.Errorf("Expected a single upstream query, got %d", n)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const cacheUsage = "usage: cache export|import [-admin <ip>:<port>] [file]"
+
+// runCache implements the cache subcommand. It exports the cache of a running
+// server to a file or imports one into it through the admin API. The file
+// defaults to standard output and input.
+func runCache(args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(cacheUsage)
+	}
+	action := args[0]
+	fs := flag.NewFlagSet("cache "+action, flag.ContinueOnError)
+	admin := fs.String("admin", "127.0.0.1:8053", "Address of the admin API of the server")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return errors.New(cacheUsage)
+	}
+	file := fs.Arg(0)
+	client := &http.Client{Timeout: time.Minute}
+	url := "http://" + *admin + "/cache/" + action
+
+	switch action {
+	case "export":
+		resp, err := client.Get(url)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if err := adminError(resp); err != nil {
+			return err
+		}
+		out := stdout
+		if file != "" && file != "-" {
+			f, err := os.Create(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			out = f
+		}
+		_, err = io.Copy(out, resp.Body)
+		return err
+	case "import":
+		in := stdin
+		if file != "" && file != "-" {
+			f, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			in = f
+		}
+		resp, err := client.Post(url, "application/x-ndjson", in)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if err := adminError(resp); err != nil {
+			return err
+		}
+		_, err = io.Copy(stdout, resp.Body)
+		return err
+	}
+	return errors.New(cacheUsage)
+}
+
+// adminError turns an unsuccessful admin API response into an error
+func adminError(resp *http.Response) error {
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("admin API: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
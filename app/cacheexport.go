@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// cacheLine is a cache entry in the export format. An export holds one JSON
+// object per line, ordered by name, type, class and subnet:
+//
+//	{"name":"example.com.","type":"A","class":"IN","rcode":"NOERROR","expires":"2024-05-01T12:00:00Z",
+//	 "answers":[{"name":"example.com.","type":"A","class":"IN","expires":"2024-05-01T12:00:00Z","data":["192.0.2.1"]}]}
+//
+// Expiry times are absolute so an export can be imported later or on another
+// instance, TTLs are derived from them on import. Record data uses the master
+// file presentation format. Answers only valid for some clients name their
+// subnet, the source is where the answer was cached from.
+type cacheLine struct {
+	Name        string       `json:"name"`
+	Type        string       `json:"type"`
+	Class       string       `json:"class"`
+	Subnet      string       `json:"subnet,omitempty"`
+	RCode       string       `json:"rcode"`
+	Negative    bool         `json:"negative,omitempty"`
+	Source      string       `json:"source,omitempty"`
+	Expires     time.Time    `json:"expires"`
+	Answers     []cacheRRset `json:"answers,omitempty"`
+	Authorities []cacheRRset `json:"authorities,omitempty"`
+	Additionals []cacheRRset `json:"additionals,omitempty"`
+}
+
+// cacheRRset is a set of records sharing owner, type and class in the export format
+type cacheRRset struct {
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	Class   string    `json:"class"`
+	Expires time.Time `json:"expires"`
+	Data    []string  `json:"data"`
+}
+
+// Export writes the unexpired entries in the export format and returns how many it wrote
+func (c *Cache) Export(w io.Writer) (int, error) {
+	c.mu.Lock()
+	now := c.now()
+	var lines []cacheLine
+	for key, entry := range c.entries {
+		if now.Before(entry.Expires) {
+			lines = append(lines, exportEntry(key, entry))
+		}
+	}
+	c.mu.Unlock()
+
+	sort.Slice(lines, func(i, j int) bool {
+		a, b := lines[i], lines[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		if a.Class != b.Class {
+			return a.Class < b.Class
+		}
+		return a.Subnet < b.Subnet
+	})
+	enc := json.NewEncoder(w)
+	for i, line := range lines {
+		if err := enc.Encode(line); err != nil {
+			return i, err
+		}
+	}
+	return len(lines), nil
+}
+
+// subnetString formats the subnet of a cache key, empty when there is none
+func subnetString(subnet netip.Prefix) string {
+	if !subnet.IsValid() {
+		return ""
+	}
+	return subnet.String()
+}
+
+func exportEntry(key cacheKey, entry *cacheEntry) cacheLine {
+	return cacheLine{
+		Name:        dnsmessage.FQDN(key.Name),
+		Type:        key.Type.String(),
+		Class:       key.Class.String(),
+		Subnet:      subnetString(key.Subnet),
+		RCode:       entry.RCode.String(),
+		Negative:    entry.Negative,
+		Source:      entry.Source,
+		Expires:     entry.Expires.UTC(),
+		Answers:     exportRRsets(entry.Answers, entry.Stored),
+		Authorities: exportRRsets(entry.Authorities, entry.Stored),
+		Additionals: exportRRsets(entry.Additionals, entry.Stored),
+	}
+}
+
+// exportRRsets groups records into RRsets expiring at their TTL after stored
+func exportRRsets(records []dnsmessage.Resource, stored time.Time) []cacheRRset {
+	var sets []cacheRRset
+	index := make(map[rrsetKey]int)
+	for i := range records {
+		r := &records[i]
+		key := keyOf(r)
+		i, ok := index[key]
+		if !ok {
+			i = len(sets)
+			index[key] = i
+			sets = append(sets, cacheRRset{
+				Name:    dnsmessage.FQDN(r.Name),
+				Type:    r.Type.String(),
+				Class:   r.Class.String(),
+				Expires: stored.Add(time.Duration(r.TTL) * time.Second).UTC(),
+			})
+		}
+		sets[i].Data = append(sets[i].Data, r.Data.String())
+	}
+	return sets
+}
+
+// Import adds the entries of an export that have not expired yet, replacing
+// entries for the same question, and returns how many it added. Nothing is
+// added when the export is invalid.
+func (c *Cache) Import(r io.Reader) (int, error) {
+	if c.maxEntries <= 0 {
+		return 0, nil
+	}
+	now := c.now()
+	type imported struct {
+		key   cacheKey
+		entry *cacheEntry
+	}
+	var entries []imported
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var line cacheLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return 0, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		key, entry, err := importEntry(line, now)
+		if err != nil {
+			return 0, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		if now.Before(entry.Expires) {
+			entries = append(entries, imported{key, entry})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range entries {
+		c.storeLocked(e.key, e.entry, now)
+	}
+	return len(entries), nil
+}
+
+func importEntry(line cacheLine, now time.Time) (cacheKey, *cacheEntry, error) {
+	var key cacheKey
+	var err error
+	key.Name = canonicalName(line.Name)
+	if key.Type, err = dnsmessage.ParseType(line.Type); err != nil {
+		return key, nil, err
+	}
+	if key.Class, err = dnsmessage.ParseClass(line.Class); err != nil {
+		return key, nil, err
+	}
+	if line.Subnet != "" {
+		if key.Subnet, err = netip.ParsePrefix(line.Subnet); err != nil {
+			return key, nil, err
+		}
+	}
+	entry := &cacheEntry{Negative: line.Negative, Source: line.Source, Stored: now, Expires: line.Expires}
+	if entry.RCode, err = dnsmessage.ParseRCode(line.RCode); err != nil {
+		return key, nil, err
+	}
+	if entry.Answers, err = importRRsets(line.Answers, now); err != nil {
+		return key, nil, err
+	}
+	if entry.Authorities, err = importRRsets(line.Authorities, now); err != nil {
+		return key, nil, err
+	}
+	if entry.Additionals, err = importRRsets(line.Additionals, now); err != nil {
+		return key, nil, err
+	}
+	return key, entry, nil
+}
+
+// importRRsets converts exported RRsets to records with the TTL left until they expire
+func importRRsets(sets []cacheRRset, now time.Time) ([]dnsmessage.Resource, error) {
+	var records []dnsmessage.Resource
+	for _, set := range sets {
+		t, err := dnsmessage.ParseType(set.Type)
+		if err != nil {
+			return nil, err
+		}
+		class, err := dnsmessage.ParseClass(set.Class)
+		if err != nil {
+			return nil, err
+		}
+		var ttl uint32
+		if left := set.Expires.Sub(now); left > 0 {
+			ttl = uint32((left + time.Second - 1) / time.Second)
+		}
+		name := set.Name
+		if name != dnsmessage.Root {
+			name = strings.TrimSuffix(name, ".")
+		}
+		for _, text := range set.Data {
+			data, err := dnsmessage.ParseRData(t, text)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: %w", set.Name, set.Type, err)
+			}
+			records = append(records, dnsmessage.Resource{Name: name, Type: t, Class: class, TTL: ttl, Data: data})
+		}
+	}
+	return records, nil
+}
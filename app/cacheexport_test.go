@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+func TestCacheExportImport(t *testing.T) {
+	src, clock := newTestCache(10)
+	a := question("www.example.com", dnsmessage.TypeA)
+	src.Put(a, &dnsmessage.Message{Answers: []dnsmessage.Resource{
+		{Name: "www.example.com", Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60, Data: &dnsmessage.A{Addr: netip.MustParseAddr("192.0.2.1")}},
+		{Name: "www.example.com", Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60, Data: &dnsmessage.A{Addr: netip.MustParseAddr("192.0.2.2")}},
+	}})
+	nx := question("nope.example.com", dnsmessage.TypeA)
+	src.Put(nx, &dnsmessage.Message{
+		Header:      dnsmessage.Header{RCode: dnsmessage.RCodeNameError},
+		Authorities: []dnsmessage.Resource{soaRecord("example.com", 3600, 300)},
+	})
+	short := question("short.example.com", dnsmessage.TypeTXT)
+	src.Put(short, &dnsmessage.Message{Answers: []dnsmessage.Resource{
+		{Name: "short.example.com", Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET, TTL: 25, Data: &dnsmessage.TXT{Text: []string{"soon gone"}}},
+	}})
+
+	clock.Advance(10 * time.Second)
+	var export bytes.Buffer
+	n, err := src.Export(&export)
+	if err != nil || n != 3 {
+		t.Fatalf("Expected 3 exported entries, got %d, %v", n, err)
+	}
+	lines := strings.Split(strings.TrimSpace(export.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], `{"name":"nope.example.com.","type":"A","class":"IN","rcode":"NXDOMAIN","negative":true`) {
+		t.Fatalf("Expected one line per entry ordered by name, got:\n%s", export.String())
+	}
+
+	// Importing 20 seconds after the export ages the answers by that time too
+	dst, dstClock := newTestCache(10)
+	dstClock.now = clock.now.Add(20 * time.Second)
+	n, err = dst.Import(&export)
+	if err != nil || n != 2 {
+		t.Fatalf("Expected 2 imported entries, got %d, %v", n, err)
+	}
+	resp, ok := dst.Get(a)
+	if !ok || len(resp.Answers) != 2 || resp.Answers[0].TTL != 30 {
+		t.Fatalf("Expected both A records with 30s left, got %v %+v", ok, resp)
+	}
+	if got := resp.Answers[1].Data.String(); got != "192.0.2.2" {
+		t.Errorf("Expected the record data to survive the round trip, got %s", got)
+	}
+	resp, ok = dst.Get(nx)
+	if !ok || resp.RCode != dnsmessage.RCodeNameError || len(resp.Authorities) != 1 {
+		t.Fatalf("Expected the negative entry with its SOA, got %v %+v", ok, resp)
+	}
+	if _, ok := dst.Get(short); ok {
+		t.Error("Expected entries expired before the import to be skipped")
+	}
+}
+
+func TestCacheImportRejectsInvalidExports(t *testing.T) {
+	for _, export := range []string{
+		"not json",
+		`{"name":"a.example.","type":"BOGUS","class":"IN","rcode":"NOERROR","expires":"2030-01-01T00:00:00Z"}`,
+		`{"name":"a.example.","type":"A","class":"IN","rcode":"NOERROR","expires":"2030-01-01T00:00:00Z","answers":[{"name":"a.example.","type":"A","class":"IN","expires":"2030-01-01T00:00:00Z","data":["not an address"]}]}`,
+	} {
+		c, _ := newTestCache(10)
+		valid := `{"name":"b.example.","type":"A","class":"IN","rcode":"NOERROR","expires":"2030-01-01T00:00:00Z"}`
+		if _, err := c.Import(strings.NewReader(valid + "\n" + export + "\n")); err == nil {
+			t.Errorf("Expected %q to be rejected", export)
+		}
+		if _, ok := c.Get(question("b.example", dnsmessage.TypeA)); ok {
+			t.Errorf("Expected nothing to be imported from %q", export)
+		}
+	}
+}
+
+func TestCacheCommand(t *testing.T) {
+	src, _ := newTestCache(10)
+	src.now = time.Now
+	q := question("www.example.com", dnsmessage.TypeA)
+	src.Put(q, &dnsmessage.Message{Answers: []dnsmessage.Resource{
+		{Name: "www.example.com", Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300, Data: &dnsmessage.A{Addr: netip.MustParseAddr("192.0.2.1")}},
+	}})
+	srcAdmin := httptest.NewServer((&Server{Cache: src}).AdminHandler())
+	defer srcAdmin.Close()
+	dst := NewCache(10)
+	dstAdmin := httptest.NewServer((&Server{Cache: dst}).AdminHandler())
+	defer dstAdmin.Close()
+
+	file := filepath.Join(t.TempDir(), "cache.jsonl")
+	var out bytes.Buffer
+	if err := runCache([]string{"export", "-admin", strings.TrimPrefix(srcAdmin.URL, "http://"), file}, nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(file); !strings.Contains(string(data), `"data":["192.0.2.1"]`) {
+		t.Fatalf("Expected the export in %s, got %s", file, data)
+	}
+	if err := runCache([]string{"import", "-admin", strings.TrimPrefix(dstAdmin.URL, "http://"), file}, nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `"imported": 1`) {
+		t.Errorf("Expected the import to report one entry, got %s", out.String())
+	}
+	if _, ok := dst.Get(q); !ok {
+		t.Error("Expected the entry to be imported into the other server")
+	}
+
+	err := runCache([]string{"import", "-admin", strings.TrimPrefix(dstAdmin.URL, "http://"), "-"}, strings.NewReader("garbage\n"), &out)
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("Expected the admin API to reject an invalid export, got %v", err)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"container/list"
+	"expvar"
+	"fmt"
+	"time"
+)
+
+var cacheMetrics = expvar.NewMap("cache")
+
+// EvictionPolicy chooses which entry a full cache drops for a new one. Expired
+// entries are always dropped first, the policy only picks among live ones. The
+// cache calls it with its lock held.
+type EvictionPolicy interface {
+	// Name is how the policy is selected in the configuration
+	Name() string
+	// Added is called when an entry is stored under key, replacing any
+	// previous entry for it
+	Added(key cacheKey, entry *cacheEntry)
+	// Accessed is called when the entry under key answers a query
+	Accessed(key cacheKey)
+	// Removed is called once the entry under key is gone
+	Removed(key cacheKey)
+	// Victim returns the entry to evict, false when there is none
+	Victim() (cacheKey, bool)
+}
+
+// NewEvictionPolicy returns the built-in policy with the given name: ttl drops
+// the entry expiring first, lru the least recently used one and lfu the least
+// frequently used one
+func NewEvictionPolicy(name string) (EvictionPolicy, error) {
+	switch name {
+	case "ttl":
+		return &ttlPolicy{expires: make(map[cacheKey]time.Time)}, nil
+	case "lru":
+		return &lruPolicy{elements: make(map[cacheKey]*list.Element), order: list.New()}, nil
+	case "lfu":
+		return &lfuPolicy{uses: make(map[cacheKey]*lfuUses)}, nil
+	}
+	return nil, fmt.Errorf("unknown eviction policy %q, expected ttl, lru or lfu", name)
+}
+
+// CacheHooks observe a cache for instrumentation. They are called with the
+// cache lock held and must not use the cache. Nil hooks are skipped.
+type CacheHooks struct {
+	// Hit and Miss are called for each Get
+	Hit  func(key cacheKey)
+	Miss func(key cacheKey)
+	// Evict is called for every entry dropped to make room, expired tells
+	// whether it was dropped for being expired rather than by the policy
+	Evict func(key cacheKey, expired bool)
+	// Expire is called for every expired entry the janitor removes
+	Expire func(key cacheKey)
+}
+
+// metricsHooks count the cache events in the cache expvar map
+func metricsHooks() CacheHooks {
+	return CacheHooks{
+		Hit:  func(cacheKey) { cacheMetrics.Add("hits", 1) },
+		Miss: func(cacheKey) { cacheMetrics.Add("misses", 1) },
+		Evict: func(_ cacheKey, expired bool) {
+			if expired {
+				cacheMetrics.Add("evictions_expired", 1)
+			} else {
+				cacheMetrics.Add("evictions", 1)
+			}
+		},
+		Expire: func(cacheKey) { cacheMetrics.Add("expired_removed", 1) },
+	}
+}
+
+// ttlPolicy evicts the entry that expires first
+type ttlPolicy struct {
+	expires map[cacheKey]time.Time
+}
+
+func (p *ttlPolicy) Name() string { return "ttl" }
+
+func (p *ttlPolicy) Added(key cacheKey, entry *cacheEntry) { p.expires[key] = entry.Expires }
+
+func (p *ttlPolicy) Accessed(cacheKey) {}
+
+func (p *ttlPolicy) Removed(key cacheKey) { delete(p.expires, key) }
+
+func (p *ttlPolicy) Victim() (cacheKey, bool) {
+	var victim cacheKey
+	var victimExpires time.Time
+	found := false
+	for key, expires := range p.expires {
+		if !found || expires.Before(victimExpires) {
+			victim, victimExpires, found = key, expires, true
+		}
+	}
+	return victim, found
+}
+
+// lruPolicy evicts the entry used least recently, storing an entry counts as
+// using it
+type lruPolicy struct {
+	elements map[cacheKey]*list.Element
+	// order holds the keys, most recently used first
+	order *list.List
+}
+
+func (p *lruPolicy) Name() string { return "lru" }
+
+func (p *lruPolicy) Added(key cacheKey, _ *cacheEntry) {
+	if e, ok := p.elements[key]; ok {
+		p.order.MoveToFront(e)
+		return
+	}
+	p.elements[key] = p.order.PushFront(key)
+}
+
+func (p *lruPolicy) Accessed(key cacheKey) {
+	if e, ok := p.elements[key]; ok {
+		p.order.MoveToFront(e)
+	}
+}
+
+func (p *lruPolicy) Removed(key cacheKey) {
+	if e, ok := p.elements[key]; ok {
+		p.order.Remove(e)
+		delete(p.elements, key)
+	}
+}
+
+func (p *lruPolicy) Victim() (cacheKey, bool) {
+	e := p.order.Back()
+	if e == nil {
+		return cacheKey{}, false
+	}
+	return e.Value.(cacheKey), true
+}
+
+// lfuPolicy evicts the entry answering the fewest queries, the one stored
+// first among equals. Refreshing an entry keeps its count, so popular names
+// stay cached across their TTL.
+type lfuPolicy struct {
+	uses map[cacheKey]*lfuUses
+	seq  uint64
+}
+
+type lfuUses struct {
+	count uint64
+	// seq orders the entries by when they were first stored
+	seq uint64
+}
+
+func (p *lfuPolicy) Name() string { return "lfu" }
+
+func (p *lfuPolicy) Added(key cacheKey, _ *cacheEntry) {
+	if _, ok := p.uses[key]; !ok {
+		p.seq++
+		p.uses[key] = &lfuUses{seq: p.seq}
+	}
+}
+
+func (p *lfuPolicy) Accessed(key cacheKey) {
+	if u, ok := p.uses[key]; ok {
+		u.count++
+	}
+}
+
+func (p *lfuPolicy) Removed(key cacheKey) { delete(p.uses, key) }
+
+func (p *lfuPolicy) Victim() (cacheKey, bool) {
+	var victim cacheKey
+	var least *lfuUses
+	for key, u := range p.uses {
+		if least == nil || u.count < least.count || u.count == least.count && u.seq < least.seq {
+			victim, least = key, u
+		}
+	}
+	return victim, least != nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+func newPolicyTestCache(t *testing.T, maxEntries int, policy string) (*Cache, *fakeClock) {
+	t.Helper()
+	p, err := NewEvictionPolicy(policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	c := NewCacheWithPolicy(maxEntries, p)
+	c.now = clock.Now
+	return c, clock
+}
+
+// putA caches an A answer for name with the given TTL
+func putA(c *Cache, name string, ttl uint32) {
+	rr := aRecord(name, "192.0.2.1")
+	rr.TTL = ttl
+	c.Put(question(name, dnsmessage.TypeA), &dnsmessage.Message{Answers: []dnsmessage.Resource{rr}})
+}
+
+func cached(c *Cache, name string) bool {
+	_, ok := c.Get(question(name, dnsmessage.TypeA))
+	return ok
+}
+
+func TestEvictionPolicies(t *testing.T) {
+	tests := []struct {
+		policy  string
+		evicted string
+	}{
+		// a expires first, b was used least recently and c least often
+		{"ttl", "a.example"},
+		{"lru", "b.example"},
+		{"lfu", "c.example"},
+	}
+	for _, tt := range tests {
+		c, _ := newPolicyTestCache(t, 3, tt.policy)
+		putA(c, "a.example", 100)
+		putA(c, "b.example", 300)
+		putA(c, "c.example", 300)
+		for _, name := range []string{"b.example", "b.example", "a.example", "a.example", "c.example"} {
+			cached(c, name)
+		}
+		putA(c, "d.example", 300)
+
+		if c.Len() != 3 {
+			t.Fatalf("%s: expected the cache to be capped at 3 entries, got %d", tt.policy, c.Len())
+		}
+		for _, name := range []string{"a.example", "b.example", "c.example", "d.example"} {
+			if got := cached(c, name); got == (name == tt.evicted) {
+				t.Errorf("%s: expected only %s to be evicted, %s cached: %v", tt.policy, tt.evicted, name, got)
+			}
+		}
+	}
+}
+
+func TestEvictionPrefersExpiredEntries(t *testing.T) {
+	for _, policy := range []string{"ttl", "lru", "lfu"} {
+		c, clock := newPolicyTestCache(t, 2, policy)
+		var evicted []cacheKey
+		var expired []bool
+		c.Hooks.Evict = func(key cacheKey, e bool) {
+			evicted, expired = append(evicted, key), append(expired, e)
+		}
+		putA(c, "short.example", 10)
+		putA(c, "long.example", 3600)
+		cached(c, "short.example")
+		clock.Advance(time.Minute)
+		putA(c, "new.example", 3600)
+
+		if len(evicted) != 1 || evicted[0].Name != "short.example" || !expired[0] {
+			t.Errorf("%s: expected the expired entry to be evicted, got %v %v", policy, evicted, expired)
+		}
+		if !cached(c, "long.example") {
+			t.Errorf("%s: expected the live entry to be kept", policy)
+		}
+	}
+}
+
+func TestCacheHooks(t *testing.T) {
+	c, _ := newPolicyTestCache(t, 10, "lru")
+	hits, misses := 0, 0
+	c.Hooks = CacheHooks{Hit: func(cacheKey) { hits++ }, Miss: func(cacheKey) { misses++ }}
+	cached(c, "www.example")
+	putA(c, "www.example", 300)
+	cached(c, "www.example")
+	cached(c, "www.example")
+	if hits != 2 || misses != 1 {
+		t.Errorf("Expected 2 hits and 1 miss, got %d and %d", hits, misses)
+	}
+	if got := c.Summary().Policy; got != "lru" {
+		t.Errorf("Expected the summary to name the policy, got %q", got)
+	}
+	if _, err := NewEvictionPolicy("fifo"); err == nil {
+		t.Error("Expected an unknown policy to be rejected")
+	}
+}
+
+func TestCacheMemoryBudget(t *testing.T) {
+	c, _ := newPolicyTestCache(t, 100, "lru")
+	putA(c, "a.example", 300)
+	entry := c.Bytes()
+	c.MaxBytes = 3 * entry
+	for _, name := range []string{"b.example", "c.example"} {
+		putA(c, name, 300)
+	}
+	cached(c, "a.example")
+	putA(c, "d.example", 300)
+
+	if c.Bytes() > c.MaxBytes || c.Len() != 3 {
+		t.Fatalf("Expected 3 entries within %d bytes, got %d in %d bytes", c.MaxBytes, c.Len(), c.Bytes())
+	}
+	if cached(c, "b.example") || !cached(c, "a.example") {
+		t.Error("Expected the least recently used entry to be evicted")
+	}
+	c.Flush("")
+	if c.Bytes() != 0 {
+		t.Errorf("Expected no memory left after a flush, got %d bytes", c.Bytes())
+	}
+
+	// An entry over the budget on its own isn't stored
+	c.MaxBytes = entry / 2
+	putA(c, "a.example", 300)
+	if c.Len() != 0 {
+		t.Errorf("Expected an entry over the budget to be skipped, got %d entries", c.Len())
+	}
+}
+
+func TestCacheJanitor(t *testing.T) {
+	c, clock := newPolicyTestCache(t, 100, "ttl")
+	c.StaleFor = time.Minute
+	var expired int
+	c.Hooks.Expire = func(cacheKey) { expired++ }
+	putA(c, "short.example", 60)
+	putA(c, "long.example", 3600)
+
+	// Expired entries are kept while they may be served stale
+	clock.Advance(90 * time.Second)
+	if n := c.sweep(); n != 0 || c.Len() != 2 {
+		t.Errorf("Expected nothing removed within StaleFor, removed %d", n)
+	}
+	clock.Advance(time.Minute)
+	if n := c.sweep(); n != 1 || expired != 1 || c.Len() != 1 || !cached(c, "long.example") {
+		t.Errorf("Expected the expired entry to be removed, removed %d, %d left", n, c.Len())
+	}
+
+	clock.Advance(2 * time.Hour)
+	c.startJanitor(time.Millisecond)
+	deadline := time.Now().Add(2 * time.Second)
+	for c.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	c.Close()
+	if c.Len() != 0 {
+		t.Errorf("Expected the janitor to remove the expired entries, %d left", c.Len())
+	}
+}
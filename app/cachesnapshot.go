@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// snapshotMagic starts a cache snapshot, the digit is the format version
+const snapshotMagic = "DNSSNAP1"
+
+const (
+	snapshotNegative = 1 << iota
+	snapshotSubnet
+)
+
+// WriteSnapshot writes the unexpired entries in the snapshot format, compact
+// and meant for this server only, and returns how many it wrote. A snapshot
+// is the magic, the time it was taken in Unix seconds and the entries, each:
+//
+//	remaining seconds (uint32) | flags (uint8) | [subnet bits (uint8), address length (uint8), address]
+//	source length (uint16) | source | message length (uint16) | message
+//
+// The message is the cached response in wire format, with the question of
+// the entry and the TTLs left when the snapshot was taken.
+func (c *Cache) WriteSnapshot(w io.Writer) (int, error) {
+	c.mu.Lock()
+	now := c.now()
+	type snapshotEntry struct {
+		key   cacheKey
+		entry *cacheEntry
+	}
+	var entries []snapshotEntry
+	for key, entry := range c.entries {
+		if now.Before(entry.Expires) {
+			entries = append(entries, snapshotEntry{key, entry})
+		}
+	}
+	c.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString(snapshotMagic)
+	binary.Write(bw, binary.BigEndian, now.Unix())
+	written := 0
+	for _, e := range entries {
+		// Remaining TTLs are whole seconds, entries expiring within one are left out
+		remaining := uint32(e.entry.Expires.Sub(now) / time.Second)
+		if remaining == 0 {
+			continue
+		}
+		elapsed := uint32(now.Sub(e.entry.Stored) / time.Second)
+		resp := e.entry.message(elapsed)
+		resp.Questions = []dnsmessage.Question{{Name: e.key.Name, Type: e.key.Type, Class: e.key.Class}}
+		msg, err := resp.Pack()
+		if err != nil || len(msg) > 0xFFFF || len(e.entry.Source) > 0xFFFF {
+			log.Printf("Leaving cache entry for %s %s out of the snapshot: %v", dnsmessage.FQDN(e.key.Name), e.key.Type, err)
+			continue
+		}
+		var flags byte
+		if e.entry.Negative {
+			flags |= snapshotNegative
+		}
+		if e.key.Subnet.IsValid() {
+			flags |= snapshotSubnet
+		}
+		b := binary.BigEndian.AppendUint32(nil, remaining)
+		b = append(b, flags)
+		if e.key.Subnet.IsValid() {
+			addr := e.key.Subnet.Addr().AsSlice()
+			b = append(b, byte(e.key.Subnet.Bits()), byte(len(addr)))
+			b = append(b, addr...)
+		}
+		b = binary.BigEndian.AppendUint16(b, uint16(len(e.entry.Source)))
+		b = append(b, e.entry.Source...)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(msg)))
+		b = append(b, msg...)
+		if _, err := bw.Write(b); err != nil {
+			return written, err
+		}
+		written++
+	}
+	return written, bw.Flush()
+}
+
+// ReadSnapshot adds the entries of a snapshot that have not expired yet, with
+// their TTLs decreased by the time since it was taken, and returns how many it
+// added. Nothing is added when the snapshot is invalid.
+func (c *Cache) ReadSnapshot(r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != snapshotMagic {
+		return 0, errors.New("not a cache snapshot")
+	}
+	var taken int64
+	if err := binary.Read(br, binary.BigEndian, &taken); err != nil {
+		return 0, fmt.Errorf("truncated snapshot: %w", err)
+	}
+	now := c.now()
+	elapsed := now.Sub(time.Unix(taken, 0))
+	if elapsed < 0 {
+		elapsed = 0
+	}
+
+	type imported struct {
+		key   cacheKey
+		entry *cacheEntry
+	}
+	var entries []imported
+	for {
+		key, entry, err := readSnapshotEntry(br, now, elapsed)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("entry %d: %w", len(entries)+1, err)
+		}
+		if entry != nil {
+			entries = append(entries, imported{key, entry})
+		}
+	}
+	if c.maxEntries <= 0 {
+		return 0, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range entries {
+		c.storeLocked(e.key, e.entry, now)
+	}
+	return len(entries), nil
+}
+
+// readSnapshotEntry reads the next entry of a snapshot taken elapsed ago, the
+// entry is nil when it has expired since. io.EOF tells there are no more.
+func readSnapshotEntry(br *bufio.Reader, now time.Time, elapsed time.Duration) (cacheKey, *cacheEntry, error) {
+	var key cacheKey
+	head := make([]byte, 5)
+	if n, err := io.ReadFull(br, head); err != nil {
+		if n == 0 && errors.Is(err, io.EOF) {
+			return key, nil, io.EOF
+		}
+		return key, nil, io.ErrUnexpectedEOF
+	}
+	remaining := time.Duration(binary.BigEndian.Uint32(head)) * time.Second
+	flags := head[4]
+	if flags&snapshotSubnet != 0 {
+		var bits, length byte
+		if err := binary.Read(br, binary.BigEndian, &bits); err != nil {
+			return key, nil, io.ErrUnexpectedEOF
+		}
+		if err := binary.Read(br, binary.BigEndian, &length); err != nil {
+			return key, nil, io.ErrUnexpectedEOF
+		}
+		raw := make([]byte, length)
+		if _, err := io.ReadFull(br, raw); err != nil {
+			return key, nil, io.ErrUnexpectedEOF
+		}
+		addr, ok := netip.AddrFromSlice(raw)
+		if !ok || int(bits) > addr.BitLen() {
+			return key, nil, errors.New("invalid subnet")
+		}
+		key.Subnet = netip.PrefixFrom(addr, int(bits))
+	}
+	source, err := readSnapshotField(br)
+	if err != nil {
+		return key, nil, err
+	}
+	msg, err := readSnapshotField(br)
+	if err != nil {
+		return key, nil, err
+	}
+	var resp dnsmessage.Message
+	if err := resp.Unpack(msg); err != nil {
+		return key, nil, err
+	}
+	if len(resp.Questions) != 1 {
+		return key, nil, errors.New("entry without question")
+	}
+	q := resp.Questions[0]
+	key.Name, key.Type, key.Class = canonicalName(q.Name), q.Type, q.Class
+	if remaining <= elapsed {
+		return key, nil, nil
+	}
+
+	age := uint32(elapsed / time.Second)
+	return key, &cacheEntry{
+		RCode:         resp.RCode,
+		AuthenticData: resp.AuthenticData,
+		Answers:       agedRecords(resp.Answers, age),
+		Authorities:   agedRecords(resp.Authorities, age),
+		Additionals:   agedRecords(resp.Additionals, age),
+		Negative:      flags&snapshotNegative != 0,
+		Source:        string(source),
+		Stored:        now,
+		Expires:       now.Add(remaining - elapsed),
+	}, nil
+}
+
+// readSnapshotField reads a field prefixed with its 16 bit length
+func readSnapshotField(br *bufio.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(br, binary.BigEndian, &length); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	field := make([]byte, length)
+	if _, err := io.ReadFull(br, field); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return field, nil
+}
+
+// saveCacheSnapshot writes a snapshot of c to path, replacing the file at once
+// so a crash never leaves half a snapshot behind
+func saveCacheSnapshot(c *Cache, path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	n, err := c.WriteSnapshot(tmp)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	log.Printf("Saved %d cache entries to %s", n, path)
+	return nil
+}
+
+// loadCacheSnapshot fills c from the snapshot at path, a missing file is a
+// cold start
+func loadCacheSnapshot(c *Cache, path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := c.ReadSnapshot(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	log.Printf("Loaded %d cache entries from %s", n, path)
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+func TestCacheSnapshotRoundTrip(t *testing.T) {
+	src, clock := newTestCache(10)
+	a := question("www.example.com", dnsmessage.TypeA)
+	src.PutFor(a, netip.Prefix{}, "192.0.2.53:53", &dnsmessage.Message{Answers: []dnsmessage.Resource{
+		{Name: "www.example.com", Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60, Data: &dnsmessage.A{Addr: netip.MustParseAddr("192.0.2.1")}},
+		{Name: "www.example.com", Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60, Data: &dnsmessage.A{Addr: netip.MustParseAddr("192.0.2.2")}},
+	}})
+	nx := question("nope.example.com", dnsmessage.TypeA)
+	src.Put(nx, &dnsmessage.Message{
+		Header:      dnsmessage.Header{RCode: dnsmessage.RCodeNameError},
+		Authorities: []dnsmessage.Resource{soaRecord("example.com", 3600, 300)},
+	})
+	subnet := netip.MustParsePrefix("198.51.100.0/24")
+	cdn := question("cdn.example.com", dnsmessage.TypeAAAA)
+	src.PutFor(cdn, subnet, "", &dnsmessage.Message{Answers: []dnsmessage.Resource{
+		{Name: "cdn.example.com", Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET, TTL: 120, Data: &dnsmessage.AAAA{Addr: netip.MustParseAddr("2001:db8::1")}},
+	}})
+	short := question("short.example.com", dnsmessage.TypeTXT)
+	src.Put(short, &dnsmessage.Message{Answers: []dnsmessage.Resource{
+		{Name: "short.example.com", Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET, TTL: 25, Data: &dnsmessage.TXT{Text: []string{"soon gone"}}},
+	}})
+
+	clock.Advance(10 * time.Second)
+	var snapshot bytes.Buffer
+	n, err := src.WriteSnapshot(&snapshot)
+	if err != nil || n != 4 {
+		t.Fatalf("Expected 4 entries in the snapshot, got %d, %v", n, err)
+	}
+
+	// Loading 20 seconds after the snapshot ages the answers by that time too
+	dst, dstClock := newTestCache(10)
+	dstClock.now = clock.now.Add(20 * time.Second)
+	n, err = dst.ReadSnapshot(&snapshot)
+	if err != nil || n != 3 {
+		t.Fatalf("Expected 3 loaded entries, got %d, %v", n, err)
+	}
+	resp, source, ok := dst.GetFor(a, netip.Prefix{})
+	if !ok || len(resp.Answers) != 2 || resp.Answers[0].TTL != 30 || resp.Answers[1].Data.String() != "192.0.2.2" {
+		t.Fatalf("Expected both A records with 30s left, got %v %+v", ok, resp)
+	}
+	if source != "192.0.2.53:53" {
+		t.Errorf("Expected the source to survive the round trip, got %q", source)
+	}
+	resp, ok = dst.Get(nx)
+	if !ok || resp.RCode != dnsmessage.RCodeNameError || len(resp.Authorities) != 1 {
+		t.Fatalf("Expected the negative entry with its SOA, got %v %+v", ok, resp)
+	}
+	if _, ok := dst.Get(cdn); ok {
+		t.Error("Expected the subnet specific answer to stay specific to its subnet")
+	}
+	if resp, _, ok := dst.GetFor(cdn, subnet); !ok || resp.Answers[0].TTL != 90 {
+		t.Errorf("Expected the answer for the subnet with 90s left, got %v %+v", ok, resp)
+	}
+	if _, ok := dst.Get(short); ok {
+		t.Error("Expected entries expired since the snapshot to be skipped")
+	}
+}
+
+func TestCacheSnapshotRejectsInvalidSnapshots(t *testing.T) {
+	src, _ := newTestCache(10)
+	src.Put(question("a.example", dnsmessage.TypeA), &dnsmessage.Message{Answers: []dnsmessage.Resource{aRecord("a.example", "192.0.2.1")}})
+	var snapshot bytes.Buffer
+	if _, err := src.WriteSnapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	valid := snapshot.Bytes()
+
+	for name, data := range map[string][]byte{
+		"empty":     nil,
+		"not magic": []byte("DNSSNAP0" + string(valid[8:])),
+		"truncated": valid[:len(valid)-3],
+	} {
+		c, _ := newTestCache(10)
+		if _, err := c.ReadSnapshot(bytes.NewReader(data)); err == nil {
+			t.Errorf("%s: expected the snapshot to be rejected", name)
+		}
+		if c.Len() != 0 {
+			t.Errorf("%s: expected nothing to be loaded", name)
+		}
+	}
+}
+
+func TestCacheSnapshotFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+	c, _ := newTestCache(10)
+	if err := loadCacheSnapshot(c, path); err != nil {
+		t.Fatalf("Expected a missing snapshot to be a cold start, got %v", err)
+	}
+	c.Put(question("a.example", dnsmessage.TypeA), &dnsmessage.Message{Answers: []dnsmessage.Resource{aRecord("a.example", "192.0.2.1")}})
+	if err := saveCacheSnapshot(c, path); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := os.ReadDir(filepath.Dir(path)); len(files) != 1 {
+		t.Errorf("Expected only the snapshot in its directory, got %v", files)
+	}
+	loaded, _ := newTestCache(10)
+	if err := loadCacheSnapshot(loaded, path); err != nil || loaded.Len() != 1 {
+		t.Errorf("Expected the saved entry to be loaded, got %d, %v", loaded.Len(), err)
+	}
+}
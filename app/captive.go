@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// captiveTTL is short so clients pick up real answers soon after leaving the portal network
+const captiveTTL = 10
+
+// typeSVCB and typeHTTPS let clients skip A/AAAA lookups entirely, they are
+// answered with NODATA so browsers fall back to the address records
+const (
+	typeSVCB  dnsmessage.Type = 64
+	typeHTTPS dnsmessage.Type = 65
+)
+
+// connectivityProbes are the names operating systems fetch over HTTP to detect a
+// captive portal. They must resolve to the portal so the probe gets intercepted
+// and the OS opens its login window.
+var connectivityProbes = []string{
+	"captive.apple.com",
+	"connectivitycheck.gstatic.com",
+	"clients3.google.com",
+	"www.msftconnecttest.com",
+	"detectportal.firefox.com",
+	"nmcheck.gnome.org",
+	"connectivity-check.ubuntu.com",
+}
+
+// dnsProbes are names whose exact answer some operating systems compare against a
+// well known value. A wrong answer makes Windows report "no internet" instead of
+// showing the portal, so they get their real addresses.
+var dnsProbes = map[string][]dnsmessage.Resource{
+	"dns.msftncsi.com": {
+		{Type: dnsmessage.TypeA, Data: &dnsmessage.A{Addr: netip.MustParseAddr("131.107.255.255")}},
+		{Type: dnsmessage.TypeAAAA, Data: &dnsmessage.AAAA{Addr: netip.MustParseAddr("fd3e:4f5a:5b81::1")}},
+	},
+}
+
+// CaptivePortal answers every address query with the portal address, except
+// for names on the allowlist which are resolved normally. Connectivity probes
+// always get the portal address, even when they fall under an allowed domain.
+type CaptivePortal struct {
+	IPv4  netip.Addr
+	IPv6  netip.Addr
+	Allow []string
+}
+
+// NewCaptivePortal creates a captive portal from comma separated portal addresses and allowed domains
+func NewCaptivePortal(portal, allow string) (*CaptivePortal, error) {
+	p := &CaptivePortal{Allow: splitList(allow)}
+	for _, item := range splitList(portal) {
+		addr, err := netip.ParseAddr(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid portal address %q: %w", item, err)
+		}
+		if addr.Is4() {
+			p.IPv4 = addr
+		} else {
+			p.IPv6 = addr
+		}
+	}
+	if !p.IPv4.IsValid() && !p.IPv6.IsValid() {
+		return nil, errors.New("no portal address given")
+	}
+	return p, nil
+}
+
+// answer returns the portal answer for question, or nil when it should be resolved normally
+func (p *CaptivePortal) answer(question dnsmessage.Question) *dnsmessage.Message {
+	if p == nil || question.Class != dnsmessage.ClassINET {
+		return nil
+	}
+	name := canonicalName(question.Name)
+	resp := &dnsmessage.Message{Header: dnsmessage.Header{Response: true}}
+	if probe, ok := dnsProbes[name]; ok {
+		for _, r := range probe {
+			if r.Type == question.Type {
+				resp.Answers = append(resp.Answers, dnsmessage.Resource{Name: question.Name, Type: r.Type, Class: question.Class, TTL: captiveTTL, Data: r.Data})
+			}
+		}
+		return resp
+	}
+	if inAnyDomain(name, p.Allow) && !inAnyDomain(name, connectivityProbes) {
+		return nil
+	}
+
+	switch question.Type {
+	case dnsmessage.TypeA:
+		if p.IPv4.IsValid() {
+			resp.Answers = []dnsmessage.Resource{{Name: question.Name, Type: question.Type, Class: question.Class, TTL: captiveTTL, Data: &dnsmessage.A{Addr: p.IPv4}}}
+		}
+	case dnsmessage.TypeAAAA:
+		if p.IPv6.IsValid() {
+			resp.Answers = []dnsmessage.Resource{{Name: question.Name, Type: question.Type, Class: question.Class, TTL: captiveTTL, Data: &dnsmessage.AAAA{Addr: p.IPv6}}}
+		}
+	case typeSVCB, typeHTTPS:
+		// NODATA
+	default:
+		return nil
+	}
+	return resp
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+func TestCaptivePortal(t *testing.T) {
+	s := newTestServer(t, dnstest.StartUDPServer(t, answerA("192.0.2.1")).Addr)
+	var err error
+	if s.Captive, err = NewCaptivePortal("10.0.0.1", "portal.example,google.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	ask := func(name string, qtype dnsmessage.Type) *dnsmessage.Message {
+		return handle(s, &dnsmessage.Message{Questions: []dnsmessage.Question{question(name, qtype)}})
+	}
+
+	tests := []struct {
+		name    string
+		qtype   dnsmessage.Type
+		answers []string
+	}{
+		{"www.example.com", dnsmessage.TypeA, []string{"10.0.0.1"}},
+		{"www.example.com", dnsmessage.TypeAAAA, nil},
+		{"www.example.com", typeHTTPS, nil},
+		{"login.portal.example", dnsmessage.TypeA, []string{"192.0.2.1"}},
+		{"www.google.com", dnsmessage.TypeA, []string{"192.0.2.1"}},
+		// Probes are intercepted even when their domain is allowed
+		{"clients3.google.com", dnsmessage.TypeA, []string{"10.0.0.1"}},
+		{"captive.apple.com", dnsmessage.TypeA, []string{"10.0.0.1"}},
+		{"dns.msftncsi.com", dnsmessage.TypeA, []string{"131.107.255.255"}},
+		{"DNS.msftncsi.com.", dnsmessage.TypeAAAA, []string{"fd3e:4f5a:5b81::1"}},
+		// Other types are forwarded, the fake upstream answers everything with an A record
+		{"www.example.com", dnsmessage.TypeTXT, []string{"192.0.2.1"}},
+	}
+	for _, tt := range tests {
+		resp := ask(tt.name, tt.qtype)
+		var got []string
+		for _, a := range resp.Answers {
+			got = append(got, a.Data.String())
+		}
+		if resp.RCode != dnsmessage.RCodeSuccess || len(got) != len(tt.answers) || (len(got) > 0 && got[0] != tt.answers[0]) {
+			t.Errorf("%s %s: expected %v, got %s %v", tt.name, tt.qtype, tt.answers, resp.RCode, got)
+		}
+	}
+}
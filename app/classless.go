@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+	"strings"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// classlessBlock is an IPv4 block smaller than a /24 whose reverse zone is
+// delegated the classless way of https://www.rfc-editor.org/rfc/rfc2317: the
+// /24 reverse zone of the provider has a CNAME for each address of the block
+// pointing into Zone, a zone of its own below the /24 one that holds the PTR
+// records.
+type classlessBlock struct {
+	Prefix netip.Prefix
+	Zone   string
+}
+
+// parseClasslessBlocks reads comma separated blocks in form <prefix>, for the
+// zone name RFC 2317 suggests like 0/26.2.0.192.in-addr.arpa, or
+// <prefix>=<zone> for providers naming them differently, like 0-26
+func parseClasslessBlocks(s string) ([]classlessBlock, error) {
+	var blocks []classlessBlock
+	for _, spec := range splitList(s) {
+		prefixSpec, zone, named := strings.Cut(spec, "=")
+		prefix, err := netip.ParsePrefix(prefixSpec)
+		if err != nil {
+			return nil, err
+		}
+		if !prefix.Addr().Is4() || prefix.Bits() <= 24 {
+			return nil, fmt.Errorf("%s is not an IPv4 block smaller than a /24", prefix)
+		}
+		if prefix != prefix.Masked() {
+			return nil, fmt.Errorf("%s has host bits set", prefix)
+		}
+		block := classlessBlock{Prefix: prefix, Zone: classlessZoneName(prefix)}
+		if named {
+			parent := parentName(reverseName(prefix.Addr()))
+			if block.Zone, err = dnsmessage.CanonicalName(dnsmessage.JoinName(zone, parent)); err != nil {
+				return nil, fmt.Errorf("invalid zone for %s: %w", prefix, err)
+			}
+			if parentName(block.Zone) != parent {
+				return nil, fmt.Errorf("zone %s for %s is not right below %s", dnsmessage.FQDN(block.Zone), prefix, dnsmessage.FQDN(parent))
+			}
+		}
+		for _, other := range blocks {
+			if other.Prefix.Overlaps(prefix) {
+				return nil, fmt.Errorf("%s overlaps %s", prefix, other.Prefix)
+			}
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+// classlessZoneName returns the zone name RFC 2317 suggests for a block:
+// its first address and length as the label below the /24 reverse zone
+func classlessZoneName(prefix netip.Prefix) string {
+	first := prefix.Addr().As4()
+	return fmt.Sprintf("%d/%d.%s", first[3], prefix.Bits(), parentName(reverseName(prefix.Addr())))
+}
+
+// ptrName returns the name the PTR record of addr has in the classless zone
+func (b classlessBlock) ptrName(addr netip.Addr) string {
+	return fmt.Sprintf("%d.%s", addr.As4()[3], b.Zone)
+}
+
+// classlessBlockOf returns the classless block holding addr
+func (d *LocalData) classlessBlockOf(addr netip.Addr) (classlessBlock, bool) {
+	addr = addr.Unmap()
+	for _, b := range d.classless {
+		if b.Prefix.Contains(addr) {
+			return b, true
+		}
+	}
+	return classlessBlock{}, false
+}
+
+// AddClassless adds the classless reverse zones of blocks: each zone,
+// answered with an SOA of its own unless it is loaded from a zone file, and
+// the CNAMEs from the /24 reverse names of its addresses into it. The CNAMEs
+// answer local clients asking for the usual reverse names like the /24 zone
+// of the provider does. Addresses with records of their own at the /24 name
+// get no CNAME. AddReverse puts the PTR records of addresses in the blocks
+// into their zones.
+func (d *LocalData) AddClassless(blocks []classlessBlock) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, b := range blocks {
+		d.classless = append(d.classless, b)
+		soa, ok := d.zones[b.Zone]
+		if !ok {
+			soa = dnsmessage.Resource{
+				Name: b.Zone, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: localZoneTTL,
+				Data: &dnsmessage.SOA{MName: b.Zone, RName: "nobody.invalid", Serial: 1, Refresh: 604800, Retry: 86400, Expire: 2419200, Minimum: localZoneTTL},
+			}
+			d.zones[b.Zone] = soa
+			d.add(soa)
+			d.sources[keyOf(&soa)] = "classless reverse zone of " + b.Prefix.String()
+		}
+		for addr := b.Prefix.Addr(); b.Prefix.Contains(addr); addr = addr.Next() {
+			name := reverseName(addr)
+			if _, exists := d.records[name]; exists {
+				continue
+			}
+			cname := dnsmessage.Resource{Name: name, Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET, TTL: soa.TTL, Data: &dnsmessage.CNAME{Target: b.ptrName(addr)}}
+			d.add(cname)
+			d.sources[keyOf(&cname)] = "classless delegation of " + b.Prefix.String()
+		}
+		log.Printf("Serving classless reverse zone %s for %s", dnsmessage.FQDN(b.Zone), b.Prefix)
+	}
+}
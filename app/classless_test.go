@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+func TestParseClasslessBlocks(t *testing.T) {
+	blocks, err := parseClasslessBlocks("192.0.2.64/26,198.51.100.128/25=128-25")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blocks[0].Zone != "64/26.2.0.192.in-addr.arpa" || blocks[1].Zone != "128-25.100.51.198.in-addr.arpa" {
+		t.Errorf("Unexpected zones %+v", blocks)
+	}
+	for _, spec := range []string{"192.0.2.0/24", "192.0.2.1/26", "2001:db8::/120", "192.0.2.0/26,192.0.2.0/27", "192.0.2.0/26=a.b"} {
+		if _, err := parseClasslessBlocks(spec); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestLocalDataClasslessReverse(t *testing.T) {
+	dir := t.TempDir()
+	hosts := filepath.Join(dir, "hosts")
+	if err := os.WriteFile(hosts, []byte("192.0.2.70 web.example.com\n192.0.2.10 other.example.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	blocks, err := parseClasslessBlocks("192.0.2.64/26")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := loadLocalData("", hosts, blocks, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{LocalData: d}
+
+	resp := handle(s, &dnsmessage.Message{Header: dnsmessage.Header{ID: 1, RecursionDesired: true}, Questions: []dnsmessage.Question{question("70.2.0.192.in-addr.arpa", dnsmessage.TypePTR)}})
+	if len(resp.Answers) != 2 || resp.Answers[0].Type != dnsmessage.TypeCNAME || resp.Answers[1].String() != "70.64/26.2.0.192.in-addr.arpa.\t60\tIN\tPTR\tweb.example.com." {
+		t.Errorf("Expected a CNAME into the classless zone and the PTR record, got %s", resp)
+	}
+	if resp := d.answer(question("71.64/26.2.0.192.in-addr.arpa", dnsmessage.TypePTR)); resp.RCode != dnsmessage.RCodeNameError || len(resp.Authorities) != 1 {
+		t.Errorf("Expected NXDOMAIN from the classless zone, got %+v", resp)
+	}
+	if resp := d.answer(question("10.2.0.192.in-addr.arpa", dnsmessage.TypePTR)); len(resp.Answers) != 1 || resp.Answers[0].Type != dnsmessage.TypePTR {
+		t.Errorf("Expected addresses outside of the block to keep their PTR, got %+v", resp)
+	}
+	if resp := d.answer(question("20.2.0.192.in-addr.arpa", dnsmessage.TypePTR)); resp != nil {
+		t.Errorf("Expected other addresses of the /24 to be left to the upstreams, got %+v", resp)
+	}
+}
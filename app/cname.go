@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// maxCNAMEChain is the longest CNAME chain followed for a question
+const maxCNAMEChain = 8
+
+// followCNAMEs walks the CNAME records in records starting at name. It returns
+// the name the chain ends at, how many CNAMEs lead there and whether the chain
+// loops back onto itself.
+func followCNAMEs(records []dnsmessage.Resource, name string) (end string, length int, looped bool) {
+	end = canonicalName(name)
+	seen := map[string]bool{end: true}
+	for {
+		next := ""
+		for _, rr := range records {
+			if cname, ok := rr.Data.(*dnsmessage.CNAME); ok && canonicalName(rr.Name) == end {
+				next = canonicalName(cname.Target)
+				break
+			}
+		}
+		if next == "" {
+			return end, length, false
+		}
+		length++
+		if seen[next] {
+			return next, length, true
+		}
+		seen[next] = true
+		end = next
+	}
+}
+
+// hasRecords reports whether records hold a record of type t owned by name
+func hasRecords(records []dnsmessage.Resource, name string, t dnsmessage.Type) bool {
+	for _, rr := range records {
+		if rr.Type == t && canonicalName(rr.Name) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// chaseCNAMEs completes the answer to question when resp ends in a CNAME
+// without the records asked for: the target is answered locally or, when
+// recursion is allowed, looked up upstream, until the chain ends. The answer
+// section then holds every CNAME and the final records, the rest of the
+// response is that of the last name. Loops and chains longer than
+// maxCNAMEChain are an error.
+func (s *Server) chaseCNAMEs(ctx context.Context, question dnsmessage.Question, resp *dnsmessage.Message, recursion, recursionDesired bool, options []dnsmessage.Option) (*dnsmessage.Message, error) {
+	if question.Type == dnsmessage.TypeCNAME || question.Type == dnsmessage.TypeANY {
+		return resp, nil
+	}
+	for lookups := 0; ; lookups++ {
+		end, length, looped := followCNAMEs(resp.Answers, question.Name)
+		if looped {
+			return nil, fmt.Errorf("CNAME loop at %s", dnsmessage.FQDN(end))
+		}
+		if length == 0 || resp.RCode != dnsmessage.RCodeSuccess || hasRecords(resp.Answers, end, question.Type) {
+			return resp, nil
+		}
+		if length > maxCNAMEChain || lookups > maxCNAMEChain {
+			return nil, fmt.Errorf("CNAME chain longer than %d", maxCNAMEChain)
+		}
+
+		target := dnsmessage.Question{Name: end, Type: question.Type, Class: question.Class}
+		next := s.answerLocally(ctx, target)
+		if next == nil {
+			if !recursion {
+				return resp, nil
+			}
+			var err error
+			if next, err = s.lookup(ctx, target, recursionDesired, options); err != nil {
+				return nil, err
+			}
+		}
+
+		merged := &dnsmessage.Message{Header: resp.Header}
+		merged.RCode = next.RCode
+		merged.Authoritative = resp.Authoritative && next.Authoritative
+		merged.AuthenticData = resp.AuthenticData && next.AuthenticData
+		merged.Answers = append(merged.Answers, resp.Answers...)
+		for _, rr := range next.Answers {
+			if !containsRecord(merged.Answers, rr) {
+				merged.Answers = append(merged.Answers, rr)
+			}
+		}
+		merged.Authorities = next.Authorities
+		merged.Additionals = next.Additionals
+		if len(merged.Answers) == len(resp.Answers) {
+			// The target has nothing to add, e.g. NODATA or NXDOMAIN
+			return merged, nil
+		}
+		resp = merged
+	}
+}
+
+// containsRecord reports whether records already hold rr, whatever its TTL
+func containsRecord(records []dnsmessage.Resource, rr dnsmessage.Resource) bool {
+	for _, r := range records {
+		if r.Type == rr.Type && r.Class == rr.Class && canonicalName(r.Name) == canonicalName(rr.Name) && r.Data.String() == rr.Data.String() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/netip"
+	"sync/atomic"
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+func cnameRecord(name, target string) dnsmessage.Resource {
+	return dnsmessage.Resource{Name: name, Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET, TTL: 300, Data: &dnsmessage.CNAME{Target: target}}
+}
+
+func aRecord(name, ip string) dnsmessage.Resource {
+	return dnsmessage.Resource{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300, Data: &dnsmessage.A{Addr: netip.MustParseAddr(ip)}}
+}
+
+// newCNAMETestServer serves a zone with CNAMEs inside and outside of it,
+// upstream answers cdn.example.net with a CNAME only
+func newCNAMETestServer(t *testing.T) (*Server, *atomic.Int32) {
+	t.Helper()
+	var queries atomic.Int32
+	upstream := dnstest.StartUDPServer(t, func(q *dnsmessage.Message) *dnsmessage.Message {
+		queries.Add(1)
+		resp := &dnsmessage.Message{Header: dnsmessage.Header{ID: q.ID, Response: true, RecursionAvailable: true}, Questions: q.Questions}
+		switch q.Questions[0].Name {
+		case "cdn.example.net":
+			resp.Answers = []dnsmessage.Resource{cnameRecord("cdn.example.net", "edge.example.net")}
+		case "edge.example.net":
+			resp.Answers = []dnsmessage.Resource{aRecord("edge.example.net", "198.51.100.7")}
+		default:
+			resp.RCode = dnsmessage.RCodeNameError
+		}
+		return resp
+	}).Addr
+	s := newTestServer(t, upstream)
+	s.LocalData = NewLocalData()
+	if err := s.LocalData.AddZone("example.com", []dnsmessage.Resource{
+		soaRecord("example.com", 3600, 300),
+		cnameRecord("www.example.com", "web.example.com"),
+		aRecord("web.example.com", "192.0.2.10"),
+		cnameRecord("static.example.com", "cdn.example.net"),
+		cnameRecord("dangling.example.com", "missing.example.com"),
+		cnameRecord("loop1.example.com", "loop2.example.com"),
+		cnameRecord("loop2.example.com", "loop1.example.com"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return s, &queries
+}
+
+func TestServerChasesCNAMEs(t *testing.T) {
+	s, _ := newCNAMETestServer(t)
+	tests := []struct {
+		name    string
+		rcode   dnsmessage.RCode
+		answers []string
+		aa      bool
+	}{
+		{"www.example.com", dnsmessage.RCodeSuccess, []string{"web.example.com.", "192.0.2.10"}, true},
+		// Local into upstream, whose answer is chased again
+		{"static.example.com", dnsmessage.RCodeSuccess, []string{"cdn.example.net.", "edge.example.net.", "198.51.100.7"}, false},
+		{"dangling.example.com", dnsmessage.RCodeNameError, []string{"missing.example.com."}, true},
+		{"loop1.example.com", dnsmessage.RCodeServerFailure, nil, false},
+	}
+	for _, tt := range tests {
+		resp := handle(s, &dnsmessage.Message{Questions: []dnsmessage.Question{question(tt.name, dnsmessage.TypeA)}})
+		var answers []string
+		for _, rr := range resp.Answers {
+			answers = append(answers, rr.Data.String())
+		}
+		if resp.RCode != tt.rcode || resp.Authoritative != tt.aa || len(answers) != len(tt.answers) {
+			t.Errorf("%s: expected %s (AA %v) with %v, got %s (AA %v) with %v", tt.name, tt.rcode, tt.aa, tt.answers, resp.RCode, resp.Authoritative, answers)
+			continue
+		}
+		for i := range answers {
+			if answers[i] != tt.answers[i] {
+				t.Errorf("%s: expected answer %d to be %s, got %s", tt.name, i, tt.answers[i], answers[i])
+			}
+		}
+	}
+}
+
+func TestServerCNAMEQueriesAreNotChased(t *testing.T) {
+	s, queries := newCNAMETestServer(t)
+	resp := handle(s, &dnsmessage.Message{Questions: []dnsmessage.Question{question("static.example.com", dnsmessage.TypeCNAME)}})
+	if len(resp.Answers) != 1 || queries.Load() != 0 {
+		t.Errorf("Expected only the CNAME without upstream queries, got %v after %d queries", resp.Answers, queries.Load())
+	}
+}
+
+func TestServerChasesCNAMEsOnlyWithRecursion(t *testing.T) {
+	s, queries := newCNAMETestServer(t)
+	acl, err := NewACL("recursion", "10.0.0.0/8", NewFirewallStats())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.RecursionACL = acl
+	resp := handle(s, &dnsmessage.Message{Questions: []dnsmessage.Question{question("static.example.com", dnsmessage.TypeA)}})
+	if resp.RCode != dnsmessage.RCodeSuccess || len(resp.Answers) != 1 || queries.Load() != 0 {
+		t.Errorf("Expected the local CNAME alone for clients without recursion, got %+v after %d queries", resp, queries.Load())
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// errUnterminated means a value continues on the next line
+var errUnterminated = errors.New("unterminated value")
+
+// loadConfigFile reads a config file, see parseConfig for its format
+func loadConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseConfig(f, path)
+}
+
+// parseConfig parses the subset of TOML used by config files into flag values.
+// Keys are flag names, underscores may be used instead of dashes and keys in a
+// [table] are prefixed with the table name, so qps in [rrl] sets -rrl-qps.
+// Values are quoted strings, numbers, booleans or arrays of those, which are
+// joined with commas like list flags expect:
+//
+//	resolver = ["1.1.1.1:53", "9.9.9.9:53"]
+//	cache_size = 50000
+//
+//	[rrl]
+//	qps = 20
+func parseConfig(r io.Reader, name string) (map[string]string, error) {
+	values := make(map[string]string)
+	table := ""
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if line[0] == '[' {
+			header, rest, ok := strings.Cut(line[1:], "]")
+			if rest = strings.TrimSpace(rest); !ok || rest != "" && rest[0] != '#' {
+				return nil, fmt.Errorf("%s:%d: invalid table header %q", name, lineNo, line)
+			}
+			table = configKey(header) + "-"
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("%s:%d: expected key = value, got %q", name, lineNo, line)
+		}
+		key = table + configKey(key)
+		if _, dup := values[key]; dup {
+			return nil, fmt.Errorf("%s:%d: %s is set twice", name, lineNo, key)
+		}
+
+		start := lineNo
+		for {
+			parsed, rest, err := parseConfigValue(strings.TrimSpace(value))
+			if errors.Is(err, errUnterminated) && scanner.Scan() {
+				// Arrays may span lines
+				lineNo++
+				value += "\n" + scanner.Text()
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s: %w", name, start, key, err)
+			}
+			if rest = strings.TrimSpace(rest); rest != "" && rest[0] != '#' {
+				return nil, fmt.Errorf("%s:%d: %s: unexpected %q after the value", name, start, key, rest)
+			}
+			values[key] = parsed
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return values, nil
+}
+
+// configKey turns a config key into the name of its flag
+func configKey(key string) string {
+	key = strings.Trim(strings.TrimSpace(key), `"`)
+	return strings.NewReplacer("_", "-", ".", "-").Replace(key)
+}
+
+// parseConfigValue parses the value at the start of s and returns it with the rest of s
+func parseConfigValue(s string) (string, string, error) {
+	if s == "" {
+		return "", "", errors.New("missing value")
+	}
+	switch s[0] {
+	case '"':
+		var b strings.Builder
+		for i := 1; i < len(s); i++ {
+			switch c := s[i]; c {
+			case '"':
+				return b.String(), s[i+1:], nil
+			case '\n':
+				return "", "", errors.New("unterminated string")
+			case '\\':
+				if i++; i == len(s) {
+					return "", "", errors.New("unterminated string")
+				}
+				switch s[i] {
+				case 'n':
+					b.WriteByte('\n')
+				case 't':
+					b.WriteByte('\t')
+				case '"', '\\':
+					b.WriteByte(s[i])
+				default:
+					return "", "", fmt.Errorf("unsupported escape \\%c", s[i])
+				}
+			default:
+				b.WriteByte(c)
+			}
+		}
+		return "", "", errors.New("unterminated string")
+	case '\'':
+		value, rest, ok := strings.Cut(s[1:], "'")
+		if !ok || strings.Contains(value, "\n") {
+			return "", "", errors.New("unterminated string")
+		}
+		return value, rest, nil
+	case '[':
+		var items []string
+		rest := s[1:]
+		for {
+			rest = skipConfigSpace(rest)
+			if rest == "" {
+				return "", "", errUnterminated
+			}
+			if rest[0] == ']' {
+				return strings.Join(items, ","), rest[1:], nil
+			}
+			if rest[0] == '[' {
+				return "", "", errors.New("nested arrays are not supported")
+			}
+			item, after, err := parseConfigValue(rest)
+			if err != nil {
+				return "", "", err
+			}
+			items = append(items, item)
+			rest = skipConfigSpace(after)
+			if rest == "" {
+				return "", "", errUnterminated
+			}
+			switch rest[0] {
+			case ',':
+				rest = rest[1:]
+			case ']':
+			default:
+				return "", "", fmt.Errorf("expected , or ] in array, got %q", rest)
+			}
+		}
+	}
+
+	end := strings.IndexAny(s, " \t\n,]#")
+	if end < 0 {
+		end = len(s)
+	}
+	bare := s[:end]
+	if bare != "true" && bare != "false" && strings.Trim(bare, "+-0123456789._eE") != "" {
+		return "", "", fmt.Errorf("%q must be a number, a boolean or a quoted string", bare)
+	}
+	return strings.ReplaceAll(bare, "_", ""), s[end:], nil
+}
+
+// skipConfigSpace skips whitespace, newlines and comments inside arrays
+func skipConfigSpace(s string) string {
+	for {
+		s = strings.TrimLeft(s, " \t\r\n")
+		if !strings.HasPrefix(s, "#") {
+			return s
+		}
+		_, rest, ok := strings.Cut(s, "\n")
+		if !ok {
+			return ""
+		}
+		s = rest
+	}
+}
+
+// applyConfig sets the flags of fs from the config file values, except those
+// given on the command line which take precedence
+func applyConfig(fs *flag.FlagSet, values map[string]string) error {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	for key, value := range values {
+		f := fs.Lookup(key)
+		if f == nil || key == "config" {
+			return fmt.Errorf("unknown setting %q", key)
+		}
+		if explicit[key] {
+			continue
+		}
+		if err := fs.Set(key, value); err != nil {
+			return fmt.Errorf("invalid %s: %w", key, err)
+		}
+	}
+	return nil
+}
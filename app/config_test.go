@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+func TestParseConfig(t *testing.T) {
+	values, err := parseConfig(strings.NewReader(`
+# Upstreams
+resolver = ["1.1.1.1:53", "9.9.9.9:53"]  # two of them
+cache_size = 50_000
+local-arpa = false
+search = 'lan'
+allow_query = [
+	"10.0.0.0/8", # office
+	"192.168.0.0/16",
+]
+
+[rrl]
+qps = 20.5
+slip = 0
+`), "test.toml")
+	if err != nil {
+		t.Fatalf("parseConfig failed: %v", err)
+	}
+	want := map[string]string{
+		"resolver":    "1.1.1.1:53,9.9.9.9:53",
+		"cache-size":  "50000",
+		"local-arpa":  "false",
+		"search":      "lan",
+		"allow-query": "10.0.0.0/8,192.168.0.0/16",
+		"rrl-qps":     "20.5",
+		"rrl-slip":    "0",
+	}
+	if len(values) != len(want) {
+		t.Errorf("Expected %d values, got %v", len(want), values)
+	}
+	for k, v := range want {
+		if values[k] != v {
+			t.Errorf("%s: expected %q, got %q", k, v, values[k])
+		}
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	for _, config := range []string{
+		"resolver",
+		"resolver = 1.1.1.1:53",
+		`resolver = "1.1.1.1:53`,
+		`resolver = ["1.1.1.1:53"`,
+		`resolver = [["1.1.1.1:53"]]`,
+		`resolver = "a" "b"`,
+		"ndots = 1\nndots = 2",
+		"[rrl",
+	} {
+		if _, err := parseConfig(strings.NewReader(config), "test.toml"); err == nil {
+			t.Errorf("Expected %q to be rejected", config)
+		}
+	}
+}
+
+// writeConfig writes a config file and returns its path
+func writeConfig(t *testing.T, dir, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, "config.toml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadOptionsCommandLineWins(t *testing.T) {
+	path := writeConfig(t, t.TempDir(), "resolver = \"192.0.2.53:53\"\ncache_size = 5\nndots = 3\n")
+	o, err := loadOptions([]string{"-config", path, "-ndots", "2"})
+	if err != nil {
+		t.Fatalf("loadOptions failed: %v", err)
+	}
+	if o.Resolver != "192.0.2.53:53" || o.CacheSize != 5 || o.NDots != 2 {
+		t.Errorf("Unexpected options %+v", o)
+	}
+
+	path = writeConfig(t, t.TempDir(), "resolvers = \"192.0.2.53:53\"\n")
+	if _, err := loadOptions([]string{"-config", path}); err == nil || !strings.Contains(err.Error(), "unknown setting") {
+		t.Errorf("Expected an unknown setting to be rejected, got %v", err)
+	}
+}
+
+func TestReloadSwapsConfiguration(t *testing.T) {
+	dir := t.TempDir()
+	upstream := dnstest.StartUDPServer(t, answerA("192.0.2.1")).Addr
+	blocklist := filepath.Join(dir, "ads.txt")
+	os.WriteFile(blocklist, []byte("ads.example\n"), 0o644)
+	path := writeConfig(t, dir, "resolver = \""+upstream+"\"\nblocklist = \""+blocklist+"\"\n")
+	args := []string{"-config", path}
+
+	opts, err := loadOptions(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := buildServer(opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Reload = reloader(server, args, opts)
+	cache := server.Cache
+
+	handle(server.active(), testQuery("ads.example"))
+	if resp := handle(server.active(), testQuery("tracker.example")); resp.RCode != dnsmessage.RCodeSuccess {
+		t.Fatalf("Expected tracker.example to resolve before the reload, got %s", resp)
+	}
+
+	os.WriteFile(blocklist, []byte("ads.example\ntracker.example\n"), 0o644)
+	rec := httptest.NewRecorder()
+	server.AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/reload", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Reload failed: %d %s", rec.Code, rec.Body)
+	}
+	next := server.active()
+	if next == server {
+		t.Fatal("Expected the reloaded configuration to be swapped in")
+	}
+	if resp := handle(next, testQuery("tracker.example")); resp.RCode != dnsmessage.RCodeNameError {
+		t.Errorf("Expected tracker.example to be blocked after the reload, got %s", resp)
+	}
+	if next.Cache != cache {
+		t.Error("Expected the cache to survive a reload with the same size")
+	}
+	for _, h := range next.FirewallStats.Snapshot() {
+		if h.Pattern == "ads.example" && h.Hits != 1 {
+			t.Errorf("Expected the rule counters to survive the reload, got %+v", h)
+		}
+	}
+
+	// A broken config keeps the running one
+	writeConfig(t, dir, "resolver = \n")
+	rec = httptest.NewRecorder()
+	server.AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/reload", nil))
+	if rec.Code != http.StatusUnprocessableEntity || server.active() != next {
+		t.Errorf("Expected a failed reload to keep the configuration, got %d", rec.Code)
+	}
+}
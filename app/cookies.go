@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// cookieMetrics counts the cookies of client queries by what they held, and
+// the queries refused for lack of a valid one
+var cookieMetrics = expvar.NewMap("cookies")
+
+const (
+	clientCookieSize = 8
+	// serverCookieSize is the size of the cookies generated, the layout of
+	// https://www.rfc-editor.org/rfc/rfc9018#section-4
+	serverCookieSize = 16
+	// cookieLifetime is how long a server cookie is accepted, cookieSkew how
+	// far its timestamp may be ahead (https://www.rfc-editor.org/rfc/rfc9018#section-4.3)
+	cookieLifetime = time.Hour
+	cookieSkew     = 5 * time.Minute
+)
+
+var errMalformedCookie = errors.New("malformed cookie option")
+
+// Cookies generates and checks the server cookies of DNS Cookies
+// (https://www.rfc-editor.org/rfc/rfc7873). Server cookies follow the layout of
+// RFC 9018, version, reserved bytes and timestamp, but are authenticated with
+// a truncated HMAC-SHA256 of the client cookie and address instead of SipHash.
+type Cookies struct {
+	secret []byte
+	// Require lists the client networks whose UDP queries are only answered
+	// with a valid server cookie, the others are answered either way
+	Require []netip.Prefix
+	now     func() time.Time
+}
+
+// NewCookies creates server cookies authenticated with secret, a hex string
+// of at least 16 bytes. Without one a random secret is used, instances sharing
+// an anycast address need to share it.
+func NewCookies(secret string, require []netip.Prefix) (*Cookies, error) {
+	c := &Cookies{Require: require, now: time.Now}
+	if secret == "" {
+		c.secret = make([]byte, 16)
+		rand.Read(c.secret)
+		return c, nil
+	}
+	var err error
+	if c.secret, err = hex.DecodeString(secret); err != nil {
+		return nil, fmt.Errorf("invalid cookie secret: %w", err)
+	}
+	if len(c.secret) < 16 {
+		return nil, errors.New("cookie secret must be at least 16 bytes")
+	}
+	return c, nil
+}
+
+// check returns the client cookie of query and reports whether its server
+// cookie is valid for client. Queries without cookies return none, malformed
+// cookie options an error (https://www.rfc-editor.org/rfc/rfc7873#section-5.2.2).
+func (c *Cookies) check(client netip.Addr, query *dnsmessage.Message) ([]byte, bool, error) {
+	if c == nil {
+		return nil, false, nil
+	}
+	data, ok := cookieOption(query)
+	if !ok {
+		cookieMetrics.Add("missing", 1)
+		return nil, false, nil
+	}
+	if len(data) != clientCookieSize && (len(data) < clientCookieSize+8 || len(data) > clientCookieSize+32) {
+		cookieMetrics.Add("malformed", 1)
+		return nil, false, errMalformedCookie
+	}
+	clientCookie, serverCookie := data[:clientCookieSize], data[clientCookieSize:]
+	if len(serverCookie) == 0 {
+		cookieMetrics.Add("client_only", 1)
+		return clientCookie, false, nil
+	}
+	if !c.valid(client, clientCookie, serverCookie) {
+		cookieMetrics.Add("invalid", 1)
+		return clientCookie, false, nil
+	}
+	cookieMetrics.Add("valid", 1)
+	return clientCookie, true, nil
+}
+
+func (c *Cookies) valid(client netip.Addr, clientCookie, serverCookie []byte) bool {
+	if len(serverCookie) != serverCookieSize || serverCookie[0] != 1 {
+		return false
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint32(serverCookie[4:8])), 0)
+	now := c.now()
+	if issued.Before(now.Add(-cookieLifetime)) || issued.After(now.Add(cookieSkew)) {
+		return false
+	}
+	return hmac.Equal(serverCookie, c.serverCookie(client, clientCookie, issued))
+}
+
+// serverCookie returns the server cookie for a client issued at the given time
+func (c *Cookies) serverCookie(client netip.Addr, clientCookie []byte, issued time.Time) []byte {
+	cookie := make([]byte, 8, serverCookieSize)
+	cookie[0] = 1
+	binary.BigEndian.PutUint32(cookie[4:], uint32(issued.Unix()))
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write(clientCookie)
+	mac.Write(cookie)
+	mac.Write(client.Unmap().AsSlice())
+	return mac.Sum(cookie)[:serverCookieSize]
+}
+
+// option returns the cookie option of a reply to client: its client cookie
+// followed by a fresh server cookie
+func (c *Cookies) option(client netip.Addr, clientCookie []byte) dnsmessage.Option {
+	data := append(append([]byte(nil), clientCookie...), c.serverCookie(client, clientCookie, c.now())...)
+	return dnsmessage.Option{Code: ednsOptionCookie, Data: data}
+}
+
+// requires reports whether the UDP queries of client need a valid server cookie
+func (c *Cookies) requires(client netip.Addr) bool {
+	if c == nil {
+		return false
+	}
+	client = client.Unmap()
+	for _, p := range c.Require {
+		if p.Contains(client) {
+			return true
+		}
+	}
+	return false
+}
+
+// cookieOption returns the data of the cookie option of m
+func cookieOption(m *dnsmessage.Message) ([]byte, bool) {
+	opt := optRecord(m)
+	if opt == nil {
+		return nil, false
+	}
+	data, _ := opt.Data.(*dnsmessage.OPT)
+	if data == nil {
+		return nil, false
+	}
+	for _, o := range data.Options {
+		if o.Code == ednsOptionCookie {
+			return o.Data, true
+		}
+	}
+	return nil, false
+}
+
+var errCookieMismatch = errors.New("answer carries another client cookie")
+
+// upstreamCookie is the cookie state of the server as a client of an
+// upstream: the client cookie sent to it and the last server cookie it
+// returned (https://www.rfc-editor.org/rfc/rfc7873#section-5.1)
+type upstreamCookie struct {
+	mu     sync.Mutex
+	client []byte
+	server []byte
+}
+
+func newUpstreamCookie() *upstreamCookie {
+	c := &upstreamCookie{client: make([]byte, clientCookieSize)}
+	rand.Read(c.client)
+	return c
+}
+
+// add returns query with the cookie option added to its OPT record, queries
+// without an OPT record or with a cookie of their own are left alone
+func (c *upstreamCookie) add(query *dnsmessage.Message) *dnsmessage.Message {
+	if c == nil {
+		return query
+	}
+	opt := optRecord(query)
+	if opt == nil {
+		return query
+	}
+	if _, ok := cookieOption(query); ok {
+		return query
+	}
+	c.mu.Lock()
+	cookie := append(append([]byte(nil), c.client...), c.server...)
+	c.mu.Unlock()
+
+	withCookie := *query
+	withCookie.Additionals = append([]dnsmessage.Resource(nil), query.Additionals...)
+	data, _ := opt.Data.(*dnsmessage.OPT)
+	options := []dnsmessage.Option{{Code: ednsOptionCookie, Data: cookie}}
+	if data != nil {
+		options = append(append([]dnsmessage.Option(nil), data.Options...), options...)
+	}
+	for i := range withCookie.Additionals {
+		if withCookie.Additionals[i].Type == dnsmessage.TypeOPT {
+			withCookie.Additionals[i].Data = &dnsmessage.OPT{Options: options}
+		}
+	}
+	return &withCookie
+}
+
+// update remembers the server cookie of resp. Answers echoing another client
+// cookie are rejected, they don't answer our query.
+func (c *upstreamCookie) update(resp *dnsmessage.Message) error {
+	if c == nil {
+		return nil
+	}
+	data, ok := cookieOption(resp)
+	if !ok {
+		return nil
+	}
+	if len(data) < clientCookieSize || !bytes.Equal(data[:clientCookieSize], c.client) {
+		return errCookieMismatch
+	}
+	c.mu.Lock()
+	c.server = append([]byte(nil), data[clientCookieSize:]...)
+	c.mu.Unlock()
+	return nil
+}
+
+// refuse answers a UDP query from a client required to have a valid server
+// cookie without one: with BADCOOKIE and a fresh cookie to retry with when it
+// sent a client cookie, truncated so it retries over TCP otherwise
+// (https://www.rfc-editor.org/rfc/rfc7873#section-5.2.3)
+func (c *Cookies) refuse(reply *dnsmessage.Message, client netip.Addr, clientCookie []byte) *dnsmessage.Message {
+	if clientCookie == nil {
+		cookieMetrics.Add("truncated", 1)
+		reply.Truncated = true
+		return reply
+	}
+	cookieMetrics.Add("badcookie", 1)
+	reply.RCode = dnsmessage.RCodeBadCookie
+	opt := newOPT(maxUDPSize, false)
+	opt.Data = &dnsmessage.OPT{Options: []dnsmessage.Option{c.option(client, clientCookie)}}
+	setExtendedRCode(&opt, reply.RCode)
+	reply.Additionals = append(reply.Additionals, opt)
+	return reply
+}
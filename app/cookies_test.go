@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+// cookieQuery asks for www.example with the given cookie option data
+func cookieQuery(cookie []byte) *dnsmessage.Message {
+	query := testQuery("www.example")
+	opt := newOPT(4096, false)
+	opt.Data = &dnsmessage.OPT{Options: []dnsmessage.Option{{Code: ednsOptionCookie, Data: cookie}}}
+	query.Additionals = []dnsmessage.Resource{opt}
+	return query
+}
+
+func TestServerCookies(t *testing.T) {
+	s := newTestServer(t, dnstest.StartUDPServer(t, answerA("192.0.2.1")).Addr)
+	var err error
+	if s.Cookies, err = NewCookies("", []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}); err != nil {
+		t.Fatal(err)
+	}
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	s.Cookies.now = clock.Now
+	clientCookie := []byte("client01")
+
+	// Without any cookie the required client is sent to TCP
+	if reply := handle(s, testQuery("www.example")); !reply.Truncated || len(reply.Answers) != 0 {
+		t.Errorf("Expected a truncated reply, got %+v", reply)
+	}
+	tcp := s.Handle(context.Background(), &QueryContext{Client: testClient, Transport: "tcp", Query: testQuery("www.example")})
+	if len(tcp.Answers) != 1 {
+		t.Errorf("Expected TCP queries to be answered without cookies, got %+v", tcp)
+	}
+
+	// A client cookie alone gets BADCOOKIE with a server cookie to retry with
+	reply := handle(s, cookieQuery(clientCookie))
+	if extendedRCode(reply) != dnsmessage.RCodeBadCookie || len(reply.Answers) != 0 {
+		t.Fatalf("Expected BADCOOKIE, got %+v", reply)
+	}
+	cookie, ok := cookieOption(reply)
+	if !ok || len(cookie) != clientCookieSize+serverCookieSize || !bytes.Equal(cookie[:clientCookieSize], clientCookie) {
+		t.Fatalf("Expected the client cookie with a server cookie, got %x", cookie)
+	}
+	reply = handle(s, cookieQuery(cookie))
+	if reply.RCode != dnsmessage.RCodeSuccess || len(reply.Answers) != 1 {
+		t.Fatalf("Expected a valid cookie to be answered, got %+v", reply)
+	}
+	if next, _ := cookieOption(reply); len(next) != len(cookie) {
+		t.Errorf("Expected a fresh server cookie, got %x", next)
+	}
+
+	// Server cookies are tied to the client address and expire
+	if _, valid, _ := s.Cookies.check(netip.MustParseAddr("192.0.2.7"), cookieQuery(cookie)); valid {
+		t.Error("Expected the cookie of another client to be invalid")
+	}
+	clock.Advance(2 * time.Hour)
+	if reply = handle(s, cookieQuery(cookie)); extendedRCode(reply) != dnsmessage.RCodeBadCookie {
+		t.Errorf("Expected an expired cookie to get BADCOOKIE, got %+v", reply)
+	}
+
+	if reply = handle(s, cookieQuery([]byte("short"))); reply.RCode != dnsmessage.RCodeFormatError {
+		t.Errorf("Expected a malformed cookie to get FORMERR, got %s", reply.RCode)
+	}
+}
+
+func TestUpstreamCookies(t *testing.T) {
+	var mu sync.Mutex
+	var sent [][]byte
+	addr := dnstest.StartUDPServer(t, func(query *dnsmessage.Message) *dnsmessage.Message {
+		resp := answerA("192.0.2.1")(query)
+		cookie, _ := cookieOption(query)
+		mu.Lock()
+		sent = append(sent, cookie)
+		mu.Unlock()
+		opt := newOPT(4096, false)
+		opt.Data = &dnsmessage.OPT{Options: []dnsmessage.Option{{Code: ednsOptionCookie, Data: append(cookie[:clientCookieSize:clientCookieSize], "server-cookie-01"...)}}}
+		resp.Additionals = append(resp.Additionals, opt)
+		return resp
+	}).Addr
+	u := &Upstream{Addr: addr, Health: newUpstreamHealth(), Cookie: newUpstreamCookie()}
+	query := testQuery("www.example")
+	query.Additionals = []dnsmessage.Resource{newOPT(ednsUDPSize, false)}
+	for i := 0; i < 2; i++ {
+		if _, err := u.exchange(context.Background(), query, time.Second, "udp"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sent) != 2 || len(sent[0]) != clientCookieSize || string(sent[1][clientCookieSize:]) != "server-cookie-01" {
+		t.Errorf("Expected the client cookie, then the server cookie along with it, got %q", sent)
+	}
+
+	if err := u.Cookie.update(cookieQuery([]byte("spoofed!"))); err == nil {
+		t.Error("Expected an answer with another client cookie to be rejected")
+	}
+}
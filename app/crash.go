@@ -0,0 +1,52 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"runtime/debug"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// crashMetrics counts the panics recovered from by transport, udp, tcp or
+// prefetch, or lookup for the upstream lookups shared by queries
+var crashMetrics = expvar.NewMap("crashes")
+
+// recoverQuery is deferred by the handlers of single queries, so a panic
+// answering one, such as on a packet the parser trips over, only fails that
+// query. It logs the panic along with everything known about the query and
+// the stack, and sends a SERVFAIL with send unless send is nil or the header
+// of the query can't be read. qc holds the query once it is parsed, the
+// SERVFAIL repeats its question then.
+func (s *Server) recoverQuery(qc *QueryContext, send func([]byte)) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	crashMetrics.Add(qc.Transport, 1)
+	var questions []dnsmessage.Question
+	if qc.Query != nil {
+		questions = qc.Query.Questions
+	}
+	log.Printf("CRASH answering %s query from %s: %v\nquestions: %v\nquery: %x\n%s", qc.Transport, qc.Client, r, questions, qc.Raw, debug.Stack())
+	if send == nil {
+		return
+	}
+	query := qc.Query
+	if query == nil {
+		header, err := dnsmessage.UnpackHeader(qc.Raw)
+		if err != nil || header.Response {
+			return
+		}
+		query = &dnsmessage.Message{Header: header}
+	}
+	// Clients only take replies repeating their question
+	reply := createDNSReply(query)
+	reply.RCode = dnsmessage.RCodeServerFailure
+	packed, err := reply.Pack()
+	if err != nil {
+		log.Printf("Failed to pack SERVFAIL after a crash: %v", err)
+		return
+	}
+	send(packed)
+}
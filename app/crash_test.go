@@ -0,0 +1,46 @@
+package main
+
+import (
+	"expvar"
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+// crashCount returns the current value of a crash counter
+func crashCount(transport string) int64 {
+	if v, ok := crashMetrics.Get(transport).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestServerRecoversFromPanics(t *testing.T) {
+	s := newTestServer(t, dnstest.StartUDPServer(t, answerA("192.0.2.1")).Addr)
+	s.Finalize = func(qc *QueryContext, reply *dnsmessage.Message) *dnsmessage.Message {
+		if qc.Query.Questions[0].Name == "boom.example" {
+			panic("boom")
+		}
+		return reply
+	}
+	addr := startTestServer(t, s)
+
+	for _, network := range []string{"udp", "tcp"} {
+		exchange := dnstest.ExchangeUDP
+		if network == "tcp" {
+			exchange = dnstest.ExchangeTCP
+		}
+		before := crashCount(network)
+		resp := exchange(t, addr, testQuery("boom.example"))
+		if resp.RCode != dnsmessage.RCodeServerFailure || resp.ID != testQuery("boom.example").ID {
+			t.Errorf("%s: expected SERVFAIL for the query that crashed, got %s", network, resp)
+		}
+		if crashCount(network) != before+1 {
+			t.Errorf("%s: expected the crash to be counted", network)
+		}
+		if resp := exchange(t, addr, testQuery("www.example")); len(resp.Answers) != 1 {
+			t.Errorf("%s: expected the server to keep answering after a crash, got %s", network, resp)
+		}
+	}
+}
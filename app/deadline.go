@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"time"
+)
+
+// defaultQueryTimeout is how long a query may take to answer, about when stub
+// resolvers give up on it and ask again
+const defaultQueryTimeout = 5 * time.Second
+
+// queryMetrics count the queries that ran out of time, apart from the upstream
+// attempts that timed out or failed
+var queryMetrics = expvar.NewMap("queries")
+
+// queryContext returns the context a query from a client is answered in,
+// done after QueryTimeout. The upstream work for the query is abandoned then,
+// the client has given up on the answer.
+func (s *Server) queryContext() (context.Context, context.CancelFunc) {
+	if s.QueryTimeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), s.QueryTimeout)
+}
+
+// timedOut reports whether err is due to ctx running out of time, rather than
+// to a failure of whoever was asked
+func timedOut(ctx context.Context, err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) && errors.Is(contextErr(ctx), context.DeadlineExceeded)
+}
+
+// contextErr returns the error of ctx, DeadlineExceeded as soon as its
+// deadline passed. Sockets given the deadline time out by themselves, the
+// timer cancelling ctx may not have caught up with them yet.
+func contextErr(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
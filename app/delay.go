@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// Delays hold answers back for configured domains, so the timeout and failover
+// handling of clients can be exercised against the server. It is a testing aid,
+// nothing a production resolver should run with.
+type Delays struct {
+	// rules are sorted most specific domain first
+	rules []delayRule
+	// random returns a number in [0, 1), for the jitter
+	random func() float64
+}
+
+type delayRule struct {
+	// Domain matches itself and its subdomains, the root matches every name
+	Domain string
+	Delay  time.Duration
+	// Jitter adds up to that much on top of Delay, chosen uniformly
+	Jitter time.Duration
+}
+
+// NewDelays parses comma separated delays in form <domain>=<delay>[~<jitter>],
+// e.g. "slow.lab=2s,flaky.lab=100ms~400ms". The most specific domain of a name
+// applies.
+func NewDelays(s string) (*Delays, error) {
+	d := &Delays{random: rand.Float64}
+	for _, spec := range splitList(s) {
+		domain, value, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("delay %q: expected <domain>=<delay>[~<jitter>]", spec)
+		}
+		delay, jitter, hasJitter := strings.Cut(value, "~")
+		rule := delayRule{Domain: canonicalName(domain)}
+		var err error
+		if rule.Delay, err = time.ParseDuration(delay); err != nil || rule.Delay < 0 {
+			return nil, fmt.Errorf("delay %q: expected a positive duration, got %q", spec, delay)
+		}
+		if hasJitter {
+			if rule.Jitter, err = time.ParseDuration(jitter); err != nil || rule.Jitter < 0 {
+				return nil, fmt.Errorf("delay %q: expected a positive jitter, got %q", spec, jitter)
+			}
+		}
+		d.rules = append(d.rules, rule)
+	}
+	sort.SliceStable(d.rules, func(i, j int) bool {
+		return labelCount(d.rules[i].Domain) > labelCount(d.rules[j].Domain)
+	})
+	return d, nil
+}
+
+// For returns how long to hold back the answer for name
+func (d *Delays) For(name string) time.Duration {
+	for _, r := range d.rules {
+		if isSubdomain(name, r.Domain) {
+			return r.Delay + time.Duration(d.random()*float64(r.Jitter))
+		}
+	}
+	return 0
+}
+
+// wait blocks for the longest delay of the questions, or until ctx is done
+func (d *Delays) wait(ctx context.Context, questions []dnsmessage.Question) {
+	if d == nil {
+		return
+	}
+	var delay time.Duration
+	for _, q := range questions {
+		delay = max(delay, d.For(q.Name))
+	}
+	if delay == 0 {
+		return
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+func TestDelaysFor(t *testing.T) {
+	d, err := NewDelays("lab=1s, slow.lab.=3s, flaky.lab=100ms~400ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.random = func() float64 { return 0.5 }
+	tests := []struct {
+		name string
+		want time.Duration
+	}{
+		{"lab", time.Second},
+		{"www.lab", time.Second},
+		{"www.slow.lab", 3 * time.Second},
+		{"flaky.lab", 300 * time.Millisecond},
+		{"example.com", 0},
+	}
+	for _, tt := range tests {
+		if got := d.For(tt.name); got != tt.want {
+			t.Errorf("For(%q) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNewDelaysInvalid(t *testing.T) {
+	for _, s := range []string{"lab", "lab=soon", "lab=-1s", "lab=1s~often"} {
+		if _, err := NewDelays(s); err == nil {
+			t.Errorf("Expected %q to be rejected", s)
+		}
+	}
+}
+
+func TestDelaysWait(t *testing.T) {
+	d, err := NewDelays("slow.lab=50ms,stuck.lab=1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	d.wait(context.Background(), []dnsmessage.Question{question("www.slow.lab", dnsmessage.TypeA)})
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected the answer to be held back 50ms, got %s", elapsed)
+	}
+
+	// The delay ends with the context of the query
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	d.wait(ctx, []dnsmessage.Question{question("stuck.lab", dnsmessage.TypeA)})
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the delay to end with the context, waited %s", elapsed)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// wellKnownNAT64Prefix is the prefix reserved for NAT64
+// (https://www.rfc-editor.org/rfc/rfc6052#section-2.1)
+var wellKnownNAT64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+
+// mappedIPv4Prefix holds the IPv4-mapped IPv6 addresses, AAAA records of
+// which don't count as IPv6 connectivity
+// (https://www.rfc-editor.org/rfc/rfc6147#section-5.1.4)
+var mappedIPv4Prefix = netip.MustParsePrefix("::ffff:0:0/96")
+
+// DNS64 synthesizes AAAA records from A records for names without IPv6
+// addresses (RFC 6147), so clients on IPv6 only networks reach IPv4 only
+// hosts through a NAT64 gateway translating the addresses of Prefix
+type DNS64 struct {
+	Prefix netip.Prefix
+}
+
+// NewDNS64 creates DNS64 synthesis with the NAT64 prefix, which must have one
+// of the lengths RFC 6052 defines
+func NewDNS64(prefix string) (*DNS64, error) {
+	p, err := netip.ParsePrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if !p.Addr().Is6() || p.Addr().Is4In6() {
+		return nil, fmt.Errorf("%s is not an IPv6 prefix", p)
+	}
+	switch p.Bits() {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return nil, fmt.Errorf("%s: the prefix length must be 32, 40, 48, 56, 64 or 96", p)
+	}
+	p = p.Masked()
+	// Bits 64 to 71 are reserved (https://www.rfc-editor.org/rfc/rfc6052#section-2.2)
+	if p.Addr().As16()[8] != 0 {
+		return nil, fmt.Errorf("%s: bits 64 to 71 must be zero", p)
+	}
+	return &DNS64{Prefix: p}, nil
+}
+
+// applies reports whether the answer resp to question of query lacks the
+// IPv6 addresses to be synthesized. Clients validating themselves, asking
+// for DNSSEC records with checking disabled, get the answer as it is as they
+// would reject synthesized records (https://www.rfc-editor.org/rfc/rfc6147#section-5.5).
+func (d *DNS64) applies(query *dnsmessage.Message, question dnsmessage.Question, resp *dnsmessage.Message) bool {
+	if d == nil || question.Type != dnsmessage.TypeAAAA || question.Class != dnsmessage.ClassINET || resp.RCode != dnsmessage.RCodeSuccess {
+		return false
+	}
+	if dnssecOK(query) && query.CheckingDisabled {
+		return false
+	}
+	for _, rr := range resp.Answers {
+		if aaaa, ok := rr.Data.(*dnsmessage.AAAA); ok && !mappedIPv4Prefix.Contains(aaaa.Addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// synthesize returns the AAAA records embedding the addresses of the A
+// records in answers. Addresses that are not globally reachable can't be
+// translated with the well-known prefix and are skipped then
+// (https://www.rfc-editor.org/rfc/rfc6052#section-3.1). The TTLs are those
+// of the A records, capped by ttl.
+func (d *DNS64) synthesize(answers []dnsmessage.Resource, ttl uint32) []dnsmessage.Resource {
+	var synthesized []dnsmessage.Resource
+	for _, rr := range answers {
+		a, ok := rr.Data.(*dnsmessage.A)
+		if !ok {
+			continue
+		}
+		if d.Prefix == wellKnownNAT64Prefix && !globalIPv4(a.Addr) {
+			continue
+		}
+		synthesized = append(synthesized, dnsmessage.Resource{Name: rr.Name, Type: dnsmessage.TypeAAAA, Class: rr.Class, TTL: min(rr.TTL, ttl), Data: &dnsmessage.AAAA{Addr: d.embed(a.Addr)}})
+	}
+	return synthesized
+}
+
+// embed returns the IPv6 address of addr under the prefix, skipping the
+// reserved bits 64 to 71 (https://www.rfc-editor.org/rfc/rfc6052#section-2.2)
+func (d *DNS64) embed(addr netip.Addr) netip.Addr {
+	b := d.Prefix.Addr().As16()
+	i := d.Prefix.Bits() / 8
+	for _, x := range addr.As4() {
+		if i == 8 {
+			i++
+		}
+		b[i] = x
+		i++
+	}
+	return netip.AddrFrom16(b)
+}
+
+// globalIPv4 reports whether addr may be reached through the well-known prefix
+func globalIPv4(addr netip.Addr) bool {
+	return !addr.IsPrivate() && !addr.IsLoopback() && !addr.IsLinkLocalUnicast() && !addr.IsUnspecified() && !addr.IsMulticast()
+}
+
+// answerDNS64 answers question, a AAAA question resp has no addresses for,
+// with the AAAA records synthesized from the A records of the name, following
+// CNAMEs like handle does. resp is the answer when there are none to
+// synthesize from. The TTLs are capped by the negative TTL of resp
+// (https://www.rfc-editor.org/rfc/rfc6147#section-5.1.7).
+func (s *Server) answerDNS64(ctx context.Context, question dnsmessage.Question, resp *dnsmessage.Message, recursion, recursionDesired bool, options []dnsmessage.Option) (*dnsmessage.Message, error) {
+	target := dnsmessage.Question{Name: question.Name, Type: dnsmessage.TypeA, Class: question.Class}
+	a := s.answerLocally(ctx, target)
+	var err error
+	if a == nil {
+		if !recursion {
+			return resp, nil
+		}
+		if a, err = s.resolve(ctx, target, recursionDesired, options); err != nil {
+			return nil, err
+		}
+	}
+	if a, err = s.chaseCNAMEs(ctx, target, a, recursion, recursionDesired, options); err != nil {
+		return nil, err
+	}
+	ttl := ^uint32(0)
+	for _, rr := range resp.Authorities {
+		if rr.Type == dnsmessage.TypeSOA {
+			ttl = min(ttl, negativeSOA(rr).TTL)
+		}
+	}
+	synthesized := s.DNS64.synthesize(a.Answers, ttl)
+	if a.RCode != dnsmessage.RCodeSuccess || len(synthesized) == 0 {
+		return resp, nil
+	}
+	// The synthesized records are neither authoritative nor validated
+	reply := &dnsmessage.Message{Header: resp.Header, Authorities: a.Authorities}
+	reply.Authoritative, reply.AuthenticData = false, false
+	for _, rr := range a.Answers {
+		if rr.Type == dnsmessage.TypeCNAME {
+			reply.Answers = append(reply.Answers, rr)
+		}
+	}
+	reply.Answers = append(reply.Answers, synthesized...)
+	return reply, nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestDNS64Embed(t *testing.T) {
+	// The examples of https://www.rfc-editor.org/rfc/rfc6052#section-2.4
+	for prefix, want := range map[string]string{
+		"2001:db8::/32":               "2001:db8:c000:221::",
+		"2001:db8:100::/40":           "2001:db8:1c0:2:21::",
+		"2001:db8:122::/48":           "2001:db8:122:c000:2:2100::",
+		"2001:db8:122:300::/56":       "2001:db8:122:3c0:0:221::",
+		"2001:db8:122:344::/64":       "2001:db8:122:344:c0:2:2100:0",
+		"2001:db8:122:344::/96":       "2001:db8:122:344::c000:221",
+		wellKnownNAT64Prefix.String(): "64:ff9b::c000:221",
+	} {
+		d, err := NewDNS64(prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := d.embed(netip.MustParseAddr("192.0.2.33")); got != netip.MustParseAddr(want) {
+			t.Errorf("Expected 192.0.2.33 under %s to be %s, got %s", prefix, want, got)
+		}
+	}
+
+	for _, prefix := range []string{"64:ff9b::/80", "10.0.0.0/8", "2001:db8:0:0:ff00::/96", "not a prefix"} {
+		if _, err := NewDNS64(prefix); err == nil {
+			t.Errorf("Expected %s to be rejected", prefix)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package dnsmessage
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+
+	xdns "golang.org/x/net/dns/dnsmessage"
+)
+
+// The codec benchmarks pack and unpack the same corpus of messages with this
+// package and with golang.org/x/net/dns/dnsmessage, as sub-benchmarks next to
+// each other so benchstat compares them:
+//
+//	go test -run '^$' -bench Codec -count 10 ./app/dnsmessage | benchstat -col /codec -
+//
+// miekg/dns is left out, the module can't take on dependencies beyond go.mod.
+
+// benchCorpus returns the messages of the benchmarks by name: a query, a
+// typical answer with a CNAME chain, a negative answer and a large answer
+func benchCorpus() map[string]*Message {
+	a := func(name, addr string) Resource {
+		return Resource{Name: name, Type: TypeA, Class: ClassINET, TTL: 300, Data: &A{Addr: netip.MustParseAddr(addr)}}
+	}
+	question := []Question{{Name: "www.example.com", Type: TypeA, Class: ClassINET}}
+	opt := Resource{Name: Root, Type: TypeOPT, Class: Class(1232), Data: &OPT{}}
+
+	large := &Message{Header: Header{ID: 4, Response: true, RecursionDesired: true, RecursionAvailable: true}, Questions: question}
+	for i := 0; i < 40; i++ {
+		large.Answers = append(large.Answers, a("www.example.com", fmt.Sprintf("192.0.2.%d", i+1)))
+	}
+	large.Additionals = []Resource{opt}
+
+	return map[string]*Message{
+		"query": {Header: Header{ID: 1, RecursionDesired: true}, Questions: question, Additionals: []Resource{opt}},
+		"answer": {
+			Header:    Header{ID: 2, Response: true, RecursionDesired: true, RecursionAvailable: true},
+			Questions: question,
+			Answers: []Resource{
+				{Name: "www.example.com", Type: TypeCNAME, Class: ClassINET, TTL: 300, Data: &CNAME{Target: "web.cdn.example.net"}},
+				a("web.cdn.example.net", "192.0.2.1"),
+				a("web.cdn.example.net", "192.0.2.2"),
+				{Name: "web.cdn.example.net", Type: TypeAAAA, Class: ClassINET, TTL: 300, Data: &AAAA{Addr: netip.MustParseAddr("2001:db8::1")}},
+			},
+			Authorities: []Resource{
+				{Name: "cdn.example.net", Type: TypeNS, Class: ClassINET, TTL: 86400, Data: &NS{Host: "ns1.cdn.example.net"}},
+				{Name: "cdn.example.net", Type: TypeNS, Class: ClassINET, TTL: 86400, Data: &NS{Host: "ns2.cdn.example.net"}},
+			},
+			Additionals: []Resource{a("ns1.cdn.example.net", "192.0.2.53"), a("ns2.cdn.example.net", "192.0.2.54"), opt},
+		},
+		"nxdomain": {
+			Header:    Header{ID: 3, Response: true, RecursionDesired: true, RecursionAvailable: true, RCode: RCodeNameError},
+			Questions: []Question{{Name: "nope.example.com", Type: TypeMX, Class: ClassINET}},
+			Authorities: []Resource{{Name: "example.com", Type: TypeSOA, Class: ClassINET, TTL: 900, Data: &SOA{
+				MName: "ns1.example.com", RName: "hostmaster.example.com", Serial: 2024010101, Refresh: 7200, Retry: 3600, Expire: 1209600, Minimum: 300,
+			}}},
+			Additionals: []Resource{opt},
+		},
+		"large": large,
+	}
+}
+
+func BenchmarkCodecPack(b *testing.B) {
+	for name, m := range benchCorpus() {
+		wire, err := m.Pack()
+		if err != nil {
+			b.Fatal(err)
+		}
+		var x xdns.Message
+		if err := x.Unpack(wire); err != nil {
+			b.Fatal(err)
+		}
+		b.Run("msg="+name+"/codec=dnsmessage", func(b *testing.B) {
+			b.SetBytes(int64(len(wire)))
+			b.ReportAllocs()
+			buf := make([]byte, 0, 512)
+			for i := 0; i < b.N; i++ {
+				if _, err := m.AppendTo(buf[:0]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run("msg="+name+"/codec=x-net", func(b *testing.B) {
+			b.SetBytes(int64(len(wire)))
+			b.ReportAllocs()
+			buf := make([]byte, 0, 512)
+			for i := 0; i < b.N; i++ {
+				if _, err := x.AppendPack(buf[:0]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCodecUnpack(b *testing.B) {
+	for name, m := range benchCorpus() {
+		wire, err := m.Pack()
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run("msg="+name+"/codec=dnsmessage", func(b *testing.B) {
+			b.SetBytes(int64(len(wire)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var got Message
+				if err := got.Unpack(wire); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run("msg="+name+"/codec=x-net", func(b *testing.B) {
+			b.SetBytes(int64(len(wire)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var got xdns.Message
+				if err := got.Unpack(wire); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// TestAppendToDoesNotAllocate checks that packing into a buffer with room
+// for the message keeps off the heap
+func TestAppendToDoesNotAllocate(t *testing.T) {
+	buf := make([]byte, 0, 1024)
+	for name, m := range benchCorpus() {
+		allocs := testing.AllocsPerRun(100, func() {
+			if _, err := m.AppendTo(buf[:0]); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if allocs != 0 {
+			t.Errorf("%s: %v allocations per message", name, allocs)
+		}
+	}
+}
+
+// TestBenchCorpus checks that both codecs read the corpus alike, so the
+// benchmarks compare the same work
+func TestBenchCorpus(t *testing.T) {
+	for name, m := range benchCorpus() {
+		wire, err := m.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var x xdns.Message
+		if err := x.Unpack(wire); err != nil {
+			t.Fatalf("%s: x/net can't unpack: %v", name, err)
+		}
+		if len(x.Answers) != len(m.Answers) || len(x.Authorities) != len(m.Authorities) || len(x.Additionals) != len(m.Additionals) {
+			t.Errorf("%s: x/net sees %d/%d/%d records", name, len(x.Answers), len(x.Authorities), len(x.Additionals))
+		}
+		repacked, err := x.Pack()
+		if err != nil {
+			t.Fatalf("%s: x/net can't pack: %v", name, err)
+		}
+		var back Message
+		if err := back.Unpack(repacked); err != nil {
+			t.Errorf("%s: can't unpack what x/net packed: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,721 @@
+package dnsmessage
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DNSSEC algorithm numbers (https://www.iana.org/assignments/dns-sec-alg-numbers)
+const (
+	AlgorithmRSASHA1         uint8 = 5
+	AlgorithmRSASHA1NSEC3    uint8 = 7
+	AlgorithmRSASHA256       uint8 = 8
+	AlgorithmRSASHA512       uint8 = 10
+	AlgorithmECDSAP256SHA256 uint8 = 13
+	AlgorithmECDSAP384SHA384 uint8 = 14
+	AlgorithmED25519         uint8 = 15
+)
+
+// DS digest types (https://www.iana.org/assignments/ds-rr-types)
+const (
+	DigestSHA1   uint8 = 1
+	DigestSHA256 uint8 = 2
+	DigestSHA384 uint8 = 4
+)
+
+// DNSKEY flags (https://www.rfc-editor.org/rfc/rfc4034#section-2.1.1)
+const (
+	FlagZoneKey     uint16 = 0x0100
+	FlagSecureEntry uint16 = 0x0001
+	// FlagRevoked is set on keys revoked by RFC 5011 key rollovers
+	FlagRevoked uint16 = 0x0080
+)
+
+const (
+	nsec3FlagOptOut uint8 = 0x01
+	// signatureTimeFmt is the presentation format of RRSIG times
+	signatureTimeFmt = "20060102150405"
+)
+
+// base32Hex is the encoding of hashed owner names in NSEC3 records
+var base32Hex = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// DNSKEY is a public key of a zone (https://www.rfc-editor.org/rfc/rfc4034#section-2)
+type DNSKEY struct {
+	Flags     uint16
+	Protocol  uint8
+	Algorithm uint8
+	PublicKey []byte
+}
+
+func (r *DNSKEY) pack(b []byte) ([]byte, error) {
+	b = binary.BigEndian.AppendUint16(b, r.Flags)
+	b = append(b, r.Protocol, r.Algorithm)
+	return append(b, r.PublicKey...), nil
+}
+
+func (r *DNSKEY) String() string {
+	return fmt.Sprintf("%d %d %d %s", r.Flags, r.Protocol, r.Algorithm, base64.StdEncoding.EncodeToString(r.PublicKey))
+}
+
+// KeyTag returns the tag RRSIG and DS records refer to the key with
+// (https://www.rfc-editor.org/rfc/rfc4034#appendix-B)
+func (r *DNSKEY) KeyTag() uint16 {
+	rdata, _ := r.pack(nil)
+	var ac uint32
+	for i, b := range rdata {
+		if i&1 == 0 {
+			ac += uint32(b) << 8
+		} else {
+			ac += uint32(b)
+		}
+	}
+	ac += ac >> 16 & 0xFFFF
+	return uint16(ac)
+}
+
+// ToDS returns the DS record of the key of zone owner with the given digest type
+func (r *DNSKEY) ToDS(owner string, digestType uint8) (*DS, error) {
+	var h hash.Hash
+	switch digestType {
+	case DigestSHA1:
+		h = sha1.New()
+	case DigestSHA256:
+		h = sha256.New()
+	case DigestSHA384:
+		h = sha512.New384()
+	default:
+		return nil, fmt.Errorf("dnssec: unsupported digest type %d", digestType)
+	}
+	name, err := appendCanonicalName(nil, owner)
+	if err != nil {
+		return nil, err
+	}
+	rdata, _ := r.pack(nil)
+	h.Write(name)
+	h.Write(rdata)
+	return &DS{KeyTag: r.KeyTag(), Algorithm: r.Algorithm, DigestType: digestType, Digest: h.Sum(nil)}, nil
+}
+
+// DS is the digest of a key of a child zone, held by its parent
+// (https://www.rfc-editor.org/rfc/rfc4034#section-5)
+type DS struct {
+	KeyTag     uint16
+	Algorithm  uint8
+	DigestType uint8
+	Digest     []byte
+}
+
+func (r *DS) pack(b []byte) ([]byte, error) {
+	b = binary.BigEndian.AppendUint16(b, r.KeyTag)
+	b = append(b, r.Algorithm, r.DigestType)
+	return append(b, r.Digest...), nil
+}
+
+func (r *DS) String() string {
+	return fmt.Sprintf("%d %d %d %s", r.KeyTag, r.Algorithm, r.DigestType, strings.ToUpper(hex.EncodeToString(r.Digest)))
+}
+
+// RRSIG is the signature of an RRset (https://www.rfc-editor.org/rfc/rfc4034#section-3)
+type RRSIG struct {
+	TypeCovered Type
+	Algorithm   uint8
+	// Labels counts the labels of the owner name, without a wildcard label
+	Labels      uint8
+	OriginalTTL uint32
+	// Expiration and Inception are in seconds since the epoch, in serial
+	// number arithmetic
+	Expiration uint32
+	Inception  uint32
+	KeyTag     uint16
+	SignerName string
+	Signature  []byte
+}
+
+func (r *RRSIG) pack(b []byte) ([]byte, error) {
+	b, err := r.appendHeader(b, false)
+	if err != nil {
+		return b, err
+	}
+	return append(b, r.Signature...), nil
+}
+
+// appendHeader appends the fields before the signature, canonical for signing
+func (r *RRSIG) appendHeader(b []byte, canonical bool) ([]byte, error) {
+	b = binary.BigEndian.AppendUint16(b, uint16(r.TypeCovered))
+	b = append(b, r.Algorithm, r.Labels)
+	b = binary.BigEndian.AppendUint32(b, r.OriginalTTL)
+	b = binary.BigEndian.AppendUint32(b, r.Expiration)
+	b = binary.BigEndian.AppendUint32(b, r.Inception)
+	b = binary.BigEndian.AppendUint16(b, r.KeyTag)
+	// Names in the payload are never compressed
+	if canonical {
+		return appendCanonicalName(b, r.SignerName)
+	}
+	return appendName(b, r.SignerName, nil)
+}
+
+func (r *RRSIG) String() string {
+	return fmt.Sprintf("%s %d %d %d %s %s %d %s %s", r.TypeCovered, r.Algorithm, r.Labels, r.OriginalTTL,
+		formatSignatureTime(r.Expiration), formatSignatureTime(r.Inception), r.KeyTag, FQDN(r.SignerName),
+		base64.StdEncoding.EncodeToString(r.Signature))
+}
+
+func formatSignatureTime(t uint32) string {
+	return time.Unix(int64(t), 0).UTC().Format(signatureTimeFmt)
+}
+
+// NSEC links an owner name to the next one of the zone, proving that the
+// names in between and the types missing from Types don't exist
+// (https://www.rfc-editor.org/rfc/rfc4034#section-4)
+type NSEC struct {
+	NextDomain string
+	Types      []Type
+}
+
+func (r *NSEC) pack(b []byte) ([]byte, error) {
+	b, err := appendName(b, r.NextDomain, nil)
+	if err != nil {
+		return b, err
+	}
+	return appendTypeBitmap(b, r.Types), nil
+}
+
+func (r *NSEC) String() string {
+	return strings.TrimSpace(FQDN(r.NextDomain) + " " + typeList(r.Types))
+}
+
+// NSEC3 is NSEC for hashed owner names (https://www.rfc-editor.org/rfc/rfc5155#section-3)
+type NSEC3 struct {
+	HashAlgorithm uint8
+	Flags         uint8
+	Iterations    uint16
+	Salt          []byte
+	NextHashed    []byte
+	Types         []Type
+}
+
+// OptOut reports whether unsigned delegations may be left out of the chain
+func (r *NSEC3) OptOut() bool { return r.Flags&nsec3FlagOptOut != 0 }
+
+func (r *NSEC3) pack(b []byte) ([]byte, error) {
+	if len(r.Salt) > 255 || len(r.NextHashed) > 255 {
+		return b, errors.New("rdata: NSEC3 salt or hash longer than 255 bytes")
+	}
+	b = append(b, r.HashAlgorithm, r.Flags)
+	b = binary.BigEndian.AppendUint16(b, r.Iterations)
+	b = append(b, byte(len(r.Salt)))
+	b = append(b, r.Salt...)
+	b = append(b, byte(len(r.NextHashed)))
+	b = append(b, r.NextHashed...)
+	return appendTypeBitmap(b, r.Types), nil
+}
+
+func (r *NSEC3) String() string {
+	return strings.TrimSpace(fmt.Sprintf("%d %d %d %s %s %s", r.HashAlgorithm, r.Flags, r.Iterations, formatSalt(r.Salt), base32Hex.EncodeToString(r.NextHashed), typeList(r.Types)))
+}
+
+// NSEC3PARAM tells the parameters of the NSEC3 chain of a zone
+// (https://www.rfc-editor.org/rfc/rfc5155#section-4)
+type NSEC3PARAM struct {
+	HashAlgorithm uint8
+	Flags         uint8
+	Iterations    uint16
+	Salt          []byte
+}
+
+func (r *NSEC3PARAM) pack(b []byte) ([]byte, error) {
+	if len(r.Salt) > 255 {
+		return b, errors.New("rdata: NSEC3PARAM salt longer than 255 bytes")
+	}
+	b = append(b, r.HashAlgorithm, r.Flags)
+	b = binary.BigEndian.AppendUint16(b, r.Iterations)
+	b = append(b, byte(len(r.Salt)))
+	return append(b, r.Salt...), nil
+}
+
+func (r *NSEC3PARAM) String() string {
+	return fmt.Sprintf("%d %d %d %s", r.HashAlgorithm, r.Flags, r.Iterations, formatSalt(r.Salt))
+}
+
+func formatSalt(salt []byte) string {
+	if len(salt) == 0 {
+		return "-"
+	}
+	return strings.ToUpper(hex.EncodeToString(salt))
+}
+
+// HasType reports whether t is in the type bitmap of an NSEC or NSEC3 record
+func HasType(types []Type, t Type) bool {
+	for _, have := range types {
+		if have == t {
+			return true
+		}
+	}
+	return false
+}
+
+func typeList(types []Type) string {
+	names := make([]string, len(types))
+	for i, t := range types {
+		names[i] = t.String()
+	}
+	return strings.Join(names, " ")
+}
+
+// appendTypeBitmap appends the window blocks of the types
+// (https://www.rfc-editor.org/rfc/rfc4034#section-4.1.2)
+func appendTypeBitmap(b []byte, types []Type) []byte {
+	sorted := append([]Type(nil), types...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	for i := 0; i < len(sorted); {
+		window := byte(sorted[i] >> 8)
+		var bitmap [32]byte
+		length := 0
+		for ; i < len(sorted) && byte(sorted[i]>>8) == window; i++ {
+			low := byte(sorted[i])
+			bitmap[low/8] |= 0x80 >> (low % 8)
+			length = int(low/8) + 1
+		}
+		b = append(b, window, byte(length))
+		b = append(b, bitmap[:length]...)
+	}
+	return b
+}
+
+func readTypeBitmap(data []byte) ([]Type, error) {
+	var types []Type
+	for len(data) > 0 {
+		if len(data) < 2 || data[1] == 0 || data[1] > 32 || len(data) < 2+int(data[1]) {
+			return nil, errRDataLength
+		}
+		window, bitmap := data[0], data[2:2+int(data[1])]
+		for i, bits := range bitmap {
+			for bit := 0; bit < 8; bit++ {
+				if bits&(0x80>>bit) != 0 {
+					types = append(types, Type(uint16(window)<<8|uint16(i*8+bit)))
+				}
+			}
+		}
+		data = data[2+len(bitmap):]
+	}
+	return types, nil
+}
+
+// unpackDNSSEC decodes the payloads of the DNSSEC types, the length bytes of
+// msg starting at off
+func unpackDNSSEC(msg []byte, off, length int, t Type) (RData, error) {
+	data := msg[off : off+length]
+	switch t {
+	case TypeDNSKEY:
+		if length < 4 {
+			return nil, errRDataLength
+		}
+		return &DNSKEY{Flags: binary.BigEndian.Uint16(data), Protocol: data[2], Algorithm: data[3], PublicKey: append([]byte(nil), data[4:]...)}, nil
+	case TypeDS:
+		if length < 4 {
+			return nil, errRDataLength
+		}
+		return &DS{KeyTag: binary.BigEndian.Uint16(data), Algorithm: data[2], DigestType: data[3], Digest: append([]byte(nil), data[4:]...)}, nil
+	case TypeRRSIG:
+		if length < 18 {
+			return nil, errRDataLength
+		}
+		r := &RRSIG{
+			TypeCovered: Type(binary.BigEndian.Uint16(data)),
+			Algorithm:   data[2],
+			Labels:      data[3],
+			OriginalTTL: binary.BigEndian.Uint32(data[4:]),
+			Expiration:  binary.BigEndian.Uint32(data[8:]),
+			Inception:   binary.BigEndian.Uint32(data[12:]),
+			KeyTag:      binary.BigEndian.Uint16(data[16:]),
+		}
+		// The signer name is not compressed, pointers are not followed
+		name, n, err := readName(msg[off+18:off+length], 0)
+		if err != nil {
+			return nil, err
+		}
+		r.SignerName = name
+		r.Signature = append([]byte(nil), data[18+n:]...)
+		return r, nil
+	case TypeNSEC:
+		name, n, err := readName(msg[off:off+length], 0)
+		if err != nil {
+			return nil, err
+		}
+		types, err := readTypeBitmap(data[n:])
+		if err != nil {
+			return nil, err
+		}
+		return &NSEC{NextDomain: name, Types: types}, nil
+	case TypeNSEC3:
+		if length < 5 {
+			return nil, errRDataLength
+		}
+		r := &NSEC3{HashAlgorithm: data[0], Flags: data[1], Iterations: binary.BigEndian.Uint16(data[2:])}
+		saltEnd := 5 + int(data[4])
+		if saltEnd+1 > length {
+			return nil, errRDataLength
+		}
+		r.Salt = append([]byte(nil), data[5:saltEnd]...)
+		hashEnd := saltEnd + 1 + int(data[saltEnd])
+		if hashEnd > length {
+			return nil, errRDataLength
+		}
+		r.NextHashed = append([]byte(nil), data[saltEnd+1:hashEnd]...)
+		types, err := readTypeBitmap(data[hashEnd:])
+		if err != nil {
+			return nil, err
+		}
+		r.Types = types
+		return r, nil
+	case TypeNSEC3PARAM:
+		if length < 5 || 5+int(data[4]) != length {
+			return nil, errRDataLength
+		}
+		return &NSEC3PARAM{HashAlgorithm: data[0], Flags: data[1], Iterations: binary.BigEndian.Uint16(data[2:]), Salt: append([]byte(nil), data[5:]...)}, nil
+	}
+	return nil, fmt.Errorf("rdata: %s is not a DNSSEC type", t)
+}
+
+// parseDNSSEC decodes the presentation format of the DNSSEC types
+func parseDNSSEC(t Type, fields []string, origin string) (RData, error) {
+	min := map[Type]int{TypeDNSKEY: 4, TypeDS: 4, TypeRRSIG: 9, TypeNSEC: 1, TypeNSEC3: 5, TypeNSEC3PARAM: 4}[t]
+	if len(fields) < min {
+		return nil, fmt.Errorf("rdata: %s expects at least %d fields, got %d", t, min, len(fields))
+	}
+	var n [4]uint64
+	numbers := func(bits ...int) error {
+		for i, size := range bits {
+			var err error
+			if n[i], err = parseUint(fields[i], size); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	switch t {
+	case TypeDNSKEY:
+		if err := numbers(16, 8, 8); err != nil {
+			return nil, err
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.Join(fields[3:], ""))
+		if err != nil {
+			return nil, fmt.Errorf("rdata: invalid DNSKEY public key: %w", err)
+		}
+		return &DNSKEY{Flags: uint16(n[0]), Protocol: uint8(n[1]), Algorithm: uint8(n[2]), PublicKey: key}, nil
+	case TypeDS:
+		if err := numbers(16, 8, 8); err != nil {
+			return nil, err
+		}
+		digest, err := hex.DecodeString(strings.Join(fields[3:], ""))
+		if err != nil {
+			return nil, fmt.Errorf("rdata: invalid DS digest: %w", err)
+		}
+		return &DS{KeyTag: uint16(n[0]), Algorithm: uint8(n[1]), DigestType: uint8(n[2]), Digest: digest}, nil
+	case TypeRRSIG:
+		covered, err := ParseType(strings.ToUpper(fields[0]))
+		if err != nil {
+			return nil, fmt.Errorf("rdata: %w", err)
+		}
+		fields = fields[1:]
+		if err := numbers(8, 8, 32); err != nil {
+			return nil, err
+		}
+		r := &RRSIG{TypeCovered: covered, Algorithm: uint8(n[0]), Labels: uint8(n[1]), OriginalTTL: uint32(n[2])}
+		if r.Expiration, err = parseSignatureTime(fields[3]); err != nil {
+			return nil, err
+		}
+		if r.Inception, err = parseSignatureTime(fields[4]); err != nil {
+			return nil, err
+		}
+		tag, err := parseUint(fields[5], 16)
+		if err != nil {
+			return nil, err
+		}
+		r.KeyTag = uint16(tag)
+		r.SignerName = JoinName(fields[6], origin)
+		if r.Signature, err = base64.StdEncoding.DecodeString(strings.Join(fields[7:], "")); err != nil {
+			return nil, fmt.Errorf("rdata: invalid RRSIG signature: %w", err)
+		}
+		return r, nil
+	case TypeNSEC:
+		types, err := parseTypes(fields[1:])
+		if err != nil {
+			return nil, err
+		}
+		return &NSEC{NextDomain: JoinName(fields[0], origin), Types: types}, nil
+	case TypeNSEC3:
+		if err := numbers(8, 8, 16); err != nil {
+			return nil, err
+		}
+		r := &NSEC3{HashAlgorithm: uint8(n[0]), Flags: uint8(n[1]), Iterations: uint16(n[2])}
+		var err error
+		if r.Salt, err = parseSalt(fields[3]); err != nil {
+			return nil, err
+		}
+		if r.NextHashed, err = base32Hex.DecodeString(strings.ToUpper(fields[4])); err != nil {
+			return nil, fmt.Errorf("rdata: invalid NSEC3 next hashed owner: %w", err)
+		}
+		if r.Types, err = parseTypes(fields[5:]); err != nil {
+			return nil, err
+		}
+		return r, nil
+	case TypeNSEC3PARAM:
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("rdata: NSEC3PARAM expects 4 fields, got %d", len(fields))
+		}
+		if err := numbers(8, 8, 16); err != nil {
+			return nil, err
+		}
+		salt, err := parseSalt(fields[3])
+		if err != nil {
+			return nil, err
+		}
+		return &NSEC3PARAM{HashAlgorithm: uint8(n[0]), Flags: uint8(n[1]), Iterations: uint16(n[2]), Salt: salt}, nil
+	}
+	return nil, fmt.Errorf("rdata: %s is not a DNSSEC type", t)
+}
+
+// parseSalt decodes a salt in hex, "-" for none
+func parseSalt(s string) ([]byte, error) {
+	if s == "-" {
+		return nil, nil
+	}
+	salt, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("rdata: invalid NSEC3 salt: %w", err)
+	}
+	return salt, nil
+}
+
+func parseTypes(fields []string) ([]Type, error) {
+	types := make([]Type, 0, len(fields))
+	for _, f := range fields {
+		t, err := ParseType(strings.ToUpper(f))
+		if err != nil {
+			return nil, fmt.Errorf("rdata: %w", err)
+		}
+		types = append(types, t)
+	}
+	return types, nil
+}
+
+// parseSignatureTime accepts the YYYYMMDDHHmmSS form and plain seconds
+// (https://www.rfc-editor.org/rfc/rfc4034#section-3.2)
+func parseSignatureTime(s string) (uint32, error) {
+	if len(s) == len(signatureTimeFmt) {
+		t, err := time.Parse(signatureTimeFmt, s)
+		if err != nil {
+			return 0, fmt.Errorf("rdata: invalid signature time %q", s)
+		}
+		return uint32(t.Unix()), nil
+	}
+	n, err := parseUint(s, 32)
+	return uint32(n), err
+}
+
+// parseUint parses a decimal field of the given size in bits
+func parseUint(s string, bits int) (uint64, error) {
+	var n uint64
+	if _, err := fmt.Sscan(s, &n); err != nil || n >= 1<<bits {
+		return 0, fmt.Errorf("rdata: invalid %d bit number %q", bits, s)
+	}
+	return n, nil
+}
+
+// appendCanonicalName appends name in the canonical form of DNSSEC:
+// uncompressed, with ASCII letters lowercase. Length bytes are at most 63, so
+// only the label bytes are affected.
+func appendCanonicalName(b []byte, name string) ([]byte, error) {
+	start := len(b)
+	b, err := appendName(b, name, nil)
+	if err != nil {
+		return b, err
+	}
+	for i := start; i < len(b); i++ {
+		if 'A' <= b[i] && b[i] <= 'Z' {
+			b[i] += 'a' - 'A'
+		}
+	}
+	return b, nil
+}
+
+// lowerName returns name with the ASCII letters of its labels lowercase,
+// escaped ones included
+func lowerName(name string) string {
+	b, err := appendCanonicalName(nil, name)
+	if err != nil {
+		return strings.ToLower(name)
+	}
+	lowered, _, err := readName(b, 0)
+	if err != nil {
+		return strings.ToLower(name)
+	}
+	return lowered
+}
+
+// canonicalRData returns the payload of a record in the canonical form of
+// DNSSEC, with the names of the types from RFC 1035, SRV and NAPTR lowercase
+// (https://www.rfc-editor.org/rfc/rfc4034#section-6.2, as amended by
+// https://www.rfc-editor.org/rfc/rfc6840#section-5.1)
+func canonicalRData(t Type, data RData) ([]byte, error) {
+	switch r := data.(type) {
+	case *NS:
+		data = &NS{Host: lowerName(r.Host)}
+	case *CNAME:
+		data = &CNAME{Target: lowerName(r.Target)}
+	case *PTR:
+		data = &PTR{Host: lowerName(r.Host)}
+	case *MX:
+		data = &MX{Preference: r.Preference, Host: lowerName(r.Host)}
+	case *SOA:
+		soa := *r
+		soa.MName, soa.RName = lowerName(r.MName), lowerName(r.RName)
+		data = &soa
+	case *SRV:
+		srv := *r
+		srv.Target = lowerName(r.Target)
+		data = &srv
+	case *NAPTR:
+		naptr := *r
+		naptr.Replacement = lowerName(r.Replacement)
+		data = &naptr
+	}
+	return packRData(nil, t, data, nil)
+}
+
+// SignedData returns the data the signature sig over rrset is computed from:
+// the fields of the RRSIG record before its signature followed by the records
+// in canonical form and order (https://www.rfc-editor.org/rfc/rfc4034#section-3.1.8.1).
+// The records of an RRset expanded from a wildcard are signed with the
+// wildcard as owner name, which sig.Labels tells.
+func SignedData(sig *RRSIG, rrset []Resource) ([]byte, error) {
+	if len(rrset) == 0 {
+		return nil, errors.New("dnssec: empty RRset")
+	}
+	b, err := sig.appendHeader(nil, true)
+	if err != nil {
+		return nil, err
+	}
+
+	owner := rrset[0].Name
+	labels := strings.Split(trimDot(owner), ".")
+	if owner == Root || owner == "" {
+		labels = nil
+	}
+	switch {
+	case len(labels) < int(sig.Labels):
+		return nil, errors.New("dnssec: RRSIG has more labels than the owner name")
+	case len(labels) > int(sig.Labels):
+		owner = "*." + strings.Join(labels[len(labels)-int(sig.Labels):], ".")
+		if sig.Labels == 0 {
+			owner = "*"
+		}
+	}
+	name, err := appendCanonicalName(nil, owner)
+	if err != nil {
+		return nil, err
+	}
+
+	rdatas := make([][]byte, 0, len(rrset))
+	for _, rr := range rrset {
+		if rr.Data == nil {
+			return nil, errors.New("dnssec: record without data")
+		}
+		rdata, err := canonicalRData(rr.Type, rr.Data)
+		if err != nil {
+			return nil, err
+		}
+		rdatas = append(rdatas, rdata)
+	}
+	sort.Slice(rdatas, func(i, j int) bool { return bytes.Compare(rdatas[i], rdatas[j]) < 0 })
+	for i, rdata := range rdatas {
+		// Duplicates are signed once (https://www.rfc-editor.org/rfc/rfc4034#section-6.3)
+		if i > 0 && bytes.Equal(rdata, rdatas[i-1]) {
+			continue
+		}
+		b = append(b, name...)
+		b = binary.BigEndian.AppendUint16(b, uint16(rrset[0].Type))
+		b = binary.BigEndian.AppendUint16(b, uint16(rrset[0].Class))
+		b = binary.BigEndian.AppendUint32(b, sig.OriginalTTL)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(rdata)))
+		b = append(b, rdata...)
+	}
+	return b, nil
+}
+
+// NSEC3Hash returns the hashed owner name of name with SHA-1, the only hash
+// algorithm of NSEC3 (https://www.rfc-editor.org/rfc/rfc5155#section-5)
+func NSEC3Hash(name string, iterations uint16, salt []byte) ([]byte, error) {
+	wire, err := appendCanonicalName(nil, name)
+	if err != nil {
+		return nil, err
+	}
+	h := sha1.New()
+	h.Write(wire)
+	h.Write(salt)
+	digest := h.Sum(nil)
+	for i := 0; i < int(iterations); i++ {
+		h.Reset()
+		h.Write(digest)
+		h.Write(salt)
+		digest = h.Sum(digest[:0])
+	}
+	return digest, nil
+}
+
+// EncodeHashedName returns the label of an NSEC3 owner name for a hash
+func EncodeHashedName(hash []byte) string {
+	return strings.ToLower(base32Hex.EncodeToString(hash))
+}
+
+// DecodeHashedName decodes the first label of an NSEC3 owner name
+func DecodeHashedName(label string) ([]byte, error) {
+	return base32Hex.DecodeString(strings.ToUpper(label))
+}
+
+// CompareNames orders names canonically, label by label from the root with
+// the labels compared as lowercase octets (https://www.rfc-editor.org/rfc/rfc4034#section-6.1).
+// It returns -1, 0 or +1.
+func CompareNames(a, b string) int {
+	la, lb := wireLabels(a), wireLabels(b)
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := bytes.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(la) < len(lb):
+		return -1
+	case len(la) > len(lb):
+		return 1
+	}
+	return 0
+}
+
+// wireLabels returns the lowercase labels of name as octets
+func wireLabels(name string) [][]byte {
+	wire, err := appendCanonicalName(nil, name)
+	if err != nil {
+		wire, _ = appendCanonicalName(nil, strings.ToLower(name))
+	}
+	var labels [][]byte
+	for i := 0; i < len(wire) && wire[i] != 0; i += 1 + int(wire[i]) {
+		labels = append(labels, wire[i+1:i+1+int(wire[i])])
+	}
+	return labels
+}
@@ -0,0 +1,111 @@
+package dnsmessage
+
+import (
+	"encoding/hex"
+	"net/netip"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestDNSSECRoundTrip(t *testing.T) {
+	records := []Resource{
+		{Name: "example.com", Type: TypeDNSKEY, Class: ClassINET, TTL: 3600, Data: &DNSKEY{Flags: 257, Protocol: 3, Algorithm: AlgorithmED25519, PublicKey: []byte{1, 2, 3}}},
+		{Name: "example.com", Type: TypeDS, Class: ClassINET, TTL: 3600, Data: &DS{KeyTag: 12345, Algorithm: AlgorithmED25519, DigestType: DigestSHA256, Digest: []byte{0xAB, 0xCD}}},
+		{Name: "example.com", Type: TypeRRSIG, Class: ClassINET, TTL: 3600, Data: &RRSIG{
+			TypeCovered: TypeA, Algorithm: AlgorithmED25519, Labels: 2, OriginalTTL: 300,
+			Expiration: 1700086400, Inception: 1700000000, KeyTag: 12345, SignerName: "example.com", Signature: []byte{9, 8, 7},
+		}},
+		{Name: "a.example.com", Type: TypeNSEC, Class: ClassINET, TTL: 300, Data: &NSEC{NextDomain: "c.example.com", Types: []Type{TypeA, TypeMX, TypeRRSIG, TypeNSEC, Type(1234)}}},
+		{Name: "0p9mhaveqvm6t7vbl5lop2u3t2rp3tom.example", Type: TypeNSEC3, Class: ClassINET, TTL: 300, Data: &NSEC3{
+			HashAlgorithm: 1, Flags: 1, Iterations: 12, Salt: []byte{0xAA, 0xBB, 0xCC, 0xDD}, NextHashed: []byte{1, 2, 3, 4, 5}, Types: []Type{TypeNS, TypeSOA, TypeDNSKEY},
+		}},
+		{Name: "example", Type: TypeNSEC3PARAM, Class: ClassINET, TTL: 0, Data: &NSEC3PARAM{HashAlgorithm: 1, Iterations: 12, Salt: []byte{0xAA, 0xBB}}},
+	}
+	m := &Message{Header: Header{ID: 1, Response: true}, Answers: records}
+	packed, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Message
+	if err := got.Unpack(packed); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range records {
+		if !reflect.DeepEqual(got.Answers[i], want) {
+			t.Errorf("Expected %+v, got %+v", want.Data, got.Answers[i].Data)
+		}
+		parsed, err := ParseRDataIn(want.Type, want.Data.String(), "example.com")
+		if err != nil {
+			t.Errorf("Failed to parse %s %q: %v", want.Type, want.Data.String(), err)
+			continue
+		}
+		if !reflect.DeepEqual(parsed, want.Data) {
+			t.Errorf("Expected %q to parse back to %+v, got %+v", want.Data.String(), want.Data, parsed)
+		}
+	}
+}
+
+// The example key of https://www.rfc-editor.org/rfc/rfc4034#section-5.4
+func TestDNSKEYToDS(t *testing.T) {
+	data, err := ParseRData(TypeDNSKEY, "256 3 5 AQOeiiR0GOMYkDshWoSKz9XzfwJr1AYtsmx3TGkJaNXVbfi/ 2pHm822aJ5iI9BMzNXxeYCmZDRD99WYwYqUSdjMmmAphXdvx egXd/M5+X7OrzKBaMbCVdFLUUh6DhweJBjEVv5f2wwjM9Xzc nOf+EPbtG9DMBmADjFDc2w/r ljwvFw==")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := data.(*DNSKEY)
+	if tag := key.KeyTag(); tag != 60485 {
+		t.Errorf("Expected key tag 60485, got %d", tag)
+	}
+	ds, err := key.ToDS("DSKEY.example.com.", DigestSHA1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(ds.Digest); got != "2bb183af5f22588179a53b0a98631fad1a292118" {
+		t.Errorf("Expected the digest of the RFC, got %s", got)
+	}
+}
+
+// The hashes of https://www.rfc-editor.org/rfc/rfc5155#appendix-A
+func TestNSEC3Hash(t *testing.T) {
+	salt := []byte{0xAA, 0xBB, 0xCC, 0xDD}
+	for name, want := range map[string]string{
+		"example":   "0p9mhaveqvm6t7vbl5lop2u3t2rp3tom",
+		"a.example": "35mthgpgcu1qg68fab165klnsnk3dpvl",
+	} {
+		hash, err := NSEC3Hash(name, 12, salt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := EncodeHashedName(hash); got != want {
+			t.Errorf("Expected hash %s for %s, got %s", want, name, got)
+		}
+	}
+}
+
+// The order of https://www.rfc-editor.org/rfc/rfc4034#section-6.1
+func TestCompareNames(t *testing.T) {
+	want := []string{"example", "a.example", "yljkjljk.a.example", "Z.a.example", "zABC.a.EXAMPLE", "z.example", `\001.z.example`, "*.z.example", `\200.z.example`}
+	names := []string{want[3], want[8], want[0], want[6], want[5], want[1], want[7], want[4], want[2]}
+	sort.Slice(names, func(i, j int) bool { return CompareNames(names[i], names[j]) < 0 })
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("Expected %v, got %v", want, names)
+	}
+	if CompareNames("WWW.example.com.", "www.example.com") != 0 {
+		t.Error("Expected names differing in case only to be equal")
+	}
+}
+
+func TestSignedDataWildcard(t *testing.T) {
+	sig := &RRSIG{TypeCovered: TypeA, Algorithm: AlgorithmED25519, Labels: 2, OriginalTTL: 300, SignerName: "Example.com"}
+	rrset := []Resource{{Name: "a.b.example.com", Type: TypeA, Class: ClassINET, TTL: 10, Data: &A{Addr: netip.MustParseAddr("192.0.2.1")}}}
+	got, err := SignedData(sig, rrset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, _ := sig.appendHeader(nil, true)
+	owner := []byte("\x01*\x07example\x03com\x00")
+	want := append(append(header, owner...), 0, 1, 0, 1, 0, 0, 1, 44, 0, 4, 192, 0, 2, 1)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
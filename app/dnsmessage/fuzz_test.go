@@ -0,0 +1,102 @@
+package dnsmessage
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// The fuzz targets check that malformed input is rejected with an error and
+// that whatever parses packs back to the same thing. Run one of them with
+//
+//	go test -run '^$' -fuzz FuzzUnpack ./app/dnsmessage
+
+func FuzzUnpackHeader(f *testing.F) {
+	f.Add([]byte{0xBE, 0xEF, 0x85, 0x83, 0, 1, 0, 0, 0, 0, 0, 0})
+	f.Add([]byte{0, 0, 0xFF, 0xFF})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		h, err := UnpackHeader(data)
+		if err != nil {
+			if len(data) >= headerLen {
+				t.Fatalf("Rejected a header of %d bytes: %v", len(data), err)
+			}
+			return
+		}
+		// The Z bit isn't kept, all other flags have to come back
+		var flags uint16 = uint16(data[2])<<8 | uint16(data[3])
+		if got := h.flags(); got != flags&^(1<<6) {
+			t.Errorf("Flags %016b came back as %016b", flags, got)
+		}
+	})
+}
+
+func FuzzUnpackQuestion(f *testing.F) {
+	f.Add([]byte{3, 'w', 'w', 'w', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 1, 0, 1})
+	f.Add([]byte{1, 'a', 0xC0, 12, 0, 1, 0, 1})
+	f.Add([]byte{2, 0, '.', 0, 0, 16, 0, 1})
+	f.Fuzz(func(t *testing.T, question []byte) {
+		msg := append([]byte{0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0}, question...)
+		var m Message
+		if err := m.Unpack(msg); err != nil {
+			return
+		}
+		checkRoundTrip(t, &m)
+	})
+}
+
+func FuzzUnpackResource(f *testing.F) {
+	m := sampleMessage()
+	for _, r := range append(m.Answers, m.Authorities...) {
+		packed, err := r.pack(nil, nil)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(packed)
+	}
+	f.Fuzz(func(t *testing.T, record []byte) {
+		msg := append([]byte{0, 1, 0x80, 0, 0, 0, 0, 1, 0, 0, 0, 0}, record...)
+		var m Message
+		if err := m.Unpack(msg); err != nil {
+			return
+		}
+		checkRoundTrip(t, &m)
+	})
+}
+
+func FuzzUnpack(f *testing.F) {
+	valid, err := sampleMessage().Pack()
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(valid)
+	f.Add(valid[:len(valid)/2])
+	f.Add([]byte{0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0xC0, 12, 0, 1, 0, 1})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var m Message
+		if err := m.Unpack(data); err != nil {
+			return
+		}
+		checkRoundTrip(t, &m)
+	})
+}
+
+// checkRoundTrip packs a message that unpacked and expects to unpack the
+// same message and the same bytes again
+func checkRoundTrip(t *testing.T, m *Message) {
+	t.Helper()
+	packed, err := m.Pack()
+	if err != nil {
+		t.Fatalf("Unpacked message doesn't pack: %v\n%s", err, m)
+	}
+	var again Message
+	if err := again.Unpack(packed); err != nil {
+		t.Fatalf("Packed message doesn't unpack: %v\n%s", err, m)
+	}
+	if !reflect.DeepEqual(&again, m) {
+		t.Fatalf("Round trip mismatch\n got: %s\nwant: %s", &again, m)
+	}
+	repacked, err := again.Pack()
+	if err != nil || !bytes.Equal(packed, repacked) {
+		t.Fatalf("Packing is not stable: %v", err)
+	}
+}
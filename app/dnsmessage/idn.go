@@ -0,0 +1,209 @@
+package dnsmessage
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+// acePrefix marks labels holding an internationalized label in Punycode
+// (https://www.rfc-editor.org/rfc/rfc5890#section-2.3.2.1)
+const acePrefix = "xn--"
+
+// The Punycode parameters (https://www.rfc-editor.org/rfc/rfc3492#section-5)
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+var errPunycode = errors.New("name: invalid punycode")
+
+// asciiLabel returns the A-label of a label in UTF-8: lower case and
+// Punycode encoded behind the xn-- prefix. The IDNA2008 mapping and
+// validity rules beyond that are left to whoever wrote the name.
+func asciiLabel(label []byte) ([]byte, error) {
+	if !utf8.Valid(label) {
+		return nil, errors.New("name: label is neither ASCII nor valid UTF-8")
+	}
+	lower := strings.ToLower(string(label))
+	ascii := true
+	for i := 0; i < len(lower); i++ {
+		ascii = ascii && lower[i] < utf8.RuneSelf
+	}
+	if ascii {
+		return []byte(lower), nil
+	}
+	return append([]byte(acePrefix), punycodeEncode([]rune(lower))...), nil
+}
+
+// UnicodeName returns name with its A-labels decoded back to Unicode, for
+// people to read in logs. Labels that don't decode to printable text stay as
+// they are.
+func UnicodeName(name string) string {
+	if !strings.Contains(name, acePrefix) {
+		return name
+	}
+	labels := strings.Split(name, ".")
+	for i, label := range labels {
+		if !strings.HasPrefix(label, acePrefix) {
+			continue
+		}
+		decoded, err := punycodeDecode(label[len(acePrefix):])
+		if err != nil {
+			continue
+		}
+		// A-labels stand for labels beyond ASCII only
+		printable, unicode := true, false
+		for _, r := range decoded {
+			printable = printable && r > ' ' && r != '.' && r != '\\' && r != 0x7F
+			unicode = unicode || r >= utf8.RuneSelf
+		}
+		if printable && unicode {
+			labels[i] = string(decoded)
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// punycodeEncode implements the encoding procedure of
+// https://www.rfc-editor.org/rfc/rfc3492#section-6.3
+func punycodeEncode(input []rune) string {
+	var out []byte
+	for _, r := range input {
+		if r < punyInitialN {
+			out = append(out, byte(r))
+		}
+	}
+	basic := len(out)
+	if basic > 0 {
+		out = append(out, '-')
+	}
+	n, delta, bias := rune(punyInitialN), 0, punyInitialBias
+	for handled := basic; handled < len(input); {
+		m := rune(utf8.MaxRune + 1)
+		for _, r := range input {
+			if r >= n && r < m {
+				m = r
+			}
+		}
+		delta += int(m-n) * (handled + 1)
+		n = m
+		for _, r := range input {
+			if r < n {
+				delta++
+			}
+			if r != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := punyThreshold(k, bias)
+				if q < t {
+					break
+				}
+				out = append(out, punyDigit(t+(q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out = append(out, punyDigit(q))
+			bias = punyAdapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+	return string(out)
+}
+
+// punycodeDecode implements the decoding procedure of
+// https://www.rfc-editor.org/rfc/rfc3492#section-6.2
+func punycodeDecode(s string) ([]rune, error) {
+	var out []rune
+	if pos := strings.LastIndexByte(s, '-'); pos >= 0 {
+		for _, c := range []byte(s[:pos]) {
+			if c >= utf8.RuneSelf {
+				return nil, errPunycode
+			}
+			out = append(out, rune(c))
+		}
+		s = s[pos+1:]
+	}
+	n, i, bias := rune(punyInitialN), 0, punyInitialBias
+	for in := 0; in < len(s); {
+		oldi, w := i, 1
+		for k := punyBase; ; k += punyBase {
+			if in >= len(s) {
+				return nil, errPunycode
+			}
+			digit, ok := punyDigitValue(s[in])
+			in++
+			if !ok || digit > (utf8.MaxRune-i)/w {
+				return nil, errPunycode
+			}
+			i += digit * w
+			t := punyThreshold(k, bias)
+			if digit < t {
+				break
+			}
+			w *= punyBase - t
+		}
+		bias = punyAdapt(i-oldi, len(out)+1, oldi == 0)
+		n += rune(i / (len(out) + 1))
+		i %= len(out) + 1
+		if n > utf8.MaxRune || n < punyInitialN {
+			return nil, errPunycode
+		}
+		out = append(out[:i], append([]rune{n}, out[i:]...)...)
+		i++
+	}
+	return out, nil
+}
+
+func punyThreshold(k, bias int) int {
+	switch {
+	case k <= bias:
+		return punyTMin
+	case k >= bias+punyTMax:
+		return punyTMax
+	}
+	return k - bias
+}
+
+func punyAdapt(delta, points int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / points
+	k := 0
+	for delta > (punyBase-punyTMin)*punyTMax/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
+
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func punyDigitValue(c byte) (int, bool) {
+	switch {
+	case 'a' <= c && c <= 'z':
+		return int(c - 'a'), true
+	case 'A' <= c && c <= 'Z':
+		return int(c - 'A'), true
+	case '0' <= c && c <= '9':
+		return int(c-'0') + 26, true
+	}
+	return 0, false
+}
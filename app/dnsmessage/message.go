@@ -0,0 +1,266 @@
+// Package dnsmessage implements packing and unpacking of DNS messages as described in
+// https://www.rfc-editor.org/rfc/rfc1035#section-4
+package dnsmessage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// headerLen is the size of the fixed DNS header
+const headerLen = 12
+
+var (
+	errShortHeader   = errors.New("message: shorter than header")
+	errShortQuestion = errors.New("message: truncated question")
+	errShortResource = errors.New("message: truncated resource record")
+)
+
+// Header is the fixed part of a DNS message. Section counts are not stored here,
+// they are derived from the section slices of Message when packing.
+//
+//	| QR  | OPCODE |  AA | TC | RD | RA | Z | AD | CD | RCODE |
+//	---------------------------------------------------------
+//	  15   14-11    10    9    8    7    6   5    4    3-0
+type Header struct {
+	ID                 uint16
+	Response           bool
+	Opcode             Opcode
+	Authoritative      bool
+	Truncated          bool
+	RecursionDesired   bool
+	RecursionAvailable bool
+	AuthenticData      bool
+	CheckingDisabled   bool
+	RCode              RCode
+}
+
+func (h *Header) flags() uint16 {
+	flags := uint16(h.Opcode&0x0F)<<11 | uint16(h.RCode&0x0F)
+	if h.Response {
+		flags |= 1 << 15
+	}
+	if h.Authoritative {
+		flags |= 1 << 10
+	}
+	if h.Truncated {
+		flags |= 1 << 9
+	}
+	if h.RecursionDesired {
+		flags |= 1 << 8
+	}
+	if h.RecursionAvailable {
+		flags |= 1 << 7
+	}
+	if h.AuthenticData {
+		flags |= 1 << 5
+	}
+	if h.CheckingDisabled {
+		flags |= 1 << 4
+	}
+	return flags
+}
+
+func (h *Header) setFlags(flags uint16) {
+	h.Response = flags&(1<<15) != 0
+	h.Opcode = Opcode(flags>>11) & 0x0F
+	h.Authoritative = flags&(1<<10) != 0
+	h.Truncated = flags&(1<<9) != 0
+	h.RecursionDesired = flags&(1<<8) != 0
+	h.RecursionAvailable = flags&(1<<7) != 0
+	h.AuthenticData = flags&(1<<5) != 0
+	h.CheckingDisabled = flags&(1<<4) != 0
+	h.RCode = RCode(flags & 0x0F)
+}
+
+// Question is an entry of the question section
+type Question struct {
+	Name  string
+	Type  Type
+	Class Class
+}
+
+// String returns the question in dig-like presentation format
+func (q Question) String() string {
+	return fmt.Sprintf("%s\t%s\t%s", FQDN(q.Name), q.Class, q.Type)
+}
+
+// Resource is a resource record of the answer, authority or additional section
+type Resource struct {
+	Name  string
+	Type  Type
+	Class Class
+	TTL   uint32
+	Data  RData
+}
+
+// String returns the record in master file presentation format
+func (r Resource) String() string {
+	data := ""
+	if r.Data != nil {
+		data = r.Data.String()
+	}
+	return fmt.Sprintf("%s\t%d\t%s\t%s\t%s", FQDN(r.Name), r.TTL, r.Class, r.Type, data)
+}
+
+// Message is a complete DNS message
+type Message struct {
+	Header
+	Questions   []Question
+	Answers     []Resource
+	Authorities []Resource
+	Additionals []Resource
+}
+
+// Pack serializes the message into wire format, compressing repeated names
+func (m *Message) Pack() ([]byte, error) {
+	return m.AppendTo(make([]byte, 0, 512))
+}
+
+// AppendTo appends the message in wire format to b, compressing repeated
+// names, and returns the extended buffer, or b as it was on error. It doesn't
+// allocate when b has room for the message, so a buffer reused across
+// messages packs them without garbage.
+func (m *Message) AppendTo(b []byte) ([]byte, error) {
+	if len(m.Questions) > 0xFFFF || len(m.Answers) > 0xFFFF || len(m.Authorities) > 0xFFFF || len(m.Additionals) > 0xFFFF {
+		return b, errors.New("message: too many records in a section")
+	}
+
+	comp := compressor{base: len(b)}
+	b = binary.BigEndian.AppendUint16(b, m.ID)
+	b = binary.BigEndian.AppendUint16(b, m.flags())
+	b = binary.BigEndian.AppendUint16(b, uint16(len(m.Questions)))
+	b = binary.BigEndian.AppendUint16(b, uint16(len(m.Answers)))
+	b = binary.BigEndian.AppendUint16(b, uint16(len(m.Authorities)))
+	b = binary.BigEndian.AppendUint16(b, uint16(len(m.Additionals)))
+
+	var err error
+	for i := range m.Questions {
+		q := &m.Questions[i]
+		if b, err = appendName(b, q.Name, &comp); err != nil {
+			return b[:comp.base], fmt.Errorf("question %q: %w", q.Name, err)
+		}
+		b = binary.BigEndian.AppendUint16(b, uint16(q.Type))
+		b = binary.BigEndian.AppendUint16(b, uint16(q.Class))
+	}
+
+	for _, section := range [...][]Resource{m.Answers, m.Authorities, m.Additionals} {
+		for i := range section {
+			r := &section[i]
+			if b, err = r.pack(b, &comp); err != nil {
+				return b[:comp.base], fmt.Errorf("record %s %s: %w", r.Name, r.Type, err)
+			}
+		}
+	}
+	return b, nil
+}
+
+func (r *Resource) pack(b []byte, comp *compressor) ([]byte, error) {
+	var err error
+	if b, err = appendName(b, r.Name, comp); err != nil {
+		return b, err
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(r.Type))
+	b = binary.BigEndian.AppendUint16(b, uint16(r.Class))
+	b = binary.BigEndian.AppendUint32(b, r.TTL)
+
+	// Reserve RDLENGTH and fill it once the payload size is known
+	lengthOff := len(b)
+	b = append(b, 0, 0)
+	if r.Data != nil {
+		if b, err = packRData(b, r.Type, r.Data, comp); err != nil {
+			return b, err
+		}
+	}
+	length := len(b) - lengthOff - 2
+	if length > 0xFFFF {
+		return b, errors.New("rdata: longer than 65535 bytes")
+	}
+	binary.BigEndian.PutUint16(b[lengthOff:], uint16(length))
+	return b, nil
+}
+
+// UnpackHeader parses just the header of a message in wire format, enough to
+// answer messages whose other sections don't parse
+func UnpackHeader(msg []byte) (Header, error) {
+	var h Header
+	if len(msg) < headerLen {
+		return h, errShortHeader
+	}
+	h.ID = binary.BigEndian.Uint16(msg[0:2])
+	h.setFlags(binary.BigEndian.Uint16(msg[2:4]))
+	return h, nil
+}
+
+// Unpack parses a message in wire format, replacing the contents of m. Every
+// read is bounds checked, malformed input yields an error and never a panic.
+func (m *Message) Unpack(msg []byte) error {
+	header, err := UnpackHeader(msg)
+	if err != nil {
+		return err
+	}
+	*m = Message{Header: header}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:6]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:8]))
+	nscount := int(binary.BigEndian.Uint16(msg[8:10]))
+	arcount := int(binary.BigEndian.Uint16(msg[10:12]))
+
+	off := headerLen
+	for i := 0; i < qdcount; i++ {
+		var q Question
+		var err error
+		if q.Name, off, err = readName(msg, off); err != nil {
+			return fmt.Errorf("question %d: %w", i, err)
+		}
+		if off+4 > len(msg) {
+			return errShortQuestion
+		}
+		q.Type = Type(binary.BigEndian.Uint16(msg[off:]))
+		q.Class = Class(binary.BigEndian.Uint16(msg[off+2:]))
+		off += 4
+		m.Questions = append(m.Questions, q)
+	}
+
+	if m.Answers, off, err = unpackSection(msg, off, ancount); err != nil {
+		return fmt.Errorf("answer section: %w", err)
+	}
+	if m.Authorities, off, err = unpackSection(msg, off, nscount); err != nil {
+		return fmt.Errorf("authority section: %w", err)
+	}
+	if m.Additionals, _, err = unpackSection(msg, off, arcount); err != nil {
+		return fmt.Errorf("additional section: %w", err)
+	}
+	return nil
+}
+
+func unpackSection(msg []byte, off, count int) ([]Resource, int, error) {
+	var section []Resource
+	for i := 0; i < count; i++ {
+		var r Resource
+		var err error
+		if r.Name, off, err = readName(msg, off); err != nil {
+			return nil, off, err
+		}
+		if off+10 > len(msg) {
+			return nil, off, errShortResource
+		}
+		r.Type = Type(binary.BigEndian.Uint16(msg[off:]))
+		r.Class = Class(binary.BigEndian.Uint16(msg[off+2:]))
+		r.TTL = binary.BigEndian.Uint32(msg[off+4:])
+		length := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		// Dynamic updates use records without data to match whole RRsets
+		// (https://www.rfc-editor.org/rfc/rfc2136#section-2.4)
+		if length == 0 && (r.Class == ClassANY || r.Class == ClassNONE) {
+			section = append(section, r)
+			continue
+		}
+		if r.Data, err = unpackRData(msg, off, length, r.Type); err != nil {
+			return nil, off, err
+		}
+		off += length
+		section = append(section, r)
+	}
+	return section, off, nil
+}
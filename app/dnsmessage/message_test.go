@@ -0,0 +1,352 @@
+package dnsmessage
+
+import (
+	"bytes"
+	"fmt"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUnpackCompressedQuestions(t *testing.T) {
+	data := []byte{16, 129, 1, 0, 0, 2, 0, 0, 0, 0, 0, 0, 3, 97, 98, 99, 17, 108, 111, 110, 103, 97, 115, 115, 100, 111, 109, 97, 105, 110, 110, 97, 109, 101, 3, 99, 111, 109, 0, 0, 1, 0, 1, 3, 100, 101, 102, 192, 16, 0, 1, 0, 1}
+
+	var m Message
+	if err := m.Unpack(data); err != nil {
+		t.Fatalf("Failed to unpack message: %v", err)
+	}
+
+	if m.ID != 0x1081 || !m.RecursionDesired || m.Response {
+		t.Errorf("Unexpected header: %+v", m.Header)
+	}
+	if len(m.Questions) != 2 {
+		t.Fatalf("Expected 2 questions, but got %d", len(m.Questions))
+	}
+	if m.Questions[0].Name != "abc.longassdomainname.com" {
+		t.Errorf("Expected question 0 name to be abc.longassdomainname.com, but got %s", m.Questions[0].Name)
+	}
+	if m.Questions[1].Name != "def.longassdomainname.com" { // Since it's a pointer, it should resolve to the same base part
+		t.Errorf("Expected question 1 name to be def.longassdomainname.com, but got %s", m.Questions[1].Name)
+	}
+	if m.Questions[1].Type != TypeA || m.Questions[1].Class != ClassINET {
+		t.Errorf("Unexpected question 1 type/class: %+v", m.Questions[1])
+	}
+}
+
+func sampleMessage() *Message {
+	return &Message{
+		Header: Header{
+			ID:                 0xBEEF,
+			Response:           true,
+			Opcode:             OpcodeQuery,
+			Authoritative:      true,
+			RecursionDesired:   true,
+			RecursionAvailable: true,
+			AuthenticData:      true,
+			RCode:              RCodeNameError,
+		},
+		Questions: []Question{
+			{Name: "www.example.com", Type: TypeA, Class: ClassINET},
+		},
+		Answers: []Resource{
+			{Name: "www.example.com", Type: TypeCNAME, Class: ClassINET, TTL: 300, Data: &CNAME{Target: "web.example.com"}},
+			{Name: "web.example.com", Type: TypeA, Class: ClassINET, TTL: 60, Data: &A{Addr: netip.MustParseAddr("192.0.2.1")}},
+			{Name: "web.example.com", Type: TypeAAAA, Class: ClassINET, TTL: 60, Data: &AAAA{Addr: netip.MustParseAddr("2001:db8::1")}},
+			{Name: "example.com", Type: TypeMX, Class: ClassINET, TTL: 3600, Data: &MX{Preference: 10, Host: "mail.example.com"}},
+			{Name: "example.com", Type: TypeTXT, Class: ClassINET, TTL: 3600, Data: &TXT{Text: []string{"v=spf1 -all", ""}}},
+			{Name: "example.com", Type: TypeHINFO, Class: ClassINET, TTL: 3600, Data: &HINFO{CPU: "RFC8482", OS: ""}},
+			{Name: "_sip._udp.example.com", Type: TypeSRV, Class: ClassINET, TTL: 3600, Data: &SRV{Priority: 10, Weight: 60, Port: 5060, Target: "web.example.com"}},
+			{Name: "example.com", Type: TypeNAPTR, Class: ClassINET, TTL: 3600, Data: &NAPTR{Order: 100, Preference: 10, Flags: "S", Services: "SIP+D2U", Replacement: "_sip._udp.example.com"}},
+			{Name: "example.com", Type: TypeCAA, Class: ClassINET, TTL: 3600, Data: &CAA{Flags: 128, Tag: "issue", Value: "letsencrypt.org; validationmethods=dns-01"}},
+			{Name: "example.com", Type: TypeHTTPS, Class: ClassINET, TTL: 300, Data: &HTTPS{SVCB{Priority: 1, Target: Root, Params: []SvcParam{
+				{Key: SvcParamALPN, Value: []byte("\x02h2\x02h3")},
+				{Key: SvcParamPort, Value: []byte{0x01, 0xbb}},
+				{Key: SvcParamIPv4Hint, Value: []byte{192, 0, 2, 1}},
+				{Key: SvcParamECH, Value: []byte{1, 2, 3}},
+				{Key: SvcParamIPv6Hint, Value: netip.MustParseAddr("2001:db8::1").AsSlice()},
+				{Key: 65001, Value: []byte("opaque")},
+			}}}},
+			{Name: "_dns.example.com", Type: TypeSVCB, Class: ClassINET, TTL: 300, Data: &SVCB{Priority: 0, Target: "web.example.com"}},
+			{Name: "1.2.0.192.in-addr.arpa", Type: TypePTR, Class: ClassINET, TTL: 3600, Data: &PTR{Host: "web.example.com"}},
+			{Name: "example.com", Type: Type(65280), Class: ClassINET, TTL: 1, Data: &Unknown{Data: []byte{1, 2, 3}}},
+		},
+		Authorities: []Resource{
+			{Name: "example.com", Type: TypeNS, Class: ClassINET, TTL: 86400, Data: &NS{Host: "ns1.example.com"}},
+			{Name: "example.com", Type: TypeSOA, Class: ClassINET, TTL: 900, Data: &SOA{
+				MName: "ns1.example.com", RName: "hostmaster.example.com",
+				Serial: 2024010101, Refresh: 7200, Retry: 3600, Expire: 1209600, Minimum: 300,
+			}},
+		},
+		Additionals: []Resource{
+			{Name: "ns1.example.com", Type: TypeA, Class: ClassINET, TTL: 86400, Data: &A{Addr: netip.MustParseAddr("192.0.2.53")}},
+			{Name: Root, Type: TypeOPT, Class: Class(1232), TTL: 0, Data: &OPT{Options: []Option{{Code: 10, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}}}}},
+		},
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	want := sampleMessage()
+
+	packed, err := want.Pack()
+	if err != nil {
+		t.Fatalf("Pack failed: %v", err)
+	}
+
+	var got Message
+	if err := got.Unpack(packed); err != nil {
+		t.Fatalf("Unpack failed: %v", err)
+	}
+	if !reflect.DeepEqual(&got, want) {
+		t.Errorf("Round trip mismatch\n got: %+v\nwant: %+v", got, *want)
+	}
+
+	repacked, err := got.Pack()
+	if err != nil {
+		t.Fatalf("Second Pack failed: %v", err)
+	}
+	if !bytes.Equal(packed, repacked) {
+		t.Errorf("Packing is not stable\n first: %v\nsecond: %v", packed, repacked)
+	}
+}
+
+func TestHeaderFlagsRoundTrip(t *testing.T) {
+	for flags := 0; flags <= 0xFFFF; flags++ {
+		// The Z bit (bit 6) is reserved and not preserved
+		if flags&(1<<6) != 0 {
+			continue
+		}
+		var h Header
+		h.setFlags(uint16(flags))
+		if got := h.flags(); got != uint16(flags) {
+			t.Fatalf("flags %016b round tripped to %016b", flags, got)
+		}
+	}
+}
+
+func TestPackCompressesNames(t *testing.T) {
+	m := &Message{
+		Questions: []Question{{Name: "www.example.com", Type: TypeA, Class: ClassINET}},
+		Answers: []Resource{
+			{Name: "www.example.com", Type: TypeA, Class: ClassINET, TTL: 60, Data: &A{Addr: netip.MustParseAddr("192.0.2.1")}},
+			{Name: "mail.example.com", Type: TypeCNAME, Class: ClassINET, TTL: 60, Data: &CNAME{Target: "www.example.com"}},
+		},
+	}
+	packed, err := m.Pack()
+	if err != nil {
+		t.Fatalf("Pack failed: %v", err)
+	}
+
+	// header + question (17 + 4) + A (2 + 10 + 4) + CNAME (7 pointer-suffixed + 10 + 2)
+	if want := 12 + 21 + 16 + 19; len(packed) != want {
+		t.Errorf("Expected compressed message of %d bytes, got %d: %v", want, len(packed), packed)
+	}
+
+	var got Message
+	if err := got.Unpack(packed); err != nil {
+		t.Fatalf("Unpack failed: %v", err)
+	}
+	if !reflect.DeepEqual(&got, m) {
+		t.Errorf("Round trip mismatch\n got: %+v\nwant: %+v", got, *m)
+	}
+}
+
+func TestPackCompressesManyNames(t *testing.T) {
+	// More names than the fixed table of the compressor holds, each repeated
+	var once, twice Message
+	for i := 0; i < 2*maxCompressed; i++ {
+		rr := Resource{Name: fmt.Sprintf("host%d.example.com", i), Type: TypeA, Class: ClassINET, TTL: 60, Data: &A{Addr: netip.MustParseAddr("192.0.2.1")}}
+		once.Answers = append(once.Answers, rr)
+		twice.Answers = append(twice.Answers, rr, rr)
+	}
+	a, err := once.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := twice.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every repeated owner name is a pointer: 2 + 10 + 4 bytes per record
+	if want := len(a) + 2*maxCompressed*16; len(b) != want {
+		t.Errorf("Expected %d bytes with every repeated name compressed, got %d", want, len(b))
+	}
+}
+
+func TestPackTrailingDot(t *testing.T) {
+	a, err := (&Message{Questions: []Question{{Name: "example.com.", Type: TypeA, Class: ClassINET}}}).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := (&Message{Questions: []Question{{Name: "example.com", Type: TypeA, Class: ClassINET}}}).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a, b) {
+		t.Errorf("Trailing dot changed the encoding: %v vs %v", a, b)
+	}
+}
+
+func TestUnpackRejectsMalformed(t *testing.T) {
+	valid, err := sampleMessage().Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every truncation of a valid message must fail cleanly
+	for i := 0; i < len(valid); i++ {
+		var m Message
+		if err := m.Unpack(valid[:i]); err == nil {
+			t.Errorf("Unpack of %d/%d bytes succeeded", i, len(valid))
+		}
+	}
+
+	tests := map[string][]byte{
+		"pointer loop":     {0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0xC0, 12, 0, 1, 0, 1},
+		"forward pointer":  {0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0xC0, 14, 0, 1, 0, 1},
+		"reserved label":   {0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0x40, 0, 0, 1, 0, 1},
+		"bad A length":     {0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 1, 0, 1, 0, 0, 0, 0, 0, 3, 1, 2, 3},
+		"label past end":   {0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 5, 'a', 'b'},
+		"rdlength overrun": {0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 16, 0, 1, 0, 0, 0, 0, 0, 9, 1, 'a'},
+		"NUL in label":     {0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 2, 'a', 0, 0, 0, 1, 0, 1},
+	}
+	for name, data := range tests {
+		var m Message
+		if err := m.Unpack(data); err == nil {
+			t.Errorf("%s: expected error, got %+v", name, m)
+		}
+	}
+}
+
+func TestRootName(t *testing.T) {
+	for _, name := range []string{"", Root} {
+		m := &Message{Questions: []Question{{Name: name, Type: TypeNS, Class: ClassINET}}}
+		packed, err := m.Pack()
+		if err != nil {
+			t.Fatalf("Pack(%q) failed: %v", name, err)
+		}
+		// header + a single zero length label + type and class
+		if !bytes.Equal(packed[12:], []byte{0, 0, 2, 0, 1}) {
+			t.Errorf("Unexpected encoding of root name %q: %v", name, packed)
+		}
+
+		var got Message
+		if err := got.Unpack(packed); err != nil {
+			t.Fatalf("Unpack failed: %v", err)
+		}
+		if got.Questions[0].Name != Root {
+			t.Errorf("Expected root to unpack as %q, got %q", Root, got.Questions[0].Name)
+		}
+		if s := got.Questions[0].String(); s != ".\tIN\tNS" {
+			t.Errorf("Unexpected presentation of root question: %q", s)
+		}
+	}
+}
+
+func TestNameEscapes(t *testing.T) {
+	// A label holding a dot, a space and a non ASCII byte survives the round trip
+	wire := []byte{7, 'a', '.', 'b', ' ', 0xC3, '\\', 'Z', 3, 'c', 'o', 'm', 0}
+	name, off, err := readName(wire, 0)
+	if err != nil || off != len(wire) {
+		t.Fatalf("readName = %q, %d, %v", name, off, err)
+	}
+	if want := `a\.b\032\195\\Z.com`; name != want {
+		t.Errorf("readName = %q, want %q", name, want)
+	}
+	packed, err := appendName(nil, name, nil)
+	if err != nil || !bytes.Equal(packed, wire) {
+		t.Errorf("appendName(%q) = %v, %v, want %v", name, packed, err, wire)
+	}
+
+	tests := map[string]string{
+		"WWW.Example.COM.":   "www.example.com",
+		`\087ww.example.com`: "www.example.com",
+		`a\.b.example.com`:   `a\.b.example.com`,
+		`a\ b.example.com`:   `a\032b.example.com`,
+		`a\\.`:               `a\\`,
+		`a\.`:                `a\.`,
+		"":                   ".",
+		".":                  ".",
+		"Bücher.example":     "xn--bcher-kva.example",
+		"例え.テスト":             "xn--r8jz45g.xn--zckzah",
+	}
+	for in, want := range tests {
+		if got, err := CanonicalName(in); err != nil || got != want {
+			t.Errorf("CanonicalName(%q) = %q, %v, want %q", in, got, err, want)
+		}
+	}
+	// Names canonical already are returned as they are
+	if allocs := testing.AllocsPerRun(100, func() { CanonicalName("www.example-1.com.") }); allocs != 0 {
+		t.Errorf("Expected no allocations for a canonical name, got %v", allocs)
+	}
+	long := strings.Repeat(strings.Repeat("a", 63)+".", 4)
+	for _, in := range []string{"a..b", "a.b..", `a\256.com`, `a\`, strings.Repeat("a", 64) + ".com", `a\000b.com`, long, "\xff.com"} {
+		if got, err := CanonicalName(in); err == nil {
+			t.Errorf("Expected CanonicalName(%q) to fail, got %q", in, got)
+		}
+	}
+}
+
+func TestUpdateRecordsWithoutData(t *testing.T) {
+	update := &Message{
+		Header:    Header{ID: 3, Opcode: OpcodeUpdate},
+		Questions: []Question{{Name: "example.com", Type: TypeSOA, Class: ClassINET}},
+		Answers:   []Resource{{Name: "www.example.com", Type: TypeA, Class: ClassANY}},
+		Authorities: []Resource{
+			{Name: "www.example.com", Type: TypeANY, Class: ClassANY},
+			{Name: "old.example.com", Type: TypeA, Class: ClassNONE, Data: &A{Addr: netip.MustParseAddr("192.0.2.1")}},
+		},
+	}
+	packed, err := update.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Message
+	if err := got.Unpack(packed); err != nil {
+		t.Fatal(err)
+	}
+	if got.Opcode != OpcodeUpdate || got.Answers[0].Data != nil || got.Authorities[0].Data != nil || got.Authorities[1].Data == nil {
+		t.Errorf("Expected the records without data to stay empty, got %+v", got)
+	}
+}
+
+func TestNameLimits(t *testing.T) {
+	// 4 labels of 63 bytes make 257 bytes on the wire
+	long := strings.Repeat(strings.Repeat("a", 63)+".", 4)
+	if _, err := appendName(nil, long, nil); err == nil {
+		t.Error("Expected appendName to reject a name over 255 bytes")
+	}
+	var wire []byte
+	for i := 0; i < 4; i++ {
+		wire = append(append(wire, 63), strings.Repeat("a", 63)...)
+	}
+	if _, _, err := readName(append(wire, 0), 0); err == nil {
+		t.Error("Expected readName to reject a name over 255 bytes")
+	}
+	if _, err := appendName(nil, `nul\000.example`, nil); err == nil {
+		t.Error("Expected a NUL byte in a label to be rejected")
+	}
+}
+
+func TestUnicodeName(t *testing.T) {
+	tests := map[string]string{
+		"xn--bcher-kva.example":  "bücher.example",
+		"xn--r8jz45g.xn--zckzah": "例え.テスト",
+		"www.example":            "www.example",
+		"xn--invalid-.example":   "xn--invalid-.example",
+	}
+	for in, want := range tests {
+		if got := UnicodeName(in); got != want {
+			t.Errorf("UnicodeName(%q) = %q, want %q", in, got, want)
+		}
+	}
+	for _, label := range []string{"münchen", "παράδειγμα", "пример", "ascii-only"} {
+		encoded, err := asciiLabel([]byte(label))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := UnicodeName(string(encoded)); got != label {
+			t.Errorf("Round trip of %q gave %q via %q", label, got, encoded)
+		}
+	}
+}
@@ -0,0 +1,358 @@
+package dnsmessage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxNameLength is the longest a name may be in wire format
+// (https://www.rfc-editor.org/rfc/rfc1035#section-2.3.4)
+const maxNameLength = 255
+
+var (
+	errNameOutOfBounds = errors.New("name: offset out of bounds")
+	errPointerLoop     = errors.New("name: compression pointer does not point backwards")
+	errLabelTooLong    = errors.New("name: label longer than 63 bytes")
+	errEmptyLabel      = errors.New("name: empty label")
+	errNULInLabel      = errors.New("name: NUL byte in label")
+	errNameTooLong     = errors.New("name: longer than 255 bytes")
+)
+
+// Root is the name of the root zone, an empty sequence of labels on the wire
+const Root = "."
+
+// maxPointerHops bounds how many compression pointers a single name may follow
+const maxPointerHops = 126
+
+// maxCompressed is the number of names a compressor records in its fixed
+// table, those past it go in a map
+const maxCompressed = 64
+
+// compressor records where the names written to a message start, so later
+// names can point at them. The first names go in a fixed table rather than
+// a map so packing a typical message doesn't allocate, only messages with
+// more names than it holds, such as large zone transfers, allocate the map.
+type compressor struct {
+	// base is the offset of the message in the buffer it is appended to
+	base  int
+	n     int
+	names [maxCompressed]string
+	offs  [maxCompressed]uint16
+	// more holds the names recorded once the table is full
+	more map[string]uint16
+}
+
+// lookup returns the offset of name in the message
+func (c *compressor) lookup(name string) (int, bool) {
+	for i := 0; i < c.n; i++ {
+		if c.names[i] == name {
+			return int(c.offs[i]), true
+		}
+	}
+	off, ok := c.more[name]
+	return int(off), ok
+}
+
+// record notes that name starts at off in the message
+func (c *compressor) record(name string, off int) {
+	// Pointers only have 14 bits available for the offset
+	if off >= 0x3FFF {
+		return
+	}
+	if c.n < maxCompressed {
+		c.names[c.n], c.offs[c.n] = name, uint16(off)
+		c.n++
+		return
+	}
+	if c.more == nil {
+		c.more = make(map[string]uint16)
+	}
+	c.more[name] = uint16(off)
+}
+
+// appendName writes name in wire format to b. When comp is not nil, suffixes already
+// present in the message are replaced by compression pointers and new suffixes are
+// recorded so later names can point at them. Escapes in name are decoded.
+// https://www.rfc-editor.org/rfc/rfc1035#section-4.1.4
+func appendName(b []byte, name string, comp *compressor) ([]byte, error) {
+	name = trimDot(name)
+	// The wire form is at most two bytes longer than the presentation form,
+	// only names that long need to be measured
+	if len(name)+2 > maxNameLength {
+		if n, err := nameLength(name); err != nil || n > maxNameLength {
+			return b, errors.Join(errNameTooLong, err)
+		}
+	}
+	for name != "" {
+		if comp != nil {
+			if ptr, ok := comp.lookup(name); ok {
+				// 0xC0 marks the two high bits, the remaining 14 bits are the offset
+				return append(b, byte(0xC0|ptr>>8), byte(ptr)), nil
+			}
+			comp.record(name, len(b)-comp.base)
+		}
+
+		// Reserve the length byte and fill it once the label is decoded
+		lengthOff := len(b)
+		packed, rest, err := appendLabel(append(b, 0), name)
+		if err != nil {
+			return b, err
+		}
+		b = packed
+		b[lengthOff] = byte(len(b) - lengthOff - 1)
+		name = rest
+	}
+	return append(b, 0), nil
+}
+
+// nameLength returns the length of a name in uncompressed wire format
+func nameLength(name string) (int, error) {
+	n := 1
+	for name = trimDot(name); name != ""; {
+		label, rest, err := nextLabel(name)
+		if err != nil {
+			return 0, err
+		}
+		n += 1 + len(label)
+		name = rest
+	}
+	return n, nil
+}
+
+// trimDot drops the trailing dot of an absolute name, unless it is escaped
+func trimDot(name string) string {
+	if !strings.HasSuffix(name, ".") {
+		return name
+	}
+	backslashes := 0
+	for i := len(name) - 2; i >= 0 && name[i] == '\\'; i-- {
+		backslashes++
+	}
+	if backslashes%2 == 1 {
+		return name
+	}
+	return name[:len(name)-1]
+}
+
+// nextLabel splits the first label off a name in presentation format and
+// decodes its \c and \DDD escapes. Labels written in Unicode, with bytes
+// beyond ASCII that are not escaped, are turned into their A-label. Labels
+// holding a NUL byte are rejected, no name in use has one and they only serve
+// to confuse software handling names as C strings.
+func nextLabel(name string) (label []byte, rest string, err error) {
+	return appendLabel(nil, name)
+}
+
+// appendLabel is nextLabel decoding the label onto the end of b, so packing
+// a name doesn't allocate a buffer per label
+func appendLabel(b []byte, name string) (_ []byte, rest string, err error) {
+	start := len(b)
+	unicode := false
+scan:
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c == '.':
+			// The trailing dot of an absolute name is trimmed before, so
+			// a dot at the end is followed by an empty label
+			if len(b) == start || i == len(name)-1 {
+				return nil, "", errEmptyLabel
+			}
+			rest = name[i+1:]
+			break scan
+		case c != '\\':
+			unicode = unicode || c >= utf8.RuneSelf
+			b = append(b, c)
+		case i+3 < len(name) && isDigit(name[i+1]) && isDigit(name[i+2]) && isDigit(name[i+3]):
+			n := int(name[i+1]-'0')*100 + int(name[i+2]-'0')*10 + int(name[i+3]-'0')
+			if n > 255 {
+				return nil, "", fmt.Errorf("name: invalid escape \\%s", name[i+1:i+4])
+			}
+			b = append(b, byte(n))
+			i += 3
+		case i+1 < len(name):
+			b = append(b, name[i+1])
+			i++
+		default:
+			return nil, "", errors.New("name: trailing backslash")
+		}
+	}
+	label := b[start:]
+	if len(label) == 0 {
+		return nil, "", errEmptyLabel
+	}
+	if bytes.IndexByte(label, 0) >= 0 {
+		return nil, "", errNULInLabel
+	}
+	if unicode {
+		if label, err = asciiLabel(label); err != nil {
+			return nil, "", err
+		}
+		b = append(b[:start], label...)
+	}
+	if len(b)-start > 63 {
+		return nil, "", errLabelTooLong
+	}
+	return b, rest, nil
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+// appendEscapedLabel writes a label read off the wire in presentation format:
+// dots and backslashes are escaped with a backslash, bytes outside of
+// printable ASCII and the space as \DDD
+func appendEscapedLabel(sb *strings.Builder, label []byte) {
+	for _, c := range label {
+		switch {
+		case c == '.' || c == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c <= ' ' || c >= 0x7F:
+			fmt.Fprintf(sb, "\\%03d", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+}
+
+// CanonicalName returns name in the form names are compared and looked up in:
+// ASCII letters in lower case, no trailing dot and escapes only where they are
+// required, the root being ".". Names from the wire are already escaped that
+// way, except for the case. Unicode labels become A-labels, and names that
+// don't fit the limits of the wire format are rejected.
+func CanonicalName(name string) (string, error) {
+	name = trimDot(name)
+	if name == "" {
+		return Root, nil
+	}
+	if isCanonical(name) {
+		return name, nil
+	}
+	var sb strings.Builder
+	sb.Grow(len(name))
+	length := 1
+	for name != "" {
+		label, rest, err := nextLabel(name)
+		if err != nil {
+			return "", err
+		}
+		if length += 1 + len(label); length > maxNameLength {
+			return "", errNameTooLong
+		}
+		for i, c := range label {
+			if c >= 'A' && c <= 'Z' {
+				label[i] = c + 'a' - 'A'
+			}
+		}
+		if sb.Len() > 0 {
+			sb.WriteByte('.')
+		}
+		appendEscapedLabel(&sb, label)
+		name = rest
+	}
+	return sb.String(), nil
+}
+
+// isCanonical reports whether name, its trailing dot trimmed, is canonical
+// already: lower case letters, digits, hyphens and underscores in labels within
+// the limits of the wire format. Most names are, they are returned as they are
+// instead of being copied.
+func isCanonical(name string) bool {
+	// The wire form is two bytes longer, the length of the first label and
+	// the root label
+	if len(name)+2 > maxNameLength {
+		return false
+	}
+	start := 0
+	for i := 0; i <= len(name); i++ {
+		if i == len(name) || name[i] == '.' {
+			if n := i - start; n == 0 || n > 63 {
+				return false
+			}
+			start = i + 1
+			continue
+		}
+		if c := name[i]; !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// readName reads a possibly compressed name starting at off and returns it together
+// with the offset right after the name in the original position (pointers are not
+// followed for the returned offset).
+func readName(msg []byte, off int) (string, int, error) {
+	var sb strings.Builder
+	end := -1
+	hops := 0
+	// length counts the bytes of the name, the terminating zero included
+	length := 1
+
+	for {
+		if off >= len(msg) {
+			return "", 0, errNameOutOfBounds
+		}
+		labelLength := int(msg[off])
+
+		switch labelLength & 0xC0 {
+		case 0x00:
+			if labelLength == 0 {
+				if end < 0 {
+					end = off + 1
+				}
+				if sb.Len() == 0 {
+					return Root, end, nil
+				}
+				return sb.String(), end, nil
+			}
+			if off+1+labelLength > len(msg) {
+				return "", 0, errNameOutOfBounds
+			}
+			if length += 1 + labelLength; length > maxNameLength {
+				return "", 0, errNameTooLong
+			}
+			// Names that can't be packed again are rejected as they are read
+			if bytes.IndexByte(msg[off+1:off+1+labelLength], 0) >= 0 {
+				return "", 0, errNULInLabel
+			}
+			if sb.Len() > 0 {
+				sb.WriteByte('.')
+			}
+			appendEscapedLabel(&sb, msg[off+1:off+1+labelLength])
+			off += 1 + labelLength
+		case 0xC0:
+			if off+1 >= len(msg) {
+				return "", 0, errNameOutOfBounds
+			}
+			// Logical AND to strip first two bits (0x3FFF = 0011111111111111)
+			ptr := (labelLength&0x3F)<<8 | int(msg[off+1])
+			// Only allow pointers to earlier positions, which rules out loops
+			if ptr >= off || hops >= maxPointerHops {
+				return "", 0, errPointerLoop
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			hops++
+			off = ptr
+		default:
+			// 0x40 and 0x80 are reserved label types (https://www.rfc-editor.org/rfc/rfc6891#section-5)
+			return "", 0, errors.New("name: unsupported label type")
+		}
+	}
+}
+
+// FQDN returns name in absolute presentation form, with a single trailing dot
+func FQDN(name string) string {
+	if name == "" || name == Root {
+		return Root
+	}
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
@@ -0,0 +1,215 @@
+package dnsmessage
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// ParseRData parses the master file presentation format of a payload of type t,
+// the inverse of RData.String. The generic RFC 3597 form "\# <length> <hex>"
+// is accepted for every type. Names are taken as they are written, there is no
+// origin to complete relative names with.
+func ParseRData(t Type, s string) (RData, error) {
+	return ParseRDataIn(t, s, "")
+}
+
+// ParseRDataIn is ParseRData for a zone file with the given origin: names
+// without a trailing dot are relative to it and "@" is the origin itself.
+func ParseRDataIn(t Type, s, origin string) (RData, error) {
+	fields, err := splitFields(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) > 0 && fields[0] == `\#` {
+		return parseGeneric(t, fields[1:])
+	}
+
+	if codec := registeredCodec(t); codec != nil {
+		rd, err := codec.Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("rdata: %s: %w", t, err)
+		}
+		return rd, nil
+	}
+
+	want := map[Type]int{TypeA: 1, TypeAAAA: 1, TypeNS: 1, TypeCNAME: 1, TypePTR: 1, TypeMX: 2, TypeHINFO: 2, TypeSRV: 4, TypeNAPTR: 6, TypeCAA: 3, TypeSOA: 7}
+	if n, ok := want[t]; ok && len(fields) != n {
+		return nil, fmt.Errorf("rdata: %s expects %d fields, got %q", t, n, s)
+	}
+	switch t {
+	case TypeA, TypeAAAA:
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("rdata: %w", err)
+		}
+		if t == TypeA {
+			if !addr.Is4() {
+				return nil, fmt.Errorf("rdata: A record requires an IPv4 address, got %s", addr)
+			}
+			return &A{Addr: addr}, nil
+		}
+		if !addr.Is6() || addr.Is4In6() {
+			return nil, fmt.Errorf("rdata: AAAA record requires an IPv6 address, got %s", addr)
+		}
+		return &AAAA{Addr: addr}, nil
+	case TypeNS:
+		return &NS{Host: JoinName(fields[0], origin)}, nil
+	case TypeCNAME:
+		return &CNAME{Target: JoinName(fields[0], origin)}, nil
+	case TypePTR:
+		return &PTR{Host: JoinName(fields[0], origin)}, nil
+	case TypeMX:
+		pref, err := strconv.ParseUint(fields[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("rdata: invalid MX preference %q", fields[0])
+		}
+		return &MX{Preference: uint16(pref), Host: JoinName(fields[1], origin)}, nil
+	case TypeTXT:
+		strs, err := unquoteFields(t, fields)
+		if err != nil {
+			return nil, err
+		}
+		return &TXT{Text: strs}, nil
+	case TypeHINFO:
+		strs, err := unquoteFields(t, fields)
+		if err != nil {
+			return nil, err
+		}
+		return &HINFO{CPU: strs[0], OS: strs[1]}, nil
+	case TypeSRV:
+		var n [3]uint64
+		for i := range n {
+			if n[i], err = parseUint(fields[i], 16); err != nil {
+				return nil, err
+			}
+		}
+		return &SRV{Priority: uint16(n[0]), Weight: uint16(n[1]), Port: uint16(n[2]), Target: JoinName(fields[3], origin)}, nil
+	case TypeNAPTR:
+		order, err := parseUint(fields[0], 16)
+		if err != nil {
+			return nil, err
+		}
+		pref, err := parseUint(fields[1], 16)
+		if err != nil {
+			return nil, err
+		}
+		strs, err := unquoteFields(t, fields[2:5])
+		if err != nil {
+			return nil, err
+		}
+		return &NAPTR{Order: uint16(order), Preference: uint16(pref), Flags: strs[0], Services: strs[1], Regexp: strs[2], Replacement: JoinName(fields[5], origin)}, nil
+	case TypeCAA:
+		flags, err := parseUint(fields[0], 8)
+		if err != nil {
+			return nil, err
+		}
+		if !validCAATag(fields[1]) {
+			return nil, fmt.Errorf("rdata: invalid CAA tag %q", fields[1])
+		}
+		value, err := unquoteFields(t, fields[2:])
+		if err != nil {
+			return nil, err
+		}
+		return &CAA{Flags: uint8(flags), Tag: fields[1], Value: value[0]}, nil
+	case TypeSVCB, TypeHTTPS:
+		return parseSVCB(t, fields, origin)
+	case TypeSOA:
+		soa := &SOA{MName: JoinName(fields[0], origin), RName: JoinName(fields[1], origin)}
+		for i, v := range []*uint32{&soa.Serial, &soa.Refresh, &soa.Retry, &soa.Expire, &soa.Minimum} {
+			n, err := strconv.ParseUint(fields[2+i], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("rdata: invalid SOA number %q", fields[2+i])
+			}
+			*v = uint32(n)
+		}
+		return soa, nil
+	case TypeDS, TypeRRSIG, TypeNSEC, TypeDNSKEY, TypeNSEC3, TypeNSEC3PARAM:
+		return parseDNSSEC(t, fields, origin)
+	}
+	return nil, fmt.Errorf("rdata: no presentation format for %s, use \\# <length> <hex>", t)
+}
+
+// JoinName completes name as written in a zone file with origin: "@" is the
+// origin, names with a trailing dot are absolute and others relative to it. An
+// empty origin takes every name as absolute. The result has no trailing dot.
+func JoinName(name, origin string) string {
+	switch {
+	case name == Root:
+		return Root
+	case name == "@" && origin != "":
+		return origin
+	case strings.HasSuffix(name, "."), origin == "":
+		return strings.TrimSuffix(name, ".")
+	case origin == Root:
+		return name
+	}
+	return name + "." + strings.TrimSuffix(origin, ".")
+}
+
+// parseGeneric decodes the RFC 3597 fields following \#
+func parseGeneric(t Type, fields []string) (RData, error) {
+	if len(fields) == 0 {
+		return nil, errors.New(`rdata: \# requires a length`)
+	}
+	length, err := strconv.Atoi(fields[0])
+	if err != nil || length < 0 || length > 0xFFFF {
+		return nil, fmt.Errorf("rdata: invalid length %q", fields[0])
+	}
+	data, err := hex.DecodeString(strings.Join(fields[1:], ""))
+	if err != nil {
+		return nil, fmt.Errorf("rdata: %w", err)
+	}
+	if len(data) != length {
+		return nil, errRDataLength
+	}
+	// Known types are decoded into their codec, the data holds no compression pointers
+	return unpackRData(data, 0, len(data), t)
+}
+
+// unquoteFields returns fields with the quotes of quoted character strings
+// removed
+func unquoteFields(t Type, fields []string) ([]string, error) {
+	strs := make([]string, len(fields))
+	for i, f := range fields {
+		if strings.HasPrefix(f, `"`) {
+			var err error
+			if f, err = strconv.Unquote(f); err != nil {
+				return nil, fmt.Errorf("rdata: invalid %s string: %w", t, err)
+			}
+		}
+		strs[i] = f
+	}
+	return strs, nil
+}
+
+// splitFields splits s at whitespace, keeping quoted strings with their quotes
+func splitFields(s string) ([]string, error) {
+	var fields []string
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		if s[0] != '"' {
+			end := strings.IndexAny(s, " \t")
+			if end < 0 {
+				end = len(s)
+			}
+			fields = append(fields, s[:end])
+			s = s[end:]
+			continue
+		}
+		end := 1
+		for ; end < len(s) && s[end] != '"'; end++ {
+			if s[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(s) {
+			return nil, fmt.Errorf("rdata: unterminated string in %q", s)
+		}
+		fields = append(fields, s[:end+1])
+		s = s[end+1:]
+	}
+	return fields, nil
+}
@@ -0,0 +1,113 @@
+package dnsmessage
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRDataRoundTrip(t *testing.T) {
+	m := sampleMessage()
+	for _, r := range append(append(m.Answers, m.Authorities...), m.Additionals[0]) {
+		got, err := ParseRData(r.Type, r.Data.String())
+		if err != nil {
+			t.Errorf("%s: %v", r, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, r.Data) {
+			t.Errorf("%s: parsed %#v, want %#v", r.Type, got, r.Data)
+		}
+	}
+}
+
+func TestParseRData(t *testing.T) {
+	tests := []struct {
+		t    Type
+		in   string
+		want RData
+	}{
+		{TypeTXT, `"quoted \"text\"" plain`, &TXT{Text: []string{`quoted "text"`, "plain"}}},
+		{TypeNS, ".", &NS{Host: Root}},
+		{TypeA, `\# 4 C0000201`, mustParse(t, TypeA, "192.0.2.1")},
+		{TypeMX, `\# 8 000a 046d61696c 00`, &MX{Preference: 10, Host: "mail"}},
+		{TypeCAA, `0 iodef "mailto:security@example.com"`, &CAA{Tag: "iodef", Value: "mailto:security@example.com"}},
+		{TypeHTTPS, `1 . port=8443 alpn=h3,h2 no-default-alpn mandatory=port,alpn`, &HTTPS{SVCB{Priority: 1, Target: Root, Params: []SvcParam{
+			{Key: SvcParamMandatory, Value: []byte{0, 3, 0, 1}},
+			{Key: SvcParamALPN, Value: []byte("\x02h3\x02h2")},
+			{Key: SvcParamNoDefaultALPN},
+			{Key: SvcParamPort, Value: []byte{0x20, 0xfb}},
+		}}}},
+	}
+	for _, tt := range tests {
+		got, err := ParseRData(tt.t, tt.in)
+		if err != nil {
+			t.Errorf("%s %q: %v", tt.t, tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s %q: parsed %#v, want %#v", tt.t, tt.in, got, tt.want)
+		}
+	}
+
+	for _, bad := range []struct {
+		t  Type
+		in string
+	}{
+		{TypeA, "2001:db8::1"},
+		{TypeAAAA, "192.0.2.1"},
+		{TypeMX, "mail.example.com"},
+		{TypeSOA, "ns1 hostmaster 1 2 3 4"},
+		{TypeTXT, `"unterminated`},
+		{TypeA, `\# 5 C0000201`},
+		{TypeOPT, "10:00"},
+		{TypeSRV, "10 60 5060"},
+		{TypeCAA, `0 is-sue "ca.example"`},
+		{TypeHTTPS, "1 . port=1 port=2"},
+		{TypeHTTPS, "1 . ipv4hint=2001:db8::1"},
+		{TypeSVCB, "1 . unknownkey=1"},
+	} {
+		if _, err := ParseRData(bad.t, bad.in); err == nil {
+			t.Errorf("%s %q: expected an error", bad.t, bad.in)
+		}
+	}
+}
+
+func mustParse(t *testing.T, typ Type, s string) RData {
+	t.Helper()
+	r, err := ParseRData(typ, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestParseTypeClassRCode(t *testing.T) {
+	if c, err := ParseClass("CH"); err != nil || c != ClassCHAOS {
+		t.Errorf("ParseClass(CH) = %v, %v", c, err)
+	}
+	if c, err := ParseClass("CLASS1232"); err != nil || c != Class(1232) {
+		t.Errorf("ParseClass(CLASS1232) = %v, %v", c, err)
+	}
+	if r, err := ParseRCode("NXDOMAIN"); err != nil || r != RCodeNameError {
+		t.Errorf("ParseRCode(NXDOMAIN) = %v, %v", r, err)
+	}
+	if _, err := ParseRCode("RCODE16"); err == nil {
+		t.Error("Expected RCODE16 to be out of range")
+	}
+}
+
+func TestJoinName(t *testing.T) {
+	tests := []struct{ name, origin, want string }{
+		{"www", "example.com", "www.example.com"},
+		{"www", "example.com.", "www.example.com"},
+		{"@", "example.com", "example.com"},
+		{"www.example.net.", "example.com", "www.example.net"},
+		{"www", "", "www"},
+		{"www", ".", "www"},
+		{".", "example.com", "."},
+	}
+	for _, tt := range tests {
+		if got := JoinName(tt.name, tt.origin); got != tt.want {
+			t.Errorf("JoinName(%q, %q) = %q, want %q", tt.name, tt.origin, got, tt.want)
+		}
+	}
+}
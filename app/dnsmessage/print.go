@@ -0,0 +1,56 @@
+package dnsmessage
+
+import (
+	"fmt"
+	"strings"
+)
+
+// String returns the message in the layout dig uses for its output
+func (m *Message) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, ";; ->>HEADER<<- opcode: %s, status: %s, id: %d\n", m.Opcode, m.RCode, m.ID)
+
+	var flags []string
+	for _, f := range []struct {
+		set  bool
+		name string
+	}{
+		{m.Response, "qr"},
+		{m.Authoritative, "aa"},
+		{m.Truncated, "tc"},
+		{m.RecursionDesired, "rd"},
+		{m.RecursionAvailable, "ra"},
+		{m.AuthenticData, "ad"},
+		{m.CheckingDisabled, "cd"},
+	} {
+		if f.set {
+			flags = append(flags, f.name)
+		}
+	}
+	fmt.Fprintf(&sb, ";; flags: %s; QUERY: %d, ANSWER: %d, AUTHORITY: %d, ADDITIONAL: %d\n",
+		strings.Join(flags, " "), len(m.Questions), len(m.Answers), len(m.Authorities), len(m.Additionals))
+
+	if len(m.Questions) > 0 {
+		sb.WriteString("\n;; QUESTION SECTION:\n")
+		for _, q := range m.Questions {
+			sb.WriteString(";" + q.String() + "\n")
+		}
+	}
+	for _, section := range []struct {
+		name    string
+		records []Resource
+	}{
+		{"ANSWER", m.Answers},
+		{"AUTHORITY", m.Authorities},
+		{"ADDITIONAL", m.Additionals},
+	} {
+		if len(section.records) == 0 {
+			continue
+		}
+		fmt.Fprintf(&sb, "\n;; %s SECTION:\n", section.name)
+		for _, r := range section.records {
+			sb.WriteString(r.String() + "\n")
+		}
+	}
+	return sb.String()
+}
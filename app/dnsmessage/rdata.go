@@ -0,0 +1,474 @@
+package dnsmessage
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+var errRDataLength = errors.New("rdata: length does not match record type")
+
+// RData is the type specific payload of a resource record. The payloads of the
+// built in types pack themselves, those of types added with RegisterType are
+// packed by their Codec.
+type RData interface {
+	// String returns the payload in master file presentation format
+	String() string
+}
+
+// packer is implemented by the payloads of the built in types whose names
+// are never compressed, packRData packs those that are
+type packer interface {
+	// pack appends the wire form of the payload to b, the message written so far
+	pack(b []byte) ([]byte, error)
+}
+
+// A is an IPv4 host address (https://www.rfc-editor.org/rfc/rfc1035#section-3.4.1)
+type A struct {
+	Addr netip.Addr
+}
+
+func (r *A) pack(b []byte) ([]byte, error) {
+	if !r.Addr.Is4() {
+		return b, fmt.Errorf("rdata: A record requires an IPv4 address, got %s", r.Addr)
+	}
+	ip := r.Addr.As4()
+	return append(b, ip[:]...), nil
+}
+
+func (r *A) String() string { return r.Addr.String() }
+
+// AAAA is an IPv6 host address (https://www.rfc-editor.org/rfc/rfc3596#section-2.2)
+type AAAA struct {
+	Addr netip.Addr
+}
+
+func (r *AAAA) pack(b []byte) ([]byte, error) {
+	if !r.Addr.Is6() {
+		return b, fmt.Errorf("rdata: AAAA record requires an IPv6 address, got %s", r.Addr)
+	}
+	ip := r.Addr.As16()
+	return append(b, ip[:]...), nil
+}
+
+func (r *AAAA) String() string { return r.Addr.String() }
+
+// NS is an authoritative name server for a zone
+type NS struct {
+	Host string
+}
+
+func (r *NS) pack(b []byte, comp *compressor) ([]byte, error) {
+	return appendName(b, r.Host, comp)
+}
+
+func (r *NS) String() string { return FQDN(r.Host) }
+
+// CNAME is the canonical name of an alias
+type CNAME struct {
+	Target string
+}
+
+func (r *CNAME) pack(b []byte, comp *compressor) ([]byte, error) {
+	return appendName(b, r.Target, comp)
+}
+
+func (r *CNAME) String() string { return FQDN(r.Target) }
+
+// PTR points to another location in the name space, mostly used for reverse lookups
+type PTR struct {
+	Host string
+}
+
+func (r *PTR) pack(b []byte, comp *compressor) ([]byte, error) {
+	return appendName(b, r.Host, comp)
+}
+
+func (r *PTR) String() string { return FQDN(r.Host) }
+
+// MX is a mail exchange for the owner name
+type MX struct {
+	Preference uint16
+	Host       string
+}
+
+func (r *MX) pack(b []byte, comp *compressor) ([]byte, error) {
+	b = binary.BigEndian.AppendUint16(b, r.Preference)
+	return appendName(b, r.Host, comp)
+}
+
+func (r *MX) String() string { return fmt.Sprintf("%d %s", r.Preference, FQDN(r.Host)) }
+
+// TXT holds one or more character strings
+type TXT struct {
+	Text []string
+}
+
+func (r *TXT) pack(b []byte) ([]byte, error) {
+	for _, s := range r.Text {
+		if len(s) > 255 {
+			return b, errors.New("rdata: TXT character string longer than 255 bytes")
+		}
+		b = append(b, byte(len(s)))
+		b = append(b, s...)
+	}
+	return b, nil
+}
+
+func (r *TXT) String() string {
+	quoted := make([]string, len(r.Text))
+	for i, s := range r.Text {
+		quoted[i] = strconv.Quote(s)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// HINFO describes the hardware and operating system of a host
+// (https://www.rfc-editor.org/rfc/rfc1035#section-3.3.2)
+type HINFO struct {
+	CPU string
+	OS  string
+}
+
+func (r *HINFO) pack(b []byte) ([]byte, error) {
+	for _, s := range []string{r.CPU, r.OS} {
+		if len(s) > 255 {
+			return b, errors.New("rdata: HINFO character string longer than 255 bytes")
+		}
+		b = append(b, byte(len(s)))
+		b = append(b, s...)
+	}
+	return b, nil
+}
+
+func (r *HINFO) String() string { return strconv.Quote(r.CPU) + " " + strconv.Quote(r.OS) }
+
+// SRV locates the servers of a service (https://www.rfc-editor.org/rfc/rfc2782)
+type SRV struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	// Target is never compressed
+	Target string
+}
+
+func (r *SRV) pack(b []byte) ([]byte, error) {
+	b = binary.BigEndian.AppendUint16(b, r.Priority)
+	b = binary.BigEndian.AppendUint16(b, r.Weight)
+	b = binary.BigEndian.AppendUint16(b, r.Port)
+	return appendName(b, r.Target, nil)
+}
+
+func (r *SRV) String() string {
+	return fmt.Sprintf("%d %d %d %s", r.Priority, r.Weight, r.Port, FQDN(r.Target))
+}
+
+// NAPTR is a rewrite rule of the Dynamic Delegation Discovery System
+// (https://www.rfc-editor.org/rfc/rfc3403#section-4)
+type NAPTR struct {
+	Order      uint16
+	Preference uint16
+	Flags      string
+	Services   string
+	Regexp     string
+	// Replacement is never compressed, the root when Regexp is used instead
+	Replacement string
+}
+
+func (r *NAPTR) pack(b []byte) ([]byte, error) {
+	b = binary.BigEndian.AppendUint16(b, r.Order)
+	b = binary.BigEndian.AppendUint16(b, r.Preference)
+	for _, s := range []string{r.Flags, r.Services, r.Regexp} {
+		if len(s) > 255 {
+			return b, errors.New("rdata: NAPTR character string longer than 255 bytes")
+		}
+		b = append(b, byte(len(s)))
+		b = append(b, s...)
+	}
+	return appendName(b, r.Replacement, nil)
+}
+
+func (r *NAPTR) String() string {
+	return fmt.Sprintf("%d %d %s %s %s %s", r.Order, r.Preference, strconv.Quote(r.Flags), strconv.Quote(r.Services), strconv.Quote(r.Regexp), FQDN(r.Replacement))
+}
+
+// CAA tells which certificate authorities may issue certificates for the
+// owner name (https://www.rfc-editor.org/rfc/rfc8659#section-4)
+type CAA struct {
+	Flags uint8
+	// Tag is the property, such as issue, issuewild or iodef
+	Tag   string
+	Value string
+}
+
+func (r *CAA) pack(b []byte) ([]byte, error) {
+	if !validCAATag(r.Tag) {
+		return b, fmt.Errorf("rdata: invalid CAA tag %q", r.Tag)
+	}
+	b = append(b, r.Flags, byte(len(r.Tag)))
+	b = append(b, r.Tag...)
+	return append(b, r.Value...), nil
+}
+
+func (r *CAA) String() string {
+	return fmt.Sprintf("%d %s %s", r.Flags, r.Tag, strconv.Quote(r.Value))
+}
+
+// validCAATag reports whether tag is 1 to 15 ASCII letters and digits
+func validCAATag(tag string) bool {
+	if len(tag) == 0 || len(tag) > 15 {
+		return false
+	}
+	for _, c := range []byte(tag) {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// readCharacterStrings splits data into length prefixed character strings
+func readCharacterStrings(data []byte) ([]string, error) {
+	var strs []string
+	for i := 0; i < len(data); {
+		l := int(data[i])
+		if i+1+l > len(data) {
+			return nil, errRDataLength
+		}
+		strs = append(strs, string(data[i+1:i+1+l]))
+		i += 1 + l
+	}
+	return strs, nil
+}
+
+// SOA marks the start of a zone of authority (https://www.rfc-editor.org/rfc/rfc1035#section-3.3.13)
+type SOA struct {
+	MName   string
+	RName   string
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minimum uint32
+}
+
+func (r *SOA) pack(b []byte, comp *compressor) ([]byte, error) {
+	var err error
+	if b, err = appendName(b, r.MName, comp); err != nil {
+		return b, err
+	}
+	if b, err = appendName(b, r.RName, comp); err != nil {
+		return b, err
+	}
+	b = binary.BigEndian.AppendUint32(b, r.Serial)
+	b = binary.BigEndian.AppendUint32(b, r.Refresh)
+	b = binary.BigEndian.AppendUint32(b, r.Retry)
+	b = binary.BigEndian.AppendUint32(b, r.Expire)
+	b = binary.BigEndian.AppendUint32(b, r.Minimum)
+	return b, nil
+}
+
+func (r *SOA) String() string {
+	return fmt.Sprintf("%s %s %d %d %d %d %d", FQDN(r.MName), FQDN(r.RName), r.Serial, r.Refresh, r.Retry, r.Expire, r.Minimum)
+}
+
+// Option is a single EDNS(0) option carried inside an OPT record
+type Option struct {
+	Code uint16
+	Data []byte
+}
+
+// OPT is the EDNS(0) pseudo record (https://www.rfc-editor.org/rfc/rfc6891#section-6.1.2)
+type OPT struct {
+	Options []Option
+}
+
+func (r *OPT) pack(b []byte) ([]byte, error) {
+	for _, o := range r.Options {
+		b = binary.BigEndian.AppendUint16(b, o.Code)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(o.Data)))
+		b = append(b, o.Data...)
+	}
+	return b, nil
+}
+
+func (r *OPT) String() string {
+	parts := make([]string, len(r.Options))
+	for i, o := range r.Options {
+		parts[i] = fmt.Sprintf("%d:%s", o.Code, hex.EncodeToString(o.Data))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Unknown carries the raw payload of a type this package has no codec for
+type Unknown struct {
+	Data []byte
+}
+
+func (r *Unknown) pack(b []byte) ([]byte, error) {
+	return append(b, r.Data...), nil
+}
+
+// String uses the generic RFC 3597 presentation format
+func (r *Unknown) String() string {
+	return fmt.Sprintf("\\# %d %s", len(r.Data), hex.EncodeToString(r.Data))
+}
+
+// unpackRData decodes the length bytes of RDATA starting at off. Names inside the
+// payload may point anywhere in msg, so the whole message is required.
+func unpackRData(msg []byte, off, length int, t Type) (RData, error) {
+	end := off + length
+	if end > len(msg) {
+		return nil, errRDataLength
+	}
+	data := msg[off:end]
+
+	switch t {
+	case TypeA:
+		if length != 4 {
+			return nil, errRDataLength
+		}
+		return &A{Addr: netip.AddrFrom4([4]byte(data))}, nil
+	case TypeAAAA:
+		if length != 16 {
+			return nil, errRDataLength
+		}
+		return &AAAA{Addr: netip.AddrFrom16([16]byte(data))}, nil
+	case TypeNS, TypeCNAME, TypePTR:
+		name, n, err := readName(msg[:end], off)
+		if err != nil {
+			return nil, err
+		}
+		if n != end {
+			return nil, errRDataLength
+		}
+		switch t {
+		case TypeNS:
+			return &NS{Host: name}, nil
+		case TypeCNAME:
+			return &CNAME{Target: name}, nil
+		}
+		return &PTR{Host: name}, nil
+	case TypeMX:
+		if length < 3 {
+			return nil, errRDataLength
+		}
+		name, n, err := readName(msg[:end], off+2)
+		if err != nil {
+			return nil, err
+		}
+		if n != end {
+			return nil, errRDataLength
+		}
+		return &MX{Preference: binary.BigEndian.Uint16(data), Host: name}, nil
+	case TypeTXT:
+		strs, err := readCharacterStrings(data)
+		if err != nil {
+			return nil, err
+		}
+		return &TXT{Text: strs}, nil
+	case TypeHINFO:
+		strs, err := readCharacterStrings(data)
+		if err != nil {
+			return nil, err
+		}
+		if len(strs) != 2 {
+			return nil, errRDataLength
+		}
+		return &HINFO{CPU: strs[0], OS: strs[1]}, nil
+	case TypeSRV:
+		if length < 7 {
+			return nil, errRDataLength
+		}
+		target, n, err := readName(msg[:end], off+6)
+		if err != nil {
+			return nil, err
+		}
+		if n != end {
+			return nil, errRDataLength
+		}
+		return &SRV{Priority: binary.BigEndian.Uint16(data), Weight: binary.BigEndian.Uint16(data[2:]), Port: binary.BigEndian.Uint16(data[4:]), Target: target}, nil
+	case TypeNAPTR:
+		if length < 8 {
+			return nil, errRDataLength
+		}
+		naptr := &NAPTR{Order: binary.BigEndian.Uint16(data), Preference: binary.BigEndian.Uint16(data[2:])}
+		n := off + 4
+		for _, s := range []*string{&naptr.Flags, &naptr.Services, &naptr.Regexp} {
+			if n >= end || n+1+int(msg[n]) > end {
+				return nil, errRDataLength
+			}
+			*s = string(msg[n+1 : n+1+int(msg[n])])
+			n += 1 + int(msg[n])
+		}
+		var err error
+		if naptr.Replacement, n, err = readName(msg[:end], n); err != nil {
+			return nil, err
+		}
+		if n != end {
+			return nil, errRDataLength
+		}
+		return naptr, nil
+	case TypeCAA:
+		if length < 2 || 2+int(data[1]) > length {
+			return nil, errRDataLength
+		}
+		caa := &CAA{Flags: data[0], Tag: string(data[2 : 2+data[1]]), Value: string(data[2+data[1]:])}
+		if !validCAATag(caa.Tag) {
+			return nil, fmt.Errorf("rdata: invalid CAA tag %q", caa.Tag)
+		}
+		return caa, nil
+	case TypeSVCB, TypeHTTPS:
+		return unpackSVCB(msg[:end], off, t)
+	case TypeSOA:
+		var soa SOA
+		var err error
+		n := off
+		if soa.MName, n, err = readName(msg[:end], n); err != nil {
+			return nil, err
+		}
+		if soa.RName, n, err = readName(msg[:end], n); err != nil {
+			return nil, err
+		}
+		if end-n != 20 {
+			return nil, errRDataLength
+		}
+		soa.Serial = binary.BigEndian.Uint32(msg[n:])
+		soa.Refresh = binary.BigEndian.Uint32(msg[n+4:])
+		soa.Retry = binary.BigEndian.Uint32(msg[n+8:])
+		soa.Expire = binary.BigEndian.Uint32(msg[n+12:])
+		soa.Minimum = binary.BigEndian.Uint32(msg[n+16:])
+		return &soa, nil
+	case TypeOPT:
+		var opt OPT
+		for i := 0; i < len(data); {
+			if i+4 > len(data) {
+				return nil, errRDataLength
+			}
+			code := binary.BigEndian.Uint16(data[i:])
+			l := int(binary.BigEndian.Uint16(data[i+2:]))
+			if i+4+l > len(data) {
+				return nil, errRDataLength
+			}
+			opt.Options = append(opt.Options, Option{Code: code, Data: append([]byte(nil), data[i+4:i+4+l]...)})
+			i += 4 + l
+		}
+		return &opt, nil
+	case TypeTSIG:
+		return unpackTSIG(msg[:end], off)
+	case TypeDS, TypeRRSIG, TypeNSEC, TypeDNSKEY, TypeNSEC3, TypeNSEC3PARAM:
+		return unpackDNSSEC(msg, off, length, t)
+	}
+	if codec := registeredCodec(t); codec != nil {
+		rd, err := codec.Unpack(append([]byte(nil), data...))
+		if err != nil {
+			return nil, fmt.Errorf("rdata: %s: %w", t, err)
+		}
+		return rd, nil
+	}
+	return &Unknown{Data: append([]byte(nil), data...)}, nil
+}
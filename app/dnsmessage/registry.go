@@ -0,0 +1,118 @@
+package dnsmessage
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Codec converts the payload of a type registered with RegisterType between
+// the wire format and the values stored in Resource.Data
+type Codec interface {
+	// Pack appends the wire form of data to b. Names must not be compressed,
+	// see https://www.rfc-editor.org/rfc/rfc3597#section-4
+	Pack(b []byte, data RData) ([]byte, error)
+	// Unpack decodes a payload in wire format, the codec may keep data
+	Unpack(data []byte) (RData, error)
+	// Parse decodes the presentation format returned by RData.String. The
+	// generic "\# <length> <hex>" form is handled before and goes to Unpack.
+	Parse(s string) (RData, error)
+}
+
+var registry = struct {
+	sync.RWMutex
+	codecs map[Type]Codec
+	names  map[Type]string
+}{codecs: make(map[Type]Codec), names: make(map[Type]string)}
+
+// RegisterType adds a type this package has no codec for, e.g. one of the
+// private use range 65280-65534, so records of that type pack, unpack, parse
+// and print like the built in ones. The name is its mnemonic in presentation
+// format, empty keeps the TYPEnnn form. It is meant to be called from init
+// functions, built in types and registered types or names can't be replaced.
+func RegisterType(t Type, name string, codec Codec) error {
+	// Type.String takes the registry lock, so t is spelled out here
+	label := fmt.Sprintf("TYPE%d", uint16(t))
+	if codec == nil {
+		return fmt.Errorf("register %s: nil codec", label)
+	}
+	if _, ok := typeNames[t]; ok || t == 0 {
+		return fmt.Errorf("register %s: type is built in", label)
+	}
+	var n uint16
+	if _, err := fmt.Sscanf(name, "TYPE%d", &n); err == nil {
+		return fmt.Errorf("register %s: name %q is the generic form of another type", label, name)
+	}
+	for _, builtin := range typeNames {
+		if builtin == name {
+			return fmt.Errorf("register %s: name %q is built in", label, name)
+		}
+	}
+
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.codecs[t]; ok {
+		return fmt.Errorf("register %s: type is already registered", label)
+	}
+	for other, registered := range registry.names {
+		if name != "" && registered == name {
+			return fmt.Errorf("register %s: name %q is registered for TYPE%d", label, name, uint16(other))
+		}
+	}
+	registry.codecs[t] = codec
+	if name != "" {
+		registry.names[t] = name
+	}
+	return nil
+}
+
+// registeredCodec returns the codec registered for t, or nil
+func registeredCodec(t Type) Codec {
+	registry.RLock()
+	defer registry.RUnlock()
+	return registry.codecs[t]
+}
+
+// registeredName returns the mnemonic registered for t
+func registeredName(t Type) (string, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	name, ok := registry.names[t]
+	return name, ok
+}
+
+// registeredType returns the registered type with mnemonic name
+func registeredType(name string) (Type, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	for t, n := range registry.names {
+		if n == name {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+// packRData appends the wire form of the payload of a record of type t. The
+// types whose names may be compressed (https://www.rfc-editor.org/rfc/rfc3597#section-4)
+// are packed by direct calls, so the compressor doesn't escape to the heap.
+func packRData(b []byte, t Type, data RData, comp *compressor) ([]byte, error) {
+	switch r := data.(type) {
+	case *NS:
+		return r.pack(b, comp)
+	case *CNAME:
+		return r.pack(b, comp)
+	case *PTR:
+		return r.pack(b, comp)
+	case *MX:
+		return r.pack(b, comp)
+	case *SOA:
+		return r.pack(b, comp)
+	}
+	if p, ok := data.(packer); ok {
+		return p.pack(b)
+	}
+	if codec := registeredCodec(t); codec != nil {
+		return codec.Pack(b, data)
+	}
+	return b, fmt.Errorf("rdata: no codec for %T in a %s record", data, t)
+}
@@ -0,0 +1,113 @@
+package dnsmessage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// typeGeo is a private use type carrying a latitude and longitude in 1/1000 degrees
+const typeGeo Type = 65400
+
+type geo struct {
+	Lat, Long int32
+}
+
+func (g *geo) String() string { return fmt.Sprintf("%d %d", g.Lat, g.Long) }
+
+type geoCodec struct{}
+
+func (geoCodec) Pack(b []byte, data RData) ([]byte, error) {
+	g, ok := data.(*geo)
+	if !ok {
+		return b, fmt.Errorf("want *geo, got %T", data)
+	}
+	b = binary.BigEndian.AppendUint32(b, uint32(g.Lat))
+	return binary.BigEndian.AppendUint32(b, uint32(g.Long)), nil
+}
+
+func (geoCodec) Unpack(data []byte) (RData, error) {
+	if len(data) != 8 {
+		return nil, errors.New("want 8 bytes")
+	}
+	return &geo{Lat: int32(binary.BigEndian.Uint32(data)), Long: int32(binary.BigEndian.Uint32(data[4:]))}, nil
+}
+
+func (geoCodec) Parse(s string) (RData, error) {
+	var g geo
+	if _, err := fmt.Sscanf(s, "%d %d", &g.Lat, &g.Long); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+func init() {
+	if err := RegisterType(typeGeo, "GEO", geoCodec{}); err != nil {
+		panic(err)
+	}
+}
+
+func TestRegisteredTypeRoundTrip(t *testing.T) {
+	rr := Resource{Name: "office.example.com", Type: typeGeo, Class: ClassINET, TTL: 300, Data: &geo{Lat: 52520, Long: -13405}}
+	packed, err := (&Message{Answers: []Resource{rr}}).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m Message
+	if err := m.Unpack(packed); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m.Answers[0], rr) {
+		t.Fatalf("Unpacked %#v, want %#v", m.Answers[0], rr)
+	}
+	if got, want := m.Answers[0].String(), "office.example.com.\t300\tIN\tGEO\t52520 -13405"; got != want {
+		t.Errorf("Printed %q, want %q", got, want)
+	}
+
+	if ty, err := ParseType("GEO"); err != nil || ty != typeGeo {
+		t.Errorf("ParseType(GEO) = %v, %v", ty, err)
+	}
+	for _, text := range []string{"52520 -13405", `\# 8 0000cd28ffffcba3`} {
+		got, err := ParseRData(typeGeo, text)
+		if err != nil || !reflect.DeepEqual(got, rr.Data) {
+			t.Errorf("ParseRData(%q) = %#v, %v", text, got, err)
+		}
+	}
+	if _, err := ParseRData(typeGeo, `\# 2 0000`); err == nil {
+		t.Error("Expected the codec to reject a short payload")
+	}
+}
+
+func TestRegisterTypeConflicts(t *testing.T) {
+	tests := []struct {
+		t    Type
+		name string
+	}{
+		{TypeA, "ADDRESS"},
+		{typeGeo, "GEO2"},
+		{65401, "GEO"},
+		{65401, "MX"},
+		{65401, "TYPE65402"},
+	}
+	for _, tt := range tests {
+		if err := RegisterType(tt.t, tt.name, geoCodec{}); err == nil {
+			t.Errorf("Expected registering %d as %s to fail", tt.t, tt.name)
+		}
+	}
+	if err := RegisterType(65402, "", nil); err == nil {
+		t.Error("Expected a nil codec to be rejected")
+	}
+	if got := Type(65401).String(); got != "TYPE"+strconv.Itoa(65401) {
+		t.Errorf("Expected failed registrations to leave no name behind, got %s", got)
+	}
+}
+
+func TestPackRejectsPayloadWithoutCodec(t *testing.T) {
+	rr := Resource{Name: "example.com", Type: 65403, Class: ClassINET, Data: &geo{}}
+	if _, err := (&Message{Answers: []Resource{rr}}).Pack(); err == nil {
+		t.Error("Expected a payload of an unregistered type without codec to fail packing")
+	}
+}
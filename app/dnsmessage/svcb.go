@@ -0,0 +1,339 @@
+package dnsmessage
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// SvcParam keys (https://www.iana.org/assignments/dns-svcb/dns-svcb.xhtml)
+const (
+	SvcParamMandatory     uint16 = 0
+	SvcParamALPN          uint16 = 1
+	SvcParamNoDefaultALPN uint16 = 2
+	SvcParamPort          uint16 = 3
+	SvcParamIPv4Hint      uint16 = 4
+	SvcParamECH           uint16 = 5
+	SvcParamIPv6Hint      uint16 = 6
+	SvcParamDoHPath       uint16 = 7
+	SvcParamOHTTP         uint16 = 8
+)
+
+var svcParamNames = map[uint16]string{
+	SvcParamMandatory:     "mandatory",
+	SvcParamALPN:          "alpn",
+	SvcParamNoDefaultALPN: "no-default-alpn",
+	SvcParamPort:          "port",
+	SvcParamIPv4Hint:      "ipv4hint",
+	SvcParamECH:           "ech",
+	SvcParamIPv6Hint:      "ipv6hint",
+	SvcParamDoHPath:       "dohpath",
+	SvcParamOHTTP:         "ohttp",
+}
+
+// SvcParam is a key and its value in wire format, the typed accessors of SVCB
+// decode the values of the keys they know
+type SvcParam struct {
+	Key   uint16
+	Value []byte
+}
+
+// SVCB binds a service to its endpoints and their parameters
+// (https://www.rfc-editor.org/rfc/rfc9460#section-2). Priority 0 makes it an
+// alias to Target, other priorities order the endpoints.
+type SVCB struct {
+	Priority uint16
+	// Target is never compressed, the root means the owner name itself
+	Target string
+	// Params are ordered by key
+	Params []SvcParam
+}
+
+// HTTPS is SVCB for HTTP origins (https://www.rfc-editor.org/rfc/rfc9460#section-9)
+type HTTPS struct {
+	SVCB
+}
+
+func (r *SVCB) pack(b []byte) ([]byte, error) {
+	b = binary.BigEndian.AppendUint16(b, r.Priority)
+	b, err := appendName(b, r.Target, nil)
+	if err != nil {
+		return b, err
+	}
+	for i, p := range r.Params {
+		if i > 0 && p.Key <= r.Params[i-1].Key {
+			return b, errors.New("rdata: SvcParams must be in increasing key order without duplicates")
+		}
+		if len(p.Value) > 0xFFFF {
+			return b, errors.New("rdata: SvcParam value too long")
+		}
+		b = binary.BigEndian.AppendUint16(b, p.Key)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(p.Value)))
+		b = append(b, p.Value...)
+	}
+	return b, nil
+}
+
+func (r *SVCB) String() string {
+	parts := []string{strconv.Itoa(int(r.Priority)), FQDN(r.Target)}
+	for _, p := range r.Params {
+		parts = append(parts, p.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+// Param returns the value of the parameter key
+func (r *SVCB) Param(key uint16) ([]byte, bool) {
+	for _, p := range r.Params {
+		if p.Key == key {
+			return p.Value, true
+		}
+	}
+	return nil, false
+}
+
+// ALPN returns the protocol identifiers of the alpn parameter
+func (r *SVCB) ALPN() []string {
+	value, _ := r.Param(SvcParamALPN)
+	ids, _ := readCharacterStrings(value)
+	return ids
+}
+
+// Port returns the port of the port parameter
+func (r *SVCB) Port() (uint16, bool) {
+	value, ok := r.Param(SvcParamPort)
+	if !ok || len(value) != 2 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(value), true
+}
+
+// IPHints returns the addresses of the ipv4hint and ipv6hint parameters
+func (r *SVCB) IPHints() []netip.Addr {
+	var addrs []netip.Addr
+	for key, size := range map[uint16]int{SvcParamIPv4Hint: 4, SvcParamIPv6Hint: 16} {
+		value, _ := r.Param(key)
+		for i := 0; i+size <= len(value); i += size {
+			addr, _ := netip.AddrFromSlice(value[i : i+size])
+			addrs = append(addrs, addr)
+		}
+	}
+	slices.SortFunc(addrs, netip.Addr.Compare)
+	return addrs
+}
+
+// String returns the parameter in presentation format, key=value
+// (https://www.rfc-editor.org/rfc/rfc9460#section-7)
+func (p SvcParam) String() string {
+	key := svcParamKeyName(p.Key)
+	switch p.Key {
+	case SvcParamNoDefaultALPN:
+		if len(p.Value) == 0 {
+			return key
+		}
+	case SvcParamMandatory:
+		if len(p.Value)%2 == 0 {
+			var keys []string
+			for i := 0; i < len(p.Value); i += 2 {
+				keys = append(keys, svcParamKeyName(binary.BigEndian.Uint16(p.Value[i:])))
+			}
+			return key + "=" + strings.Join(keys, ",")
+		}
+	case SvcParamALPN:
+		if ids, err := readCharacterStrings(p.Value); err == nil && len(ids) > 0 {
+			for i, id := range ids {
+				ids[i] = strings.ReplaceAll(id, ",", `\,`)
+			}
+			return key + "=" + strconv.Quote(strings.Join(ids, ","))
+		}
+	case SvcParamPort:
+		if len(p.Value) == 2 {
+			return fmt.Sprintf("%s=%d", key, binary.BigEndian.Uint16(p.Value))
+		}
+	case SvcParamIPv4Hint, SvcParamIPv6Hint:
+		size := 4
+		if p.Key == SvcParamIPv6Hint {
+			size = 16
+		}
+		if len(p.Value) > 0 && len(p.Value)%size == 0 {
+			var addrs []string
+			for i := 0; i < len(p.Value); i += size {
+				addr, _ := netip.AddrFromSlice(p.Value[i : i+size])
+				addrs = append(addrs, addr.String())
+			}
+			return key + "=" + strings.Join(addrs, ",")
+		}
+	case SvcParamECH, SvcParamOHTTP:
+		if p.Key == SvcParamECH || len(p.Value) > 0 {
+			return key + "=" + base64.StdEncoding.EncodeToString(p.Value)
+		}
+		return key
+	}
+	return key + "=" + strconv.Quote(string(p.Value))
+}
+
+// svcParamKeyName returns the mnemonic of a key, keyNNNNN for unnamed ones
+func svcParamKeyName(key uint16) string {
+	if name, ok := svcParamNames[key]; ok {
+		return name
+	}
+	return fmt.Sprintf("key%d", key)
+}
+
+// parseSvcParamKey converts a key mnemonic or keyNNNNN into the key
+func parseSvcParamKey(s string) (uint16, error) {
+	for key, name := range svcParamNames {
+		if name == s {
+			return key, nil
+		}
+	}
+	if n, ok := strings.CutPrefix(s, "key"); ok {
+		key, err := strconv.ParseUint(n, 10, 16)
+		if err == nil && key != 65535 {
+			return uint16(key), nil
+		}
+	}
+	return 0, fmt.Errorf("rdata: unknown SvcParam key %q", s)
+}
+
+// unpackSVCB decodes an SVCB or HTTPS payload from off to the end of msg
+func unpackSVCB(msg []byte, off int, t Type) (RData, error) {
+	if len(msg)-off < 3 {
+		return nil, errRDataLength
+	}
+	r := SVCB{Priority: binary.BigEndian.Uint16(msg[off:])}
+	target, n, err := readName(msg, off+2)
+	if err != nil {
+		return nil, err
+	}
+	r.Target = target
+	for n < len(msg) {
+		if n+4 > len(msg) {
+			return nil, errRDataLength
+		}
+		key := binary.BigEndian.Uint16(msg[n:])
+		l := int(binary.BigEndian.Uint16(msg[n+2:]))
+		if n+4+l > len(msg) {
+			return nil, errRDataLength
+		}
+		if len(r.Params) > 0 && key <= r.Params[len(r.Params)-1].Key {
+			return nil, errors.New("rdata: SvcParams out of order")
+		}
+		r.Params = append(r.Params, SvcParam{Key: key, Value: append([]byte(nil), msg[n+4:n+4+l]...)})
+		n += 4 + l
+	}
+	if t == TypeHTTPS {
+		return &HTTPS{SVCB: r}, nil
+	}
+	return &r, nil
+}
+
+// parseSVCB decodes the presentation format of SVCB and HTTPS, the
+// parameters may come in any order
+func parseSVCB(t Type, fields []string, origin string) (RData, error) {
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("rdata: %s expects at least 2 fields, got %d", t, len(fields))
+	}
+	priority, err := parseUint(fields[0], 16)
+	if err != nil {
+		return nil, err
+	}
+	r := SVCB{Priority: uint16(priority), Target: JoinName(fields[1], origin)}
+	for _, f := range fields[2:] {
+		p, err := parseSvcParam(f)
+		if err != nil {
+			return nil, err
+		}
+		if _, dup := r.Param(p.Key); dup {
+			return nil, fmt.Errorf("rdata: duplicate SvcParam %s", svcParamKeyName(p.Key))
+		}
+		r.Params = append(r.Params, p)
+	}
+	slices.SortFunc(r.Params, func(a, b SvcParam) int { return int(a.Key) - int(b.Key) })
+	if t == TypeHTTPS {
+		return &HTTPS{SVCB: r}, nil
+	}
+	return &r, nil
+}
+
+// parseSvcParam decodes a key=value field, values may be quoted
+func parseSvcParam(f string) (SvcParam, error) {
+	name, value, hasValue := strings.Cut(f, "=")
+	key, err := parseSvcParamKey(name)
+	if err != nil {
+		return SvcParam{}, err
+	}
+	if strings.HasPrefix(value, `"`) {
+		if value, err = strconv.Unquote(value); err != nil {
+			return SvcParam{}, fmt.Errorf("rdata: invalid SvcParam value: %w", err)
+		}
+	}
+	p := SvcParam{Key: key}
+	switch key {
+	case SvcParamNoDefaultALPN:
+		if hasValue {
+			return p, errors.New("rdata: no-default-alpn takes no value")
+		}
+	case SvcParamMandatory:
+		for _, k := range strings.Split(value, ",") {
+			mandatory, err := parseSvcParamKey(k)
+			if err != nil {
+				return p, err
+			}
+			p.Value = binary.BigEndian.AppendUint16(p.Value, mandatory)
+		}
+	case SvcParamALPN:
+		for _, id := range splitEscapedCommas(value) {
+			if id == "" || len(id) > 255 {
+				return p, fmt.Errorf("rdata: invalid ALPN identifier %q", id)
+			}
+			p.Value = append(append(p.Value, byte(len(id))), id...)
+		}
+	case SvcParamPort:
+		port, err := parseUint(value, 16)
+		if err != nil {
+			return p, err
+		}
+		p.Value = binary.BigEndian.AppendUint16(nil, uint16(port))
+	case SvcParamIPv4Hint, SvcParamIPv6Hint:
+		for _, s := range strings.Split(value, ",") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil || addr.Is4() != (key == SvcParamIPv4Hint) || addr.Is4In6() {
+				return p, fmt.Errorf("rdata: invalid %s address %q", svcParamKeyName(key), s)
+			}
+			p.Value = append(p.Value, addr.AsSlice()...)
+		}
+	case SvcParamECH, SvcParamOHTTP:
+		if p.Value, err = base64.StdEncoding.DecodeString(value); err != nil {
+			return p, fmt.Errorf("rdata: invalid %s value: %w", svcParamKeyName(key), err)
+		}
+	default:
+		p.Value = []byte(value)
+	}
+	return p, nil
+}
+
+// splitEscapedCommas splits a value list at the commas not escaped with a
+// backslash (https://www.rfc-editor.org/rfc/rfc9460#appendix-A.1)
+func splitEscapedCommas(s string) []string {
+	var items []string
+	var item strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s):
+			i++
+			item.WriteByte(s[i])
+		case s[i] == ',':
+			items = append(items, item.String())
+			item.Reset()
+		default:
+			item.WriteByte(s[i])
+		}
+	}
+	return append(items, item.String())
+}
@@ -0,0 +1,31 @@
+package dnsmessage
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestSVCBParams(t *testing.T) {
+	rd := mustParse(t, TypeHTTPS, `1 svc.example.com. alpn="h2,h3" port=8443 ipv6hint=2001:db8::2 ipv4hint=192.0.2.1,192.0.2.2`)
+	https := rd.(*HTTPS)
+	if got := https.ALPN(); !reflect.DeepEqual(got, []string{"h2", "h3"}) {
+		t.Errorf("ALPN() = %q", got)
+	}
+	if port, ok := https.Port(); !ok || port != 8443 {
+		t.Errorf("Port() = %d, %v", port, ok)
+	}
+	want := []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2"), netip.MustParseAddr("2001:db8::2")}
+	if got := https.IPHints(); !reflect.DeepEqual(got, want) {
+		t.Errorf("IPHints() = %v", got)
+	}
+	if got, want := https.String(), `1 svc.example.com. alpn="h2,h3" port=8443 ipv4hint=192.0.2.1,192.0.2.2 ipv6hint=2001:db8::2`; got != want {
+		t.Errorf("String() = %s, want %s", got, want)
+	}
+
+	// Values are ordered by key on the wire, other orders are malformed
+	outOfOrder := []byte{0, 1, 0, 0, 3, 0, 2, 0x01, 0xbb, 0, 1, 0, 3, 2, 'h', '2'}
+	if _, err := unpackSVCB(outOfOrder, 0, TypeSVCB); err == nil {
+		t.Error("Expected SvcParams out of order to be rejected")
+	}
+}
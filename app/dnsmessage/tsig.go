@@ -0,0 +1,152 @@
+package dnsmessage
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TSIG is the transaction signature of a message, always the last record of
+// the additional section (https://www.rfc-editor.org/rfc/rfc8945#section-4.2).
+// The owner name of the record is the name of the key.
+type TSIG struct {
+	Algorithm string
+	// TimeSigned is in seconds since the epoch, only the low 48 bits are sent
+	TimeSigned uint64
+	Fudge      uint16
+	MAC        []byte
+	OriginalID uint16
+	Error      RCode
+	OtherData  []byte
+}
+
+func (r *TSIG) pack(b []byte) ([]byte, error) {
+	// Names in the payload must not be compressed
+	b, err := appendName(b, r.Algorithm, nil)
+	if err != nil {
+		return b, err
+	}
+	b = appendTimeSigned(b, r.TimeSigned)
+	b = binary.BigEndian.AppendUint16(b, r.Fudge)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(r.MAC)))
+	b = append(b, r.MAC...)
+	b = binary.BigEndian.AppendUint16(b, r.OriginalID)
+	b = binary.BigEndian.AppendUint16(b, uint16(r.Error))
+	b = binary.BigEndian.AppendUint16(b, uint16(len(r.OtherData)))
+	return append(b, r.OtherData...), nil
+}
+
+// String uses the format of dig, there is no master file format for TSIG
+func (r *TSIG) String() string {
+	return fmt.Sprintf("%s %d %d %d %s %d %s %d", FQDN(r.Algorithm), r.TimeSigned, r.Fudge, len(r.MAC), base64.StdEncoding.EncodeToString(r.MAC), r.OriginalID, r.Error, len(r.OtherData))
+}
+
+func appendTimeSigned(b []byte, t uint64) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(t>>32))
+	return binary.BigEndian.AppendUint32(b, uint32(t))
+}
+
+func unpackTSIG(msg []byte, off int) (RData, error) {
+	var r TSIG
+	var err error
+	if r.Algorithm, off, err = readName(msg, off); err != nil {
+		return nil, err
+	}
+	if off+10 > len(msg) {
+		return nil, errRDataLength
+	}
+	r.TimeSigned = uint64(binary.BigEndian.Uint16(msg[off:]))<<32 | uint64(binary.BigEndian.Uint32(msg[off+2:]))
+	r.Fudge = binary.BigEndian.Uint16(msg[off+6:])
+	macLen := int(binary.BigEndian.Uint16(msg[off+8:]))
+	off += 10
+	if off+macLen+6 > len(msg) {
+		return nil, errRDataLength
+	}
+	r.MAC = append([]byte(nil), msg[off:off+macLen]...)
+	off += macLen
+	r.OriginalID = binary.BigEndian.Uint16(msg[off:])
+	r.Error = RCode(binary.BigEndian.Uint16(msg[off+2:]))
+	otherLen := int(binary.BigEndian.Uint16(msg[off+4:]))
+	off += 6
+	if off+otherLen != len(msg) {
+		return nil, errRDataLength
+	}
+	r.OtherData = append([]byte(nil), msg[off:]...)
+	return &r, nil
+}
+
+// SplitTSIG separates the TSIG record from a message in wire format. It
+// returns the message as it was before signing, without the record and with
+// its original ID, and the record, or a nil record if msg is not signed.
+// A TSIG record anywhere but last in the additional section is an error.
+func SplitTSIG(msg []byte) ([]byte, *Resource, error) {
+	if len(msg) < headerLen {
+		return nil, nil, errShortHeader
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:6]))
+	arcount := int(binary.BigEndian.Uint16(msg[10:12]))
+	total := int(binary.BigEndian.Uint16(msg[6:8])) + int(binary.BigEndian.Uint16(msg[8:10])) + arcount
+
+	off := headerLen
+	for i := 0; i < qdcount; i++ {
+		var err error
+		if _, off, err = readName(msg, off); err != nil {
+			return nil, nil, fmt.Errorf("question %d: %w", i, err)
+		}
+		if off += 4; off > len(msg) {
+			return nil, nil, errShortQuestion
+		}
+	}
+	for i := 0; i < total; i++ {
+		start := off
+		records, next, err := unpackSection(msg, off, 1)
+		if err != nil {
+			return nil, nil, err
+		}
+		off = next
+		if records[0].Type != TypeTSIG {
+			continue
+		}
+		if i != total-1 || arcount == 0 {
+			return nil, nil, errors.New("message: TSIG record is not the last record")
+		}
+		rr := records[0]
+		unsigned := append([]byte(nil), msg[:start]...)
+		binary.BigEndian.PutUint16(unsigned[0:2], rr.Data.(*TSIG).OriginalID)
+		binary.BigEndian.PutUint16(unsigned[10:12], uint16(arcount-1))
+		return unsigned, &rr, nil
+	}
+	return msg, nil, nil
+}
+
+// AppendTSIGVariables appends the fields of the TSIG record rr that are signed
+// along with the message (https://www.rfc-editor.org/rfc/rfc8945#section-4.3.3).
+// With timersOnly, used for the later messages of a zone transfer, only the
+// time fields are.
+func AppendTSIGVariables(b []byte, rr Resource, timersOnly bool) ([]byte, error) {
+	tsig, ok := rr.Data.(*TSIG)
+	if !ok {
+		return b, errors.New("message: not a TSIG record")
+	}
+	if timersOnly {
+		b = appendTimeSigned(b, tsig.TimeSigned)
+		return binary.BigEndian.AppendUint16(b, tsig.Fudge), nil
+	}
+	// Names are signed in the canonical form, lowercase and uncompressed
+	b, err := appendName(b, strings.ToLower(rr.Name), nil)
+	if err != nil {
+		return b, err
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(ClassANY))
+	b = binary.BigEndian.AppendUint32(b, 0)
+	if b, err = appendName(b, strings.ToLower(tsig.Algorithm), nil); err != nil {
+		return b, err
+	}
+	b = appendTimeSigned(b, tsig.TimeSigned)
+	b = binary.BigEndian.AppendUint16(b, tsig.Fudge)
+	b = binary.BigEndian.AppendUint16(b, uint16(tsig.Error))
+	b = binary.BigEndian.AppendUint16(b, uint16(len(tsig.OtherData)))
+	return append(b, tsig.OtherData...), nil
+}
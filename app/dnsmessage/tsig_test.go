@@ -0,0 +1,81 @@
+package dnsmessage
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func signedSample() *Message {
+	m := sampleMessage()
+	m.ID = 0x1234
+	m.Additionals = append(m.Additionals, Resource{Name: "key.example.com", Type: TypeTSIG, Class: ClassANY, Data: &TSIG{
+		Algorithm: "hmac-sha256", TimeSigned: 1<<40 + 5, Fudge: 300, MAC: []byte{1, 2, 3, 4}, OriginalID: 0xBEEF, Error: RCodeBadTime, OtherData: []byte{0, 0, 0, 0, 0, 9},
+	}})
+	return m
+}
+
+func TestTSIGRoundTrip(t *testing.T) {
+	want := signedSample()
+	packed, err := want.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Message
+	if err := got.Unpack(packed); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Additionals[2], want.Additionals[2]) {
+		t.Errorf("Expected %+v, got %+v", want.Additionals[2].Data, got.Additionals[2].Data)
+	}
+}
+
+func TestSplitTSIG(t *testing.T) {
+	signed, err := signedSample().Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned, rr, err := SplitTSIG(signed)
+	if err != nil || rr == nil || rr.Name != "key.example.com" {
+		t.Fatalf("Expected the TSIG record, got %+v, %v", rr, err)
+	}
+	// The message as it was before the record was added, with its original ID
+	want, err := sampleMessage().Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unsigned, want) {
+		t.Errorf("Expected the unsigned message\n%v\ngot\n%v", want, unsigned)
+	}
+
+	if rest, rr, err := SplitTSIG(want); err != nil || rr != nil || !bytes.Equal(rest, want) {
+		t.Errorf("Expected an unsigned message to be returned as is, got %+v, %v", rr, err)
+	}
+
+	misplaced := signedSample()
+	n := len(misplaced.Additionals)
+	misplaced.Additionals[n-1], misplaced.Additionals[n-2] = misplaced.Additionals[n-2], misplaced.Additionals[n-1]
+	packed, err := misplaced.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := SplitTSIG(packed); err == nil {
+		t.Error("Expected a TSIG record before another record to be rejected")
+	}
+}
+
+func TestAppendTSIGVariables(t *testing.T) {
+	rr := signedSample().Additionals[2]
+	rr.Name = "KEY.example.com."
+	got, err := AppendTSIGVariables(nil, rr, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte("\x03key\x07example\x03com\x00\x00\xff\x00\x00\x00\x00\x0bhmac-sha256\x00\x01\x00\x00\x00\x00\x05\x01\x2c\x00\x12\x00\x06\x00\x00\x00\x00\x00\x09")
+	if !bytes.Equal(got, want) {
+		t.Errorf("Expected\n%q\ngot\n%q", want, got)
+	}
+	if got, _ := AppendTSIGVariables(nil, rr, true); !bytes.Equal(got, []byte{1, 0, 0, 0, 0, 5, 1, 0x2c}) {
+		t.Errorf("Expected only the timers, got %v", got)
+	}
+}
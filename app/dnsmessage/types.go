@@ -0,0 +1,225 @@
+package dnsmessage
+
+import "fmt"
+
+// Type is a resource record type (https://www.rfc-editor.org/rfc/rfc1035#section-3.2.2)
+type Type uint16
+
+const (
+	TypeA     Type = 1
+	TypeNS    Type = 2
+	TypeCNAME Type = 5
+	TypeSOA   Type = 6
+	TypePTR   Type = 12
+	TypeHINFO Type = 13
+	TypeMX    Type = 15
+	TypeTXT   Type = 16
+	TypeAAAA  Type = 28
+	TypeSRV   Type = 33
+	TypeNAPTR Type = 35
+	TypeOPT   Type = 41
+	// The DNSSEC types (https://www.rfc-editor.org/rfc/rfc4034, https://www.rfc-editor.org/rfc/rfc5155)
+	TypeDS     Type = 43
+	TypeRRSIG  Type = 46
+	TypeNSEC   Type = 47
+	TypeDNSKEY Type = 48
+	TypeNSEC3  Type = 50
+	// TypeNSEC3PARAM holds the NSEC3 parameters of a zone at its apex
+	TypeNSEC3PARAM Type = 51
+	// The service binding types (https://www.rfc-editor.org/rfc/rfc9460)
+	TypeSVCB  Type = 64
+	TypeHTTPS Type = 65
+	TypeTSIG  Type = 250
+	TypeIXFR  Type = 251
+	TypeAXFR  Type = 252
+	TypeANY   Type = 255
+	TypeCAA   Type = 257
+)
+
+var typeNames = map[Type]string{
+	TypeA:          "A",
+	TypeNS:         "NS",
+	TypeCNAME:      "CNAME",
+	TypeSOA:        "SOA",
+	TypePTR:        "PTR",
+	TypeHINFO:      "HINFO",
+	TypeMX:         "MX",
+	TypeTXT:        "TXT",
+	TypeAAAA:       "AAAA",
+	TypeSRV:        "SRV",
+	TypeNAPTR:      "NAPTR",
+	TypeOPT:        "OPT",
+	TypeDS:         "DS",
+	TypeRRSIG:      "RRSIG",
+	TypeNSEC:       "NSEC",
+	TypeDNSKEY:     "DNSKEY",
+	TypeNSEC3:      "NSEC3",
+	TypeNSEC3PARAM: "NSEC3PARAM",
+	TypeSVCB:       "SVCB",
+	TypeHTTPS:      "HTTPS",
+	TypeTSIG:       "TSIG",
+	TypeIXFR:       "IXFR",
+	TypeAXFR:       "AXFR",
+	TypeANY:        "ANY",
+	TypeCAA:        "CAA",
+}
+
+// String returns the mnemonic of the type, or the RFC 3597 TYPEnnn form for unknown types
+func (t Type) String() string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	if name, ok := registeredName(t); ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", uint16(t))
+}
+
+// ParseType converts a mnemonic such as "AAAA" or "TYPE65" into a Type,
+// including the mnemonics of registered types
+func ParseType(s string) (Type, error) {
+	for t, name := range typeNames {
+		if name == s {
+			return t, nil
+		}
+	}
+	if t, ok := registeredType(s); ok {
+		return t, nil
+	}
+	var n uint16
+	if _, err := fmt.Sscanf(s, "TYPE%d", &n); err == nil {
+		return Type(n), nil
+	}
+	return 0, fmt.Errorf("unknown type %q", s)
+}
+
+// Class is a resource record class (https://www.rfc-editor.org/rfc/rfc1035#section-3.2.4)
+type Class uint16
+
+const (
+	ClassINET  Class = 1
+	ClassCHAOS Class = 3
+	// ClassNONE only appears in dynamic updates (https://www.rfc-editor.org/rfc/rfc2136#section-2.4)
+	ClassNONE Class = 254
+	ClassANY  Class = 255
+)
+
+// String returns the mnemonic of the class
+func (c Class) String() string {
+	switch c {
+	case ClassINET:
+		return "IN"
+	case ClassCHAOS:
+		return "CH"
+	case ClassNONE:
+		return "NONE"
+	case ClassANY:
+		return "ANY"
+	}
+	return fmt.Sprintf("CLASS%d", uint16(c))
+}
+
+// ParseClass converts a mnemonic such as "IN" or "CLASS3" into a Class
+func ParseClass(s string) (Class, error) {
+	for _, c := range []Class{ClassINET, ClassCHAOS, ClassNONE, ClassANY} {
+		if c.String() == s {
+			return c, nil
+		}
+	}
+	var n uint16
+	if _, err := fmt.Sscanf(s, "CLASS%d", &n); err == nil {
+		return Class(n), nil
+	}
+	return 0, fmt.Errorf("unknown class %q", s)
+}
+
+// Opcode is the kind of query carried by a message (4 bits)
+type Opcode uint8
+
+const (
+	OpcodeQuery  Opcode = 0
+	OpcodeStatus Opcode = 2
+	OpcodeNotify Opcode = 4
+	OpcodeUpdate Opcode = 5
+)
+
+// String returns the mnemonic of the opcode
+func (o Opcode) String() string {
+	switch o {
+	case OpcodeQuery:
+		return "QUERY"
+	case OpcodeStatus:
+		return "STATUS"
+	case OpcodeNotify:
+		return "NOTIFY"
+	case OpcodeUpdate:
+		return "UPDATE"
+	}
+	return fmt.Sprintf("OPCODE%d", uint8(o))
+}
+
+// RCode is the response code of a message (4 bits in the header)
+type RCode uint8
+
+const (
+	RCodeSuccess        RCode = 0
+	RCodeFormatError    RCode = 1
+	RCodeServerFailure  RCode = 2
+	RCodeNameError      RCode = 3
+	RCodeNotImplemented RCode = 4
+	RCodeRefused        RCode = 5
+	// The codes of dynamic updates (https://www.rfc-editor.org/rfc/rfc2136#section-2.2)
+	RCodeYXDomain RCode = 6
+	RCodeYXRRSet  RCode = 7
+	RCodeNXRRSet  RCode = 8
+	RCodeNotAuth  RCode = 9
+	RCodeNotZone  RCode = 10
+	// The codes of the TSIG error field, they don't fit in the header
+	// (https://www.rfc-editor.org/rfc/rfc8945#section-3)
+	RCodeBadSig  RCode = 16
+	RCodeBadKey  RCode = 17
+	RCodeBadTime RCode = 18
+	// RCodeBadCookie needs the extended bits of the OPT record
+	// (https://www.rfc-editor.org/rfc/rfc7873#section-8)
+	RCodeBadCookie RCode = 23
+)
+
+var rcodeNames = map[RCode]string{
+	RCodeSuccess:        "NOERROR",
+	RCodeFormatError:    "FORMERR",
+	RCodeServerFailure:  "SERVFAIL",
+	RCodeNameError:      "NXDOMAIN",
+	RCodeNotImplemented: "NOTIMP",
+	RCodeRefused:        "REFUSED",
+	RCodeYXDomain:       "YXDOMAIN",
+	RCodeYXRRSet:        "YXRRSET",
+	RCodeNXRRSet:        "NXRRSET",
+	RCodeNotAuth:        "NOTAUTH",
+	RCodeNotZone:        "NOTZONE",
+	RCodeBadSig:         "BADSIG",
+	RCodeBadKey:         "BADKEY",
+	RCodeBadTime:        "BADTIME",
+	RCodeBadCookie:      "BADCOOKIE",
+}
+
+// String returns the mnemonic of the response code
+func (r RCode) String() string {
+	if name, ok := rcodeNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("RCODE%d", uint8(r))
+}
+
+// ParseRCode converts a mnemonic such as "NXDOMAIN" or "RCODE9" into an RCode
+func ParseRCode(s string) (RCode, error) {
+	for r, name := range rcodeNames {
+		if name == s {
+			return r, nil
+		}
+	}
+	var n uint8
+	if _, err := fmt.Sscanf(s, "RCODE%d", &n); err == nil && n < 16 {
+		return RCode(n), nil
+	}
+	return 0, fmt.Errorf("unknown rcode %q", s)
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// maxNSEC3Iterations is the most NSEC3 iterations a denial is accepted with,
+// see https://www.rfc-editor.org/rfc/rfc9276#section-3.2
+const maxNSEC3Iterations = 150
+
+// supportedAlgorithm reports whether signatures of the algorithm can be verified
+func supportedAlgorithm(alg uint8) bool {
+	switch alg {
+	case dnsmessage.AlgorithmRSASHA1, dnsmessage.AlgorithmRSASHA1NSEC3, dnsmessage.AlgorithmRSASHA256, dnsmessage.AlgorithmRSASHA512,
+		dnsmessage.AlgorithmECDSAP256SHA256, dnsmessage.AlgorithmECDSAP384SHA384, dnsmessage.AlgorithmED25519:
+		return true
+	}
+	return false
+}
+
+// verifySignature checks the signature of sig over data with key
+func verifySignature(key *dnsmessage.DNSKEY, sig *dnsmessage.RRSIG, data []byte) error {
+	var hashed []byte
+	var hash crypto.Hash
+	switch sig.Algorithm {
+	case dnsmessage.AlgorithmRSASHA1, dnsmessage.AlgorithmRSASHA1NSEC3:
+		sum := sha1.Sum(data)
+		hashed, hash = sum[:], crypto.SHA1
+	case dnsmessage.AlgorithmRSASHA256, dnsmessage.AlgorithmECDSAP256SHA256:
+		sum := sha256.Sum256(data)
+		hashed, hash = sum[:], crypto.SHA256
+	case dnsmessage.AlgorithmECDSAP384SHA384:
+		sum := sha512.Sum384(data)
+		hashed, hash = sum[:], crypto.SHA384
+	case dnsmessage.AlgorithmRSASHA512:
+		sum := sha512.Sum512(data)
+		hashed, hash = sum[:], crypto.SHA512
+	case dnsmessage.AlgorithmED25519:
+		if len(key.PublicKey) != ed25519.PublicKeySize {
+			return errors.New("invalid Ed25519 key")
+		}
+		if !ed25519.Verify(key.PublicKey, data, sig.Signature) {
+			return errors.New("signature does not verify")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported algorithm %d", sig.Algorithm)
+	}
+
+	switch sig.Algorithm {
+	case dnsmessage.AlgorithmECDSAP256SHA256, dnsmessage.AlgorithmECDSAP384SHA384:
+		curve := elliptic.P256()
+		if sig.Algorithm == dnsmessage.AlgorithmECDSAP384SHA384 {
+			curve = elliptic.P384()
+		}
+		// Keys and signatures are the two coordinates and the two
+		// numbers of the signature next to each other
+		// (https://www.rfc-editor.org/rfc/rfc6605#section-4)
+		size := (curve.Params().BitSize + 7) / 8
+		if len(key.PublicKey) != 2*size || len(sig.Signature) != 2*size {
+			return errors.New("invalid ECDSA key or signature length")
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(key.PublicKey[:size]), Y: new(big.Int).SetBytes(key.PublicKey[size:])}
+		r, s := new(big.Int).SetBytes(sig.Signature[:size]), new(big.Int).SetBytes(sig.Signature[size:])
+		if !ecdsa.Verify(pub, hashed, r, s) {
+			return errors.New("signature does not verify")
+		}
+		return nil
+	}
+	pub, err := parseRSAKey(key.PublicKey)
+	if err != nil {
+		return err
+	}
+	if err := rsa.VerifyPKCS1v15(pub, hash, hashed, sig.Signature); err != nil {
+		return errors.New("signature does not verify")
+	}
+	return nil
+}
+
+// parseRSAKey decodes an RSA public key in the format of https://www.rfc-editor.org/rfc/rfc3110#section-2
+func parseRSAKey(key []byte) (*rsa.PublicKey, error) {
+	if len(key) < 3 {
+		return nil, errors.New("invalid RSA key")
+	}
+	expLen, key := int(key[0]), key[1:]
+	if expLen == 0 {
+		expLen, key = int(key[0])<<8|int(key[1]), key[2:]
+	}
+	if expLen == 0 || expLen > 4 || len(key) <= expLen {
+		return nil, errors.New("invalid RSA key")
+	}
+	e := 0
+	for _, b := range key[:expLen] {
+		e = e<<8 | int(b)
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(key[expLen:]), E: e}, nil
+}
+
+// signatureValid reports whether now is within the validity period of sig,
+// the times are compared in serial number arithmetic
+// (https://www.rfc-editor.org/rfc/rfc4034#section-3.1.5)
+func signatureValid(sig *dnsmessage.RRSIG, now time.Time) bool {
+	t := uint32(now.Unix())
+	return int32(t-sig.Inception) >= 0 && int32(sig.Expiration-t) >= 0
+}
+
+// proof is the outcome of checking a denial of existence
+type proof int
+
+const (
+	// proofMissing means the records don't prove the denial
+	proofMissing proof = iota
+	proofSecure
+	// proofOptOut means the denial may hide an unsigned delegation, or uses
+	// NSEC3 parameters too costly to check, the answer is insecure
+	proofOptOut
+)
+
+// denial holds the validated NSEC and NSEC3 records of a response
+type denial struct {
+	nsec  []dnsmessage.Resource
+	nsec3 []dnsmessage.Resource
+}
+
+// nameError checks the proof that name does not exist, nor a wildcard that
+// would have matched it (https://www.rfc-editor.org/rfc/rfc4035#section-5.4,
+// https://www.rfc-editor.org/rfc/rfc5155#section-8.4)
+func (d *denial) nameError(name string) proof {
+	for _, rr := range d.nsec {
+		if !nsecCovers(rr, name) {
+			continue
+		}
+		// The closest encloser is the longest ancestor of name that is
+		// one of the names the NSEC record is between, or an ancestor of them
+		ce := closestCommonAncestor(name, rr.Name)
+		if other := closestCommonAncestor(name, rr.Data.(*dnsmessage.NSEC).NextDomain); labelCount(other) > labelCount(ce) {
+			ce = other
+		}
+		for _, w := range d.nsec {
+			if nsecCovers(w, wildcardOf(ce)) {
+				return proofSecure
+			}
+		}
+	}
+	if len(d.nsec3) == 0 {
+		return proofMissing
+	}
+	ce, covering, ok := d.closestEncloser(name)
+	if !ok {
+		return d.nsec3Limits()
+	}
+	if covering.Data.(*dnsmessage.NSEC3).OptOut() {
+		return proofOptOut
+	}
+	if _, covers := d.nsec3Covering(wildcardOf(ce)); !covers {
+		return proofMissing
+	}
+	return proofSecure
+}
+
+// noData checks the proof that name exists without records of type t,
+// directly or by a wildcard (https://www.rfc-editor.org/rfc/rfc4035#section-5.4,
+// https://www.rfc-editor.org/rfc/rfc5155#section-8.5)
+func (d *denial) noData(name string, t dnsmessage.Type) proof {
+	for _, rr := range d.nsec {
+		nsec := rr.Data.(*dnsmessage.NSEC)
+		if canonicalName(rr.Name) == name {
+			if typeDenied(nsec.Types, t) {
+				return proofSecure
+			}
+			return proofMissing
+		}
+		// An empty non-terminal sits right before its descendants
+		if nsecCovers(rr, name) && isSubdomain(canonicalName(nsec.NextDomain), name) {
+			return proofSecure
+		}
+	}
+	for _, rr := range d.nsec {
+		// Wildcard NODATA: name is covered, the wildcard lacks the type
+		if !strings.HasPrefix(canonicalName(rr.Name), "*.") || !typeDenied(rr.Data.(*dnsmessage.NSEC).Types, t) {
+			continue
+		}
+		ce := strings.TrimPrefix(canonicalName(rr.Name), "*.")
+		for _, c := range d.nsec {
+			if isSubdomain(name, ce) && nsecCovers(c, name) {
+				return proofSecure
+			}
+		}
+	}
+
+	if len(d.nsec3) == 0 {
+		return proofMissing
+	}
+	if rr, ok := d.nsec3Matching(name); ok {
+		if typeDenied(rr.Data.(*dnsmessage.NSEC3).Types, t) {
+			return proofSecure
+		}
+		return proofMissing
+	}
+	ce, covering, ok := d.closestEncloser(name)
+	if !ok {
+		return d.nsec3Limits()
+	}
+	// A missing DS in an opt-out span: the delegation may be unsigned
+	if t == dnsmessage.TypeDS && covering.Data.(*dnsmessage.NSEC3).OptOut() {
+		return proofOptOut
+	}
+	if rr, ok := d.nsec3Matching(wildcardOf(ce)); ok && typeDenied(rr.Data.(*dnsmessage.NSEC3).Types, t) {
+		return proofSecure
+	}
+	return proofMissing
+}
+
+// wildcardExpansion checks the proof that name, answered from the wildcard of
+// the closest encloser ce, does not exist itself
+// (https://www.rfc-editor.org/rfc/rfc4035#section-5.3.4)
+func (d *denial) wildcardExpansion(name, ce string) proof {
+	for _, rr := range d.nsec {
+		if nsecCovers(rr, name) {
+			return proofSecure
+		}
+	}
+	if len(d.nsec3) == 0 {
+		return proofMissing
+	}
+	rr, ok := d.nsec3Covering(nextCloser(name, ce))
+	if !ok {
+		return d.nsec3Limits()
+	}
+	if rr.Data.(*dnsmessage.NSEC3).OptOut() {
+		return proofOptOut
+	}
+	return proofSecure
+}
+
+// nsec3Limits tells proofs that failed because of NSEC3 parameters this
+// validator does not handle, those answers are insecure
+func (d *denial) nsec3Limits() proof {
+	for _, rr := range d.nsec3 {
+		nsec3 := rr.Data.(*dnsmessage.NSEC3)
+		if nsec3.HashAlgorithm != 1 || nsec3.Iterations > maxNSEC3Iterations {
+			return proofOptOut
+		}
+	}
+	return proofMissing
+}
+
+// closestEncloser finds the closest provable encloser of name and the NSEC3
+// record covering the next closer name (https://www.rfc-editor.org/rfc/rfc5155#section-8.3)
+func (d *denial) closestEncloser(name string) (string, dnsmessage.Resource, bool) {
+	for candidate := name; candidate != dnsmessage.Root; {
+		parent := parentName(candidate)
+		if _, ok := d.nsec3Matching(parent); ok {
+			rr, covers := d.nsec3Covering(candidate)
+			return parent, rr, covers
+		}
+		candidate = parent
+	}
+	return "", dnsmessage.Resource{}, false
+}
+
+// nsec3Matching returns the NSEC3 record owned by the hash of name
+func (d *denial) nsec3Matching(name string) (dnsmessage.Resource, bool) {
+	for _, rr := range d.nsec3 {
+		hash, owner, ok := nsec3Hashes(rr, name)
+		if ok && bytes.Equal(hash, owner) {
+			return rr, true
+		}
+	}
+	return dnsmessage.Resource{}, false
+}
+
+// nsec3Covering returns the NSEC3 record whose span holds the hash of name
+func (d *denial) nsec3Covering(name string) (dnsmessage.Resource, bool) {
+	for _, rr := range d.nsec3 {
+		hash, owner, ok := nsec3Hashes(rr, name)
+		if !ok {
+			continue
+		}
+		next := rr.Data.(*dnsmessage.NSEC3).NextHashed
+		after, before := bytes.Compare(owner, hash) < 0, bytes.Compare(hash, next) < 0
+		// The last record of the chain wraps around to the first
+		if (after && before) || (bytes.Compare(next, owner) <= 0 && (after || before)) {
+			return rr, true
+		}
+	}
+	return dnsmessage.Resource{}, false
+}
+
+// nsec3Hashes returns the hash of name with the parameters of the NSEC3 record
+// rr and the hash the record is owned by, name has to be in the zone of rr
+func nsec3Hashes(rr dnsmessage.Resource, name string) (hash, owner []byte, ok bool) {
+	nsec3 := rr.Data.(*dnsmessage.NSEC3)
+	ownerName := canonicalName(rr.Name)
+	label, zone := strings.SplitN(ownerName, ".", 2)[0], parentName(ownerName)
+	if nsec3.HashAlgorithm != 1 || nsec3.Iterations > maxNSEC3Iterations || !isSubdomain(name, zone) {
+		return nil, nil, false
+	}
+	owner, err := dnsmessage.DecodeHashedName(label)
+	if err != nil {
+		return nil, nil, false
+	}
+	if hash, err = dnsmessage.NSEC3Hash(name, nsec3.Iterations, nsec3.Salt); err != nil {
+		return nil, nil, false
+	}
+	return hash, owner, true
+}
+
+// nsecCovers reports whether name falls between the owner of the NSEC record
+// rr and the next name, the last record of the zone points back at the apex
+func nsecCovers(rr dnsmessage.Resource, name string) bool {
+	next := rr.Data.(*dnsmessage.NSEC).NextDomain
+	if dnsmessage.CompareNames(rr.Name, name) >= 0 {
+		return false
+	}
+	return dnsmessage.CompareNames(name, next) < 0 || dnsmessage.CompareNames(next, rr.Name) <= 0
+}
+
+// typeDenied reports whether a type bitmap proves there are no records of type
+// t, nor a CNAME that would have been followed instead
+func typeDenied(types []dnsmessage.Type, t dnsmessage.Type) bool {
+	return !dnsmessage.HasType(types, t) && !dnsmessage.HasType(types, dnsmessage.TypeCNAME)
+}
+
+// closestCommonAncestor returns the longest name both a and b are in
+func closestCommonAncestor(a, b string) string {
+	a, b = canonicalName(a), canonicalName(b)
+	for !isSubdomain(b, a) {
+		a = parentName(a)
+	}
+	return a
+}
+
+// nextCloser is the ancestor of name one label longer than ce
+func nextCloser(name, ce string) string {
+	for parentName(name) != ce && name != dnsmessage.Root {
+		name = parentName(name)
+	}
+	return name
+}
+
+func wildcardOf(name string) string {
+	if name == dnsmessage.Root {
+		return "*"
+	}
+	return "*." + name
+}
+
+// signRRset returns the signature of rrset by key, made in zone and valid
+// between inception and expiration. labels counts the labels of the owner name
+// the records come from, one less than a wildcard owner.
+func signRRset(key *signingKey, zone string, rrset []dnsmessage.Resource, labels int, inception, expiration time.Time) (dnsmessage.Resource, error) {
+	first := rrset[0]
+	sig := &dnsmessage.RRSIG{
+		TypeCovered: first.Type,
+		Algorithm:   key.dnskey.Algorithm,
+		Labels:      uint8(labels),
+		OriginalTTL: first.TTL,
+		Expiration:  uint32(expiration.Unix()),
+		Inception:   uint32(inception.Unix()),
+		KeyTag:      key.dnskey.KeyTag(),
+		SignerName:  zone,
+	}
+	data, err := dnsmessage.SignedData(sig, rrset)
+	if err != nil {
+		return dnsmessage.Resource{}, err
+	}
+	switch priv := key.private.(type) {
+	case ed25519.PrivateKey:
+		sig.Signature = ed25519.Sign(priv, data)
+	case *ecdsa.PrivateKey:
+		var hashed []byte
+		if sig.Algorithm == dnsmessage.AlgorithmECDSAP384SHA384 {
+			sum := sha512.Sum384(data)
+			hashed = sum[:]
+		} else {
+			sum := sha256.Sum256(data)
+			hashed = sum[:]
+		}
+		r, s, err := ecdsa.Sign(rand.Reader, priv, hashed)
+		if err != nil {
+			return dnsmessage.Resource{}, err
+		}
+		size := (priv.Curve.Params().BitSize + 7) / 8
+		sig.Signature = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+	default:
+		return dnsmessage.Resource{}, fmt.Errorf("unsupported private key %T", priv)
+	}
+	return dnsmessage.Resource{Name: first.Name, Type: dnsmessage.TypeRRSIG, Class: first.Class, TTL: first.TTL, Data: sig}, nil
+}
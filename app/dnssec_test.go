@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"sort"
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+func TestVerifySignature(t *testing.T) {
+	rrset := []dnsmessage.Resource{aRecord("www.example", "192.0.2.1")}
+	sig := &dnsmessage.RRSIG{TypeCovered: dnsmessage.TypeA, Labels: 2, OriginalTTL: 300, SignerName: "example"}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		algorithm uint8
+		key       []byte
+		sign      func(data []byte) []byte
+	}{
+		{"RSASHA256", dnsmessage.AlgorithmRSASHA256, append([]byte{3, 1, 0, 1}, rsaKey.N.Bytes()...), func(data []byte) []byte {
+			sum := sha256.Sum256(data)
+			s, _ := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, sum[:])
+			return s
+		}},
+		{"ECDSAP256SHA256", dnsmessage.AlgorithmECDSAP256SHA256, append(p256.X.FillBytes(make([]byte, 32)), p256.Y.FillBytes(make([]byte, 32))...), func(data []byte) []byte {
+			sum := sha256.Sum256(data)
+			r, s, _ := ecdsa.Sign(rand.Reader, p256, sum[:])
+			return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}},
+		{"ECDSAP384SHA384", dnsmessage.AlgorithmECDSAP384SHA384, append(p384.X.FillBytes(make([]byte, 48)), p384.Y.FillBytes(make([]byte, 48))...), func(data []byte) []byte {
+			sum := sha512.Sum384(data)
+			r, s, _ := ecdsa.Sign(rand.Reader, p384, sum[:])
+			return append(r.FillBytes(make([]byte, 48)), s.FillBytes(make([]byte, 48))...)
+		}},
+	}
+	for _, tt := range tests {
+		key := &dnsmessage.DNSKEY{Flags: dnsmessage.FlagZoneKey, Protocol: 3, Algorithm: tt.algorithm, PublicKey: tt.key}
+		s := *sig
+		s.Algorithm, s.KeyTag = tt.algorithm, key.KeyTag()
+		data, err := dnsmessage.SignedData(&s, rrset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Signature = tt.sign(data)
+		if err := verifySignature(key, &s, data); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		data[len(data)-1]++
+		if err := verifySignature(key, &s, data); err == nil {
+			t.Errorf("%s: expected a signature over other data to fail", tt.name)
+		}
+	}
+}
+
+// nsec3Chain returns the NSEC3 records of a zone holding names, each with the
+// given types
+func nsec3Chain(t *testing.T, zone string, optOut bool, names map[string][]dnsmessage.Type) []dnsmessage.Resource {
+	t.Helper()
+	type hashed struct {
+		hash  []byte
+		types []dnsmessage.Type
+	}
+	var chain []hashed
+	for name, types := range names {
+		hash, err := dnsmessage.NSEC3Hash(name, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain = append(chain, hashed{hash, types})
+	}
+	sort.Slice(chain, func(i, j int) bool { return string(chain[i].hash) < string(chain[j].hash) })
+	var records []dnsmessage.Resource
+	for i, h := range chain {
+		nsec3 := &dnsmessage.NSEC3{HashAlgorithm: 1, NextHashed: chain[(i+1)%len(chain)].hash, Types: h.types}
+		if optOut {
+			nsec3.Flags = 1
+		}
+		records = append(records, dnsmessage.Resource{Name: dnsmessage.EncodeHashedName(h.hash) + "." + zone, Type: dnsmessage.TypeNSEC3, Class: dnsmessage.ClassINET, TTL: 300, Data: nsec3})
+	}
+	return records
+}
+
+func TestNSEC3Denial(t *testing.T) {
+	names := map[string][]dnsmessage.Type{
+		"example":     {dnsmessage.TypeSOA, dnsmessage.TypeNS, dnsmessage.TypeRRSIG},
+		"www.example": {dnsmessage.TypeA, dnsmessage.TypeRRSIG},
+		"sub.example": {dnsmessage.TypeNS},
+	}
+	d := &denial{nsec3: nsec3Chain(t, "example", false, names)}
+	if p := d.nameError("nx.example"); p != proofSecure {
+		t.Errorf("Expected nx.example to be proven not to exist, got %d", p)
+	}
+	if p := d.noData("www.example", dnsmessage.TypeAAAA); p != proofSecure {
+		t.Errorf("Expected www.example to be proven to have no AAAA records, got %d", p)
+	}
+	if p := d.noData("www.example", dnsmessage.TypeA); p != proofMissing {
+		t.Errorf("Expected no proof for the A records of www.example, got %d", p)
+	}
+	if !d.insecureDelegation("sub.example") || d.insecureDelegation("www.example") {
+		t.Error("Expected only sub.example to be an unsigned delegation")
+	}
+
+	optOut := &denial{nsec3: nsec3Chain(t, "example", true, names)}
+	if p := optOut.nameError("nx.example"); p != proofOptOut {
+		t.Errorf("Expected an opt-out NXDOMAIN to be insecure, got %d", p)
+	}
+	if !optOut.insecureDelegation("other.example") {
+		t.Error("Expected a name in an opt-out span to be a possible unsigned delegation")
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+// startForwarding starts a server forwarding to an upstream serving records
+func startForwarding(t *testing.T, records ...dnsmessage.Resource) (addr string, upstream *dnstest.Server) {
+	t.Helper()
+	upstream = dnstest.StartServer(t, dnstest.Zone(records...))
+	return startTestServer(t, newTestServer(t, upstream.Addr)), upstream
+}
+
+func TestEndToEndForwarding(t *testing.T) {
+	addr, upstream := startForwarding(t, dnstest.SOA("example.test", 60), dnstest.A("www.example.test", "192.0.2.1"))
+
+	resp := dnstest.ExchangeUDP(t, addr, dnstest.Query("www.example.test", dnsmessage.TypeA))
+	if resp.RCode != dnsmessage.RCodeSuccess || len(resp.Answers) != 1 || !resp.RecursionAvailable {
+		t.Fatalf("Expected the answer of the upstream, got %s", resp)
+	}
+	if got := resp.Answers[0].Data.(*dnsmessage.A).Addr.String(); got != "192.0.2.1" {
+		t.Errorf("Expected 192.0.2.1, got %s", got)
+	}
+	if got := len(upstream.Queries()); got != 1 {
+		t.Errorf("Expected the query to be forwarded once, got %d", got)
+	}
+}
+
+func TestEndToEndRCodes(t *testing.T) {
+	addr, _ := startForwarding(t, dnstest.SOA("example.test", 60), dnstest.A("www.example.test", "192.0.2.1"))
+
+	resp := dnstest.ExchangeTCP(t, addr, dnstest.Query("missing.example.test", dnsmessage.TypeA))
+	if resp.RCode != dnsmessage.RCodeNameError || len(resp.Authorities) != 1 || resp.Authorities[0].Type != dnsmessage.TypeSOA {
+		t.Errorf("Expected NXDOMAIN with the SOA, got %s", resp)
+	}
+
+	refusing := dnstest.StartServer(t, dnstest.RCode(dnsmessage.RCodeRefused))
+	addr = startTestServer(t, newTestServer(t, refusing.Addr))
+	if resp := dnstest.ExchangeUDP(t, addr, dnstest.Query("www.example.test", dnsmessage.TypeA)); resp.RCode != dnsmessage.RCodeRefused {
+		t.Errorf("Expected the REFUSED of the upstream, got %s", resp.RCode)
+	}
+}
+
+func TestEndToEndTruncation(t *testing.T) {
+	var records []dnsmessage.Resource
+	for i := 1; i <= 40; i++ {
+		records = append(records, dnstest.A("big.example.test", fmt.Sprintf("192.0.2.%d", i)))
+	}
+	addr, _ := startForwarding(t, records...)
+
+	if resp := dnstest.ExchangeUDP(t, addr, dnstest.Query("big.example.test", dnsmessage.TypeA)); !resp.Truncated {
+		t.Errorf("Expected a truncated answer over UDP, got %s", resp)
+	}
+	if resp := dnstest.ExchangeTCP(t, addr, dnstest.Query("big.example.test", dnsmessage.TypeA)); resp.Truncated || len(resp.Answers) != 40 {
+		t.Errorf("Expected the full answer over TCP, got %s", resp)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"net/netip"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// clientSubnet is the EDNS Client Subnet option
+// (https://www.rfc-editor.org/rfc/rfc7871#section-6): the network of the
+// client in queries, and in responses the network the answer is valid for
+type clientSubnet struct {
+	Source netip.Prefix
+	// Scope is the prefix length the answer applies to, 0 for every client
+	Scope uint8
+}
+
+// ECS address families (https://www.iana.org/assignments/address-family-numbers)
+const (
+	ecsFamilyIPv4 = 1
+	ecsFamilyIPv6 = 2
+)
+
+// parseClientSubnet decodes the data of an ECS option, the address only holds
+// the bytes covered by the source prefix
+func parseClientSubnet(data []byte) (clientSubnet, error) {
+	if len(data) < 4 {
+		return clientSubnet{}, errors.New("short client subnet option")
+	}
+	family, bits, scope := uint16(data[0])<<8|uint16(data[1]), int(data[2]), data[3]
+	var addr [16]byte
+	size := 4
+	switch family {
+	case ecsFamilyIPv4:
+	case ecsFamilyIPv6:
+		size = 16
+	default:
+		return clientSubnet{}, errors.New("unknown client subnet family")
+	}
+	if bits > size*8 || int(scope) > size*8 || len(data)-4 != (bits+7)/8 {
+		return clientSubnet{}, errors.New("invalid client subnet prefix")
+	}
+	copy(addr[:], data[4:])
+	ip := netip.AddrFrom16(addr)
+	if size == 4 {
+		ip = netip.AddrFrom4([4]byte(addr[:4]))
+	}
+	prefix, err := ip.Prefix(bits)
+	if err != nil {
+		return clientSubnet{}, err
+	}
+	return clientSubnet{Source: prefix, Scope: scope}, nil
+}
+
+// option encodes c as an ECS option, leaving out the bits beyond the prefix
+func (c clientSubnet) option() dnsmessage.Option {
+	family := ecsFamilyIPv4
+	if c.Source.Addr().Is6() {
+		family = ecsFamilyIPv6
+	}
+	masked := c.Source.Masked()
+	addr := masked.Addr().AsSlice()
+	data := append([]byte{0, byte(family), byte(masked.Bits()), c.Scope}, addr[:(masked.Bits()+7)/8]...)
+	return dnsmessage.Option{Code: ednsOptionECS, Data: data}
+}
+
+// clientSubnetOf returns the first valid ECS option among options
+func clientSubnetOf(options []dnsmessage.Option) (clientSubnet, bool) {
+	for _, o := range options {
+		if o.Code != ednsOptionECS {
+			continue
+		}
+		if c, err := parseClientSubnet(o.Data); err == nil {
+			return c, true
+		}
+	}
+	return clientSubnet{}, false
+}
+
+// answerScope returns the subnet the response to a query with the ECS option
+// sent is valid for: the zero prefix when it is valid for every client or has
+// no ECS option, else the network of its scope. Scopes longer than the subnet
+// sent can't be told apart, they are that of the subnet
+// (https://www.rfc-editor.org/rfc/rfc7871#section-7.3.1).
+func answerScope(sent clientSubnet, resp *dnsmessage.Message) netip.Prefix {
+	opt := optRecord(resp)
+	if opt == nil {
+		return netip.Prefix{}
+	}
+	data, _ := opt.Data.(*dnsmessage.OPT)
+	if data == nil {
+		return netip.Prefix{}
+	}
+	got, ok := clientSubnetOf(data.Options)
+	if !ok || got.Scope == 0 || got.Source != sent.Source {
+		return netip.Prefix{}
+	}
+	if int(got.Scope) < sent.Source.Bits() {
+		return netip.PrefixFrom(sent.Source.Addr(), int(got.Scope)).Masked()
+	}
+	return sent.Source
+}
+
+// upstreamOptions returns the EDNS options of a query from client passed on to
+// upstreams. Client subnets are decoded and packed again, so nothing beyond
+// their prefix leaves, and the configured ECS prefix goes to clients whose ECS
+// option is honored. With UpstreamNSID the upstreams are asked for their NSID.
+func (s *Server) upstreamOptions(client netip.Addr, query *dnsmessage.Message) []dnsmessage.Option {
+	var options []dnsmessage.Option
+	subnet, nsid := false, false
+	for _, o := range s.EDNSPolicy.options(client, query, ednsForward) {
+		nsid = nsid || o.Code == ednsOptionNSID
+		if o.Code != ednsOptionECS {
+			options = append(options, o)
+		} else if c, err := parseClientSubnet(o.Data); err == nil && !subnet {
+			options, subnet = append(options, clientSubnet{Source: c.Source}.option()), true
+		}
+	}
+	if s.ECSPrefix.IsValid() && !subnet && s.EDNSPolicy.honors(client, ednsOptionECS) {
+		options = append(options, clientSubnet{Source: s.ECSPrefix}.option())
+	}
+	if s.UpstreamNSID && !nsid {
+		options = append(options, nsidOption(""))
+	}
+	return options
+}
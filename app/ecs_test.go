@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+func TestClientSubnetOption(t *testing.T) {
+	for _, prefix := range []string{"192.0.2.0/24", "192.0.2.128/25", "2001:db8::/56", "0.0.0.0/0"} {
+		c := clientSubnet{Source: netip.MustParsePrefix(prefix), Scope: 16}
+		got, err := parseClientSubnet(c.option().Data)
+		if err != nil || got != c {
+			t.Errorf("%s: expected a round trip, got %+v %v", prefix, got, err)
+		}
+	}
+	// Bits beyond the prefix are not sent
+	c := clientSubnet{Source: netip.MustParsePrefix("192.0.2.77/20")}
+	if data := c.option().Data; len(data) != 7 || data[6] != 0 {
+		t.Errorf("Expected the address truncated to the prefix, got %v", data)
+	}
+	for _, data := range [][]byte{{0, 1, 24}, {0, 3, 0, 0}, {0, 1, 33, 0, 1, 2, 3, 4, 5}, {0, 1, 24, 0, 192, 0}} {
+		if _, err := parseClientSubnet(data); err == nil {
+			t.Errorf("Expected %v to be rejected", data)
+		}
+	}
+}
+
+// ecsQuery asks for www.example on behalf of the clients in subnet
+func ecsQuery(subnet string) *dnsmessage.Message {
+	query := testQuery("www.example")
+	opt := newOPT(4096, false)
+	opt.Data = &dnsmessage.OPT{Options: []dnsmessage.Option{clientSubnet{Source: netip.MustParsePrefix(subnet)}.option()}}
+	query.Additionals = []dnsmessage.Resource{opt}
+	return query
+}
+
+func TestServerClientSubnets(t *testing.T) {
+	var mu sync.Mutex
+	var sent []netip.Prefix
+	// The upstream answers with a scope of /16
+	s := newTestServer(t, dnstest.StartUDPServer(t, func(query *dnsmessage.Message) *dnsmessage.Message {
+		resp := answerA("192.0.2.1")(query)
+		var subnet clientSubnet
+		if opt := optRecord(query); opt != nil {
+			subnet, _ = clientSubnetOf(opt.Data.(*dnsmessage.OPT).Options)
+			subnet.Scope = 16
+			reply := newOPT(4096, false)
+			reply.Data = &dnsmessage.OPT{Options: []dnsmessage.Option{subnet.option()}}
+			resp.Additionals = append(resp.Additionals, reply)
+		}
+		mu.Lock()
+		sent = append(sent, subnet.Source)
+		mu.Unlock()
+		return resp
+	}).Addr)
+	s.Cache = NewCache(100)
+	s.EDNSPolicy, _ = NewEDNSPolicy("ecs=forward")
+
+	handle(s, ecsQuery("10.1.2.0/24"))
+	handle(s, ecsQuery("10.1.3.0/24"))
+	handle(s, ecsQuery("10.2.0.0/24"))
+	mu.Lock()
+	if len(sent) != 2 || sent[0] != netip.MustParsePrefix("10.1.2.0/24") || sent[1] != netip.MustParsePrefix("10.2.0.0/24") {
+		t.Errorf("Expected the answer to be cached for its /16 scope only, upstream got %v", sent)
+	}
+	mu.Unlock()
+
+	// The configured prefix replaces the subnets of the clients, unless ECS
+	// is stripped for them
+	s.Cache = nil
+	s.ECSPrefix = netip.MustParsePrefix("198.51.100.0/24")
+	s.EDNSPolicy, _ = NewEDNSPolicy("ecs=strip@192.0.2.0/24")
+	handle(s, ecsQuery("10.1.2.0/24"))
+	s.EDNSPolicy, _ = NewEDNSPolicy("ecs=strip@127.0.0.0/8")
+	handle(s, ecsQuery("10.1.2.0/24"))
+	mu.Lock()
+	if len(sent) != 4 || sent[2] != s.ECSPrefix || sent[3].IsValid() {
+		t.Errorf("Expected the configured prefix, then no subnet, got %v", sent[2:])
+	}
+	mu.Unlock()
+}
+
+func TestCacheExportKeepsSubnets(t *testing.T) {
+	c, _ := newTestCache(100)
+	subnet := netip.MustParsePrefix("10.1.0.0/16")
+	c.PutFor(question("www.example", dnsmessage.TypeA), subnet, "upstream 192.0.2.53:53", answerA("192.0.2.1")(testQuery("www.example")))
+	var buf bytes.Buffer
+	if _, err := c.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+	imported, _ := newTestCache(100)
+	if _, err := imported.Import(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, source, ok := imported.GetFor(question("www.example", dnsmessage.TypeA), netip.MustParsePrefix("10.1.2.0/24")); !ok || source != "upstream 192.0.2.53:53" {
+		t.Errorf("Expected the answer for the subnet to be imported with its source, got %q", source)
+	}
+	if _, ok := imported.Get(question("www.example", dnsmessage.TypeA)); ok {
+		t.Error("Expected the answer for the subnet not to be served to other clients")
+	}
+}
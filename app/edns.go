@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/binary"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// ednsUDPSize is the UDP payload size advertised to upstreams, the size
+// recommended to avoid IP fragmentation (https://www.dnsflagday.net/2020/)
+const ednsUDPSize = 1232
+
+// ednsDO is the DNSSEC OK bit among the flags in the TTL field of an OPT
+// record (https://www.rfc-editor.org/rfc/rfc3225#section-3)
+const ednsDO = 1 << 15
+
+// optRecord returns the OPT record of m, or nil without one
+func optRecord(m *dnsmessage.Message) *dnsmessage.Resource {
+	for i := range m.Additionals {
+		if m.Additionals[i].Type == dnsmessage.TypeOPT {
+			return &m.Additionals[i]
+		}
+	}
+	return nil
+}
+
+// dnssecOK reports whether the sender of m asked for DNSSEC records
+func dnssecOK(m *dnsmessage.Message) bool {
+	opt := optRecord(m)
+	return opt != nil && opt.TTL&ednsDO != 0
+}
+
+// newOPT returns an OPT record advertising size as UDP payload size, the
+// class field holds it (https://www.rfc-editor.org/rfc/rfc6891#section-6.1.2)
+func newOPT(size uint16, do bool) dnsmessage.Resource {
+	opt := dnsmessage.Resource{Name: dnsmessage.Root, Type: dnsmessage.TypeOPT, Class: dnsmessage.Class(size), Data: &dnsmessage.OPT{}}
+	if do {
+		opt.TTL = ednsDO
+	}
+	return opt
+}
+
+// setExtendedRCode stores the upper bits of rcode in opt, the header only
+// holds the lower four (https://www.rfc-editor.org/rfc/rfc6891#section-6.1.3)
+func setExtendedRCode(opt *dnsmessage.Resource, rcode dnsmessage.RCode) {
+	opt.TTL = opt.TTL&0x00FFFFFF | uint32(rcode>>4)<<24
+}
+
+// extendedRCode returns the full response code of m, the header bits
+// combined with those of its OPT record
+func extendedRCode(m *dnsmessage.Message) dnsmessage.RCode {
+	rcode := m.RCode & 0x0F
+	if opt := optRecord(m); opt != nil {
+		rcode |= dnsmessage.RCode(opt.TTL>>24) << 4
+	}
+	return rcode
+}
+
+// Extended DNS error codes (https://www.rfc-editor.org/rfc/rfc8914#section-4)
+const (
+	// edeBlocked is for names blocked by the policy of the operator
+	edeBlocked uint16 = 15
+)
+
+// extendedError returns an Extended DNS Error option with an info code and
+// a text for humans (https://www.rfc-editor.org/rfc/rfc8914#section-2)
+func extendedError(code uint16, text string) dnsmessage.Option {
+	data := binary.BigEndian.AppendUint16(nil, code)
+	return dnsmessage.Option{Code: ednsOptionEDE, Data: append(data, text...)}
+}
+
+// extendedErrors returns the Extended DNS Error options of m
+func extendedErrors(m *dnsmessage.Message) []dnsmessage.Option {
+	opt := optRecord(m)
+	if opt == nil {
+		return nil
+	}
+	data, _ := opt.Data.(*dnsmessage.OPT)
+	if data == nil {
+		return nil
+	}
+	var errs []dnsmessage.Option
+	for _, o := range data.Options {
+		if o.Code == ednsOptionEDE && len(o.Data) >= 2 {
+			errs = append(errs, o)
+		}
+	}
+	return errs
+}
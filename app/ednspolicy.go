@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// EDNS option codes (https://www.iana.org/assignments/dns-parameters/dns-parameters.xhtml#dns-parameters-11)
+const (
+	ednsOptionNSID      uint16 = 3
+	ednsOptionECS       uint16 = 8
+	ednsOptionCookie    uint16 = 10
+	ednsOptionKeepalive uint16 = 11
+	ednsOptionPadding   uint16 = 12
+	ednsOptionEDE       uint16 = 15
+)
+
+// ednsOptionNames are the options rules can name, the others are "unknown"
+var ednsOptionNames = map[string]uint16{
+	"nsid":      ednsOptionNSID,
+	"ecs":       ednsOptionECS,
+	"cookie":    ednsOptionCookie,
+	"padding":   ednsOptionPadding,
+	"keepalive": ednsOptionKeepalive,
+}
+
+// paddingBlock is the size padded responses are a multiple of
+// (https://www.rfc-editor.org/rfc/rfc8467#section-4.1)
+const paddingBlock = 468
+
+// ednsAction is what is done with an EDNS option of a client query, a set of
+// the flags below. Without any the option is stripped: ignored altogether.
+type ednsAction uint8
+
+const (
+	// ednsHonor lets the server act on the option where it supports it
+	ednsHonor ednsAction = 1 << iota
+	// ednsForward passes the option on to upstreams
+	ednsForward
+	// ednsEcho copies the option into the reply unchanged
+	ednsEcho
+)
+
+var ednsActionNames = map[string]ednsAction{"honor": ednsHonor, "forward": ednsForward, "echo": ednsEcho, "strip": 0}
+
+// EDNSPolicy decides per client network what happens to the EDNS options of
+// queries. Options without a matching rule are honored, and neither forwarded
+// nor echoed.
+type EDNSPolicy struct {
+	rules []ednsRule
+}
+
+type ednsRule struct {
+	// code is the option the rule is for, unknown rules have none
+	code    uint16
+	unknown bool
+	action  ednsAction
+	// clients are the networks the rule applies to, all clients without any
+	clients []netip.Prefix
+}
+
+// NewEDNSPolicy parses comma separated rules in form
+// <option>=<action>[|<action>...][@<network>[+<network>...]]. Options are
+// nsid, ecs, cookie, padding, keepalive, a code or unknown for every option without a
+// name, the actions honor, forward, echo or strip.
+func NewEDNSPolicy(s string) (*EDNSPolicy, error) {
+	p := &EDNSPolicy{}
+	for _, spec := range splitList(s) {
+		option, rest, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected <option>=<action>, got %q", spec)
+		}
+		actions, networks, _ := strings.Cut(rest, "@")
+		var rule ednsRule
+		if code, ok := ednsOptionNames[option]; ok {
+			rule.code = code
+		} else if option == "unknown" {
+			rule.unknown = true
+		} else {
+			code, err := strconv.ParseUint(option, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("unknown EDNS option %q, expected nsid, ecs, cookie, padding, keepalive, unknown or a code", option)
+			}
+			rule.code = uint16(code)
+		}
+		for _, name := range strings.Split(actions, "|") {
+			action, ok := ednsActionNames[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown EDNS option action %q, expected honor, forward, echo or strip", name)
+			}
+			if action == 0 && actions != name {
+				return nil, fmt.Errorf("%q: strip can't be combined with other actions", spec)
+			}
+			rule.action |= action
+		}
+		if networks != "" {
+			var err error
+			if rule.clients, err = parsePrefixes(strings.ReplaceAll(networks, "+", ",")); err != nil {
+				return nil, err
+			}
+		}
+		p.rules = append(p.rules, rule)
+	}
+	return p, nil
+}
+
+// action returns what is done with the option code of a query from client:
+// the rule with the most specific network containing client wins, rules for
+// the code itself before unknown ones
+func (p *EDNSPolicy) action(client netip.Addr, code uint16) ednsAction {
+	if p == nil {
+		return ednsHonor
+	}
+	_, named := ednsNameOf(code)
+	action, best := ednsHonor, -1
+	for _, rule := range p.rules {
+		if rule.unknown && named || !rule.unknown && rule.code != code {
+			continue
+		}
+		bits := -1
+		for _, prefix := range rule.clients {
+			if prefix.Contains(client) && prefix.Bits() > bits {
+				bits = prefix.Bits()
+			}
+		}
+		if len(rule.clients) > 0 && bits < 0 {
+			continue
+		}
+		// Twice the prefix length leaves room to rank code rules first
+		rank := 2 * (bits + 1)
+		if !rule.unknown {
+			rank++
+		}
+		if rank > best {
+			action, best = rule.action, rank
+		}
+	}
+	return action
+}
+
+// ednsNameOf returns the name of an option code, false for unknown options
+func ednsNameOf(code uint16) (string, bool) {
+	for name, c := range ednsOptionNames {
+		if c == code {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// honors reports whether the server may act on the option code of client
+func (p *EDNSPolicy) honors(client netip.Addr, code uint16) bool {
+	return p.action(client, code)&ednsHonor != 0
+}
+
+// options returns the options of query whose action for client includes want
+func (p *EDNSPolicy) options(client netip.Addr, query *dnsmessage.Message, want ednsAction) []dnsmessage.Option {
+	opt := optRecord(query)
+	if opt == nil {
+		return nil
+	}
+	data, _ := opt.Data.(*dnsmessage.OPT)
+	if data == nil {
+		return nil
+	}
+	var options []dnsmessage.Option
+	for _, o := range data.Options {
+		if p.action(client, o.Code)&want != 0 {
+			options = append(options, o)
+		}
+	}
+	return options
+}
+
+// hasOption reports whether the OPT record of m carries the option code
+func hasOption(m *dnsmessage.Message, code uint16) bool {
+	if opt := optRecord(m); opt != nil {
+		if data, ok := opt.Data.(*dnsmessage.OPT); ok {
+			for _, o := range data.Options {
+				if o.Code == code {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// optionsKey tells apart lookups forwarding different options
+func optionsKey(options []dnsmessage.Option) string {
+	return (&dnsmessage.OPT{Options: options}).String()
+}
+
+// pad adds a padding option to the OPT record of reply so its size is a
+// multiple of paddingBlock (https://www.rfc-editor.org/rfc/rfc7830)
+func pad(reply *dnsmessage.Message) error {
+	opt := optRecord(reply)
+	if opt == nil {
+		return nil
+	}
+	packed, err := reply.Pack()
+	if err != nil {
+		return err
+	}
+	// The option header takes 4 bytes of the block too
+	length := (paddingBlock - (len(packed)+4)%paddingBlock) % paddingBlock
+	data := opt.Data.(*dnsmessage.OPT)
+	opt.Data = &dnsmessage.OPT{Options: append(append([]dnsmessage.Option(nil), data.Options...), dnsmessage.Option{Code: ednsOptionPadding, Data: make([]byte, length)})}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+func TestEDNSPolicyActions(t *testing.T) {
+	p, err := NewEDNSPolicy("ecs=strip,ecs=forward@10.0.0.0/8,ecs=echo@10.1.0.0/16,unknown=forward|echo,65001=strip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		client string
+		code   uint16
+		want   ednsAction
+	}{
+		{"192.0.2.1", ednsOptionECS, 0},
+		{"10.2.0.1", ednsOptionECS, ednsForward},
+		{"10.1.0.1", ednsOptionECS, ednsEcho},
+		{"192.0.2.1", ednsOptionCookie, ednsHonor},
+		{"192.0.2.1", 65000, ednsForward | ednsEcho},
+		// Rules for a code win over unknown ones
+		{"192.0.2.1", 65001, 0},
+	}
+	for _, tt := range tests {
+		if got := p.action(netip.MustParseAddr(tt.client), tt.code); got != tt.want {
+			t.Errorf("%s option %d: expected %b, got %b", tt.client, tt.code, tt.want, got)
+		}
+	}
+	if got := (*EDNSPolicy)(nil).action(netip.MustParseAddr("192.0.2.1"), ednsOptionNSID); got != ednsHonor {
+		t.Errorf("Expected options to be honored without a policy, got %b", got)
+	}
+
+	for _, spec := range []string{"ecs", "ecs=drop", "bogus=strip", "ecs=strip|echo", "ecs=echo@not-a-network"} {
+		if _, err := NewEDNSPolicy(spec); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestServerAppliesEDNSPolicy(t *testing.T) {
+	var mu sync.Mutex
+	var forwarded []dnsmessage.Option
+	s := newTestServer(t, dnstest.StartUDPServer(t, func(query *dnsmessage.Message) *dnsmessage.Message {
+		mu.Lock()
+		defer mu.Unlock()
+		if opt := optRecord(query); opt != nil {
+			forwarded = opt.Data.(*dnsmessage.OPT).Options
+		}
+		return answerA("192.0.2.1")(query)
+	}).Addr)
+	var err error
+	if s.EDNSPolicy, err = NewEDNSPolicy("ecs=strip,65000=forward,nsid=echo"); err != nil {
+		t.Fatal(err)
+	}
+	query := testQuery("www.example")
+	opt := newOPT(4096, false)
+	opt.Data = &dnsmessage.OPT{Options: []dnsmessage.Option{
+		{Code: ednsOptionECS, Data: []byte{0, 1, 24, 0, 192, 0, 2}},
+		{Code: 65000, Data: []byte("forward me")},
+		{Code: ednsOptionNSID},
+	}}
+	query.Additionals = []dnsmessage.Resource{opt}
+	reply := handle(s, query)
+
+	mu.Lock()
+	if len(forwarded) != 1 || forwarded[0].Code != 65000 {
+		t.Errorf("Expected only option 65000 to be forwarded, got %v", forwarded)
+	}
+	mu.Unlock()
+	echoed := optRecord(reply).Data.(*dnsmessage.OPT).Options
+	if len(echoed) != 1 || echoed[0].Code != ednsOptionNSID {
+		t.Errorf("Expected only the NSID option to be echoed, got %v", echoed)
+	}
+}
+
+func TestServerPadsTCPReplies(t *testing.T) {
+	s := newTestServer(t, dnstest.StartUDPServer(t, answerA("192.0.2.1")).Addr)
+	query := testQuery("www.example")
+	opt := newOPT(4096, false)
+	opt.Data = &dnsmessage.OPT{Options: []dnsmessage.Option{{Code: ednsOptionPadding, Data: make([]byte, 100)}}}
+	query.Additionals = []dnsmessage.Resource{opt}
+
+	reply := s.Handle(context.Background(), &QueryContext{Client: testClient, Transport: "tcp", Query: query})
+	packed, err := reply.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packed)%paddingBlock != 0 {
+		t.Errorf("Expected the reply to be padded to a multiple of %d bytes, got %d", paddingBlock, len(packed))
+	}
+	if reply = handle(s, query); hasOption(reply, ednsOptionPadding) {
+		t.Error("Expected UDP replies to be left unpadded")
+	}
+
+	s.EDNSPolicy, _ = NewEDNSPolicy("padding=strip")
+	if reply = s.Handle(context.Background(), &QueryContext{Client: testClient, Transport: "tcp", Query: query}); hasOption(reply, ednsOptionPadding) {
+		t.Error("Expected stripped padding not to be honored")
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// Blocklist is a list of blocked domains, each one also blocking its subdomains
+type Blocklist struct {
+	// Name identifies the list in the firewall statistics
+	Name string
+	// rules maps a blocked domain to the rule it was listed as
+	rules map[string]string
+}
+
+// LoadBlocklist reads a blocklist file. Each line holds a domain, optionally in
+// hosts file form ("0.0.0.0 ads.example") or as a wildcard ("*.ads.example");
+// everything after a # is a comment.
+func LoadBlocklist(path string) (*Blocklist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	l := &Blocklist{Name: filepath.Base(path), rules: make(map[string]string)}
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		switch len(fields) {
+		case 0:
+			continue
+		case 1:
+		case 2:
+			// hosts file entry, the address is irrelevant
+			fields = fields[1:]
+		default:
+			return nil, fmt.Errorf("%s:%d: expected a domain, got %q", path, lineNo, line)
+		}
+		rule := fields[0]
+		domain := canonicalName(strings.TrimPrefix(rule, "*."))
+		if domain == dnsmessage.Root || domain == "localhost" {
+			continue
+		}
+		l.rules[domain] = rule
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return l, nil
+}
+
+// Len returns the number of rules in the list
+func (l *Blocklist) Len() int {
+	return len(l.rules)
+}
+
+// match returns the rule blocking name, the most specific one if several do
+func (l *Blocklist) match(name string) (string, bool) {
+	for name = canonicalName(name); name != dnsmessage.Root; name = parentName(name) {
+		if rule, ok := l.rules[name]; ok {
+			return rule, true
+		}
+	}
+	return "", false
+}
+
+// Firewall blocks queries for names on its blocklists and records which rules
+// matched
+type Firewall struct {
+	Lists []*Blocklist
+	Stats *FirewallStats
+	// BlockPage is a URL explaining blocked names to the users, sent along
+	// as TXT record in the additional section when set
+	BlockPage string
+}
+
+// NewFirewall creates a firewall from blocklists, registering their rules with
+// stats so rules that never match show up too
+func NewFirewall(stats *FirewallStats, lists ...*Blocklist) *Firewall {
+	for _, l := range lists {
+		for _, rule := range l.rules {
+			stats.Register(Rule{List: l.Name, Pattern: rule})
+		}
+	}
+	return &Firewall{Lists: lists, Stats: stats}
+}
+
+// answer returns the blocked answer for question, or nil when no rule matches.
+// It carries an Extended DNS Error telling the name is blocked, so users see
+// why instead of a plain NXDOMAIN.
+func (fw *Firewall) answer(question dnsmessage.Question) *dnsmessage.Message {
+	if fw == nil {
+		return nil
+	}
+	for _, l := range fw.Lists {
+		if rule, ok := l.match(question.Name); ok {
+			fw.Stats.Hit(Rule{List: l.Name, Pattern: rule})
+			resp := &dnsmessage.Message{Header: dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeNameError}}
+			text := fmt.Sprintf("%s is on blocklist %s", dnsmessage.FQDN(question.Name), l.Name)
+			if fw.BlockPage != "" {
+				text += ", see " + fw.BlockPage
+				resp.Additionals = append(resp.Additionals, dnsmessage.Resource{
+					Name: question.Name, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET, TTL: 60,
+					Data: &dnsmessage.TXT{Text: []string{"Blocked, see " + fw.BlockPage}},
+				})
+			}
+			opt := newOPT(maxUDPSize, false)
+			opt.Data = &dnsmessage.OPT{Options: []dnsmessage.Option{extendedError(edeBlocked, text)}}
+			resp.Additionals = append(resp.Additionals, opt)
+			return resp
+		}
+	}
+	return nil
+}
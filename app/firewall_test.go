@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+// writeBlocklist writes a blocklist file named name and loads it
+func writeBlocklist(t *testing.T, name, content string) *Blocklist {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	l, err := LoadBlocklist(path)
+	if err != nil {
+		t.Fatalf("LoadBlocklist failed: %v", err)
+	}
+	return l
+}
+
+func TestFirewallBlocksListedDomains(t *testing.T) {
+	list := writeBlocklist(t, "ads.txt", `
+# comment
+ads.example
+0.0.0.0 Tracker.Example   # hosts file entry
+*.metrics.example
+0.0.0.0 localhost
+`)
+	if list.Len() != 3 {
+		t.Fatalf("Expected 3 rules, got %d", list.Len())
+	}
+	fw := NewFirewall(NewFirewallStats(), list)
+
+	tests := []struct {
+		name    string
+		blocked bool
+	}{
+		{"ads.example", true},
+		{"cdn.ads.example", true},
+		{"TRACKER.example.", true},
+		{"metrics.example", true},
+		{"a.b.metrics.example", true},
+		{"example", false},
+		{"badads.example", false},
+		{"localhost", false},
+	}
+	for _, tt := range tests {
+		resp := fw.answer(question(tt.name, dnsmessage.TypeA))
+		if blocked := resp != nil && resp.RCode == dnsmessage.RCodeNameError; blocked != tt.blocked {
+			t.Errorf("%s: expected blocked=%v, got %v", tt.name, tt.blocked, resp)
+		}
+	}
+}
+
+func TestFirewallExplainsBlockedAnswers(t *testing.T) {
+	s := newTestServer(t, dnstest.StartUDPServer(t, answerA("192.0.2.1")).Addr)
+	s.Firewall = NewFirewall(NewFirewallStats(), writeBlocklist(t, "ads.txt", "ads.example\n"))
+	s.Firewall.BlockPage = "http://blocked.home.lan/"
+
+	query := testQuery("ads.example")
+	query.Additionals = []dnsmessage.Resource{newOPT(ednsUDPSize, false)}
+	reply := handle(s, query)
+	if reply.RCode != dnsmessage.RCodeNameError {
+		t.Fatalf("Expected NXDOMAIN, got %s", reply.RCode)
+	}
+	errs := extendedErrors(reply)
+	if len(errs) != 1 || string(errs[0].Data[2:]) != "ads.example. is on blocklist ads.txt, see http://blocked.home.lan/" {
+		t.Errorf("Expected an extended error naming the blocklist, got %+v", errs)
+	}
+	if len(reply.Additionals) != 2 || reply.Additionals[0].Type != dnsmessage.TypeTXT {
+		t.Errorf("Expected a TXT record with the block page, got %+v", reply.Additionals)
+	}
+
+	// Clients without EDNS get the TXT record alone
+	if reply = handle(s, testQuery("ads.example")); len(reply.Additionals) != 1 || optRecord(reply) != nil {
+		t.Errorf("Expected no OPT record, got %+v", reply.Additionals)
+	}
+}
+
+func TestFirewallStatsPersist(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0).UTC()}
+	list := writeBlocklist(t, "ads.txt", "ads.example\nunused.example\n")
+	stats := NewFirewallStats()
+	stats.now = clock.Now
+	fw := NewFirewall(stats, list)
+
+	fw.answer(question("ads.example", dnsmessage.TypeA))
+	clock.Advance(time.Hour)
+	fw.answer(question("www.ads.example", dnsmessage.TypeAAAA))
+
+	path := filepath.Join(t.TempDir(), "stats.json")
+	if err := stats.Save(path); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	// A restart with one more rule and one removed
+	restarted := NewFirewallStats()
+	NewFirewall(restarted, writeBlocklist(t, "ads.txt", "ads.example\nnew.example\n"))
+	if err := restarted.Load(path); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	got := restarted.Snapshot()
+	if len(got) != 2 {
+		t.Fatalf("Expected the 2 current rules, got %+v", got)
+	}
+	ads, fresh := got[0], got[1]
+	if ads.Pattern != "ads.example" || ads.Hits != 2 || ads.LastHit == nil || !ads.LastHit.Equal(clock.now) {
+		t.Errorf("Expected 2 hits last at %s restored, got %+v", clock.now, ads)
+	}
+	if fresh.Pattern != "new.example" || fresh.Hits != 0 || fresh.LastHit != nil {
+		t.Errorf("Expected the new rule without hits, got %+v", fresh)
+	}
+
+	if err := NewFirewallStats().Load(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Errorf("A missing statistics file should not be an error: %v", err)
+	}
+}
+
+func TestAdminFirewallRules(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0).UTC()}
+	stats := NewFirewallStats()
+	stats.now = clock.Now
+	s := &Server{FirewallStats: stats, Firewall: NewFirewall(stats,
+		writeBlocklist(t, "ads.txt", "ads.example\nold.example\nnever.example\n"),
+		writeBlocklist(t, "malware.txt", "malware.example\n"),
+	)}
+	s.Firewall.answer(question("old.example", dnsmessage.TypeA))
+	clock.Advance(48 * time.Hour)
+	s.Firewall.answer(question("ads.example", dnsmessage.TypeA))
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"ads.example", "never.example", "old.example", "malware.example"}},
+		{"?list=malware.txt", []string{"malware.example"}},
+		{"?unused=true", []string{"never.example", "malware.example"}},
+		{"?idle=24h", []string{"never.example", "old.example", "malware.example"}},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		s.AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/firewall/rules"+tt.query, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status %d: %s", tt.query, rec.Code, rec.Body)
+		}
+		var rules []RuleHits
+		if err := json.Unmarshal(rec.Body.Bytes(), &rules); err != nil {
+			t.Fatalf("%s: invalid JSON: %v", tt.query, err)
+		}
+		var got []string
+		for _, r := range rules {
+			got = append(got, r.Pattern)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.query, tt.want, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: expected %v, got %v", tt.query, tt.want, got)
+				break
+			}
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	s.AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/firewall/rules?idle=soon", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid duration to be rejected, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Rule identifies a firewall rule: the list it belongs to and the rule as written there
+type Rule struct {
+	List    string `json:"list"`
+	Pattern string `json:"rule"`
+}
+
+// RuleHits is how often a rule matched and when it last did
+type RuleHits struct {
+	Rule
+	Hits    uint64     `json:"hits"`
+	LastHit *time.Time `json:"last_hit,omitempty"`
+}
+
+// FirewallStats counts hits per firewall rule. The counters can be saved to a
+// file so they survive restarts, which is what makes them useful to find rules
+// that never match.
+type FirewallStats struct {
+	mu    sync.Mutex
+	rules map[Rule]*RuleHits
+	now   func() time.Time
+}
+
+// NewFirewallStats creates empty statistics
+func NewFirewallStats() *FirewallStats {
+	return &FirewallStats{rules: make(map[Rule]*RuleHits), now: time.Now}
+}
+
+// Register adds a rule with no hits, keeping the counters of a known rule
+func (s *FirewallStats) Register(rule Rule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.rules[rule]; !ok {
+		s.rules[rule] = &RuleHits{Rule: rule}
+	}
+}
+
+// Hit records a match of rule
+func (s *FirewallStats) Hit(rule Rule) {
+	now := s.now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.rules[rule]
+	if !ok {
+		h = &RuleHits{Rule: rule}
+		s.rules[rule] = h
+	}
+	h.Hits++
+	h.LastHit = &now
+}
+
+// Snapshot returns the counters of all rules ordered by list and rule
+func (s *FirewallStats) Snapshot() []RuleHits {
+	s.mu.Lock()
+	hits := make([]RuleHits, 0, len(s.rules))
+	for _, h := range s.rules {
+		hits = append(hits, *h)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].List != hits[j].List {
+			return hits[i].List < hits[j].List
+		}
+		return hits[i].Pattern < hits[j].Pattern
+	})
+	return hits
+}
+
+// Load restores the counters of registered rules from a file written by Save.
+// Counters of rules that are no longer registered are dropped, as is a missing file.
+func (s *FirewallStats) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved []RuleHits
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	s.merge(saved)
+	return nil
+}
+
+// merge adds the counters of the registered rules in hits
+func (s *FirewallStats) merge(hits []RuleHits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, h := range hits {
+		if known, ok := s.rules[h.Rule]; ok {
+			known.Hits += h.Hits
+			if known.LastHit == nil || h.LastHit != nil && h.LastHit.After(*known.LastHit) {
+				known.LastHit = h.LastHit
+			}
+		}
+	}
+}
+
+// Save writes the counters to path, replacing it atomically so a crash never
+// leaves a partial file behind
+func (s *FirewallStats) Save(path string) error {
+	data, err := json.MarshalIndent(s.Snapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
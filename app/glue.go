@@ -0,0 +1,75 @@
+package main
+
+import (
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// additionalTarget returns the name whose addresses go into the additional
+// section along with rr, for the record types that name a host
+// (https://www.rfc-editor.org/rfc/rfc1035#section-3.3.9)
+func additionalTarget(rr dnsmessage.Resource) (string, bool) {
+	switch data := rr.Data.(type) {
+	case *dnsmessage.NS:
+		return canonicalName(data.Host), true
+	case *dnsmessage.MX:
+		return canonicalName(data.Host), true
+	case *dnsmessage.SRV:
+		// A target of . means the service is not available
+		if target := canonicalName(data.Target); target != dnsmessage.Root {
+			return target, true
+		}
+	}
+	return "", false
+}
+
+// additionals returns the A and AAAA records held for the hosts records name,
+// for the additional section. The caller holds d.mu.
+func (d *LocalData) additionals(records []dnsmessage.Resource) []dnsmessage.Resource {
+	var extra []dnsmessage.Resource
+	seen := make(map[string]bool)
+	for _, rr := range records {
+		target, ok := additionalTarget(rr)
+		if !ok || seen[target] {
+			continue
+		}
+		seen[target] = true
+		for _, addr := range d.records[target] {
+			if addr.Type == dnsmessage.TypeA || addr.Type == dnsmessage.TypeAAAA {
+				extra = append(extra, addr)
+			}
+		}
+	}
+	return extra
+}
+
+// withoutOptionalAdditionals returns reply without the additional records it
+// can do without, so it may fit into a UDP response without truncation
+// (https://www.rfc-editor.org/rfc/rfc2181#section-9). The addresses of name
+// servers inside the zone of their NS records stay, they are needed to reach
+// the zone at all (https://www.rfc-editor.org/rfc/rfc9471#section-3). Signed
+// replies are returned as they are, dropping records breaks the signature.
+func withoutOptionalAdditionals(reply *dnsmessage.Message) *dnsmessage.Message {
+	required := make(map[string]bool)
+	for _, section := range [][]dnsmessage.Resource{reply.Answers, reply.Authorities} {
+		for _, rr := range section {
+			if ns, ok := rr.Data.(*dnsmessage.NS); ok && isSubdomain(canonicalName(ns.Host), canonicalName(rr.Name)) {
+				required[canonicalName(ns.Host)] = true
+			}
+		}
+	}
+	var kept []dnsmessage.Resource
+	for _, rr := range reply.Additionals {
+		switch {
+		case rr.Type == dnsmessage.TypeTSIG:
+			return reply
+		case rr.Type == dnsmessage.TypeOPT, required[canonicalName(rr.Name)]:
+			kept = append(kept, rr)
+		}
+	}
+	if len(kept) == len(reply.Additionals) {
+		return reply
+	}
+	trimmed := *reply
+	trimmed.Additionals = kept
+	return &trimmed
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+func nsRecord(zone, host string) dnsmessage.Resource {
+	return dnsmessage.Resource{Name: zone, Type: dnsmessage.TypeNS, Class: dnsmessage.ClassINET, TTL: 300, Data: &dnsmessage.NS{Host: host}}
+}
+
+func TestWithoutOptionalAdditionals(t *testing.T) {
+	reply := &dnsmessage.Message{
+		Answers:     []dnsmessage.Resource{nsRecord("example.com", "ns1.example.com"), nsRecord("example.com", "ns.other.net")},
+		Additionals: []dnsmessage.Resource{aRecord("ns1.example.com", "192.0.2.1"), aRecord("ns.other.net", "198.51.100.1"), newOPT(1232, false)},
+	}
+	trimmed := withoutOptionalAdditionals(reply)
+	if len(trimmed.Additionals) != 2 || trimmed.Additionals[0].Name != "ns1.example.com" || trimmed.Additionals[1].Type != dnsmessage.TypeOPT {
+		t.Errorf("Expected the in-zone glue and the OPT record to stay, got %v", trimmed.Additionals)
+	}
+	if len(reply.Additionals) != 3 {
+		t.Error("Expected the reply to be left alone")
+	}
+
+	// Signed replies stay whole
+	reply.Additionals = append(reply.Additionals, dnsmessage.Resource{Name: "key", Type: dnsmessage.TypeTSIG, Class: dnsmessage.ClassANY, Data: &dnsmessage.TSIG{}})
+	if got := withoutOptionalAdditionals(reply); got != reply {
+		t.Errorf("Expected a signed reply to be kept, got %v", got.Additionals)
+	}
+}
+
+func TestUDPDropsOptionalAdditionals(t *testing.T) {
+	d := NewLocalData()
+	var records []dnsmessage.Resource
+	for i := 0; i < 12; i++ {
+		host := fmt.Sprintf("mail%d.example.net", i)
+		records = append(records,
+			dnsmessage.Resource{Name: "example.com", Type: dnsmessage.TypeMX, Class: dnsmessage.ClassINET, TTL: 300, Data: &dnsmessage.MX{Preference: uint16(i), Host: host}},
+			aRecord(host, fmt.Sprintf("192.0.2.%d", i)),
+			dnsmessage.Resource{Name: host, Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET, TTL: 300, Data: &dnsmessage.AAAA{Addr: netip.MustParseAddr(fmt.Sprintf("2001:db8::%d", i))}},
+		)
+	}
+	d.Add(records...)
+	addr := startTestServer(t, &Server{LocalData: d})
+	query := &dnsmessage.Message{Header: dnsmessage.Header{ID: 5}, Questions: []dnsmessage.Question{question("example.com", dnsmessage.TypeMX)}}
+
+	// Over TCP everything fits
+	if reply := dnstest.ExchangeTCP(t, addr, query); len(reply.Answers) != 12 || len(reply.Additionals) != 24 {
+		t.Fatalf("Expected 12 answers and 24 additionals over TCP, got %d and %d", len(reply.Answers), len(reply.Additionals))
+	}
+	// Over UDP the addresses are dropped instead of truncating the answer
+	reply := dnstest.ExchangeUDP(t, addr, query)
+	if reply.Truncated || len(reply.Answers) != 12 || len(reply.Additionals) != 0 {
+		t.Errorf("Expected the 12 answers without additionals and truncation, got %d, %d and TC %v", len(reply.Answers), len(reply.Additionals), reply.Truncated)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// handoffEnv tells a process started by handOff that it inherits the sockets of
+// its parent: the UDP socket as fd 3, the TCP listener as fd 4 and fd 5 to
+// report on once it serves them
+const handoffEnv = "DNS_SERVER_HANDOFF"
+
+// handoffAdminEnv tells a process started by handOff that it also inherits the
+// listener of the admin API, as fd 6
+const handoffAdminEnv = "DNS_SERVER_HANDOFF_ADMIN"
+
+const (
+	// handoffReadyTimeout is how long the new process may take to start serving
+	handoffReadyTimeout = 10 * time.Second
+	// handoffDrainTimeout is how long the old process, or one stopped by a
+	// signal, keeps answering the queries it already read before exiting
+	handoffDrainTimeout = 5 * time.Second
+)
+
+// listen opens the UDP socket and TCP listener on addr, or takes over those of
+// the parent process after a handoff or those systemd passed. ready must be
+// called once they are served, it tells the parent or systemd.
+func listen(addr string) (udp *net.UDPConn, tcp *net.TCPListener, ready func(), err error) {
+	// Telling systemd is best effort, the service serves either way
+	notifyReady := func() {
+		if err := sdNotify("READY=1", "STATUS=Serving on "+udp.LocalAddr().String()); err != nil {
+			log.Printf("Failed to report readiness: %v", err)
+		}
+	}
+	if os.Getenv(handoffEnv) == "" {
+		if udp, tcp, err = systemdSockets(); err != nil {
+			return nil, nil, nil, fmt.Errorf("sockets passed by systemd: %w", err)
+		} else if udp != nil {
+			log.Printf("Serving the sockets on %s and %s passed by systemd", udp.LocalAddr(), tcp.Addr())
+			return udp, tcp, notifyReady, nil
+		}
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("resolving UDP address: %w", err)
+		}
+		if udp, err = net.ListenUDP("udp", udpAddr); err != nil {
+			return nil, nil, nil, fmt.Errorf("binding UDP: %w", explainBindError("udp", addr, err))
+		}
+		// TCP serves the clients retrying truncated UDP answers
+		l, err := net.Listen("tcp", udp.LocalAddr().String())
+		if err != nil {
+			udp.Close()
+			return nil, nil, nil, fmt.Errorf("binding TCP: %w", explainBindError("tcp", udp.LocalAddr().String(), err))
+		}
+		return udp, l.(*net.TCPListener), notifyReady, nil
+	}
+
+	os.Unsetenv(handoffEnv)
+	udpFile, tcpFile, readyFile := os.NewFile(3, "udp"), os.NewFile(4, "tcp"), os.NewFile(5, "ready")
+	defer udpFile.Close()
+	defer tcpFile.Close()
+	pc, err := net.FilePacketConn(udpFile)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("inherited UDP socket: %w", err)
+	}
+	l, err := net.FileListener(tcpFile)
+	if err != nil {
+		pc.Close()
+		return nil, nil, nil, fmt.Errorf("inherited TCP listener: %w", err)
+	}
+	udp, okUDP := pc.(*net.UDPConn)
+	tcp, okTCP := l.(*net.TCPListener)
+	if !okUDP || !okTCP || udp.LocalAddr().String() != tcp.Addr().String() {
+		pc.Close()
+		l.Close()
+		return nil, nil, nil, errors.New("inherited sockets are not a UDP socket and a TCP listener on the same address")
+	}
+	log.Printf("Took over the sockets on %s from the previous process", udp.LocalAddr())
+	return udp, tcp, func() {
+		readyFile.Write([]byte{1})
+		readyFile.Close()
+	}, nil
+}
+
+// listenAdmin opens the listener of the admin API on addr, or takes over that
+// of the parent process after a handoff
+func listenAdmin(addr string) (*net.TCPListener, error) {
+	if os.Getenv(handoffAdminEnv) == "" {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, explainBindError("tcp", addr, err)
+		}
+		return l.(*net.TCPListener), nil
+	}
+	os.Unsetenv(handoffAdminEnv)
+	f := os.NewFile(6, "admin")
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("inherited admin listener: %w", err)
+	}
+	tcp, ok := l.(*net.TCPListener)
+	if !ok {
+		l.Close()
+		return nil, errors.New("inherited admin listener is not a TCP listener")
+	}
+	log.Printf("Took over the admin API listener on %s from the previous process", tcp.Addr())
+	return tcp, nil
+}
+
+// handOff starts a new process with the same arguments that takes over udp,
+// tcp and admin, the listener of the admin API if not nil, and returns once it
+// serves them. The caller then stops serving and drains. The new process is a
+// child of this one, a service manager tracking the main process must allow it
+// to go on after this one exits.
+func handOff(udp *net.UDPConn, tcp *net.TCPListener, admin *net.TCPListener) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	// File returns duplicates, the sockets stay open in both processes
+	udpFile, err := udp.File()
+	if err != nil {
+		return err
+	}
+	defer udpFile.Close()
+	tcpFile, err := tcp.File()
+	if err != nil {
+		return err
+	}
+	defer tcpFile.Close()
+	readyRead, readyWrite, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyRead.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), handoffEnv+"=1")
+	cmd.ExtraFiles = []*os.File{udpFile, tcpFile, readyWrite}
+	if admin != nil {
+		adminFile, err := admin.File()
+		if err != nil {
+			readyWrite.Close()
+			return err
+		}
+		defer adminFile.Close()
+		cmd.Env = append(cmd.Env, handoffAdminEnv+"=1")
+		cmd.ExtraFiles = append(cmd.ExtraFiles, adminFile)
+	}
+	err = cmd.Start()
+	readyWrite.Close()
+	if err != nil {
+		return err
+	}
+
+	// The new process writes a byte once it serves, EOF means it exited before
+	readyRead.SetReadDeadline(time.Now().Add(handoffReadyTimeout))
+	if _, err := readyRead.Read(make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("new process did not take over: %w", err)
+	}
+	log.Printf("Handed the sockets over to process %d", cmd.Process.Pid)
+	// systemd tracks the new process as the main one from now on
+	if err := sdNotify(fmt.Sprintf("MAINPID=%d", cmd.Process.Pid)); err != nil {
+		log.Printf("Failed to report the new main process: %v", err)
+	}
+	return cmd.Process.Release()
+}
+
+// stopServing makes ServeUDP and ServeTCP return without closing the sockets,
+// so the queries being answered can still be replied to, see Drain
+func (s *Server) stopServing(udp *net.UDPConn, tcp *net.TCPListener) {
+	s.draining.Store(true)
+	// Wakes up ServeUDP, the socket stays usable for writing
+	udp.SetReadDeadline(time.Now())
+	tcp.Close()
+}
+
+// Drain waits for the queries being answered to be replied to, at most timeout
+func (s *Server) Drain(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
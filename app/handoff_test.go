@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+func TestStopServingDrains(t *testing.T) {
+	s := newTestServer(t, dnstest.StartUDPServer(t, answerA("192.0.2.1")).Addr)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpDone, tcpDone := make(chan error, 1), make(chan error, 1)
+	go func() { udpDone <- s.ServeUDP(conn) }()
+	go func() { tcpDone <- s.ServeTCP(l) }()
+
+	if resp := dnstest.ExchangeUDP(t, conn.LocalAddr().String(), testQuery("example.com")); len(resp.Answers) != 1 {
+		t.Fatalf("Expected an answer before stopping, got %+v", resp)
+	}
+	s.stopServing(conn, l)
+	for name, done := range map[string]chan error{"UDP": udpDone, "TCP": tcpDone} {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Expected %s serving to stop without error, got %v", name, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected %s serving to stop", name)
+		}
+	}
+	if !s.Drain(time.Second) {
+		t.Error("Expected no query left to drain")
+	}
+	// The socket itself stays open for the process taking over
+	if _, err := conn.WriteToUDP([]byte{0}, conn.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Errorf("Expected the UDP socket to stay usable, got %v", err)
+	}
+}
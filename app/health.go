@@ -0,0 +1,100 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// maxConsecutiveFailures is how many timeouts in a row mark an upstream as dead
+	maxConsecutiveFailures = 3
+	// minDeadTime and maxDeadTime bound the exponential backoff before a dead upstream is retried
+	minDeadTime = time.Second
+	maxDeadTime = 30 * time.Second
+)
+
+// UpstreamHealth tracks whether an upstream is currently worth sending queries to.
+// Timeouts only mark the upstream dead after a few in a row, while an ICMP
+// port/host unreachable is a definitive signal and marks it dead immediately.
+type UpstreamHealth struct {
+	mu        sync.Mutex
+	failures  int
+	deadTime  time.Duration
+	deadUntil time.Time
+	lastError error
+	now       func() time.Time
+}
+
+func newUpstreamHealth() *UpstreamHealth {
+	return &UpstreamHealth{now: time.Now}
+}
+
+// Alive reports whether the upstream should be tried
+func (h *UpstreamHealth) Alive() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return !h.now().Before(h.deadUntil)
+}
+
+// DeadUntil returns when a dead upstream becomes eligible again, zero if it is alive
+func (h *UpstreamHealth) DeadUntil() time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.now().Before(h.deadUntil) {
+		return time.Time{}
+	}
+	return h.deadUntil
+}
+
+// Failures returns the number of failures since the last success
+func (h *UpstreamHealth) Failures() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.failures
+}
+
+// LastError returns the error of the most recent failure
+func (h *UpstreamHealth) LastError() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.lastError
+}
+
+// MarkSuccess resets the failure counters after a good response
+func (h *UpstreamHealth) MarkSuccess() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failures = 0
+	h.deadTime = 0
+	h.deadUntil = time.Time{}
+}
+
+// MarkFailure records a soft failure such as a timeout
+func (h *UpstreamHealth) MarkFailure(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastError = err
+	h.failures++
+	if h.failures >= maxConsecutiveFailures {
+		h.markDeadLocked()
+	}
+}
+
+// MarkUnreachable records a hard failure reported by the network (ICMP), the
+// upstream is considered dead right away
+func (h *UpstreamHealth) MarkUnreachable(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastError = err
+	h.failures++
+	h.markDeadLocked()
+}
+
+func (h *UpstreamHealth) markDeadLocked() {
+	if h.deadTime == 0 {
+		h.deadTime = minDeadTime
+	} else {
+		h.deadTime = min(h.deadTime*2, maxDeadTime)
+	}
+	h.deadUntil = h.now().Add(h.deadTime)
+}
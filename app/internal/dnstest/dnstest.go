@@ -0,0 +1,293 @@
+// Package dnstest runs DNS servers on ephemeral localhost ports and exchanges
+// messages with them, so tests can assert end-to-end behavior such as
+// forwarding, truncation and RCODEs without external tools
+package dnstest
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// Timeout bounds every exchange of the helpers
+const Timeout = 2 * time.Second
+
+// maxUDPSize is the largest UDP answer to queries without EDNS
+// (https://www.rfc-editor.org/rfc/rfc1035#section-4.2.1)
+const maxUDPSize = 512
+
+// Handler answers a query, nil sends no answer at all
+type Handler func(query *dnsmessage.Message) *dnsmessage.Message
+
+// Server serves a Handler over UDP, TCP or both on the same localhost port
+type Server struct {
+	// Addr is the address the server listens on, as host:port
+	Addr string
+
+	handler Handler
+	udp     *net.UDPConn
+	tcp     net.Listener
+	// truncate has UDP answers larger than the buffer of the client truncated
+	truncate bool
+
+	mu      sync.Mutex
+	queries []*dnsmessage.Message
+}
+
+// StartServer serves handler on an ephemeral localhost port over UDP and TCP
+// until the test ends. UDP answers larger than the buffer of the client are
+// truncated, so clients see them the way a real server would send them.
+func StartServer(t testing.TB, handler Handler) *Server {
+	t.Helper()
+	udp, tcp := Listen(t)
+	s := &Server{Addr: udp.LocalAddr().String(), handler: handler, udp: udp, tcp: tcp, truncate: true}
+	go s.serveUDP()
+	go s.serveTCP()
+	return s
+}
+
+// StartUDPServer serves handler on an ephemeral localhost port over UDP only
+// until the test ends
+func StartUDPServer(t testing.TB, handler Handler) *Server {
+	t.Helper()
+	return StartUDPServerOn(t, "127.0.0.1:0", handler)
+}
+
+// StartUDPServerOn serves handler over UDP only on addr until the test ends.
+// Answers are sent as the handler builds them, never truncated, so tests can
+// play upstreams sending oversized or truncated answers.
+func StartUDPServerOn(t testing.TB, addr string, handler Handler) *Server {
+	t.Helper()
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatalf("Failed to resolve %s: %v", addr, err)
+	}
+	udp, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		t.Fatalf("Failed to listen on UDP: %v", err)
+	}
+	t.Cleanup(func() { udp.Close() })
+	s := &Server{Addr: udp.LocalAddr().String(), handler: handler, udp: udp}
+	go s.serveUDP()
+	return s
+}
+
+// StartTCPServerOn serves handler over TCP only on addr until the test ends,
+// usually the port of a server from StartUDPServer answering differently
+func StartTCPServerOn(t testing.TB, addr string, handler Handler) *Server {
+	t.Helper()
+	tcp, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to listen on TCP: %v", err)
+	}
+	t.Cleanup(func() { tcp.Close() })
+	s := &Server{Addr: tcp.Addr().String(), handler: handler, tcp: tcp}
+	go s.serveTCP()
+	return s
+}
+
+// Listen listens on an ephemeral localhost port over UDP and TCP until the
+// test ends, trying other ports while the TCP port of the UDP one is taken
+func Listen(t testing.TB) (*net.UDPConn, net.Listener) {
+	t.Helper()
+	for attempt := 0; ; attempt++ {
+		udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("Failed to listen on UDP: %v", err)
+		}
+		tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+		if err != nil {
+			udp.Close()
+			if attempt < 10 {
+				continue
+			}
+			t.Fatalf("Failed to listen on TCP: %v", err)
+		}
+		t.Cleanup(func() { udp.Close(); tcp.Close() })
+		return udp, tcp
+	}
+}
+
+// Queries returns the queries the server received so far, in order
+func (s *Server) Queries() []*dnsmessage.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*dnsmessage.Message(nil), s.queries...)
+}
+
+// answer unpacks a query and packs the answer of the handler, nil when there
+// is none. Answers larger than limit returns for the query are truncated, nil
+// leaves them whole.
+func (s *Server) answer(data []byte, limit func(*dnsmessage.Message) int) []byte {
+	var query dnsmessage.Message
+	if err := query.Unpack(data); err != nil {
+		return nil
+	}
+	s.mu.Lock()
+	s.queries = append(s.queries, &query)
+	s.mu.Unlock()
+	resp := s.handler(&query)
+	if resp == nil {
+		return nil
+	}
+	packed, err := resp.Pack()
+	if err != nil {
+		return nil
+	}
+	if limit != nil && len(packed) > limit(&query) {
+		truncated := &dnsmessage.Message{Header: resp.Header, Questions: resp.Questions}
+		truncated.Truncated = true
+		if packed, err = truncated.Pack(); err != nil {
+			return nil
+		}
+	}
+	return packed
+}
+
+func (s *Server) serveUDP() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := s.udp.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		var limit func(*dnsmessage.Message) int
+		if s.truncate {
+			limit = udpLimit
+		}
+		if packed := s.answer(buf[:n], limit); packed != nil {
+			s.udp.WriteToUDP(packed, addr)
+		}
+	}
+}
+
+func (s *Server) serveTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				conn.SetDeadline(time.Now().Add(Timeout))
+				data, err := readTCP(conn)
+				if err != nil {
+					return
+				}
+				packed := s.answer(data, nil)
+				if packed == nil {
+					continue
+				}
+				if err := writeTCP(conn, packed); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// udpLimit returns the EDNS buffer size of query, 512 bytes without EDNS
+func udpLimit(query *dnsmessage.Message) int {
+	for _, rr := range query.Additionals {
+		if rr.Type == dnsmessage.TypeOPT {
+			return max(maxUDPSize, int(rr.Class))
+		}
+	}
+	return maxUDPSize
+}
+
+// ExchangeUDP sends query to addr over UDP and returns the answer, failing
+// the test when there is none within Timeout
+func ExchangeUDP(t testing.TB, addr string, query *dnsmessage.Message) *dnsmessage.Message {
+	t.Helper()
+	resp, err := Exchange("udp", addr, query)
+	if err != nil {
+		t.Fatalf("Exchange over UDP with %s failed: %v", addr, err)
+	}
+	return resp
+}
+
+// ExchangeTCP sends query to addr over TCP and returns the answer, failing
+// the test when there is none within Timeout
+func ExchangeTCP(t testing.TB, addr string, query *dnsmessage.Message) *dnsmessage.Message {
+	t.Helper()
+	resp, err := Exchange("tcp", addr, query)
+	if err != nil {
+		t.Fatalf("Exchange over TCP with %s failed: %v", addr, err)
+	}
+	return resp
+}
+
+// Exchange sends query to addr over network, "udp" or "tcp", and returns the
+// answer with the ID of the query
+func Exchange(network, addr string, query *dnsmessage.Message) (*dnsmessage.Message, error) {
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout(network, addr, Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(Timeout))
+
+	var data []byte
+	if network == "tcp" {
+		if err := writeTCP(conn, packed); err != nil {
+			return nil, err
+		}
+		if data, err = readTCP(conn); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(packed); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 65535)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		data = buf[:n]
+	}
+	var resp dnsmessage.Message
+	if err := resp.Unpack(data); err != nil {
+		return nil, err
+	}
+	if resp.ID != query.ID {
+		return nil, fmt.Errorf("answer with ID %d to the query with ID %d", resp.ID, query.ID)
+	}
+	return &resp, nil
+}
+
+// writeTCP writes msg prefixed with its two byte length
+// (https://www.rfc-editor.org/rfc/rfc1035#section-4.2.2)
+func writeTCP(w io.Writer, msg []byte) error {
+	if len(msg) > 0xFFFF {
+		return errors.New("message larger than 65535 bytes")
+	}
+	_, err := w.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...))
+	return err
+}
+
+// readTCP reads a length prefixed message
+func readTCP(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
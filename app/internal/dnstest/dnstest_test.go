@@ -0,0 +1,78 @@
+package dnstest
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+func TestZone(t *testing.T) {
+	s := StartServer(t, Zone(SOA("example.test", 60), A("www.example.test", "192.0.2.1")))
+	tests := []struct {
+		name    string
+		qtype   dnsmessage.Type
+		rcode   dnsmessage.RCode
+		answers int
+	}{
+		{"WWW.example.test.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, 1},
+		{"www.example.test", dnsmessage.TypeMX, dnsmessage.RCodeSuccess, 0},
+		{"missing.example.test", dnsmessage.TypeA, dnsmessage.RCodeNameError, 0},
+	}
+	for _, tt := range tests {
+		resp := ExchangeUDP(t, s.Addr, Query(tt.name, tt.qtype))
+		if resp.RCode != tt.rcode || len(resp.Answers) != tt.answers || !resp.Authoritative {
+			t.Errorf("%s %s: expected %s with %d answers, got %s", tt.name, tt.qtype, tt.rcode, tt.answers, resp)
+		}
+		if tt.answers == 0 && (len(resp.Authorities) != 1 || resp.Authorities[0].Type != dnsmessage.TypeSOA) {
+			t.Errorf("%s %s: expected the SOA with the negative answer, got %v", tt.name, tt.qtype, resp.Authorities)
+		}
+	}
+	if got := len(s.Queries()); got != len(tests) {
+		t.Errorf("Expected %d queries to be recorded, got %d", len(tests), got)
+	}
+}
+
+func TestServerTruncatesOverUDP(t *testing.T) {
+	var records []dnsmessage.Resource
+	for i := 1; i <= 40; i++ {
+		records = append(records, A("big.example.test", fmt.Sprintf("192.0.2.%d", i)))
+	}
+	s := StartServer(t, Zone(records...))
+
+	if resp := ExchangeUDP(t, s.Addr, Query("big.example.test", dnsmessage.TypeA)); !resp.Truncated || len(resp.Answers) != 0 {
+		t.Errorf("Expected a truncated answer over UDP, got %s", resp)
+	}
+	query := Query("big.example.test", dnsmessage.TypeA)
+	query.Additionals = []dnsmessage.Resource{{Name: dnsmessage.Root, Type: dnsmessage.TypeOPT, Class: 4096, Data: &dnsmessage.OPT{}}}
+	if resp := ExchangeUDP(t, s.Addr, query); resp.Truncated || len(resp.Answers) != 40 {
+		t.Errorf("Expected the full answer within the EDNS buffer, got %s", resp)
+	}
+	if resp := ExchangeTCP(t, s.Addr, Query("big.example.test", dnsmessage.TypeA)); resp.Truncated || len(resp.Answers) != 40 {
+		t.Errorf("Expected the full answer over TCP, got %s", resp)
+	}
+}
+
+func TestRCode(t *testing.T) {
+	s := StartServer(t, RCode(dnsmessage.RCodeRefused))
+	if resp := ExchangeTCP(t, s.Addr, Query("example.test", dnsmessage.TypeA)); resp.RCode != dnsmessage.RCodeRefused {
+		t.Errorf("Expected REFUSED, got %s", resp.RCode)
+	}
+}
+
+func TestUDPAndTCPServers(t *testing.T) {
+	var records []dnsmessage.Resource
+	for i := 1; i <= 40; i++ {
+		records = append(records, A("big.example.test", fmt.Sprintf("192.0.2.%d", i)))
+	}
+	udp := StartUDPServer(t, Zone(records...))
+	StartTCPServerOn(t, udp.Addr, RCode(dnsmessage.RCodeRefused))
+
+	// The UDP server sends its answers whole, the TCP one on the same port answers apart
+	if resp := ExchangeUDP(t, udp.Addr, Query("big.example.test", dnsmessage.TypeA)); resp.Truncated || len(resp.Answers) != 40 {
+		t.Errorf("Expected the full answer over UDP, got %s", resp)
+	}
+	if resp := ExchangeTCP(t, udp.Addr, Query("big.example.test", dnsmessage.TypeA)); resp.RCode != dnsmessage.RCodeRefused {
+		t.Errorf("Expected REFUSED over TCP, got %s", resp)
+	}
+}
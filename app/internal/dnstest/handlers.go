@@ -0,0 +1,91 @@
+package dnstest
+
+import (
+	"net/netip"
+	"strings"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// Query returns a recursive query for name and type with a fixed ID
+func Query(name string, t dnsmessage.Type) *dnsmessage.Message {
+	return &dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 0x1234, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: t, Class: dnsmessage.ClassINET}},
+	}
+}
+
+// A returns an A record with a TTL of 300 seconds
+func A(name, addr string) dnsmessage.Resource {
+	return dnsmessage.Resource{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300, Data: &dnsmessage.A{Addr: netip.MustParseAddr(addr)}}
+}
+
+// SOA returns the SOA record of zone, negative answers are cached for
+// minimum seconds
+func SOA(zone string, minimum uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{Name: zone, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 3600, Data: &dnsmessage.SOA{
+		MName: "ns." + zone, RName: "hostmaster." + zone, Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400, Minimum: minimum,
+	}}
+}
+
+// reply returns the skeleton of the answer to query
+func reply(query *dnsmessage.Message) *dnsmessage.Message {
+	return &dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: query.ID, Response: true, Opcode: query.Opcode, RecursionDesired: query.RecursionDesired, RecursionAvailable: true},
+		Questions: query.Questions,
+	}
+}
+
+// RCode answers every query with rcode and no records
+func RCode(rcode dnsmessage.RCode) Handler {
+	return func(query *dnsmessage.Message) *dnsmessage.Message {
+		resp := reply(query)
+		resp.RCode = rcode
+		return resp
+	}
+}
+
+// Zone answers authoritatively from records, the way the servers of a zone
+// do: the records of the name and type asked for, NODATA for names with
+// records of other types only and NXDOMAIN for the others. Negative answers
+// carry the SOA among records, if there is one.
+func Zone(records ...dnsmessage.Resource) Handler {
+	var soa []dnsmessage.Resource
+	for _, rr := range records {
+		if rr.Type == dnsmessage.TypeSOA {
+			soa = append(soa, rr)
+		}
+	}
+	return func(query *dnsmessage.Message) *dnsmessage.Message {
+		resp := reply(query)
+		if len(query.Questions) != 1 {
+			resp.RCode = dnsmessage.RCodeFormatError
+			return resp
+		}
+		q := query.Questions[0]
+		resp.Authoritative = true
+		exists := false
+		for _, rr := range records {
+			if !sameName(rr.Name, q.Name) {
+				continue
+			}
+			exists = true
+			if rr.Type == q.Type || q.Type == dnsmessage.TypeANY {
+				resp.Answers = append(resp.Answers, rr)
+			}
+		}
+		if len(resp.Answers) == 0 {
+			resp.Authorities = soa
+			if !exists {
+				resp.RCode = dnsmessage.RCodeNameError
+			}
+		}
+		return resp
+	}
+}
+
+// sameName reports whether two names are equal, ignoring case and the
+// trailing dot
+func sameName(a, b string) bool {
+	return strings.EqualFold(strings.TrimSuffix(a, "."), strings.TrimSuffix(b, "."))
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+var iteratorMetrics = expvar.NewMap("iterator")
+
+const (
+	// maxReferrals bounds the delegations followed for a single name
+	maxReferrals = 16
+	// maxIterationQueries bounds the queries sent for a single name, the
+	// referrals and the labels revealed by minimization together
+	maxIterationQueries = 64
+	// maxNSLookups bounds the nesting of address lookups for name servers
+	// delegated to without glue
+	maxNSLookups = 4
+	// maxDelegations bounds the zone cuts cached, the least recently used
+	// one is dropped past it
+	maxDelegations = 10000
+	// maxDelegationTTL caps how long a zone cut is cached, whatever the TTL
+	// of its NS records
+	maxDelegationTTL = 24 * time.Hour
+	// maxIteratorServers bounds the name servers whose health is tracked, the
+	// least recently queried one is forgotten past it
+	maxIteratorServers = 10000
+)
+
+var errNoNameServers = errors.New("no reachable name servers")
+
+// Iterator resolves queries itself, following the delegations from the root
+// servers down to the servers authoritative for the name
+type Iterator struct {
+	// Roots are the addresses of the root servers, the root hints by default
+	Roots []netip.Addr
+	// Port is the port name servers are queried on
+	Port uint16
+	// Timeout applies to each query sent to a name server
+	Timeout time.Duration
+	// Minimize only reveals the next label of the name to each zone, instead
+	// of the full query name (https://www.rfc-editor.org/rfc/rfc9156)
+	Minimize bool
+	// IPv4 and IPv6 are the address families name servers are queried over
+	IPv4, IPv6 bool
+
+	now func() time.Time
+
+	mu sync.Mutex
+	// servers track the health of the name servers queried most recently
+	servers *lruMap[netip.Addr, *Upstream]
+	// delegations cache the zone cuts followed, by the TTL of their NS records
+	delegations *lruMap[string, delegation]
+}
+
+// delegation is a cached zone cut, with the addresses of its servers
+type delegation struct {
+	servers []netip.Addr
+	expires time.Time
+}
+
+// NewIterator creates an iterator starting at the root hints, querying name
+// servers over the address families the host has a route for: IPv6 only on
+// IPv6-only hosts. Without a route for either both are tried.
+func NewIterator() *Iterator {
+	it := &Iterator{Port: 53, Timeout: defaultUpstreamTimeout, Minimize: true, now: time.Now}
+	for _, s := range rootServers {
+		it.Roots = append(it.Roots, s.IPv4, s.IPv6)
+	}
+	it.IPv4 = routable(netip.AddrPortFrom(rootServers[0].IPv4, it.Port))
+	it.IPv6 = routable(netip.AddrPortFrom(rootServers[0].IPv6, it.Port))
+	if !it.IPv4 && !it.IPv6 {
+		it.IPv4, it.IPv6 = true, true
+	}
+	return it
+}
+
+// routable reports whether the host has a route to addr. Connecting a UDP
+// socket looks the route up without sending anything.
+func routable(addr netip.AddrPort) bool {
+	conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(addr))
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// reachable returns the addresses of addrs in the families queried
+func (it *Iterator) reachable(addrs []netip.Addr) []netip.Addr {
+	var usable []netip.Addr
+	for _, addr := range addrs {
+		if addr = addr.Unmap(); addr.Is4() && it.IPv4 || addr.Is6() && it.IPv6 {
+			usable = append(usable, addr)
+		}
+	}
+	return usable
+}
+
+// addressTypes returns the types of the address records of name servers in
+// the families queried
+func (it *Iterator) addressTypes() []dnsmessage.Type {
+	var types []dnsmessage.Type
+	if it.IPv4 {
+		types = append(types, dnsmessage.TypeA)
+	}
+	if it.IPv6 {
+		types = append(types, dnsmessage.TypeAAAA)
+	}
+	return types
+}
+
+// Exchange resolves the single question of query and returns the answer of
+// the server authoritative for it. The DO bit and EDNS options of query are
+// sent along to every server.
+func (it *Iterator) Exchange(ctx context.Context, query *dnsmessage.Message) (*dnsmessage.Message, error) {
+	if len(query.Questions) != 1 {
+		return nil, fmt.Errorf("can't resolve %d questions at once", len(query.Questions))
+	}
+	iterateCtx, p := withProvenance(ctx)
+	resp, err := it.iterate(iterateCtx, query.Questions[0], optRecord(query), 0)
+	if err != nil {
+		return nil, err
+	}
+	provenanceOf(ctx).note("iterative resolution, answered by "+strings.TrimPrefix(p.Last(), "upstream "), resp)
+	// The answer is ours, not the authoritative one
+	answer := *resp
+	answer.ID = query.ID
+	answer.Questions = query.Questions
+	answer.Authoritative = false
+	answer.RecursionDesired = query.RecursionDesired
+	answer.RecursionAvailable = true
+	return &answer, nil
+}
+
+// iterate follows the referrals for question starting at the closest zone cut
+// cached, or at the root. When the servers of a cached cut fail to answer the
+// root is started over from. Traced resolutions always start at the root, for
+// the trace to show every step. With minimization every zone is asked for an A record of the name one label below
+// it only, until it is the query name or a delegation to the zone holding it.
+// Servers failing to answer a minimized name, NXDOMAIN included since some
+// wrongly deny empty non-terminals, are asked for the full name after all.
+func (it *Iterator) iterate(ctx context.Context, question dnsmessage.Question, opt *dnsmessage.Resource, depth int) (*dnsmessage.Message, error) {
+	name := canonicalName(question.Name)
+	zone, servers := dnsmessage.Root, it.reachable(it.Roots)
+	// cached is set while the servers asked are those of a cached cut
+	cached := false
+	if traceOf(ctx) == nil {
+		if cut, addrs, ok := it.cachedDelegation(name); ok {
+			zone, servers, cached = cut, addrs, true
+			iteratorMetrics.Add("delegation_cache_hits", 1)
+		}
+	}
+	minimize := it.Minimize
+	// revealed is the number of labels of name already known to the servers
+	revealed := 0
+	referrals := 0
+	for queries := 0; queries < maxIterationQueries; queries++ {
+		q := question
+		if revealed = max(revealed, labelCount(zone)); minimize && revealed+1 < labelCount(name) {
+			q = dnsmessage.Question{Name: ancestorName(name, revealed+1), Type: dnsmessage.TypeA, Class: question.Class}
+		}
+		step := traceOf(ctx).begin(depth, zone, q, servers)
+		start := time.Now()
+		resp, err := it.ask(ctx, servers, q, opt)
+		step.finish(ctx, time.Since(start), resp, err)
+		if err != nil && cached {
+			// The servers may have moved since they were cached
+			it.forgetDelegation(zone)
+			iteratorMetrics.Add("delegation_cache_failures", 1)
+			zone, servers, cached, revealed = dnsmessage.Root, it.reachable(it.Roots), false, 0
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("resolving %s in %s: %w", dnsmessage.FQDN(q.Name), dnsmessage.FQDN(zone), err)
+		}
+
+		if cut, ns := referral(resp, canonicalName(q.Name)); len(ns) > 0 {
+			step.referral(cut, ns)
+			if cut == zone || !isSubdomain(cut, zone) {
+				err := fmt.Errorf("servers of %s referred %s to %s", dnsmessage.FQDN(zone), dnsmessage.FQDN(q.Name), dnsmessage.FQDN(cut))
+				step.fail(err)
+				return nil, err
+			}
+			if servers, err = it.nameServers(ctx, resp, zone, ns, depth); err != nil {
+				step.fail(err)
+				return nil, fmt.Errorf("delegation to %s: %w", dnsmessage.FQDN(cut), err)
+			}
+			step.next(servers)
+			it.cacheDelegation(cut, servers, ns)
+			cached = false
+			iteratorMetrics.Add("referrals", 1)
+			if referrals++; referrals > maxReferrals {
+				return nil, fmt.Errorf("more than %d referrals resolving %s", maxReferrals, dnsmessage.FQDN(name))
+			}
+			zone = cut
+			continue
+		}
+		if canonicalName(q.Name) == name {
+			return resp, nil
+		}
+		if resp.RCode != dnsmessage.RCodeSuccess {
+			step.note("minimized name denied, asking for the full name")
+			iteratorMetrics.Add("minimization_fallbacks", 1)
+			minimize = false
+			continue
+		}
+		// The name exists in the same zone, an empty non-terminal or not
+		step.note("the name exists, revealing the next label")
+		revealed++
+	}
+	return nil, fmt.Errorf("more than %d queries resolving %s", maxIterationQueries, dnsmessage.FQDN(name))
+}
+
+// ask sends question to the servers of a zone, moving on to the next one when
+// a server fails to answer
+func (it *Iterator) ask(ctx context.Context, servers []netip.Addr, question dnsmessage.Question, opt *dnsmessage.Resource) (*dnsmessage.Message, error) {
+	f := &Forwarder{Timeout: it.Timeout, Attempts: min(len(servers), defaultUpstreamAttempts)}
+	for _, addr := range servers {
+		f.Upstreams = append(f.Upstreams, it.server(addr))
+	}
+	query := &dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: newQueryID()},
+		Questions: []dnsmessage.Question{question},
+	}
+	if opt != nil {
+		query.Additionals = []dnsmessage.Resource{*opt}
+	}
+	return f.Exchange(ctx, query)
+}
+
+// server returns the upstream for a name server address
+func (it *Iterator) server(addr netip.Addr) *Upstream {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	if it.servers == nil {
+		it.servers = newLRUMap[netip.Addr, *Upstream](maxIteratorServers)
+	}
+	u, ok := it.servers.get(addr)
+	if !ok {
+		u = &Upstream{Addr: netip.AddrPortFrom(addr, it.Port).String(), Health: newUpstreamHealth()}
+		it.servers.put(addr, u)
+	}
+	return u
+}
+
+// cachedDelegation returns the closest zone cut above name that is cached,
+// with the addresses of its servers
+func (it *Iterator) cachedDelegation(name string) (string, []netip.Addr, bool) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	if it.delegations == nil {
+		return "", nil, false
+	}
+	now := it.now()
+	for zone := name; zone != dnsmessage.Root; zone = parentName(zone) {
+		d, ok := it.delegations.get(zone)
+		if !ok {
+			continue
+		}
+		if now.Before(d.expires) {
+			return zone, d.servers, true
+		}
+		it.delegations.remove(zone)
+	}
+	return "", nil, false
+}
+
+// cacheDelegation caches the servers of the zone cut delegated to with the NS
+// records ns, for their lowest TTL up to maxDelegationTTL
+func (it *Iterator) cacheDelegation(cut string, servers []netip.Addr, ns []dnsmessage.Resource) {
+	ttl := maxDelegationTTL
+	for _, rr := range ns {
+		ttl = min(ttl, time.Duration(rr.TTL)*time.Second)
+	}
+	if ttl <= 0 {
+		return
+	}
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	if it.delegations == nil {
+		it.delegations = newLRUMap[string, delegation](maxDelegations)
+	}
+	it.delegations.put(cut, delegation{servers: servers, expires: it.now().Add(ttl)})
+}
+
+// forgetDelegation drops the zone cut from the cache
+func (it *Iterator) forgetDelegation(cut string) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	if it.delegations != nil {
+		it.delegations.remove(cut)
+	}
+}
+
+// lruMap maps keys to values for at most max keys, dropping the least
+// recently used one to make room. It isn't safe for concurrent use.
+type lruMap[K comparable, V any] struct {
+	max   int
+	items map[K]*list.Element
+	// order holds the entries, most recently used first
+	order *list.List
+}
+
+// lruEntry is a key with its value in the order of an lruMap
+type lruEntry[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+// newLRUMap creates an empty map of at most max keys
+func newLRUMap[K comparable, V any](max int) *lruMap[K, V] {
+	return &lruMap[K, V]{max: max, items: make(map[K]*list.Element), order: list.New()}
+}
+
+// get returns the value of key, marking it used
+func (m *lruMap[K, V]) get(key K) (V, bool) {
+	e, ok := m.items[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	m.order.MoveToFront(e)
+	return e.Value.(*lruEntry[K, V]).value, true
+}
+
+// put sets the value of key, marking it used
+func (m *lruMap[K, V]) put(key K, value V) {
+	if e, ok := m.items[key]; ok {
+		e.Value.(*lruEntry[K, V]).value = value
+		m.order.MoveToFront(e)
+		return
+	}
+	if len(m.items) >= m.max {
+		oldest := m.order.Back()
+		delete(m.items, m.order.Remove(oldest).(*lruEntry[K, V]).key)
+	}
+	m.items[key] = m.order.PushFront(&lruEntry[K, V]{key: key, value: value})
+}
+
+// remove drops key
+func (m *lruMap[K, V]) remove(key K) {
+	if e, ok := m.items[key]; ok {
+		m.order.Remove(e)
+		delete(m.items, key)
+	}
+}
+
+// referral returns the zone cut a response delegates name to with its NS
+// records, none when resp answers name
+func referral(resp *dnsmessage.Message, name string) (string, []dnsmessage.Resource) {
+	if resp.RCode != dnsmessage.RCodeSuccess || len(resp.Answers) > 0 {
+		return "", nil
+	}
+	var cut string
+	var ns []dnsmessage.Resource
+	for _, rr := range resp.Authorities {
+		owner := canonicalName(rr.Name)
+		if rr.Type != dnsmessage.TypeNS || !isSubdomain(name, owner) || len(ns) > 0 && owner != cut {
+			continue
+		}
+		cut = owner
+		ns = append(ns, rr)
+	}
+	return cut, ns
+}
+
+// nameServers returns the addresses of the servers a referral from zone
+// delegates to, in the families queried. Glue is only taken from within zone,
+// whose servers may not speak for other names. Servers without glue are
+// looked up themselves, except those inside the zone delegated to: finding
+// them takes the delegation being followed. The lookups stop at the first
+// addresses found, AAAA records are only asked for without A records.
+func (it *Iterator) nameServers(ctx context.Context, resp *dnsmessage.Message, zone string, ns []dnsmessage.Resource, depth int) ([]netip.Addr, error) {
+	var addrs []netip.Addr
+	var unglued []string
+	for _, rr := range ns {
+		host := canonicalName(rr.Data.(*dnsmessage.NS).Host)
+		var glue []netip.Addr
+		for _, g := range resp.Additionals {
+			if canonicalName(g.Name) == host && isSubdomain(host, zone) {
+				if addr, ok := recordAddr(g); ok {
+					glue = append(glue, addr)
+				}
+			}
+		}
+		for _, addr := range it.reachable(glue) {
+			if !slices.Contains(addrs, addr) {
+				addrs = append(addrs, addr)
+			}
+		}
+		if len(it.reachable(glue)) == 0 && !isSubdomain(host, canonicalName(rr.Name)) {
+			unglued = append(unglued, host)
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs, nil
+	}
+	if depth >= maxNSLookups {
+		return nil, fmt.Errorf("%w, name server lookups nested too deep", errNoNameServers)
+	}
+	var lastErr error = errNoNameServers
+	for _, host := range unglued {
+		for _, t := range it.addressTypes() {
+			resp, err := it.iterate(ctx, dnsmessage.Question{Name: host, Type: t, Class: dnsmessage.ClassINET}, nil, depth+1)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			for _, rr := range resp.Answers {
+				if addr, ok := recordAddr(rr); ok {
+					addrs = append(addrs, addr)
+				}
+			}
+			if addrs = it.reachable(addrs); len(addrs) > 0 {
+				return addrs, nil
+			}
+		}
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+// fakeZone answers like the servers of a zone: names at or below one of the
+// cuts are referred to its server, the others answered from records
+type fakeZone struct {
+	// cuts map the delegated zones to the address of their server
+	cuts    map[string]string
+	records []dnsmessage.Resource
+	// broken servers deny empty non-terminals
+	broken atomic.Bool
+
+	mu      sync.Mutex
+	queries []string
+}
+
+func (z *fakeZone) handle(query *dnsmessage.Message) *dnsmessage.Message {
+	q := query.Questions[0]
+	name := canonicalName(q.Name)
+	z.mu.Lock()
+	z.queries = append(z.queries, name)
+	z.mu.Unlock()
+
+	resp := &dnsmessage.Message{Header: dnsmessage.Header{ID: query.ID, Response: true}, Questions: query.Questions}
+	for cut, addr := range z.cuts {
+		if isSubdomain(name, cut) {
+			host := "ns." + cut
+			resp.Authorities = []dnsmessage.Resource{{Name: cut, Type: dnsmessage.TypeNS, Class: dnsmessage.ClassINET, TTL: 300, Data: &dnsmessage.NS{Host: host}}}
+			resp.Additionals = []dnsmessage.Resource{aRecord(host, addr)}
+			return resp
+		}
+	}
+	resp.Authoritative = true
+	exists := false
+	for _, rr := range z.records {
+		owner := canonicalName(rr.Name)
+		if owner == name && rr.Type == q.Type {
+			resp.Answers = append(resp.Answers, rr)
+		}
+		exists = exists || owner == name || !z.broken.Load() && isSubdomain(owner, name)
+	}
+	if !exists {
+		resp.RCode = dnsmessage.RCodeNameError
+	}
+	return resp
+}
+
+func (z *fakeZone) seen() []string {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	queries := z.queries
+	z.queries = nil
+	return queries
+}
+
+// startFakeHierarchy serves a root zone delegating example to one server,
+// which delegates sub.example to another, all on the port of the returned
+// iterator
+func startFakeHierarchy(t *testing.T) (*Iterator, *fakeZone, *fakeZone, *fakeZone) {
+	root := &fakeZone{cuts: map[string]string{"example": "127.0.0.2"}}
+	example := &fakeZone{cuts: map[string]string{"sub.example": "127.0.0.3"}, records: []dnsmessage.Resource{aRecord("www.example", "192.0.2.1")}}
+	sub := &fakeZone{records: []dnsmessage.Resource{aRecord("deep.host.sub.example", "192.0.2.2")}}
+
+	_, port, _ := net.SplitHostPort(dnstest.StartUDPServer(t, root.handle).Addr)
+	dnstest.StartUDPServerOn(t, net.JoinHostPort("127.0.0.2", port), example.handle)
+	dnstest.StartUDPServerOn(t, net.JoinHostPort("127.0.0.3", port), sub.handle)
+	n, _ := strconv.Atoi(port)
+
+	it := NewIterator()
+	it.Roots = []netip.Addr{netip.MustParseAddr("127.0.0.1")}
+	it.Port = uint16(n)
+	it.IPv4 = true
+	return it, root, example, sub
+}
+
+func TestIteratorMinimizesNames(t *testing.T) {
+	it, root, example, sub := startFakeHierarchy(t)
+	resolve := func(name string) *dnsmessage.Message {
+		t.Helper()
+		resp, err := it.Exchange(context.Background(), testQuery(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := resolve("deep.host.sub.example")
+	if len(resp.Answers) != 1 || resp.Authoritative {
+		t.Errorf("Expected a non-authoritative answer, got %+v", resp)
+	}
+	for _, tt := range []struct {
+		zone *fakeZone
+		want []string
+	}{
+		{root, []string{"example"}},
+		{example, []string{"sub.example"}},
+		{sub, []string{"host.sub.example", "deep.host.sub.example"}},
+	} {
+		if got := tt.zone.seen(); !slices.Equal(got, tt.want) {
+			t.Errorf("Expected the queries %v, got %v", tt.want, got)
+		}
+	}
+
+	// Servers denying empty non-terminals are asked for the full name
+	sub.broken.Store(true)
+	if resp = resolve("deep.host.sub.example"); len(resp.Answers) != 1 {
+		t.Errorf("Expected the full name to be answered, got %+v", resp)
+	}
+	if got := sub.seen(); !slices.Equal(got, []string{"host.sub.example", "deep.host.sub.example"}) {
+		t.Errorf("Expected a fallback to the full name, got %v", got)
+	}
+	if resp = resolve("nx.host.sub.example"); resp.RCode != dnsmessage.RCodeNameError {
+		t.Errorf("Expected NXDOMAIN, got %+v", resp)
+	}
+
+	// Started from the root, not from the cached delegation
+	it.forgetDelegation("example")
+	root.seen()
+	it.Minimize = false
+	if resp = resolve("www.example"); len(resp.Answers) != 1 {
+		t.Errorf("Expected an answer, got %+v", resp)
+	}
+	if got := root.seen(); !slices.Equal(got, []string{"www.example"}) {
+		t.Errorf("Expected the full name without minimization, got %v", got)
+	}
+
+	// Fully qualified names end up at the same answer
+	it.Minimize = true
+	sub.seen()
+	if resp = resolve("deep.host.sub.example."); len(resp.Answers) != 1 {
+		t.Errorf("Expected an answer for the fully qualified name, got %+v", resp)
+	}
+	if got := sub.seen(); !slices.Equal(got, []string{"host.sub.example", "deep.host.sub.example"}) {
+		t.Errorf("Expected the minimized queries, got %v", got)
+	}
+}
+
+func TestIteratorCachesDelegations(t *testing.T) {
+	it, root, example, sub := startFakeHierarchy(t)
+	it.Timeout = 200 * time.Millisecond
+	resolve := func(name string) {
+		t.Helper()
+		if resp, err := it.Exchange(context.Background(), testQuery(name)); err != nil || len(resp.Answers) != 1 {
+			t.Fatalf("Expected an answer for %s, got %+v, %v", name, resp, err)
+		}
+	}
+	seen := func() [3]int {
+		return [3]int{len(root.seen()), len(example.seen()), len(sub.seen())}
+	}
+
+	resolve("deep.host.sub.example")
+	seen()
+	// The servers of sub.example are asked straight away until the TTL of
+	// the delegation is over
+	resolve("deep.host.sub.example")
+	if got := seen(); got != [3]int{0, 0, 2} {
+		t.Errorf("Expected the cached delegation to be followed, got the queries per zone %v", got)
+	}
+	now := time.Now().Add(301 * time.Second)
+	it.now = func() time.Time { return now }
+	resolve("deep.host.sub.example")
+	if got := seen(); got != [3]int{1, 1, 2} {
+		t.Errorf("Expected the expired delegation to be followed from the root, got the queries per zone %v", got)
+	}
+
+	// Servers of a cached delegation failing to answer are dropped, the
+	// delegation is followed from the root again
+	it.cacheDelegation("sub.example", []netip.Addr{netip.MustParseAddr("127.0.0.4")}, []dnsmessage.Resource{nsRecord("sub.example", "ns.sub.example")})
+	resolve("deep.host.sub.example")
+	if got := seen(); got != [3]int{1, 1, 2} {
+		t.Errorf("Expected a fallback to the root, got the queries per zone %v", got)
+	}
+
+	// A trace shows every step from the root
+	trace := traceResolution(context.Background(), it, question("deep.host.sub.example", dnsmessage.TypeA))
+	if trace.Error != "" || len(trace.Steps) == 0 || trace.Steps[0].Zone != "." {
+		t.Errorf("Expected the trace to start at the root, got %+v", trace)
+	}
+}
+
+func TestLRUMap(t *testing.T) {
+	m := newLRUMap[string, int](2)
+	m.put("a", 1)
+	m.put("b", 2)
+	m.get("a")
+	m.put("c", 3)
+	if _, ok := m.get("b"); ok {
+		t.Error("Expected the least recently used key to be dropped")
+	}
+	if v, ok := m.get("a"); !ok || v != 1 {
+		t.Errorf("Expected a to be kept, got %d, %v", v, ok)
+	}
+	m.remove("a")
+	if _, ok := m.get("a"); ok || len(m.items) != 1 || m.order.Len() != 1 {
+		t.Errorf("Expected only c left, got %v", m.items)
+	}
+}
+
+func TestServerIterates(t *testing.T) {
+	it, _, _, _ := startFakeHierarchy(t)
+	s := newTestServer(t, dnstest.StartUDPServer(t, answerA("203.0.113.1")).Addr)
+	s.Iterator = it
+	reply := handle(s, testQuery("www.example"))
+	if len(reply.Answers) != 1 || reply.Answers[0].Data.(*dnsmessage.A).Addr != netip.MustParseAddr("192.0.2.1") || reply.Authoritative {
+		t.Errorf("Expected the answer of the example servers, got %+v", reply)
+	}
+}
+
+func TestIteratorGlue(t *testing.T) {
+	it := NewIterator()
+	it.IPv4, it.IPv6 = true, false
+	resp := &dnsmessage.Message{
+		Authorities: []dnsmessage.Resource{nsRecord("sub.example", "ns1.sub.example"), nsRecord("sub.example", "ns.elsewhere.test")},
+		Additionals: []dnsmessage.Resource{
+			aRecord("NS1.sub.example", "192.0.2.1"),
+			aRecord("ns1.sub.example", "192.0.2.1"),
+			// The servers of example can't speak for elsewhere.test
+			aRecord("ns.elsewhere.test", "198.51.100.1"),
+		},
+	}
+	addrs, err := it.nameServers(context.Background(), resp, "example", resp.Authorities, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(addrs, []netip.Addr{netip.MustParseAddr("192.0.2.1")}) {
+		t.Errorf("Expected the in-bailiwick glue once, got %v", addrs)
+	}
+
+	// Only the glue of the families queried is taken
+	resp.Additionals = append(resp.Additionals, dnsmessage.Resource{Name: "ns1.sub.example", Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET, TTL: 300, Data: &dnsmessage.AAAA{Addr: netip.MustParseAddr("2001:db8::1")}})
+	for _, tt := range []struct {
+		ipv4, ipv6 bool
+		want       []string
+	}{
+		{true, false, []string{"192.0.2.1"}},
+		{false, true, []string{"2001:db8::1"}},
+		{true, true, []string{"192.0.2.1", "2001:db8::1"}},
+	} {
+		it.IPv4, it.IPv6 = tt.ipv4, tt.ipv6
+		addrs, err := it.nameServers(context.Background(), resp, "example", resp.Authorities, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, addr := range addrs {
+			got = append(got, addr.String())
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("IPv4 %v IPv6 %v: expected the glue %v, got %v", tt.ipv4, tt.ipv6, tt.want, got)
+		}
+	}
+
+	// A server inside the delegated zone can't be found without glue
+	resp.Authorities, resp.Additionals = resp.Authorities[:1], nil
+	if _, err := it.nameServers(context.Background(), resp, "example", resp.Authorities, 0); !errors.Is(err, errNoNameServers) {
+		t.Errorf("Expected no name servers without glue, got %v", err)
+	}
+}
+
+func TestIteratorLooksUpUngluedServers(t *testing.T) {
+	var mu sync.Mutex
+	var types []dnsmessage.Type
+	addr := dnstest.StartUDPServer(t, func(query *dnsmessage.Message) *dnsmessage.Message {
+		q := query.Questions[0]
+		mu.Lock()
+		types = append(types, q.Type)
+		mu.Unlock()
+		resp := &dnsmessage.Message{Header: dnsmessage.Header{ID: query.ID, Response: true, Authoritative: true}, Questions: query.Questions}
+		if q.Type == dnsmessage.TypeA {
+			resp.Answers = []dnsmessage.Resource{aRecord(q.Name, "192.0.2.53")}
+		}
+		return resp
+	}).Addr
+	_, port, _ := net.SplitHostPort(addr)
+	n, _ := strconv.Atoi(port)
+	it := NewIterator()
+	it.Roots = []netip.Addr{netip.MustParseAddr("127.0.0.1")}
+	it.Port = uint16(n)
+	it.IPv4, it.IPv6 = true, true
+	it.Minimize = false
+
+	resp := &dnsmessage.Message{Authorities: []dnsmessage.Resource{nsRecord("sub.example", "ns.elsewhere.test")}}
+	addrs, err := it.nameServers(context.Background(), resp, "example", resp.Authorities, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(addrs, []netip.Addr{netip.MustParseAddr("192.0.2.53")}) {
+		t.Errorf("Expected the address looked up, got %v", addrs)
+	}
+	// The A record does, AAAA isn't asked for
+	if !slices.Equal(types, []dnsmessage.Type{dnsmessage.TypeA}) {
+		t.Errorf("Expected a single A lookup, got %v", types)
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// hostsTTL is the TTL of the records read from hosts files
+const hostsTTL = 60
+
+// LocalData answers from records configured locally in zone files and hosts
+// files. Names inside a zone are answered authoritatively, including NXDOMAIN
+// for names the zone doesn't hold, except for those delegated to a child zone
+// with NS records, which get a referral. Other names are answered when they
+// are known and forwarded otherwise.
+type LocalData struct {
+	// mu guards the data against dynamic updates while answering
+	mu sync.RWMutex
+	// records holds the records by canonical owner name
+	records map[string][]dnsmessage.Resource
+	// zones holds the SOA record of each zone by canonical origin
+	zones map[string]dnsmessage.Resource
+	// nodes are the owner names and their ancestors, a name in a zone that
+	// has no records but names below it exists nonetheless
+	nodes map[string]bool
+	// files holds the zone file of each zone loaded from a single one by origin
+	files map[string]string
+	// sources tell where each RRset came from, see Provenance
+	sources map[rrsetKey]string
+	// classless are the blocks with classless reverse zones, see AddClassless
+	classless []classlessBlock
+}
+
+// NewLocalData creates empty local data
+func NewLocalData() *LocalData {
+	return &LocalData{
+		records: make(map[string][]dnsmessage.Resource),
+		zones:   make(map[string]dnsmessage.Resource),
+		nodes:   make(map[string]bool),
+		files:   make(map[string]string),
+		sources: make(map[rrsetKey]string),
+	}
+}
+
+// loadLocalData reads the comma separated <origin>=<path> zones, see
+// loadZoneFiles for the paths, and hosts files and adds the classless reverse
+// zones of blocks, adding PTR records for their addresses when reverse is set
+func loadLocalData(zones, hosts string, blocks []classlessBlock, reverse bool) (*LocalData, error) {
+	d := NewLocalData()
+	var forward []dnsmessage.Resource
+	for _, spec := range splitList(zones) {
+		origin, path, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected <origin>=<path>, got %q", spec)
+		}
+		zone, err := loadZoneFiles(path, origin)
+		if err != nil {
+			return nil, err
+		}
+		if err := d.AddZone(origin, zone.records); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		d.setSources(zone.records, zone.sources, "zone file ")
+		// Zones made of several files can't be written back as they were
+		if len(zone.files) == 1 {
+			d.files[canonicalName(origin)] = zone.files[0]
+		}
+		log.Printf("Loaded zone %s with %d records from %s", canonicalName(origin), len(zone.records), strings.Join(zone.files, ", "))
+		forward = append(forward, zone.records...)
+	}
+	for _, path := range splitList(hosts) {
+		records, primary, sources, err := loadHostsFile(path)
+		if err != nil {
+			return nil, err
+		}
+		d.Add(records...)
+		d.setSources(records, sources, "hosts file ")
+		log.Printf("Loaded %d records from hosts file %s", len(records), path)
+		forward = append(forward, primary...)
+	}
+	d.AddClassless(blocks)
+	if reverse {
+		d.AddReverse(forward)
+	}
+	return d, nil
+}
+
+// loadHostsFile reads a hosts file: lines holding an address followed by its
+// canonical name and aliases, everything after a # is a comment. It returns the
+// records of all names and those of the canonical names only, and the
+// <file>:<line> of each of the former.
+func loadHostsFile(path string) (records, primary []dnsmessage.Resource, sources []string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, nil, nil, fmt.Errorf("%s:%d: expected an address and names, got %q", path, lineNo, line)
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+		addr = addr.WithZone("").Unmap()
+		for i, name := range fields[1:] {
+			rr := dnsmessage.Resource{Name: canonicalName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: hostsTTL, Data: &dnsmessage.A{Addr: addr}}
+			if addr.Is6() {
+				rr.Type, rr.Data = dnsmessage.TypeAAAA, &dnsmessage.AAAA{Addr: addr}
+			}
+			records = append(records, rr)
+			sources = append(sources, fmt.Sprintf("%s:%d", path, lineNo))
+			if i == 0 {
+				primary = append(primary, rr)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return records, primary, sources, nil
+}
+
+// setSources records where the RRsets of records came from, prefix followed
+// by the source of their first record. RRsets already known keep their source.
+func (d *LocalData) setSources(records []dnsmessage.Resource, sources []string, prefix string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i := range records {
+		rr := records[i]
+		rr.Name = canonicalName(rr.Name)
+		if key := keyOf(&rr); d.sources[key] == "" {
+			d.sources[key] = prefix + sources[i]
+		}
+	}
+}
+
+// sourceOf returns where the RRset of rr came from, empty when it is unknown
+func (d *LocalData) sourceOf(rr *dnsmessage.Resource) string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.sources[keyOf(rr)]
+}
+
+// Add adds records, they are part of a zone if one has been added for them
+func (d *LocalData) Add(records ...dnsmessage.Resource) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.add(records...)
+}
+
+func (d *LocalData) add(records ...dnsmessage.Resource) {
+	for _, rr := range records {
+		rr.Name = canonicalName(rr.Name)
+		d.records[rr.Name] = append(d.records[rr.Name], rr)
+		for name := rr.Name; !d.nodes[name]; name = parentName(name) {
+			d.nodes[name] = true
+			if name == dnsmessage.Root {
+				break
+			}
+		}
+	}
+}
+
+// AddZone adds the zone origin and its records, which must hold the SOA record
+// of the zone and nothing outside of it
+func (d *LocalData) AddZone(origin string, records []dnsmessage.Resource) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	origin = canonicalName(origin)
+	if _, ok := d.zones[origin]; ok {
+		return fmt.Errorf("zone %s is defined twice", origin)
+	}
+	var soa *dnsmessage.Resource
+	for i, rr := range records {
+		if !isSubdomain(rr.Name, origin) {
+			return fmt.Errorf("record %s is outside of zone %s", dnsmessage.FQDN(rr.Name), dnsmessage.FQDN(origin))
+		}
+		if rr.Type == dnsmessage.TypeSOA && canonicalName(rr.Name) == origin {
+			soa = &records[i]
+		}
+	}
+	if soa == nil {
+		return fmt.Errorf("zone %s has no SOA record", dnsmessage.FQDN(origin))
+	}
+	d.zones[origin] = *soa
+	d.add(records...)
+	return nil
+}
+
+// AddReverse adds PTR records pointing from the addresses of the A and AAAA
+// records in forward to their names, except for addresses that already have
+// one. Addresses in classless blocks get theirs in the classless zone.
+func (d *LocalData) AddReverse(forward []dnsmessage.Resource) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	explicit := make(map[string]bool)
+	for name, records := range d.records {
+		for _, rr := range records {
+			if rr.Type == dnsmessage.TypePTR {
+				explicit[name] = true
+			}
+		}
+	}
+	seen := make(map[string]bool)
+	for _, rr := range forward {
+		addr, ok := recordAddr(rr)
+		if !ok || isWildcard(rr.Name) {
+			continue
+		}
+		name := reverseName(addr)
+		if b, ok := d.classlessBlockOf(addr); ok {
+			name = b.ptrName(addr)
+		}
+		key := name + " " + canonicalName(rr.Name)
+		if explicit[name] || seen[key] {
+			continue
+		}
+		seen[key] = true
+		ptr := dnsmessage.Resource{Name: name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: rr.TTL, Data: &dnsmessage.PTR{Host: canonicalName(rr.Name)}}
+		d.add(ptr)
+		if key := keyOf(&ptr); d.sources[key] == "" {
+			d.sources[key] = "reverse of " + dnsmessage.FQDN(canonicalName(rr.Name))
+		}
+	}
+}
+
+// isWildcard reports whether name is a wildcard owner, starting with a * label
+func isWildcard(name string) bool {
+	return name == "*" || strings.HasPrefix(name, "*.")
+}
+
+// zoneOf returns the most specific zone containing name
+func (d *LocalData) zoneOf(name string) (string, bool) {
+	for ; ; name = parentName(name) {
+		if _, ok := d.zones[name]; ok {
+			return name, true
+		}
+		if name == dnsmessage.Root {
+			return "", false
+		}
+	}
+}
+
+// answer returns the answer for question from the local data, or nil when the
+// name is neither known nor inside a zone
+func (d *LocalData) answer(question dnsmessage.Question) *dnsmessage.Message {
+	if d == nil || question.Class != dnsmessage.ClassINET {
+		return nil
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	name := canonicalName(question.Name)
+	zone, inZone := d.zoneOf(name)
+	// The DS records of a child zone are held by the parent and answered
+	// like the other records of the zone
+	if inZone {
+		if cut := d.delegation(zone, name); cut != "" && (cut != name || question.Type != dnsmessage.TypeDS) {
+			return d.referral(cut)
+		}
+	}
+	records, exists := d.records[name]
+	if !exists && d.nodes[name] {
+		// An empty non-terminal, it only exists in a zone
+		exists = inZone
+	} else if !exists {
+		records, exists = d.wildcard(name)
+	}
+	if !exists && !inZone {
+		return nil
+	}
+
+	resp := &dnsmessage.Message{Header: dnsmessage.Header{Response: true, Authoritative: true}}
+	for _, rr := range records {
+		if rr.Type == question.Type || question.Type == dnsmessage.TypeANY {
+			resp.Answers = append(resp.Answers, rr)
+		}
+	}
+	if len(resp.Answers) == 0 && question.Type != dnsmessage.TypeCNAME {
+		for _, rr := range records {
+			if rr.Type == dnsmessage.TypeCNAME {
+				resp.Answers = append(resp.Answers, rr)
+			}
+		}
+	}
+	if len(resp.Answers) > 0 {
+		resp.Additionals = d.additionals(resp.Answers)
+		return resp
+	}
+
+	if inZone {
+		resp.Authorities = []dnsmessage.Resource{negativeSOA(d.zones[zone])}
+		if !exists {
+			resp.RCode = dnsmessage.RCodeNameError
+		}
+	}
+	return resp
+}
+
+// delegation returns the highest name from name up to below zone that holds NS
+// records, the cut whose child zone name belongs to, "" when there is none
+func (d *LocalData) delegation(zone, name string) string {
+	cut := ""
+	for ; name != zone && isSubdomain(name, zone); name = parentName(name) {
+		if hasRecords(d.records[name], name, dnsmessage.TypeNS) {
+			cut = name
+		}
+	}
+	return cut
+}
+
+// referral returns the referral to the child zone delegated at cut: no
+// answers, the NS records of the cut in the authority section and the
+// addresses of the name servers as glue. The zone is not authoritative for
+// the child, so AA is clear (https://www.rfc-editor.org/rfc/rfc1034#section-4.3.2).
+// The DS records of the cut are left to the Signer. The caller holds d.mu.
+func (d *LocalData) referral(cut string) *dnsmessage.Message {
+	resp := &dnsmessage.Message{Header: dnsmessage.Header{Response: true}}
+	for _, rr := range d.records[cut] {
+		if rr.Type == dnsmessage.TypeNS {
+			resp.Authorities = append(resp.Authorities, rr)
+		}
+	}
+	resp.Additionals = d.additionals(resp.Authorities)
+	return resp
+}
+
+// wildcard synthesizes the records of a name that doesn't exist from the
+// wildcard at its closest encloser, the deepest ancestor that does exist
+// (https://www.rfc-editor.org/rfc/rfc4592#section-3.3.1). A wildcard only
+// covers names below an ancestor that is missing too, so it is shadowed by
+// every existing name and never matches names below an existing one.
+func (d *LocalData) wildcard(name string) ([]dnsmessage.Resource, bool) {
+	encloser := d.encloser(name)
+	source := "*"
+	if encloser != dnsmessage.Root {
+		source += "." + encloser
+	}
+	wildcards, ok := d.records[source]
+	if !ok {
+		return nil, false
+	}
+	records := make([]dnsmessage.Resource, len(wildcards))
+	for i, rr := range wildcards {
+		rr.Name = name
+		records[i] = rr
+	}
+	return records, true
+}
+
+// encloser returns the closest encloser of a name that doesn't exist
+func (d *LocalData) encloser(name string) string {
+	encloser := parentName(name)
+	for !d.nodes[encloser] && encloser != dnsmessage.Root {
+		encloser = parentName(encloser)
+	}
+	return encloser
+}
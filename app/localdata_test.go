@@ -0,0 +1,234 @@
+package main
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+const testHosts = `# local machines
+192.168.1.10	nas nas.home.lan
+fd00::10	nas
+192.168.1.20	printer.home.lan
+`
+
+// newTestLocalData loads testZone, testReverseZone and testHosts
+func newTestLocalData(t testing.TB, reverse bool) *LocalData {
+	t.Helper()
+	dir := t.TempDir()
+	files := map[string]string{"home.lan.zone": testZone, "reverse.zone": testReverseZone, "hosts": testHosts}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	zones := "home.lan=" + filepath.Join(dir, "home.lan.zone") + ",1.168.192.in-addr.arpa=" + filepath.Join(dir, "reverse.zone")
+	d, err := loadLocalData(zones, filepath.Join(dir, "hosts"), nil, reverse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestLocalDataAnswers(t *testing.T) {
+	d := newTestLocalData(t, false)
+	tests := []struct {
+		name    string
+		qtype   dnsmessage.Type
+		rcode   dnsmessage.RCode
+		answers int
+		soa     bool
+	}{
+		{"WWW.home.lan", dnsmessage.TypeA, dnsmessage.RCodeSuccess, 1, false},
+		{"www.home.lan", dnsmessage.TypeMX, dnsmessage.RCodeSuccess, 0, true},
+		{"missing.home.lan", dnsmessage.TypeA, dnsmessage.RCodeNameError, 0, true},
+		{"printer.home.lan", dnsmessage.TypeA, dnsmessage.RCodeSuccess, 1, false},
+		// Hosts names outside any zone only answer what they hold
+		{"nas", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, 1, false},
+		{"nas", dnsmessage.TypeMX, dnsmessage.RCodeSuccess, 0, false},
+		{"2.1.168.192.in-addr.arpa", dnsmessage.TypePTR, dnsmessage.RCodeSuccess, 1, false},
+		// Without -auto-reverse the reverse zone only holds its explicit PTR
+		{"10.1.168.192.in-addr.arpa", dnsmessage.TypePTR, dnsmessage.RCodeNameError, 0, true},
+	}
+	for _, tt := range tests {
+		resp := d.answer(question(tt.name, tt.qtype))
+		if resp == nil {
+			t.Errorf("%s %s: expected a local answer", tt.name, tt.qtype)
+			continue
+		}
+		if resp.RCode != tt.rcode || len(resp.Answers) != tt.answers || (len(resp.Authorities) == 1) != tt.soa || !resp.Authoritative {
+			t.Errorf("%s %s: expected %s with %d answers (SOA %v), got %+v", tt.name, tt.qtype, tt.rcode, tt.answers, tt.soa, resp)
+		}
+	}
+	// The SOA of negative answers is cached as long as its MINIMUM, not its TTL of 1h
+	if resp := d.answer(question("missing.home.lan", dnsmessage.TypeA)); resp.Authorities[0].TTL != 300 {
+		t.Errorf("Expected the SOA TTL of a negative answer to be capped at 300, got %d", resp.Authorities[0].TTL)
+	}
+	for _, name := range []string{"example.com", "2.168.192.in-addr.arpa", "other.lan"} {
+		if resp := d.answer(question(name, dnsmessage.TypeA)); resp != nil {
+			t.Errorf("Expected %s to be forwarded, got %+v", name, resp)
+		}
+	}
+}
+
+func TestLocalDataEmptyNonTerminal(t *testing.T) {
+	d := NewLocalData()
+	if err := d.AddZone("example.com", []dnsmessage.Resource{
+		soaRecord("example.com", 3600, 300),
+		{Name: "a.b.example.com", Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60, Data: &dnsmessage.A{Addr: netip.MustParseAddr("192.0.2.1")}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	resp := d.answer(question("b.example.com", dnsmessage.TypeA))
+	if resp.RCode != dnsmessage.RCodeSuccess || len(resp.Answers) != 0 {
+		t.Errorf("Expected NODATA for a name that only has names below it, got %+v", resp)
+	}
+	if err := d.AddZone("example.net", []dnsmessage.Resource{soaRecord("example.com", 3600, 300)}); err == nil {
+		t.Error("Expected records outside the zone to be rejected")
+	}
+	if err := d.AddZone("example.org", nil); err == nil {
+		t.Error("Expected a zone without SOA to be rejected")
+	}
+}
+
+// wildcardZone is the example zone of RFC 4592 section 2.2.1, with TXT records
+// in place of the SRV records and without the delegation
+const wildcardZone = `$ORIGIN example.
+$TTL 3600
+@                        SOA   ns.example.com. hostmaster.example. 1 3600 600 86400 300
+*                        TXT   "this is a wildcard"
+*                        MX    10 host1.example.
+sub.*                    TXT   "this is not a wildcard"
+host1                    A     192.0.2.1
+_ssh._tcp.host1          TXT   "ssh"
+_ssh._tcp.host2          TXT   "ssh"
+`
+
+func TestLocalDataWildcards(t *testing.T) {
+	records, err := parseZone(strings.NewReader(wildcardZone), "example.zone", "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewLocalData()
+	if err := d.AddZone("example", records); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		qtype   dnsmessage.Type
+		rcode   dnsmessage.RCode
+		answers int
+	}{
+		// Synthesized from *.example, the closest encloser being example
+		{"host3.example", dnsmessage.TypeMX, dnsmessage.RCodeSuccess, 1},
+		{"foo.bar.example", dnsmessage.TypeTXT, dnsmessage.RCodeSuccess, 1},
+		{"host3.example", dnsmessage.TypeANY, dnsmessage.RCodeSuccess, 2},
+		// The wildcard exists but has no A record
+		{"host3.example", dnsmessage.TypeA, dnsmessage.RCodeSuccess, 0},
+		// Existing names shadow the wildcard, whatever types they hold
+		{"host1.example", dnsmessage.TypeMX, dnsmessage.RCodeSuccess, 0},
+		{"sub.*.example", dnsmessage.TypeMX, dnsmessage.RCodeSuccess, 0},
+		// Empty non-terminals exist too
+		{"_tcp.host2.example", dnsmessage.TypeTXT, dnsmessage.RCodeSuccess, 0},
+		// The closest enclosers are _tcp.host1.example and *.example, neither
+		// has a wildcard below it
+		{"_telnet._tcp.host1.example", dnsmessage.TypeTXT, dnsmessage.RCodeNameError, 0},
+		{"ghost.*.example", dnsmessage.TypeMX, dnsmessage.RCodeNameError, 0},
+		// The wildcard owner itself is an ordinary name
+		{"*.example", dnsmessage.TypeTXT, dnsmessage.RCodeSuccess, 1},
+	}
+	for _, tt := range tests {
+		resp := d.answer(question(tt.name, tt.qtype))
+		if resp == nil || resp.RCode != tt.rcode || len(resp.Answers) != tt.answers {
+			t.Errorf("%s %s: expected %s with %d answers, got %+v", tt.name, tt.qtype, tt.rcode, tt.answers, resp)
+			continue
+		}
+		for _, rr := range resp.Answers {
+			if rr.Name != tt.name {
+				t.Errorf("%s %s: expected answers owned by the query name, got %s", tt.name, tt.qtype, rr.Name)
+			}
+		}
+	}
+	if resp := d.answer(question("host3.example", dnsmessage.TypeTXT)); resp != nil && len(resp.Answers) == 1 {
+		if got := resp.Answers[0].Data.(*dnsmessage.TXT).Text; len(got) != 1 || got[0] != "this is a wildcard" {
+			t.Errorf("Expected the wildcard TXT record, got %q", got)
+		}
+	}
+}
+
+func TestLocalDataHostsWildcard(t *testing.T) {
+	d := NewLocalData()
+	d.Add(
+		dnsmessage.Resource{Name: "*.dev.lan", Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: hostsTTL, Data: &dnsmessage.A{Addr: netip.MustParseAddr("192.0.2.1")}},
+		dnsmessage.Resource{Name: "api.dev.lan", Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET, TTL: hostsTTL, Data: &dnsmessage.AAAA{Addr: netip.MustParseAddr("2001:db8::1")}},
+	)
+	if resp := d.answer(question("app.dev.lan", dnsmessage.TypeA)); resp == nil || len(resp.Answers) != 1 {
+		t.Errorf("Expected app.dev.lan to match the wildcard, got %+v", resp)
+	}
+	if resp := d.answer(question("api.dev.lan", dnsmessage.TypeA)); resp == nil || len(resp.Answers) != 0 {
+		t.Errorf("Expected api.dev.lan to shadow the wildcard, got %+v", resp)
+	}
+	for _, name := range []string{"dev.lan", "example.com"} {
+		if resp := d.answer(question(name, dnsmessage.TypeA)); resp != nil {
+			t.Errorf("Expected %s to be forwarded, got %+v", name, resp)
+		}
+	}
+}
+
+func TestLocalDataReverse(t *testing.T) {
+	d := newTestLocalData(t, true)
+	tests := []struct {
+		addr  string
+		hosts []string
+	}{
+		{"192.168.1.10", []string{"www.home.lan", "nas"}},
+		{"fd00::10", []string{"www.home.lan", "nas"}},
+		{"192.168.1.20", []string{"printer.home.lan"}},
+		// The explicit PTR record is kept, the address of ns1 gets no second one
+		{"192.168.1.2", []string{"ns1.home.lan"}},
+	}
+	for _, tt := range tests {
+		resp := d.answer(question(reverseName(netip.MustParseAddr(tt.addr)), dnsmessage.TypePTR))
+		if resp == nil || len(resp.Answers) != len(tt.hosts) {
+			t.Errorf("%s: expected PTR records for %v, got %+v", tt.addr, tt.hosts, resp)
+			continue
+		}
+		for i, host := range tt.hosts {
+			if got := resp.Answers[i].Data.(*dnsmessage.PTR).Host; got != host {
+				t.Errorf("%s: expected PTR %d to be %s, got %s", tt.addr, i, host, got)
+			}
+		}
+	}
+}
+
+func TestReverseName(t *testing.T) {
+	tests := map[string]string{
+		"192.0.2.1":          "1.2.0.192.in-addr.arpa",
+		"::ffff:192.0.2.1":   "1.2.0.192.in-addr.arpa",
+		"2001:db8::567:89ab": "b.a.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa",
+	}
+	for addr, want := range tests {
+		if got := reverseName(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("reverseName(%s) = %s, want %s", addr, got, want)
+		}
+	}
+}
+
+func TestServerPrefersLocalDataOverLocalZones(t *testing.T) {
+	s := newTestServer(t, closedUDPAddr(t))
+	s.LocalData = newTestLocalData(t, true)
+	s.LocalZones = NewLocalZones("")
+
+	resp := handle(s, &dnsmessage.Message{Questions: []dnsmessage.Question{question("10.1.168.192.in-addr.arpa", dnsmessage.TypePTR)}})
+	if resp.RCode != dnsmessage.RCodeSuccess || len(resp.Answers) != 2 || !resp.Authoritative {
+		t.Errorf("Expected the generated PTR records, got %+v", resp)
+	}
+	resp = handle(s, &dnsmessage.Message{Questions: []dnsmessage.Question{question("7.7.168.192.in-addr.arpa", dnsmessage.TypePTR)}})
+	if resp.RCode != dnsmessage.RCodeNameError {
+		t.Errorf("Expected other private addresses to stay NXDOMAIN, got %+v", resp)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// localZoneTTL is the SOA MINIMUM and TTL RFC 6303 recommends for locally served zones
+const localZoneTTL = 604800
+
+// defaultLocalZones are the reverse zones of private, special purpose and
+// documentation address space that should never be sent to the public
+// internet (https://www.rfc-editor.org/rfc/rfc6303#section-4 and RFC 7793).
+var defaultLocalZones = func() []string {
+	zones := []string{
+		"10.in-addr.arpa",
+		"168.192.in-addr.arpa",
+		"0.in-addr.arpa",
+		"127.in-addr.arpa",
+		"254.169.in-addr.arpa",
+		"2.0.192.in-addr.arpa",
+		"100.51.198.in-addr.arpa",
+		"113.0.203.in-addr.arpa",
+		"255.255.255.255.in-addr.arpa",
+		"0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa",
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa",
+		"d.f.ip6.arpa",
+		"c.f.ip6.arpa",
+		"8.e.f.ip6.arpa",
+		"9.e.f.ip6.arpa",
+		"a.e.f.ip6.arpa",
+		"b.e.f.ip6.arpa",
+		"8.b.d.0.1.0.0.2.ip6.arpa",
+	}
+	// 172.16.0.0/12
+	for i := 16; i <= 31; i++ {
+		zones = append(zones, fmt.Sprintf("%d.172.in-addr.arpa", i))
+	}
+	// 100.64.0.0/10, shared address space for carrier grade NAT
+	for i := 64; i <= 127; i++ {
+		zones = append(zones, fmt.Sprintf("%d.100.in-addr.arpa", i))
+	}
+	return zones
+}()
+
+// LocalZones answers authoritatively for empty reverse zones of local address
+// space, like the AS112 project does, so private PTR lookups never leak upstream
+type LocalZones struct {
+	zones []string
+	// delegated zones are served by a local resolver and forwarded as usual
+	delegated []string
+}
+
+// NewLocalZones creates the default local zones, except for the comma separated
+// zones that are delegated locally
+func NewLocalZones(delegated string) *LocalZones {
+	z := &LocalZones{zones: defaultLocalZones}
+	for _, d := range splitList(delegated) {
+		z.delegated = append(z.delegated, canonicalName(d))
+	}
+	return z
+}
+
+// zoneOf returns the most specific local zone containing name
+func (z *LocalZones) zoneOf(name string) (string, bool) {
+	best := ""
+	for _, zone := range z.zones {
+		if isSubdomain(name, zone) && len(zone) > len(best) {
+			best = zone
+		}
+	}
+	if best == "" {
+		return "", false
+	}
+	// Names under a local delegation are forwarded, whether the delegation is
+	// the whole zone, a parent of it or only a part of it
+	for _, d := range z.delegated {
+		if isSubdomain(name, d) {
+			return "", false
+		}
+	}
+	return best, true
+}
+
+// answer returns the authoritative answer for question, or nil when it is not in a local zone
+func (z *LocalZones) answer(question dnsmessage.Question) *dnsmessage.Message {
+	if z == nil || question.Class != dnsmessage.ClassINET {
+		return nil
+	}
+	zone, ok := z.zoneOf(question.Name)
+	if !ok {
+		return nil
+	}
+
+	soa := dnsmessage.Resource{
+		Name: zone, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: localZoneTTL,
+		Data: &dnsmessage.SOA{MName: zone, RName: "nobody.invalid", Serial: 1, Refresh: 604800, Retry: 86400, Expire: 2419200, Minimum: localZoneTTL},
+	}
+	resp := &dnsmessage.Message{Header: dnsmessage.Header{Response: true, Authoritative: true}}
+	if !strings.EqualFold(canonicalName(question.Name), zone) {
+		resp.RCode = dnsmessage.RCodeNameError
+		resp.Authorities = []dnsmessage.Resource{soa}
+		return resp
+	}
+
+	switch question.Type {
+	case dnsmessage.TypeSOA:
+		resp.Answers = []dnsmessage.Resource{soa}
+	case dnsmessage.TypeNS:
+		resp.Answers = []dnsmessage.Resource{{Name: zone, Type: dnsmessage.TypeNS, Class: dnsmessage.ClassINET, TTL: localZoneTTL, Data: &dnsmessage.NS{Host: zone}}}
+	default:
+		resp.Authorities = []dnsmessage.Resource{soa}
+	}
+	return resp
+}
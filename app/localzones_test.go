@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+func TestLocalZones(t *testing.T) {
+	s := newTestServer(t, dnstest.StartUDPServer(t, answerA("192.0.2.1")).Addr)
+	s.LocalZones = NewLocalZones("1.168.192.in-addr.arpa")
+
+	tests := []struct {
+		name    string
+		qtype   dnsmessage.Type
+		rcode   dnsmessage.RCode
+		answers int
+		aa      bool
+	}{
+		{"10.1.168.192.in-addr.arpa", dnsmessage.TypePTR, dnsmessage.RCodeSuccess, 1, false}, // delegated, forwarded
+		{"10.2.168.192.in-addr.arpa", dnsmessage.TypePTR, dnsmessage.RCodeNameError, 0, true},
+		{"5.0.20.172.in-addr.arpa", dnsmessage.TypePTR, dnsmessage.RCodeNameError, 0, true},
+		{"5.0.32.172.in-addr.arpa", dnsmessage.TypePTR, dnsmessage.RCodeSuccess, 1, false}, // public space
+		{"1.0.0.100.in-addr.arpa", dnsmessage.TypePTR, dnsmessage.RCodeSuccess, 1, false},
+		{"1.0.64.100.in-addr.arpa", dnsmessage.TypePTR, dnsmessage.RCodeNameError, 0, true},
+		{"10.in-addr.arpa", dnsmessage.TypeSOA, dnsmessage.RCodeSuccess, 1, true},
+		{"10.in-addr.arpa", dnsmessage.TypeNS, dnsmessage.RCodeSuccess, 1, true},
+		{"10.in-addr.arpa", dnsmessage.TypePTR, dnsmessage.RCodeSuccess, 0, true},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa", dnsmessage.TypePTR, dnsmessage.RCodeNameError, 0, true},
+	}
+	for _, tt := range tests {
+		resp := handle(s, &dnsmessage.Message{Questions: []dnsmessage.Question{question(tt.name, tt.qtype)}})
+		if resp.RCode != tt.rcode || len(resp.Answers) != tt.answers {
+			t.Errorf("%s %s: expected %s with %d answers, got %s", tt.name, tt.qtype, tt.rcode, tt.answers, resp)
+		}
+		if resp.Authoritative != tt.aa {
+			t.Errorf("%s %s: expected AA=%v, got %s", tt.name, tt.qtype, tt.aa, resp)
+		}
+		if tt.aa && len(resp.Authorities)+len(resp.Answers) == 0 {
+			t.Errorf("%s %s: expected SOA or answer from the local zone, got %s", tt.name, tt.qtype, resp)
+		}
+	}
+}
@@ -1,347 +1,334 @@
 package main
 
 import (
-	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"golang.org/x/net/context"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
-// DNSHeader represents a DNS message header
-type DNSHeader struct {
-	ID      uint16 // Packet Identifier (16 bits)
-	Flags   uint16 // Flags (16 bits) - contains multiple sub-fields
-	QDCOUNT uint16 // Number of Question Records
-	ANCOUNT uint16 // Number of Answer Records
-	NSCOUNT uint16 // Number of Authority Records
-	ARCOUNT uint16 // Number of Additional Records
-}
-
-// Serialize serializes the DNSHeader into a byte array
-func (h *DNSHeader) Serialize() []byte {
-	buf := make([]byte, 12) // DNS header is always 12 bytes long
-	binary.BigEndian.PutUint16(buf[0:2], h.ID)
-	binary.BigEndian.PutUint16(buf[2:4], h.Flags)
-	binary.BigEndian.PutUint16(buf[4:6], h.QDCOUNT)
-	binary.BigEndian.PutUint16(buf[6:8], h.ANCOUNT)
-	binary.BigEndian.PutUint16(buf[8:10], h.NSCOUNT)
-	binary.BigEndian.PutUint16(buf[10:12], h.ARCOUNT)
-	return buf
-}
-
-// Parse parses a byte array into a DNSHeader struct
-func (h *DNSHeader) Parse(data []byte) {
-	h.ID = binary.BigEndian.Uint16(data[0:2])
-	h.Flags = binary.BigEndian.Uint16(data[2:4])
-	h.QDCOUNT = binary.BigEndian.Uint16(data[4:6])
-	h.ANCOUNT = binary.BigEndian.Uint16(data[6:8])
-	h.NSCOUNT = binary.BigEndian.Uint16(data[8:10])
-	h.ARCOUNT = binary.BigEndian.Uint16(data[10:12])
-}
-
-type DNSQuestion struct {
-	Name  string
-	Type  uint16
-	Class uint16
-}
-
-func (q *DNSQuestion) Serialize() []byte {
-	var buf []byte
-	labels := strings.Split(q.Name, ".")
-	for _, label := range labels {
-		buf = append(buf, byte(len(label)))
-		buf = append(buf, []byte(label)...)
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "query" {
+		if err := runQuery(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
 	}
-	buf = append(buf, 0)
-
-	qType := make([]byte, 2)
-	binary.BigEndian.PutUint16(qType, q.Type)
-	buf = append(buf, qType...)
-
-	class := make([]byte, 2)
-	binary.BigEndian.PutUint16(class, q.Class)
-	buf = append(buf, class...)
-
-	return buf
-}
-
-type DNSAnswer struct {
-	Name     string
-	Type     uint16
-	Class    uint16
-	TTL      uint32
-	RDLength uint16
-	RData    []byte
-}
-
-func (a *DNSAnswer) Serialize() []byte {
-	var buf []byte
-
-	labels := strings.Split(a.Name, ".")
-	for _, label := range labels {
-		buf = append(buf, byte(len(label)))
-		buf = append(buf, []byte(label)...)
+	if len(os.Args) > 1 && os.Args[1] == "xfr" {
+		if err := runXfr(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
 	}
-	buf = append(buf, 0)
-
-	typeBytes := make([]byte, 2)
-	binary.BigEndian.PutUint16(typeBytes, a.Type)
-	buf = append(buf, typeBytes...)
-
-	classBytes := make([]byte, 2)
-	binary.BigEndian.PutUint16(classBytes, a.Class)
-	buf = append(buf, classBytes...)
-
-	ttlBytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(ttlBytes, a.TTL)
-	buf = append(buf, ttlBytes...)
-
-	rdLengthBytes := make([]byte, 2)
-	binary.BigEndian.PutUint16(rdLengthBytes, a.RDLength)
-	buf = append(buf, rdLengthBytes...)
-
-	buf = append(buf, a.RData...)
-
-	return buf
-}
-
-// Create a new DNS reply message based on the specified values
-func createDNSReply(header DNSHeader, questions []DNSQuestion, answers []DNSAnswer) []byte {
-	// Construct the 16-bit Flags field
-	// | QR  | OPCODE |  AA | TC | RD | RA | Z   | RCODE |
-	// |  1  | 0000   |  1  |  0 |  0 |  0 | 000 | 0000  |
-	// ---------------------------------------------------
-	//  16-15  14-11    10    9    8    7    6-4   3-0
-	// ---------------------------------------------------
-	// QR = 1
-	// OPCODE = 0 (0000)
-	// AA = 1
-	// TC = 0
-	// RD = 0
-	// RA = 0
-	// Z = 0 (000)
-	// RCODE = 0 (0000)
-	// ---------------------------------------------------
-	// 1000 0000 0000 0000  (QR << 15)
-	// OR 0000 0000 0000 0000  (OPCODE << 11)
-	// OR 0000 0100 0000 0000  (AA << 10)
-	// OR 0000 0000 0000 0000  (TC << 9)
-	// OR 0000 0000 0000 0000  (RD << 8)
-	// OR 0000 0000 0000 0000  (RA << 7)
-	// OR 0000 0000 0000 0000  (RCODE)
-	// = 1000 0100 0000 0000 (combined)
-	flags := (1 << 15) | // QR bit (1 bit)
-		(header.Flags & 0x7800) | // OPCODE (4 bits) - mask: 0111 1000 0000 0000
-		(header.Flags & 0x0400) | // AA bit (1 bit) - mask: 0000 0100 0000 0000
-		(0 << 9) | // TC bit (1 bit)
-		(header.Flags & 0x0100) | // RD bit (1 bit) - mask: 0000 0001 0000 0000
-		(1 << 7) | // RA bit (1 bit)
-		(uint16(4) & 0x00FF) // RCODE (4 bits)
-
-	replyHeader := &DNSHeader{
-		ID:      header.ID,
-		Flags:   flags,
-		QDCOUNT: header.QDCOUNT,
-		ANCOUNT: uint16(len(answers)),
-		NSCOUNT: 0,
-		ARCOUNT: 0,
+	if len(os.Args) > 1 && os.Args[1] == "trace" {
+		if err := runTrace(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
 	}
-
-	var questionsBinary []byte
-	for _, question := range questions {
-		questionsBinary = append(questionsBinary, question.Serialize()...)
+	if len(os.Args) > 1 && os.Args[1] == "cache" {
+		if err := runCache(os.Args[2:], os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
 	}
 
-	var answersBinary []byte
-	for _, answer := range answers {
-		answersBinary = append(answersBinary, answer.Serialize()...)
+	opts, err := loadOptions(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if opts.Version {
+		fmt.Println("dns-server", versionString())
+		return
+	}
+	log.Printf("Starting dns-server %s", versionString())
+	server, err := buildServer(opts, nil)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
 	}
 
-	return append(append(replyHeader.Serialize(), questionsBinary...), answersBinary...)
-}
-
-func parseName(data []byte, offset int) (string, int, error) {
-	var nameParts []string
-
-	for {
-		if offset >= len(data) {
-			log.Printf("parseName: offset %d out of bounds (data length %d)", offset, len(data))
-			return "", 0, fmt.Errorf("offset out of bounds")
-		}
-
-		labelLength := int(data[offset])
-		if labelLength == 0 {
-			offset++
-			break
+	if opts.FirewallStats != "" {
+		if err := server.FirewallStats.Load(opts.FirewallStats); err != nil {
+			log.Fatalf("Failed to load firewall statistics: %v", err)
 		}
-
-		nameParts = append(nameParts, string(data[offset+1:offset+1+labelLength]))
-		offset += 1 + labelLength
+		go func() {
+			for range time.Tick(time.Minute) {
+				if err := server.active().FirewallStats.Save(opts.FirewallStats); err != nil {
+					log.Printf("Failed to save firewall statistics: %v", err)
+				}
+			}
+		}()
 	}
 
-	name := strings.Join(nameParts, ".")
-	return name, offset, nil
-}
-
-func decompressQuestions(data []byte) []byte {
-	decompressedData := make([]byte, 0, len(data))
-	for i := 0; i < len(data); i++ {
-		// checks if question is compressed
-		// 0xC0 == 11000000 -> https://www.rfc-editor.org/rfc/rfc1035#section-4.1.4
-		// if first two bits are 1, then question is compressed and the following offset is
-		// a pointer to a previous position
-		if data[i] != 0xC0 {
-			decompressedData = append(decompressedData, data[i])
-			continue
+	saveSnapshot := func() {}
+	if opts.CacheSnapshot != "" {
+		if opts.SnapshotInterval <= 0 {
+			log.Fatalf("Invalid configuration: -cache-snapshot-interval must be positive")
 		}
-
-		// This part deals with the compression pointer
-		// 0xC0 is a pointer indicating the next byte is part of the pointer address
-		pointer := binary.BigEndian.Uint16(data[i : i+2])
-		// Logical AND to strip first two bits (0x3FFF = 0011111111111111)
-		pointerValue := int(pointer & 0x3FFF)
-		// Adjust because the pointer is relative to the start of the DNS packet header
-		pointerValue -= 12
-		// Resolve the pointer by copying the pointed-to name into decompressedData
-		for j := pointerValue; j < len(data); j++ {
-			if data[j] == 0x00 {
-				// End of the compressed name
-				decompressedData = append(decompressedData, data[j])
-				// Skip the next byte as it was part of the pointer
-				i += 1
-				break
+		if server.Cache != nil {
+			if err := loadCacheSnapshot(server.Cache, opts.CacheSnapshot); err != nil {
+				log.Printf("Starting with a cold cache, failed to load the cache snapshot: %v", err)
+			}
+		}
+		saveSnapshot = func() {
+			if cache := server.active().Cache; cache != nil {
+				if err := saveCacheSnapshot(cache, opts.CacheSnapshot); err != nil {
+					log.Printf("Failed to save the cache snapshot: %v", err)
+				}
 			}
-			// Add decompressed byte by byte
-			decompressedData = append(decompressedData, data[j])
 		}
+		go func() {
+			for range time.Tick(opts.SnapshotInterval) {
+				saveSnapshot()
+			}
+		}()
 	}
-	return decompressedData
-}
-
-func parseDNSQuestions(data []byte, header DNSHeader) ([]DNSQuestion, error) {
-	expandedData := decompressQuestions(data)
-	questions := make([]DNSQuestion, header.QDCOUNT)
-	offset := 0
 
-	for i := range questions {
-		var question DNSQuestion
-		var err error
-
-		question.Name, offset, err = parseName(expandedData, offset)
-		if err != nil {
-			return questions, err
+	server.Reload = reloader(server, os.Args[1:], opts)
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			sdNotify("RELOADING=1")
+			if err := server.Reload(); err != nil {
+				log.Printf("Reload failed, keeping the current configuration: %v", err)
+			}
+			sdNotify("READY=1")
 		}
+	}()
 
-		if len(expandedData) < offset+4 {
-			return questions, fmt.Errorf("invalid question format")
+	dump := make(chan os.Signal, 1)
+	signal.Notify(dump, syscall.SIGUSR1)
+	go func() {
+		for range dump {
+			writeStateDump(server, opts.StateDump)
 		}
+	}()
 
-		question.Type = binary.BigEndian.Uint16(expandedData[offset : offset+2])
-		offset += 2
-		question.Class = binary.BigEndian.Uint16(expandedData[offset : offset+2])
-		offset += 2
+	maintenance := make(chan os.Signal, 1)
+	signal.Notify(maintenance, syscall.SIGUSR2)
+	go func() {
+		for range maintenance {
+			server.active().Modes.ToggleMaintenance()
+		}
+	}()
 
-		questions[i] = question
+	var adminListener *net.TCPListener
+	if opts.Admin != "" {
+		if adminListener, err = listenAdmin(opts.Admin); err != nil {
+			log.Fatalf("Failed to listen for the admin API: %v", err)
+		}
+		go func() {
+			log.Printf("Admin API listening on %s", adminListener.Addr())
+			// Also returns once the listener was handed over and closed
+			log.Printf("Admin API stopped: %v", http.Serve(adminListener, server.AdminHandler()))
+		}()
 	}
-	return questions, nil
-}
 
-func handleDNSRequest(conn *net.UDPConn, addr *net.UDPAddr, data []byte, resolverAddr string) {
-	// Log the received packet
-	log.Printf("Received DNS query from %s with data: %v", addr.String(), data)
+	if opts.MDNS {
+		responder, err := loadMDNSResponder(opts.MDNSNames)
+		if err != nil {
+			log.Fatalf("Invalid configuration: %v", err)
+		}
+		mdnsConn, err := listenMDNS()
+		if err != nil {
+			log.Fatalf("Failed to join the multicast DNS group: %v", err)
+		}
+		go func() {
+			if err := responder.Serve(mdnsConn); err != nil {
+				log.Printf("Multicast DNS responder stopped: %v", err)
+			}
+		}()
+	}
 
-	var header DNSHeader
-	header.Parse(data)
-	log.Printf("Parsed DNS header: %+v", header)
+	// Sockets passed by systemd are bound already
+	if activatedSockets() == 0 {
+		for _, problem := range startupCheck(opts.Listen) {
+			log.Printf("WARNING: %s", problem)
+		}
+	}
 
-	// Parse the incoming DNS questions
-	questions, err := parseDNSQuestions(data[12:], header) // Skip the first 12 bytes (DNS header)
+	udpConn, tcpListener, ready, err := listen(opts.Listen)
 	if err != nil {
-		log.Printf("Failed to parse DNS question: %v", err)
+		fmt.Println("Failed to listen:", err)
 		return
 	}
+	defer udpConn.Close()
+	defer tcpListener.Close()
+	go func() {
+		if err := server.ServeTCP(tcpListener); err != nil {
+			log.Printf("TCP server stopped: %v", err)
+		}
+	}()
+	ready()
+
+	// exited is told why serving stopped, once the queries being answered
+	// are replied to and the state is saved
+	exited := make(chan string, 1)
+	stopped := func(why string) {
+		select {
+		case exited <- why:
+		default:
+		}
+	}
 
-	resolver := &net.Resolver{
-		PreferGo: true,
-		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-			d := net.Dialer{
-				Timeout: time.Millisecond * time.Duration(10000),
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-stop
+		// Another signal exits right away
+		signal.Stop(stop)
+		log.Printf("Stopping on %s, finishing the queries being answered", sig)
+		sdNotify("STOPPING=1")
+		stopped("Exiting on " + sig.String())
+		server.stopServing(udpConn, tcpListener)
+		if adminListener != nil {
+			adminListener.Close()
+		}
+	}()
+
+	if opts.MaxLifetime > 0 {
+		time.AfterFunc(opts.MaxLifetime, func() {
+			log.Printf("Reached the maximum lifetime of %s, restarting", opts.MaxLifetime)
+			// The new process starts from the snapshot
+			saveSnapshot()
+			if err := handOff(udpConn, tcpListener, adminListener); err != nil {
+				log.Printf("Restart failed, serving on: %v", err)
+				return
+			}
+			stopped(fmt.Sprintf("Exiting, the new process serves on %s", udpConn.LocalAddr()))
+			server.stopServing(udpConn, tcpListener)
+			if adminListener != nil {
+				adminListener.Close()
 			}
-			return d.DialContext(ctx, network, resolverAddr)
-		},
+		})
 	}
 
-	log.Printf("Parsed DNS questions: %+v", questions)
+	if opts.Iterate {
+		log.Printf("DNS resolver running on %s, resolving from the root servers", udpConn.LocalAddr())
+	} else {
+		log.Printf("DNS forwarder running on %s, forwarding to %s", udpConn.LocalAddr(), opts.Resolver)
+	}
 
-	answers := make([]DNSAnswer, len(questions))
-	for i, question := range questions {
-		ips, err := resolver.LookupIP(context.Background(), "ip4", question.Name)
-		if err != nil {
-			continue
+	if err := server.ServeUDP(udpConn); err != nil {
+		log.Printf("UDP server stopped: %v", err)
+		return
+	}
+	// Stopped serving after a handoff or a signal
+	if !server.Drain(handoffDrainTimeout) {
+		log.Printf("Gave up waiting for the queries being answered after %s", handoffDrainTimeout)
+	}
+	if opts.FirewallStats != "" {
+		if err := server.active().FirewallStats.Save(opts.FirewallStats); err != nil {
+			log.Printf("Failed to save firewall statistics: %v", err)
 		}
-		ip := ips[0].To4()
+	}
+	saveSnapshot()
+	log.Print(<-exited)
+}
 
-		// Construct a sample answer
-		answers[i] = DNSAnswer{
-			Name:     question.Name,
-			Type:     1, // A record
-			Class:    1, // IN (Internet)
-			TTL:      60,
-			RDLength: 4,
-			RData:    []byte{ip[0], ip[1], ip[2], ip[3]},
+// writeStateDump appends a snapshot of the state of server to the file at path,
+// or logs it when path is empty
+func writeStateDump(server *Server, path string) {
+	state := server.StateDump()
+	if path != "" {
+		if err := appendStateDump(path, state); err != nil {
+			log.Printf("Failed to write state dump: %v", err)
+			return
 		}
+		log.Printf("Wrote state dump to %s", path)
+		return
 	}
-
-	log.Printf("Constructed DNS answers: %+v", answers)
-
-	reply := createDNSReply(header, questions, answers)
-
-	log.Printf("Sending DNS reply to %s with ID: %d", addr.String(), header.ID)
-
-	_, err = conn.WriteToUDP(reply, addr)
+	line, err := json.Marshal(state)
 	if err != nil {
-		log.Printf("Failed to send DNS reply: %v", err)
+		log.Printf("Failed to write state dump: %v", err)
 		return
 	}
-
-	log.Printf("Sent DNS reply to %s", addr.String())
+	log.Printf("State dump: %s", line)
 }
 
-func main() {
-	resolverAddr := flag.String("resolver", "", "Address of the DNS resolver to forward queries to in form <ip>:<port>")
-	flag.Parse()
+// reloader returns the function re-reading the configuration from args and the
+// config file and swapping it into server. Settings only applied on startup
+// are compared against running and reported when they changed.
+func reloader(server *Server, args []string, running *options) func() error {
+	var mu sync.Mutex
+	return func() error {
+		mu.Lock()
+		defer mu.Unlock()
 
-	if *resolverAddr == "" {
-		log.Fatalf("resolver address is required")
+		opts, err := loadOptions(args)
+		if err != nil {
+			return err
+		}
+		prev := server.active()
+		next, err := buildServer(opts, prev)
+		if err != nil {
+			return err
+		}
+		server.Swap(next)
+		closeReplaced(prev, next)
+		next.notifyChanged()
+		log.Printf("Reloaded configuration")
+		if changed := opts.restartRequired(running); len(changed) > 0 {
+			log.Printf("WARNING: changes to %s only take effect after a restart", strings.Join(changed, ", "))
+		}
+		return nil
 	}
+}
 
-	udpAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:2053")
-	if err != nil {
-		fmt.Println("Failed to resolve UDP address:", err)
-		return
+// closeReplaced closes the components of prev that next, swapped in for it,
+// doesn't take over: the mirror, the notifier and the secondary zones, and the
+// caches and upstream transports of the server and of each of its views
+func closeReplaced(prev, next *Server) {
+	if prev.Mirror != next.Mirror {
+		prev.Mirror.Close()
 	}
-
-	udpConn, err := net.ListenUDP("udp", udpAddr)
-	if err != nil {
-		fmt.Println("Failed to bind to address:", err)
-		return
+	if prev.Notifier != next.Notifier {
+		prev.Notifier.Close()
 	}
-	defer udpConn.Close()
-
-	log.Printf("DNS forwarder running on %s, forwarding to %s", udpAddr, *resolverAddr)
-
-	for {
-		buf := make([]byte, 512) // DNS messages are usually limited to 512 bytes
-		n, addr, err := udpConn.ReadFromUDP(buf)
-		if err != nil {
-			log.Printf("Failed to read UDP packet: %v", err)
-			continue
+	for _, sec := range prev.Secondaries {
+		if next.secondary(sec.Origin) != sec {
+			sec.Close()
 		}
+	}
+	closeOwnReplaced(prev, next)
+	for _, v := range prev.Views {
+		closeOwnReplaced(v.Server, next.view(v.Name))
+	}
+}
 
-		go handleDNSRequest(udpConn, addr, buf[:n], *resolverAddr)
+// closeOwnReplaced closes the cache and the encrypted upstream transports of
+// prev that next doesn't take over, all of them when next is nil. Views have
+// those of their own, while they share the other components with the server.
+func closeOwnReplaced(prev, next *Server) {
+	if next == nil || prev.Cache != next.Cache {
+		prev.Cache.Close()
+	}
+	for _, f := range prev.forwarders() {
+		for _, u := range f.Upstreams {
+			var kept *Upstream
+			if next != nil {
+				kept = next.upstream(u.Addr)
+			}
+			if kept == nil || kept.Encrypted != u.Encrypted {
+				u.Encrypted.Close()
+			}
+		}
 	}
 }
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+const (
+	// mdnsPort is the port of multicast DNS (https://www.rfc-editor.org/rfc/rfc6762)
+	mdnsPort = 5353
+	// mdnsTTL is the TTL recommended for records holding host names
+	// (https://www.rfc-editor.org/rfc/rfc6762#section-10)
+	mdnsTTL = 120
+	// mdnsLegacyTTL caps the TTLs of the answers to legacy unicast queries,
+	// sent by ordinary resolvers from ports other than mdnsPort
+	// (https://www.rfc-editor.org/rfc/rfc6762#section-6.7)
+	mdnsLegacyTTL = 10
+	// mdnsUnicastResponse is the top bit of the class of a question asking
+	// for a unicast answer, QU instead of QM
+	// (https://www.rfc-editor.org/rfc/rfc6762#section-5.4)
+	mdnsUnicastResponse = 0x8000
+	// mdnsCacheFlush is the top bit of the class of a record telling caches
+	// it replaces the RRset, the records of the responder are all unique
+	// (https://www.rfc-editor.org/rfc/rfc6762#section-10.2)
+	mdnsCacheFlush = 0x8000
+)
+
+// mdnsGroup is the IPv4 multicast address and port of multicast DNS
+var mdnsGroup = netip.AddrPortFrom(netip.AddrFrom4([4]byte{224, 0, 0, 251}), mdnsPort)
+
+// MDNSResponder answers multicast DNS queries for the .local names of the
+// host and those configured, with their addresses and the PTR records of the
+// addresses. It only ever answers what it holds, never negatively, as other
+// responders on the link may hold the name.
+type MDNSResponder struct {
+	// records holds the records by canonical owner name
+	records map[string][]dnsmessage.Resource
+}
+
+// NewMDNSResponder creates a responder for hostname.local with addrs and the
+// comma separated <name>=<address> entries of names, names without a .local
+// suffix get one
+func NewMDNSResponder(hostname string, addrs []netip.Addr, names string) (*MDNSResponder, error) {
+	m := &MDNSResponder{records: make(map[string][]dnsmessage.Resource)}
+	if hostname != "" {
+		host := mdnsName(hostname)
+		for _, addr := range addrs {
+			m.add(host, addr)
+		}
+	}
+	for _, spec := range splitList(names) {
+		name, address, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected <name>=<address>, got %q", spec)
+		}
+		addr, err := netip.ParseAddr(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address of %s: %w", name, err)
+		}
+		m.add(mdnsName(name), addr.WithZone("").Unmap())
+	}
+	return m, nil
+}
+
+// loadMDNSResponder creates a responder for the host name of the machine and
+// the addresses of its interfaces, and names, see NewMDNSResponder
+func loadMDNSResponder(names string) (*MDNSResponder, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	hostname, _, _ = strings.Cut(hostname, ".")
+	ifaddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	var addrs []netip.Addr
+	for _, ifaddr := range ifaddrs {
+		prefix, err := netip.ParsePrefix(ifaddr.String())
+		if err != nil || prefix.Addr().IsLoopback() {
+			continue
+		}
+		addrs = append(addrs, prefix.Addr().Unmap())
+	}
+	m, err := NewMDNSResponder(hostname, addrs, names)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Answering multicast DNS for %s.local with %v", hostname, addrs)
+	return m, nil
+}
+
+// mdnsName returns the canonical .local name of name
+func mdnsName(name string) string {
+	name = canonicalName(name)
+	if !isSubdomain(name, "local") {
+		name += ".local"
+	}
+	return name
+}
+
+// add adds the address record of name and the PTR record of addr
+func (m *MDNSResponder) add(name string, addr netip.Addr) {
+	rr := dnsmessage.Resource{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: mdnsTTL, Data: &dnsmessage.A{Addr: addr}}
+	if addr.Is6() {
+		rr.Type, rr.Data = dnsmessage.TypeAAAA, &dnsmessage.AAAA{Addr: addr}
+	}
+	ptr := dnsmessage.Resource{Name: reverseName(addr), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: mdnsTTL, Data: &dnsmessage.PTR{Host: name}}
+	for _, r := range []dnsmessage.Resource{rr, ptr} {
+		if !containsRecord(m.records[r.Name], r) {
+			m.records[r.Name] = append(m.records[r.Name], r)
+		}
+	}
+}
+
+// answer returns the response to query from from and where to send it, the
+// link for QM questions and the querier for QU questions and legacy unicast
+// queries, or nil when there is nothing to answer. Records the querier lists
+// as known answers with at least half their TTL left are left out
+// (https://www.rfc-editor.org/rfc/rfc6762#section-7.1).
+func (m *MDNSResponder) answer(query *dnsmessage.Message, from netip.AddrPort) (*dnsmessage.Message, netip.AddrPort) {
+	if query.Response || query.Opcode != dnsmessage.OpcodeQuery || query.RCode != dnsmessage.RCodeSuccess {
+		return nil, netip.AddrPort{}
+	}
+	legacy := from.Port() != mdnsPort
+	reply := &dnsmessage.Message{Header: dnsmessage.Header{Response: true, Authoritative: true}}
+	unicast := true
+	for _, q := range query.Questions {
+		class := q.Class &^ mdnsUnicastResponse
+		if class != dnsmessage.ClassINET && class != dnsmessage.ClassANY {
+			continue
+		}
+		var answers []dnsmessage.Resource
+		for _, rr := range m.records[canonicalName(q.Name)] {
+			if (q.Type == rr.Type || q.Type == dnsmessage.TypeANY) && !knownAnswer(query.Answers, rr) {
+				answers = append(answers, rr)
+			}
+		}
+		if len(answers) == 0 {
+			continue
+		}
+		// A single QM question sends the whole response to the link
+		unicast = unicast && q.Class&mdnsUnicastResponse != 0
+		reply.Answers = append(reply.Answers, answers...)
+	}
+	if len(reply.Answers) == 0 {
+		return nil, netip.AddrPort{}
+	}
+	// The other addresses of the names answered spare queriers a query
+	// (https://www.rfc-editor.org/rfc/rfc6762#section-6.2)
+	for _, rr := range reply.Answers {
+		if rr.Type != dnsmessage.TypeA && rr.Type != dnsmessage.TypeAAAA {
+			continue
+		}
+		for _, other := range m.records[rr.Name] {
+			if other.Type != rr.Type && other.Type != dnsmessage.TypePTR && !containsRecord(reply.Answers, other) && !containsRecord(reply.Additionals, other) {
+				reply.Additionals = append(reply.Additionals, other)
+			}
+		}
+	}
+
+	if legacy {
+		// Legacy resolvers need the ID and question of their query, and
+		// don't know about the cache flush bit
+		reply.ID, reply.RecursionDesired = query.ID, query.RecursionDesired
+		for _, q := range query.Questions {
+			reply.Questions = append(reply.Questions, dnsmessage.Question{Name: q.Name, Type: q.Type, Class: q.Class &^ mdnsUnicastResponse})
+		}
+		capTTLs(reply.Answers, mdnsLegacyTTL)
+		capTTLs(reply.Additionals, mdnsLegacyTTL)
+		return reply, from
+	}
+	for _, section := range [][]dnsmessage.Resource{reply.Answers, reply.Additionals} {
+		for i := range section {
+			section[i].Class |= mdnsCacheFlush
+		}
+	}
+	if unicast {
+		return reply, from
+	}
+	return reply, mdnsGroup
+}
+
+// knownAnswer reports whether known holds rr with at least half its TTL left
+func knownAnswer(known []dnsmessage.Resource, rr dnsmessage.Resource) bool {
+	for _, k := range known {
+		k.Class &^= mdnsCacheFlush
+		if k.TTL >= rr.TTL/2 && containsRecord([]dnsmessage.Resource{k}, rr) {
+			return true
+		}
+	}
+	return false
+}
+
+// capTTLs lowers the TTLs of records above ttl to ttl
+func capTTLs(records []dnsmessage.Resource, ttl uint32) {
+	for i := range records {
+		records[i].TTL = min(records[i].TTL, ttl)
+	}
+}
+
+// listenMDNS joins the multicast DNS group on the default interface
+func listenMDNS() (*net.UDPConn, error) {
+	return net.ListenMulticastUDP("udp4", nil, net.UDPAddrFromAddrPort(mdnsGroup))
+}
+
+// Serve answers the multicast DNS queries arriving on conn until it is closed
+func (m *MDNSResponder) Serve(conn *net.UDPConn) error {
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		query := &dnsmessage.Message{}
+		if err := query.Unpack(buf[:n]); err != nil {
+			continue
+		}
+		reply, to := m.answer(query, from)
+		if reply == nil {
+			continue
+		}
+		packed, err := reply.Pack()
+		if err != nil {
+			log.Printf("Failed to pack multicast DNS response: %v", err)
+			continue
+		}
+		if _, err := conn.WriteToUDPAddrPort(packed, to); err != nil {
+			log.Printf("Failed to send multicast DNS response to %s: %v", to, err)
+		}
+	}
+}
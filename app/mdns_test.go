@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+func newTestMDNSResponder(t *testing.T) *MDNSResponder {
+	t.Helper()
+	m, err := NewMDNSResponder("box", []netip.Addr{netip.MustParseAddr("192.168.1.5"), netip.MustParseAddr("fe80::5")}, "printer=192.168.1.20,nas.local=192.168.1.30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func mdnsQuery(qu bool, questions ...dnsmessage.Question) *dnsmessage.Message {
+	for i := range questions {
+		if qu {
+			questions[i].Class |= mdnsUnicastResponse
+		}
+	}
+	return &dnsmessage.Message{Questions: questions}
+}
+
+func TestMDNSAnswer(t *testing.T) {
+	m := newTestMDNSResponder(t)
+	peer := netip.MustParseAddrPort("192.168.1.9:5353")
+
+	// QM questions are answered to the link with the cache flush bit, the
+	// other address of the name as additional record
+	reply, to := m.answer(mdnsQuery(false, question("box.local", dnsmessage.TypeA)), peer)
+	if reply == nil || to != mdnsGroup {
+		t.Fatalf("Expected a multicast response, got %v to %s", reply, to)
+	}
+	if reply.ID != 0 || !reply.Authoritative || len(reply.Questions) != 0 {
+		t.Errorf("Expected an authoritative response without ID and questions, got %v", reply)
+	}
+	if len(reply.Answers) != 1 || reply.Answers[0].String() != "box.local.\t120\tCLASS32769\tA\t192.168.1.5" {
+		t.Errorf("Expected the address of box.local with the cache flush bit, got %v", reply.Answers)
+	}
+	if len(reply.Additionals) != 1 || reply.Additionals[0].Type != dnsmessage.TypeAAAA {
+		t.Errorf("Expected the IPv6 address as additional record, got %v", reply.Additionals)
+	}
+
+	// QU questions are answered to the querier
+	if reply, to := m.answer(mdnsQuery(true, question("printer.local", dnsmessage.TypeA)), peer); reply == nil || to != peer {
+		t.Errorf("Expected a unicast response, got %v to %s", reply, to)
+	}
+	// Unless a QM question is answered along
+	mixed := mdnsQuery(true, question("printer.local", dnsmessage.TypeA))
+	mixed.Questions = append(mixed.Questions, question("nas.local", dnsmessage.TypeA))
+	if _, to := m.answer(mixed, peer); to != mdnsGroup {
+		t.Errorf("Expected a multicast response with a QM question, got one to %s", to)
+	}
+
+	// Reverse lookups of the addresses
+	reply, _ = m.answer(mdnsQuery(false, question("30.1.168.192.in-addr.arpa", dnsmessage.TypePTR)), peer)
+	if reply == nil || len(reply.Answers) != 1 || reply.Answers[0].Data.String() != "nas.local." {
+		t.Errorf("Expected the PTR record of nas.local, got %v", reply)
+	}
+
+	// Names not held, responses and known answers get no response
+	for _, query := range []*dnsmessage.Message{
+		mdnsQuery(false, question("other.local", dnsmessage.TypeA)),
+		mdnsQuery(false, question("box.local", dnsmessage.TypeMX)),
+		{Header: dnsmessage.Header{Response: true}, Questions: []dnsmessage.Question{question("box.local", dnsmessage.TypeA)}},
+		{
+			Questions: []dnsmessage.Question{question("box.local", dnsmessage.TypeA)},
+			Answers:   []dnsmessage.Resource{aRecord("box.local", "192.168.1.5")},
+		},
+	} {
+		if reply, _ := m.answer(query, peer); reply != nil {
+			t.Errorf("Expected no response to %v, got %v", query, reply)
+		}
+	}
+	// A known answer about to expire doesn't suppress the answer
+	stale := aRecord("box.local", "192.168.1.5")
+	stale.TTL = 30
+	if reply, _ := m.answer(&dnsmessage.Message{Questions: []dnsmessage.Question{question("box.local", dnsmessage.TypeA)}, Answers: []dnsmessage.Resource{stale}}, peer); reply == nil {
+		t.Error("Expected an answer despite a known answer with little TTL left")
+	}
+}
+
+func TestMDNSLegacyUnicast(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go newTestMDNSResponder(t).Serve(conn)
+
+	// Ordinary resolvers query from other ports and get ordinary answers
+	reply := dnstest.ExchangeUDP(t, conn.LocalAddr().String(), testQuery("BOX.local"))
+	if reply.ID != 1234 || len(reply.Questions) != 1 {
+		t.Errorf("Expected the ID and question of the query, got %v", reply)
+	}
+	if len(reply.Answers) != 1 || reply.Answers[0].String() != "box.local.\t10\tIN\tA\t192.168.1.5" {
+		t.Errorf("Expected the address with TTL 10 and without cache flush bit, got %v", reply.Answers)
+	}
+
+	// Nothing is sent for names not held
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	packed, err := testQuery("other.local").Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Write(packed)
+	client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := client.Read(make([]byte, 512)); err == nil {
+		t.Errorf("Expected no response, got %d bytes", n)
+	}
+}
+
+func TestNewMDNSResponderRejectsInvalidNames(t *testing.T) {
+	for _, names := range []string{"printer", "printer=not-an-address"} {
+		if _, err := NewMDNSResponder("box", nil, names); err == nil {
+			t.Errorf("Expected %q to be rejected", names)
+		}
+	}
+}
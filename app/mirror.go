@@ -0,0 +1,122 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"sync"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// mirrorQueueSize is how many queries may wait to be mirrored, more are dropped
+// rather than slowing down the clients
+const mirrorQueueSize = 1024
+
+// mirrorMetrics counts the mirrored queries as sent, dropped and failed
+var mirrorMetrics = expvar.NewMap("mirror")
+
+// Mirror copies a sample of the incoming queries to another DNS server, e.g. to
+// warm the cache of a standby resolver or to feed analytics. Queries are sent
+// in the background and the answers are discarded, clients never wait for it.
+type Mirror struct {
+	Addr string
+	// Sample is the fraction of the queries mirrored, between 0 and 1
+	Sample float64
+
+	conn  net.Conn
+	queue chan *dnsmessage.Message
+	done  chan struct{}
+	once  sync.Once
+}
+
+// NewMirror starts mirroring the given fraction of the queries to addr over UDP
+func NewMirror(addr string, sample float64) (*Mirror, error) {
+	if sample <= 0 || sample > 1 {
+		return nil, fmt.Errorf("sample must be above 0 and at most 1, got %v", sample)
+	}
+	if _, err := net.ResolveUDPAddr("udp", addr); err != nil {
+		return nil, err
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	m := &Mirror{
+		Addr:   addr,
+		Sample: sample,
+		conn:   conn,
+		queue:  make(chan *dnsmessage.Message, mirrorQueueSize),
+		done:   make(chan struct{}),
+	}
+	go m.run()
+	go m.discardAnswers()
+	return m, nil
+}
+
+// send queues query to be mirrored if it is part of the sample
+func (m *Mirror) send(query *dnsmessage.Message) {
+	if m == nil || m.Sample < 1 && rand.Float64() >= m.Sample {
+		return
+	}
+	select {
+	case m.queue <- query:
+	case <-m.done:
+	default:
+		mirrorMetrics.Add("dropped", 1)
+	}
+}
+
+func (m *Mirror) run() {
+	for {
+		select {
+		case query := <-m.queue:
+			// The copy gets its own ID, the destination sees queries from us
+			// and the client's ID means nothing to it
+			mirrored := *query
+			mirrored.ID = newQueryID()
+			packed, err := mirrored.Pack()
+			if err == nil {
+				_, err = m.conn.Write(packed)
+			}
+			if err != nil {
+				mirrorMetrics.Add("failed", 1)
+				continue
+			}
+			mirrorMetrics.Add("sent", 1)
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// discardAnswers reads the answers of the destination so they don't pile up
+func (m *Mirror) discardAnswers() {
+	buf := make([]byte, 512)
+	for {
+		if _, err := m.conn.Read(buf); err != nil {
+			select {
+			case <-m.done:
+				return
+			default:
+			}
+			// ICMP errors of an unreachable destination surface here and
+			// are already counted by the writes failing
+		}
+	}
+}
+
+// Close stops mirroring, queries still queued are dropped
+func (m *Mirror) Close() {
+	if m == nil {
+		return
+	}
+	m.once.Do(func() {
+		close(m.done)
+		if err := m.conn.Close(); err != nil {
+			log.Printf("Failed to close the mirror connection to %s: %v", m.Addr, err)
+		}
+	})
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+func TestServerMirrorsQueries(t *testing.T) {
+	mirrored := make(chan *dnsmessage.Message, 1)
+	standby := dnstest.StartUDPServer(t, func(q *dnsmessage.Message) *dnsmessage.Message {
+		mirrored <- q
+		return answerA("192.0.2.99")(q)
+	}).Addr
+	s := newTestServer(t, dnstest.StartUDPServer(t, answerA("192.0.2.1")).Addr)
+	mirror, err := NewMirror(standby, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mirror.Close()
+	s.Mirror = mirror
+
+	resp := handle(s, testQuery("www.example.com"))
+	if len(resp.Answers) != 1 || resp.Answers[0].Data.String() != "192.0.2.1" {
+		t.Fatalf("Expected the answer of the real upstream, got %+v", resp.Answers)
+	}
+	select {
+	case q := <-mirrored:
+		if q.Questions[0].Name != "www.example.com" || !q.RecursionDesired {
+			t.Errorf("Expected a copy of the query, got %+v", q)
+		}
+		if q.ID == 1234 {
+			t.Error("Expected the mirrored query to get its own ID")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the query to be mirrored")
+	}
+}
+
+func TestNewMirrorValidatesSample(t *testing.T) {
+	for _, sample := range []float64{0, -0.5, 1.5} {
+		if _, err := NewMirror("127.0.0.1:53", sample); err == nil {
+			t.Errorf("Expected sample %v to be rejected", sample)
+		}
+	}
+}
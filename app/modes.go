@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// Modes are the runtime toggles for intervention windows on shared instances,
+// switched through the admin API and SIGUSR2 and kept across reloads. In
+// read-only mode everything that changes state is refused while queries are
+// answered as usual. In maintenance mode queries are answered with a fixed
+// RCODE or with their TTLs trimmed, so clients don't hold on to answers from
+// the window for long. Blocking can be paused, answering the names on the
+// blocklists like any other.
+type Modes struct {
+	mu          sync.RWMutex
+	readOnly    bool
+	maintenance *Maintenance
+	// blockingPaused is kept inverted so the zero Modes blocks
+	blockingPaused bool
+	// defaults is the maintenance mode SIGUSR2 switches on, from the options
+	defaults Maintenance
+}
+
+// Maintenance is how queries are answered in maintenance mode
+type Maintenance struct {
+	// RCode answers every query without resolving it, NOERROR answers queries
+	// as usual
+	RCode dnsmessage.RCode
+	// MaxTTL caps the TTLs of the answers, 0 leaves them alone
+	MaxTTL uint32
+	// Reason is logged and shown by the admin API
+	Reason string
+}
+
+// ParseMaintenance builds the maintenance mode answering with rcode, empty
+// for answering as usual, and TTLs capped at maxTTL seconds
+func ParseMaintenance(rcode string, maxTTL uint32) (Maintenance, error) {
+	m := Maintenance{MaxTTL: maxTTL}
+	if rcode != "" {
+		var err error
+		if m.RCode, err = dnsmessage.ParseRCode(strings.ToUpper(rcode)); err != nil {
+			return m, err
+		}
+	}
+	if m.RCode == dnsmessage.RCodeSuccess && m.MaxTTL == 0 {
+		return m, errors.New("maintenance mode needs an RCODE or a maximum TTL")
+	}
+	return m, nil
+}
+
+// ReadOnly reports whether read-only mode is on
+func (m *Modes) ReadOnly() bool {
+	if m == nil {
+		return false
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.readOnly
+}
+
+// SetReadOnly switches read-only mode on or off
+func (m *Modes) SetReadOnly(on bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.readOnly != on {
+		log.Printf("Read-only mode %s", onOff(on))
+	}
+	m.readOnly = on
+}
+
+// Blocking reports whether the names on the blocklists are blocked
+func (m *Modes) Blocking() bool {
+	if m == nil {
+		return true
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return !m.blockingPaused
+}
+
+// SetBlocking resumes or pauses blocking
+func (m *Modes) SetBlocking(on bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.blockingPaused == on {
+		log.Printf("Blocking %s", onOff(on))
+	}
+	m.blockingPaused = !on
+}
+
+// Maintenance returns the maintenance mode in effect, nil when it is off
+func (m *Modes) Maintenance() *Maintenance {
+	if m == nil {
+		return nil
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.maintenance
+}
+
+// SetMaintenance switches maintenance mode on with the settings of mode, or
+// off with nil
+func (m *Modes) SetMaintenance(mode *Maintenance) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case mode == nil && m.maintenance != nil:
+		log.Printf("Maintenance mode off")
+	case mode != nil:
+		log.Printf("Maintenance mode on, answering with %s and TTLs up to %d: %s", mode.RCode, mode.MaxTTL, mode.Reason)
+	}
+	m.maintenance = mode
+}
+
+// ToggleMaintenance switches maintenance mode off, or on with the settings
+// of the options, for SIGUSR2
+func (m *Modes) ToggleMaintenance() {
+	if m.Maintenance() != nil {
+		m.SetMaintenance(nil)
+		return
+	}
+	mode := m.defaultMaintenance()
+	mode.Reason = "switched on by SIGUSR2"
+	m.SetMaintenance(&mode)
+}
+
+// defaultMaintenance returns the maintenance mode set by the options
+func (m *Modes) defaultMaintenance() Maintenance {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.defaults
+}
+
+// setDefaults sets the maintenance mode set by the options
+func (m *Modes) setDefaults(mode Maintenance) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.defaults = mode
+}
+
+// intercept answers query in maintenance mode with its RCODE, nil when the
+// query is to be answered as usual
+func (m *Modes) intercept(query *dnsmessage.Message) *dnsmessage.Message {
+	mode := m.Maintenance()
+	if mode == nil || mode.RCode == dnsmessage.RCodeSuccess {
+		return nil
+	}
+	reply := createDNSReply(query)
+	reply.RCode = mode.RCode
+	return reply
+}
+
+// trim caps the TTLs of reply in maintenance mode. The records may be shared
+// with the cache, so trimmed sections are copies.
+func (m *Modes) trim(reply *dnsmessage.Message) {
+	mode := m.Maintenance()
+	if mode == nil || mode.MaxTTL == 0 {
+		return
+	}
+	for _, section := range []*[]dnsmessage.Resource{&reply.Answers, &reply.Authorities, &reply.Additionals} {
+		trimmed := append([]dnsmessage.Resource(nil), *section...)
+		for i := range trimmed {
+			// The TTL of OPT records holds flags
+			if trimmed[i].Type != dnsmessage.TypeOPT {
+				trimmed[i].TTL = min(trimmed[i].TTL, mode.MaxTTL)
+			}
+		}
+		*section = trimmed
+	}
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
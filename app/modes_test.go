@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+func TestReadOnlyModeRefusesChanges(t *testing.T) {
+	s := newUpdateTestServer(t)
+	s.Modes = &Modes{}
+	s.Cache = NewCache(10)
+	admin := s.AdminHandler()
+
+	rec := httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest("PUT", "/modes/read-only", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"read_only": true`) {
+		t.Fatalf("Expected read-only mode to be switched on, got %d %s", rec.Code, rec.Body)
+	}
+	add := []dnsmessage.Resource{aRecord("nas2.home.lan", "192.168.1.30")}
+	if resp := sendUpdate(s, "127.0.0.1:5000", "home.lan", nil, add); resp.RCode != dnsmessage.RCodeRefused {
+		t.Errorf("Expected updates to be refused in read-only mode, got %s", resp.RCode)
+	}
+	rec = httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest("POST", "/cache/import", strings.NewReader("")))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("Expected cache imports to be refused in read-only mode, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest("DELETE", "/cache", nil))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("Expected cache flushes to be refused in read-only mode, got %d", rec.Code)
+	}
+	if resp := handle(s, testQuery("www.home.lan")); len(resp.Answers) != 1 {
+		t.Errorf("Expected queries to be answered in read-only mode, got %s", resp)
+	}
+
+	admin.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("DELETE", "/modes/read-only", nil))
+	if resp := sendUpdate(s, "127.0.0.1:5000", "home.lan", nil, add); resp.RCode != dnsmessage.RCodeSuccess {
+		t.Errorf("Expected updates once read-only mode is off, got %s", resp.RCode)
+	}
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	s := newTestServer(t, dnstest.StartUDPServer(t, answerA("192.0.2.1")).Addr)
+	s.Cache = NewCache(10)
+	s.Modes = &Modes{}
+	defaults, err := ParseMaintenance("", 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Modes.setDefaults(defaults)
+
+	s.Modes.ToggleMaintenance()
+	if resp := handle(s, testQuery("www.example")); resp.Answers[0].TTL != 30 {
+		t.Errorf("Expected the TTL to be trimmed, got %s", resp)
+	}
+	if resp, _ := s.Cache.Get(question("www.example", dnsmessage.TypeA)); resp.Answers[0].TTL != 60 {
+		t.Errorf("Expected the cached answer to keep its TTL, got %s", resp)
+	}
+
+	rec := httptest.NewRecorder()
+	s.AdminHandler().ServeHTTP(rec, httptest.NewRequest("PUT", "/modes/maintenance", strings.NewReader(`{"rcode": "refused", "reason": "upgrade"}`)))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"rcode": "REFUSED"`) {
+		t.Fatalf("Expected maintenance mode answering REFUSED, got %d %s", rec.Code, rec.Body)
+	}
+	if resp := handle(s, testQuery("www.example")); resp.RCode != dnsmessage.RCodeRefused || len(resp.Answers) != 0 {
+		t.Errorf("Expected REFUSED in maintenance mode, got %s", resp)
+	}
+
+	rec = httptest.NewRecorder()
+	s.AdminHandler().ServeHTTP(rec, httptest.NewRequest("PUT", "/modes/maintenance", strings.NewReader(`{"rcode": "bogus"}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown RCODE to be rejected, got %d", rec.Code)
+	}
+
+	s.Modes.ToggleMaintenance()
+	if resp := handle(s, testQuery("www.example")); resp.RCode != dnsmessage.RCodeSuccess || resp.Answers[0].TTL != 60 {
+		t.Errorf("Expected answers as usual once maintenance mode is off, got %s", resp)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// isSubdomain reports whether name equals zone or is below it, ignoring case
+func isSubdomain(name, zone string) bool {
+	name, zone = canonicalName(name), canonicalName(zone)
+	if zone == dnsmessage.Root {
+		return true
+	}
+	if name == zone {
+		return true
+	}
+	if !strings.HasSuffix(name, "."+zone) {
+		return false
+	}
+	// The dot in front of zone must separate labels, not be an escaped one
+	return !escaped(name, len(name)-len(zone)-1)
+}
+
+// escaped reports whether the byte at i of a name in presentation format is
+// escaped by the backslashes in front of it
+func escaped(name string, i int) bool {
+	backslashes := 0
+	for i--; i >= 0 && name[i] == '\\'; i-- {
+		backslashes++
+	}
+	return backslashes%2 == 1
+}
+
+// inAnyDomain reports whether name is at or below one of domains
+func inAnyDomain(name string, domains []string) bool {
+	for _, d := range domains {
+		if isSubdomain(name, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList splits a comma separated flag value, dropping empty items
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// canonicalName is the form names are compared and looked up in: lower case
+// without trailing dot, escaped only where needed, the root being ".". Names
+// that can't be valid are only lowered, they match nothing valid either way.
+func canonicalName(name string) string {
+	if c, err := dnsmessage.CanonicalName(name); err == nil {
+		return c
+	}
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// normalizeQuestions returns the questions with their names in canonical form,
+// so all later stages see a single spelling of each name and the cache and
+// local data can't miss on differences in case or escaping
+func normalizeQuestions(questions []dnsmessage.Question) ([]dnsmessage.Question, error) {
+	normalized := make([]dnsmessage.Question, len(questions))
+	for i, q := range questions {
+		name, err := dnsmessage.CanonicalName(q.Name)
+		if err != nil {
+			return nil, fmt.Errorf("question %q: %w", q.Name, err)
+		}
+		q.Name = name
+		normalized[i] = q
+	}
+	return normalized, nil
+}
+
+// parentName returns the canonical name one label above a canonical name, the
+// parent of a top level domain and of the root is the root
+func parentName(name string) string {
+	for i := 0; i < len(name); i++ {
+		if name[i] == '\\' {
+			i++
+		} else if name[i] == '.' {
+			return name[i+1:]
+		}
+	}
+	return dnsmessage.Root
+}
+
+// ancestorName returns the ancestor of a canonical name with the given number
+// of labels, or name itself when it has no more than that
+func ancestorName(name string, labels int) string {
+	for n := labelCount(name); n > labels; n-- {
+		name = parentName(name)
+	}
+	return name
+}
+
+// reverseName returns the canonical PTR owner name of addr, in in-addr.arpa
+// for IPv4 and ip6.arpa nibbles for IPv6 (https://www.rfc-editor.org/rfc/rfc3596#section-2.5)
+func reverseName(addr netip.Addr) string {
+	addr = addr.Unmap()
+	b := addr.AsSlice()
+	labels := make([]string, 0, 2*len(b)+2)
+	for i := len(b) - 1; i >= 0; i-- {
+		if addr.Is4() {
+			labels = append(labels, strconv.Itoa(int(b[i])))
+		} else {
+			labels = append(labels, strconv.FormatUint(uint64(b[i]&0xf), 16), strconv.FormatUint(uint64(b[i]>>4), 16))
+		}
+	}
+	if addr.Is4() {
+		labels = append(labels, "in-addr", "arpa")
+	} else {
+		labels = append(labels, "ip6", "arpa")
+	}
+	return strings.Join(labels, ".")
+}
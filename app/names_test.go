@@ -0,0 +1,56 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+func TestServerNormalizesQuestionNames(t *testing.T) {
+	var queries atomic.Int32
+	answer := answerA("192.0.2.1")
+	upstream := dnstest.StartUDPServer(t, func(q *dnsmessage.Message) *dnsmessage.Message {
+		queries.Add(1)
+		if q.Questions[0].Name != "www.example.com" {
+			t.Errorf("Expected upstream to see the canonical name, got %q", q.Questions[0].Name)
+		}
+		return answer(q)
+	}).Addr
+	s := newTestServer(t, upstream)
+	s.Cache = NewCache(10)
+
+	for _, name := range []string{"www.example.com", "WWW.Example.Com.", `\087ww.example.com`} {
+		resp := handle(s, &dnsmessage.Message{Questions: []dnsmessage.Question{question(name, dnsmessage.TypeA)}})
+		if len(resp.Answers) != 1 {
+			t.Fatalf("%s: expected an answer, got %+v", name, resp)
+		}
+		if resp.Questions[0].Name != name {
+			t.Errorf("Expected the question to be echoed as asked, got %q for %q", resp.Questions[0].Name, name)
+		}
+	}
+	if n := queries.Load(); n != 1 {
+		t.Errorf("Expected every spelling to hit the cache after the first, got %d upstream queries", n)
+	}
+
+	resp := handle(s, &dnsmessage.Message{Questions: []dnsmessage.Question{question("a..example.com", dnsmessage.TypeA)}})
+	if resp.RCode != dnsmessage.RCodeFormatError {
+		t.Errorf("Expected FORMERR for an invalid name, got %s", resp.RCode)
+	}
+}
+
+func TestNamesWithEscapedDots(t *testing.T) {
+	if isSubdomain(`www\.example.com`, "example.com") {
+		t.Error(`Expected www\.example.com, a single label below com, not to be below example.com`)
+	}
+	if !isSubdomain(`a.www\.example.com`, `WWW\.example.com`) {
+		t.Error("Expected escaped dots to compare like any other byte")
+	}
+	if got := parentName(`www\.example.com`); got != "com" {
+		t.Errorf("Expected the parent of an escaped label to skip its dot, got %s", got)
+	}
+	if got := labelCount(`www\.example.com`); got != 2 {
+		t.Errorf("Expected 2 labels, got %d", got)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+const (
+	// notifyAttempts bounds the NOTIFY messages sent for a change to a
+	// secondary that doesn't acknowledge them
+	notifyAttempts = 5
+	// notifyTimeout is how long the first NOTIFY waits for its
+	// acknowledgement, each retry waits twice as long
+	notifyTimeout = 2 * time.Second
+)
+
+// notifyMetrics counts the NOTIFY messages sent, acknowledged and given up on
+var notifyMetrics = expvar.NewMap("notify")
+
+// Notifier tells the secondary servers of the local zones about changes with
+// NOTIFY messages (https://www.rfc-editor.org/rfc/rfc1996), so they transfer
+// the zone right away instead of waiting for the SOA refresh timer. Messages
+// are retried with a doubling timeout until acknowledged, a newer change of
+// the zone takes over from the retries of the last one.
+type Notifier struct {
+	// spec is the configuration the notifier was built from, see buildServer
+	spec    string
+	targets map[string][]notifyTarget
+	// timeout is that of the first attempt
+	timeout time.Duration
+
+	mu sync.Mutex
+	// pending cancels the retries under way by zone and secondary
+	pending map[notifyTarget]context.CancelFunc
+	closed  bool
+}
+
+// notifyTarget is a secondary server of a zone
+type notifyTarget struct {
+	zone string
+	addr string
+	key  *tsigKey
+}
+
+// NewNotifier parses comma separated <origin>=<ip>:<port>[/<key>] naming the
+// secondaries of the local zones and the key of keys signing the messages to
+// them. A zone with several secondaries is listed once for each.
+func NewNotifier(s string, keys *TSIGKeys) (*Notifier, error) {
+	n := &Notifier{spec: s, targets: make(map[string][]notifyTarget), timeout: notifyTimeout, pending: make(map[notifyTarget]context.CancelFunc)}
+	for _, spec := range splitList(s) {
+		origin, secondary, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected <origin>=<ip>:<port>[/<key>], got %q", spec)
+		}
+		secondary, keyName, signed := strings.Cut(secondary, "/")
+		if _, err := netip.ParseAddrPort(secondary); err != nil {
+			return nil, fmt.Errorf("secondary of %s: %w", origin, err)
+		}
+		t := notifyTarget{zone: canonicalName(origin), addr: secondary}
+		if signed {
+			if t.key = keys.key(keyName); t.key == nil {
+				return nil, fmt.Errorf("key of %s: no -tsig-key named %q", origin, keyName)
+			}
+		}
+		n.targets[t.zone] = append(n.targets[t.zone], t)
+	}
+	return n, nil
+}
+
+// notify sends a NOTIFY for zone, whose SOA record is now soa, to each of its
+// secondaries in the background
+func (n *Notifier) notify(zone string, soa dnsmessage.Resource) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return
+	}
+	for _, t := range n.targets[zone] {
+		if cancel := n.pending[t]; cancel != nil {
+			cancel()
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		n.pending[t] = cancel
+		go func() {
+			n.send(ctx, t, soa)
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if ctx.Err() == nil {
+				delete(n.pending, t)
+			}
+			cancel()
+		}()
+	}
+}
+
+// untransferable returns the secondaries notified of changes that may not
+// transfer the zone from the server, going by the address and key they are
+// notified with. They have to take the zone from somewhere else.
+func (s *Server) untransferable() []notifyTarget {
+	if s.Notifier == nil {
+		return nil
+	}
+	var zones []string
+	for zone := range s.Notifier.targets {
+		zones = append(zones, zone)
+	}
+	sort.Strings(zones)
+	var targets []notifyTarget
+	for _, zone := range zones {
+		for _, t := range s.Notifier.targets[zone] {
+			addr, _ := netip.ParseAddrPort(t.addr)
+			qc := &QueryContext{Client: addr}
+			if t.key != nil {
+				qc.Key = t.key.Name
+			}
+			if !s.transferAllowed(qc) {
+				targets = append(targets, t)
+			}
+		}
+	}
+	return targets
+}
+
+// errNotifyRefused is returned for a NOTIFY the secondary won't take, which
+// is not sent again
+var errNotifyRefused = errors.New("NOTIFY refused")
+
+// send sends the NOTIFY to t until it is acknowledged, the attempts are used
+// up, the secondary refuses it or ctx is done. Attempts are timeout apart,
+// also when they fail right away, and the timeout doubles with each one.
+func (n *Notifier) send(ctx context.Context, t notifyTarget, soa dnsmessage.Resource) {
+	serial := soa.Data.(*dnsmessage.SOA).Serial
+	timeout := n.timeout
+	for attempt := 1; ; attempt++ {
+		notifyMetrics.Add("sent", 1)
+		next := time.NewTimer(timeout)
+		err := sendNotify(ctx, t, soa, timeout)
+		if err == nil {
+			next.Stop()
+			notifyMetrics.Add("acknowledged", 1)
+			log.Printf("Secondary %s acknowledged NOTIFY for %s serial %d", t.addr, dnsmessage.FQDN(t.zone), serial)
+			return
+		}
+		if ctx.Err() == nil && (errors.Is(err, errNotifyRefused) || attempt == notifyAttempts) {
+			next.Stop()
+			notifyMetrics.Add("failed", 1)
+			log.Printf("Giving up on NOTIFY for %s serial %d to %s after %d attempts: %v", dnsmessage.FQDN(t.zone), serial, t.addr, attempt, err)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			next.Stop()
+			return
+		case <-next.C:
+		}
+		timeout *= 2
+	}
+}
+
+// sendNotify sends a single NOTIFY to t and waits up to timeout for the
+// acknowledgement. The SOA record goes along as a hint about the serial
+// (https://www.rfc-editor.org/rfc/rfc1996#section-3.7). A signed NOTIFY only
+// takes signed responses, but for NOTAUTH reporting that the secondary could
+// not verify it, which is unsigned (https://www.rfc-editor.org/rfc/rfc8945#section-5.2).
+func sendNotify(ctx context.Context, t notifyTarget, soa dnsmessage.Resource, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", t.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	// Canceling interrupts the wait for the acknowledgement
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	soa.Name = dnsmessage.FQDN(t.zone)
+	query := &dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: newQueryID(), Opcode: dnsmessage.OpcodeNotify, Authoritative: true},
+		Questions: []dnsmessage.Question{{Name: soa.Name, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET}},
+		Answers:   []dnsmessage.Resource{soa},
+	}
+	var verify func(*dnsmessage.Message, []byte) error
+	if t.key != nil {
+		stream := &tsigStream{key: t.key}
+		if err := stream.sign(query); err != nil {
+			return err
+		}
+		verify = func(resp *dnsmessage.Message, raw []byte) error {
+			if resp.RCode == dnsmessage.RCodeNotAuth {
+				return nil
+			}
+			return stream.verify(raw)
+		}
+	}
+	resp, _, err := exchangeVerified(conn, query, verify)
+	if err != nil {
+		return err
+	}
+	switch resp.RCode {
+	case dnsmessage.RCodeSuccess:
+		return nil
+	case dnsmessage.RCodeRefused, dnsmessage.RCodeNotAuth:
+		return fmt.Errorf("%w with %s", errNotifyRefused, resp.RCode)
+	}
+	return fmt.Errorf("NOTIFY rejected with %s", resp.RCode)
+}
+
+// Close stops the retries under way, nothing is sent after
+func (n *Notifier) Close() {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.closed = true
+	for t, cancel := range n.pending {
+		cancel()
+		delete(n.pending, t)
+	}
+}
+
+// notifyChanged notifies the secondaries of the zones that changed with the
+// configuration the server was built from
+func (s *Server) notifyChanged() {
+	for _, zone := range s.changedZones {
+		if soa, ok := s.LocalData.soa(zone); ok {
+			log.Printf("Zone %s changed, serial %d", dnsmessage.FQDN(zone), soa.Data.(*dnsmessage.SOA).Serial)
+			s.Notifier.notify(zone, soa)
+		}
+	}
+}
+
+// soa returns the SOA record of zone
+func (d *LocalData) soa(zone string) (dnsmessage.Resource, bool) {
+	if d == nil {
+		return dnsmessage.Resource{}, false
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	soa, ok := d.zones[zone]
+	if _, isSOA := soa.Data.(*dnsmessage.SOA); !ok || !isSOA {
+		return dnsmessage.Resource{}, false
+	}
+	return soa, true
+}
+
+// changedZones compares the zones of d, just loaded, with those of prev, the
+// local data being served, and returns the zones that are new, whose records
+// differ or whose serial is newer. A changed zone whose serial is not newer
+// than the old one gets the serial after it, so secondaries see the change.
+func (d *LocalData) changedZones(prev *LocalData) []string {
+	var changed []string
+	for zone := range d.zones {
+		records, ok := d.zoneContent(zone)
+		if !ok {
+			continue
+		}
+		old, ok := prev.soa(zone)
+		if !ok {
+			changed = append(changed, zone)
+			continue
+		}
+		oldRecords, _ := prev.zoneContent(zone)
+		oldSerial := old.Data.(*dnsmessage.SOA).Serial
+		newer := serialNewer(d.zones[zone].Data.(*dnsmessage.SOA).Serial, oldSerial)
+		if slices.Equal(records, oldRecords) && !newer {
+			continue
+		}
+		if !newer {
+			soa := d.zones[zone]
+			data := *soa.Data.(*dnsmessage.SOA)
+			data.Serial = oldSerial
+			soa.Data = &data
+			d.zones[zone] = soa
+			d.bumpSerial(zone)
+		}
+		changed = append(changed, zone)
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// zoneContent returns the records of zone in their text form, sorted, with
+// the serial left out of the SOA record so only changes of the data count
+func (d *LocalData) zoneContent(zone string) ([]string, bool) {
+	if d == nil {
+		return nil, false
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if _, ok := d.zones[zone].Data.(*dnsmessage.SOA); !ok {
+		return nil, false
+	}
+	var content []string
+	for name, records := range d.records {
+		if z, _ := d.zoneOf(name); z != zone {
+			continue
+		}
+		for _, rr := range records {
+			if soa, ok := rr.Data.(*dnsmessage.SOA); ok {
+				data := *soa
+				data.Serial = 0
+				rr.Data = &data
+			}
+			content = append(content, rr.String())
+		}
+	}
+	sort.Strings(content)
+	return content, true
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+// startFakeSecondary receives NOTIFY messages, leaving the first drop of them
+// unanswered, and passes each on to the returned channel
+func startFakeSecondary(t *testing.T, drop int) (string, <-chan *dnsmessage.Message) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	received := make(chan *dnsmessage.Message, 16)
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			var msg dnsmessage.Message
+			if msg.Unpack(buf[:n]) != nil {
+				continue
+			}
+			received <- &msg
+			if drop > 0 {
+				drop--
+				continue
+			}
+			ack := &dnsmessage.Message{Header: dnsmessage.Header{ID: msg.ID, Response: true, Opcode: msg.Opcode, Authoritative: true}, Questions: msg.Questions}
+			packed, _ := ack.Pack()
+			conn.WriteToUDP(packed, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), received
+}
+
+func receiveNotify(t *testing.T, received <-chan *dnsmessage.Message) *dnsmessage.Message {
+	t.Helper()
+	select {
+	case msg := <-received:
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a NOTIFY")
+		return nil
+	}
+}
+
+func notifySerial(t *testing.T, msg *dnsmessage.Message) uint32 {
+	t.Helper()
+	if msg.Opcode != dnsmessage.OpcodeNotify || !msg.Authoritative || len(msg.Questions) != 1 || msg.Questions[0].Type != dnsmessage.TypeSOA {
+		t.Fatalf("Expected a NOTIFY for the SOA record, got %v", msg)
+	}
+	if len(msg.Answers) != 1 {
+		t.Fatalf("Expected the SOA record along, got %v", msg.Answers)
+	}
+	return msg.Answers[0].Data.(*dnsmessage.SOA).Serial
+}
+
+func TestNotifierRetries(t *testing.T) {
+	addr, received := startFakeSecondary(t, 2)
+	n, err := NewNotifier("example.com="+addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.timeout = 20 * time.Millisecond
+	defer n.Close()
+
+	n.notify("example.com", serialSOA(3))
+	for i := 0; i < 3; i++ {
+		if serial := notifySerial(t, receiveNotify(t, received)); serial != 3 {
+			t.Errorf("Expected serial 3, got %d", serial)
+		}
+	}
+	// The third attempt is acknowledged, nothing is sent after
+	select {
+	case msg := <-received:
+		t.Errorf("Expected no NOTIFY after the acknowledgement, got %v", msg)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestNotifierStopsWhenRefused(t *testing.T) {
+	var attempts atomic.Int32
+	addr := dnstest.StartUDPServer(t, func(query *dnsmessage.Message) *dnsmessage.Message {
+		attempts.Add(1)
+		return &dnsmessage.Message{Header: dnsmessage.Header{ID: query.ID, Response: true, Opcode: query.Opcode, RCode: dnsmessage.RCodeRefused}, Questions: query.Questions}
+	}).Addr
+	n, err := NewNotifier("example.com="+addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.timeout = 20 * time.Millisecond
+	defer n.Close()
+
+	n.notify("example.com", serialSOA(3))
+	time.Sleep(200 * time.Millisecond)
+	if got := attempts.Load(); got != 1 {
+		t.Errorf("Expected a refused NOTIFY not to be retried, got %d attempts", got)
+	}
+}
+
+func TestNotifierVerifiesSignedAcks(t *testing.T) {
+	keys := testKeys(t)
+	// The fake secondary acknowledges without signing
+	addr, received := startFakeSecondary(t, 0)
+	n, err := NewNotifier("example.com="+addr+"/test-key", keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.timeout = 20 * time.Millisecond
+	defer n.Close()
+
+	n.notify("example.com", serialSOA(3))
+	for i := 0; i < 2; i++ {
+		msg := receiveNotify(t, received)
+		if last := msg.Additionals[len(msg.Additionals)-1]; last.Type != dnsmessage.TypeTSIG {
+			t.Fatalf("Expected a signed NOTIFY, got %v", msg)
+		}
+	}
+
+	// A signed acknowledgement ends the retries
+	var attempts atomic.Int32
+	addr = dnstest.StartUDPServer(t, func(query *dnsmessage.Message) *dnsmessage.Message {
+		attempts.Add(1)
+		tsig := query.Additionals[len(query.Additionals)-1].Data.(*dnsmessage.TSIG)
+		ack := &dnsmessage.Message{Header: dnsmessage.Header{ID: query.ID, Response: true, Opcode: query.Opcode, Authoritative: true}, Questions: query.Questions}
+		(&signature{key: keys.key("test-key"), mac: tsig.MAC, now: time.Now()}).sign(ack)
+		return ack
+	}).Addr
+	signed, err := NewNotifier("example.com="+addr+"/test-key", keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed.timeout = 20 * time.Millisecond
+	defer signed.Close()
+	signed.notify("example.com", serialSOA(3))
+	time.Sleep(200 * time.Millisecond)
+	if got := attempts.Load(); got != 1 {
+		t.Errorf("Expected the signed acknowledgement to be taken, got %d attempts", got)
+	}
+}
+
+func TestNotifyOnUpdate(t *testing.T) {
+	addr, received := startFakeSecondary(t, 0)
+	s := newUpdateTestServer(t)
+	var err error
+	if s.Notifier, err = NewNotifier("home.lan="+addr, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Notifier.Close()
+	serial := zoneSerialOf(t, s.LocalData, "home.lan")
+
+	if resp := sendUpdate(s, "127.0.0.1:5000", "home.lan", nil, []dnsmessage.Resource{aRecord("nas2.home.lan", "192.168.1.30")}); resp.RCode != dnsmessage.RCodeSuccess {
+		t.Fatalf("Expected the update to succeed, got %v", resp)
+	}
+	msg := receiveNotify(t, received)
+	if got := notifySerial(t, msg); got != serial+1 {
+		t.Errorf("Expected the NOTIFY to carry serial %d, got %d", serial+1, got)
+	}
+	if canonicalName(msg.Questions[0].Name) != "home.lan" {
+		t.Errorf("Expected a NOTIFY for home.lan, got %s", msg.Questions[0].Name)
+	}
+}
+
+func TestReloadNotifiesChangedZones(t *testing.T) {
+	dir := t.TempDir()
+	addr, received := startFakeSecondary(t, 0)
+	zone := filepath.Join(dir, "home.lan.zone")
+	content := "$TTL 300\n@ IN SOA ns1 hostmaster 7 3600 600 86400 300\n@ IN NS ns1\nns1 IN A 192.168.1.2\nwww IN A 192.168.1.10\n"
+	os.WriteFile(zone, []byte(content), 0o644)
+	other := filepath.Join(dir, "other.lan.zone")
+	os.WriteFile(other, []byte(strings.ReplaceAll(content, "www", "mail")), 0o644)
+	resolver := "resolver = \"" + dnstest.StartUDPServer(t, answerA("192.0.2.1")).Addr + "\"\n"
+	path := writeConfig(t, dir, resolver+"zone = \"home.lan="+zone+",other.lan="+other+"\"\nnotify = \"home.lan="+addr+",other.lan="+addr+"\"\n")
+	args := []string{"-config", path}
+	opts, err := loadOptions(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := buildServer(opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Notifier.Close()
+	reload := reloader(server, args, opts)
+
+	// The zone changed without a new serial, the serial is bumped
+	os.WriteFile(zone, []byte(strings.ReplaceAll(content, "192.168.1.10", "192.168.1.11")), 0o644)
+	if err := reload(); err != nil {
+		t.Fatal(err)
+	}
+	msg := receiveNotify(t, received)
+	if got := notifySerial(t, msg); got != 8 || canonicalName(msg.Questions[0].Name) != "home.lan" {
+		t.Errorf("Expected a NOTIFY for home.lan serial 8, got %v", msg)
+	}
+	if got := zoneSerialOf(t, server.active().LocalData, "home.lan"); got != 8 {
+		t.Errorf("Expected the zone to be served with serial 8, got %d", got)
+	}
+	// The unchanged zone is not notified
+	select {
+	case msg := <-received:
+		t.Errorf("Expected no NOTIFY for the unchanged zone, got %v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := os.WriteFile(path, []byte(resolver+"zone = \"home.lan="+zone+"\"\nnotify = \"other.lan="+addr+"\"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reload(); err == nil || !strings.Contains(err.Error(), "not loaded from a zone file") {
+		t.Errorf("Expected notifying a zone not loaded to be rejected, got %v", err)
+	}
+}
+
+func TestNotifiedSecondaryTransfers(t *testing.T) {
+	primary := &Server{LocalData: newTestLocalData(t, false)}
+	var err error
+	if primary.Notifier, err = NewNotifier("home.lan=127.0.0.1:5300", nil); err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Notifier.Close()
+	if got := primary.untransferable(); len(got) != 1 {
+		t.Errorf("Expected the secondary to be reported as unable to transfer, got %v", got)
+	}
+	if primary.TransferACL, err = NewACL("transfer", "127.0.0.0/8", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := primary.untransferable(); len(got) != 0 {
+		t.Errorf("Expected the secondary to be allowed to transfer, got %v", got)
+	}
+
+	// The secondary transfers the zone from the primary it is notified by
+	secondaries, err := parseSecondaries("home.lan="+startTestServer(t, primary), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sec := secondaries[0]
+	if err := sec.transfer(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if resp := sec.answer(question("www.home.lan", dnsmessage.TypeA)); resp == nil || len(resp.Answers) != 1 {
+		t.Errorf("Expected the transferred zone to answer, got %v", resp)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/hex"
+	"strconv"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// nsidOption returns the NSID option identifying the server as id, sent to
+// clients asking for it with an empty one
+// (https://www.rfc-editor.org/rfc/rfc5001#section-2.3)
+func nsidOption(id string) dnsmessage.Option {
+	return dnsmessage.Option{Code: ednsOptionNSID, Data: []byte(id)}
+}
+
+// nsidOf returns the server identifier of the NSID option of resp, quoted
+// when it is printable and in hex otherwise, like dig shows it
+func nsidOf(resp *dnsmessage.Message) (string, bool) {
+	opt := optRecord(resp)
+	if opt == nil {
+		return "", false
+	}
+	data, _ := opt.Data.(*dnsmessage.OPT)
+	if data == nil {
+		return "", false
+	}
+	for _, o := range data.Options {
+		if o.Code != ednsOptionNSID || len(o.Data) == 0 {
+			continue
+		}
+		if id := string(o.Data); strconv.CanBackquote(id) {
+			return strconv.Quote(id), true
+		}
+		return hex.EncodeToString(o.Data), true
+	}
+	return "", false
+}
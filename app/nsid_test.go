@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+// nsidQuery returns a query for name asking for the NSID
+func nsidQuery(name string) *dnsmessage.Message {
+	query := testQuery(name)
+	opt := newOPT(ednsUDPSize, false)
+	opt.Data = &dnsmessage.OPT{Options: []dnsmessage.Option{nsidOption("")}}
+	query.Additionals = []dnsmessage.Resource{opt}
+	return query
+}
+
+func TestServerAnswersNSID(t *testing.T) {
+	s := newTestServer(t, dnstest.StartUDPServer(t, answerA("192.0.2.1")).Addr)
+	s.NSID = "ams-1"
+
+	if id, ok := nsidOf(handle(s, nsidQuery("www.example.com"))); !ok || id != `"ams-1"` {
+		t.Errorf("Expected the NSID of the server, got %q", id)
+	}
+	if _, ok := nsidOf(handle(s, testQuery("www.example.com"))); ok {
+		t.Error("Expected no NSID for a query not asking for it")
+	}
+	var err error
+	if s.EDNSPolicy, err = NewEDNSPolicy("nsid=strip"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := nsidOf(handle(s, nsidQuery("www.example.com"))); ok {
+		t.Error("Expected no NSID when the option is stripped")
+	}
+}
+
+func TestServerAsksUpstreamsForNSID(t *testing.T) {
+	var asked atomic.Bool
+	upstream := dnstest.StartUDPServer(t, func(query *dnsmessage.Message) *dnsmessage.Message {
+		resp := answerA("192.0.2.1")(query)
+		if hasOption(query, ednsOptionNSID) {
+			asked.Store(true)
+			opt := newOPT(ednsUDPSize, false)
+			opt.Data = &dnsmessage.OPT{Options: []dnsmessage.Option{{Code: ednsOptionNSID, Data: []byte{0xca, 0xfe}}}}
+			resp.Additionals = append(resp.Additionals, opt)
+		}
+		return resp
+	}).Addr
+	s := newTestServer(t, upstream)
+	s.UpstreamNSID = true
+
+	ctx, p := withProvenance(context.Background())
+	resp, err := s.lookup(ctx, question("www.example.com", dnsmessage.TypeA), true, s.upstreamOptions(testClient.Addr(), testQuery("www.example.com")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !asked.Load() {
+		t.Fatal("Expected the upstream to be asked for its NSID")
+	}
+	if got := p.Source(&resp.Answers[0]); got != "upstream "+upstream+" nsid cafe" {
+		t.Errorf("Expected the NSID of the upstream with the source, got %q", got)
+	}
+}
+
+func TestRunQueryShowsNSID(t *testing.T) {
+	s := newTestServer(t, dnstest.StartUDPServer(t, answerA("192.0.2.1")).Addr)
+	s.NSID = "ams-1"
+	server := startTestServer(t, s)
+
+	var out bytes.Buffer
+	if err := runQuery([]string{"www.example.com", "@" + server, "+nsid"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `;; NSID: "ams-1"`) {
+		t.Errorf("Expected the NSID in the output:\n%s", out.String())
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// nxRedirectTTL is kept short so clients notice quickly once a typo'd name starts to exist
+const nxRedirectTTL = 30
+
+// NXRedirect answers NXDOMAIN address queries of selected clients with a
+// landing page address instead. This breaks the semantics of DNS for those
+// clients, so it only applies to explicitly listed client networks and never
+// to names under the excluded domains.
+type NXRedirect struct {
+	IPv4    netip.Addr
+	IPv6    netip.Addr
+	Clients []netip.Prefix
+	Exclude []string
+}
+
+// NewNXRedirect creates a redirection from comma separated landing addresses,
+// client prefixes and excluded domains
+func NewNXRedirect(landing, clients, exclude string) (*NXRedirect, error) {
+	r := &NXRedirect{Exclude: splitList(exclude)}
+	for _, item := range splitList(landing) {
+		addr, err := netip.ParseAddr(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid landing address %q: %w", item, err)
+		}
+		if addr.Is4() {
+			r.IPv4 = addr
+		} else {
+			r.IPv6 = addr
+		}
+	}
+	if !r.IPv4.IsValid() && !r.IPv6.IsValid() {
+		return nil, errors.New("no landing address given")
+	}
+
+	var err error
+	if r.Clients, err = parsePrefixes(clients); err != nil {
+		return nil, err
+	}
+	// Refuse the tempting default of redirecting everybody
+	if len(r.Clients) == 0 {
+		return nil, errors.New("NXDOMAIN redirection requires an explicit list of client networks")
+	}
+	log.Printf("WARNING: NXDOMAIN redirection to %s is enabled for clients %v, nonexistent names will resolve for them", landing, r.Clients)
+	return r, nil
+}
+
+// applies reports whether the answer resp to question should be redirected for client
+func (r *NXRedirect) applies(client netip.Addr, question dnsmessage.Question, resp *dnsmessage.Message) bool {
+	if r == nil || resp.RCode != dnsmessage.RCodeNameError || question.Class != dnsmessage.ClassINET {
+		return false
+	}
+	switch question.Type {
+	case dnsmessage.TypeA:
+		if !r.IPv4.IsValid() {
+			return false
+		}
+	case dnsmessage.TypeAAAA:
+		if !r.IPv6.IsValid() {
+			return false
+		}
+	default:
+		return false
+	}
+	return prefixesContain(r.Clients, client) && !inAnyDomain(question.Name, r.Exclude)
+}
+
+// answer synthesizes the landing address answer for question
+func (r *NXRedirect) answer(question dnsmessage.Question) *dnsmessage.Message {
+	record := dnsmessage.Resource{Name: question.Name, Type: question.Type, Class: question.Class, TTL: nxRedirectTTL}
+	if question.Type == dnsmessage.TypeA {
+		record.Data = &dnsmessage.A{Addr: r.IPv4}
+	} else {
+		record.Data = &dnsmessage.AAAA{Addr: r.IPv6}
+	}
+	return &dnsmessage.Message{
+		Header:  dnsmessage.Header{Response: true},
+		Answers: []dnsmessage.Resource{record},
+	}
+}
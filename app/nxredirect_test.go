@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+func TestNXRedirect(t *testing.T) {
+	upstream := dnstest.StartUDPServer(t, func(q *dnsmessage.Message) *dnsmessage.Message {
+		return &dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: q.ID, Response: true, RCode: dnsmessage.RCodeNameError},
+			Questions: q.Questions,
+		}
+	}).Addr
+	s := newTestServer(t, upstream)
+	var err error
+	if s.NXRedirect, err = NewNXRedirect("192.0.2.80", "192.168.1.0/24", "corp.example"); err != nil {
+		t.Fatal(err)
+	}
+
+	ask := func(client, name string, qtype dnsmessage.Type) *dnsmessage.Message {
+		query := &dnsmessage.Message{Questions: []dnsmessage.Question{question(name, qtype)}}
+		return s.Handle(context.Background(), &QueryContext{Client: netip.MustParseAddrPort(client), Transport: "udp", Query: query})
+	}
+
+	resp := ask("192.168.1.20:5000", "typo.example.com", dnsmessage.TypeA)
+	if resp.RCode != dnsmessage.RCodeSuccess || len(resp.Answers) != 1 || resp.Answers[0].Data.String() != "192.0.2.80" {
+		t.Errorf("Expected redirection to the landing address, got %s", resp)
+	}
+
+	for name, resp := range map[string]*dnsmessage.Message{
+		"other client":    ask("10.0.0.1:5000", "typo.example.com", dnsmessage.TypeA),
+		"excluded domain": ask("192.168.1.20:5000", "host.corp.example", dnsmessage.TypeA),
+		"no IPv6 landing": ask("192.168.1.20:5000", "typo.example.com", dnsmessage.TypeAAAA),
+		"non-address":     ask("192.168.1.20:5000", "typo.example.com", dnsmessage.TypeMX),
+	} {
+		if resp.RCode != dnsmessage.RCodeNameError {
+			t.Errorf("%s: expected NXDOMAIN to pass through, got %s", name, resp)
+		}
+	}
+}
+
+func TestNXRedirectRequiresClients(t *testing.T) {
+	if _, err := NewNXRedirect("192.0.2.80", "", ""); err == nil {
+		t.Error("Expected redirection without client networks to be rejected")
+	}
+	if _, err := NewNXRedirect("", "0.0.0.0/0", ""); err == nil {
+		t.Error("Expected redirection without landing address to be rejected")
+	}
+}
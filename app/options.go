@@ -0,0 +1,634 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// options are the settings of the server, from the command line and the config file
+type options struct {
+	Version            bool
+	Config             string
+	Listen             string
+	Resolver           string
+	Iterate            bool
+	QNAMEMinimization  bool
+	RootPolicy         string
+	AnyPolicy          string
+	ChaosVersion       string
+	ChaosHostname      string
+	ChaosID            string
+	NSID               string
+	UpstreamNSID       bool
+	LogPackets         bool
+	CacheSize          int
+	CachePolicy        string
+	CacheMemory        int
+	CacheSweep         time.Duration
+	CacheSnapshot      string
+	SnapshotInterval   time.Duration
+	Search             string
+	NDots              int
+	NXRedirect         string
+	NXRedirectClients  string
+	NXRedirectExclude  string
+	DNS64              bool
+	DNS64Prefix        string
+	CaptivePortal      string
+	CaptiveAllow       string
+	Routes             string
+	UpstreamTimeout    time.Duration
+	QueryTimeout       time.Duration
+	UpstreamAttempts   int
+	UpstreamFallback   bool
+	UpstreamBootstrap  string
+	UpstreamQPS        string
+	UpstreamBandwidth  string
+	ServeStale         time.Duration
+	PrefetchHits       int
+	MaintenanceRCode   string
+	MaintenanceMaxTTL  time.Duration
+	TrustAnchors       string
+	SignZones          string
+	EDNSOptions        string
+	ECSPrefix          string
+	Cookies            bool
+	CookieSecret       string
+	RequireCookies     string
+	NSEC3              bool
+	Zones              string
+	Hosts              string
+	Secondaries        string
+	Notify             string
+	AutoReverse        bool
+	ClasslessReverse   string
+	Rotate             bool
+	Weights            string
+	LocalArpa          bool
+	LocalArpaDelegated string
+	RRLQPS             float64
+	RRLBurst           float64
+	RRLSlip            int
+	RRLIPv4Prefix      int
+	RRLIPv6Prefix      int
+	StormThreshold     float64
+	StormRRLQPS        float64
+	Mirror             string
+	MirrorSample       float64
+	Delays             string
+	AllowQuery         string
+	AllowRecursion     string
+	AllowUpdate        string
+	UpdateKeys         string
+	AllowTransfer      string
+	TransferKeys       string
+	TSIGKeys           string
+	PersistUpdates     bool
+	Blocklists         string
+	BlockPage          string
+	FirewallStats      string
+	StateDump          string
+	MaxLifetime        time.Duration
+	TCPIdleTimeout     time.Duration
+	TCPReadTimeout     time.Duration
+	TCPMaxConnections  int
+	TCPPipeline        int
+	UDPSize            int
+	StatsRetention     time.Duration
+	Admin              string
+	MDNS               bool
+	MDNSNames          string
+	// Views holds the settings of the [view.<name>] tables of the config
+	// file by view name, see View
+	Views map[string]map[string]string
+}
+
+// newFlagSet defines the command line flags, which are also the keys of the config file
+func newFlagSet(o *options) *flag.FlagSet {
+	fs := flag.NewFlagSet("dns-server", flag.ContinueOnError)
+	fs.BoolVar(&o.Version, "version", false, "Print the version and exit")
+	fs.StringVar(&o.Config, "config", "", "Config file setting any of these flags, flags given on the command line take precedence, and split-horizon views in [view.<name>] tables setting the clients, zone, hosts, blocklist, route and resolver of the view. It is re-read on SIGHUP")
+	fs.StringVar(&o.Listen, "listen", "127.0.0.1:2053", "Address to serve DNS on, UDP and TCP, [::]:53 takes IPv4 and IPv6 clients")
+	fs.StringVar(&o.Resolver, "resolver", "", "Comma separated addresses of the DNS resolvers to forward queries to in form <ip>:<port>, tls://<host>[:<port>][#<server name>] for DNS over TLS or an https:// URL for DNS over HTTPS")
+	fs.BoolVar(&o.Iterate, "iterate", false, "Resolve queries from the root servers down instead of forwarding them to -resolver, queries matching a -route are still forwarded")
+	fs.BoolVar(&o.QNAMEMinimization, "qname-minimization", true, "Only reveal the next label of the query name to each zone with -iterate (RFC 9156), servers mishandling that are asked for the full name")
+	fs.StringVar(&o.RootPolicy, "root-policy", string(RootForward), "How to answer queries for the root zone: forward, hints or refuse")
+	fs.StringVar(&o.AnyPolicy, "any-policy", string(AnyHINFO), "How to answer ANY queries over UDP: full, hinfo for a single HINFO record or rrset for one of the RRsets")
+	hostname, _ := os.Hostname()
+	fs.StringVar(&o.ChaosVersion, "chaos-version", version, "Answer to CHAOS TXT queries for version.bind and version.server, empty refuses them")
+	fs.StringVar(&o.ChaosHostname, "chaos-hostname", hostname, "Answer to CHAOS TXT queries for hostname.bind, empty refuses them")
+	fs.StringVar(&o.ChaosID, "chaos-id", hostname, "Answer to CHAOS TXT queries for id.server, empty refuses them")
+	fs.StringVar(&o.NSID, "nsid", "", "Server identifier returned in the NSID option (RFC 5001) to clients asking for it, telling apart the instances of an anycast address, empty returns none")
+	fs.BoolVar(&o.UpstreamNSID, "upstream-nsid", false, "Ask the upstreams for their NSID and log it with the answers they give, telling which instance answered")
+	fs.BoolVar(&o.LogPackets, "log-packets", false, "Log every query received with its packet and every reply sent, for debugging, this slows answering down")
+	fs.IntVar(&o.CacheSize, "cache-size", 10000, "Maximum number of cached responses, 0 disables the cache")
+	fs.StringVar(&o.CachePolicy, "cache-policy", "ttl", "Which cached response to evict when the cache is full and none has expired: ttl (the one expiring first), lru (least recently used) or lfu (least frequently used)")
+	fs.IntVar(&o.CacheMemory, "cache-memory", 0, "Estimated memory in MiB the cached responses may take, beyond it responses are evicted by the -cache-policy, 0 for no limit")
+	fs.DurationVar(&o.CacheSweep, "cache-sweep-interval", time.Minute, "How often expired responses are removed from the cache, 0 leaves them until they are asked for or evicted")
+	fs.StringVar(&o.CacheSnapshot, "cache-snapshot", "", "File the cache is saved to periodically and on shutdown and loaded from on startup, with the TTLs left, so restarts start with a warm cache")
+	fs.DurationVar(&o.SnapshotInterval, "cache-snapshot-interval", 5*time.Minute, "How often the cache is saved to the -cache-snapshot file")
+	fs.StringVar(&o.Search, "search", "", "Comma separated search domains used to expand short query names")
+	fs.IntVar(&o.NDots, "ndots", 1, "Names with fewer dots than this are expanded with the search domains")
+	fs.StringVar(&o.NXRedirect, "nxdomain-redirect", "", "Landing addresses (IPv4 and/or IPv6) NXDOMAIN answers are rewritten to, off by default")
+	fs.StringVar(&o.NXRedirectClients, "nxdomain-redirect-clients", "", "Comma separated client networks NXDOMAIN redirection applies to (required with -nxdomain-redirect)")
+	fs.StringVar(&o.NXRedirectExclude, "nxdomain-redirect-exclude", "", "Comma separated domains never redirected")
+	fs.BoolVar(&o.DNS64, "dns64", false, "Synthesize AAAA answers from the A records of names without IPv6 addresses (RFC 6147), for IPv6 only networks behind a NAT64 gateway")
+	fs.StringVar(&o.DNS64Prefix, "dns64-prefix", wellKnownNAT64Prefix.String(), "NAT64 prefix the IPv4 addresses are embedded in with -dns64, of length 32, 40, 48, 56, 64 or 96")
+	fs.StringVar(&o.CaptivePortal, "captive-portal", "", "Portal addresses (IPv4 and/or IPv6) every address query is answered with, enables captive portal mode")
+	fs.StringVar(&o.CaptiveAllow, "captive-allow", "", "Comma separated domains resolved normally in captive portal mode")
+	fs.StringVar(&o.Routes, "route", "", "Comma separated routes forwarding some queries to other upstreams in form [<domain>][/<type>[|<type>...]]=<ip>:<port>[+<ip>:<port>...], e.g. /TXT|ANY=9.9.9.9:53 or corp.example/PTR=10.0.0.53:53. The most specific domain wins, then routes with types")
+	fs.DurationVar(&o.UpstreamTimeout, "upstream-timeout", defaultUpstreamTimeout, "Timeout of a single upstream attempt")
+	fs.DurationVar(&o.QueryTimeout, "query-timeout", defaultQueryTimeout, "How long answering a query may take across all upstream attempts, after it the answer is SERVFAIL and the upstream work is abandoned, 0 for no limit")
+	fs.IntVar(&o.UpstreamAttempts, "upstream-attempts", defaultUpstreamAttempts, "Attempts per query across all upstreams before answering SERVFAIL")
+	fs.BoolVar(&o.UpstreamFallback, "upstream-fallback", false, "Send queries over plain DNS to port 53 of tls:// and https:// upstreams when the encrypted connection fails, false never sends them unencrypted")
+	fs.StringVar(&o.UpstreamBootstrap, "upstream-bootstrap", "", "Comma separated <ip>:<port> addresses of the DNS resolvers the host names of tls:// and https:// upstreams are looked up with, the system resolver when empty")
+	fs.StringVar(&o.UpstreamQPS, "upstream-qps", "", "Queries per second allowed per upstream, a default and/or <ip>:<port>=<qps> overrides, unlimited by default")
+	fs.StringVar(&o.UpstreamBandwidth, "upstream-bandwidth", "", "Bytes per second allowed per upstream, both directions, a default and/or <ip>:<port>=<bytes> overrides, unlimited by default")
+	fs.DurationVar(&o.ServeStale, "serve-stale", 0, "How long expired cache entries are kept to answer with while every upstream is over budget, 0 disables it")
+	fs.IntVar(&o.PrefetchHits, "prefetch-hits", 0, "Refresh cached answers asked for that many times from the upstreams when less than a tenth of their TTL is left, 0 disables prefetching")
+	fs.StringVar(&o.MaintenanceRCode, "maintenance-rcode", "", "RCODE every query is answered with in maintenance mode, switched on and off with SIGUSR2 or the admin API, empty answers queries as usual")
+	fs.DurationVar(&o.MaintenanceMaxTTL, "maintenance-max-ttl", 30*time.Second, "Maximum TTL of the answers in maintenance mode, 0 leaves them alone")
+	fs.StringVar(&o.TrustAnchors, "dnssec-trust-anchors", "", "Master file with the DS or DNSKEY records of the DNSSEC trust anchors, such as the root anchors published by IANA. Enables the validation of forwarded answers: validated ones get the AD bit, bogus ones are answered with SERVFAIL")
+	fs.StringVar(&o.SignZones, "dnssec-sign", "", "Comma separated zones loaded with -zone signed online for clients asking for DNSSEC records, in form <origin>=<key directory>. The keys are read from BIND style K<zone>+<alg>+<tag> files, an ECDSA P-256 KSK and ZSK are generated when there are none and the DS record for the parent zone is logged")
+	fs.BoolVar(&o.NSEC3, "dnssec-nsec3", false, "Prove denials in signed zones with NSEC3 records instead of NSEC")
+	fs.StringVar(&o.EDNSOptions, "edns-options", "", "Comma separated rules for the EDNS options of client queries in form <option>=<action>[|<action>...][@<network>[+<network>...]]. Options are nsid, ecs, cookie, padding, keepalive, an option code or unknown for the options without a name. Actions are honor (acted on where supported, the default), forward (passed on to upstreams), echo (copied into the reply) or strip (ignored). Rules with networks apply to those clients, the most specific network wins")
+	fs.StringVar(&o.ECSPrefix, "ecs-prefix", "", "Network sent upstream in an EDNS Client Subnet option with the queries of clients whose ECS option is honored, such as 192.0.2.0/24. With ecs=forward in -edns-options the subnet of the client is passed on instead, with ecs=strip none is sent")
+	fs.BoolVar(&o.Cookies, "cookies", false, "Answer DNS cookies (RFC 7873) with server cookies and send client cookies to the upstreams")
+	fs.StringVar(&o.CookieSecret, "cookie-secret", "", "Hex secret of at least 16 bytes the server cookies are generated with, random by default. Servers sharing an address need to share it")
+	fs.StringVar(&o.RequireCookies, "require-cookies", "", "Comma separated client networks whose UDP queries are only answered with a valid server cookie, the others get BADCOOKIE or a truncated answer to retry over TCP. Needs -cookies")
+	fs.StringVar(&o.Zones, "zone", "", "Comma separated zones served authoritatively from master files in form <origin>=<path>. The path may list several files and directories of *.zone files separated by '"+string(filepath.ListSeparator)+"', an RRset in a later file replaces the one of earlier files")
+	fs.StringVar(&o.Notify, "notify", "", "Comma separated secondary servers of the -zone zones in form <origin>=<ip>:<port>[/<key>], sent a NOTIFY whenever the zone changes on reload or dynamic update, signed with the -tsig-key key. They transfer the zone from this server, allow them with -allow-transfer or -transfer-key. A zone with several secondaries is listed once for each")
+	fs.StringVar(&o.Secondaries, "secondary", "", "Comma separated secondary zones transferred from their primary server in form <origin>=<ip>:<port>[/<key>], refreshed by the SOA timers and on NOTIFY, the transfers are signed with the -tsig-key key")
+	fs.StringVar(&o.Hosts, "hosts", "", "Comma separated hosts files whose names are answered locally")
+	fs.BoolVar(&o.AutoReverse, "auto-reverse", true, "Answer PTR queries for the addresses of the local A and AAAA records")
+	fs.StringVar(&o.ClasslessReverse, "classless-reverse", "", "Comma separated IPv4 blocks smaller than a /24 whose reverse zone is delegated with CNAMEs (RFC 2317), in form <prefix> for zones named like 0/26.2.0.192.in-addr.arpa or <prefix>=<label> for other names below the /24 zone. The zone is served, from -zone if it is loaded there, and the /24 reverse names of the block are answered with CNAMEs into it")
+	fs.BoolVar(&o.Rotate, "rotate", true, "Rotate the order of the A and AAAA records of every answer so clients spread over the addresses")
+	fs.StringVar(&o.Weights, "weights", "", "Comma separated address weights in form <name>/<address>=<weight>, addresses of the name are shuffled by weight instead of rotated")
+	fs.BoolVar(&o.LocalArpa, "local-arpa", true, "Answer reverse queries for private and special purpose address space locally (RFC 6303)")
+	fs.StringVar(&o.LocalArpaDelegated, "local-arpa-delegated", "", "Comma separated reverse zones that are served by a local resolver and forwarded anyway")
+	fs.Float64Var(&o.RRLQPS, "rrl-qps", 0, "UDP queries per second allowed per client network, 0 disables response rate limiting")
+	fs.Float64Var(&o.RRLBurst, "rrl-burst", 0, "Queries a client network may send in a burst, one second worth by default")
+	fs.IntVar(&o.RRLSlip, "rrl-slip", 2, "Answer every n-th rate limited query with a truncated response so real clients retry over TCP, 0 drops them all")
+	fs.IntVar(&o.RRLIPv4Prefix, "rrl-ipv4-prefix", 24, "Prefix length IPv4 clients are grouped by for rate limiting")
+	fs.IntVar(&o.RRLIPv6Prefix, "rrl-ipv6-prefix", 56, "Prefix length IPv6 clients are grouped by for rate limiting")
+	fs.Float64Var(&o.StormThreshold, "nxdomain-storm-threshold", 0, "NXDOMAIN answers per second for random names below a zone that make an NXDOMAIN storm, 0 disables detection")
+	fs.Float64Var(&o.StormRRLQPS, "nxdomain-storm-rrl-qps", 0, "UDP queries per second allowed per client network for zones under an NXDOMAIN storm, 0 only reports storms")
+	fs.StringVar(&o.Mirror, "mirror", "", "Address of a DNS server a sample of the queries is copied to in form <ip>:<port>, answers are discarded")
+	fs.Float64Var(&o.MirrorSample, "mirror-sample", 1, "Fraction of the queries copied to the -mirror server")
+	fs.StringVar(&o.Delays, "delay", "", "Testing aid: comma separated answer delays in form <domain>=<delay>[~<jitter>], e.g. slow.lab=2s or flaky.lab=100ms~400ms, the most specific domain applies")
+	fs.StringVar(&o.AllowQuery, "allow-query", "", "Comma separated client networks allowed to query, everybody by default")
+	fs.StringVar(&o.AllowRecursion, "allow-recursion", "", "Comma separated client networks allowed to get forwarded answers, everybody by default")
+	fs.StringVar(&o.AllowUpdate, "allow-update", "", "Comma separated client networks allowed to update the -zone zones dynamically (RFC 2136), nobody by default")
+	fs.StringVar(&o.UpdateKeys, "update-key", "", "Comma separated names of -tsig-key keys allowed to update the -zone zones dynamically from any client network")
+	fs.StringVar(&o.AllowTransfer, "allow-transfer", "", "Comma separated client networks allowed to transfer the -zone and -secondary zones with AXFR and IXFR over TCP, nobody by default")
+	fs.StringVar(&o.TransferKeys, "transfer-key", "", "Comma separated names of -tsig-key keys allowed to transfer the -zone and -secondary zones from any client network, the transfers are signed with them")
+	fs.StringVar(&o.TSIGKeys, "tsig-key", "", "Comma separated TSIG keys (RFC 8945) in form [<algorithm>:]<name>:<base64 secret> like dig -y, hmac-sha256 by default, better kept in the -config file. Queries signed with them get signed replies")
+	fs.BoolVar(&o.PersistUpdates, "persist-updates", false, "Write zones back to their zone files after dynamic updates, otherwise updates are lost on reload and restart")
+	fs.StringVar(&o.Blocklists, "blocklist", "", "Comma separated blocklist files, queries for listed domains and their subdomains get NXDOMAIN")
+	fs.StringVar(&o.BlockPage, "block-page", "", "URL explaining blocked names, sent along with blocked answers as TXT record and extended DNS error text")
+	fs.StringVar(&o.FirewallStats, "firewall-stats", "", "File the per rule firewall hit counters are persisted to")
+	fs.StringVar(&o.StateDump, "state-dump", "", "File a snapshot of the runtime state is appended to on SIGUSR1, the log by default")
+	fs.DurationVar(&o.MaxLifetime, "max-lifetime", 0, "Restart after running that long, handing the sockets over to the new process without dropping queries, 0 runs forever")
+	fs.DurationVar(&o.TCPIdleTimeout, "tcp-idle-timeout", defaultTCPIdleTimeout, "How long a TCP connection may wait for the next query before it is closed, announced to clients sending the edns-tcp-keepalive option")
+	fs.DurationVar(&o.TCPReadTimeout, "tcp-read-timeout", defaultTCPReadTimeout, "How long a client may take to send the rest of a query over TCP once it started")
+	fs.IntVar(&o.TCPMaxConnections, "tcp-max-connections", 1000, "Maximum number of open TCP connections, further ones are closed right away, 0 accepts any number")
+	fs.IntVar(&o.TCPPipeline, "tcp-pipeline", defaultTCPPipeline, "Queries of a TCP connection answered at the same time, their answers are sent as they are ready, 1 answers them in order")
+	fs.IntVar(&o.UDPSize, "udp-size", ednsUDPSize, "Largest response sent over UDP to clients advertising an EDNS buffer that large, larger ones are truncated and retried over TCP, clients without EDNS get 512 bytes")
+	fs.DurationVar(&o.StatsRetention, "stats-retention", 0, "How long queries count towards the top names, clients and domains of the admin API, 0 counts them since the start")
+	fs.StringVar(&o.Admin, "admin", "", "Address of the admin HTTP API, with the metrics on /debug/vars and the pprof profiles on /debug/pprof/, e.g. 127.0.0.1:8053, off by default")
+	fs.BoolVar(&o.MDNS, "mdns", false, "Answer multicast DNS queries (RFC 6762) on 224.0.0.251:5353 for the <hostname>.local name of this machine, its addresses and the -mdns-names")
+	fs.StringVar(&o.MDNSNames, "mdns-names", "", "Comma separated <name>=<address> names answered over multicast DNS with -mdns, .local is appended to names without it")
+	return fs
+}
+
+// loadOptions parses the command line arguments and the config file they name
+func loadOptions(args []string) (*options, error) {
+	o := &options{}
+	fs := newFlagSet(o)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if o.Config == "" {
+		return o, nil
+	}
+	values, err := loadConfigFile(o.Config)
+	if err != nil {
+		return nil, err
+	}
+	if o.Views, err = extractViews(values); err != nil {
+		return nil, fmt.Errorf("%s: %w", o.Config, err)
+	}
+	if err := applyConfig(fs, values); err != nil {
+		return nil, fmt.Errorf("%s: %w", o.Config, err)
+	}
+	return o, nil
+}
+
+// restartRequired lists the settings that differ between o and running but are
+// only applied on startup
+func (o *options) restartRequired(running *options) []string {
+	var changed []string
+	if o.Listen != running.Listen {
+		changed = append(changed, "listen")
+	}
+	if o.Admin != running.Admin {
+		changed = append(changed, "admin")
+	}
+	if o.FirewallStats != running.FirewallStats {
+		changed = append(changed, "firewall-stats")
+	}
+	if o.CacheSnapshot != running.CacheSnapshot || o.SnapshotInterval != running.SnapshotInterval {
+		changed = append(changed, "cache-snapshot")
+	}
+	if o.StateDump != running.StateDump {
+		changed = append(changed, "state-dump")
+	}
+	if o.MaxLifetime != running.MaxLifetime {
+		changed = append(changed, "max-lifetime")
+	}
+	if o.MDNS != running.MDNS || o.MDNSNames != running.MDNSNames {
+		changed = append(changed, "mdns")
+	}
+	return changed
+}
+
+// buildServer creates a server from the options. State worth keeping across a
+// reload is taken over from prev when it is not nil: the cache and the rate
+// limiter and the mirror when their settings are unchanged, upstream health,
+// rule, query and truncation counters, the Finalize hook and the runtime modes.
+func buildServer(o *options, prev *Server) (*Server, error) {
+	var forwarder *Forwarder
+	var iterator *Iterator
+	switch {
+	case o.Iterate && o.Resolver != "":
+		return nil, errors.New("-resolver and -iterate are mutually exclusive")
+	case o.Iterate:
+		forwarder = &Forwarder{}
+		iterator = NewIterator()
+		iterator.Timeout = o.UpstreamTimeout
+		iterator.Minimize = o.QNAMEMinimization
+	case o.Resolver == "":
+		return nil, errors.New("resolver address is required")
+	default:
+		var err error
+		if forwarder, err = NewForwarder(o.Resolver); err != nil {
+			return nil, fmt.Errorf("invalid resolver address: %w", err)
+		}
+	}
+	routes, err := parseRoutes(o.Routes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid route: %w", err)
+	}
+	qpsLimits, err := parseUpstreamLimits(o.UpstreamQPS)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream QPS: %w", err)
+	}
+	bandwidthLimits, err := parseUpstreamLimits(o.UpstreamBandwidth)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream bandwidth: %w", err)
+	}
+	policy, err := ParseRootPolicy(o.RootPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid root policy: %w", err)
+	}
+	anyPolicy, err := ParseAnyPolicy(o.AnyPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ANY policy: %w", err)
+	}
+
+	server := &Server{Forwarder: forwarder, Iterator: iterator, Routes: routes, RootPolicy: policy, AnyPolicy: anyPolicy}
+	server.Chaos = &Chaos{Version: o.ChaosVersion, Hostname: o.ChaosHostname, ID: o.ChaosID}
+	if len(o.NSID) > 65535 {
+		return nil, errors.New("invalid NSID: it can't be longer than 65535 bytes")
+	}
+	server.NSID, server.UpstreamNSID = o.NSID, o.UpstreamNSID
+	server.LogPackets = o.LogPackets
+	for _, f := range server.forwarders() {
+		f.Timeout = o.UpstreamTimeout
+		f.Attempts = o.UpstreamAttempts
+	}
+	bootstrap, err := newBootstrapResolver(o.UpstreamBootstrap)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream bootstrap: %w", err)
+	}
+	// The transports of the previous upstreams look their hosts up with the
+	// previous bootstrap resolvers
+	sameBootstrap := prev == nil || prev.options == nil || prev.options.UpstreamBootstrap == o.UpstreamBootstrap
+	for _, u := range server.shareUpstreams() {
+		u.Budget = NewBudget(qpsLimits.For(u.Addr), bandwidthLimits.For(u.Addr))
+		if o.Cookies {
+			u.Cookie = newUpstreamCookie()
+		}
+		if u.Encrypted != nil {
+			u.Encrypted.Resolver = bootstrap
+		}
+		if prev != nil {
+			if old := prev.upstream(u.Addr); old != nil {
+				u.Health = old.Health
+				if old.Encrypted != nil && sameBootstrap {
+					// Pooled connections and TLS sessions are kept
+					u.Encrypted = old.Encrypted
+				}
+				if o.Cookies && old.Cookie != nil {
+					u.Cookie = old.Cookie
+				}
+			}
+		}
+		if u.Encrypted != nil {
+			u.Encrypted.Fallback = o.UpstreamFallback
+		}
+	}
+	if o.Cookies {
+		require, err := parsePrefixes(o.RequireCookies)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cookie networks: %w", err)
+		}
+		if server.Cookies, err = NewCookies(o.CookieSecret, require); err != nil {
+			return nil, err
+		}
+		if o.CookieSecret == "" && prev != nil && prev.Cookies != nil {
+			// Cookies handed out before the reload stay valid
+			server.Cookies.secret = prev.Cookies.secret
+		}
+	} else if o.RequireCookies != "" {
+		return nil, errors.New("-require-cookies needs -cookies")
+	}
+	if o.TrustAnchors != "" {
+		anchors, err := loadTrustAnchors(o.TrustAnchors)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trust anchors: %w", err)
+		}
+		server.Validator = NewValidator(anchors, server.queryDNSSEC)
+	}
+	maintenance, err := ParseMaintenance(o.MaintenanceRCode, uint32(o.MaintenanceMaxTTL/time.Second))
+	if err != nil {
+		return nil, fmt.Errorf("invalid maintenance mode: %w", err)
+	}
+	if o.CacheSize > 0 {
+		// Answers cached before validation was turned on or off don't tell
+		// whether they were validated
+		policy, err := NewEvictionPolicy(o.CachePolicy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cache policy: %w", err)
+		}
+		if o.CacheMemory < 0 || o.CacheSweep < 0 {
+			return nil, errors.New("invalid cache: the memory and sweep interval can't be negative")
+		}
+		if prev != nil && prev.Cache != nil && prev.Cache.maxEntries == o.CacheSize && prev.Cache.MaxBytes == o.CacheMemory<<20 && prev.Cache.sweepEvery == o.CacheSweep && prev.Cache.StaleFor == o.ServeStale && prev.Cache.PrefetchHits == o.PrefetchHits && prev.Cache.Policy() == policy.Name() && (prev.Validator != nil) == (server.Validator != nil) {
+			server.Cache = prev.Cache
+		} else {
+			server.Cache = NewCacheWithPolicy(o.CacheSize, policy)
+			server.Cache.MaxBytes = o.CacheMemory << 20
+			server.Cache.StaleFor = o.ServeStale
+			server.Cache.PrefetchHits = o.PrefetchHits
+			server.Cache.Hooks = metricsHooks()
+		}
+	}
+	if o.NXRedirect != "" {
+		if server.NXRedirect, err = NewNXRedirect(o.NXRedirect, o.NXRedirectClients, o.NXRedirectExclude); err != nil {
+			return nil, fmt.Errorf("invalid NXDOMAIN redirection: %w", err)
+		}
+	}
+	if o.DNS64 {
+		if server.DNS64, err = NewDNS64(o.DNS64Prefix); err != nil {
+			return nil, fmt.Errorf("invalid DNS64 prefix: %w", err)
+		}
+	}
+	blocks, err := parseClasslessBlocks(o.ClasslessReverse)
+	if err != nil {
+		return nil, fmt.Errorf("invalid classless reverse zones: %w", err)
+	}
+	if o.Zones != "" || o.Hosts != "" || blocks != nil {
+		if server.LocalData, err = loadLocalData(o.Zones, o.Hosts, blocks, o.AutoReverse); err != nil {
+			return nil, fmt.Errorf("invalid local data: %w", err)
+		}
+	}
+	if o.EDNSOptions != "" {
+		if server.EDNSPolicy, err = NewEDNSPolicy(o.EDNSOptions); err != nil {
+			return nil, fmt.Errorf("invalid EDNS options: %w", err)
+		}
+	}
+	if o.ECSPrefix != "" {
+		if server.ECSPrefix, err = netip.ParsePrefix(o.ECSPrefix); err != nil {
+			return nil, fmt.Errorf("invalid ECS prefix: %w", err)
+		}
+		server.ECSPrefix = server.ECSPrefix.Masked()
+	}
+	if o.SignZones != "" {
+		if server.Signer, err = loadSigner(o.SignZones, server.LocalData, o.NSEC3); err != nil {
+			return nil, fmt.Errorf("invalid signed zones: %w", err)
+		}
+	}
+	if o.TSIGKeys != "" {
+		if server.TSIGKeys, err = NewTSIGKeys(o.TSIGKeys); err != nil {
+			return nil, fmt.Errorf("invalid TSIG keys: %w", err)
+		}
+	}
+	secondaries, err := parseSecondaries(o.Secondaries, server.TSIGKeys)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secondary zone: %w", err)
+	}
+	for _, sec := range secondaries {
+		if server.LocalData != nil && server.LocalData.zones[sec.Origin].Data != nil {
+			return nil, fmt.Errorf("invalid secondary zone: %s is also loaded from a zone file", sec.Origin)
+		}
+	}
+	if o.Notify != "" {
+		if prev != nil && prev.Notifier != nil && prev.Notifier.spec == o.Notify && prev.options != nil && prev.options.TSIGKeys == o.TSIGKeys {
+			server.Notifier = prev.Notifier
+		} else if server.Notifier, err = NewNotifier(o.Notify, server.TSIGKeys); err != nil {
+			return nil, fmt.Errorf("invalid notify: %w", err)
+		}
+		for zone := range server.Notifier.targets {
+			if _, ok := server.LocalData.soa(zone); !ok {
+				return nil, fmt.Errorf("invalid notify: %s is not loaded from a zone file", zone)
+			}
+		}
+	}
+	if prev != nil && server.LocalData != nil {
+		// Changes are notified once the server is swapped in, see reloader
+		server.changedZones = server.LocalData.changedZones(prev.LocalData)
+	}
+	if o.Rotate {
+		if server.Rotate, err = NewRotator(o.Weights); err != nil {
+			return nil, fmt.Errorf("invalid weights: %w", err)
+		}
+	}
+	if o.TCPIdleTimeout <= 0 || o.TCPReadTimeout <= 0 {
+		return nil, errors.New("invalid TCP timeouts: they must be positive")
+	}
+	if o.TCPMaxConnections < 0 || o.TCPPipeline < 1 {
+		return nil, errors.New("invalid TCP limits: -tcp-max-connections can't be negative and -tcp-pipeline must be at least 1")
+	}
+	server.TCP = TCPLimits{IdleTimeout: o.TCPIdleTimeout, ReadTimeout: o.TCPReadTimeout, MaxConnections: o.TCPMaxConnections, Pipeline: o.TCPPipeline}
+	if o.UDPSize < maxUDPSize || o.UDPSize > 65535 {
+		return nil, fmt.Errorf("invalid UDP size %d: it must be between %d and 65535", o.UDPSize, maxUDPSize)
+	}
+	server.UDPSize = uint16(o.UDPSize)
+	if o.QueryTimeout < 0 {
+		return nil, errors.New("invalid query timeout: it can't be negative")
+	}
+	server.QueryTimeout = o.QueryTimeout
+	if o.StatsRetention < 0 {
+		return nil, errors.New("invalid stats retention: it can't be negative")
+	}
+	if o.Delays != "" {
+		if server.Delays, err = NewDelays(o.Delays); err != nil {
+			return nil, fmt.Errorf("invalid delays: %w", err)
+		}
+	}
+	if o.LocalArpa {
+		server.LocalZones = NewLocalZones(o.LocalArpaDelegated)
+	}
+	if o.CaptivePortal != "" {
+		if server.Captive, err = NewCaptivePortal(o.CaptivePortal, o.CaptiveAllow); err != nil {
+			return nil, fmt.Errorf("invalid captive portal: %w", err)
+		}
+	}
+	if o.Search != "" {
+		if server.Search, err = NewSearchList(o.Search, o.NDots); err != nil {
+			return nil, fmt.Errorf("invalid search domains: %w", err)
+		}
+	}
+
+	if o.RRLQPS > 0 {
+		if server.RateLimit, err = NewRateLimiter(o.RRLQPS, o.RRLBurst, o.RRLSlip); err != nil {
+			return nil, fmt.Errorf("invalid rate limit: %w", err)
+		}
+		server.RateLimit.IPv4Prefix = o.RRLIPv4Prefix
+		server.RateLimit.IPv6Prefix = o.RRLIPv6Prefix
+		if prev != nil && prev.RateLimit.sameLimits(server.RateLimit) {
+			server.RateLimit = prev.RateLimit
+		}
+	}
+
+	if o.StormThreshold > 0 {
+		server.Storms = NewStormDetector(o.StormThreshold)
+		if o.StormRRLQPS > 0 {
+			if server.Storms.Limit, err = NewRateLimiter(o.StormRRLQPS, 0, o.RRLSlip); err != nil {
+				return nil, fmt.Errorf("invalid NXDOMAIN storm rate limit: %w", err)
+			}
+			server.Storms.Limit.IPv4Prefix = o.RRLIPv4Prefix
+			server.Storms.Limit.IPv6Prefix = o.RRLIPv6Prefix
+		}
+		if prev != nil && prev.Storms.sameSettings(server.Storms) {
+			server.Storms = prev.Storms
+		}
+	} else if o.StormRRLQPS > 0 {
+		return nil, errors.New("-nxdomain-storm-rrl-qps needs -nxdomain-storm-threshold")
+	}
+
+	stats := NewFirewallStats()
+	server.FirewallStats = stats
+	if o.AllowQuery != "" {
+		if server.QueryACL, err = NewACL("query", o.AllowQuery, stats); err != nil {
+			return nil, fmt.Errorf("invalid query ACL: %w", err)
+		}
+	}
+	if o.AllowRecursion != "" {
+		if server.RecursionACL, err = NewACL("recursion", o.AllowRecursion, stats); err != nil {
+			return nil, fmt.Errorf("invalid recursion ACL: %w", err)
+		}
+	}
+	if o.AllowUpdate != "" {
+		if server.UpdateACL, err = NewACL("update", o.AllowUpdate, stats); err != nil {
+			return nil, fmt.Errorf("invalid update ACL: %w", err)
+		}
+	}
+	for _, name := range splitList(o.UpdateKeys) {
+		if server.TSIGKeys.key(name) == nil {
+			return nil, fmt.Errorf("invalid update key: no -tsig-key named %q", name)
+		}
+		server.UpdateKeys = append(server.UpdateKeys, canonicalName(name))
+	}
+	if server.UpdateACL != nil || server.UpdateKeys != nil {
+		server.PersistUpdates = o.PersistUpdates
+	}
+	if o.AllowTransfer != "" {
+		if server.TransferACL, err = NewACL("transfer", o.AllowTransfer, stats); err != nil {
+			return nil, fmt.Errorf("invalid transfer ACL: %w", err)
+		}
+	}
+	for _, name := range splitList(o.TransferKeys) {
+		if server.TSIGKeys.key(name) == nil {
+			return nil, fmt.Errorf("invalid transfer key: no -tsig-key named %q", name)
+		}
+		server.TransferKeys = append(server.TransferKeys, canonicalName(name))
+	}
+	for _, t := range server.untransferable() {
+		log.Printf("WARNING: %s is notified of changes to %s but may not transfer the zone from here, allow it with -allow-transfer or -transfer-key", t.addr, dnsmessage.FQDN(t.zone))
+	}
+	if o.Blocklists != "" {
+		var lists []*Blocklist
+		for _, path := range splitList(o.Blocklists) {
+			l, err := LoadBlocklist(path)
+			if err != nil {
+				return nil, fmt.Errorf("invalid blocklist: %w", err)
+			}
+			log.Printf("Loaded %d rules from blocklist %s", l.Len(), l.Name)
+			lists = append(lists, l)
+		}
+		server.Firewall = NewFirewall(stats, lists...)
+		server.Firewall.BlockPage = o.BlockPage
+	}
+	if prev != nil && prev.FirewallStats != nil {
+		stats.merge(prev.FirewallStats.Snapshot())
+	}
+
+	if server.Views, err = buildViews(o, prev); err != nil {
+		return nil, fmt.Errorf("invalid view: %w", err)
+	}
+
+	// The mirror comes last, it holds a socket that would leak if a later setting was invalid
+	if o.Mirror != "" {
+		if prev != nil && prev.Mirror != nil && prev.Mirror.Addr == o.Mirror && prev.Mirror.Sample == o.MirrorSample {
+			server.Mirror = prev.Mirror
+		} else if server.Mirror, err = NewMirror(o.Mirror, o.MirrorSample); err != nil {
+			return nil, fmt.Errorf("invalid mirror: %w", err)
+		}
+	}
+	// The janitor of a new cache is started last as well
+	if server.Cache != nil && (prev == nil || server.Cache != prev.Cache) && o.CacheSweep > 0 {
+		server.Cache.startJanitor(o.CacheSweep)
+	}
+	// Secondaries are started last as well, they transfer in the background
+	for _, sec := range secondaries {
+		if old := prev.secondary(sec.Origin); old != nil && old.Primary == sec.Primary && old.Key.equal(sec.Key) {
+			sec = old
+		} else {
+			sec.start()
+		}
+		server.Secondaries = append(server.Secondaries, sec)
+	}
+	// The runtime modes are switched at runtime, not by options
+	server.Modes = &Modes{}
+	server.QueryStats = NewQueryStats(o.StatsRetention)
+	server.Truncation = NewTruncationStats()
+	if prev != nil {
+		// Hooks are set by embedders, not by options
+		server.Finalize = prev.Finalize
+		if prev.Modes != nil {
+			server.Modes = prev.Modes
+		}
+		if prev.QueryStats != nil && prev.QueryStats.retention == o.StatsRetention {
+			server.QueryStats = prev.QueryStats
+		}
+		if prev.Truncation != nil {
+			server.Truncation = prev.Truncation
+		}
+	}
+	server.Modes.setDefaults(maintenance)
+	for _, v := range server.Views {
+		v.Server.Modes, v.Server.Secondaries = server.Modes, server.Secondaries
+	}
+	server.options = o
+	return server, nil
+}
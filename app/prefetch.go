@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+const (
+	// prefetchFraction is the part of its TTL an entry has left when it is
+	// refreshed, as in Unbound
+	prefetchFraction = 0.1
+	// prefetchTimeout bounds a refresh, nobody is waiting for it
+	prefetchTimeout = 10 * time.Second
+)
+
+// prefetchDue reports whether the entry answering q for every client has been
+// answered PrefetchHits times and has less than prefetchFraction of its TTL
+// left, so popular names are refreshed before clients have to wait for the
+// upstreams. It reports each entry once, the refresh replaces it.
+func (c *Cache) prefetchDue(q dnsmessage.Question) bool {
+	if c.PrefetchHits <= 0 {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[cacheKeyOf(q)]
+	if !ok || entry.Prefetching || entry.Hits < c.PrefetchHits {
+		return false
+	}
+	ttl := entry.Expires.Sub(entry.Stored)
+	left := entry.Expires.Sub(c.now())
+	if left <= 0 || float64(left) >= prefetchFraction*float64(ttl) {
+		return false
+	}
+	entry.Prefetching = true
+	return true
+}
+
+// prefetch refreshes the cached answer to question in the background
+func (s *Server) prefetch(question dnsmessage.Question, recursionDesired bool, options []dnsmessage.Option) {
+	defer s.recoverQuery(&QueryContext{Transport: "prefetch", Query: &dnsmessage.Message{Questions: []dnsmessage.Question{question}}}, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), prefetchTimeout)
+	defer cancel()
+	cacheMetrics.Add("prefetches", 1)
+	if _, _, err := s.fetch(ctx, question, recursionDesired, options, clientSubnet{}); err != nil {
+		cacheMetrics.Add("prefetch_failures", 1)
+		log.Printf("Failed to prefetch %s: %v", question, err)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+func TestServerPrefetchesPopularEntries(t *testing.T) {
+	var asked atomic.Int32
+	upstream := dnstest.StartUDPServer(t, func(q *dnsmessage.Message) *dnsmessage.Message {
+		asked.Add(1)
+		return answerA("192.0.2.1")(q)
+	}).Addr
+	s := newTestServer(t, upstream)
+	var clock *fakeClock
+	s.Cache, clock = newTestCache(10)
+	s.Cache.PrefetchHits = 2
+
+	handle(s, testQuery("hot.example"))
+	handle(s, testQuery("cold.example"))
+	clock.Advance(55 * time.Second)
+	handle(s, testQuery("cold.example"))
+	handle(s, testQuery("hot.example"))
+	if asked.Load() != 2 {
+		t.Fatalf("Expected no prefetch before enough hits, the upstream was asked %d times", asked.Load())
+	}
+	if resp := handle(s, testQuery("hot.example")); resp.Answers[0].TTL != 5 {
+		t.Errorf("Expected the cached answer while prefetching, got %s", resp)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for asked.Load() < 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if asked.Load() != 3 {
+		t.Fatalf("Expected the hot entry to be prefetched once, the upstream was asked %d times", asked.Load())
+	}
+	for time.Now().Before(deadline) {
+		if resp, ok := s.Cache.Get(question("hot.example", dnsmessage.TypeA)); ok && resp.Answers[0].TTL == 60 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if resp, ok := s.Cache.Get(question("hot.example", dnsmessage.TypeA)); !ok || resp.Answers[0].TTL != 60 {
+		t.Errorf("Expected the prefetched answer to replace the entry, got %v", resp)
+	}
+	if _, ok := s.Cache.Get(question("cold.example", dnsmessage.TypeA)); !ok {
+		t.Error("Expected the cold entry to stay cached")
+	}
+}
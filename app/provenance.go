@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// Provenance records where the RRsets of the answer to a query came from, such
+// as "zone file home.lan.zone:12" or "upstream 9.9.9.9:53", so the logs tell
+// for every answered record which backend produced it
+type Provenance struct {
+	mu      sync.Mutex
+	sources map[rrsetKey]string
+	// last is the source noted last for a whole message
+	last string
+}
+
+type provenanceKey struct{}
+
+// withProvenance returns a context recording the provenance of the answers
+// produced under it
+func withProvenance(ctx context.Context) (context.Context, *Provenance) {
+	p := &Provenance{sources: make(map[rrsetKey]string)}
+	return context.WithValue(ctx, provenanceKey{}, p), p
+}
+
+// provenanceOf returns the provenance recorded by ctx, nil when it records none
+func provenanceOf(ctx context.Context) *Provenance {
+	p, _ := ctx.Value(provenanceKey{}).(*Provenance)
+	return p
+}
+
+// note records source for the RRsets of m that don't have one yet, the first
+// stage handing out an RRset is where it came from
+func (p *Provenance) note(source string, m *dnsmessage.Message) {
+	if p == nil || m == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.last = source
+	for _, section := range [][]dnsmessage.Resource{m.Answers, m.Authorities, m.Additionals} {
+		for i := range section {
+			if section[i].Type == dnsmessage.TypeOPT {
+				continue
+			}
+			if key := keyOf(&section[i]); p.sources[key] == "" {
+				p.sources[key] = source
+			}
+		}
+	}
+}
+
+// noteRRsets records the source each RRset of m has according to sourceOf,
+// falling back to fallback for those it doesn't know
+func (p *Provenance) noteRRsets(m *dnsmessage.Message, fallback string, sourceOf func(*dnsmessage.Resource) string) {
+	if p == nil || m == nil {
+		return
+	}
+	p.mu.Lock()
+	for _, section := range [][]dnsmessage.Resource{m.Answers, m.Authorities, m.Additionals} {
+		for i := range section {
+			key := keyOf(&section[i])
+			if p.sources[key] != "" {
+				continue
+			}
+			if source := sourceOf(&section[i]); source != "" {
+				p.sources[key] = source
+			}
+		}
+	}
+	p.mu.Unlock()
+	p.note(fallback, m)
+}
+
+// Last returns the source noted last for a whole message
+func (p *Provenance) Last() string {
+	if p == nil {
+		return ""
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.last
+}
+
+// Source returns where the RRset of rr came from, empty when it is unknown
+func (p *Provenance) Source(rr *dnsmessage.Resource) string {
+	if p == nil {
+		return ""
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.sources[keyOf(rr)]
+}
+
+// Lines describes the source of every RRset of reply, one line each in the
+// order of the sections. Internationalized names are shown in Unicode.
+func (p *Provenance) Lines(reply *dnsmessage.Message) []string {
+	var lines []string
+	seen := make(map[rrsetKey]bool)
+	for _, section := range [][]dnsmessage.Resource{reply.Answers, reply.Authorities, reply.Additionals} {
+		for i := range section {
+			key := keyOf(&section[i])
+			if section[i].Type == dnsmessage.TypeOPT || seen[key] {
+				continue
+			}
+			seen[key] = true
+			source := p.Source(&section[i])
+			if source == "" {
+				source = "unknown"
+			}
+			lines = append(lines, fmt.Sprintf("%s %s: %s", dnsmessage.UnicodeName(dnsmessage.FQDN(section[i].Name)), section[i].Type, source))
+		}
+	}
+	return lines
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+func TestProvenance(t *testing.T) {
+	upstream := dnstest.StartUDPServer(t, answerA("192.0.2.1")).Addr
+	s := newTestServer(t, upstream)
+	s.Cache = NewCache(100)
+	s.LocalData = newTestLocalData(t, true)
+
+	tests := []struct {
+		name  string
+		qtype dnsmessage.Type
+		want  string
+	}{
+		{"www.home.lan", dnsmessage.TypeAAAA, "zone file "},
+		{"printer.home.lan", dnsmessage.TypeA, "hosts file "},
+		{"10.1.168.192.in-addr.arpa", dnsmessage.TypePTR, "reverse of www.home.lan."},
+		{"www.example", dnsmessage.TypeA, "upstream " + upstream},
+		{"www.example", dnsmessage.TypeA, "cache, from upstream " + upstream},
+	}
+	for _, tt := range tests {
+		ctx, p := withProvenance(context.Background())
+		q := question(tt.name, tt.qtype)
+		resp := s.answerLocally(ctx, q)
+		if resp == nil {
+			var err error
+			if resp, err = s.lookup(ctx, q, true, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(resp.Answers) == 0 {
+			t.Fatalf("%s: expected an answer, got %+v", tt.name, resp)
+		}
+		if got := p.Source(&resp.Answers[0]); !strings.HasPrefix(got, tt.want) {
+			t.Errorf("%s %s: expected the source %q, got %q", tt.name, tt.qtype, tt.want, got)
+		}
+	}
+
+	// Zone file records name the line of their entry
+	ctx, p := withProvenance(context.Background())
+	resp := s.answerLocally(ctx, question("www.home.lan", dnsmessage.TypeAAAA))
+	if got := p.Source(&resp.Answers[0]); !strings.HasSuffix(got, "home.lan.zone:8") {
+		t.Errorf("Expected the source of the AAAA record to be line 8, got %q", got)
+	}
+	if lines := p.Lines(resp); len(lines) != 1 || !strings.HasPrefix(lines[0], "www.home.lan. AAAA: zone file ") {
+		t.Errorf("Unexpected provenance lines %q", lines)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+const defaultQueryServer = "127.0.0.1:2053"
+
+// queryOptions are the arguments of the query subcommand
+type queryOptions struct {
+	Name      string
+	Type      dnsmessage.Type
+	Class     dnsmessage.Class
+	Server    string
+	TCP       bool
+	Recursion bool
+	Short     bool
+	NSID      bool
+	Timeout   time.Duration
+}
+
+// parseQueryArgs parses dig-like arguments: name, type and class in any order,
+// @server for the server to ask and +option toggles
+func parseQueryArgs(args []string) (*queryOptions, error) {
+	opts := &queryOptions{
+		Type:      dnsmessage.TypeA,
+		Class:     dnsmessage.ClassINET,
+		Server:    defaultQueryServer,
+		Recursion: true,
+		Timeout:   5 * time.Second,
+	}
+
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "@"):
+			opts.Server = serverAddr(strings.TrimPrefix(arg, "@"))
+		case strings.HasPrefix(arg, "+"):
+			option, value, _ := strings.Cut(strings.TrimPrefix(arg, "+"), "=")
+			switch option {
+			case "tcp", "vc":
+				opts.TCP = true
+			case "notcp", "novc":
+				opts.TCP = false
+			case "rec", "recurse":
+				opts.Recursion = true
+			case "norec", "norecurse":
+				opts.Recursion = false
+			case "short":
+				opts.Short = true
+			case "nsid":
+				opts.NSID = true
+			case "nonsid":
+				opts.NSID = false
+			case "timeout", "time":
+				seconds, err := strconv.Atoi(value)
+				if err != nil || seconds <= 0 {
+					return nil, fmt.Errorf("invalid timeout %q", value)
+				}
+				opts.Timeout = time.Duration(seconds) * time.Second
+			default:
+				return nil, fmt.Errorf("unknown option %q", arg)
+			}
+		default:
+			upper := strings.ToUpper(arg)
+			t, typeErr := dnsmessage.ParseType(upper)
+			switch {
+			case opts.Name == "":
+				opts.Name = arg
+			case upper == "IN":
+				opts.Class = dnsmessage.ClassINET
+			case upper == "CH":
+				opts.Class = dnsmessage.ClassCHAOS
+			case typeErr == nil:
+				opts.Type = t
+			default:
+				return nil, fmt.Errorf("unexpected argument %q", arg)
+			}
+		}
+	}
+
+	if opts.Name == "" {
+		return nil, fmt.Errorf("usage: query <name> [type] [class] [@server[:port]] [+tcp] [+norec] [+short] [+nsid] [+timeout=<seconds>]")
+	}
+	return opts, nil
+}
+
+// serverAddr adds the DNS port to a server address given without one
+func serverAddr(server string) string {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		return net.JoinHostPort(strings.Trim(server, "[]"), "53")
+	}
+	return server
+}
+
+// sendQuery builds the query described by opts and exchanges it with the server,
+// retrying over TCP when the UDP response comes back truncated
+func sendQuery(opts *queryOptions) (*dnsmessage.Message, string, error) {
+	query := &dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               newQueryID(),
+			Opcode:           dnsmessage.OpcodeQuery,
+			RecursionDesired: opts.Recursion,
+		},
+		Questions: []dnsmessage.Question{{Name: opts.Name, Type: opts.Type, Class: opts.Class}},
+	}
+	if opts.NSID {
+		opt := newOPT(ednsUDPSize, false)
+		opt.Data = &dnsmessage.OPT{Options: []dnsmessage.Option{nsidOption("")}}
+		query.Additionals = []dnsmessage.Resource{opt}
+	}
+
+	network := "udp"
+	if opts.TCP {
+		network = "tcp"
+	}
+	for {
+		conn, err := net.DialTimeout(network, opts.Server, opts.Timeout)
+		if err != nil {
+			return nil, network, err
+		}
+		conn.SetDeadline(time.Now().Add(opts.Timeout))
+		resp, _, err := exchangeConn(conn, query)
+		conn.Close()
+		if err != nil {
+			return nil, network, err
+		}
+		if resp.Truncated && network == "udp" {
+			network = "tcp"
+			continue
+		}
+		return resp, network, nil
+	}
+}
+
+// runQuery implements the query subcommand
+func runQuery(args []string, out io.Writer) error {
+	opts, err := parseQueryArgs(args)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	resp, network, err := sendQuery(opts)
+	if err != nil {
+		return fmt.Errorf(";; communications error to %s: %w", opts.Server, err)
+	}
+	elapsed := time.Since(start)
+
+	if opts.Short {
+		for _, answer := range resp.Answers {
+			fmt.Fprintln(out, answer.Data.String())
+		}
+		return nil
+	}
+
+	size := 0
+	if packed, err := resp.Pack(); err == nil {
+		size = len(packed)
+	}
+	fmt.Fprint(out, resp.String())
+	if nsid, ok := nsidOf(resp); ok {
+		fmt.Fprintf(out, "\n;; NSID: %s", nsid)
+	}
+	fmt.Fprintf(out, "\n;; Query time: %d msec\n", elapsed.Milliseconds())
+	fmt.Fprintf(out, ";; SERVER: %s (%s)\n", opts.Server, network)
+	fmt.Fprintf(out, ";; WHEN: %s\n", start.Format(time.RFC1123))
+	fmt.Fprintf(out, ";; MSG SIZE  rcvd: %d\n", size)
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+func TestParseQueryArgs(t *testing.T) {
+	opts, err := parseQueryArgs([]string{"example.com", "AAAA", "@192.0.2.53", "+tcp", "+norec", "+timeout=2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Name != "example.com" || opts.Type != dnsmessage.TypeAAAA || opts.Server != "192.0.2.53:53" {
+		t.Errorf("Unexpected options: %+v", opts)
+	}
+	if !opts.TCP || opts.Recursion || opts.Timeout.Seconds() != 2 {
+		t.Errorf("Unexpected toggles: %+v", opts)
+	}
+
+	opts, err = parseQueryArgs([]string{"version.bind", "TXT", "CH", "@[::1]:5353"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Class != dnsmessage.ClassCHAOS || opts.Type != dnsmessage.TypeTXT || opts.Server != "[::1]:5353" {
+		t.Errorf("Unexpected options: %+v", opts)
+	}
+
+	for _, args := range [][]string{{}, {"example.com", "+bogus"}, {"example.com", "A", "extra"}} {
+		if _, err := parseQueryArgs(args); err == nil {
+			t.Errorf("Expected %v to be rejected", args)
+		}
+	}
+}
+
+func TestRunQuery(t *testing.T) {
+	server := dnstest.StartUDPServer(t, answerA("192.0.2.7")).Addr
+
+	var out bytes.Buffer
+	if err := runQuery([]string{"example.com", "@" + server}, &out); err != nil {
+		t.Fatalf("runQuery failed: %v", err)
+	}
+	for _, want := range []string{"status: NOERROR", ";; ANSWER SECTION:", "example.com.\t60\tIN\tA\t192.0.2.7", "(udp)"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Output is missing %q:\n%s", want, out.String())
+		}
+	}
+
+	out.Reset()
+	if err := runQuery([]string{"example.com", "@" + server, "+short"}, &out); err != nil {
+		t.Fatalf("runQuery failed: %v", err)
+	}
+	if out.String() != "192.0.2.7\n" {
+		t.Errorf("Unexpected short output %q", out.String())
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"container/list"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+const (
+	// queryStatsMaxNames bounds the names, clients and domains counted over the
+	// whole window, each of its slices counts an equal share of them. Once a
+	// share is reached the one asked for once the longest ago makes room for
+	// a new one.
+	queryStatsMaxNames = 10000
+	// queryStatsBuckets is the number of slices the retention window is
+	// counted in, the oldest slice is dropped as a whole
+	queryStatsBuckets = 12
+)
+
+// QueryStats counts the queries per name, per client address and per second
+// level domain of the name, for the top-N reports of the admin API. With a
+// retention window only the queries within it are counted, otherwise those
+// since the start.
+type QueryStats struct {
+	retention time.Duration
+	now       func() time.Time
+
+	mu sync.Mutex
+	// buckets count consecutive slices of the retention window, oldest
+	// first, the last one is being filled
+	buckets []*queryBucket
+}
+
+// queryBucket holds the counts of the queries from start on
+type queryBucket struct {
+	start   time.Time
+	names   *keyCounts[string]
+	clients *keyCounts[netip.Addr]
+	domains *keyCounts[string]
+}
+
+// keyCounts counts the queries per key, for at most max keys
+type keyCounts[K comparable] struct {
+	max    int
+	counts map[K]*keyCount
+	// once lists the keys counted once, oldest first, those are the ones
+	// dropped to make room
+	once *list.List
+}
+
+// keyCount is the count of a key, with its element in the once list while
+// it is 1
+type keyCount struct {
+	n    uint64
+	once *list.Element
+}
+
+// NameCount is a name with the number of queries for it
+type NameCount struct {
+	Name    string `json:"name"`
+	Queries uint64 `json:"queries"`
+}
+
+// ClientCount is a client address with the number of queries from it
+type ClientCount struct {
+	Client  string `json:"client"`
+	Queries uint64 `json:"queries"`
+}
+
+// QueryReport lists the names, clients and second level domains with the
+// most queries within the retention window, 0 for since the start
+type QueryReport struct {
+	Retention string        `json:"retention"`
+	Names     []NameCount   `json:"names"`
+	Clients   []ClientCount `json:"clients"`
+	Domains   []NameCount   `json:"domains"`
+}
+
+// NewQueryStats creates statistics with no queries counted, keeping them for
+// retention or since the start when it is 0
+func NewQueryStats(retention time.Duration) *QueryStats {
+	return &QueryStats{retention: retention, now: time.Now}
+}
+
+// observe counts a query from client for question
+func (q *QueryStats) observe(client netip.Addr, question dnsmessage.Question) {
+	if q == nil {
+		return
+	}
+	name := canonicalName(question.Name)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	b := q.current(q.now())
+	b.names.count(name)
+	b.clients.count(client.Unmap())
+	b.domains.count(ancestorName(name, 2))
+}
+
+// current returns the bucket counting queries at now, dropping those out of
+// the retention window. The caller holds q.mu.
+func (q *QueryStats) current(now time.Time) *queryBucket {
+	q.expire(now)
+	if n := len(q.buckets); n > 0 && (q.retention <= 0 || now.Before(q.buckets[n-1].start.Add(q.retention/queryStatsBuckets))) {
+		return q.buckets[n-1]
+	}
+	max := queryStatsMaxNames
+	if q.retention > 0 {
+		max /= queryStatsBuckets
+	}
+	b := &queryBucket{start: now, names: newKeyCounts[string](max), clients: newKeyCounts[netip.Addr](max), domains: newKeyCounts[string](max)}
+	q.buckets = append(q.buckets, b)
+	return b
+}
+
+// expire drops the buckets that ended before the retention window at now.
+// The caller holds q.mu.
+func (q *QueryStats) expire(now time.Time) {
+	if q.retention <= 0 {
+		return
+	}
+	span := q.retention / queryStatsBuckets
+	for len(q.buckets) > 0 && !q.buckets[0].start.Add(span).After(now.Add(-q.retention)) {
+		q.buckets = q.buckets[1:]
+	}
+}
+
+// newKeyCounts creates counts of at most max keys
+func newKeyCounts[K comparable](max int) *keyCounts[K] {
+	return &keyCounts[K]{max: max, counts: make(map[K]*keyCount), once: list.New()}
+}
+
+// count counts a query for key. A new key takes the place of the one counted
+// once the longest ago when the counts are full, and isn't counted when all
+// keys were counted more than once.
+func (c *keyCounts[K]) count(key K) {
+	if kc, ok := c.counts[key]; ok {
+		if kc.once != nil {
+			c.once.Remove(kc.once)
+			kc.once = nil
+		}
+		kc.n++
+		return
+	}
+	if len(c.counts) >= c.max {
+		oldest := c.once.Front()
+		if oldest == nil {
+			return
+		}
+		delete(c.counts, c.once.Remove(oldest).(K))
+	}
+	c.counts[key] = &keyCount{n: 1, once: c.once.PushBack(key)}
+}
+
+// Top returns the n names queried most, most queried first
+func (q *QueryStats) Top(n int) []NameCount {
+	return q.Report(n).Names
+}
+
+// Report returns the n names, clients and second level domains with the most
+// queries, most queried first
+func (q *QueryStats) Report(n int) QueryReport {
+	report := QueryReport{Names: []NameCount{}, Clients: []ClientCount{}, Domains: []NameCount{}}
+	if q == nil {
+		return report
+	}
+	report.Retention = q.retention.String()
+	names := make(map[string]uint64)
+	clients := make(map[netip.Addr]uint64)
+	domains := make(map[string]uint64)
+	q.mu.Lock()
+	q.expire(q.now())
+	for _, b := range q.buckets {
+		for name, kc := range b.names.counts {
+			names[name] += kc.n
+		}
+		for client, kc := range b.clients.counts {
+			clients[client] += kc.n
+		}
+		for domain, kc := range b.domains.counts {
+			domains[domain] += kc.n
+		}
+	}
+	q.mu.Unlock()
+
+	for name, count := range names {
+		report.Names = append(report.Names, NameCount{Name: dnsmessage.FQDN(name), Queries: count})
+	}
+	for client, count := range clients {
+		report.Clients = append(report.Clients, ClientCount{Client: client.String(), Queries: count})
+	}
+	for domain, count := range domains {
+		report.Domains = append(report.Domains, NameCount{Name: dnsmessage.FQDN(domain), Queries: count})
+	}
+	report.Names = topCounts(report.Names, n, func(c NameCount) (string, uint64) { return c.Name, c.Queries })
+	report.Clients = topCounts(report.Clients, n, func(c ClientCount) (string, uint64) { return c.Client, c.Queries })
+	report.Domains = topCounts(report.Domains, n, func(c NameCount) (string, uint64) { return c.Name, c.Queries })
+	return report
+}
+
+// topCounts orders counts by queries, then by key, and keeps the first n
+func topCounts[T any](counts []T, n int, key func(T) (string, uint64)) []T {
+	sort.Slice(counts, func(i, j int) bool {
+		ki, qi := key(counts[i])
+		kj, qj := key(counts[j])
+		if qi != qj {
+			return qi > qj
+		}
+		return ki < kj
+	})
+	if len(counts) > n {
+		counts = counts[:n]
+	}
+	return counts
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+func TestQueryStatsReport(t *testing.T) {
+	stats := NewQueryStats(0)
+	alice, bob := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("::ffff:192.0.2.2")
+	for _, name := range []string{"www.example.com", "mail.example.com", "www.example.com"} {
+		stats.observe(alice, question(name, dnsmessage.TypeA))
+	}
+	stats.observe(bob, question("example.net", dnsmessage.TypeA))
+
+	report := stats.Report(1)
+	if len(report.Names) != 1 || report.Names[0] != (NameCount{"www.example.com.", 2}) {
+		t.Errorf("Expected www.example.com to be queried most, got %v", report.Names)
+	}
+	if len(report.Clients) != 1 || report.Clients[0] != (ClientCount{"192.0.2.1", 3}) {
+		t.Errorf("Expected 192.0.2.1 to query most, got %v", report.Clients)
+	}
+	if len(report.Domains) != 1 || report.Domains[0] != (NameCount{"example.com.", 3}) {
+		t.Errorf("Expected example.com to be the top domain, got %v", report.Domains)
+	}
+	// Mapped addresses count as the IPv4 client
+	if clients := stats.Report(10).Clients; len(clients) != 2 || clients[1] != (ClientCount{"192.0.2.2", 1}) {
+		t.Errorf("Expected the mapped client to be unmapped, got %v", clients)
+	}
+}
+
+func TestQueryStatsRetention(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	stats := NewQueryStats(time.Hour)
+	stats.now = func() time.Time { return now }
+	client := netip.MustParseAddr("192.0.2.1")
+
+	stats.observe(client, question("old.example.com", dnsmessage.TypeA))
+	// The slices of the window share the bound
+	if max := stats.buckets[0].names.max; max != queryStatsMaxNames/queryStatsBuckets {
+		t.Errorf("Expected a slice to count up to %d names, got %d", queryStatsMaxNames/queryStatsBuckets, max)
+	}
+	now = now.Add(30 * time.Minute)
+	stats.observe(client, question("new.example.org", dnsmessage.TypeA))
+	if report := stats.Report(10); len(report.Names) != 2 || report.Clients[0].Queries != 2 {
+		t.Fatalf("Expected both queries within the hour, got %+v", report)
+	}
+
+	now = now.Add(40 * time.Minute)
+	report := stats.Report(10)
+	if len(report.Names) != 1 || report.Names[0].Name != "new.example.org." || report.Clients[0].Queries != 1 {
+		t.Errorf("Expected the query older than an hour to be dropped, got %+v", report)
+	}
+	if report.Retention != "1h0m0s" {
+		t.Errorf("Expected the retention to be reported, got %q", report.Retention)
+	}
+	now = now.Add(time.Hour)
+	if report := stats.Report(10); len(report.Names) != 0 || len(stats.buckets) != 0 {
+		t.Errorf("Expected nothing left after the window, got %+v", report)
+	}
+}
+
+func TestKeyCountsBound(t *testing.T) {
+	c := newKeyCounts[string](3)
+	for _, key := range []string{"a", "b", "b", "c", "d"} {
+		c.count(key)
+	}
+	// d took the place of a, counted once before c
+	if _, ok := c.counts["a"]; ok || len(c.counts) != 3 || c.counts["d"].n != 1 {
+		t.Errorf("Expected d to replace a, got %v", c.counts)
+	}
+	c.count("c")
+	c.count("d")
+	// With every key counted more than once a new one isn't counted
+	c.count("e")
+	if _, ok := c.counts["e"]; ok || c.counts["b"].n != 2 || c.counts["c"].n != 2 || c.counts["d"].n != 2 {
+		t.Errorf("Expected the keys counted twice to be kept, got %v", c.counts)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/netip"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// rootHintsTTL is the TTL used in the IANA named.root file
+const rootHintsTTL = 3600000
+
+// rootServer is an entry of the root hints (https://www.internic.net/domain/named.root)
+type rootServer struct {
+	Name string
+	IPv4 netip.Addr
+	IPv6 netip.Addr
+}
+
+var rootServers = []rootServer{
+	{"a.root-servers.net", netip.MustParseAddr("198.41.0.4"), netip.MustParseAddr("2001:503:ba3e::2:30")},
+	{"b.root-servers.net", netip.MustParseAddr("170.247.170.2"), netip.MustParseAddr("2801:1b8:10::b")},
+	{"c.root-servers.net", netip.MustParseAddr("192.33.4.12"), netip.MustParseAddr("2001:500:2::c")},
+	{"d.root-servers.net", netip.MustParseAddr("199.7.91.13"), netip.MustParseAddr("2001:500:2d::d")},
+	{"e.root-servers.net", netip.MustParseAddr("192.203.230.10"), netip.MustParseAddr("2001:500:a8::e")},
+	{"f.root-servers.net", netip.MustParseAddr("192.5.5.241"), netip.MustParseAddr("2001:500:2f::f")},
+	{"g.root-servers.net", netip.MustParseAddr("192.112.36.4"), netip.MustParseAddr("2001:500:12::d0d")},
+	{"h.root-servers.net", netip.MustParseAddr("198.97.190.53"), netip.MustParseAddr("2001:500:1::53")},
+	{"i.root-servers.net", netip.MustParseAddr("192.36.148.17"), netip.MustParseAddr("2001:7fe::53")},
+	{"j.root-servers.net", netip.MustParseAddr("192.58.128.30"), netip.MustParseAddr("2001:503:c27::2:30")},
+	{"k.root-servers.net", netip.MustParseAddr("193.0.14.129"), netip.MustParseAddr("2001:7fd::1")},
+	{"l.root-servers.net", netip.MustParseAddr("199.7.83.42"), netip.MustParseAddr("2001:500:9f::42")},
+	{"m.root-servers.net", netip.MustParseAddr("202.12.27.33"), netip.MustParseAddr("2001:dc3::35")},
+}
+
+// rootSOA mirrors the SOA published for the root zone, the serial is the date of the hints
+var rootSOA = dnsmessage.SOA{
+	MName:   "a.root-servers.net",
+	RName:   "nstld.verisign-grs.com",
+	Serial:  2024041101,
+	Refresh: 1800,
+	Retry:   900,
+	Expire:  604800,
+	Minimum: 86400,
+}
+
+// rootNSRecords returns the NS RRset of the root zone
+func rootNSRecords() []dnsmessage.Resource {
+	records := make([]dnsmessage.Resource, len(rootServers))
+	for i, s := range rootServers {
+		records[i] = dnsmessage.Resource{
+			Name: dnsmessage.Root, Type: dnsmessage.TypeNS, Class: dnsmessage.ClassINET, TTL: rootHintsTTL,
+			Data: &dnsmessage.NS{Host: s.Name},
+		}
+	}
+	return records
+}
+
+// rootGlueRecords returns the addresses of the root servers
+func rootGlueRecords() []dnsmessage.Resource {
+	records := make([]dnsmessage.Resource, 0, 2*len(rootServers))
+	for _, s := range rootServers {
+		records = append(records,
+			dnsmessage.Resource{Name: s.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: rootHintsTTL, Data: &dnsmessage.A{Addr: s.IPv4}},
+			dnsmessage.Resource{Name: s.Name, Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET, TTL: rootHintsTTL, Data: &dnsmessage.AAAA{Addr: s.IPv6}},
+		)
+	}
+	return records
+}
+
+// rootSOARecord returns the SOA of the root zone
+func rootSOARecord() dnsmessage.Resource {
+	soa := rootSOA
+	return dnsmessage.Resource{Name: dnsmessage.Root, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: soa.Minimum, Data: &soa}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// Rotator reorders the A and AAAA records of every answer. Most clients use
+// the first address, so rotating spreads them over all addresses of a name,
+// which is enough DNS based load balancing for a few home lab services.
+type Rotator struct {
+	// weights holds the configured weights by canonical owner and address,
+	// names with weights are shuffled by them instead of rotated
+	weights map[string]map[netip.Addr]float64
+	// turn advances with every rotated RRset, rotations of different names
+	// share it so no state per name is needed
+	turn   atomic.Uint64
+	random func() float64
+}
+
+// NewRotator creates a rotator from comma separated weights in form
+// <name>/<address>=<weight>. Addresses of weighted names without weight of
+// their own count 1.
+func NewRotator(weights string) (*Rotator, error) {
+	r := &Rotator{weights: make(map[string]map[netip.Addr]float64), random: rand.Float64}
+	for _, spec := range splitList(weights) {
+		target, value, ok := strings.Cut(spec, "=")
+		name, addr, ok2 := strings.Cut(target, "/")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("weight %q: expected <name>/<address>=<weight>", spec)
+		}
+		ip, err := netip.ParseAddr(addr)
+		if err != nil {
+			return nil, fmt.Errorf("weight %q: %w", spec, err)
+		}
+		w, err := strconv.ParseFloat(value, 64)
+		if err != nil || w <= 0 || math.IsInf(w, 0) {
+			return nil, fmt.Errorf("weight %q: expected a positive number", spec)
+		}
+		name = canonicalName(name)
+		if r.weights[name] == nil {
+			r.weights[name] = make(map[netip.Addr]float64)
+		}
+		r.weights[name][ip.Unmap()] = w
+	}
+	return r, nil
+}
+
+// apply reorders each A and AAAA RRset in records in place, the positions the
+// RRsets take in the section stay the same
+func (r *Rotator) apply(records []dnsmessage.Resource) {
+	if r == nil {
+		return
+	}
+	positions := make(map[rrsetKey][]int)
+	var order []rrsetKey
+	for i := range records {
+		if t := records[i].Type; t != dnsmessage.TypeA && t != dnsmessage.TypeAAAA {
+			continue
+		}
+		key := keyOf(&records[i])
+		if positions[key] == nil {
+			order = append(order, key)
+		}
+		positions[key] = append(positions[key], i)
+	}
+
+	for _, key := range order {
+		idx := positions[key]
+		if len(idx) < 2 {
+			continue
+		}
+		set := make([]dnsmessage.Resource, len(idx))
+		for j, i := range idx {
+			set[j] = records[i]
+		}
+		if weights, ok := r.weights[canonicalName(key.Name)]; ok {
+			r.shuffle(set, weights)
+		} else {
+			shift := int(r.turn.Add(1) % uint64(len(set)))
+			set = append(set[shift:], set[:shift]...)
+		}
+		for j, i := range idx {
+			records[i] = set[j]
+		}
+	}
+}
+
+// shuffle orders set randomly so each address comes first with a probability
+// proportional to its weight (weighted sampling without replacement,
+// Efraimidis and Spirakis 2006)
+func (r *Rotator) shuffle(set []dnsmessage.Resource, weights map[netip.Addr]float64) {
+	keys := make([]float64, len(set))
+	for i, rr := range set {
+		w := 1.0
+		if addr, ok := recordAddr(rr); ok {
+			if configured, ok := weights[addr]; ok {
+				w = configured
+			}
+		}
+		// The smaller -ln(U)/w is, the earlier in the order
+		keys[i] = -math.Log(1-r.random()) / w
+	}
+	sort.Sort(byKey{set, keys})
+}
+
+type byKey struct {
+	set  []dnsmessage.Resource
+	keys []float64
+}
+
+func (b byKey) Len() int           { return len(b.set) }
+func (b byKey) Less(i, j int) bool { return b.keys[i] < b.keys[j] }
+func (b byKey) Swap(i, j int) {
+	b.set[i], b.set[j] = b.set[j], b.set[i]
+	b.keys[i], b.keys[j] = b.keys[j], b.keys[i]
+}
+
+// recordAddr returns the address of an A or AAAA record
+func recordAddr(rr dnsmessage.Resource) (netip.Addr, bool) {
+	switch data := rr.Data.(type) {
+	case *dnsmessage.A:
+		return data.Addr, true
+	case *dnsmessage.AAAA:
+		return data.Addr.Unmap(), true
+	}
+	return netip.Addr{}, false
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"math/rand/v2"
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+func firstAddrs(records []dnsmessage.Resource) []string {
+	var addrs []string
+	for _, rr := range records {
+		addrs = append(addrs, rr.Data.String())
+	}
+	return addrs
+}
+
+func TestRotatorRoundRobin(t *testing.T) {
+	r, err := NewRotator("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, closedUDPAddr(t))
+	s.Rotate = r
+	s.LocalData = NewLocalData()
+	s.LocalData.Add(
+		cnameRecord("www.home.lan", "web.home.lan"),
+		aRecord("web.home.lan", "192.168.1.10"),
+		aRecord("web.home.lan", "192.168.1.11"),
+		aRecord("web.home.lan", "192.168.1.12"),
+	)
+
+	firsts := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		resp := handle(s, &dnsmessage.Message{Questions: []dnsmessage.Question{question("www.home.lan", dnsmessage.TypeA)}})
+		got := firstAddrs(resp.Answers)
+		if len(got) != 4 || got[0] != "web.home.lan." {
+			t.Fatalf("Expected the CNAME to stay in front of the rotated addresses, got %v", got)
+		}
+		firsts[got[1]]++
+	}
+	for _, addr := range []string{"192.168.1.10", "192.168.1.11", "192.168.1.12"} {
+		if firsts[addr] != 2 {
+			t.Errorf("Expected every address to come first equally often, got %v", firsts)
+		}
+	}
+}
+
+func TestRotatorWeights(t *testing.T) {
+	r, err := NewRotator("web.home.lan/192.168.1.10=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.random = rand.New(rand.NewPCG(1, 2)).Float64
+	firsts := make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		set := []dnsmessage.Resource{aRecord("web.home.lan", "192.168.1.10"), aRecord("web.home.lan", "192.168.1.11")}
+		r.apply(set)
+		firsts[set[0].Data.String()]++
+	}
+	// A weight of 3 against 1 puts the address first three times out of four
+	if light := firsts["192.168.1.11"]; light < 800 || light > 1200 {
+		t.Errorf("Expected the unweighted address first about 1000 times, got %v", firsts)
+	}
+}
+
+func TestNewRotatorRejectsInvalidWeights(t *testing.T) {
+	for _, spec := range []string{"web.home.lan=3", "web.home.lan/nope=3", "web.home.lan/192.168.1.10=0", "web.home.lan/192.168.1.10=x"} {
+		if _, err := NewRotator(spec); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+}
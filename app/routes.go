@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// Route forwards the queries for a domain and/or of some query types to their
+// own upstreams instead of the default ones
+type Route struct {
+	// Domain matches itself and its subdomains, the root matches every name
+	Domain string
+	// Types are the query types matched, none matches every type
+	Types     []dnsmessage.Type
+	Forwarder *Forwarder
+}
+
+// parseRoutes parses comma separated routes in form
+// [<domain>][/<type>[|<type>...]]=<ip>:<port>[+<ip>:<port>...], e.g.
+// "corp.example=10.0.0.53:53" or "/TXT|ANY=9.9.9.9:53". They are returned
+// most specific first: by the length of the domain, then routes with types
+// before those without.
+func parseRoutes(s string) ([]*Route, error) {
+	var routes []*Route
+	for _, spec := range splitList(s) {
+		match, upstreams, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("route %q: expected <domain>/<types>=<upstreams>", spec)
+		}
+		domain, types, _ := strings.Cut(match, "/")
+		r := &Route{Domain: canonicalName(domain)}
+		if types != "" {
+			for _, name := range strings.Split(types, "|") {
+				t, err := dnsmessage.ParseType(name)
+				if err != nil {
+					return nil, fmt.Errorf("route %q: %w", spec, err)
+				}
+				r.Types = append(r.Types, t)
+			}
+		}
+		if r.Domain == dnsmessage.Root && len(r.Types) == 0 {
+			return nil, fmt.Errorf("route %q matches every query, use -resolver for the default upstreams", spec)
+		}
+		forwarder, err := NewForwarder(strings.ReplaceAll(upstreams, "+", ","))
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %w", spec, err)
+		}
+		r.Forwarder = forwarder
+		routes = append(routes, r)
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		if a, b := labelCount(routes[i].Domain), labelCount(routes[j].Domain); a != b {
+			return a > b
+		}
+		return len(routes[i].Types) > 0 && len(routes[j].Types) == 0
+	})
+	return routes, nil
+}
+
+// labelCount returns the number of labels of a canonical name, 0 for the root
+func labelCount(name string) int {
+	n := 0
+	for ; name != dnsmessage.Root; name = parentName(name) {
+		n++
+	}
+	return n
+}
+
+// matches reports whether question is forwarded along r
+func (r *Route) matches(question dnsmessage.Question) bool {
+	return isSubdomain(question.Name, r.Domain) && (len(r.Types) == 0 || slices.Contains(r.Types, question.Type))
+}
+
+// exchange sends query for question along the first route matching it. Other
+// queries go to the default forwarder, or are resolved by the Iterator.
+func (s *Server) exchange(ctx context.Context, question dnsmessage.Question, query *dnsmessage.Message) (*dnsmessage.Message, error) {
+	for _, r := range s.Routes {
+		if r.matches(question) {
+			return r.Forwarder.Exchange(ctx, query)
+		}
+	}
+	if s.Iterator != nil {
+		return s.Iterator.Exchange(ctx, query)
+	}
+	return s.Forwarder.Exchange(ctx, query)
+}
+
+// forwarders returns the default forwarder followed by those of the routes
+func (s *Server) forwarders() []*Forwarder {
+	forwarders := []*Forwarder{s.Forwarder}
+	for _, r := range s.Routes {
+		forwarders = append(forwarders, r.Forwarder)
+	}
+	return forwarders
+}
+
+// shareUpstreams makes the forwarders use a single Upstream per address, so
+// routes sharing an address share its health and budget, and returns them
+func (s *Server) shareUpstreams() []*Upstream {
+	byAddr := make(map[string]*Upstream)
+	var all []*Upstream
+	for _, f := range s.forwarders() {
+		for i, u := range f.Upstreams {
+			if known, ok := byAddr[u.Addr]; ok {
+				f.Upstreams[i] = known
+				continue
+			}
+			byAddr[u.Addr] = u
+			all = append(all, u)
+		}
+	}
+	return all
+}
+
+// upstream returns the upstream with the given address, or nil
+func (s *Server) upstream(addr string) *Upstream {
+	for _, f := range s.forwarders() {
+		for _, u := range f.Upstreams {
+			if u.Addr == addr {
+				return u
+			}
+		}
+	}
+	return nil
+}
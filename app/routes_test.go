@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+func TestParseRoutesOrder(t *testing.T) {
+	routes, err := parseRoutes("/TXT|ANY=192.0.2.1:53, corp.example=192.0.2.2:53+192.0.2.3:53, corp.example/PTR=192.0.2.4:53, lab.corp.example=192.0.2.5:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var order []string
+	for _, r := range routes {
+		order = append(order, r.Forwarder.Upstreams[0].Addr)
+	}
+	want := []string{"192.0.2.5:53", "192.0.2.4:53", "192.0.2.2:53", "192.0.2.1:53"}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("Expected routes most specific first %v, got %v", want, order)
+		}
+	}
+	if len(routes[2].Forwarder.Upstreams) != 2 {
+		t.Errorf("Expected + to separate upstreams, got %d", len(routes[2].Forwarder.Upstreams))
+	}
+
+	for _, spec := range []string{"corp.example", "/BOGUS=192.0.2.1:53", "corp.example=", "/=192.0.2.1:53", "corp.example=192.0.2.1"} {
+		if _, err := parseRoutes(spec); err == nil {
+			t.Errorf("Expected route %q to be rejected", spec)
+		}
+	}
+}
+
+func TestServerRoutesByType(t *testing.T) {
+	s := newTestServer(t, dnstest.StartUDPServer(t, answerA("192.0.2.1")).Addr)
+	routes, err := parseRoutes("/TXT|TYPE65=" + dnstest.StartUDPServer(t, answerA("192.0.2.2")).Addr + ",corp.example=" + dnstest.StartUDPServer(t, answerA("192.0.2.3")).Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Routes = routes
+
+	tests := []struct {
+		name  string
+		qtype dnsmessage.Type
+		want  string
+	}{
+		{"www.example.com", dnsmessage.TypeA, "192.0.2.1"},
+		{"www.example.com", dnsmessage.TypeTXT, "192.0.2.2"},
+		{"www.example.com", dnsmessage.Type(65), "192.0.2.2"},
+		{"www.corp.example", dnsmessage.TypeA, "192.0.2.3"},
+		// The name is more specific than the type
+		{"www.corp.example", dnsmessage.TypeTXT, "192.0.2.3"},
+	}
+	for _, tt := range tests {
+		resp := handle(s, &dnsmessage.Message{Questions: []dnsmessage.Question{question(tt.name, tt.qtype)}})
+		if len(resp.Answers) != 1 || resp.Answers[0].Data.String() != tt.want {
+			t.Errorf("%s %s: expected the answer of the upstream for %s, got %+v", tt.name, tt.qtype, tt.want, resp.Answers)
+		}
+	}
+}
+
+func TestBuildServerSharesRouteUpstreams(t *testing.T) {
+	o, err := loadOptions([]string{"-resolver", "192.0.2.1:53", "-route", "/TXT=192.0.2.1:53+192.0.2.2:53", "-upstream-qps", "10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := buildServer(o, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Forwarder.Upstreams[0] != s.Routes[0].Forwarder.Upstreams[0] {
+		t.Error("Expected the default forwarder and the route to share the upstream")
+	}
+	if s.Routes[0].Forwarder.Upstreams[1].Budget == nil {
+		t.Error("Expected the route upstreams to get a budget")
+	}
+
+	next, err := buildServer(o, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Routes[0].Forwarder.Upstreams[1].Health != s.Routes[0].Forwarder.Upstreams[1].Health {
+		t.Error("Expected the health of route upstreams to survive a reload")
+	}
+}
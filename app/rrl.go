@@ -0,0 +1,124 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// rrlMaxBuckets bounds the memory used by the rate limiter, even under a flood
+// of spoofed sources. Once reached the bucket of the network queried least
+// recently is dropped, a network limited for flooding keeps querying and stays.
+const rrlMaxBuckets = 100000
+
+// rrlMetrics counts the UDP queries over their rate as dropped and slipped
+var rrlMetrics = expvar.NewMap("rrl")
+
+// rrlAction is what to do with a UDP query
+type rrlAction int
+
+const (
+	rrlAllow rrlAction = iota
+	// rrlDrop sends no response at all
+	rrlDrop
+	// rrlSlip sends an empty truncated response, so legitimate clients retry
+	// over TCP while a spoofed victim only gets a small packet
+	rrlSlip
+)
+
+// RateLimiter limits the UDP queries per second of each client network with a
+// token bucket, so the server can't be used to amplify attacks against spoofed
+// source addresses. Clients are grouped by prefix since attackers can easily
+// spread their spoofed addresses over a network.
+type RateLimiter struct {
+	QPS   float64
+	Burst float64
+	// IPv4Prefix and IPv6Prefix are the prefix lengths clients are grouped by
+	IPv4Prefix int
+	IPv6Prefix int
+	// Slip answers every Slip-th limited query with a truncated response and
+	// drops the others, 0 drops them all
+	Slip int
+
+	mu      sync.Mutex
+	buckets *lruMap[netip.Prefix, *rrlBucket]
+	now     func() time.Time
+}
+
+type rrlBucket struct {
+	tokenBucket
+	limited int
+}
+
+// NewRateLimiter creates a rate limiter grouping clients by /24 IPv4 and /56 IPv6
+// networks. A burst below 1 defaults to one second worth of queries.
+func NewRateLimiter(qps, burst float64, slip int) (*RateLimiter, error) {
+	if qps <= 0 {
+		return nil, fmt.Errorf("rate limit must be positive, got %v", qps)
+	}
+	if slip < 0 {
+		return nil, fmt.Errorf("slip must not be negative, got %d", slip)
+	}
+	if burst < 1 {
+		burst = max(qps, 1)
+	}
+	return &RateLimiter{
+		QPS:        qps,
+		Burst:      burst,
+		IPv4Prefix: 24,
+		IPv6Prefix: 56,
+		Slip:       slip,
+		buckets:    newLRUMap[netip.Prefix, *rrlBucket](rrlMaxBuckets),
+		now:        time.Now,
+	}, nil
+}
+
+// sameLimits reports whether l and other limit alike, so the state of l can be kept
+func (l *RateLimiter) sameLimits(other *RateLimiter) bool {
+	return l != nil && other != nil &&
+		l.QPS == other.QPS && l.Burst == other.Burst && l.Slip == other.Slip &&
+		l.IPv4Prefix == other.IPv4Prefix && l.IPv6Prefix == other.IPv6Prefix
+}
+
+// networkOf returns the network client is accounted to
+func (l *RateLimiter) networkOf(client netip.Addr) netip.Prefix {
+	client = client.Unmap()
+	bits := l.IPv6Prefix
+	if client.Is4() {
+		bits = l.IPv4Prefix
+	}
+	p, _ := client.Prefix(bits)
+	return p
+}
+
+// check spends a token of the client's network and decides how to respond
+func (l *RateLimiter) check(client netip.Addr) rrlAction {
+	if l == nil {
+		return rrlAllow
+	}
+	network := l.networkOf(client)
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets.get(network)
+	if !ok {
+		b = &rrlBucket{tokenBucket: newTokenBucket(l.QPS, l.Burst, now)}
+		l.buckets.put(network, b)
+	}
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return rrlAllow
+	}
+
+	b.limited++
+	if l.Slip > 0 && b.limited%l.Slip == 0 {
+		rrlMetrics.Add("slipped", 1)
+		return rrlSlip
+	}
+	rrlMetrics.Add("dropped", 1)
+	return rrlDrop
+}
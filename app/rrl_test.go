@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+func newTestRateLimiter(t *testing.T, qps, burst float64, slip int) (*RateLimiter, *fakeClock) {
+	t.Helper()
+	l, err := NewRateLimiter(qps, burst, slip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	l.now = clock.Now
+	return l, clock
+}
+
+func TestRateLimiterPerNetwork(t *testing.T) {
+	l, clock := newTestRateLimiter(t, 1, 3, 0)
+	client := netip.MustParseAddr("198.51.100.1")
+	neighbour := netip.MustParseAddr("198.51.100.200")
+	other := netip.MustParseAddr("203.0.113.1")
+
+	for i := 0; i < 3; i++ {
+		if got := l.check(client); got != rrlAllow {
+			t.Fatalf("Query %d within the burst was limited: %v", i, got)
+		}
+	}
+	if got := l.check(neighbour); got != rrlDrop {
+		t.Errorf("Expected the /24 to share the budget, got %v", got)
+	}
+	if got := l.check(other); got != rrlAllow {
+		t.Errorf("Expected another network to have its own budget, got %v", got)
+	}
+	clock.Advance(time.Second)
+	if got := l.check(client); got != rrlAllow {
+		t.Errorf("Expected a token to be earned back, got %v", got)
+	}
+
+	v6 := netip.MustParseAddr("2001:db8:0:ff::1")
+	v6Neighbour := netip.MustParseAddr("2001:db8:0:1::1")
+	for i := 0; i < 3; i++ {
+		l.check(v6)
+	}
+	if got := l.check(v6Neighbour); got != rrlDrop {
+		t.Errorf("Expected the /56 to share the budget, got %v", got)
+	}
+}
+
+func TestRateLimiterSlip(t *testing.T) {
+	l, _ := newTestRateLimiter(t, 1, 1, 2)
+	client := netip.MustParseAddr("::ffff:198.51.100.1")
+	want := []rrlAction{rrlAllow, rrlDrop, rrlSlip, rrlDrop, rrlSlip}
+	for i, w := range want {
+		if got := l.check(client); got != w {
+			t.Errorf("Query %d: expected %v, got %v", i, w, got)
+		}
+	}
+}
+
+func TestRateLimiterBound(t *testing.T) {
+	l, _ := newTestRateLimiter(t, 1, 1, 0)
+	attacker := netip.MustParseAddr("198.51.100.1")
+	l.check(attacker)
+
+	// A flood from spoofed networks fills the table up to its bound only, the
+	// network still querying keeps its bucket
+	for i := 0; i < 2*rrlMaxBuckets; i++ {
+		l.check(netip.AddrFrom4([4]byte{byte(i >> 16), byte(i >> 8), byte(i), 1}))
+		if i%1000 == 0 {
+			l.check(attacker)
+		}
+	}
+	if n := len(l.buckets.items); n != rrlMaxBuckets {
+		t.Errorf("Expected %d buckets, got %d", rrlMaxBuckets, n)
+	}
+	if got := l.check(attacker); got != rrlDrop {
+		t.Errorf("Expected the limited network to stay limited, got %v", got)
+	}
+}
+
+func TestServerRateLimitsUDP(t *testing.T) {
+	s := newTestServer(t, dnstest.StartUDPServer(t, answerA("192.0.2.1")).Addr)
+	var err error
+	if s.RateLimit, err = NewRateLimiter(0.001, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	addr := startTestServer(t, s)
+
+	if resp := dnstest.ExchangeUDP(t, addr, testQuery("example.com")); resp.Truncated || len(resp.Answers) != 1 {
+		t.Fatalf("Expected the first query to be answered, got %s", resp)
+	}
+	if resp := dnstest.ExchangeUDP(t, addr, testQuery("example.com")); !resp.Truncated || len(resp.Answers) != 0 {
+		t.Fatalf("Expected a slipped truncated answer, got %s", resp)
+	}
+	// TCP isn't rate limited, the source address can't be spoofed there
+	if resp := dnstest.ExchangeTCP(t, addr, testQuery("example.com")); resp.Truncated || len(resp.Answers) != 1 {
+		t.Errorf("Expected the answer over TCP, got %s", resp)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// rrsetKey identifies an RRset: all records sharing owner name, class and type
+type rrsetKey struct {
+	Name  string
+	Type  dnsmessage.Type
+	Class dnsmessage.Class
+}
+
+func keyOf(r *dnsmessage.Resource) rrsetKey {
+	return rrsetKey{Name: strings.ToLower(r.Name), Type: r.Type, Class: r.Class}
+}
+
+// ttlKeyOf is the key of the RRset whose TTL r has to share, signatures have
+// the TTL of the RRset they cover (https://www.rfc-editor.org/rfc/rfc4034#section-3)
+func ttlKeyOf(r *dnsmessage.Resource) rrsetKey {
+	key := keyOf(r)
+	key.Type = coveredType(*r)
+	return key
+}
+
+// harmonizeTTLs lowers the TTL of every record to the minimum TTL of its RRset.
+// RFC 2181 section 5.2 forbids differing TTLs within an RRset and clients that
+// cache the records individually would otherwise expire parts of the set early.
+// source names where the records came from and is only used for logging.
+func harmonizeTTLs(records []dnsmessage.Resource, source string) {
+	minTTL := make(map[rrsetKey]uint32)
+	inconsistent := make(map[rrsetKey]bool)
+	for i := range records {
+		// OPT is a pseudo record whose TTL field holds flags
+		if records[i].Type == dnsmessage.TypeOPT {
+			continue
+		}
+		key := ttlKeyOf(&records[i])
+		ttl, seen := minTTL[key]
+		if !seen {
+			minTTL[key] = records[i].TTL
+			continue
+		}
+		if records[i].TTL != ttl {
+			inconsistent[key] = true
+			minTTL[key] = min(ttl, records[i].TTL)
+		}
+	}
+
+	for key := range inconsistent {
+		log.Printf("Inconsistent TTLs in RRset %s %s from %s, using minimum %d", key.Name, key.Type, source, minTTL[key])
+	}
+	if len(inconsistent) == 0 {
+		return
+	}
+	for i := range records {
+		if records[i].Type == dnsmessage.TypeOPT {
+			continue
+		}
+		if key := ttlKeyOf(&records[i]); inconsistent[key] {
+			records[i].TTL = minTTL[key]
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+func TestHarmonizeTTLs(t *testing.T) {
+	a := func(name string, ttl uint32, ip string) dnsmessage.Resource {
+		return dnsmessage.Resource{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl, Data: &dnsmessage.A{Addr: netip.MustParseAddr(ip)}}
+	}
+	records := []dnsmessage.Resource{
+		a("www.example.com", 300, "192.0.2.1"),
+		a("WWW.example.com", 60, "192.0.2.2"),
+		a("www.example.com", 120, "192.0.2.3"),
+		a("other.example.com", 900, "192.0.2.4"),
+		{Name: "www.example.com", Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET, TTL: 500, Data: &dnsmessage.AAAA{Addr: netip.MustParseAddr("2001:db8::1")}},
+		{Name: "", Type: dnsmessage.TypeOPT, Class: 1232, TTL: 0x8000, Data: &dnsmessage.OPT{}},
+	}
+
+	harmonizeTTLs(records, "test")
+
+	want := []uint32{60, 60, 60, 900, 500, 0x8000}
+	for i, ttl := range want {
+		if records[i].TTL != ttl {
+			t.Errorf("record %d (%s): expected TTL %d, got %d", i, records[i].Name, ttl, records[i].TTL)
+		}
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+// The scenarios in testdata/scenarios describe the behavior of the server
+// declaratively, in YAML (see parseYAML for the subset understood):
+//
+//	name: blocked names get NXDOMAIN
+//	options:                 # flags, as in the config file, $dir is the directory of the files
+//	  blocklist: $dir/ads.txt
+//	files:                   # written to a temporary directory, $dir expanded
+//	  ads.txt: |
+//	    ads.example
+//	upstream:                # answers of the fake upstream, others are REFUSED
+//	  - query: www.example A
+//	    answers: [www.example. 60 IN A 192.0.2.1]
+//	queries:
+//	  - query: ads.example A # name, type and optionally class, RD is set
+//	    client: 10.0.0.1     # answered in process as if from that client, over the sockets otherwise
+//	    transport: tcp       # udp by default
+//	    expect:
+//	      rcode: NXDOMAIN
+//	      flags: [qr, rd, ra] # exactly the header flags set
+//	      answers: []         # records in master file format, in any order
+//	      answer_count: 0
+//
+// The server is built from the options like the daemon builds it, forwarding
+// to the fake upstream unless -resolver or -iterate is given. Queries are
+// sent in order, so later ones see what earlier ones cached. Records in the
+// authority and additional sections are checked when listed, the OPT record
+// is left out of the additionals.
+
+// scenario is a scenario file
+type scenario struct {
+	name     string
+	options  map[string]string
+	files    map[string]string
+	upstream []scenarioAnswer
+	queries  []scenarioQuery
+}
+
+// scenarioAnswer is an answer of the fake upstream
+type scenarioAnswer struct {
+	question    dnsmessage.Question
+	rcode       dnsmessage.RCode
+	answers     []dnsmessage.Resource
+	authorities []dnsmessage.Resource
+}
+
+// scenarioQuery is a query with the reply it expects
+type scenarioQuery struct {
+	text      string
+	question  dnsmessage.Question
+	rd        bool
+	client    netip.Addr
+	transport string
+	expect    map[string]any
+}
+
+func TestScenarios(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "scenarios", "*.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("Expected scenarios in testdata/scenarios")
+	}
+	for _, path := range paths {
+		src, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc, err := parseScenario(string(src), path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Run(sc.name, func(t *testing.T) { sc.run(t) })
+	}
+}
+
+// parseScenario reads a scenario file
+func parseScenario(src, name string) (*scenario, error) {
+	doc, err := parseYAML(src, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := yamlOnly(doc, "name", "options", "files", "upstream", "queries"); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	sc := &scenario{name: strings.TrimSuffix(filepath.Base(name), ".yaml"), options: map[string]string{}, files: map[string]string{}}
+	if n, ok := doc["name"].(string); ok && n != "" {
+		sc.name = n
+	}
+	if sc.options, err = yamlStrings(doc["options"], ","); err != nil {
+		return nil, fmt.Errorf("%s: options: %w", name, err)
+	}
+	if sc.files, err = yamlStrings(doc["files"], "\n"); err != nil {
+		return nil, fmt.Errorf("%s: files: %w", name, err)
+	}
+	for i, item := range yamlList(doc["upstream"]) {
+		a, err := parseScenarioAnswer(item)
+		if err != nil {
+			return nil, fmt.Errorf("%s: upstream %d: %w", name, i+1, err)
+		}
+		sc.upstream = append(sc.upstream, a)
+	}
+	for i, item := range yamlList(doc["queries"]) {
+		q, err := parseScenarioQuery(item)
+		if err != nil {
+			return nil, fmt.Errorf("%s: query %d: %w", name, i+1, err)
+		}
+		sc.queries = append(sc.queries, q)
+	}
+	if len(sc.queries) == 0 {
+		return nil, fmt.Errorf("%s: no queries", name)
+	}
+	return sc, nil
+}
+
+func parseScenarioAnswer(item any) (scenarioAnswer, error) {
+	var a scenarioAnswer
+	m, ok := item.(map[string]any)
+	if !ok {
+		return a, fmt.Errorf("expected a mapping")
+	}
+	if err := yamlOnly(m, "query", "rcode", "answers", "authorities"); err != nil {
+		return a, err
+	}
+	var err error
+	if a.question, err = parseScenarioQuestion(m["query"]); err != nil {
+		return a, err
+	}
+	if rcode, ok := m["rcode"].(string); ok {
+		if a.rcode, err = dnsmessage.ParseRCode(rcode); err != nil {
+			return a, err
+		}
+	}
+	if a.answers, err = parseScenarioRecords(m["answers"]); err != nil {
+		return a, fmt.Errorf("answers: %w", err)
+	}
+	if a.authorities, err = parseScenarioRecords(m["authorities"]); err != nil {
+		return a, fmt.Errorf("authorities: %w", err)
+	}
+	return a, nil
+}
+
+func parseScenarioQuery(item any) (scenarioQuery, error) {
+	q := scenarioQuery{rd: true, transport: "udp"}
+	m, ok := item.(map[string]any)
+	if !ok {
+		return q, fmt.Errorf("expected a mapping")
+	}
+	if err := yamlOnly(m, "query", "rd", "client", "transport", "expect"); err != nil {
+		return q, err
+	}
+	q.text, _ = m["query"].(string)
+	var err error
+	if q.question, err = parseScenarioQuestion(m["query"]); err != nil {
+		return q, err
+	}
+	if rd, ok := m["rd"].(string); ok {
+		if q.rd, err = strconv.ParseBool(rd); err != nil {
+			return q, fmt.Errorf("invalid rd: %w", err)
+		}
+	}
+	if client, ok := m["client"].(string); ok {
+		if q.client, err = netip.ParseAddr(client); err != nil {
+			return q, fmt.Errorf("invalid client: %w", err)
+		}
+	}
+	if transport, ok := m["transport"].(string); ok {
+		if transport != "udp" && transport != "tcp" {
+			return q, fmt.Errorf("invalid transport %q", transport)
+		}
+		q.transport = transport
+	}
+	if q.expect, ok = m["expect"].(map[string]any); !ok {
+		return q, fmt.Errorf("expected an expect mapping")
+	}
+	if err := yamlOnly(q.expect, "rcode", "flags", "answers", "authorities", "additionals", "answer_count"); err != nil {
+		return q, fmt.Errorf("expect: %w", err)
+	}
+	return q, nil
+}
+
+// parseScenarioQuestion parses a question as <name> <type> [<class>]
+func parseScenarioQuestion(v any) (dnsmessage.Question, error) {
+	s, _ := v.(string)
+	fields := strings.Fields(s)
+	if len(fields) != 2 && len(fields) != 3 {
+		return dnsmessage.Question{}, fmt.Errorf("expected a query as <name> <type> [<class>], got %q", s)
+	}
+	q := dnsmessage.Question{Name: fields[0], Class: dnsmessage.ClassINET}
+	var err error
+	if q.Type, err = dnsmessage.ParseType(strings.ToUpper(fields[1])); err != nil {
+		return q, err
+	}
+	if len(fields) == 3 {
+		if q.Class, err = dnsmessage.ParseClass(strings.ToUpper(fields[2])); err != nil {
+			return q, err
+		}
+	}
+	return q, nil
+}
+
+// parseScenarioRecords parses a list of records in master file format with
+// absolute names
+func parseScenarioRecords(v any) ([]dnsmessage.Resource, error) {
+	var records []dnsmessage.Resource
+	for _, item := range yamlList(v) {
+		line, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected a record, got %v", item)
+		}
+		rrs, err := parseZone(strings.NewReader(line+"\n"), "record", dnsmessage.Root)
+		if err != nil || len(rrs) != 1 {
+			return nil, fmt.Errorf("invalid record %q: %v", line, err)
+		}
+		records = append(records, rrs[0])
+	}
+	return records, nil
+}
+
+// run builds the server of the scenario and checks the reply to each query
+func (sc *scenario) run(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range sc.files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(strings.ReplaceAll(content, "$dir", dir)), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var args []string
+	for name, value := range sc.options {
+		args = append(args, "-"+name+"="+strings.ReplaceAll(value, "$dir", dir))
+	}
+	if _, ok := sc.options["resolver"]; !ok && sc.options["iterate"] != "true" {
+		args = append(args, "-resolver="+dnstest.StartUDPServer(t, sc.answer).Addr)
+	}
+	opts, err := loadOptions(args)
+	if err != nil {
+		t.Fatalf("Invalid options: %v", err)
+	}
+	s, err := buildServer(opts, nil)
+	if err != nil {
+		t.Fatalf("Invalid configuration: %v", err)
+	}
+	addr := startTestServer(t, s)
+
+	for i, q := range sc.queries {
+		query := &dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: uint16(4200 + i), RecursionDesired: q.rd},
+			Questions: []dnsmessage.Question{q.question},
+		}
+		var reply *dnsmessage.Message
+		if q.client.IsValid() {
+			reply = s.active().Handle(context.Background(), &QueryContext{Client: netip.AddrPortFrom(q.client, 53000), Transport: q.transport, Query: query})
+			if reply == nil {
+				t.Errorf("%s: expected a reply", q.text)
+				continue
+			}
+		} else {
+			if reply, err = dnstest.Exchange(q.transport, addr, query); err != nil {
+				t.Fatalf("%s: %v", q.text, err)
+			}
+		}
+		for _, problem := range q.check(reply) {
+			t.Errorf("query %d, %s: %s\n%s", i+1, q.text, problem, reply)
+		}
+	}
+}
+
+// answer is the fake upstream of the scenario
+func (sc *scenario) answer(query *dnsmessage.Message) *dnsmessage.Message {
+	reply := &dnsmessage.Message{Header: dnsmessage.Header{ID: query.ID, Response: true, RecursionDesired: query.RecursionDesired, RecursionAvailable: true}, Questions: query.Questions}
+	reply.RCode = dnsmessage.RCodeRefused
+	if len(query.Questions) != 1 {
+		return reply
+	}
+	q := query.Questions[0]
+	for _, a := range sc.upstream {
+		if canonicalName(a.question.Name) == canonicalName(q.Name) && a.question.Type == q.Type && a.question.Class == q.Class {
+			reply.RCode, reply.Answers, reply.Authorities = a.rcode, a.answers, a.authorities
+			break
+		}
+	}
+	return reply
+}
+
+// check returns how reply differs from the expectations of q
+func (q *scenarioQuery) check(reply *dnsmessage.Message) []string {
+	var problems []string
+	if want, ok := q.expect["rcode"].(string); ok && !strings.EqualFold(want, reply.RCode.String()) {
+		problems = append(problems, fmt.Sprintf("expected rcode %s, got %s", want, reply.RCode))
+	}
+	if want, ok := q.expect["flags"]; ok {
+		var flags []string
+		for _, f := range yamlList(want) {
+			flags = append(flags, strings.ToLower(fmt.Sprint(f)))
+		}
+		sort.Strings(flags)
+		if got := headerFlags(reply.Header); strings.Join(got, " ") != strings.Join(flags, " ") {
+			problems = append(problems, fmt.Sprintf("expected flags %v, got %v", flags, got))
+		}
+	}
+	if want, ok := q.expect["answer_count"].(string); ok && want != strconv.Itoa(len(reply.Answers)) {
+		problems = append(problems, fmt.Sprintf("expected %s answers, got %d", want, len(reply.Answers)))
+	}
+	var additionals []dnsmessage.Resource
+	for _, rr := range reply.Additionals {
+		if rr.Type != dnsmessage.TypeOPT {
+			additionals = append(additionals, rr)
+		}
+	}
+	for _, section := range []struct {
+		name    string
+		records []dnsmessage.Resource
+	}{{"answers", reply.Answers}, {"authorities", reply.Authorities}, {"additionals", additionals}} {
+		v, ok := q.expect[section.name]
+		if !ok {
+			continue
+		}
+		want, err := parseScenarioRecords(v)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", section.name, err))
+			continue
+		}
+		if got, want := recordStrings(section.records), recordStrings(want); strings.Join(got, "\n") != strings.Join(want, "\n") {
+			problems = append(problems, fmt.Sprintf("expected %s\n\t%s\ngot\n\t%s", section.name, strings.Join(want, "\n\t"), strings.Join(got, "\n\t")))
+		}
+	}
+	return problems
+}
+
+// headerFlags lists the flags set in h in order
+func headerFlags(h dnsmessage.Header) []string {
+	var flags []string
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"aa", h.Authoritative}, {"ad", h.AuthenticData}, {"cd", h.CheckingDisabled},
+		{"qr", h.Response}, {"ra", h.RecursionAvailable}, {"rd", h.RecursionDesired}, {"tc", h.Truncated},
+	} {
+		if f.set {
+			flags = append(flags, f.name)
+		}
+	}
+	return flags
+}
+
+// recordStrings returns records in master file format with canonical owner
+// names, sorted so the order of the records doesn't matter
+func recordStrings(records []dnsmessage.Resource) []string {
+	lines := []string{}
+	for _, rr := range records {
+		rr.Name = canonicalName(rr.Name)
+		lines = append(lines, rr.String())
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// yamlList returns the items of a sequence, nothing for an empty value
+func yamlList(v any) []any {
+	switch v := v.(type) {
+	case []any:
+		return v
+	case string:
+		if v != "" {
+			return []any{v}
+		}
+	}
+	return nil
+}
+
+// yamlStrings returns a mapping of scalars as strings, sequences joined with sep
+func yamlStrings(v any, sep string) (map[string]string, error) {
+	values := make(map[string]string)
+	if v == nil || v == "" {
+		return values, nil
+	}
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("expected a mapping")
+	}
+	for key, value := range m {
+		switch value := value.(type) {
+		case string:
+			values[key] = value
+		case []any:
+			var items []string
+			for _, item := range value {
+				items = append(items, fmt.Sprint(item))
+			}
+			values[key] = strings.Join(items, sep)
+		default:
+			return nil, fmt.Errorf("%s: expected a scalar or a sequence", key)
+		}
+	}
+	return values, nil
+}
+
+// yamlOnly rejects keys of m not in keys, catching typos in scenarios
+func yamlOnly(m map[string]any, keys ...string) error {
+	for key := range m {
+		found := false
+		for _, k := range keys {
+			found = found || k == key
+		}
+		if !found {
+			return fmt.Errorf("unknown key %s", key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// SearchList expands short names with search domains on behalf of clients that
+// don't do it themselves, like the search and ndots options of resolv.conf
+type SearchList struct {
+	Domains []string
+	// NDots is the number of dots below which a name is expanded
+	NDots int
+}
+
+// NewSearchList creates a search list from a comma separated list of domains
+func NewSearchList(domains string, ndots int) (*SearchList, error) {
+	if ndots < 1 {
+		return nil, fmt.Errorf("ndots must be at least 1, got %d", ndots)
+	}
+	l := &SearchList{NDots: ndots}
+	for _, d := range splitList(domains) {
+		if d = strings.Trim(d, "."); d != "" {
+			l.Domains = append(l.Domains, d)
+		}
+	}
+	if len(l.Domains) == 0 {
+		return nil, fmt.Errorf("no search domains in %q", domains)
+	}
+	return l, nil
+}
+
+// applies reports whether question should be expanded
+func (l *SearchList) applies(question dnsmessage.Question) bool {
+	if l == nil || question.Name == dnsmessage.Root || question.Class != dnsmessage.ClassINET {
+		return false
+	}
+	return labelCount(canonicalName(question.Name))-1 < l.NDots
+}
+
+// resolveSearch tries each search domain in order and answers with the first
+// expansion that has data. The owner name the client asked for is kept by
+// prefixing the answer with a CNAME to the expanded name. If no expansion has
+// data, the name is resolved as given.
+func (s *Server) resolveSearch(ctx context.Context, question dnsmessage.Question, recursionDesired bool, options []dnsmessage.Option) (*dnsmessage.Message, error) {
+	for _, domain := range s.Search.Domains {
+		expanded := question
+		expanded.Name = strings.TrimSuffix(question.Name, ".") + "." + domain
+
+		resp, err := s.lookup(ctx, expanded, recursionDesired, options)
+		if err != nil || resp.RCode != dnsmessage.RCodeSuccess || len(resp.Answers) == 0 {
+			continue
+		}
+
+		alias := dnsmessage.Resource{
+			Name:  question.Name,
+			Type:  dnsmessage.TypeCNAME,
+			Class: dnsmessage.ClassINET,
+			TTL:   resp.Answers[0].TTL,
+			Data:  &dnsmessage.CNAME{Target: expanded.Name},
+		}
+		expandedResp := *resp
+		expandedResp.Answers = append([]dnsmessage.Resource{alias}, resp.Answers...)
+		return &expandedResp, nil
+	}
+	return s.lookup(ctx, question, recursionDesired, options)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+func TestSearchListExpansion(t *testing.T) {
+	upstream := dnstest.StartUDPServer(t, func(q *dnsmessage.Message) *dnsmessage.Message {
+		if q.Questions[0].Name == "nas.home.arpa" {
+			return answerA("192.168.1.10")(q)
+		}
+		return &dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: q.ID, Response: true, RCode: dnsmessage.RCodeNameError},
+			Questions: q.Questions,
+		}
+	}).Addr
+	s := newTestServer(t, upstream)
+	var err error
+	if s.Search, err = NewSearchList("lan, home.arpa.", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := handle(s, testQuery("nas"))
+	if resp.RCode != dnsmessage.RCodeSuccess || len(resp.Answers) != 2 {
+		t.Fatalf("Expected CNAME and A answers, got %s", resp)
+	}
+	cname, ok := resp.Answers[0].Data.(*dnsmessage.CNAME)
+	if !ok || resp.Answers[0].Name != "nas" || cname.Target != "nas.home.arpa" {
+		t.Errorf("Expected CNAME nas -> nas.home.arpa, got %s", resp.Answers[0])
+	}
+	if resp.Answers[1].Data.String() != "192.168.1.10" {
+		t.Errorf("Unexpected address answer %s", resp.Answers[1])
+	}
+
+	// Names with enough dots and failed expansions are resolved as given
+	if resp := handle(s, testQuery("nas.example")); resp.RCode != dnsmessage.RCodeNameError {
+		t.Errorf("Expected NXDOMAIN for a qualified name, got %s", resp.RCode)
+	}
+	if resp := handle(s, testQuery("printer")); resp.RCode != dnsmessage.RCodeNameError || len(resp.Answers) != 0 {
+		t.Errorf("Expected NXDOMAIN when no expansion matches, got %s", resp)
+	}
+}
+
+func TestSearchListApplies(t *testing.T) {
+	l, err := NewSearchList("lan", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{"nas": true, "nas.lab": true, "nas.lab.": true, "a.b.c": false, ".": false} {
+		if got := l.applies(question(name, dnsmessage.TypeA)); got != want {
+			t.Errorf("applies(%q) = %v, want %v", name, got, want)
+		}
+	}
+	if _, err := NewSearchList(" , ", 1); err == nil {
+		t.Error("Expected an empty search list to be rejected")
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+const (
+	// secondaryRetry is how long to wait before trying again to get a zone
+	// that was never transferred, its SOA timers are not known yet
+	secondaryRetry = 30 * time.Second
+	// secondaryMinRefresh keeps small SOA timers from flooding the primary
+	secondaryMinRefresh = 5 * time.Second
+	// soaQueryTimeout bounds the SOA query asking the primary for its serial
+	soaQueryTimeout = 5 * time.Second
+)
+
+// Secondary serves a zone transferred from its primary server, refreshing it
+// by the SOA timers and whenever the primary sends a NOTIFY
+// (https://www.rfc-editor.org/rfc/rfc1996). An expired zone, one that could
+// not be refreshed within the SOA expire time, is answered with SERVFAIL.
+type Secondary struct {
+	Origin  string
+	Primary string
+	// Key signs the transfers, nil leaves them unsigned
+	Key *tsigKey
+
+	zone    atomic.Pointer[secondaryZone]
+	refresh chan struct{}
+	done    chan struct{}
+	once    sync.Once
+	now     func() time.Time
+}
+
+// secondaryZone is a transferred version of the zone
+type secondaryZone struct {
+	records []dnsmessage.Resource
+	soa     *dnsmessage.SOA
+	data    *LocalData
+	// expires is when the zone is no longer served without a refresh
+	expires time.Time
+}
+
+// parseSecondaries parses comma separated <origin>=<ip>:<port>[/<key>] naming
+// the primary server of each secondary zone and the key of keys signing the
+// transfers
+func parseSecondaries(s string, keys *TSIGKeys) ([]*Secondary, error) {
+	var secondaries []*Secondary
+	for _, spec := range splitList(s) {
+		origin, primary, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected <origin>=<ip>:<port>[/<key>], got %q", spec)
+		}
+		primary, keyName, signed := strings.Cut(primary, "/")
+		if _, err := netip.ParseAddrPort(primary); err != nil {
+			return nil, fmt.Errorf("primary of %s: %w", origin, err)
+		}
+		sec := NewSecondary(origin, primary)
+		if signed {
+			if sec.Key = keys.key(keyName); sec.Key == nil {
+				return nil, fmt.Errorf("key of %s: no -tsig-key named %q", origin, keyName)
+			}
+		}
+		secondaries = append(secondaries, sec)
+	}
+	return secondaries, nil
+}
+
+// NewSecondary creates the secondary of zone origin, start begins transferring it
+func NewSecondary(origin, primary string) *Secondary {
+	return &Secondary{
+		Origin:  canonicalName(origin),
+		Primary: primary,
+		refresh: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		now:     time.Now,
+	}
+}
+
+// start transfers the zone in the background and keeps it up to date until Close
+func (s *Secondary) start() {
+	go func() {
+		for {
+			wait := s.refreshZone(context.Background())
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-s.refresh:
+				timer.Stop()
+			case <-s.done:
+				timer.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// Close stops refreshing the zone
+func (s *Secondary) Close() {
+	if s != nil {
+		s.once.Do(func() { close(s.done) })
+	}
+}
+
+// notify asks for a refresh as soon as possible
+func (s *Secondary) notify() {
+	select {
+	case s.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// refreshZone brings the zone up to date with the primary and returns how long
+// to wait before the next refresh
+func (s *Secondary) refreshZone(ctx context.Context) time.Duration {
+	zone := s.zone.Load()
+	if zone == nil {
+		if err := s.transfer(ctx, nil); err != nil {
+			log.Printf("Failed to transfer zone %s from %s: %v", dnsmessage.FQDN(s.Origin), s.Primary, err)
+			return secondaryRetry
+		}
+		return s.timer(s.zone.Load().soa.Refresh)
+	}
+
+	serial, err := s.primarySerial(ctx)
+	if err == nil && serialNewer(serial, zone.soa.Serial) {
+		err = s.transfer(ctx, zone)
+	}
+	if err != nil {
+		log.Printf("Failed to refresh zone %s from %s: %v", dnsmessage.FQDN(s.Origin), s.Primary, err)
+		if !s.now().Before(zone.expires) {
+			log.Printf("WARNING: zone %s expired, answering SERVFAIL until it is refreshed", dnsmessage.FQDN(s.Origin))
+		}
+		return s.timer(zone.soa.Retry)
+	}
+	if s.zone.Load() == zone {
+		// Up to date, the zone is good for another expire time
+		s.zone.Store(&secondaryZone{records: zone.records, soa: zone.soa, data: zone.data, expires: s.now().Add(time.Duration(zone.soa.Expire) * time.Second)})
+	}
+	return s.timer(s.zone.Load().soa.Refresh)
+}
+
+func (s *Secondary) timer(seconds uint32) time.Duration {
+	return max(time.Duration(seconds)*time.Second, secondaryMinRefresh)
+}
+
+// primarySerial asks the primary for the serial of the zone
+func (s *Secondary) primarySerial(ctx context.Context) (uint32, error) {
+	ctx, cancel := context.WithTimeout(ctx, soaQueryTimeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", s.Primary)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	query := &dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: newQueryID()},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.FQDN(s.Origin), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET}},
+	}
+	resp, _, err := exchangeConn(conn, query)
+	if err != nil {
+		return 0, err
+	}
+	for _, rr := range resp.Answers {
+		if soa, ok := rr.Data.(*dnsmessage.SOA); ok && canonicalName(rr.Name) == s.Origin {
+			return soa.Serial, nil
+		}
+	}
+	return 0, fmt.Errorf("no SOA record in the answer, got %s", resp.RCode)
+}
+
+// transfer gets a new version of the zone: incrementally when there is one
+// already, falling back to a full transfer
+func (s *Secondary) transfer(ctx context.Context, current *secondaryZone) error {
+	var t *transfer
+	var err error
+	var records []dnsmessage.Resource
+	if current != nil {
+		soa := current.data.zones[s.Origin]
+		t, err = requestTransfer(ctx, s.Primary, s.Origin, dnsmessage.TypeIXFR, &soa, s.Key)
+		switch {
+		case err != nil:
+		case t.UpToDate:
+			return nil
+		case t.Records != nil:
+			records = t.Records
+		default:
+			records, err = applyDiffs(current.records, t.Diffs)
+		}
+		if err != nil {
+			log.Printf("Incremental transfer of zone %s failed, transferring it fully: %v", dnsmessage.FQDN(s.Origin), err)
+		}
+	}
+	if records == nil {
+		if t, err = requestTransfer(ctx, s.Primary, s.Origin, dnsmessage.TypeAXFR, nil, s.Key); err != nil {
+			return err
+		}
+		records = t.Records
+	}
+
+	for i := range records {
+		records[i].Name = canonicalName(records[i].Name)
+	}
+	data := NewLocalData()
+	if err := data.AddZone(s.Origin, records); err != nil {
+		return err
+	}
+	soa := data.zones[s.Origin].Data.(*dnsmessage.SOA)
+	s.zone.Store(&secondaryZone{records: records, soa: soa, data: data, expires: s.now().Add(time.Duration(soa.Expire) * time.Second)})
+	log.Printf("Transferred zone %s serial %d with %d records from %s", dnsmessage.FQDN(s.Origin), soa.Serial, len(records), s.Primary)
+	return nil
+}
+
+// answer returns the answer for question from the zone, SERVFAIL while the
+// zone is not transferred yet or expired
+func (s *Secondary) answer(question dnsmessage.Question) *dnsmessage.Message {
+	zone := s.zone.Load()
+	if zone == nil || !s.now().Before(zone.expires) {
+		return &dnsmessage.Message{Header: dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeServerFailure}}
+	}
+	return zone.data.answer(question)
+}
+
+// secondaryFor returns the most specific secondary zone containing name, or nil
+func (s *Server) secondaryFor(name string) *Secondary {
+	var found *Secondary
+	for _, sec := range s.Secondaries {
+		if isSubdomain(name, sec.Origin) && (found == nil || labelCount(sec.Origin) > labelCount(found.Origin)) {
+			found = sec
+		}
+	}
+	return found
+}
+
+// secondary returns the secondary zone with the given origin, or nil
+func (s *Server) secondary(origin string) *Secondary {
+	if s == nil {
+		return nil
+	}
+	for _, sec := range s.Secondaries {
+		if sec.Origin == origin {
+			return sec
+		}
+	}
+	return nil
+}
+
+// answerSecondary returns the answer for question from the secondary zones, or nil
+func (s *Server) answerSecondary(question dnsmessage.Question) *dnsmessage.Message {
+	if question.Class != dnsmessage.ClassINET {
+		return nil
+	}
+	sec := s.secondaryFor(question.Name)
+	if sec == nil {
+		return nil
+	}
+	return sec.answer(question)
+}
+
+// handleNotify answers a NOTIFY for a secondary zone, if it comes from the
+// primary of the zone its refresh is brought forward
+func (s *Server) handleNotify(qc *QueryContext) *dnsmessage.Message {
+	reply := createDNSReply(qc.Query)
+	reply.RCode = dnsmessage.RCodeSuccess
+	reply.RecursionAvailable = false
+	if len(qc.Query.Questions) != 1 || qc.Query.Questions[0].Type != dnsmessage.TypeSOA {
+		reply.RCode = dnsmessage.RCodeFormatError
+		return reply
+	}
+	sec := s.secondaryFor(canonicalName(qc.Query.Questions[0].Name))
+	if sec == nil || canonicalName(qc.Query.Questions[0].Name) != sec.Origin {
+		reply.RCode = dnsmessage.RCodeRefused
+		return reply
+	}
+	primary, _ := netip.ParseAddrPort(sec.Primary)
+	if qc.Client.Addr().Unmap() != primary.Addr().Unmap() {
+		log.Printf("Ignoring NOTIFY for %s from %s, it is not the primary", dnsmessage.FQDN(sec.Origin), qc.Client)
+		reply.RCode = dnsmessage.RCodeRefused
+		return reply
+	}
+	log.Printf("Received NOTIFY for %s from %s", dnsmessage.FQDN(sec.Origin), qc.Client)
+	reply.Authoritative = true
+	sec.notify()
+	return reply
+}
+
+// zoneState describes the secondary zone for state dumps
+func (s *Secondary) zoneState() ZoneState {
+	state := ZoneState{Origin: s.Origin, Primary: s.Primary}
+	if zone := s.zone.Load(); zone != nil {
+		state.Serial = zone.soa.Serial
+		state.Records = len(zone.records)
+		state.Expired = !s.now().Before(zone.expires)
+	}
+	return state
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+// fakePrimary serves versions of example.com: the SOA over UDP, AXFR with the
+// latest version and IXFR with the diffs from the version of the client
+type fakePrimary struct {
+	mu       sync.Mutex
+	versions [][]dnsmessage.Resource
+	requests []dnsmessage.Type
+}
+
+func serialSOA(serial uint32) dnsmessage.Resource {
+	soa := soaRecord("example.com", 3600, 300)
+	data := *soa.Data.(*dnsmessage.SOA)
+	data.Serial, data.Refresh, data.Retry, data.Expire = serial, 60, 30, 600
+	soa.Data = &data
+	return soa
+}
+
+func (p *fakePrimary) latest() []dnsmessage.Resource {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.versions[len(p.versions)-1]
+}
+
+// transfer returns the messages answering an AXFR or IXFR, the records of
+// full transfers are split over two messages
+func (p *fakePrimary) transfer(query *dnsmessage.Message) []*dnsmessage.Message {
+	p.mu.Lock()
+	p.requests = append(p.requests, query.Questions[0].Type)
+	versions := p.versions
+	p.mu.Unlock()
+	latest := versions[len(versions)-1]
+	reply := func(records []dnsmessage.Resource) *dnsmessage.Message {
+		return &dnsmessage.Message{Header: dnsmessage.Header{ID: query.ID, Response: true, Authoritative: true}, Questions: query.Questions, Answers: records}
+	}
+
+	if query.Questions[0].Type == dnsmessage.TypeIXFR {
+		from := query.Authorities[0].Data.(*dnsmessage.SOA).Serial
+		if from == uint32(len(versions)) {
+			return []*dnsmessage.Message{reply(latest[:1])}
+		}
+		records := []dnsmessage.Resource{latest[0]}
+		for _, v := range versions[from:] {
+			old := versions[v[0].Data.(*dnsmessage.SOA).Serial-2]
+			records = append(records, old[0])
+			for _, rr := range old[1:] {
+				if !containsRecord(v, rr) {
+					records = append(records, rr)
+				}
+			}
+			records = append(records, v[0])
+			for _, rr := range v[1:] {
+				if !containsRecord(old, rr) {
+					records = append(records, rr)
+				}
+			}
+		}
+		return []*dnsmessage.Message{reply(append(records, latest[0]))}
+	}
+	half := len(latest) / 2
+	second := reply(append(append([]dnsmessage.Resource(nil), latest[half:]...), latest[0]))
+	second.Questions = nil
+	return []*dnsmessage.Message{reply(latest[:half]), second}
+}
+
+func startFakePrimary(t *testing.T, p *fakePrimary) string {
+	t.Helper()
+	addr := dnstest.StartUDPServer(t, func(q *dnsmessage.Message) *dnsmessage.Message {
+		return &dnsmessage.Message{Header: dnsmessage.Header{ID: q.ID, Response: true, Authoritative: true}, Questions: q.Questions, Answers: p.latest()[:1]}
+	}).Addr
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			data, err := readTCPMessage(conn)
+			var query dnsmessage.Message
+			if err == nil && query.Unpack(data) == nil {
+				for _, msg := range p.transfer(&query) {
+					packed, _ := msg.Pack()
+					writeTCPMessage(conn, packed)
+				}
+			}
+			conn.Close()
+		}
+	}()
+	return addr
+}
+
+func TestSecondaryTransfers(t *testing.T) {
+	p := &fakePrimary{versions: [][]dnsmessage.Resource{
+		{serialSOA(1), aRecord("www.example.com", "192.0.2.1"), aRecord("ftp.example.com", "192.0.2.3"), aRecord("ftp.example.com", "192.0.2.4")},
+	}}
+	addr := startFakePrimary(t, p)
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	sec := NewSecondary("example.com", addr)
+	sec.now = clock.Now
+	ctx := context.Background()
+
+	if resp := sec.answer(question("www.example.com", dnsmessage.TypeA)); resp.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf("Expected SERVFAIL before the first transfer, got %+v", resp)
+	}
+	if wait := sec.refreshZone(ctx); wait != time.Minute {
+		t.Errorf("Expected the next refresh after the SOA refresh time, got %s", wait)
+	}
+	if resp := sec.answer(question("ftp.example.com", dnsmessage.TypeA)); len(resp.Answers) != 2 || !resp.Authoritative {
+		t.Errorf("Expected both addresses of the transferred zone, got %+v", resp)
+	}
+
+	// Nothing changed, the IXFR is not even requested
+	sec.refreshZone(ctx)
+	p.mu.Lock()
+	p.versions = append(p.versions, []dnsmessage.Resource{serialSOA(2), aRecord("www.example.com", "192.0.2.1"), aRecord("ftp.example.com", "192.0.2.3")})
+	p.versions = append(p.versions, []dnsmessage.Resource{serialSOA(3), aRecord("www.example.com", "192.0.2.1"), aRecord("mail.example.com", "192.0.2.5")})
+	p.mu.Unlock()
+	sec.refreshZone(ctx)
+	if resp := sec.answer(question("ftp.example.com", dnsmessage.TypeA)); resp.RCode != dnsmessage.RCodeNameError {
+		t.Errorf("Expected ftp to be deleted by the diffs, got %+v", resp)
+	}
+	if resp := sec.answer(question("mail.example.com", dnsmessage.TypeA)); len(resp.Answers) != 1 {
+		t.Errorf("Expected mail to be added by the diffs, got %+v", resp)
+	}
+	if state := sec.zoneState(); state.Serial != 3 || state.Records != 3 {
+		t.Errorf("Expected serial 3 with 3 records, got %+v", state)
+	}
+	if want := []dnsmessage.Type{dnsmessage.TypeAXFR, dnsmessage.TypeIXFR}; len(p.requests) != 2 || p.requests[0] != want[0] || p.requests[1] != want[1] {
+		t.Errorf("Expected an AXFR then an IXFR, got %v", p.requests)
+	}
+
+	// Without the primary the zone expires after the SOA expire time
+	sec.Primary = closedUDPAddr(t)
+	clock.Advance(599 * time.Second)
+	if resp := sec.answer(question("www.example.com", dnsmessage.TypeA)); len(resp.Answers) != 1 {
+		t.Errorf("Expected the zone to be served until it expires, got %+v", resp)
+	}
+	if wait := sec.refreshZone(ctx); wait != 30*time.Second {
+		t.Errorf("Expected a retry after the SOA retry time, got %s", wait)
+	}
+	clock.Advance(time.Second)
+	if resp := sec.answer(question("www.example.com", dnsmessage.TypeA)); resp.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf("Expected SERVFAIL once the zone expired, got %+v", resp)
+	}
+}
+
+func TestSecondaryNotify(t *testing.T) {
+	sec := NewSecondary("example.com", "127.0.0.1:5300")
+	s := &Server{Secondaries: []*Secondary{sec}}
+	notify := func(client, zone string) *dnsmessage.Message {
+		return s.Handle(context.Background(), &QueryContext{Client: netip.MustParseAddrPort(client), Transport: "udp", Query: &dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: 7, Opcode: dnsmessage.OpcodeNotify, Authoritative: true},
+			Questions: []dnsmessage.Question{question(zone, dnsmessage.TypeSOA)},
+		}})
+	}
+
+	resp := notify("127.0.0.1:40000", "Example.com.")
+	if resp.RCode != dnsmessage.RCodeSuccess || resp.Opcode != dnsmessage.OpcodeNotify || !resp.Response || resp.ID != 7 {
+		t.Errorf("Expected the NOTIFY of the primary to be acknowledged, got %+v", resp)
+	}
+	select {
+	case <-sec.refresh:
+	default:
+		t.Error("Expected the NOTIFY to trigger a refresh")
+	}
+	if resp := notify("192.0.2.99:40000", "example.com"); resp.RCode != dnsmessage.RCodeRefused {
+		t.Errorf("Expected a NOTIFY from another address to be refused, got %s", resp.RCode)
+	}
+	if resp := notify("127.0.0.1:40000", "other.example"); resp.RCode != dnsmessage.RCodeRefused {
+		t.Errorf("Expected a NOTIFY for another zone to be refused, got %s", resp.RCode)
+	}
+	if len(sec.refresh) != 0 {
+		t.Error("Expected refused NOTIFY messages not to trigger a refresh")
+	}
+}
+
+func TestSerialNewer(t *testing.T) {
+	tests := []struct {
+		a, b uint32
+		want bool
+	}{
+		{2, 1, true},
+		{1, 2, false},
+		{1, 1, false},
+		// Serials wrap around
+		{0, 0xFFFFFFFF, true},
+		{0xFFFFFFFF, 0, false},
+	}
+	for _, tt := range tests {
+		if got := serialNewer(tt.a, tt.b); got != tt.want {
+			t.Errorf("serialNewer(%d, %d) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestSecondarySignedTransfers(t *testing.T) {
+	p := &fakePrimary{versions: [][]dnsmessage.Resource{{serialSOA(1), aRecord("www.example.com", "192.0.2.1")}}}
+	secondaries, err := parseSecondaries("example.com="+startFakePrimary(t, p)+"/test-key", testKeys(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sec := secondaries[0]
+	if sec.Key == nil || sec.Key.Name != "test-key" {
+		t.Fatalf("Expected the secondary to sign with test-key, got %+v", sec.Key)
+	}
+	// The fake primary does not sign its answers
+	sec.refreshZone(context.Background())
+	if sec.zone.Load() != nil {
+		t.Error("Expected an unsigned transfer to be rejected")
+	}
+
+	if _, err := parseSecondaries("example.com=127.0.0.1:53/missing", testKeys(t)); err == nil {
+		t.Error("Expected a secondary with an unknown key to be rejected")
+	}
+}
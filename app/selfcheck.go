@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// capNetBindService is the capability bit allowing to bind ports below 1024
+const capNetBindService = 10
+
+// privilegedPort reports whether binding port requires privileges
+func privilegedPort(port int) bool {
+	return port > 0 && port < 1024
+}
+
+// startupCheck looks for problems that would make binding addr fail and
+// returns a description of each with how to fix it
+func startupCheck(addr string) []string {
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return []string{fmt.Sprintf("Invalid listen address %q: %v, expected <ip>:<port>", addr, err)}
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	var problems []string
+	if privilegedPort(port) && os.Geteuid() != 0 {
+		if has, known := hasCapability(capNetBindService); known && !has {
+			problems = append(problems, fmt.Sprintf("Port %d is privileged and the process lacks CAP_NET_BIND_SERVICE. %s", port, capabilityHint()))
+		}
+	}
+	return problems
+}
+
+// explainBindError adds remediation guidance for the common reasons binding
+// addr over network fails
+func explainBindError(network, addr string, err error) error {
+	_, portStr, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(portStr)
+
+	switch {
+	case errors.Is(err, syscall.EADDRINUSE):
+		hint := fmt.Sprintf("Another process already listens on %s/%d, find it with `ss -lnp 'sport = :%d'`", network, port, port)
+		if port == 53 && systemdResolvedRunning() {
+			hint = "systemd-resolved runs a stub resolver on port 53. Disable it by setting DNSStubListener=no " +
+				"in /etc/systemd/resolved.conf and running `systemctl restart systemd-resolved`, " +
+				"or listen on a specific address that does not conflict with 127.0.0.53."
+		}
+		return fmt.Errorf("%w\n%s", err, hint)
+	case errors.Is(err, syscall.EACCES) && privilegedPort(port):
+		return fmt.Errorf("%w\nPort %d is privileged. %s", err, port, capabilityHint())
+	case errors.Is(err, syscall.EADDRNOTAVAIL):
+		return fmt.Errorf("%w\nThe address of %s is not assigned to any interface, check it with `ip addr`", err, addr)
+	}
+	return err
+}
+
+func capabilityHint() string {
+	exe, err := os.Executable()
+	if err != nil {
+		exe = "<binary>"
+	}
+	return fmt.Sprintf("Grant the capability with `sudo setcap cap_net_bind_service=+ep %s`, "+
+		"add AmbientCapabilities=CAP_NET_BIND_SERVICE to the systemd unit, or listen on a port above 1023.", exe)
+}
+
+// hasCapability reports whether the process has the effective capability bit.
+// known is false when capabilities can't be inspected, e.g. outside of Linux.
+func hasCapability(bit uint) (has, known bool) {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return false, false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		value, ok := strings.CutPrefix(scanner.Text(), "CapEff:")
+		if !ok {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		if err != nil {
+			return false, false
+		}
+		return caps&(1<<bit) != 0, true
+	}
+	return false, false
+}
+
+// systemdResolvedRunning reports whether systemd-resolved appears to be active
+func systemdResolvedRunning() bool {
+	_, err := os.Stat("/run/systemd/resolve/stub-resolv.conf")
+	return err == nil
+}
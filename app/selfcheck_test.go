@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestExplainBindErrorAddressInUse(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	addr := conn.LocalAddr().String()
+
+	_, err = net.ListenPacket("udp", addr)
+	if err == nil {
+		t.Fatal("Expected the second bind to fail")
+	}
+	explained := explainBindError("udp", addr, err)
+	if !errors.Is(explained, syscall.EADDRINUSE) {
+		t.Errorf("Expected the original error to be wrapped, got %v", explained)
+	}
+	if !strings.Contains(explained.Error(), "ss -lnp") {
+		t.Errorf("Expected a hint to find the conflicting process, got %v", explained)
+	}
+}
+
+func TestExplainBindErrorPrivilegedPort(t *testing.T) {
+	err := explainBindError("udp", "0.0.0.0:53", &net.OpError{Op: "listen", Net: "udp", Err: syscall.EACCES})
+	if !strings.Contains(err.Error(), "cap_net_bind_service") {
+		t.Errorf("Expected a capability hint, got %v", err)
+	}
+	// Not a privileged port, nothing to add
+	plain := &net.OpError{Op: "listen", Net: "udp", Err: syscall.EACCES}
+	if err := explainBindError("udp", "0.0.0.0:2053", plain); err != error(plain) {
+		t.Errorf("Expected the error unchanged, got %v", err)
+	}
+}
+
+func TestStartupCheck(t *testing.T) {
+	if problems := startupCheck("127.0.0.1:2053"); len(problems) != 0 {
+		t.Errorf("Expected no problems for an unprivileged port, got %v", problems)
+	}
+	if problems := startupCheck("127.0.0.1"); len(problems) != 1 {
+		t.Errorf("Expected the missing port to be reported, got %v", problems)
+	}
+}
@@ -0,0 +1,926 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// RootPolicy decides how queries for the root zone itself are answered
+type RootPolicy string
+
+const (
+	// RootForward sends root queries upstream like any other name
+	RootForward RootPolicy = "forward"
+	// RootHints answers root NS and SOA queries from the built in root hints
+	RootHints RootPolicy = "hints"
+	// RootRefuse answers root queries with REFUSED
+	RootRefuse RootPolicy = "refuse"
+)
+
+// ParseRootPolicy validates a root policy name
+func ParseRootPolicy(s string) (RootPolicy, error) {
+	switch p := RootPolicy(s); p {
+	case RootForward, RootHints, RootRefuse:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown root policy %q (expected forward, hints or refuse)", s)
+}
+
+// Server answers DNS queries, forwarding what it can't answer itself
+type Server struct {
+	Forwarder *Forwarder
+	// Iterator resolves the queries without a route from the root servers
+	// down instead of the Forwarder, nil forwards them
+	Iterator *Iterator
+	// Routes send some queries to other upstreams, most specific first
+	Routes     []*Route
+	RootPolicy RootPolicy
+	// AnyPolicy minimizes the answers to ANY queries over UDP, empty answers
+	// them in full
+	AnyPolicy AnyPolicy
+	// Chaos answers the CHAOS queries for the version and identity of the
+	// server, nil passes them on like other queries
+	Chaos *Chaos
+	// Cache holds positive and negative upstream answers, nil disables caching
+	Cache *Cache
+	// Validator checks the DNSSEC signatures of upstream answers, nil passes
+	// them on unchecked
+	Validator *Validator
+	// EDNSPolicy decides which EDNS options of client queries are honored,
+	// forwarded or echoed, nil only honors them
+	EDNSPolicy *EDNSPolicy
+	// ECSPrefix is sent upstream as client subnet on behalf of the clients
+	// whose ECS option is honored, the zero prefix sends none
+	ECSPrefix netip.Prefix
+	// Signer signs the answers from local zones for clients asking for DNSSEC
+	// records, nil leaves them unsigned
+	Signer *Signer
+	// Search expands short names with search domains, nil disables expansion
+	Search *SearchList
+	// Views answer some clients with other local data, blocklists and routes
+	Views []*View
+	// NXRedirect rewrites NXDOMAIN answers for selected clients, nil disables it
+	NXRedirect *NXRedirect
+	// DNS64 synthesizes AAAA answers for names with IPv4 addresses only, nil
+	// disables it
+	DNS64 *DNS64
+
+	// QueryACL lists the clients allowed to query at all, nil allows everybody
+	QueryACL *ACL
+	// RecursionACL lists the clients allowed to get answers that are not served
+	// locally, nil allows everybody
+	RecursionACL *ACL
+
+	// Finalize is called with the reply to every query just before it is
+	// signed and sent, for embedders to change it or to veto it by returning
+	// nil, nothing is sent then. nil sends replies as they are built.
+	Finalize func(*QueryContext, *dnsmessage.Message) *dnsmessage.Message
+
+	// Cookies generate and check the DNS cookies of clients, and have cookies
+	// sent to the upstreams, nil ignores cookies
+	Cookies *Cookies
+
+	// RateLimit limits the UDP queries per client network, nil disables it
+	RateLimit *RateLimiter
+	// Storms detects NXDOMAIN storms against zones and rate limits them harder
+	// while they last, nil disables detection
+	Storms *StormDetector
+
+	// Firewall blocks names on blocklists, nil disables blocking
+	Firewall *Firewall
+	// FirewallStats holds the hit counters of the blocklist and ACL rules
+	FirewallStats *FirewallStats
+
+	// Captive answers address queries with a portal address, nil disables it
+	Captive *CaptivePortal
+
+	// LocalData answers from zone and hosts files, nil disables it
+	LocalData *LocalData
+	// UpdateACL lists the clients allowed to update the zones of LocalData
+	// dynamically, nil refuses every update
+	UpdateACL *ACL
+	// UpdateKeys are the TSIG keys updates may be signed with instead of
+	// coming from UpdateACL
+	UpdateKeys []string
+	// PersistUpdates writes updated zones back to their zone files
+	PersistUpdates bool
+	// TransferACL lists the clients allowed to transfer the zones of
+	// LocalData and the secondary zones, nil refuses every transfer
+	TransferACL *ACL
+	// TransferKeys are the TSIG keys transfer requests may be signed with
+	// instead of coming from TransferACL
+	TransferKeys []string
+	// Notifier sends NOTIFY messages to the secondaries of the local zones
+	// when they change, nil notifies nobody
+	Notifier *Notifier
+	// TSIGKeys verify signed queries, their replies are signed with the same
+	// key. Without keys signed queries are answered with BADKEY.
+	TSIGKeys *TSIGKeys
+
+	// Secondaries serve the zones transferred from primary servers
+	Secondaries []*Secondary
+
+	// LocalZones answers reverse queries for private address space, nil forwards them
+	LocalZones *LocalZones
+
+	// Rotate reorders the addresses of every answer, nil keeps their order
+	Rotate *Rotator
+
+	// Mirror copies a sample of the queries to another server, nil disables it
+	Mirror *Mirror
+
+	// Delays hold answers back for some domains, nil answers right away
+	Delays *Delays
+
+	// Reload re-reads the configuration for the admin API, nil disables reloading
+	Reload func() error
+	// Modes hold the read-only, maintenance and blocking toggles, nil leaves
+	// them as configured
+	Modes *Modes
+	// QueryStats counts the queries per name, client and domain, nil counts
+	// nothing
+	QueryStats *QueryStats
+	// Truncation counts the UDP answers truncated per client network and
+	// domain, nil counts nothing
+	Truncation *TruncationStats
+
+	// TCP bounds the TCP connections and the queries answered on each
+	TCP TCPLimits
+	// NSID identifies the server to clients asking for it with the NSID
+	// option, empty sends none
+	NSID string
+	// UpstreamNSID asks the upstreams for their NSID, noted with the answers
+	// they give
+	UpstreamNSID bool
+	// UDPSize is the largest response sent over UDP to clients advertising an
+	// EDNS buffer at least that large, maxUDPSize when zero. Larger responses
+	// are truncated.
+	UDPSize uint16
+	// QueryTimeout bounds the time answering a query from a client takes, the
+	// answer is SERVFAIL once it passed. 0 leaves it to the upstream timeouts.
+	QueryTimeout time.Duration
+	// LogPackets logs every query with its packet and every reply, which
+	// formats them on the path of every query
+	LogPackets bool
+
+	// options are the options the server was built from, for the admin API
+	options *options
+	// changedZones are the local zones that changed with the configuration,
+	// see notifyChanged
+	changedZones []string
+
+	inflight flightGroup
+	// handlers counts the queries read but not replied to yet, see Drain
+	handlers sync.WaitGroup
+	// answering counts the queries being answered, for the runtime metrics
+	answering atomic.Int64
+	// draining is set once the server stops serving for a handoff
+	draining atomic.Bool
+	// tcpConns counts the open TCP connections, for TCPLimits.MaxConnections
+	tcpConns atomic.Int64
+	// reloaded is the server built from the latest configuration, see Swap
+	reloaded atomic.Pointer[Server]
+}
+
+// Swap atomically replaces the configuration new queries are answered with.
+// Queries already being answered finish with the configuration they started with.
+func (s *Server) Swap(next *Server) {
+	s.reloaded.Store(next)
+}
+
+// active returns the server answering new queries: the one swapped in by the
+// last reload, or s itself
+func (s *Server) active() *Server {
+	if next := s.reloaded.Load(); next != nil {
+		return next
+	}
+	return s
+}
+
+// createDNSReply builds the reply skeleton for a query: the header mirrors the ID,
+// OPCODE and RD bit of the request and the questions are echoed back
+func createDNSReply(query *dnsmessage.Message) *dnsmessage.Message {
+	reply := &dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 query.ID,
+			Response:           true,
+			Opcode:             query.Opcode,
+			RecursionDesired:   query.RecursionDesired,
+			RecursionAvailable: true,
+		},
+		Questions: query.Questions,
+	}
+	// Only standard queries are supported
+	if query.Opcode != dnsmessage.OpcodeQuery {
+		reply.RCode = dnsmessage.RCodeNotImplemented
+	}
+	return reply
+}
+
+// parseQuery unpacks a query. When only its header parses, it returns a query
+// with just that header and the error, to answer with FORMERR. Packets too
+// short for a header and responses, which must not be answered, give a nil
+// query.
+func parseQuery(data []byte) (*dnsmessage.Message, error) {
+	var query dnsmessage.Message
+	err := query.Unpack(data)
+	if err == nil {
+		return &query, nil
+	}
+	header, headerErr := dnsmessage.UnpackHeader(data)
+	if headerErr != nil || header.Response {
+		return nil, err
+	}
+	return &dnsmessage.Message{Header: header}, err
+}
+
+// formatError answers a query that doesn't parse, echoing its ID and opcode
+// (https://www.rfc-editor.org/rfc/rfc1035#section-4.1.1)
+func formatError(query *dnsmessage.Message) *dnsmessage.Message {
+	reply := createDNSReply(query)
+	reply.RCode = dnsmessage.RCodeFormatError
+	return reply
+}
+
+// QueryContext carries what is known about a query while it is being answered
+type QueryContext struct {
+	// Client is the source address of the query
+	Client netip.AddrPort
+	// Transport is the network the query arrived on, "udp" or "tcp"
+	Transport string
+	Query     *dnsmessage.Message
+	// Raw is the query in wire format as received, TSIG signatures are
+	// computed over it. Without it the query is packed again.
+	Raw []byte
+	// Key is the name of the TSIG key the query was signed with, empty when it
+	// was not signed
+	Key string
+
+	// sig signs the reply to a signed query, also once it is truncated
+	sig *signature
+}
+
+// Handle builds the reply for a parsed query, signed queries get signed
+// replies. It returns nil when no reply is to be sent at all.
+func (s *Server) Handle(ctx context.Context, qc *QueryContext) *dnsmessage.Message {
+	sig, failed := s.checkTSIG(qc)
+	if failed != nil {
+		return failed
+	}
+	qc.sig = sig
+	reply := s.Modes.intercept(qc.Query)
+	if reply == nil {
+		reply = s.viewFor(qc.Client.Addr()).handle(ctx, qc)
+	}
+	if reply != nil && len(qc.Query.Questions) > 0 {
+		s.Storms.observe(qc.Query.Questions[0], reply.RCode)
+		s.QueryStats.observe(qc.Client.Addr(), qc.Query.Questions[0])
+	}
+	if reply != nil {
+		s.Modes.trim(reply)
+	}
+	if reply != nil && s.Finalize != nil {
+		if reply = s.Finalize(qc, reply); reply == nil {
+			return nil
+		}
+	}
+	sig.sign(reply)
+	return reply
+}
+
+func (s *Server) handle(ctx context.Context, qc *QueryContext) *dnsmessage.Message {
+	ctx, provenance := withProvenance(ctx)
+	query := qc.Query
+	switch query.Opcode {
+	case dnsmessage.OpcodeNotify:
+		return s.handleNotify(qc)
+	case dnsmessage.OpcodeUpdate:
+		return s.handleUpdate(qc)
+	}
+	reply := createDNSReply(query)
+	if reply.RCode != dnsmessage.RCodeSuccess {
+		return reply
+	}
+	if isTransfer(query) {
+		// Transfers are served over TCP alone, see serveTransfer
+		reply.Truncated = true
+		return reply
+	}
+	client := qc.Client.Addr()
+	if !s.QueryACL.allows(client) {
+		reply.RCode = dnsmessage.RCodeRefused
+		reply.RecursionAvailable = false
+		return reply
+	}
+	var cookie []byte
+	if s.EDNSPolicy.honors(client, ednsOptionCookie) {
+		var valid bool
+		var err error
+		if cookie, valid, err = s.Cookies.check(client, query); err != nil {
+			reply.RCode = dnsmessage.RCodeFormatError
+			return reply
+		}
+		if qc.Transport == "udp" && !valid && s.Cookies.requires(client) {
+			return s.Cookies.refuse(reply, client, cookie)
+		}
+	}
+	// The keepalive option is only meaningful over TCP, over UDP it is ignored
+	keepalive, malformed := keepaliveQuery(query)
+	keepalive = keepalive && qc.Transport == "tcp" && s.EDNSPolicy.honors(client, ednsOptionKeepalive)
+	if keepalive && malformed {
+		reply.RCode = dnsmessage.RCodeFormatError
+		return reply
+	}
+	s.Mirror.send(query)
+	recursion := s.RecursionACL.allows(client)
+	reply.RecursionAvailable = recursion
+
+	questions, err := normalizeQuestions(query.Questions)
+	if err != nil {
+		log.Printf("Rejecting query with invalid name: %v", err)
+		reply.RCode = dnsmessage.RCodeFormatError
+		return reply
+	}
+
+	// The reply is only authoritative if every question was answered from local
+	// data, and authenticated if every answer was validated
+	reply.Authoritative = len(questions) > 0
+	do := dnssecOK(query)
+	if query.CheckingDisabled && s.Validator != nil {
+		ctx = withCheckingDisabled(ctx)
+	}
+	forward := s.upstreamOptions(client, query)
+	authenticated := s.Validator != nil && len(questions) > 0
+	// extendedErrs are the Extended DNS Errors of the answers, passed on to
+	// clients speaking EDNS
+	var extendedErrs []dnsmessage.Option
+	for _, question := range questions {
+		var resp *dnsmessage.Message
+		var err error
+		if resp = s.answerLocally(ctx, question); resp == nil {
+			if recursion {
+				resp, err = s.resolve(ctx, question, query.RecursionDesired, forward)
+			} else {
+				resp = &dnsmessage.Message{Header: dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeRefused}}
+			}
+		}
+		if err == nil {
+			resp, err = s.chaseCNAMEs(ctx, question, resp, recursion, query.RecursionDesired, forward)
+		}
+		if err == nil && s.DNS64.applies(query, question, resp) {
+			if resp, err = s.answerDNS64(ctx, question, resp, recursion, query.RecursionDesired, forward); err == nil {
+				provenance.note("DNS64 synthesis", resp)
+			}
+		}
+		if err == nil && qc.Transport == "udp" {
+			// Over TCP the full answer is given, the source address can't be
+			// spoofed there
+			if minimized := s.AnyPolicy.minimize(question, resp); minimized != resp {
+				resp = minimized
+				provenance.note("ANY minimization", resp)
+			}
+		}
+		if err == nil && do {
+			resp = s.Signer.sign(s.LocalData, question, resp)
+			provenance.note("online signer", resp)
+		}
+		if timedOut(ctx, err) {
+			queryMetrics.Add("timeouts", 1)
+			log.Printf("Timed out resolving question %s: %v", dnsmessage.UnicodeName(question.Name), err)
+		} else if err != nil {
+			queryMetrics.Add("failures", 1)
+			log.Printf("Failed to resolve question %s: %v", dnsmessage.UnicodeName(question.Name), err)
+		}
+		if err != nil {
+			reply.RCode = dnsmessage.RCodeServerFailure
+			reply.Authoritative = false
+			continue
+		}
+		reply.Authoritative = reply.Authoritative && resp.Authoritative
+		authenticated = authenticated && resp.AuthenticData
+		if s.NXRedirect.applies(client, question, resp) {
+			resp = s.NXRedirect.answer(question)
+			provenance.note("NXDOMAIN redirection", resp)
+		}
+		if resp.RCode != dnsmessage.RCodeSuccess && reply.RCode == dnsmessage.RCodeSuccess {
+			reply.RCode = resp.RCode
+		}
+		reply.Answers = append(reply.Answers, resp.Answers...)
+		reply.Authorities = append(reply.Authorities, resp.Authorities...)
+		extendedErrs = append(extendedErrs, extendedErrors(resp)...)
+		for _, r := range resp.Additionals {
+			if r.Type != dnsmessage.TypeOPT {
+				reply.Additionals = append(reply.Additionals, r)
+			}
+		}
+	}
+
+	// DNSSEC records only go to clients asking for them, while the AD bit is
+	// also set for clients asking for it alone (https://www.rfc-editor.org/rfc/rfc6840#section-5.7)
+	if !do {
+		var asked dnsmessage.Type
+		if len(questions) == 1 {
+			asked = questions[0].Type
+		}
+		reply.Answers = stripDNSSEC(reply.Answers, asked)
+		reply.Authorities = stripDNSSEC(reply.Authorities, asked)
+		reply.Additionals = stripDNSSEC(reply.Additionals, asked)
+	}
+	reply.AuthenticData = authenticated && reply.RCode != dnsmessage.RCodeServerFailure && (do || query.AuthenticData)
+	if optRecord(query) != nil {
+		opt := newOPT(s.udpSize(), do)
+		options := s.EDNSPolicy.options(client, query, ednsEcho)
+		if cookie != nil {
+			// The cookie of the client comes back with a fresh server cookie
+			options = slices.DeleteFunc(options, func(o dnsmessage.Option) bool { return o.Code == ednsOptionCookie })
+			options = append(options, s.Cookies.option(client, cookie))
+		}
+		if s.NSID != "" && hasOption(query, ednsOptionNSID) && s.EDNSPolicy.honors(client, ednsOptionNSID) {
+			options = slices.DeleteFunc(options, func(o dnsmessage.Option) bool { return o.Code == ednsOptionNSID })
+			options = append(options, nsidOption(s.NSID))
+		}
+		if keepalive {
+			options = slices.DeleteFunc(options, func(o dnsmessage.Option) bool { return o.Code == ednsOptionKeepalive })
+			options = append(options, keepaliveOption(s.TCP.idleTimeout()))
+		}
+		opt.Data = &dnsmessage.OPT{Options: append(options, extendedErrs...)}
+		reply.Additionals = append(reply.Additionals, opt)
+	}
+
+	// Questions can share RRsets, so they are harmonized again once merged
+	harmonizeTTLs(reply.Answers, "merged answers")
+	harmonizeTTLs(reply.Authorities, "merged authorities")
+	harmonizeTTLs(reply.Additionals, "merged additionals")
+	s.Rotate.apply(reply.Answers)
+	// Padding is only added over TCP, it would push UDP answers past the
+	// UDP size into truncation
+	if qc.Transport == "tcp" && hasOption(query, ednsOptionPadding) && s.EDNSPolicy.honors(client, ednsOptionPadding) {
+		if err := pad(reply); err != nil {
+			log.Printf("Failed to pad reply: %v", err)
+		}
+	}
+	for _, line := range provenance.Lines(reply) {
+		log.Printf("Answer for %s: %s", qc.Client, line)
+	}
+	s.Delays.wait(ctx, questions)
+	return reply
+}
+
+// answerLocally returns the answer for question when it is not to be
+// forwarded, noting where it came from in the provenance of ctx
+func (s *Server) answerLocally(ctx context.Context, question dnsmessage.Question) *dnsmessage.Message {
+	p := provenanceOf(ctx)
+	if resp := s.Chaos.answer(question); resp != nil {
+		p.note("CHAOS identity", resp)
+		return resp
+	}
+	if s.Modes.Blocking() {
+		if resp := s.Firewall.answer(question); resp != nil {
+			p.note("blocklist", resp)
+			return resp
+		}
+	}
+	if resp := s.Captive.answer(question); resp != nil {
+		p.note("captive portal", resp)
+		return resp
+	}
+	// Local records win over the empty reverse zones, they may well hold
+	// the PTR records of local addresses
+	if resp := s.LocalData.answer(question); resp != nil {
+		p.noteRRsets(resp, "local data", s.LocalData.sourceOf)
+		return resp
+	}
+	if resp := s.answerSecondary(question); resp != nil {
+		p.note("secondary zone, transferred from "+s.secondaryFor(question.Name).Primary, resp)
+		return resp
+	}
+	resp := s.LocalZones.answer(question)
+	p.note("empty reverse zone", resp)
+	return resp
+}
+
+// resolve answers a single question
+// with options being the EDNS options of the client passed on to upstreams
+func (s *Server) resolve(ctx context.Context, question dnsmessage.Question, recursionDesired bool, options []dnsmessage.Option) (*dnsmessage.Message, error) {
+	if question.Name == dnsmessage.Root && question.Class == dnsmessage.ClassINET && s.RootPolicy != RootForward && s.RootPolicy != "" {
+		resp := s.answerRoot(question)
+		provenanceOf(ctx).note("root hints", resp)
+		return resp, nil
+	}
+
+	if s.Search.applies(question) {
+		return s.resolveSearch(ctx, question, recursionDesired, options)
+	}
+	return s.lookup(ctx, question, recursionDesired, options)
+}
+
+// lookup answers a question from the cache or the upstreams. Answers to a
+// client subnet option passed on are cached for that subnet alone, the other
+// options don't count: cached answers are shared whichever were passed on.
+func (s *Server) lookup(ctx context.Context, question dnsmessage.Question, recursionDesired bool, options []dnsmessage.Option) (*dnsmessage.Message, error) {
+	// Answers for a client subnet are cached for it alone
+	sent, _ := clientSubnetOf(options)
+	if s.Cache != nil {
+		if resp, source, ok := s.Cache.GetFor(question, sent.Source); ok {
+			provenanceOf(ctx).note(cachedSource(source), resp)
+			if !sent.Source.IsValid() && s.Cache.prefetchDue(question) {
+				go s.prefetch(question, recursionDesired, options)
+			}
+			return resp, nil
+		}
+	}
+	resp, source, err := s.fetch(ctx, question, recursionDesired, options, sent)
+	provenanceOf(ctx).note(source, resp)
+	return resp, err
+}
+
+// fetch asks the upstreams for the answer to question and caches it,
+// returning where it came from
+func (s *Server) fetch(ctx context.Context, question dnsmessage.Question, recursionDesired bool, options []dnsmessage.Option, sent clientSubnet) (*dnsmessage.Message, string, error) {
+	// Concurrent identical lookups share one upstream round trip
+	key := flightKey{cacheKey: cacheKeyOf(question), RecursionDesired: recursionDesired, Options: optionsKey(options), CheckingDisabled: checkingDisabled(ctx)}
+	resp, source, err, _ := s.inflight.Do(ctx, key, s.QueryTimeout, func(ctx context.Context) (*dnsmessage.Message, string, error) {
+		// Upstreams generally only answer a single question per message, so each
+		// question is forwarded on its own and the answers are merged
+		upstreamQuery := &dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: newQueryID(), RecursionDesired: recursionDesired},
+			Questions: []dnsmessage.Question{question},
+		}
+		if s.Validator != nil || s.Cookies != nil || len(options) > 0 {
+			opt := newOPT(ednsUDPSize, s.Validator != nil)
+			opt.Data = &dnsmessage.OPT{Options: options}
+			upstreamQuery.Additionals = []dnsmessage.Resource{opt}
+		}
+		if s.Validator != nil {
+			// The upstream is asked for the signatures and not to drop
+			// answers failing its own validation, they are checked here
+			upstreamQuery.CheckingDisabled = true
+		}
+		upstreamCtx, p := withProvenance(ctx)
+		resp, err := s.exchange(upstreamCtx, question, upstreamQuery)
+		if errors.Is(err, errBudgetExhausted) && s.Cache != nil {
+			// Better an old answer than none while the upstream budgets recover
+			if stale, ok := s.Cache.GetStale(question); ok {
+				log.Printf("Serving stale answer for %s: %v", question.Name, err)
+				return stale, "stale cache entry", nil
+			}
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		source := p.Last()
+		if s.Validator != nil {
+			unvalidated := resp
+			if checkingDisabled(ctx) {
+				unvalidated = copyMessage(resp)
+			}
+			// Bogus answers are not cached, the next query tries again
+			if resp, err = s.Validator.validate(ctx, question, resp); err != nil {
+				if !checkingDisabled(ctx) {
+					return nil, "", err
+				}
+				log.Printf("Passing on the answer for %s to a query with checking disabled: %v", dnsmessage.UnicodeName(question.Name), err)
+				unvalidated.AuthenticData = false
+				return unvalidated, source, nil
+			}
+		}
+		if s.Cache != nil {
+			s.Cache.PutFor(question, answerScope(sent, resp), source, resp)
+		}
+		return resp, source, nil
+	})
+	return resp, source, err
+}
+
+// cachedSource describes an answer served from the cache that was stored from
+// source
+func cachedSource(source string) string {
+	if source == "" {
+		return "cache"
+	}
+	return "cache, from " + source
+}
+
+// answerRoot answers a question for the root zone according to the root policy
+func (s *Server) answerRoot(question dnsmessage.Question) *dnsmessage.Message {
+	resp := &dnsmessage.Message{Header: dnsmessage.Header{Response: true}}
+	if s.RootPolicy == RootRefuse {
+		resp.RCode = dnsmessage.RCodeRefused
+		return resp
+	}
+
+	switch question.Type {
+	case dnsmessage.TypeNS:
+		resp.Answers = rootNSRecords()
+		resp.Additionals = rootGlueRecords()
+	case dnsmessage.TypeSOA:
+		resp.Answers = []dnsmessage.Resource{rootSOARecord()}
+	default:
+		// The root has no other data, answer NODATA with the SOA for negative caching
+		resp.Authorities = []dnsmessage.Resource{rootSOARecord()}
+	}
+	return resp
+}
+
+// maxUDPSize is the largest response sent over UDP to clients without EDNS,
+// larger ones are truncated so the client retries over TCP
+// (https://www.rfc-editor.org/rfc/rfc1035#section-4.2.1)
+const maxUDPSize = 512
+
+// udpSize returns the UDP payload size the server advertises
+func (s *Server) udpSize() uint16 {
+	if s.UDPSize < maxUDPSize {
+		return maxUDPSize
+	}
+	return s.UDPSize
+}
+
+// udpLimit returns the largest UDP response to query, the EDNS buffer of the
+// client up to the UDP size of the server
+// (https://www.rfc-editor.org/rfc/rfc6891#section-6.2.3)
+func (s *Server) udpLimit(query *dnsmessage.Message) int {
+	limit := maxUDPSize
+	if opt := optRecord(query); opt != nil {
+		limit = max(limit, int(opt.Class))
+	}
+	return min(limit, int(s.udpSize()))
+}
+
+// ServeUDP reads queries from conn until it is closed, answering each in its
+// own goroutine. It returns nil when the server stops serving for a handoff.
+func (s *Server) ServeUDP(conn *net.UDPConn) error {
+	// Signed updates and queries with EDNS options may well exceed 512 bytes,
+	// the buffer takes any datagram and each query gets a copy of its own
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if s.draining.Load() {
+				return nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			log.Printf("Failed to read UDP packet: %v", err)
+			continue
+		}
+
+		data := bytes.Clone(buf[:n])
+		s.handlers.Add(1)
+		go func() {
+			defer s.handlers.Done()
+			s.handleUDP(conn, addr, data)
+		}()
+	}
+}
+
+func (s *Server) handleUDP(conn *net.UDPConn, addr *net.UDPAddr, data []byte) {
+	s.answering.Add(1)
+	defer s.answering.Add(-1)
+	client := unmapAddrPort(addr.AddrPort())
+	qc := &QueryContext{Client: client, Transport: "udp", Raw: data}
+	defer s.recoverQuery(qc, func(packed []byte) { conn.WriteToUDP(packed, addr) })
+
+	srv := s.active()
+	if srv.LogPackets {
+		log.Printf("Received DNS query from %s with data: %v", client, data)
+	}
+
+	query, parseErr := parseQuery(data)
+	if query == nil {
+		log.Printf("Failed to parse DNS query: %v", parseErr)
+		return
+	}
+	qc.Query = query
+	if srv.LogPackets {
+		log.Printf("Parsed DNS query: %+v", *query)
+	}
+
+	var reply *dnsmessage.Message
+	action := srv.RateLimit.check(client.Addr())
+	if action == rrlAllow {
+		action = srv.Storms.check(client.Addr(), query)
+	}
+	switch {
+	case action == rrlDrop:
+		log.Printf("Dropping query from %s over its rate limit", client)
+		return
+	case action == rrlSlip:
+		reply = createDNSReply(query)
+		reply.Truncated = true
+	case parseErr != nil:
+		log.Printf("Answering malformed DNS query from %s with FORMERR: %v", client, parseErr)
+		reply = formatError(query)
+	default:
+		ctx, cancel := srv.queryContext()
+		defer cancel()
+		reply = srv.Handle(ctx, qc)
+	}
+	if reply == nil {
+		log.Printf("Sending no reply to %s", client)
+		return
+	}
+
+	if srv.LogPackets {
+		log.Printf("Constructed DNS answers: %+v", reply.Answers)
+	}
+
+	buf := replyBuffers.Get().(*[]byte)
+	defer replyBuffers.Put(buf)
+	packed, err := reply.AppendTo((*buf)[:0])
+	if err != nil {
+		log.Printf("Failed to pack DNS reply: %v", err)
+		return
+	}
+	size, limit := len(packed), srv.udpLimit(query)
+	if size > limit {
+		if trimmed := withoutOptionalAdditionals(reply); trimmed != reply {
+			// The trimmed reply goes behind the full one, which stays
+			// intact should the trimmed one fail to pack
+			if p, err := trimmed.AppendTo(packed[len(packed):]); err == nil {
+				packed = p
+			}
+		}
+	}
+	truncated := len(packed) > limit
+	if truncated {
+		if packed, err = truncate(reply, qc.sig).AppendTo((*buf)[:0]); err != nil {
+			log.Printf("Failed to pack truncated DNS reply: %v", err)
+			return
+		}
+	}
+	srv.Truncation.observeUDP(client.Addr(), query, size, truncated)
+
+	if _, err = conn.WriteToUDP(packed, addr); err != nil {
+		log.Printf("Failed to send DNS reply: %v", err)
+		return
+	}
+	if srv.LogPackets {
+		log.Printf("Sent DNS reply to %s with ID %d", client, reply.ID)
+	}
+}
+
+// replyBuffers hold the replies being sent, each reply is packed into the
+// buffer of an earlier one rather than a new one
+var replyBuffers = sync.Pool{New: func() any {
+	b := make([]byte, 0, 4096)
+	return &b
+}}
+
+// truncate returns the header, questions and OPT record of reply with the TC
+// bit set. The truncated reply to a signed query is signed with sig again, the
+// signature of the full one doesn't cover it.
+func truncate(reply *dnsmessage.Message, sig *signature) *dnsmessage.Message {
+	t := &dnsmessage.Message{Header: reply.Header, Questions: reply.Questions}
+	t.Truncated = true
+	if opt := optRecord(reply); opt != nil {
+		t.Additionals = []dnsmessage.Resource{*opt}
+	}
+	sig.sign(t)
+	return t
+}
+
+// ServeTCP accepts connections on l until it is closed, answering the queries
+// of each connection in its own goroutine. Connections over
+// TCPLimits.MaxConnections are closed right away.
+func (s *Server) ServeTCP(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.draining.Load() {
+				return nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			log.Printf("Failed to accept TCP connection: %v", err)
+			continue
+		}
+		if limit := s.active().TCP.MaxConnections; limit > 0 && s.tcpConns.Load() >= int64(limit) {
+			log.Printf("Closing TCP connection from %s, %d connections are open", conn.RemoteAddr(), limit)
+			tcpMetrics.Add("rejected", 1)
+			conn.Close()
+			continue
+		}
+		tcpMetrics.Add("accepted", 1)
+		s.tcpConns.Add(1)
+		s.handlers.Add(1)
+		go func() {
+			defer s.handlers.Done()
+			defer s.tcpConns.Add(-1)
+			s.handleTCP(conn)
+		}()
+	}
+}
+
+// handleTCP reads the queries of conn, answering up to TCPLimits.Pipeline of
+// them at the same time. Answers are written as they are ready, so they may
+// come out of order (https://www.rfc-editor.org/rfc/rfc7766#section-7).
+func (s *Server) handleTCP(conn net.Conn) {
+	defer conn.Close()
+	client, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		log.Printf("Invalid TCP client address %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	client = unmapAddrPort(client)
+
+	limits := s.active().TCP
+	var writing sync.Mutex
+	send := func(packed []byte) error {
+		writing.Lock()
+		defer writing.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(limits.idleTimeout()))
+		return writeTCPMessage(conn, packed)
+	}
+	// Pending answers are sent before the connection is closed
+	var answering sync.WaitGroup
+	defer answering.Wait()
+	slots := make(chan struct{}, limits.pipeline())
+	for {
+		data, err := readTCPQuery(conn, limits.idleTimeout(), limits.readTimeout())
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				tcpMetrics.Add("timeouts", 1)
+			}
+			return
+		}
+		// A full pipeline holds off reading, the client waits for answers
+		slots <- struct{}{}
+		answering.Add(1)
+		go func() {
+			defer answering.Done()
+			defer func() { <-slots }()
+			if !s.answerTCP(send, client, data) {
+				conn.Close()
+			}
+		}()
+		if s.draining.Load() {
+			// The client reconnects to the process that took over
+			return
+		}
+	}
+}
+
+// answerTCP answers the query in data, writing the answer with send, and
+// reports whether the connection can go on. It doesn't after a crash, which
+// is answered with SERVFAIL.
+func (s *Server) answerTCP(send func([]byte) error, client netip.AddrPort, data []byte) bool {
+	s.answering.Add(1)
+	defer s.answering.Add(-1)
+	qc := &QueryContext{Client: client, Transport: "tcp", Raw: data}
+	defer s.recoverQuery(qc, func(packed []byte) { send(packed) })
+
+	query, err := parseQuery(data)
+	if query == nil {
+		log.Printf("Failed to parse DNS query over TCP: %v", err)
+		return false
+	}
+	qc.Query = query
+	srv := s.active()
+	var reply *dnsmessage.Message
+	if err != nil {
+		// The framing is intact, so the connection can go on
+		log.Printf("Answering malformed DNS query over TCP from %s with FORMERR: %v", client, err)
+		reply = formatError(query)
+	} else {
+		if srv.LogPackets {
+			log.Printf("Received DNS query over TCP from %s: %+v", client, *query)
+		}
+		if isTransfer(query) {
+			return srv.serveTransfer(send, qc)
+		}
+		srv.Truncation.observeTCP(client.Addr(), query)
+		ctx, cancel := srv.queryContext()
+		defer cancel()
+		reply = srv.Handle(ctx, qc)
+	}
+	if reply == nil {
+		log.Printf("Sending no reply over TCP to %s", client)
+		return true
+	}
+	buf := replyBuffers.Get().(*[]byte)
+	defer replyBuffers.Put(buf)
+	packed, err := reply.AppendTo((*buf)[:0])
+	if err != nil {
+		log.Printf("Failed to pack DNS reply: %v", err)
+		return false
+	}
+	if err := send(packed); err != nil {
+		log.Printf("Failed to send DNS reply over TCP: %v", err)
+		return false
+	}
+	return true
+}
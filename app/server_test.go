@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"net"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+// startTestServer serves s on an ephemeral localhost port, UDP and TCP, and returns its address
+func startTestServer(t *testing.T, s *Server) string {
+	t.Helper()
+	conn, l := dnstest.Listen(t)
+	go s.ServeUDP(conn)
+	go s.ServeTCP(l)
+	return conn.LocalAddr().String()
+}
+
+// testClient is the source address handle pretends queries come from
+var testClient = netip.MustParseAddrPort("127.0.0.1:53000")
+
+// handle answers query as if it came from testClient over UDP
+func handle(s *Server, query *dnsmessage.Message) *dnsmessage.Message {
+	return s.Handle(context.Background(), &QueryContext{Client: testClient, Transport: "udp", Query: query})
+}
+
+func newTestServer(t testing.TB, upstream string) *Server {
+	t.Helper()
+	f, err := NewForwarder(upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Server{Forwarder: f, RootPolicy: RootForward}
+}
+
+func TestServerForwardsEachQuestion(t *testing.T) {
+	s := newTestServer(t, dnstest.StartUDPServer(t, answerA("192.0.2.1")).Addr)
+	addr := startTestServer(t, s)
+
+	query := &dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 42, RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: "abc.example.com", Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+			{Name: "def.example.com", Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+		},
+	}
+	resp := dnstest.ExchangeUDP(t, addr, query)
+
+	if resp.ID != 42 || !resp.Response || !resp.RecursionDesired || resp.RCode != dnsmessage.RCodeSuccess {
+		t.Errorf("Unexpected header: %+v", resp.Header)
+	}
+	if len(resp.Questions) != 2 || len(resp.Answers) != 2 {
+		t.Fatalf("Expected 2 questions and answers, got %+v", resp)
+	}
+	if resp.Answers[0].Name != "abc.example.com" || resp.Answers[1].Name != "def.example.com" {
+		t.Errorf("Unexpected answers: %+v", resp.Answers)
+	}
+}
+
+func TestServerNotImplementedOpcode(t *testing.T) {
+	s := newTestServer(t, closedUDPAddr(t))
+	query := testQuery("example.com")
+	query.Opcode = dnsmessage.OpcodeStatus
+	if resp := handle(s, query); resp.RCode != dnsmessage.RCodeNotImplemented {
+		t.Errorf("Expected NOTIMP, got %s", resp.RCode)
+	}
+}
+
+func TestServerRootPolicy(t *testing.T) {
+	rootQuery := func(t dnsmessage.Type) *dnsmessage.Message {
+		return &dnsmessage.Message{Questions: []dnsmessage.Question{{Name: dnsmessage.Root, Type: t, Class: dnsmessage.ClassINET}}}
+	}
+
+	s := newTestServer(t, closedUDPAddr(t))
+	s.RootPolicy = RootHints
+
+	resp := handle(s, rootQuery(dnsmessage.TypeNS))
+	if resp.RCode != dnsmessage.RCodeSuccess || len(resp.Answers) != len(rootServers) || len(resp.Additionals) != 2*len(rootServers) {
+		t.Errorf("Unexpected root NS response: %s", resp)
+	}
+	resp = handle(s, rootQuery(dnsmessage.TypeSOA))
+	if len(resp.Answers) != 1 || resp.Answers[0].Type != dnsmessage.TypeSOA || resp.Answers[0].Name != dnsmessage.Root {
+		t.Errorf("Unexpected root SOA response: %s", resp)
+	}
+	resp = handle(s, rootQuery(dnsmessage.TypeA))
+	if resp.RCode != dnsmessage.RCodeSuccess || len(resp.Answers) != 0 || len(resp.Authorities) != 1 {
+		t.Errorf("Expected NODATA with SOA for root A, got %s", resp)
+	}
+
+	s.RootPolicy = RootRefuse
+	if resp := handle(s, rootQuery(dnsmessage.TypeNS)); resp.RCode != dnsmessage.RCodeRefused {
+		t.Errorf("Expected REFUSED, got %s", resp.RCode)
+	}
+
+	// The root response must survive the wire, it is too large for UDP
+	s.RootPolicy = RootHints
+	resp = dnstest.ExchangeTCP(t, startTestServer(t, s), rootQuery(dnsmessage.TypeNS))
+	if len(resp.Answers) != len(rootServers) || resp.Questions[0].Name != dnsmessage.Root {
+		t.Errorf("Unexpected root NS response over the wire: %s", resp)
+	}
+}
+
+func TestServerTruncatesLargeUDPAnswers(t *testing.T) {
+	s := newTestServer(t, closedUDPAddr(t))
+	s.RootPolicy = RootHints
+	addr := startTestServer(t, s)
+
+	query := &dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 99},
+		Questions: []dnsmessage.Question{question(dnsmessage.Root, dnsmessage.TypeNS)},
+	}
+	resp := dnstest.ExchangeUDP(t, addr, query)
+	if !resp.Truncated || len(resp.Answers) != 0 || len(resp.Questions) != 1 {
+		t.Fatalf("Expected an empty truncated UDP answer, got %s", resp)
+	}
+	resp = dnstest.ExchangeTCP(t, addr, query)
+	if resp.Truncated || len(resp.Answers) != len(rootServers) {
+		t.Errorf("Expected the full answer over TCP, got %s", resp)
+	}
+}
+
+func TestServerHonorsEDNSBufferSize(t *testing.T) {
+	s := newTestServer(t, closedUDPAddr(t))
+	s.RootPolicy = RootHints
+	s.UDPSize = ednsUDPSize
+	addr := startTestServer(t, s)
+
+	query := &dnsmessage.Message{
+		Header:      dnsmessage.Header{ID: 99},
+		Questions:   []dnsmessage.Question{question(dnsmessage.Root, dnsmessage.TypeNS)},
+		Additionals: []dnsmessage.Resource{newOPT(4096, false)},
+	}
+	resp := dnstest.ExchangeUDP(t, addr, query)
+	if resp.Truncated || len(resp.Answers) != len(rootServers) {
+		t.Fatalf("Expected the full answer within the EDNS buffer, got %s", resp)
+	}
+	if opt := optRecord(resp); opt == nil || opt.Class != ednsUDPSize {
+		t.Errorf("Expected the UDP size to be advertised, got %v", opt)
+	}
+
+	// The client buffer bounds the answer as well
+	query.Additionals = []dnsmessage.Resource{newOPT(512, false)}
+	if resp = dnstest.ExchangeUDP(t, addr, query); !resp.Truncated {
+		t.Errorf("Expected an answer over the buffer of the client to be truncated, got %s", resp)
+	}
+	s = newTestServer(t, closedUDPAddr(t))
+	s.RootPolicy = RootHints
+	query.Additionals = []dnsmessage.Resource{newOPT(4096, false)}
+	if resp = dnstest.ExchangeUDP(t, startTestServer(t, s), query); !resp.Truncated {
+		t.Errorf("Expected an answer over 512 bytes to be truncated without a UDP size, got %s", resp)
+	}
+}
+
+func TestServerReadsLargeUDPQueries(t *testing.T) {
+	addr := startTestServer(t, newTestServer(t, dnstest.StartUDPServer(t, answerA("192.0.2.1")).Addr))
+	query := testQuery("www.example.com")
+	opt := newOPT(1232, false)
+	opt.Data = &dnsmessage.OPT{Options: []dnsmessage.Option{{Code: ednsOptionPadding, Data: make([]byte, 600)}}}
+	query.Additionals = []dnsmessage.Resource{opt}
+	if resp := dnstest.ExchangeUDP(t, addr, query); resp.RCode != dnsmessage.RCodeSuccess || len(resp.Answers) != 1 {
+		t.Errorf("Expected a query over 512 bytes to be answered, got %s", resp)
+	}
+}
+
+func TestServerListensDualStack(t *testing.T) {
+	udp, tcp, _, err := listen("[::]:0")
+	if err != nil {
+		t.Skipf("No IPv6: %v", err)
+	}
+	t.Cleanup(func() { udp.Close(); tcp.Close() })
+	s := newTestServer(t, dnstest.StartUDPServer(t, answerA("192.0.2.1")).Addr)
+	clients := make(chan netip.Addr, 1)
+	s.Finalize = func(qc *QueryContext, reply *dnsmessage.Message) *dnsmessage.Message {
+		clients <- qc.Client.Addr()
+		return reply
+	}
+	go s.ServeUDP(udp)
+	go s.ServeTCP(tcp)
+
+	port := strconv.Itoa(udp.LocalAddr().(*net.UDPAddr).Port)
+	for _, network := range []string{"udp", "tcp"} {
+		for _, host := range []string{"127.0.0.1", "::1"} {
+			resp, err := dnstest.Exchange(network, net.JoinHostPort(host, port), testQuery("www.example.com"))
+			if err != nil {
+				t.Fatalf("%s from %s: %v", network, host, err)
+			}
+			if len(resp.Answers) != 1 {
+				t.Errorf("%s from %s: expected an answer, got %s", network, host, resp)
+			}
+			// IPv4 clients of the IPv6 socket are seen unmapped
+			if got := <-clients; got != netip.MustParseAddr(host) {
+				t.Errorf("%s from %s: expected the client address %s, got %s", network, host, host, got)
+			}
+		}
+	}
+}
+
+func TestServerQueryDeadline(t *testing.T) {
+	s := newTestServer(t, dnstest.StartUDPServer(t, func(*dnsmessage.Message) *dnsmessage.Message { return nil }).Addr)
+	s.Forwarder.Timeout = 2 * time.Second
+	s.QueryTimeout = 100 * time.Millisecond
+	addr := startTestServer(t, s)
+	count := func(name string) int64 {
+		if v, ok := queryMetrics.Get(name).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	timeouts, upstreamTimeouts := count("timeouts"), count("upstream_timeouts")
+
+	start := time.Now()
+	resp := dnstest.ExchangeUDP(t, addr, testQuery("www.example.com"))
+	if resp.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf("Expected SERVFAIL past the deadline, got %s", resp.RCode)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the answer at the deadline, took %s", elapsed)
+	}
+	if count("timeouts") != timeouts+1 || count("upstream_timeouts") != upstreamTimeouts {
+		t.Errorf("Expected a query timeout and no upstream timeout to be counted")
+	}
+	// The upstream didn't get to time out, it isn't held responsible
+	if !s.Forwarder.Upstreams[0].Health.Alive() {
+		t.Error("Expected the upstream to stay healthy")
+	}
+}
+
+// BenchmarkServeQuery answers a query from local data and one from the
+// cache, then packs the reply into a reused buffer as handleUDP does. The
+// packing doesn't allocate, which TestAppendToDoesNotAllocate checks, while
+// answering still allocates the reply and its records, and the provenance
+// logged for it.
+func BenchmarkServeQuery(b *testing.B) {
+	forwarded := newTestServer(b, dnstest.StartUDPServer(b, answerA("192.0.2.1")).Addr)
+	forwarded.Cache = NewCache(100)
+	servers := map[string]struct {
+		s *Server
+		q *dnsmessage.Message
+	}{
+		"local":  {&Server{LocalData: newTestLocalData(b, false)}, testQuery("www.home.lan")},
+		"cached": {forwarded, testQuery("www.example.com")},
+	}
+	for name, tt := range servers {
+		if reply := handle(tt.s, tt.q); reply.RCode != dnsmessage.RCodeSuccess || len(reply.Answers) == 0 {
+			b.Fatalf("%s: expected an answer, got %s", name, reply)
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			buf := make([]byte, 0, 512)
+			for i := 0; i < b.N; i++ {
+				reply := handle(tt.s, tt.q)
+				if _, err := reply.AppendTo(buf[:0]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestServerFinalize(t *testing.T) {
+	s := newTestServer(t, dnstest.StartUDPServer(t, answerA("192.0.2.1")).Addr)
+	s.Finalize = func(qc *QueryContext, reply *dnsmessage.Message) *dnsmessage.Message {
+		if qc.Query.Questions[0].Name == "veto.example" {
+			return nil
+		}
+		reply.Answers[0].TTL = 5
+		return reply
+	}
+	addr := startTestServer(t, s)
+	if resp := dnstest.ExchangeUDP(t, addr, testQuery("www.example")); len(resp.Answers) != 1 || resp.Answers[0].TTL != 5 {
+		t.Errorf("Expected the hook to change the TTL, got %s", resp)
+	}
+	if reply := handle(s, testQuery("veto.example")); reply != nil {
+		t.Errorf("Expected a vetoed reply to be dropped, got %s", reply)
+	}
+}
+
+func TestServerAnswersMalformedQueriesWithFormErr(t *testing.T) {
+	addr := startTestServer(t, newTestServer(t, closedUDPAddr(t)))
+	packed, err := testQuery("www.example").Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The header promises a question that is cut short
+	malformed := packed[:len(packed)-3]
+
+	for _, network := range []string{"udp", "tcp"} {
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		var data []byte
+		if network == "udp" {
+			_, err = conn.Write(malformed)
+			buf := make([]byte, 512)
+			var n int
+			if err == nil {
+				n, err = conn.Read(buf)
+			}
+			data = buf[:n]
+		} else if err = writeTCPMessage(conn, malformed); err == nil {
+			data, err = readTCPMessage(conn)
+		}
+		if err != nil {
+			t.Fatalf("%s: no reply to a malformed query: %v", network, err)
+		}
+		var resp dnsmessage.Message
+		if err := resp.Unpack(data); err != nil {
+			t.Fatalf("%s: invalid reply: %v", network, err)
+		}
+		if resp.RCode != dnsmessage.RCodeFormatError || resp.ID != testQuery("www.example").ID || len(resp.Questions) != 0 {
+			t.Errorf("%s: expected FORMERR echoing the ID, got %s", network, &resp)
+		}
+	}
+
+	responseHeader := append([]byte(nil), malformed...)
+	responseHeader[2] |= 0x80
+	if query, _ := parseQuery(responseHeader); query != nil {
+		t.Errorf("Expected malformed responses to be left unanswered, got %s", query)
+	}
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+const (
+	// signatureValidity is how long the signatures made for answers are
+	// valid, they start signatureBackdate early for clients with clocks behind
+	signatureValidity = 7 * 24 * time.Hour
+	signatureBackdate = time.Hour
+	// keyTTL is the TTL of the DNSKEY records of generated keys
+	keyTTL = 3600
+)
+
+// signingKey is a private key of a zone with the DNSKEY record publishing it
+type signingKey struct {
+	dnskey *dnsmessage.DNSKEY
+	// private is an *ecdsa.PrivateKey or an ed25519.PrivateKey
+	private crypto.Signer
+}
+
+// signedZone holds the keys of a zone, the KSK signing its DNSKEY RRset and the
+// ZSK everything else. They are the same key for zones with a single one.
+type signedZone struct {
+	ksk, zsk *signingKey
+}
+
+// Signer signs the answers from local zones online for clients asking for
+// DNSSEC records, adding NSEC or NSEC3 records to prove names and types don't
+// exist. Nothing is precomputed, so the zones can change by dynamic updates.
+type Signer struct {
+	zones map[string]*signedZone
+	// NSEC3 proves denials with NSEC3 records instead of NSEC, without salt
+	// nor extra iterations (https://www.rfc-editor.org/rfc/rfc9276#section-3.1)
+	NSEC3 bool
+	now   func() time.Time
+}
+
+// loadSigner reads the keys of the comma separated <origin>=<key directory>
+// zones of data, generating a KSK and a ZSK for zones without keys, and
+// publishes them in the zones. DNSKEY records already in a zone are kept, so
+// keys can be published ahead of a rollover.
+func loadSigner(spec string, data *LocalData, nsec3 bool) (*Signer, error) {
+	sg := &Signer{zones: make(map[string]*signedZone), NSEC3: nsec3, now: time.Now}
+	for _, entry := range splitList(spec) {
+		origin, dir, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected <origin>=<key directory>, got %q", entry)
+		}
+		zone := canonicalName(origin)
+		var soa dnsmessage.Resource
+		if data != nil {
+			data.mu.RLock()
+			soa, ok = data.zones[zone]
+			data.mu.RUnlock()
+		}
+		if data == nil || !ok {
+			return nil, fmt.Errorf("zone %s is not a local zone", dnsmessage.FQDN(zone))
+		}
+		keys, err := loadSigningKeys(dir, zone)
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) == 0 {
+			if keys, err = generateSigningKeys(dir, zone); err != nil {
+				return nil, err
+			}
+		}
+
+		z := &signedZone{}
+		published := make([]dnsmessage.Resource, 0, len(keys)+1)
+		for _, key := range keys {
+			if key.dnskey.Flags&dnsmessage.FlagSecureEntry != 0 && z.ksk == nil {
+				z.ksk = key
+			} else if key.dnskey.Flags&dnsmessage.FlagSecureEntry == 0 && z.zsk == nil {
+				z.zsk = key
+			}
+			published = append(published, dnsmessage.Resource{Name: zone, Type: dnsmessage.TypeDNSKEY, Class: dnsmessage.ClassINET, TTL: soa.TTL, Data: key.dnskey})
+		}
+		if z.ksk == nil {
+			z.ksk = z.zsk
+		} else if z.zsk == nil {
+			z.zsk = z.ksk
+		}
+		if nsec3 {
+			// NSEC3PARAM records have no TTL to honour, they are for the
+			// servers of the zone (https://www.rfc-editor.org/rfc/rfc5155#section-4)
+			published = append(published, dnsmessage.Resource{Name: zone, Type: dnsmessage.TypeNSEC3PARAM, Class: dnsmessage.ClassINET, Data: &dnsmessage.NSEC3PARAM{HashAlgorithm: 1}})
+		}
+		data.mu.Lock()
+		for _, rr := range published {
+			if !containsRecord(data.records[zone], rr) {
+				data.add(rr)
+				if key := keyOf(&rr); data.sources[key] == "" {
+					data.sources[key] = "signing keys in " + dir
+				}
+			}
+		}
+		data.mu.Unlock()
+
+		ds, err := z.ksk.dnskey.ToDS(zone, dnsmessage.DigestSHA256)
+		if err != nil {
+			return nil, err
+		}
+		sg.zones[zone] = z
+		log.Printf("Signing zone %s, its DS record is %s", dnsmessage.FQDN(zone), dnsmessage.Resource{Name: zone, Type: dnsmessage.TypeDS, Class: dnsmessage.ClassINET, TTL: soa.TTL, Data: ds})
+	}
+	return sg, nil
+}
+
+// keyFileBase is the path of the key files of a zone without their extension,
+// named like those of BIND: K<zone>+<algorithm>+<key tag>
+func keyFileBase(dir, zone string, key *dnsmessage.DNSKEY) string {
+	return filepath.Join(dir, fmt.Sprintf("K%s+%03d+%05d", dnsmessage.FQDN(zone), key.Algorithm, key.KeyTag()))
+}
+
+// loadSigningKeys reads the keys of zone from dir, each a .key file holding its
+// DNSKEY record in the master file format and a .private file with the key
+func loadSigningKeys(dir, zone string) ([]*signingKey, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "K"+dnsmessage.FQDN(zone)+"+*.private"))
+	if err != nil {
+		return nil, err
+	}
+	var keys []*signingKey
+	for _, path := range paths {
+		key, err := readSigningKey(strings.TrimSuffix(path, ".private"), zone)
+		if err != nil {
+			return nil, err
+		}
+		if key.dnskey.Flags&dnsmessage.FlagRevoked == 0 {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func readSigningKey(base, zone string) (*signingKey, error) {
+	records, err := loadZoneFile(base+".key", zone)
+	if err != nil {
+		return nil, err
+	}
+	key := &signingKey{}
+	for _, rr := range records {
+		if dnskey, ok := rr.Data.(*dnsmessage.DNSKEY); ok && canonicalName(rr.Name) == zone {
+			key.dnskey = dnskey
+		}
+	}
+	if key.dnskey == nil {
+		return nil, fmt.Errorf("%s.key: no DNSKEY record for %s", base, dnsmessage.FQDN(zone))
+	}
+
+	fields, err := readPrivateKeyFile(base + ".private")
+	if err != nil {
+		return nil, err
+	}
+	if alg, _, _ := strings.Cut(fields["Algorithm"], " "); alg != strconv.Itoa(int(key.dnskey.Algorithm)) {
+		return nil, fmt.Errorf("%s.private: expected algorithm %d, got %q", base, key.dnskey.Algorithm, fields["Algorithm"])
+	}
+	raw, err := base64.StdEncoding.DecodeString(fields["PrivateKey"])
+	if err != nil {
+		return nil, fmt.Errorf("%s.private: %w", base, err)
+	}
+	var public []byte
+	switch key.dnskey.Algorithm {
+	case dnsmessage.AlgorithmECDSAP256SHA256, dnsmessage.AlgorithmECDSAP384SHA384:
+		curve, ecdhCurve := elliptic.P256(), ecdh.P256()
+		if key.dnskey.Algorithm == dnsmessage.AlgorithmECDSAP384SHA384 {
+			curve, ecdhCurve = elliptic.P384(), ecdh.P384()
+		}
+		priv, err := ecdhCurve.NewPrivateKey(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s.private: %w", base, err)
+		}
+		// The uncompressed point is 4 followed by both coordinates
+		public = priv.PublicKey().Bytes()[1:]
+		size := len(public) / 2
+		key.private = &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(public[:size]), Y: new(big.Int).SetBytes(public[size:])},
+			D:         new(big.Int).SetBytes(raw),
+		}
+	case dnsmessage.AlgorithmED25519:
+		if len(raw) != ed25519.SeedSize {
+			return nil, fmt.Errorf("%s.private: invalid Ed25519 key", base)
+		}
+		priv := ed25519.NewKeyFromSeed(raw)
+		public, key.private = priv.Public().(ed25519.PublicKey), priv
+	default:
+		return nil, fmt.Errorf("%s: unsupported signing algorithm %d", base, key.dnskey.Algorithm)
+	}
+	if !bytes.Equal(public, key.dnskey.PublicKey) {
+		return nil, fmt.Errorf("%s.private: the key doesn't match the DNSKEY record", base)
+	}
+	return key, nil
+}
+
+// readPrivateKeyFile reads the "<field>: <value>" lines of a private key file
+func readPrivateKeyFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fields := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if field, value, ok := strings.Cut(scanner.Text(), ":"); ok {
+			fields[strings.TrimSpace(field)] = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return fields, nil
+}
+
+// generateSigningKeys creates an ECDSA P-256 KSK and ZSK for zone and writes
+// them to dir
+func generateSigningKeys(dir, zone string) ([]*signingKey, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	var keys []*signingKey
+	for _, flags := range []uint16{dnsmessage.FlagZoneKey | dnsmessage.FlagSecureEntry, dnsmessage.FlagZoneKey} {
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		key := &signingKey{
+			dnskey: &dnsmessage.DNSKEY{
+				Flags:     flags,
+				Protocol:  3,
+				Algorithm: dnsmessage.AlgorithmECDSAP256SHA256,
+				PublicKey: append(priv.X.FillBytes(make([]byte, 32)), priv.Y.FillBytes(make([]byte, 32))...),
+			},
+			private: priv,
+		}
+		kind := "zone"
+		if flags&dnsmessage.FlagSecureEntry != 0 {
+			kind = "key"
+		}
+		base := keyFileBase(dir, zone, key.dnskey)
+		rr := dnsmessage.Resource{Name: zone, Type: dnsmessage.TypeDNSKEY, Class: dnsmessage.ClassINET, TTL: keyTTL, Data: key.dnskey}
+		public := fmt.Sprintf("; This is a %s-signing key, keyid %d, for %s\n%s\n", kind, key.dnskey.KeyTag(), dnsmessage.FQDN(zone), rr)
+		private := fmt.Sprintf("Private-key-format: v1.3\nAlgorithm: %d (ECDSAP256SHA256)\nPrivateKey: %s\n",
+			dnsmessage.AlgorithmECDSAP256SHA256, base64.StdEncoding.EncodeToString(priv.D.FillBytes(make([]byte, 32))))
+		if err := os.WriteFile(base+".key", []byte(public), 0o644); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(base+".private", []byte(private), 0o600); err != nil {
+			return nil, err
+		}
+		log.Printf("Generated %s-signing key %d for zone %s in %s", kind, key.dnskey.KeyTag(), dnsmessage.FQDN(zone), dir)
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// sign returns resp with the signatures of its RRsets from signed zones and the
+// NSEC or NSEC3 records proving the names or types it lacks don't exist, for
+// clients asking for DNSSEC records
+func (sg *Signer) sign(d *LocalData, question dnsmessage.Question, resp *dnsmessage.Message) *dnsmessage.Message {
+	if sg == nil || d == nil || resp.RCode != dnsmessage.RCodeSuccess && resp.RCode != dnsmessage.RCodeNameError {
+		return resp
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	signed := *resp
+	proofs := sg.proofs(d, question, resp)
+	signed.Answers = sg.signSection(d, resp.Answers)
+	signed.Authorities = sg.signSection(d, append(append([]dnsmessage.Resource(nil), resp.Authorities...), proofs...))
+	return &signed
+}
+
+// proofs returns the denial of existence records resp needs: those of the name
+// or type missing at the end of its CNAME chain, and those proving there are
+// no closer names than the wildcards its answers were synthesized from
+func (sg *Signer) proofs(d *LocalData, question dnsmessage.Question, resp *dnsmessage.Message) []dnsmessage.Resource {
+	chains := make(map[string]*denialChain)
+	chainOf := func(name string) *denialChain {
+		zone, ok := d.zoneOf(name)
+		if !ok || sg.zones[zone] == nil {
+			return nil
+		}
+		if chains[zone] == nil {
+			chains[zone] = sg.chain(d, zone)
+		}
+		return chains[zone]
+	}
+	var proofs []dnsmessage.Resource
+	add := func(records ...dnsmessage.Resource) {
+		for _, rr := range records {
+			if !containsRecord(proofs, rr) {
+				proofs = append(proofs, rr)
+			}
+		}
+	}
+
+	for _, set := range signedRRsets(resp.Answers) {
+		if c := chainOf(set.Name); c != nil && !d.nodes[set.Name] {
+			add(c.wildcardAnswer(set.Name)...)
+		}
+	}
+	if cut, ns := referral(resp, canonicalName(question.Name)); len(ns) > 0 {
+		// A referral carries the DS records of the child zone, or the proof
+		// that there are none and the child is unsigned
+		// (https://www.rfc-editor.org/rfc/rfc4035#section-3.1.4)
+		c := chainOf(cut)
+		if c == nil {
+			return proofs
+		}
+		for _, rr := range d.records[cut] {
+			if rr.Type == dnsmessage.TypeDS {
+				add(rr)
+			}
+		}
+		if len(proofs) == 0 {
+			add(c.noData(cut)...)
+		}
+		return proofs
+	}
+	end, _, _ := followCNAMEs(resp.Answers, question.Name)
+	c := chainOf(end)
+	switch {
+	case c == nil:
+	case resp.RCode == dnsmessage.RCodeNameError:
+		add(c.nameError(end)...)
+	case len(resp.Answers) == 0,
+		question.Type != dnsmessage.TypeCNAME && question.Type != dnsmessage.TypeANY && !hasRecords(resp.Answers, end, question.Type):
+		add(c.noData(end)...)
+	}
+	return proofs
+}
+
+// signSection appends the signatures of the unsigned RRsets of section owned by
+// signed zones, except for the delegations and glue that belong to child zones
+func (sg *Signer) signSection(d *LocalData, section []dnsmessage.Resource) []dnsmessage.Resource {
+	out := append([]dnsmessage.Resource(nil), section...)
+	now := sg.now()
+	for _, set := range signedRRsets(section) {
+		zone, ok := d.zoneOf(set.Name)
+		z := sg.zones[zone]
+		if !ok || z == nil || len(set.records) == 0 || len(set.sigs) > 0 {
+			continue
+		}
+		if cut := d.delegation(zone, set.Name); cut != "" && (cut != set.Name || set.Type != dnsmessage.TypeDS && set.Type != dnsmessage.TypeNSEC) {
+			continue
+		}
+		// Records synthesized from a wildcard are signed as its records
+		owner := set.Name
+		if set.Type != dnsmessage.TypeNSEC3 && !d.nodes[owner] {
+			owner = wildcardOf(d.encloser(owner))
+		}
+		labels := labelCount(owner)
+		if isWildcard(owner) {
+			labels--
+		}
+		key := z.zsk
+		if set.Type == dnsmessage.TypeDNSKEY && set.Name == zone {
+			key = z.ksk
+		}
+		sig, err := signRRset(key, zone, set.records, labels, now.Add(-signatureBackdate), now.Add(signatureValidity))
+		if err != nil {
+			log.Printf("Failed to sign %s %s: %v", set.Name, set.Type, err)
+			continue
+		}
+		out = append(out, sig)
+	}
+	return out
+}
+
+// denialChain is the NSEC or NSEC3 chain of a signed zone, its data has to stay
+// locked while it is used
+type denialChain struct {
+	d     *LocalData
+	zone  string
+	ttl   uint32
+	nsec3 bool
+	// links are ordered by name for NSEC and by hash for NSEC3
+	links []chainLink
+}
+
+type chainLink struct {
+	name  string
+	hash  []byte
+	types []dnsmessage.Type
+}
+
+// chain returns the denial chain of zone. NSEC chains hold the names of the
+// zone with records, NSEC3 chains empty non-terminals too. Names below a
+// delegation belong to the child zone and are left out.
+func (sg *Signer) chain(d *LocalData, zone string) *denialChain {
+	// Denials are cached as long as negative answers
+	// (https://www.rfc-editor.org/rfc/rfc4034#section-4)
+	c := &denialChain{d: d, zone: zone, ttl: negativeSOA(d.zones[zone]).TTL, nsec3: sg.NSEC3}
+	for name := range d.nodes {
+		if inZone, _ := d.zoneOf(name); !isSubdomain(name, zone) || inZone != zone {
+			continue
+		}
+		cut := d.delegation(zone, name)
+		records := d.records[name]
+		if cut != "" && cut != name || len(records) == 0 && !c.nsec3 {
+			continue
+		}
+		var types []dnsmessage.Type
+		for _, rr := range records {
+			if !dnsmessage.HasType(types, rr.Type) {
+				types = append(types, rr.Type)
+			}
+		}
+		link := chainLink{name: name, types: types}
+		if c.nsec3 {
+			// The NSEC3 record of an unsigned delegation is the only one
+			// proving it, there is no RRSIG at its name
+			if len(records) > 0 && (cut == "" || dnsmessage.HasType(types, dnsmessage.TypeDS)) {
+				link.types = append(link.types, dnsmessage.TypeRRSIG)
+			}
+			link.hash, _ = dnsmessage.NSEC3Hash(name, 0, nil)
+		} else {
+			link.types = append(link.types, dnsmessage.TypeNSEC, dnsmessage.TypeRRSIG)
+		}
+		c.links = append(c.links, link)
+	}
+	sort.Slice(c.links, func(i, j int) bool { return c.compare(i, c.links[j]) < 0 })
+	return c
+}
+
+// compare orders the link at i against other
+func (c *denialChain) compare(i int, other chainLink) int {
+	if c.nsec3 {
+		return bytes.Compare(c.links[i].hash, other.hash)
+	}
+	return dnsmessage.CompareNames(c.links[i].name, other.name)
+}
+
+// link returns the record of the link matching name, or of the one covering it
+// when name is not in the chain
+func (c *denialChain) link(name string) dnsmessage.Resource {
+	target := chainLink{name: name}
+	if c.nsec3 {
+		target.hash, _ = dnsmessage.NSEC3Hash(name, 0, nil)
+	}
+	i := sort.Search(len(c.links), func(i int) bool { return c.compare(i, target) > 0 }) - 1
+	if i < 0 {
+		// Hashes before the first one are covered by the last link
+		i = len(c.links) - 1
+	}
+	return c.record(i)
+}
+
+func (c *denialChain) record(i int) dnsmessage.Resource {
+	link, next := c.links[i], c.links[(i+1)%len(c.links)]
+	rr := dnsmessage.Resource{Name: link.name, Type: dnsmessage.TypeNSEC, Class: dnsmessage.ClassINET, TTL: c.ttl, Data: &dnsmessage.NSEC{NextDomain: next.name, Types: link.types}}
+	if c.nsec3 {
+		rr.Name = dnsmessage.EncodeHashedName(link.hash)
+		if c.zone != dnsmessage.Root {
+			rr.Name += "." + c.zone
+		}
+		rr.Type, rr.Data = dnsmessage.TypeNSEC3, &dnsmessage.NSEC3{HashAlgorithm: 1, NextHashed: next.hash, Types: link.types}
+	}
+	return rr
+}
+
+// nameError proves name doesn't exist, nor a wildcard at its closest encloser
+// (https://www.rfc-editor.org/rfc/rfc4035#section-3.1.3.2, https://www.rfc-editor.org/rfc/rfc5155#section-7.2.2)
+func (c *denialChain) nameError(name string) []dnsmessage.Resource {
+	ce := c.d.encloser(name)
+	if c.nsec3 {
+		return []dnsmessage.Resource{c.link(ce), c.link(nextCloser(name, ce)), c.link(wildcardOf(ce))}
+	}
+	return []dnsmessage.Resource{c.link(name), c.link(wildcardOf(ce))}
+}
+
+// noData proves name has no records of the type asked for. Names that don't
+// exist only have none when the wildcard they are synthesized from has none,
+// which is proven like they don't exist plus the record of the wildcard.
+func (c *denialChain) noData(name string) []dnsmessage.Resource {
+	if c.d.nodes[name] {
+		return []dnsmessage.Resource{c.link(name)}
+	}
+	return c.nameError(name)
+}
+
+// wildcardAnswer proves no name closer than the wildcard an answer for name was
+// synthesized from exists
+func (c *denialChain) wildcardAnswer(name string) []dnsmessage.Resource {
+	if c.nsec3 {
+		return []dnsmessage.Resource{c.link(nextCloser(name, c.d.encloser(name)))}
+	}
+	return []dnsmessage.Resource{c.link(name)}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// newSigningServer serves the test zones with home.lan signed, holding a
+// wildcard, an empty non-terminal and an unsigned delegation too. It returns
+// the server and a validator trusting the keys of home.lan.
+func newSigningServer(t *testing.T, nsec3 bool) (*Server, *Validator) {
+	t.Helper()
+	d := newTestLocalData(t, false)
+	d.Add(aRecord("*.wild.home.lan", "192.168.1.50"), aRecord("host.ent.home.lan", "192.168.1.51"),
+		dnsmessage.Resource{Name: "sub.home.lan", Type: dnsmessage.TypeNS, Class: dnsmessage.ClassINET, TTL: 3600, Data: &dnsmessage.NS{Host: "ns.sub.home.lan"}},
+		aRecord("ns.sub.home.lan", "192.168.1.53"))
+	sg, err := loadSigner("home.lan="+t.TempDir(), d, nsec3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{LocalData: d, Signer: sg}
+	var anchors []dnsmessage.Resource
+	for _, rr := range d.records["home.lan"] {
+		if rr.Type == dnsmessage.TypeDNSKEY {
+			anchors = append(anchors, rr)
+		}
+	}
+	exchange := func(_ context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+		return handle(s, dnssecQuery(q)), nil
+	}
+	return s, NewValidator(anchors, exchange)
+}
+
+func dnssecQuery(q dnsmessage.Question) *dnsmessage.Message {
+	query := testQuery(q.Name)
+	query.Questions[0].Type = q.Type
+	query.Additionals = []dnsmessage.Resource{newOPT(4096, true)}
+	return query
+}
+
+func TestSignerAnswersValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		q     dnsmessage.Question
+		rcode dnsmessage.RCode
+	}{
+		{"signed answer", question("www.home.lan", dnsmessage.TypeA), dnsmessage.RCodeSuccess},
+		{"NODATA", question("www.home.lan", dnsmessage.TypeMX), dnsmessage.RCodeSuccess},
+		{"NXDOMAIN", question("missing.home.lan", dnsmessage.TypeA), dnsmessage.RCodeNameError},
+		{"wildcard answer", question("host.wild.home.lan", dnsmessage.TypeA), dnsmessage.RCodeSuccess},
+		{"wildcard NODATA", question("host.wild.home.lan", dnsmessage.TypeMX), dnsmessage.RCodeSuccess},
+		{"empty non-terminal", question("ent.home.lan", dnsmessage.TypeA), dnsmessage.RCodeSuccess},
+		{"unsigned delegation", question("sub.home.lan", dnsmessage.TypeDS), dnsmessage.RCodeSuccess},
+	}
+	for _, nsec3 := range []bool{false, true} {
+		s, v := newSigningServer(t, nsec3)
+		for _, tt := range tests {
+			resp := handle(s, dnssecQuery(tt.q))
+			if resp.RCode != tt.rcode {
+				t.Errorf("%s (NSEC3 %v): expected %s, got %s", tt.name, nsec3, tt.rcode, resp.RCode)
+				continue
+			}
+			validated, err := v.validate(context.Background(), tt.q, resp)
+			if err != nil {
+				t.Errorf("%s (NSEC3 %v): %v", tt.name, nsec3, err)
+			} else if !validated.AuthenticData {
+				t.Errorf("%s (NSEC3 %v): expected a secure answer", tt.name, nsec3)
+			}
+		}
+	}
+}
+
+func TestSignerOnlySignsForDNSSECClients(t *testing.T) {
+	s, _ := newSigningServer(t, false)
+	reply := handle(s, testQuery("www.home.lan"))
+	for _, rr := range append(reply.Answers, reply.Authorities...) {
+		if isDNSSECType(rr.Type) {
+			t.Errorf("Expected no DNSSEC records without the DO bit, got %s", rr)
+		}
+	}
+	reply = handle(s, dnssecQuery(question("ns.sub.home.lan", dnsmessage.TypeA)))
+	for _, rr := range reply.Answers {
+		if rr.Type == dnsmessage.TypeRRSIG {
+			t.Errorf("Expected glue below a delegation to be left unsigned, got %s", rr)
+		}
+	}
+}
+
+func TestSignerProvesReferralsUnsigned(t *testing.T) {
+	s, _ := newSigningServer(t, false)
+	reply := handle(s, dnssecQuery(question("www.sub.home.lan", dnsmessage.TypeA)))
+	if reply.Authoritative || len(reply.Answers) != 0 {
+		t.Fatalf("Expected a referral, got %v", reply)
+	}
+	var ns, nsec, nsecSigs int
+	for _, rr := range reply.Authorities {
+		switch rr.Type {
+		case dnsmessage.TypeNS:
+			ns++
+		case dnsmessage.TypeNSEC:
+			nsec++
+		case dnsmessage.TypeRRSIG:
+			switch rr.Data.(*dnsmessage.RRSIG).TypeCovered {
+			case dnsmessage.TypeNSEC:
+				nsecSigs++
+			case dnsmessage.TypeNS:
+				t.Errorf("Expected the NS records of a delegation to be left unsigned, got %s", rr)
+			}
+		}
+	}
+	if ns != 1 || nsec != 1 || nsecSigs != 1 {
+		t.Errorf("Expected the NS records and a signed NSEC for sub.home.lan, got %v", reply.Authorities)
+	}
+	if len(reply.Additionals) == 0 || reply.Additionals[0].Name != "ns.sub.home.lan" {
+		t.Errorf("Expected the glue of the delegation, got %v", reply.Additionals)
+	}
+}
+
+func TestSignerKeys(t *testing.T) {
+	dir := t.TempDir()
+	d := newTestLocalData(t, false)
+	if _, err := loadSigner("home.lan="+dir, d, true); err != nil {
+		t.Fatal(err)
+	}
+	private, _ := filepath.Glob(filepath.Join(dir, "Khome.lan.+013+*.private"))
+	if len(private) != 2 {
+		t.Fatalf("Expected a KSK and a ZSK to be generated, got %v", private)
+	}
+	if info, err := os.Stat(private[0]); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("Expected the private key to be readable by its owner only, got %v %v", info.Mode(), err)
+	}
+
+	// Loading the keys again publishes the same records once
+	generated := d.answer(question("home.lan", dnsmessage.TypeDNSKEY)).Answers
+	d2 := newTestLocalData(t, false)
+	d2.Add(generated...)
+	sg, err := loadSigner("home.lan="+dir, d2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := d2.answer(question("home.lan", dnsmessage.TypeDNSKEY)).Answers; len(got) != 2 || len(generated) != 2 {
+		t.Errorf("Expected the two keys to be published once, got %v", got)
+	}
+	if z := sg.zones["home.lan"]; z.ksk == z.zsk || z.ksk.dnskey.Flags&dnsmessage.FlagSecureEntry == 0 {
+		t.Error("Expected a separate KSK and ZSK")
+	}
+	if got := d2.answer(question("home.lan", dnsmessage.TypeNSEC3PARAM)).Answers; len(got) != 1 {
+		t.Errorf("Expected an NSEC3PARAM record, got %v", got)
+	}
+
+	if _, err := loadSigner("other.lan="+dir, d, false); err == nil {
+		t.Error("Expected signing a zone that isn't local to fail")
+	}
+}
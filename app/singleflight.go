@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// flightKey identifies upstream lookups that can share a round trip
+type flightKey struct {
+	cacheKey
+	RecursionDesired bool
+	// Options are the EDNS options passed on, see optionsKey
+	Options string
+	// CheckingDisabled lookups get the answers failing validation, which the
+	// others fail on
+	CheckingDisabled bool
+}
+
+// flightCall is an upstream lookup in progress
+type flightCall struct {
+	done chan struct{}
+	resp *dnsmessage.Message
+	// source is where resp came from, see Provenance
+	source string
+	err    error
+}
+
+// flightGroup coalesces concurrent identical lookups so only the first one goes
+// upstream while the others wait for its result
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[flightKey]*flightCall
+}
+
+// Do runs fn once for all concurrent callers with the same key. Every caller
+// gets its own copy of the response so later stages can modify it freely.
+// shared reports whether the result came from another caller's lookup, source
+// is passed on from fn.
+//
+// fn runs on a context detached from that of the caller starting it, done
+// after timeout unless it is 0: the callers joining later have deadlines of
+// their own and must not fail when the first one gives up. Each caller waits
+// until its own ctx is done at most, the lookup goes on for the others.
+func (g *flightGroup) Do(ctx context.Context, key flightKey, timeout time.Duration, fn func(ctx context.Context) (*dnsmessage.Message, string, error)) (resp *dnsmessage.Message, source string, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[flightKey]*flightCall)
+	}
+	call, shared := g.calls[key]
+	if !shared {
+		call = &flightCall{done: make(chan struct{})}
+		g.calls[key] = call
+		go g.run(ctx, key, call, timeout, fn)
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return copyMessage(call.resp), call.source, call.err, shared
+	case <-ctx.Done():
+		return nil, "", ctx.Err(), shared
+	}
+}
+
+// run runs fn for call and releases its waiters
+func (g *flightGroup) run(ctx context.Context, key flightKey, call *flightCall, timeout time.Duration, fn func(ctx context.Context) (*dnsmessage.Message, string, error)) {
+	// The values of the context, such as the provenance, are kept
+	ctx = context.WithoutCancel(ctx)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	// A panic in fn fails the waiters, the key must not be left behind for
+	// the next lookups to wait on forever. No query handler is there to
+	// recover from it, the lookup runs on its own.
+	defer func() {
+		if r := recover(); r != nil {
+			crashMetrics.Add("lookup", 1)
+			log.Printf("CRASH looking up %s %s: %v\n%s", key.Name, key.Type, r, debug.Stack())
+			call.resp, call.err = nil, fmt.Errorf("lookup panicked: %v", r)
+		}
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(call.done)
+	}()
+	call.resp, call.source, call.err = fn(ctx)
+}
+
+// InFlight returns the number of distinct lookups currently waiting on upstreams
+func (g *flightGroup) InFlight() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.calls)
+}
+
+// copyMessage copies the header and the section slices of m. The record data
+// is shared, it is never modified once parsed.
+func copyMessage(m *dnsmessage.Message) *dnsmessage.Message {
+	if m == nil {
+		return nil
+	}
+	c := *m
+	c.Questions = append([]dnsmessage.Question(nil), m.Questions...)
+	c.Answers = append([]dnsmessage.Resource(nil), m.Answers...)
+	c.Authorities = append([]dnsmessage.Resource(nil), m.Authorities...)
+	c.Additionals = append([]dnsmessage.Resource(nil), m.Additionals...)
+	return &c
+}
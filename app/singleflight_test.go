@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+func TestServerCoalescesConcurrentLookups(t *testing.T) {
+	var queries atomic.Int32
+	release := make(chan struct{})
+	upstream := dnstest.StartUDPServer(t, func(q *dnsmessage.Message) *dnsmessage.Message {
+		queries.Add(1)
+		<-release
+		return answerA("192.0.2.1")(q)
+	}).Addr
+	s := newTestServer(t, upstream)
+
+	const clients = 50
+	var wg sync.WaitGroup
+	results := make([]*dnsmessage.Message, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = handle(s, testQuery("popular.example.com"))
+		}(i)
+	}
+
+	// Give every client the chance to join the in-flight lookup before answering
+	deadline := time.Now().Add(2 * time.Second)
+	for s.inflight.InFlight() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := queries.Load(); n != 1 {
+		t.Errorf("Expected 1 upstream query for %d concurrent clients, got %d", clients, n)
+	}
+	for i, resp := range results {
+		if len(resp.Answers) != 1 || resp.Answers[0].Data.String() != "192.0.2.1" {
+			t.Fatalf("Client %d got unexpected response %s", i, resp)
+		}
+	}
+	// Waiters get their own copies of the sections
+	results[0].Answers[0].TTL = 1
+	if results[1].Answers[0].TTL == 1 {
+		t.Error("Expected waiters not to share answer slices")
+	}
+}
+
+func TestFlightGroupPanicReleasesWaiters(t *testing.T) {
+	var g flightGroup
+	key := flightKey{cacheKey: cacheKeyOf(question("panic.example.com", dnsmessage.TypeA))}
+	release := make(chan struct{})
+	errs := make(chan error, 2)
+	lookup := func(context.Context) (*dnsmessage.Message, string, error) {
+		<-release
+		panic("boom")
+	}
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, _, err, _ := g.Do(context.Background(), key, 0, lookup)
+			errs <- err
+		}()
+	}
+	// Give both callers the chance to join the lookup before it panics
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if err == nil {
+				t.Error("Expected the callers to fail with the panic")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected the callers to be released by the panic")
+		}
+	}
+	ok := func(context.Context) (*dnsmessage.Message, string, error) { return nil, "", nil }
+	if _, _, err, shared := g.Do(context.Background(), key, 0, ok); err != nil || shared {
+		t.Errorf("Expected a new lookup to run after the panic, got %v, shared %v", err, shared)
+	}
+}
+
+func TestFlightGroupWaitersKeepTheirDeadlines(t *testing.T) {
+	var g flightGroup
+	key := flightKey{cacheKey: cacheKeyOf(question("slow.example.com", dnsmessage.TypeA))}
+	lookupErr := make(chan error, 1)
+	lookup := func(ctx context.Context) (*dnsmessage.Message, string, error) {
+		time.Sleep(100 * time.Millisecond)
+		lookupErr <- ctx.Err()
+		return answerA("192.0.2.1")(testQuery("slow.example.com")), "upstream", nil
+	}
+
+	leaderCtx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	leader := make(chan error, 1)
+	go func() {
+		_, _, err, _ := g.Do(leaderCtx, key, time.Second, lookup)
+		leader <- err
+	}()
+	time.Sleep(5 * time.Millisecond)
+	resp, _, err, shared := g.Do(context.Background(), key, time.Second, lookup)
+	if err != nil || !shared || len(resp.Answers) != 1 {
+		t.Errorf("Expected the follower to get the shared answer past the deadline of the leader, got %v, %v, shared %v", resp, err, shared)
+	}
+	if err := <-leader; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the leader to give up at its deadline, got %v", err)
+	}
+	if err := <-lookupErr; err != nil {
+		t.Errorf("Expected the lookup not to be canceled with the leader, got %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// StateDump is a snapshot of the runtime state for post-incident analysis,
+// written on SIGUSR1 and served by the admin API on /debug/state
+type StateDump struct {
+	Time       time.Time `json:"time"`
+	Goroutines int       `json:"goroutines"`
+	// InFlight is the number of distinct lookups waiting on upstreams
+	InFlight  int             `json:"in_flight"`
+	Cache     *CacheSummary   `json:"cache,omitempty"`
+	Upstreams []UpstreamState `json:"upstreams"`
+	Zones     []ZoneState     `json:"zones,omitempty"`
+}
+
+// UpstreamState is the health of an upstream at the time of a dump
+type UpstreamState struct {
+	Addr      string     `json:"addr"`
+	Alive     bool       `json:"alive"`
+	Failures  int        `json:"failures"`
+	DeadUntil *time.Time `json:"dead_until,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+// ZoneState describes a zone served from local data or a secondary zone
+type ZoneState struct {
+	Origin  string `json:"origin"`
+	Serial  uint32 `json:"serial"`
+	Records int    `json:"records"`
+	// Primary is the server a secondary zone is transferred from
+	Primary string `json:"primary,omitempty"`
+	Expired bool   `json:"expired,omitempty"`
+}
+
+// StateDump takes a snapshot of the state of the active configuration
+func (s *Server) StateDump() StateDump {
+	srv := s.active()
+	dump := StateDump{
+		Time:       time.Now(),
+		Goroutines: runtime.NumGoroutine(),
+		InFlight:   srv.inflight.InFlight(),
+		Upstreams:  []UpstreamState{},
+		Zones:      srv.LocalData.Zones(),
+	}
+	for _, sec := range srv.Secondaries {
+		dump.Zones = append(dump.Zones, sec.zoneState())
+	}
+	if srv.Cache != nil {
+		summary := srv.Cache.Summary()
+		dump.Cache = &summary
+	}
+	seen := make(map[string]bool)
+	for _, f := range srv.forwarders() {
+		for _, u := range f.Upstreams {
+			if seen[u.Addr] {
+				continue
+			}
+			seen[u.Addr] = true
+			state := UpstreamState{Addr: u.Addr, Alive: u.Health.Alive(), Failures: u.Health.Failures()}
+			if until := u.Health.DeadUntil(); !until.IsZero() {
+				state.DeadUntil = &until
+			}
+			if err := u.Health.LastError(); err != nil {
+				state.LastError = err.Error()
+			}
+			dump.Upstreams = append(dump.Upstreams, state)
+		}
+	}
+	return dump
+}
+
+// Zones describes the zones of the local data, sorted by origin
+func (d *LocalData) Zones() []ZoneState {
+	if d == nil {
+		return nil
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	var zones []ZoneState
+	for origin, soa := range d.zones {
+		zone := ZoneState{Origin: origin}
+		if data, ok := soa.Data.(*dnsmessage.SOA); ok {
+			zone.Serial = data.Serial
+		}
+		for name, records := range d.records {
+			if z, _ := d.zoneOf(name); z == origin {
+				zone.Records += len(records)
+			}
+		}
+		zones = append(zones, zone)
+	}
+	sort.Slice(zones, func(i, j int) bool { return zones[i].Origin < zones[j].Origin })
+	return zones
+}
+
+// appendStateDump appends dump as a single line of JSON to the file at path,
+// so the dumps of one incident can be compared
+func appendStateDump(path string, dump StateDump) error {
+	line, err := json.Marshal(dump)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+func TestStateDump(t *testing.T) {
+	s := newTestServer(t, "192.0.2.53:53,192.0.2.54:53")
+	s.Cache, _ = newTestCache(10)
+	s.Cache.Put(question("www.example.com", dnsmessage.TypeA), answerA("192.0.2.1")(testQuery("www.example.com")))
+	s.Cache.Put(question("nope.example.com", dnsmessage.TypeA), &dnsmessage.Message{
+		Header:      dnsmessage.Header{RCode: dnsmessage.RCodeNameError},
+		Authorities: []dnsmessage.Resource{soaRecord("example.com", 3600, 300)},
+	})
+	s.LocalData = newTestLocalData(t, false)
+	s.Forwarder.Upstreams[1].Health.MarkUnreachable(errors.New("connection refused"))
+
+	dump := s.StateDump()
+	if dump.Goroutines == 0 || dump.Cache == nil || dump.Cache.Positive != 1 || dump.Cache.Negative != 1 {
+		t.Errorf("Expected the goroutines and both cache entries, got %+v", dump)
+	}
+	if len(dump.Upstreams) != 2 || !dump.Upstreams[0].Alive || dump.Upstreams[1].Alive || dump.Upstreams[1].DeadUntil == nil || dump.Upstreams[1].LastError != "connection refused" {
+		t.Errorf("Expected the second upstream to be dead, got %+v", dump.Upstreams)
+	}
+	if len(dump.Zones) != 2 || dump.Zones[1].Origin != "home.lan" || dump.Zones[1].Serial == 0 || dump.Zones[1].Records == 0 {
+		t.Errorf("Expected both zones with their serials, got %+v", dump.Zones)
+	}
+
+	path := filepath.Join(t.TempDir(), "state.jsonl")
+	for range 2 {
+		if err := appendStateDump(path, s.StateDump()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 2 {
+		t.Errorf("Expected one line per dump, got:\n%s", data)
+	}
+}
+
+func TestAdminStateDump(t *testing.T) {
+	admin := httptest.NewServer(newTestServer(t, "192.0.2.53:53").AdminHandler())
+	defer admin.Close()
+	resp, err := http.Get(admin.URL + "/debug/state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var dump StateDump
+	if err := json.NewDecoder(resp.Body).Decode(&dump); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(dump.Time) > time.Minute || len(dump.Upstreams) != 1 || dump.Cache != nil {
+		t.Errorf("Expected a fresh dump without cache, got %+v", dump)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"math"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// stormMetrics counts the NXDOMAIN storms detected, holds the number of zones
+// under one as active and a zone:<name> entry with the rate of each of them
+var stormMetrics = expvar.NewMap("nxdomain_storm")
+
+const (
+	// stormWindow is the time constant NXDOMAIN rates are averaged over
+	stormWindow = 10 * time.Second
+	// stormMaxZones bounds the zones tracked, once exceeded quiet ones are dropped
+	stormMaxZones = 10000
+	// minRandomLabel is the shortest label taken for a random one
+	minRandomLabel = 8
+)
+
+// StormDetector spots NXDOMAIN storms, also known as water torture attacks:
+// floods of queries for random names below a victim zone that all end in
+// NXDOMAIN and pass every cache. It keeps an exponentially decaying rate of
+// NXDOMAIN answers for random looking names per parent zone. A zone is under a
+// storm while that rate is above Threshold, until it drops below half of it.
+type StormDetector struct {
+	// Threshold is the NXDOMAIN answers per second starting a storm
+	Threshold float64
+	// Limit rate limits the UDP queries for zones under a storm per client
+	// network, nil only reports storms
+	Limit *RateLimiter
+
+	mu    sync.Mutex
+	zones map[string]*stormZone
+	now   func() time.Time
+}
+
+type stormZone struct {
+	// score decays by stormWindow, divided by it it is the rate
+	score    float64
+	last     time.Time
+	storming bool
+}
+
+// NewStormDetector creates a detector for storms of threshold NXDOMAIN answers
+// per second and more
+func NewStormDetector(threshold float64) *StormDetector {
+	return &StormDetector{Threshold: threshold, zones: make(map[string]*stormZone), now: time.Now}
+}
+
+// sameSettings reports whether d and other detect and limit alike, so the
+// storms tracked by d can be kept
+func (d *StormDetector) sameSettings(other *StormDetector) bool {
+	return d != nil && other != nil && d.Threshold == other.Threshold &&
+		(d.Limit == nil && other.Limit == nil || d.Limit.sameLimits(other.Limit))
+}
+
+// observe accounts the answer to question
+func (d *StormDetector) observe(question dnsmessage.Question, rcode dnsmessage.RCode) {
+	if d == nil || rcode != dnsmessage.RCodeNameError {
+		return
+	}
+	name := canonicalName(question.Name)
+	label, zone := firstLabel(name), parentName(name)
+	if zone == dnsmessage.Root || !randomLooking(label) {
+		return
+	}
+	now := d.now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	z, ok := d.zones[zone]
+	if !ok {
+		if len(d.zones) >= stormMaxZones {
+			d.pruneLocked(now)
+		}
+		z = &stormZone{last: now}
+		d.zones[zone] = z
+	}
+	z.decay(now)
+	z.score++
+	if rate := z.rate(); !z.storming && rate >= d.Threshold {
+		z.storming = true
+		stormMetrics.Add("detected", 1)
+		stormMetrics.Add("active", 1)
+		log.Printf("NXDOMAIN storm for %s: %.0f NXDOMAIN answers per second for random names", dnsmessage.FQDN(zone), rate)
+	}
+	if z.storming {
+		rate := new(expvar.Float)
+		rate.Set(z.rate())
+		stormMetrics.Set("zone:"+zone, rate)
+	}
+}
+
+// decay ages the score of z to now
+func (z *stormZone) decay(now time.Time) {
+	if elapsed := now.Sub(z.last); elapsed > 0 {
+		z.score *= math.Exp(-elapsed.Seconds() / stormWindow.Seconds())
+		z.last = now
+	}
+}
+
+func (z *stormZone) rate() float64 {
+	return z.score / stormWindow.Seconds()
+}
+
+// storming reports whether zone is under a storm now, ending storms that
+// have calmed down
+func (d *StormDetector) storming(zone string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	z, ok := d.zones[zone]
+	if !ok || !z.storming {
+		return false
+	}
+	z.decay(d.now())
+	if z.rate() < d.Threshold/2 {
+		d.endLocked(zone, z)
+		return false
+	}
+	return true
+}
+
+func (d *StormDetector) endLocked(zone string, z *stormZone) {
+	z.storming = false
+	stormMetrics.Add("active", -1)
+	stormMetrics.Delete("zone:" + zone)
+	log.Printf("NXDOMAIN storm for %s is over", dnsmessage.FQDN(zone))
+}
+
+// pruneLocked drops the zones whose rate has decayed to almost nothing
+func (d *StormDetector) pruneLocked(now time.Time) {
+	for zone, z := range d.zones {
+		z.decay(now)
+		if z.storming && z.rate() < d.Threshold/2 {
+			d.endLocked(zone, z)
+		}
+		if !z.storming && z.score < 1 {
+			delete(d.zones, zone)
+		}
+	}
+}
+
+// check applies the stricter rate limit to UDP queries for a zone under a
+// storm, other queries are allowed
+func (d *StormDetector) check(client netip.Addr, query *dnsmessage.Message) rrlAction {
+	if d == nil || d.Limit == nil || len(query.Questions) == 0 {
+		return rrlAllow
+	}
+	if !d.storming(parentName(canonicalName(query.Questions[0].Name))) {
+		return rrlAllow
+	}
+	return d.Limit.check(client)
+}
+
+// Storms returns the zones under a storm with their NXDOMAIN rate
+func (d *StormDetector) Storms() map[string]float64 {
+	storms := make(map[string]float64)
+	if d == nil {
+		return storms
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.now()
+	for zone, z := range d.zones {
+		if !z.storming {
+			continue
+		}
+		if z.decay(now); z.rate() < d.Threshold/2 {
+			d.endLocked(zone, z)
+			continue
+		}
+		storms[zone] = z.rate()
+	}
+	return storms
+}
+
+// firstLabel returns the leftmost label of a canonical name
+func firstLabel(name string) string {
+	parent := parentName(name)
+	if parent == dnsmessage.Root {
+		return name
+	}
+	return name[:len(name)-len(parent)-1]
+}
+
+// randomLooking reports whether a label looks machine generated: long and
+// mixing letters with digits, or made of mostly distinct characters
+func randomLooking(label string) bool {
+	if len(label) < minRandomLabel {
+		return false
+	}
+	letters, digits := 0, 0
+	distinct := make(map[rune]bool)
+	for _, c := range label {
+		switch {
+		case c >= '0' && c <= '9':
+			digits++
+		case c >= 'a' && c <= 'z':
+			letters++
+		}
+		distinct[c] = true
+	}
+	return letters > 0 && digits > 0 || float64(len(distinct)) >= 0.75*float64(len(label))
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+func TestRandomLooking(t *testing.T) {
+	for label, want := range map[string]bool{
+		"www":         false,
+		"mail":        false,
+		"a8f3k2q9z1":  true,
+		"xkcdqwrtzp":  true,
+		"accountants": false,
+	} {
+		if got := randomLooking(label); got != want {
+			t.Errorf("randomLooking(%q) = %v, want %v", label, got, want)
+		}
+	}
+}
+
+func TestStormDetector(t *testing.T) {
+	d := NewStormDetector(10)
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	d.now = clock.Now
+	var err error
+	if d.Limit, err = NewRateLimiter(1, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	d.Limit.now = clock.Now
+	client := netip.MustParseAddr("198.51.100.1")
+	victim := testQuery("www.victim.example")
+
+	// Plain names and answers other than NXDOMAIN don't make a storm
+	for i := 0; i < 200; i++ {
+		d.observe(question("mail.victim.example", dnsmessage.TypeA), dnsmessage.RCodeNameError)
+		d.observe(question(fmt.Sprintf("q%07d.victim.example", i), dnsmessage.TypeA), dnsmessage.RCodeSuccess)
+	}
+	if storms := d.Storms(); len(storms) != 0 {
+		t.Fatalf("Expected no storm, got %v", storms)
+	}
+
+	for i := 0; i < 150; i++ {
+		d.observe(question(fmt.Sprintf("q%07d.victim.example", i), dnsmessage.TypeA), dnsmessage.RCodeNameError)
+	}
+	if _, ok := d.Storms()["victim.example"]; !ok {
+		t.Fatalf("Expected a storm for victim.example, got %v", d.Storms())
+	}
+	if got := d.check(client, victim); got != rrlAllow {
+		t.Errorf("Expected the first query within the storm limit, got %v", got)
+	}
+	if got := d.check(client, victim); got != rrlDrop {
+		t.Errorf("Expected queries for the victim zone to be limited, got %v", got)
+	}
+	if got := d.check(client, testQuery("www.example.com")); got != rrlAllow {
+		t.Errorf("Expected other zones not to be limited, got %v", got)
+	}
+
+	// The storm ends once the rate has decayed below half the threshold
+	clock.Advance(20 * time.Second)
+	if storms := d.Storms(); len(storms) != 0 {
+		t.Errorf("Expected the storm to be over, got %v", storms)
+	}
+	if got := d.check(client, victim); got != rrlAllow {
+		t.Errorf("Expected no limit after the storm, got %v", got)
+	}
+}
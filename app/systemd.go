@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor systemd passes sockets on
+// (https://www.freedesktop.org/software/systemd/man/latest/sd_listen_fds.html)
+const listenFDsStart = 3
+
+// activatedSockets returns the number of sockets systemd passed to the process
+// through socket activation, 0 when it was started otherwise
+func activatedSockets() int {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return 0
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// systemdSockets takes over the UDP socket and TCP listener systemd passed
+// to the process, nil ones when it passed none. A socket unit with
+// ListenDatagram= and ListenStream= on the DNS port provides them, so the
+// sockets stay bound across restarts of the service. The environment is
+// cleared so processes started later don't take them for theirs.
+func systemdSockets() (*net.UDPConn, *net.TCPListener, error) {
+	n := activatedSockets()
+	for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(name)
+	}
+	if n == 0 {
+		return nil, nil, nil
+	}
+	files := make([]*os.File, n)
+	for i := range files {
+		files[i] = os.NewFile(uintptr(listenFDsStart+i), "systemd socket "+strconv.Itoa(listenFDsStart+i))
+	}
+	return inheritedSockets(files)
+}
+
+// inheritedSockets returns the UDP socket and TCP listener among files, which
+// must hold one of each and nothing else. The files are closed, the sockets
+// returned hold duplicates.
+func inheritedSockets(files []*os.File) (udp *net.UDPConn, tcp *net.TCPListener, err error) {
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+		if err != nil && udp != nil {
+			udp.Close()
+		}
+		if err != nil && tcp != nil {
+			tcp.Close()
+		}
+		if err != nil {
+			udp, tcp = nil, nil
+		}
+	}()
+	for _, f := range files {
+		if pc, err := net.FilePacketConn(f); err == nil {
+			if conn, ok := pc.(*net.UDPConn); ok && udp == nil {
+				udp = conn
+				continue
+			}
+			pc.Close()
+		} else if l, err := net.FileListener(f); err == nil {
+			if listener, ok := l.(*net.TCPListener); ok && tcp == nil {
+				tcp = listener
+				continue
+			}
+			l.Close()
+		}
+		return udp, tcp, fmt.Errorf("%s is not the only UDP socket or TCP listener", f.Name())
+	}
+	if udp == nil || tcp == nil {
+		return udp, tcp, errors.New("expected a UDP socket and a TCP listener, ListenDatagram= and ListenStream= in the socket unit")
+	}
+	return udp, tcp, nil
+}
+
+// sdNotify reports state to systemd, such as READY=1 once the service serves,
+// when it runs the process as a Type=notify service. It does nothing otherwise.
+// (https://www.freedesktop.org/software/systemd/man/latest/sd_notify.html)
+func sdNotify(state ...string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	// An @ starts a name in the abstract namespace
+	if strings.HasPrefix(addr, "@") {
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("notifying systemd: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(strings.Join(state, "\n"))); err != nil {
+		return fmt.Errorf("notifying systemd: %w", err)
+	}
+	return nil
+}
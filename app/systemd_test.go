@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+func TestInheritedSockets(t *testing.T) {
+	udp, l := dnstest.Listen(t)
+	tcp := l.(*net.TCPListener)
+	file := func(f *os.File, err error) *os.File {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+
+	gotUDP, gotTCP, err := inheritedSockets([]*os.File{file(tcp.File()), file(udp.File())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gotUDP.Close()
+	defer gotTCP.Close()
+	if gotUDP.LocalAddr().String() != udp.LocalAddr().String() || gotTCP.Addr().String() != tcp.Addr().String() {
+		t.Errorf("Expected the sockets on %s, got %s and %s", udp.LocalAddr(), gotUDP.LocalAddr(), gotTCP.Addr())
+	}
+
+	// Both are needed, and nothing else
+	if _, _, err := inheritedSockets([]*os.File{file(udp.File())}); err == nil {
+		t.Error("Expected an error without a TCP listener")
+	}
+	if _, _, err := inheritedSockets([]*os.File{file(udp.File()), file(tcp.File()), file(udp.File())}); err == nil {
+		t.Error("Expected an error for a second UDP socket")
+	}
+}
+
+func TestActivatedSockets(t *testing.T) {
+	t.Setenv("LISTEN_FDS", "2")
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	if n := activatedSockets(); n != 0 {
+		t.Errorf("Expected the sockets of another process to be ignored, got %d", n)
+	}
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	if n := activatedSockets(); n != 2 {
+		t.Errorf("Expected 2 sockets, got %d", n)
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Errorf("Expected nothing to be done outside systemd, got %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", path)
+	if err := sdNotify("READY=1", "STATUS=Serving"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "READY=1\nSTATUS=Serving" {
+		t.Errorf("Expected the state on separate lines, got %q", got)
+	}
+}
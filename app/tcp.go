@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/binary"
+	"expvar"
+	"io"
+	"net"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+const (
+	defaultTCPIdleTimeout = 10 * time.Second
+	defaultTCPReadTimeout = 2 * time.Second
+	defaultTCPPipeline    = 16
+)
+
+// tcpMetrics counts the TCP connections accepted, those rejected over the
+// connection cap and those closed for being idle or reading too slowly
+var tcpMetrics = expvar.NewMap("tcp")
+
+// TCPLimits bound the TCP connections of the server. Zero values are the
+// defaults, a MaxConnections of 0 accepts any number of connections.
+type TCPLimits struct {
+	// IdleTimeout is how long a connection may wait for the next query
+	IdleTimeout time.Duration
+	// ReadTimeout is how long the rest of a query may take once its first
+	// byte arrived, so slow clients can't hold connections
+	ReadTimeout time.Duration
+	// MaxConnections caps the connections open at the same time
+	MaxConnections int
+	// Pipeline is how many queries of a connection are answered at the same
+	// time, their answers are sent as they are ready
+	// (https://www.rfc-editor.org/rfc/rfc7766#section-6.2.1.1)
+	Pipeline int
+}
+
+func (l TCPLimits) idleTimeout() time.Duration {
+	if l.IdleTimeout <= 0 {
+		return defaultTCPIdleTimeout
+	}
+	return l.IdleTimeout
+}
+
+func (l TCPLimits) readTimeout() time.Duration {
+	if l.ReadTimeout <= 0 {
+		return defaultTCPReadTimeout
+	}
+	return l.ReadTimeout
+}
+
+func (l TCPLimits) pipeline() int {
+	if l.Pipeline <= 0 {
+		return defaultTCPPipeline
+	}
+	return l.Pipeline
+}
+
+// readTCPQuery reads the next length-prefixed message from conn, waiting up
+// to idle for it to begin and up to read for the rest
+func readTCPQuery(conn net.Conn, idle, read time.Duration) ([]byte, error) {
+	conn.SetReadDeadline(time.Now().Add(idle))
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:1]); err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(read))
+	if _, err := io.ReadFull(conn, length[1:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// keepaliveOption announces the idle timeout in units of 100 milliseconds
+// (https://www.rfc-editor.org/rfc/rfc7828#section-3.1)
+func keepaliveOption(timeout time.Duration) dnsmessage.Option {
+	units := min(timeout/(100*time.Millisecond), 0xFFFF)
+	return dnsmessage.Option{Code: ednsOptionKeepalive, Data: binary.BigEndian.AppendUint16(nil, uint16(units))}
+}
+
+// keepaliveQuery checks the edns-tcp-keepalive option of query: whether it
+// carries one, and whether that is malformed as clients send it empty
+// (https://www.rfc-editor.org/rfc/rfc7828#section-3.2.1)
+func keepaliveQuery(query *dnsmessage.Message) (asked, malformed bool) {
+	opt := optRecord(query)
+	if opt == nil {
+		return false, false
+	}
+	data, _ := opt.Data.(*dnsmessage.OPT)
+	if data == nil {
+		return false, false
+	}
+	for _, o := range data.Options {
+		if o.Code == ednsOptionKeepalive {
+			return true, len(o.Data) != 0
+		}
+	}
+	return false, false
+}
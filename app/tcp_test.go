@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+// dialTCP connects to the TCP listener of a test server
+func dialTCP(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	return conn
+}
+
+func sendTCPQuery(t *testing.T, conn net.Conn, query *dnsmessage.Message) {
+	t.Helper()
+	packed, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeTCPMessage(conn, packed); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTCPReply(t *testing.T, conn net.Conn) *dnsmessage.Message {
+	t.Helper()
+	data, err := readTCPMessage(conn)
+	if err != nil {
+		t.Fatalf("Failed to read the reply: %v", err)
+	}
+	var reply dnsmessage.Message
+	if err := reply.Unpack(data); err != nil {
+		t.Fatal(err)
+	}
+	return &reply
+}
+
+func TestTCPPipelining(t *testing.T) {
+	s := newTestServer(t, dnstest.StartUDPServer(t, answerA("192.0.2.1")).Addr)
+	var err error
+	if s.Delays, err = NewDelays("slow.example=300ms"); err != nil {
+		t.Fatal(err)
+	}
+	conn := dialTCP(t, startTestServer(t, s))
+
+	// The slow query is asked first, the fast answer doesn't wait for it
+	slow, fast := testQuery("slow.example"), testQuery("fast.example")
+	slow.ID, fast.ID = 1, 2
+	sendTCPQuery(t, conn, slow)
+	sendTCPQuery(t, conn, fast)
+	if reply := readTCPReply(t, conn); reply.ID != 2 {
+		t.Errorf("Expected the fast answer first, got ID %d", reply.ID)
+	}
+	if reply := readTCPReply(t, conn); reply.ID != 1 {
+		t.Errorf("Expected the slow answer second, got ID %d", reply.ID)
+	}
+
+	// Without pipelining the answers come in order
+	s.TCP.Pipeline = 1
+	conn = dialTCP(t, startTestServer(t, s))
+	sendTCPQuery(t, conn, slow)
+	sendTCPQuery(t, conn, fast)
+	if reply := readTCPReply(t, conn); reply.ID != 1 {
+		t.Errorf("Expected the answers in order, got ID %d first", reply.ID)
+	}
+}
+
+func TestTCPLimits(t *testing.T) {
+	s := newTestServer(t, dnstest.StartUDPServer(t, answerA("192.0.2.1")).Addr)
+	s.TCP = TCPLimits{IdleTimeout: 200 * time.Millisecond, ReadTimeout: 100 * time.Millisecond, MaxConnections: 1}
+	addr := startTestServer(t, s)
+
+	first := dialTCP(t, addr)
+	sendTCPQuery(t, first, testQuery("www.example.com"))
+	readTCPReply(t, first)
+	// Over the cap connections are closed right away
+	second := dialTCP(t, addr)
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the connection over the cap to be closed, got %v", err)
+	}
+
+	// Idle connections are closed
+	start := time.Now()
+	if _, err := first.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the idle connection to be closed, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the idle connection to be closed after 200ms, took %s", elapsed)
+	}
+
+	// So are those sending a query too slowly
+	time.Sleep(50 * time.Millisecond)
+	slow := dialTCP(t, addr)
+	slow.Write([]byte{0})
+	start = time.Now()
+	if _, err := slow.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the slow connection to be closed, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 180*time.Millisecond {
+		t.Errorf("Expected the slow connection to be closed after the read timeout, took %s", elapsed)
+	}
+}
+
+func TestTCPKeepalive(t *testing.T) {
+	s := newTestServer(t, dnstest.StartUDPServer(t, answerA("192.0.2.1")).Addr)
+	s.TCP.IdleTimeout = 30 * time.Second
+	addr := startTestServer(t, s)
+	query := testQuery("www.example.com")
+	opt := newOPT(1232, false)
+	opt.Data = &dnsmessage.OPT{Options: []dnsmessage.Option{{Code: ednsOptionKeepalive}}}
+	query.Additionals = []dnsmessage.Resource{opt}
+
+	// Over TCP the idle timeout is announced in units of 100ms
+	reply := dnstest.ExchangeTCP(t, addr, query)
+	var timeout []byte
+	for _, o := range optRecord(reply).Data.(*dnsmessage.OPT).Options {
+		if o.Code == ednsOptionKeepalive {
+			timeout = o.Data
+		}
+	}
+	if len(timeout) != 2 || binary.BigEndian.Uint16(timeout) != 300 {
+		t.Errorf("Expected a timeout of 300, got %v", timeout)
+	}
+	// Over UDP the option is ignored
+	if reply := dnstest.ExchangeUDP(t, addr, query); hasOption(reply, ednsOptionKeepalive) {
+		t.Error("Expected no keepalive option over UDP")
+	}
+	// Clients send the option without a timeout
+	opt.Data = &dnsmessage.OPT{Options: []dnsmessage.Option{{Code: ednsOptionKeepalive, Data: []byte{0, 1}}}}
+	query.Additionals = []dnsmessage.Resource{opt}
+	if reply := dnstest.ExchangeTCP(t, addr, query); reply.RCode != dnsmessage.RCodeFormatError {
+		t.Errorf("Expected FORMERR for a keepalive option with a timeout, got %v", reply.RCode)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+const traceUsage = "usage: trace <name> [<type>] [@<root server>[:port]] [--no-minimize] [--json]"
+
+// Trace is the step by step record of an iterative resolution, like dig +trace
+// shows it: every zone asked on the way down, the server that answered, how
+// long it took and where it referred to
+type Trace struct {
+	Question string `json:"question"`
+	RCode    string `json:"rcode,omitempty"`
+	// Answers are the records of the final answer in master file format
+	Answers []string     `json:"answers,omitempty"`
+	Error   string       `json:"error,omitempty"`
+	Steps   []*TraceStep `json:"steps"`
+
+	mu sync.Mutex
+}
+
+// TraceStep is a single question asked to the servers of a zone
+type TraceStep struct {
+	// Depth is 0 for the steps resolving the question, deeper steps look up
+	// the addresses of name servers delegated to without glue
+	Depth    int      `json:"depth"`
+	Zone     string   `json:"zone"`
+	Question string   `json:"question"`
+	Servers  []string `json:"servers"`
+	// Server is the one that answered
+	Server string  `json:"server,omitempty"`
+	RTT    float64 `json:"rtt_ms"`
+	RCode  string  `json:"rcode,omitempty"`
+	// Referral is the zone the answer delegated to, with its name servers
+	// and the addresses asked next
+	Referral    string   `json:"referral,omitempty"`
+	NameServers []string `json:"name_servers,omitempty"`
+	Next        []string `json:"next,omitempty"`
+	Answers     []string `json:"answers,omitempty"`
+	Note        string   `json:"note,omitempty"`
+	Error       string   `json:"error,omitempty"`
+}
+
+type traceKey struct{}
+
+// withTrace returns a context recording the steps of the iterative
+// resolutions under it
+func withTrace(ctx context.Context) (context.Context, *Trace) {
+	t := &Trace{Steps: []*TraceStep{}}
+	return context.WithValue(ctx, traceKey{}, t), t
+}
+
+// traceOf returns the trace recorded by ctx, nil when it records none
+func traceOf(ctx context.Context) *Trace {
+	t, _ := ctx.Value(traceKey{}).(*Trace)
+	return t
+}
+
+// begin records a question about to be asked to the servers of zone, nil
+// when nothing is traced
+func (t *Trace) begin(depth int, zone string, q dnsmessage.Question, servers []netip.Addr) *TraceStep {
+	if t == nil {
+		return nil
+	}
+	step := &TraceStep{Depth: depth, Zone: dnsmessage.FQDN(zone), Question: dnsmessage.FQDN(q.Name) + " " + q.Type.String(), Servers: addrStrings(servers)}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Steps = append(t.Steps, step)
+	return step
+}
+
+// finish records the outcome of asking the question
+func (s *TraceStep) finish(ctx context.Context, rtt time.Duration, resp *dnsmessage.Message, err error) {
+	if s == nil {
+		return
+	}
+	s.RTT = float64(rtt.Microseconds()) / 1000
+	if err != nil {
+		s.fail(err)
+		return
+	}
+	s.Server = strings.TrimPrefix(provenanceOf(ctx).Last(), "upstream ")
+	s.RCode = resp.RCode.String()
+	s.Answers = recordLines(resp.Answers)
+}
+
+// referral records the delegation the answer holds
+func (s *TraceStep) referral(cut string, ns []dnsmessage.Resource) {
+	if s == nil {
+		return
+	}
+	s.Referral = dnsmessage.FQDN(cut)
+	for _, rr := range ns {
+		s.NameServers = append(s.NameServers, dnsmessage.FQDN(rr.Data.(*dnsmessage.NS).Host))
+	}
+}
+
+// next records the addresses of the servers delegated to
+func (s *TraceStep) next(servers []netip.Addr) {
+	if s != nil {
+		s.Next = addrStrings(servers)
+	}
+}
+
+func (s *TraceStep) note(note string) {
+	if s != nil {
+		s.Note = note
+	}
+}
+
+func (s *TraceStep) fail(err error) {
+	if s != nil {
+		s.Error = err.Error()
+	}
+}
+
+func addrStrings(addrs []netip.Addr) []string {
+	strs := make([]string, len(addrs))
+	for i, addr := range addrs {
+		strs[i] = addr.String()
+	}
+	return strs
+}
+
+func recordLines(records []dnsmessage.Resource) []string {
+	var lines []string
+	for _, rr := range records {
+		lines = append(lines, rr.String())
+	}
+	return lines
+}
+
+// traceResolution resolves question with it from the root down and returns
+// the trace of every step
+func traceResolution(ctx context.Context, it *Iterator, question dnsmessage.Question) *Trace {
+	ctx, t := withTrace(ctx)
+	t.Question = dnsmessage.FQDN(question.Name) + " " + question.Type.String()
+	resp, err := it.Exchange(ctx, &dnsmessage.Message{Header: dnsmessage.Header{ID: newQueryID(), RecursionDesired: true}, Questions: []dnsmessage.Question{question}})
+	if err != nil {
+		t.Error = err.Error()
+		return t
+	}
+	t.RCode = resp.RCode.String()
+	t.Answers = recordLines(resp.Answers)
+	return t
+}
+
+// WriteText writes the trace in the style of dig +trace: a line per step,
+// indented for the lookups of name servers, with the records answered below
+func (t *Trace) WriteText(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "; trace of %s\n", t.Question)
+	for _, s := range t.Steps {
+		indent := strings.Repeat("  ", s.Depth)
+		server := s.Server
+		if server == "" {
+			server = strings.Join(s.Servers, ", ")
+		}
+		fmt.Fprintf(&b, "%s%s asked for %s at %s in %.1fms: ", indent, s.Zone, s.Question, server, s.RTT)
+		switch {
+		case s.Referral != "":
+			fmt.Fprintf(&b, "referral to %s, %s", s.Referral, strings.Join(s.NameServers, " "))
+			if len(s.Next) > 0 {
+				fmt.Fprintf(&b, " at %s", strings.Join(s.Next, " "))
+			}
+		case s.RCode != "":
+			b.WriteString(s.RCode)
+		}
+		if s.Note != "" {
+			fmt.Fprintf(&b, ", %s", s.Note)
+		}
+		if s.Error != "" {
+			if s.Referral != "" || s.RCode != "" {
+				b.WriteString(", ")
+			}
+			fmt.Fprintf(&b, "failed: %s", s.Error)
+		}
+		b.WriteString("\n")
+		if s.Referral == "" {
+			for _, line := range s.Answers {
+				fmt.Fprintf(&b, "%s  %s\n", indent, line)
+			}
+		}
+	}
+	if t.Error != "" {
+		fmt.Fprintf(&b, ";; resolution failed: %s\n", t.Error)
+	} else {
+		fmt.Fprintf(&b, ";; %s with %d answers\n", t.RCode, len(t.Answers))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// traceOptions are the arguments of the trace subcommand
+type traceOptions struct {
+	Question dnsmessage.Question
+	// Root replaces the root servers, to trace test hierarchies
+	Root       string
+	NoMinimize bool
+	JSON       bool
+}
+
+func parseTraceArgs(args []string) (*traceOptions, error) {
+	opts := &traceOptions{Question: dnsmessage.Question{Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}}
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "@"):
+			opts.Root = serverAddr(strings.TrimPrefix(arg, "@"))
+		case arg == "--no-minimize" || arg == "-no-minimize":
+			opts.NoMinimize = true
+		case arg == "--json" || arg == "-json":
+			opts.JSON = true
+		case strings.HasPrefix(arg, "-"):
+			return nil, fmt.Errorf("unknown option %q", arg)
+		case opts.Question.Name == "":
+			opts.Question.Name = canonicalName(arg)
+		default:
+			t, err := dnsmessage.ParseType(strings.ToUpper(arg))
+			if err != nil {
+				return nil, fmt.Errorf("unexpected argument %q", arg)
+			}
+			opts.Question.Type = t
+		}
+	}
+	if opts.Question.Name == "" {
+		return nil, errors.New(traceUsage)
+	}
+	return opts, nil
+}
+
+// runTrace implements the trace subcommand, resolving a name from the root
+// servers down like -iterate does and printing every step
+func runTrace(args []string, out io.Writer) error {
+	opts, err := parseTraceArgs(args)
+	if err != nil {
+		return err
+	}
+	it := NewIterator()
+	it.Minimize = !opts.NoMinimize
+	if opts.Root != "" {
+		host, port, _ := net.SplitHostPort(opts.Root)
+		addr, err := netip.ParseAddr(host)
+		if err != nil {
+			return fmt.Errorf("invalid root server %q: %w", opts.Root, err)
+		}
+		n, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid root server port %q", port)
+		}
+		it.Roots, it.Port = []netip.Addr{addr}, uint16(n)
+	}
+	t := traceResolution(context.Background(), it, opts.Question)
+	if opts.JSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(t); err != nil {
+			return err
+		}
+	} else if err := t.WriteText(out); err != nil {
+		return err
+	}
+	if t.Error != "" {
+		return errors.New(";; trace failed")
+	}
+	return nil
+}
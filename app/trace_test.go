@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRunTrace(t *testing.T) {
+	it, _, _, _ := startFakeHierarchy(t)
+	root := "@127.0.0.1:" + strconv.Itoa(int(it.Port))
+	var out strings.Builder
+	if err := runTrace([]string{"deep.host.sub.example", root}, &out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	want := []string{
+		"; trace of deep.host.sub.example. A",
+		". asked for example. A at 127.0.0.1:",
+		"example. asked for sub.example. A at 127.0.0.2:",
+		"sub.example. asked for host.sub.example. A at 127.0.0.3:",
+		"sub.example. asked for deep.host.sub.example. A at 127.0.0.3:",
+		"  deep.host.sub.example.\t300\tIN\tA\t192.0.2.2",
+		";; NOERROR with 1 answers",
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("Expected %d lines, got:\n%s", len(want), out.String())
+	}
+	for i, prefix := range want {
+		if !strings.HasPrefix(lines[i], prefix) {
+			t.Errorf("Expected line %d to start with %q, got %q", i, prefix, lines[i])
+		}
+	}
+	if !strings.Contains(lines[1], "referral to example., ns.example. at 127.0.0.2") {
+		t.Errorf("Expected the referral to example, got %q", lines[1])
+	}
+	if !strings.HasSuffix(lines[3], "NOERROR, the name exists, revealing the next label") {
+		t.Errorf("Expected the empty non-terminal to be noted, got %q", lines[3])
+	}
+
+	if err := runTrace([]string{"missing.example", "--json", root}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if err := runTrace([]string{"www.example", "--bogus"}, &out); err == nil {
+		t.Error("Expected an unknown option to be rejected")
+	}
+}
+
+func TestAdminTrace(t *testing.T) {
+	it, _, _, _ := startFakeHierarchy(t)
+	s := &Server{Iterator: it}
+	rec := httptest.NewRecorder()
+	s.AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/trace?name=www.example&type=a", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected a trace, got %d %s", rec.Code, rec.Body)
+	}
+	var trace Trace
+	if err := json.Unmarshal(rec.Body.Bytes(), &trace); err != nil {
+		t.Fatal(err)
+	}
+	if trace.RCode != "NOERROR" || len(trace.Answers) != 1 || len(trace.Steps) != 2 {
+		t.Fatalf("Expected two steps to the answer, got %+v", &trace)
+	}
+	if step := trace.Steps[0]; step.Zone != "." || step.Referral != "example." || !strings.HasPrefix(step.Server, "127.0.0.1:") || step.RTT <= 0 {
+		t.Errorf("Expected the root to refer to example, got %+v", step)
+	}
+
+	rec = httptest.NewRecorder()
+	s.AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/trace", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected a missing name to be rejected, got %d", rec.Code)
+	}
+}
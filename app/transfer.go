@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// transferBatch is how many records go in each message of an outgoing zone
+// transfer
+const transferBatch = 100
+
+// isTransfer reports whether query asks for a zone transfer
+func isTransfer(query *dnsmessage.Message) bool {
+	if query.Opcode != dnsmessage.OpcodeQuery || len(query.Questions) != 1 {
+		return false
+	}
+	t := query.Questions[0].Type
+	return t == dnsmessage.TypeAXFR || t == dnsmessage.TypeIXFR
+}
+
+// serveTransfer answers an AXFR or IXFR over TCP with the records of a local
+// or secondary zone, sent with send over as many messages as they take
+// (https://www.rfc-editor.org/rfc/rfc5936). Only clients in TransferACL and
+// requests signed with one of TransferKeys are served, the messages of signed
+// requests are signed in turn. The changes between serials are not kept, so
+// an IXFR gets the full zone as well, or the SOA alone when the serial of the
+// client is current (https://www.rfc-editor.org/rfc/rfc1995#section-4). It
+// reports whether the connection can go on.
+func (s *Server) serveTransfer(send func([]byte) error, qc *QueryContext) bool {
+	sig, failed := s.checkTSIG(qc)
+	if failed != nil {
+		return sendTransfer(send, failed)
+	}
+	qc.sig = sig
+	view := s.viewFor(qc.Client.Addr())
+	query := qc.Query
+	question := query.Questions[0]
+	zone := canonicalName(question.Name)
+	reply := createDNSReply(query)
+	reply.RecursionAvailable = false
+
+	records, ok := view.zoneRecords(zone)
+	switch {
+	case !view.transferAllowed(qc):
+		log.Printf("Refusing transfer of %s to %s", dnsmessage.FQDN(zone), qc.Client)
+		reply.RCode = dnsmessage.RCodeRefused
+	case !ok:
+		log.Printf("Refusing transfer of %s to %s, it is no local or secondary zone", dnsmessage.FQDN(zone), qc.Client)
+		reply.RCode = dnsmessage.RCodeNotAuth
+	}
+	if reply.RCode != dnsmessage.RCodeSuccess {
+		sig.signNext(reply)
+		return sendTransfer(send, reply)
+	}
+
+	reply.Authoritative = true
+	soa := records[0]
+	if question.Type == dnsmessage.TypeIXFR && upToDate(query, soa) {
+		reply.Answers = []dnsmessage.Resource{soa}
+		sig.signNext(reply)
+		return sendTransfer(send, reply)
+	}
+	records = append(records, soa)
+	log.Printf("Transferring %s with %d records to %s", dnsmessage.FQDN(zone), len(records)-1, qc.Client)
+	for len(records) > 0 {
+		n := min(len(records), transferBatch)
+		msg := *reply
+		msg.Answers = records[:n]
+		sig.signNext(&msg)
+		if !sendTransfer(send, &msg) {
+			return false
+		}
+		records = records[n:]
+		// Only the first message repeats the question
+		reply.Questions = nil
+	}
+	return true
+}
+
+// sendTransfer packs and sends a message of a transfer
+func sendTransfer(send func([]byte) error, msg *dnsmessage.Message) bool {
+	packed, err := msg.Pack()
+	if err == nil && len(packed) > 0xFFFF {
+		err = fmt.Errorf("message of %d bytes", len(packed))
+	}
+	if err != nil {
+		log.Printf("Failed to pack transfer message: %v", err)
+		return false
+	}
+	if err := send(packed); err != nil {
+		log.Printf("Failed to send transfer message: %v", err)
+		return false
+	}
+	return true
+}
+
+// upToDate reports whether the SOA record in the authority section of an
+// IXFR request has the serial of soa or a newer one
+func upToDate(query *dnsmessage.Message, soa dnsmessage.Resource) bool {
+	if len(query.Authorities) != 1 {
+		return false
+	}
+	held, ok := query.Authorities[0].Data.(*dnsmessage.SOA)
+	return ok && !serialNewer(soa.Data.(*dnsmessage.SOA).Serial, held.Serial)
+}
+
+// transferAllowed reports whether the transfer request is signed with one of
+// TransferKeys or comes from a client in TransferACL
+func (s *Server) transferAllowed(qc *QueryContext) bool {
+	if qc.Key != "" && slices.Contains(s.TransferKeys, qc.Key) {
+		return true
+	}
+	return s.TransferACL != nil && s.TransferACL.allows(qc.Client.Addr())
+}
+
+// zoneRecords returns the records of the local or secondary zone origin, the
+// SOA record first
+func (s *Server) zoneRecords(origin string) ([]dnsmessage.Resource, bool) {
+	if records, ok := s.LocalData.zoneRecords(origin); ok {
+		return records, true
+	}
+	if sec := s.secondary(origin); sec != nil {
+		if z := sec.zone.Load(); z != nil && sec.now().Before(z.expires) {
+			return orderZone(z.records), true
+		}
+	}
+	return nil, false
+}
+
+// zoneRecords returns the records of zone, the SOA record first
+func (d *LocalData) zoneRecords(zone string) ([]dnsmessage.Resource, bool) {
+	if d == nil {
+		return nil, false
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if _, ok := d.zones[zone]; !ok {
+		return nil, false
+	}
+	var records []dnsmessage.Resource
+	for name, rrs := range d.records {
+		if z, _ := d.zoneOf(name); z == zone {
+			records = append(records, rrs...)
+		}
+	}
+	return orderZone(records), true
+}
+
+// orderZone returns records sorted by owner name, with the SOA record first
+func orderZone(records []dnsmessage.Resource) []dnsmessage.Resource {
+	records = slices.Clone(records)
+	sort.SliceStable(records, func(i, j int) bool {
+		si, sj := records[i].Type == dnsmessage.TypeSOA, records[j].Type == dnsmessage.TypeSOA
+		if si != sj {
+			return si
+		}
+		return canonicalName(records[i].Name) < canonicalName(records[j].Name)
+	})
+	return records
+}
+
+// signNext signs the next message answering a signed request, nil leaves it
+// unsigned. The messages of a zone transfer are each signed over the MAC of
+// the one before, those after the first over the timers of their TSIG record
+// only (https://www.rfc-editor.org/rfc/rfc8945#section-5.3.1).
+func (sig *signature) signNext(msg *dnsmessage.Message) {
+	if sig == nil {
+		return
+	}
+	tsig := dnsmessage.TSIG{TimeSigned: uint64(sig.now.Unix()), Fudge: tsigFudge}
+	mac, err := sig.key.sign(msg, macPrefix(sig.mac), tsig, sig.streaming)
+	if err != nil {
+		log.Printf("Failed to sign transfer message: %v", err)
+		return
+	}
+	sig.mac, sig.streaming = mac, true
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+// newTransferTestServer serves the zone big.example with more records than
+// fit a single transfer message
+func newTransferTestServer(t *testing.T) *Server {
+	t.Helper()
+	records := []dnsmessage.Resource{soaRecord("big.example", 3600, 60), nsRecord("big.example", "ns.big.example")}
+	for i := 0; i < 2*transferBatch; i++ {
+		records = append(records, aRecord(fmt.Sprintf("host%d.big.example", i), fmt.Sprintf("192.0.2.%d", i%250+1)))
+	}
+	d := NewLocalData()
+	if err := d.AddZone("big.example", records); err != nil {
+		t.Fatal(err)
+	}
+	return &Server{LocalData: d, TSIGKeys: testKeys(t)}
+}
+
+func TestServeTransfer(t *testing.T) {
+	s := newTransferTestServer(t)
+	acl, err := NewACL("transfer", "127.0.0.0/8", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.TransferACL = acl
+	addr := startTestServer(t, s)
+
+	tr, err := requestTransfer(context.Background(), addr, "big.example", dnsmessage.TypeAXFR, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.Records) != 2*transferBatch+2 || tr.Records[0].Type != dnsmessage.TypeSOA {
+		t.Errorf("Expected the %d records of the zone, SOA first, got %d", 2*transferBatch+2, len(tr.Records))
+	}
+
+	// An IXFR gets the full zone, or the SOA alone for the current serial
+	current := soaRecord("big.example", 3600, 60)
+	if tr, err := requestTransfer(context.Background(), addr, "big.example", dnsmessage.TypeIXFR, &current, nil); err != nil || !tr.UpToDate {
+		t.Errorf("Expected the IXFR to find the zone up to date, got %+v, %v", tr, err)
+	}
+	current.Data.(*dnsmessage.SOA).Serial = 0
+	if tr, err := requestTransfer(context.Background(), addr, "big.example", dnsmessage.TypeIXFR, &current, nil); err != nil || len(tr.Records) != 2*transferBatch+2 {
+		t.Errorf("Expected the IXFR to get the full zone, got %+v, %v", tr, err)
+	}
+
+	if _, err := requestTransfer(context.Background(), addr, "other.example", dnsmessage.TypeAXFR, nil, nil); err == nil || !strings.Contains(err.Error(), "NOTAUTH") {
+		t.Errorf("Expected the transfer of another zone to fail with NOTAUTH, got %v", err)
+	}
+
+	// Over UDP the client is sent to TCP
+	query := &dnsmessage.Message{Header: dnsmessage.Header{ID: 7}, Questions: []dnsmessage.Question{question("big.example", dnsmessage.TypeAXFR)}}
+	if resp := dnstest.ExchangeUDP(t, addr, query); !resp.Truncated || len(resp.Answers) != 0 {
+		t.Errorf("Expected a truncated answer to an AXFR over UDP, got %s", resp)
+	}
+}
+
+func TestServeSignedTransfer(t *testing.T) {
+	s := newTransferTestServer(t)
+	s.TransferKeys = []string{"test-key"}
+	addr := startTestServer(t, s)
+
+	if _, err := requestTransfer(context.Background(), addr, "big.example", dnsmessage.TypeAXFR, nil, nil); err == nil || !strings.Contains(err.Error(), "REFUSED") {
+		t.Errorf("Expected an unsigned transfer to be refused, got %v", err)
+	}
+	// Every message of the transfer is verified against the key
+	tr, err := requestTransfer(context.Background(), addr, "big.example", dnsmessage.TypeAXFR, nil, s.TSIGKeys.key("test-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.Records) != 2*transferBatch+2 {
+		t.Errorf("Expected the %d records of the zone, got %d", 2*transferBatch+2, len(tr.Records))
+	}
+}
+
+func TestTransferAllowed(t *testing.T) {
+	acl, err := NewACL("transfer", "192.0.2.0/24", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{TransferACL: acl, TransferKeys: []string{"test-key"}}
+	tests := []struct {
+		client string
+		key    string
+		want   bool
+	}{
+		{"192.0.2.1", "", true},
+		{"198.51.100.1", "", false},
+		{"198.51.100.1", "test-key", true},
+		{"198.51.100.1", "other-key", false},
+	}
+	for _, tt := range tests {
+		qc := &QueryContext{Client: netip.AddrPortFrom(netip.MustParseAddr(tt.client), 53), Key: tt.key}
+		if got := s.transferAllowed(qc); got != tt.want {
+			t.Errorf("%s with key %q: expected %v, got %v", tt.client, tt.key, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+var errMessageTooLarge = errors.New("message larger than 65535 bytes")
+
+// writeTCPMessage writes msg prefixed with its two byte length as required for
+// DNS over TCP (https://www.rfc-editor.org/rfc/rfc1035#section-4.2.2)
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	if len(msg) > 0xFFFF {
+		return errMessageTooLarge
+	}
+	buf := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	_, err := w.Write(append(buf, msg...))
+	return err
+}
+
+// readTCPMessage reads a single length prefixed message
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// exchangeConn sends query over an established connection and waits for the
+// response to it. Stream connections, TCP and TLS ones, use the TCP length
+// framing. The number of bytes sent and received is returned even when the
+// exchange fails.
+func exchangeConn(conn net.Conn, query *dnsmessage.Message) (*dnsmessage.Message, int, error) {
+	return exchangeVerified(conn, query, nil)
+}
+
+// exchangeVerified is exchangeConn checking every response to query with
+// verify, given it parsed and in wire format. Responses failing it are
+// skipped like spoofed ones. A nil verify takes any response.
+func exchangeVerified(conn net.Conn, query *dnsmessage.Message, verify func(resp *dnsmessage.Message, raw []byte) error) (*dnsmessage.Message, int, error) {
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	_, packet := conn.(net.PacketConn)
+	stream := !packet
+	if stream {
+		err = writeTCPMessage(conn, packed)
+	} else {
+		_, err = conn.Write(packed)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	transferred := len(packed)
+
+	buf := make([]byte, 65535)
+	for {
+		var data []byte
+		if stream {
+			if data, err = readTCPMessage(conn); err != nil {
+				return nil, transferred, err
+			}
+		} else {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return nil, transferred, err
+			}
+			data = buf[:n]
+		}
+		transferred += len(data)
+
+		var resp dnsmessage.Message
+		if err := resp.Unpack(data); err != nil || !isResponseTo(&resp, query) {
+			// Not an answer to our query, possibly a spoofed one, keep waiting for the real one
+			continue
+		}
+		if verify != nil {
+			if err := verify(&resp, data); err != nil {
+				log.Printf("Ignoring response from %s: %v", conn.RemoteAddr(), err)
+				continue
+			}
+		}
+		return &resp, transferred, nil
+	}
+}
+
+// isResponseTo reports whether resp answers query: it must carry the same ID and
+// repeat the question exactly, with the name compared case insensitively
+// (https://www.rfc-editor.org/rfc/rfc5452#section-4.1)
+func isResponseTo(resp, query *dnsmessage.Message) bool {
+	if !resp.Response || resp.ID != query.ID || len(resp.Questions) != len(query.Questions) {
+		return false
+	}
+	for i, q := range query.Questions {
+		r := resp.Questions[i]
+		if r.Type != q.Type || r.Class != q.Class || !strings.EqualFold(dnsmessage.FQDN(r.Name), dnsmessage.FQDN(q.Name)) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/netip"
+	"sort"
+	"sync"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// truncationMetrics counts the UDP responses, those truncated for exceeding
+// the UDP size and those of them that would have fit the EDNS buffer of the client
+var truncationMetrics = expvar.NewMap("truncation")
+
+const (
+	// truncationMaxKeys bounds the client networks and domains tracked each,
+	// once exceeded the ones without truncated answers are dropped
+	truncationMaxKeys = 10000
+	// truncationMinAdvice is the number of truncated answers advice is given from
+	truncationMinAdvice = 10
+	// truncationReportSize is the number of client networks and domains reported
+	truncationReportSize = 20
+	// truncationMaxAdvisedSize caps the -udp-size advised to clients
+	// advertising a larger EDNS buffer, the size RFC 6891 suggests starting
+	// from (https://www.rfc-editor.org/rfc/rfc6891#section-6.2.5)
+	truncationMaxAdvisedSize = 4096
+	// truncationIPv4Prefix and truncationIPv6Prefix group clients like the
+	// defaults of the rate limiter
+	truncationIPv4Prefix = 24
+	truncationIPv6Prefix = 56
+)
+
+// TruncationStats counts the UDP answers truncated per client network and
+// per second level domain of the query name, for an advisory report on the
+// UDP size and TCP reachability
+type TruncationStats struct {
+	mu      sync.Mutex
+	clients map[netip.Prefix]*TruncationCounts
+	domains map[string]*TruncationCounts
+}
+
+// TruncationCounts are the counters of a client network or domain
+type TruncationCounts struct {
+	Responses uint64 `json:"responses"`
+	Truncated uint64 `json:"truncated"`
+	// WouldFit counts the truncated answers that would have fit the EDNS
+	// buffer advertised in the query
+	WouldFit uint64 `json:"would_fit"`
+	// Largest is the size of the largest truncated answer
+	Largest int `json:"largest"`
+	// EDNSSize is the largest EDNS buffer advertised, 0 without EDNS
+	EDNSSize int `json:"edns_size"`
+	// TCPQueries counts the queries over TCP, where truncated answers are retried
+	TCPQueries uint64 `json:"tcp_queries"`
+}
+
+// TruncationEntry is a client network or domain in the report
+type TruncationEntry struct {
+	Key string `json:"key"`
+	TruncationCounts
+}
+
+// TruncationReport lists the client networks and domains with the most
+// truncated answers and the advice derived from them
+type TruncationReport struct {
+	Clients []TruncationEntry `json:"clients"`
+	Domains []TruncationEntry `json:"domains"`
+	Advice  []string          `json:"advice"`
+}
+
+// NewTruncationStats creates statistics with nothing counted
+func NewTruncationStats() *TruncationStats {
+	return &TruncationStats{clients: make(map[netip.Prefix]*TruncationCounts), domains: make(map[string]*TruncationCounts)}
+}
+
+// observeUDP counts the UDP answer of size bytes to query from client, which
+// was truncated when it exceeded the UDP size
+func (t *TruncationStats) observeUDP(client netip.Addr, query *dnsmessage.Message, size int, truncated bool) {
+	if t == nil {
+		return
+	}
+	edns := 0
+	if opt := optRecord(query); opt != nil {
+		edns = int(opt.Class)
+	}
+	wouldFit := truncated && size <= edns
+	truncationMetrics.Add("responses", 1)
+	if truncated {
+		truncationMetrics.Add("truncated", 1)
+	}
+	if wouldFit {
+		truncationMetrics.Add("would_fit", 1)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.each(client, query, func(c *TruncationCounts) {
+		c.Responses++
+		c.EDNSSize = max(c.EDNSSize, edns)
+		if truncated {
+			c.Truncated++
+			c.Largest = max(c.Largest, size)
+		}
+		if wouldFit {
+			c.WouldFit++
+		}
+	})
+}
+
+// observeTCP counts a query from client over TCP
+func (t *TruncationStats) observeTCP(client netip.Addr, query *dnsmessage.Message) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.each(client, query, func(c *TruncationCounts) { c.TCPQueries++ })
+}
+
+// each calls count with the counters of the network of client and of the
+// domain of the question of query
+func (t *TruncationStats) each(client netip.Addr, query *dnsmessage.Message, count func(*TruncationCounts)) {
+	client = client.Unmap()
+	bits := truncationIPv6Prefix
+	if client.Is4() {
+		bits = truncationIPv4Prefix
+	}
+	if network, err := client.Prefix(bits); err == nil {
+		count(countsFor(t.clients, network))
+	}
+	if len(query.Questions) > 0 {
+		count(countsFor(t.domains, ancestorName(canonicalName(query.Questions[0].Name), 2)))
+	}
+}
+
+// countsFor returns the counters of key in m, making room when m is full
+func countsFor[K comparable](m map[K]*TruncationCounts, key K) *TruncationCounts {
+	c, ok := m[key]
+	if ok {
+		return c
+	}
+	if len(m) >= truncationMaxKeys {
+		for k, other := range m {
+			if other.Truncated == 0 {
+				delete(m, k)
+			}
+		}
+	}
+	c = &TruncationCounts{}
+	if len(m) < truncationMaxKeys {
+		m[key] = c
+	}
+	return c
+}
+
+// Report returns the client networks and domains with the most truncated
+// answers along with advice for them
+func (t *TruncationStats) Report() TruncationReport {
+	report := TruncationReport{Clients: []TruncationEntry{}, Domains: []TruncationEntry{}, Advice: []string{}}
+	if t == nil {
+		return report
+	}
+	t.mu.Lock()
+	for network, c := range t.clients {
+		if c.Truncated > 0 {
+			report.Clients = append(report.Clients, TruncationEntry{network.String(), *c})
+		}
+	}
+	for domain, c := range t.domains {
+		if c.Truncated > 0 {
+			report.Domains = append(report.Domains, TruncationEntry{dnsmessage.FQDN(domain), *c})
+		}
+	}
+	t.mu.Unlock()
+	report.Clients = topTruncated(report.Clients)
+	report.Domains = topTruncated(report.Domains)
+
+	for _, e := range report.Clients {
+		if e.Truncated < truncationMinAdvice {
+			continue
+		}
+		if e.TCPQueries == 0 {
+			report.Advice = append(report.Advice, fmt.Sprintf("%s: %d answers were truncated but no query came over TCP, make sure these clients can reach TCP port 53", e.Key, e.Truncated))
+		}
+		if e.WouldFit*2 >= e.Truncated {
+			report.Advice = append(report.Advice, fmt.Sprintf("%s: %d of %d truncated answers fit the EDNS buffer of %d bytes these clients advertise, raising -udp-size to %d would spare them the retries over TCP", e.Key, e.WouldFit, e.Truncated, e.EDNSSize, min(e.EDNSSize, truncationMaxAdvisedSize)))
+		}
+	}
+	for _, e := range report.Domains {
+		if e.Truncated < truncationMinAdvice || e.Truncated*10 < e.Responses {
+			continue
+		}
+		advice := fmt.Sprintf("%s: %d%% of its UDP answers are truncated, the largest has %d bytes", e.Key, e.Truncated*100/e.Responses, e.Largest)
+		if e.Largest > ednsUDPSize {
+			advice += fmt.Sprintf(", more than the %d bytes safe over UDP, so only TCP can carry them", ednsUDPSize)
+		}
+		report.Advice = append(report.Advice, advice)
+	}
+	return report
+}
+
+// topTruncated orders entries by truncated answers and keeps the first ones
+func topTruncated(entries []TruncationEntry) []TruncationEntry {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Truncated != entries[j].Truncated {
+			return entries[i].Truncated > entries[j].Truncated
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	if len(entries) > truncationReportSize {
+		entries = entries[:truncationReportSize]
+	}
+	return entries
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+func TestTruncationStatsCountUDPAndTCP(t *testing.T) {
+	s := newTestServer(t, closedUDPAddr(t))
+	s.RootPolicy = RootHints
+	s.Truncation = NewTruncationStats()
+	addr := startTestServer(t, s)
+
+	query := &dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 99},
+		Questions: []dnsmessage.Question{question(dnsmessage.Root, dnsmessage.TypeNS)},
+	}
+	dnstest.ExchangeUDP(t, addr, query)
+	dnstest.ExchangeTCP(t, addr, query)
+	dnstest.ExchangeUDP(t, addr, testQuery("version.bind"))
+
+	report := s.Truncation.Report()
+	if len(report.Clients) != 1 || report.Clients[0].Key != "127.0.0.0/24" {
+		t.Fatalf("Expected the client network with truncated answers, got %+v", report.Clients)
+	}
+	c := report.Clients[0]
+	if c.Responses != 2 || c.Truncated != 1 || c.TCPQueries != 1 || c.Largest <= maxUDPSize {
+		t.Errorf("Expected 2 UDP answers, 1 truncated and retried over TCP, got %+v", c)
+	}
+	if len(report.Domains) != 1 || report.Domains[0].Key != "." {
+		t.Errorf("Expected the root to be the domain with truncated answers, got %+v", report.Domains)
+	}
+}
+
+func TestTruncationAdvice(t *testing.T) {
+	stats := NewTruncationStats()
+	withEDNS := testQuery("big.example.com")
+	withEDNS.Additionals = []dnsmessage.Resource{newOPT(4096, false)}
+	for range 10 {
+		stats.observeUDP(netip.MustParseAddr("192.0.2.1"), withEDNS, 1400, true)
+		stats.observeUDP(netip.MustParseAddr("198.51.100.1"), testQuery("huge.example.net"), 2000, true)
+		stats.observeTCP(netip.MustParseAddr("198.51.100.1"), testQuery("huge.example.net"))
+	}
+	stats.observeUDP(netip.MustParseAddr("203.0.113.1"), testQuery("small.example.org"), 100, false)
+
+	report := stats.Report()
+	if len(report.Clients) != 2 || len(report.Domains) != 2 {
+		t.Fatalf("Expected only the clients and domains with truncated answers, got %+v", report)
+	}
+	want := []string{
+		"192.0.2.0/24: 10 answers were truncated but no query came over TCP",
+		"192.0.2.0/24: 10 of 10 truncated answers fit the EDNS buffer of 4096 bytes these clients advertise, raising -udp-size to 4096",
+		"example.com.: 100% of its UDP answers are truncated, the largest has 1400 bytes, more than the 1232 bytes safe over UDP",
+		"example.net.: 100% of its UDP answers are truncated, the largest has 2000 bytes, more than the 1232 bytes safe over UDP",
+	}
+	if len(report.Advice) != len(want) {
+		t.Fatalf("Expected %d pieces of advice, got %q", len(want), report.Advice)
+	}
+	for i, prefix := range want {
+		if !strings.HasPrefix(report.Advice[i], prefix) {
+			t.Errorf("Expected advice %q, got %q", prefix, report.Advice[i])
+		}
+	}
+}
+
+func TestTruncationAdviceCapsUDPSize(t *testing.T) {
+	stats := NewTruncationStats()
+	query := testQuery("big.example.com")
+	query.Additionals = []dnsmessage.Resource{newOPT(65000, false)}
+	for range 10 {
+		stats.observeUDP(netip.MustParseAddr("192.0.2.1"), query, 1400, true)
+		stats.observeTCP(netip.MustParseAddr("192.0.2.1"), query)
+	}
+	advice := stats.Report().Advice
+	if len(advice) == 0 || !strings.HasSuffix(advice[0], "raising -udp-size to 4096 would spare them the retries over TCP") {
+		t.Errorf("Expected the advised UDP size to be capped, got %q", advice)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// tsigFudge is the clock skew allowed between the signer and the verifier of a
+// message, the value recommended by https://www.rfc-editor.org/rfc/rfc8945#section-10
+const tsigFudge = 300
+
+// tsigMaxUnsigned is how many messages of a zone transfer in a row may be left
+// unsigned (https://www.rfc-editor.org/rfc/rfc8945#section-5.3.1)
+const tsigMaxUnsigned = 99
+
+// tsigAlgorithms are the HMAC algorithms keys can use, by their TSIG names
+var tsigAlgorithms = map[string]func() hash.Hash{
+	"hmac-sha1":   sha1.New,
+	"hmac-sha224": sha256.New224,
+	"hmac-sha256": sha256.New,
+	"hmac-sha384": sha512.New384,
+	"hmac-sha512": sha512.New,
+}
+
+// tsigError fails the verification of a TSIG record with rcode, which goes in
+// the error field of the TSIG record of the reply
+type tsigError struct {
+	rcode  dnsmessage.RCode
+	reason string
+}
+
+func (e *tsigError) Error() string { return e.rcode.String() + ": " + e.reason }
+
+// tsigKey is a secret shared with another party to sign messages with TSIG
+// (https://www.rfc-editor.org/rfc/rfc8945)
+type tsigKey struct {
+	Name      string
+	Algorithm string
+	Secret    []byte
+}
+
+func (k *tsigKey) equal(other *tsigKey) bool {
+	if k == nil || other == nil {
+		return k == other
+	}
+	return k.Name == other.Name && k.Algorithm == other.Algorithm && bytes.Equal(k.Secret, other.Secret)
+}
+
+// mac computes the MAC of msg, the message in wire format without the TSIG
+// record rr, following prefix, the MAC of the request or of the previous
+// message of a zone transfer
+func (k *tsigKey) mac(prefix, msg []byte, rr dnsmessage.Resource, timersOnly bool) ([]byte, error) {
+	variables, err := dnsmessage.AppendTSIGVariables(nil, rr, timersOnly)
+	if err != nil {
+		return nil, err
+	}
+	h := hmac.New(tsigAlgorithms[k.Algorithm], k.Secret)
+	h.Write(prefix)
+	h.Write(msg)
+	h.Write(variables)
+	return h.Sum(nil), nil
+}
+
+// sign adds a TSIG record to msg, it must not be changed afterwards. The time
+// and error fields are taken from tsig, the MAC is returned.
+func (k *tsigKey) sign(msg *dnsmessage.Message, prefix []byte, tsig dnsmessage.TSIG, timersOnly bool) ([]byte, error) {
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	tsig.Algorithm = k.Algorithm
+	tsig.OriginalID = msg.ID
+	tsig.MAC = nil
+	rr := dnsmessage.Resource{Name: k.Name, Type: dnsmessage.TypeTSIG, Class: dnsmessage.ClassANY, Data: &tsig}
+	if tsig.MAC, err = k.mac(prefix, packed, rr, timersOnly); err != nil {
+		return nil, err
+	}
+	// The additionals may be shared with a cached answer
+	msg.Additionals = append(msg.Additionals[:len(msg.Additionals):len(msg.Additionals)], rr)
+	return tsig.MAC, nil
+}
+
+// verify checks the TSIG record rr signing msg, see mac, at time now
+func (k *tsigKey) verify(rr *dnsmessage.Resource, prefix, msg []byte, timersOnly bool, now time.Time) error {
+	tsig := rr.Data.(*dnsmessage.TSIG)
+	if k == nil || canonicalName(rr.Name) != k.Name || canonicalName(tsig.Algorithm) != k.Algorithm {
+		return &tsigError{rcode: dnsmessage.RCodeBadKey, reason: fmt.Sprintf("unknown key %s (%s)", dnsmessage.FQDN(rr.Name), dnsmessage.FQDN(tsig.Algorithm))}
+	}
+	mac, err := k.mac(prefix, msg, *rr, timersOnly)
+	if err != nil {
+		return err
+	}
+	// Truncated MACs are not supported, they fail like wrong ones
+	if !hmac.Equal(mac, tsig.MAC) {
+		return &tsigError{rcode: dnsmessage.RCodeBadSig, reason: "MAC does not match with key " + dnsmessage.FQDN(k.Name)}
+	}
+	if skew := now.Unix() - int64(tsig.TimeSigned); skew > int64(tsig.Fudge) || -skew > int64(tsig.Fudge) {
+		return &tsigError{rcode: dnsmessage.RCodeBadTime, reason: fmt.Sprintf("signed %ds away from the local time, more than the fudge of %ds", skew, tsig.Fudge)}
+	}
+	return nil
+}
+
+// macPrefix is how the MAC of a request precedes the response it signs
+func macPrefix(mac []byte) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(mac))), mac...)
+}
+
+// TSIGKeys are the keys queries to the server can be signed with
+type TSIGKeys struct {
+	keys map[string]*tsigKey
+	now  func() time.Time
+}
+
+// NewTSIGKeys parses comma separated keys in form [<algorithm>:]<name>:<secret>,
+// the format of dig -y: the secret is in base64 and the algorithm hmac-sha256
+// when it is left out
+func NewTSIGKeys(s string) (*TSIGKeys, error) {
+	ks := &TSIGKeys{keys: make(map[string]*tsigKey), now: time.Now}
+	for _, spec := range splitList(s) {
+		parts := strings.Split(spec, ":")
+		if len(parts) == 2 {
+			parts = append([]string{"hmac-sha256"}, parts...)
+		}
+		if len(parts) != 3 {
+			return nil, errors.New("expected [<algorithm>:]<name>:<secret>")
+		}
+		key := &tsigKey{Name: canonicalName(parts[1]), Algorithm: canonicalName(parts[0])}
+		if _, ok := tsigAlgorithms[key.Algorithm]; !ok {
+			return nil, fmt.Errorf("key %s: unsupported algorithm %q", key.Name, parts[0])
+		}
+		var err error
+		if key.Secret, err = base64.StdEncoding.DecodeString(parts[2]); err != nil || len(key.Secret) == 0 {
+			return nil, fmt.Errorf("key %s: secret is not base64", key.Name)
+		}
+		if _, ok := ks.keys[key.Name]; ok {
+			return nil, fmt.Errorf("key %s: defined twice", key.Name)
+		}
+		ks.keys[key.Name] = key
+	}
+	return ks, nil
+}
+
+// key returns the key with the given name, or nil
+func (ks *TSIGKeys) key(name string) *tsigKey {
+	if ks == nil {
+		return nil
+	}
+	return ks.keys[canonicalName(name)]
+}
+
+func (ks *TSIGKeys) clock() time.Time {
+	if ks == nil || ks.now == nil {
+		return time.Now()
+	}
+	return ks.now()
+}
+
+// signature is the verified TSIG record of a query, the reply is signed with
+// the same key
+type signature struct {
+	key *tsigKey
+	mac []byte
+	now time.Time
+	// streaming is set once the first message of a reply spanning several
+	// is signed, see signNext
+	streaming bool
+}
+
+// checkTSIG verifies the TSIG record of a signed query, removing it from the
+// query. It returns the reply when the verification fails.
+func (s *Server) checkTSIG(qc *QueryContext) (*signature, *dnsmessage.Message) {
+	n := len(qc.Query.Additionals)
+	if n == 0 || qc.Query.Additionals[n-1].Type != dnsmessage.TypeTSIG {
+		return nil, nil
+	}
+	raw := qc.Raw
+	if raw == nil {
+		raw, _ = qc.Query.Pack()
+	}
+	query := *qc.Query
+	query.Additionals = query.Additionals[:n-1]
+	qc.Query = &query
+	reply := createDNSReply(qc.Query)
+	reply.RecursionAvailable = false
+
+	unsigned, rr, err := dnsmessage.SplitTSIG(raw)
+	if err != nil || rr == nil {
+		log.Printf("Rejecting query from %s with an invalid TSIG record: %v", qc.Client, err)
+		reply.RCode = dnsmessage.RCodeFormatError
+		return nil, reply
+	}
+	tsig := rr.Data.(*dnsmessage.TSIG)
+	now := s.TSIGKeys.clock()
+	key := s.TSIGKeys.key(rr.Name)
+	err = key.verify(rr, nil, unsigned, false, now)
+	if err == nil {
+		qc.Key = key.Name
+		return &signature{key: key, mac: tsig.MAC, now: now}, nil
+	}
+	log.Printf("Rejecting signed query from %s: %v", qc.Client, err)
+	var terr *tsigError
+	if !errors.As(err, &terr) {
+		reply.RCode = dnsmessage.RCodeServerFailure
+		return nil, reply
+	}
+
+	// Failures are reported in the TSIG record of a NOTAUTH reply, only the
+	// reply to a query signed at the wrong time is signed itself, with the
+	// local time for the client to compare
+	// (https://www.rfc-editor.org/rfc/rfc8945#section-5.2)
+	reply.RCode = dnsmessage.RCodeNotAuth
+	failure := dnsmessage.TSIG{Algorithm: tsig.Algorithm, TimeSigned: tsig.TimeSigned, Fudge: tsig.Fudge, OriginalID: reply.ID, Error: terr.rcode}
+	if terr.rcode == dnsmessage.RCodeBadTime {
+		failure.OtherData = binary.BigEndian.AppendUint64(nil, uint64(now.Unix()))[2:]
+		if _, err := key.sign(reply, macPrefix(tsig.MAC), failure, false); err != nil {
+			log.Printf("Failed to sign reply: %v", err)
+		}
+		return nil, reply
+	}
+	reply.Additionals = append(reply.Additionals, dnsmessage.Resource{Name: rr.Name, Type: dnsmessage.TypeTSIG, Class: dnsmessage.ClassANY, Data: &failure})
+	return nil, reply
+}
+
+// sign adds the TSIG record to the reply of a signed query, nil leaves it unsigned
+func (sig *signature) sign(reply *dnsmessage.Message) {
+	if sig == nil {
+		return
+	}
+	tsig := dnsmessage.TSIG{TimeSigned: uint64(sig.now.Unix()), Fudge: tsigFudge}
+	if _, err := sig.key.sign(reply, macPrefix(sig.mac), tsig, false); err != nil {
+		log.Printf("Failed to sign reply: %v", err)
+	}
+}
+
+// tsigStream verifies the responses to a request signed with key. After the
+// first one, messages of a zone transfer may leave the signature to a later
+// message, which then covers them too.
+type tsigStream struct {
+	key *tsigKey
+	// mac is the MAC of the request, then that of the last signed message
+	mac      []byte
+	unsigned []byte
+	pending  int
+	signed   bool
+}
+
+// sign signs request, whose responses the stream then verifies
+func (t *tsigStream) sign(request *dnsmessage.Message) error {
+	mac, err := t.key.sign(request, nil, dnsmessage.TSIG{TimeSigned: uint64(time.Now().Unix()), Fudge: tsigFudge}, false)
+	t.mac = mac
+	return err
+}
+
+// verify checks the next response in wire format
+func (t *tsigStream) verify(raw []byte) error {
+	msg, rr, err := dnsmessage.SplitTSIG(raw)
+	if err != nil {
+		return err
+	}
+	if rr == nil {
+		if !t.signed {
+			return errors.New("response is not signed")
+		}
+		if t.pending++; t.pending > tsigMaxUnsigned {
+			return fmt.Errorf("more than %d messages in a row are not signed", tsigMaxUnsigned)
+		}
+		t.unsigned = append(t.unsigned, msg...)
+		return nil
+	}
+	if tsig := rr.Data.(*dnsmessage.TSIG); tsig.Error != dnsmessage.RCodeSuccess {
+		return fmt.Errorf("signature rejected with %s", tsig.Error)
+	}
+	if err := t.key.verify(rr, macPrefix(t.mac), append(t.unsigned, msg...), t.signed, time.Now()); err != nil {
+		return err
+	}
+	t.mac = rr.Data.(*dnsmessage.TSIG).MAC
+	t.unsigned, t.pending, t.signed = nil, 0, true
+	return nil
+}
+
+// done checks that the last response was signed
+func (t *tsigStream) done() error {
+	if t.pending > 0 {
+		return errors.New("last message is not signed")
+	}
+	return nil
+}
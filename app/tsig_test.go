@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+// testKeys holds the key "test-key" with the secret "secret"
+func testKeys(t *testing.T) *TSIGKeys {
+	t.Helper()
+	keys, err := NewTSIGKeys("hmac-sha256:test-key:c2VjcmV0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// signedQuery returns a query for name signed with key and the stream
+// verifying its replies
+func signedQuery(t *testing.T, key *tsigKey, name string) (*dnsmessage.Message, *tsigStream) {
+	t.Helper()
+	query := &dnsmessage.Message{Header: dnsmessage.Header{ID: 42}, Questions: []dnsmessage.Question{question(name, dnsmessage.TypeA)}}
+	stream := &tsigStream{key: key}
+	if err := stream.sign(query); err != nil {
+		t.Fatal(err)
+	}
+	return query, stream
+}
+
+func replyTSIG(t *testing.T, reply *dnsmessage.Message) *dnsmessage.TSIG {
+	t.Helper()
+	n := len(reply.Additionals)
+	if n == 0 || reply.Additionals[n-1].Type != dnsmessage.TypeTSIG {
+		t.Fatalf("Expected a TSIG record in the reply, got %+v", reply)
+	}
+	return reply.Additionals[n-1].Data.(*dnsmessage.TSIG)
+}
+
+func TestNewTSIGKeys(t *testing.T) {
+	keys, err := NewTSIGKeys("Test-Key.:c2VjcmV0, hmac-sha512:other:b3RoZXI=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k := keys.key("test-key"); k == nil || k.Algorithm != "hmac-sha256" || string(k.Secret) != "secret" {
+		t.Errorf("Expected test-key with hmac-sha256 by default, got %+v", k)
+	}
+	if k := keys.key("other."); k == nil || k.Algorithm != "hmac-sha512" {
+		t.Errorf("Expected other with hmac-sha512, got %+v", k)
+	}
+	for _, s := range []string{"secret", "hmac-md4:k:c2VjcmV0", "k:not base64", "k:c2VjcmV0,k:c2VjcmV0"} {
+		if _, err := NewTSIGKeys(s); err == nil {
+			t.Errorf("Expected %q to be rejected", s)
+		}
+	}
+}
+
+func TestSignedQueries(t *testing.T) {
+	keys := testKeys(t)
+	s := &Server{LocalData: newTestLocalData(t, false), TSIGKeys: keys}
+
+	query, stream := signedQuery(t, keys.key("test-key"), "www.home.lan")
+	reply := handle(s, query)
+	if reply.RCode != dnsmessage.RCodeSuccess || len(reply.Answers) != 1 {
+		t.Fatalf("Expected the signed query to be answered, got %+v", reply)
+	}
+	packed, err := reply.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.verify(packed); err != nil {
+		t.Errorf("Expected a reply signed with the key, got %v", err)
+	}
+
+	// Unsigned queries still get unsigned replies
+	if reply := handle(s, testQuery("www.home.lan")); len(reply.Additionals) != 0 {
+		t.Errorf("Expected an unsigned reply, got %+v", reply.Additionals)
+	}
+}
+
+func TestSignedQueriesTruncated(t *testing.T) {
+	keys := testKeys(t)
+	s := &Server{RootPolicy: RootHints, TSIGKeys: keys}
+	addr := startTestServer(t, s)
+
+	// The root servers and their addresses exceed 512 bytes
+	query := &dnsmessage.Message{Header: dnsmessage.Header{ID: 42}, Questions: []dnsmessage.Question{question(dnsmessage.Root, dnsmessage.TypeNS)}}
+	stream := &tsigStream{key: keys.key("test-key")}
+	if err := stream.sign(query); err != nil {
+		t.Fatal(err)
+	}
+	reply := dnstest.ExchangeUDP(t, addr, query)
+	if !reply.Truncated || len(reply.Answers) != 0 {
+		t.Fatalf("Expected a truncated reply, got %s", reply)
+	}
+	packed, err := reply.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.verify(packed); err != nil {
+		t.Errorf("Expected the truncated reply to be signed, got %v", err)
+	}
+}
+
+func TestSignedQueryFailures(t *testing.T) {
+	keys := testKeys(t)
+	wrong, err := NewTSIGKeys("test-key:d3Jvbmc=,unknown:c2VjcmV0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{LocalData: newTestLocalData(t, false), TSIGKeys: keys}
+
+	tests := []struct {
+		name  string
+		key   *tsigKey
+		error dnsmessage.RCode
+	}{
+		{"unknown key", wrong.key("unknown"), dnsmessage.RCodeBadKey},
+		{"wrong secret", wrong.key("test-key"), dnsmessage.RCodeBadSig},
+	}
+	for _, tt := range tests {
+		query, _ := signedQuery(t, tt.key, "www.home.lan")
+		reply := handle(s, query)
+		if reply.RCode != dnsmessage.RCodeNotAuth || len(reply.Answers) != 0 {
+			t.Errorf("%s: expected NOTAUTH, got %+v", tt.name, reply)
+			continue
+		}
+		if tsig := replyTSIG(t, reply); tsig.Error != tt.error || len(tsig.MAC) != 0 {
+			t.Errorf("%s: expected an unsigned %s, got %+v", tt.name, tt.error, tsig)
+		}
+	}
+
+	// A query signed too long ago is answered with a signed BADTIME carrying
+	// the local time
+	now := time.Now().Add(time.Hour)
+	keys.now = func() time.Time { return now }
+	query, _ := signedQuery(t, keys.key("test-key"), "www.home.lan")
+	reply := handle(s, query)
+	tsig := replyTSIG(t, reply)
+	if reply.RCode != dnsmessage.RCodeNotAuth || tsig.Error != dnsmessage.RCodeBadTime || len(tsig.MAC) == 0 || len(tsig.OtherData) != 6 {
+		t.Errorf("Expected a signed BADTIME, got %s with %+v", reply.RCode, tsig)
+	}
+}
+
+func TestSignedUpdates(t *testing.T) {
+	keys := testKeys(t)
+	s := &Server{LocalData: newTestLocalData(t, false), TSIGKeys: keys, UpdateKeys: []string{"test-key"}}
+	update := func(signed bool) *dnsmessage.Message {
+		query := &dnsmessage.Message{
+			Header:      dnsmessage.Header{ID: 9, Opcode: dnsmessage.OpcodeUpdate},
+			Questions:   []dnsmessage.Question{question("home.lan", dnsmessage.TypeSOA)},
+			Authorities: []dnsmessage.Resource{aRecord("nas2.home.lan", "192.168.1.30")},
+		}
+		if signed {
+			if _, err := keys.key("test-key").sign(query, nil, dnsmessage.TSIG{TimeSigned: uint64(time.Now().Unix()), Fudge: tsigFudge}, false); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return s.Handle(context.Background(), &QueryContext{Client: testClient, Transport: "tcp", Query: query})
+	}
+
+	if resp := update(false); resp.RCode != dnsmessage.RCodeRefused {
+		t.Errorf("Expected an unsigned update to be refused, got %s", resp.RCode)
+	}
+	resp := update(true)
+	if resp.RCode != dnsmessage.RCodeSuccess {
+		t.Fatalf("Expected the signed update to succeed, got %s", resp.RCode)
+	}
+	replyTSIG(t, resp)
+	if got := s.LocalData.answer(question("nas2.home.lan", dnsmessage.TypeA)); len(got.Answers) != 1 {
+		t.Errorf("Expected the signed update to be applied, got %+v", got)
+	}
+}
+
+func TestTSIGStream(t *testing.T) {
+	key := testKeys(t).key("test-key")
+	query, stream := signedQuery(t, key, "example.com")
+	requestMAC := stream.mac
+	now := dnsmessage.TSIG{TimeSigned: uint64(time.Now().Unix()), Fudge: tsigFudge}
+	message := func(ip string) *dnsmessage.Message {
+		return &dnsmessage.Message{Header: dnsmessage.Header{ID: query.ID, Response: true}, Answers: []dnsmessage.Resource{aRecord("www.example.com", ip)}}
+	}
+	pack := func(m *dnsmessage.Message) []byte {
+		packed, err := m.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return packed
+	}
+
+	// The first message is signed after the request, the second is left
+	// unsigned and the third signs both with the timers only
+	first := message("192.0.2.1")
+	mac, err := key.sign(first, macPrefix(requestMAC), now, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := pack(message("192.0.2.2"))
+	third := message("192.0.2.3")
+	if _, err := key.sign(third, append(macPrefix(mac), second...), now, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stream.verify(second); err == nil {
+		t.Error("Expected an unsigned first response to be rejected")
+	}
+	for i, msg := range [][]byte{pack(first), second, pack(third)} {
+		if err := stream.verify(msg); err != nil {
+			t.Fatalf("Message %d: %v", i, err)
+		}
+	}
+	if err := stream.done(); err != nil {
+		t.Errorf("Expected the transfer to be verified, got %v", err)
+	}
+	if err := stream.verify(second); err != nil || stream.done() == nil {
+		t.Errorf("Expected an unsigned last message to fail the transfer, got %v", err)
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// updateError fails a dynamic update with rcode
+type updateError struct {
+	rcode  dnsmessage.RCode
+	reason string
+}
+
+func (e *updateError) Error() string { return e.rcode.String() + ": " + e.reason }
+
+func updateFailure(rcode dnsmessage.RCode, format string, args ...any) error {
+	return &updateError{rcode: rcode, reason: fmt.Sprintf(format, args...)}
+}
+
+// handleUpdate applies a dynamic update (https://www.rfc-editor.org/rfc/rfc2136)
+// to a zone of the local data. Only clients in UpdateACL and updates signed with
+// one of UpdateKeys are accepted, when PersistUpdates is set the zone file is
+// rewritten after each update.
+func (s *Server) handleUpdate(qc *QueryContext) *dnsmessage.Message {
+	query := qc.Query
+	reply := createDNSReply(query)
+	reply.RCode = dnsmessage.RCodeSuccess
+	reply.RecursionAvailable = false
+	if !s.updateAllowed(qc) {
+		reply.RCode = dnsmessage.RCodeRefused
+		return reply
+	}
+	if s.Modes.ReadOnly() {
+		log.Printf("Refusing update from %s in read-only mode", qc.Client)
+		reply.RCode = dnsmessage.RCodeRefused
+		return reply
+	}
+	if len(query.Questions) != 1 || query.Questions[0].Type != dnsmessage.TypeSOA {
+		reply.RCode = dnsmessage.RCodeFormatError
+		return reply
+	}
+	zone := canonicalName(query.Questions[0].Name)
+	source := fmt.Sprintf("dynamic update from %s", qc.Client.Addr())
+	if qc.Key != "" {
+		source += " signed with key " + qc.Key
+	}
+	changed, err := s.LocalData.update(zone, query.Answers, query.Authorities, source)
+	if err != nil {
+		log.Printf("Rejected update of %s from %s: %v", dnsmessage.FQDN(zone), qc.Client, err)
+		reply.RCode = dnsmessage.RCodeServerFailure
+		var uerr *updateError
+		if errors.As(err, &uerr) {
+			reply.RCode = uerr.rcode
+		}
+		return reply
+	}
+	log.Printf("Applied update of %s from %s, %d records changed", dnsmessage.FQDN(zone), qc.Client, changed)
+	if changed > 0 && s.PersistUpdates {
+		if err := s.LocalData.saveZone(zone); err != nil {
+			log.Printf("Failed to save zone %s: %v", dnsmessage.FQDN(zone), err)
+		}
+	}
+	if changed > 0 {
+		if soa, ok := s.LocalData.soa(zone); ok {
+			s.Notifier.notify(zone, soa)
+		}
+	}
+	return reply
+}
+
+// updateAllowed reports whether the update is signed with one of UpdateKeys or
+// comes from a client in UpdateACL
+func (s *Server) updateAllowed(qc *QueryContext) bool {
+	if qc.Key != "" && slices.Contains(s.UpdateKeys, qc.Key) {
+		return true
+	}
+	return s.UpdateACL != nil && s.UpdateACL.allows(qc.Client.Addr())
+}
+
+// update checks the prerequisites and applies the updates to zone as a whole,
+// returning the number of records added or deleted. The RRsets records are
+// added to are from source from then on.
+func (d *LocalData) update(zone string, prerequisites, updates []dnsmessage.Resource, source string) (int, error) {
+	if d == nil {
+		return 0, updateFailure(dnsmessage.RCodeNotAuth, "no local zones")
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.zones[zone]; !ok {
+		return 0, updateFailure(dnsmessage.RCodeNotAuth, "not authoritative for %s", dnsmessage.FQDN(zone))
+	}
+	if err := d.checkPrerequisites(zone, prerequisites); err != nil {
+		return 0, err
+	}
+	for _, rr := range updates {
+		if err := checkUpdate(zone, rr); err != nil {
+			return 0, err
+		}
+	}
+
+	changed := 0
+	soaUpdated := false
+	for _, rr := range updates {
+		rr.Name = canonicalName(rr.Name)
+		n := d.applyUpdate(zone, rr)
+		if n > 0 && rr.Class == dnsmessage.ClassINET {
+			d.sources[keyOf(&rr)] = source
+		}
+		changed += n
+		soaUpdated = soaUpdated || (n > 0 && rr.Type == dnsmessage.TypeSOA)
+	}
+	if changed > 0 && !soaUpdated {
+		d.bumpSerial(zone)
+	}
+	d.nodes = make(map[string]bool)
+	for name := range d.records {
+		for n := name; !d.nodes[n]; n = parentName(n) {
+			d.nodes[n] = true
+			if n == dnsmessage.Root {
+				break
+			}
+		}
+	}
+	return changed, nil
+}
+
+// checkPrerequisites verifies the prerequisite section of an update
+// (https://www.rfc-editor.org/rfc/rfc2136#section-3.2)
+func (d *LocalData) checkPrerequisites(zone string, prerequisites []dnsmessage.Resource) error {
+	type rrsetKey struct {
+		name string
+		t    dnsmessage.Type
+	}
+	expected := make(map[rrsetKey][]dnsmessage.Resource)
+	var order []rrsetKey
+	for _, rr := range prerequisites {
+		name := canonicalName(rr.Name)
+		if rr.TTL != 0 {
+			return updateFailure(dnsmessage.RCodeFormatError, "prerequisite %s has a TTL", dnsmessage.FQDN(name))
+		}
+		if !isSubdomain(name, zone) {
+			return updateFailure(dnsmessage.RCodeNotZone, "prerequisite %s is outside of the zone", dnsmessage.FQDN(name))
+		}
+		records := d.records[name]
+		switch {
+		case rr.Class == dnsmessage.ClassANY && rr.Type == dnsmessage.TypeANY:
+			if len(records) == 0 {
+				return updateFailure(dnsmessage.RCodeNameError, "%s is not in use", dnsmessage.FQDN(name))
+			}
+		case rr.Class == dnsmessage.ClassANY:
+			if !hasRecords(records, name, rr.Type) {
+				return updateFailure(dnsmessage.RCodeNXRRSet, "%s has no %s records", dnsmessage.FQDN(name), rr.Type)
+			}
+		case rr.Class == dnsmessage.ClassNONE && rr.Type == dnsmessage.TypeANY:
+			if len(records) > 0 {
+				return updateFailure(dnsmessage.RCodeYXDomain, "%s is in use", dnsmessage.FQDN(name))
+			}
+		case rr.Class == dnsmessage.ClassNONE:
+			if hasRecords(records, name, rr.Type) {
+				return updateFailure(dnsmessage.RCodeYXRRSet, "%s has %s records", dnsmessage.FQDN(name), rr.Type)
+			}
+		case rr.Class == dnsmessage.ClassINET && rr.Data != nil:
+			key := rrsetKey{name, rr.Type}
+			if expected[key] == nil {
+				order = append(order, key)
+			}
+			rr.Name = name
+			expected[key] = append(expected[key], rr)
+		default:
+			return updateFailure(dnsmessage.RCodeFormatError, "invalid prerequisite %s", rr)
+		}
+	}
+	// RRsets given with their data must match exactly, whatever the TTL
+	for _, key := range order {
+		var actual []dnsmessage.Resource
+		for _, rr := range d.records[key.name] {
+			if rr.Type == key.t {
+				actual = append(actual, rr)
+			}
+		}
+		want := expected[key]
+		if !sameRecords(actual, want) {
+			return updateFailure(dnsmessage.RCodeNXRRSet, "%s %s records differ", dnsmessage.FQDN(key.name), key.t)
+		}
+	}
+	return nil
+}
+
+// sameRecords reports whether a and b hold the same records, ignoring duplicates and TTLs
+func sameRecords(a, b []dnsmessage.Resource) bool {
+	for _, rr := range a {
+		if !containsRecord(b, rr) {
+			return false
+		}
+	}
+	for _, rr := range b {
+		if !containsRecord(a, rr) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkUpdate validates an update record before any is applied
+// (https://www.rfc-editor.org/rfc/rfc2136#section-3.4.1)
+func checkUpdate(zone string, rr dnsmessage.Resource) error {
+	name := canonicalName(rr.Name)
+	if !isSubdomain(name, zone) {
+		return updateFailure(dnsmessage.RCodeNotZone, "update %s is outside of the zone", dnsmessage.FQDN(name))
+	}
+	switch rr.Class {
+	case dnsmessage.ClassINET:
+		if rr.Data == nil || rr.Type == dnsmessage.TypeANY || rr.Type == dnsmessage.TypeAXFR || rr.Type == dnsmessage.TypeIXFR || rr.Type == dnsmessage.TypeOPT {
+			return updateFailure(dnsmessage.RCodeFormatError, "invalid record %s", rr)
+		}
+	case dnsmessage.ClassANY:
+		if rr.TTL != 0 || rr.Data != nil || rr.Type == dnsmessage.TypeAXFR || rr.Type == dnsmessage.TypeIXFR {
+			return updateFailure(dnsmessage.RCodeFormatError, "invalid RRset deletion %s", rr)
+		}
+	case dnsmessage.ClassNONE:
+		if rr.TTL != 0 || rr.Data == nil || rr.Type == dnsmessage.TypeANY || rr.Type == dnsmessage.TypeAXFR || rr.Type == dnsmessage.TypeIXFR {
+			return updateFailure(dnsmessage.RCodeFormatError, "invalid record deletion %s", rr)
+		}
+	default:
+		return updateFailure(dnsmessage.RCodeFormatError, "update %s has class %s", dnsmessage.FQDN(name), rr.Class)
+	}
+	return nil
+}
+
+// applyUpdate applies a single update record and returns how many records it
+// added or deleted (https://www.rfc-editor.org/rfc/rfc2136#section-3.4.2)
+func (d *LocalData) applyUpdate(zone string, rr dnsmessage.Resource) int {
+	name := rr.Name
+	records := d.records[name]
+	apex := name == zone
+	switch rr.Class {
+	case dnsmessage.ClassINET:
+		hasCNAME := hasRecords(records, name, dnsmessage.TypeCNAME)
+		if rr.Type == dnsmessage.TypeCNAME && len(records) > 0 && !hasCNAME {
+			// A CNAME can't join other data
+			return 0
+		}
+		if rr.Type != dnsmessage.TypeCNAME && hasCNAME {
+			return 0
+		}
+		if rr.Type == dnsmessage.TypeSOA {
+			if !apex || !serialNewer(rr.Data.(*dnsmessage.SOA).Serial, d.zones[zone].Data.(*dnsmessage.SOA).Serial) {
+				return 0
+			}
+			d.records[name] = append(without(records, func(r dnsmessage.Resource) bool { return r.Type == dnsmessage.TypeSOA }), rr)
+			d.zones[zone] = rr
+			return 1
+		}
+		if rr.Type == dnsmessage.TypeCNAME && hasCNAME {
+			// The new CNAME replaces the old one
+			d.records[name] = append(without(records, func(r dnsmessage.Resource) bool { return r.Type == dnsmessage.TypeCNAME }), rr)
+			return 1
+		}
+		if containsRecord(records, rr) {
+			return 0
+		}
+		d.records[name] = append(records, rr)
+		return 1
+	case dnsmessage.ClassANY:
+		kept := without(records, func(r dnsmessage.Resource) bool {
+			if apex && (r.Type == dnsmessage.TypeSOA || r.Type == dnsmessage.TypeNS) {
+				return false
+			}
+			return rr.Type == dnsmessage.TypeANY || r.Type == rr.Type
+		})
+		return d.setRecords(name, kept, len(records)-len(kept))
+	default:
+		if rr.Type == dnsmessage.TypeSOA {
+			return 0
+		}
+		match := rr
+		match.Class = dnsmessage.ClassINET
+		kept := without(records, func(r dnsmessage.Resource) bool { return containsRecord([]dnsmessage.Resource{match}, r) })
+		if apex && rr.Type == dnsmessage.TypeNS && !hasRecords(kept, name, dnsmessage.TypeNS) {
+			// The last NS record of the zone stays
+			return 0
+		}
+		return d.setRecords(name, kept, len(records)-len(kept))
+	}
+}
+
+func (d *LocalData) setRecords(name string, records []dnsmessage.Resource, changed int) int {
+	if len(records) == 0 {
+		delete(d.records, name)
+	} else {
+		d.records[name] = records
+	}
+	return changed
+}
+
+// without returns a copy of records without those drop matches
+func without(records []dnsmessage.Resource, drop func(dnsmessage.Resource) bool) []dnsmessage.Resource {
+	var kept []dnsmessage.Resource
+	for _, r := range records {
+		if !drop(r) {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
+
+// bumpSerial increments the serial of the SOA record of zone
+func (d *LocalData) bumpSerial(zone string) {
+	soa := d.zones[zone]
+	data := *soa.Data.(*dnsmessage.SOA)
+	data.Serial++
+	soa.Data = &data
+	d.zones[zone] = soa
+	d.records[zone] = append(without(d.records[zone], func(r dnsmessage.Resource) bool { return r.Type == dnsmessage.TypeSOA }), soa)
+}
+
+// saveZone rewrites the zone file of zone with its current records, replacing
+// the file at once so a crash never leaves half a zone behind
+func (d *LocalData) saveZone(zone string) error {
+	d.mu.RLock()
+	path, ok := d.files[zone]
+	d.mu.RUnlock()
+	records, _ := d.zoneRecords(zone)
+	if !ok {
+		return fmt.Errorf("zone %s is not loaded from a single zone file", dnsmessage.FQDN(zone))
+	}
+	content := formatZone(zone, records, fmt.Sprintf("rewritten after a dynamic update on %s", time.Now().UTC().Format(time.RFC3339)))
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	tmp.Chmod(info.Mode().Perm())
+	if _, err := tmp.WriteString(content); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// newUpdateTestServer serves the test local data, allowing updates from 127.0.0.1
+func newUpdateTestServer(t *testing.T) *Server {
+	t.Helper()
+	acl, err := NewACL("update", "127.0.0.1/32", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Server{LocalData: newTestLocalData(t, false), UpdateACL: acl}
+}
+
+func sendUpdate(s *Server, client, zone string, prerequisites, updates []dnsmessage.Resource) *dnsmessage.Message {
+	return s.Handle(context.Background(), &QueryContext{Client: netip.MustParseAddrPort(client), Transport: "tcp", Query: &dnsmessage.Message{
+		Header:      dnsmessage.Header{ID: 9, Opcode: dnsmessage.OpcodeUpdate},
+		Questions:   []dnsmessage.Question{question(zone, dnsmessage.TypeSOA)},
+		Answers:     prerequisites,
+		Authorities: updates,
+	}})
+}
+
+// meta builds a record without data, as prerequisites and deletions use them
+func meta(name string, t dnsmessage.Type, class dnsmessage.Class) dnsmessage.Resource {
+	return dnsmessage.Resource{Name: name, Type: t, Class: class}
+}
+
+func zoneSerialOf(t *testing.T, d *LocalData, zone string) uint32 {
+	t.Helper()
+	resp := d.answer(question(zone, dnsmessage.TypeSOA))
+	if resp == nil || len(resp.Answers) != 1 {
+		t.Fatalf("Expected the SOA record of %s, got %+v", zone, resp)
+	}
+	return resp.Answers[0].Data.(*dnsmessage.SOA).Serial
+}
+
+func TestUpdateAddsAndDeletes(t *testing.T) {
+	s := newUpdateTestServer(t)
+	serial := zoneSerialOf(t, s.LocalData, "home.lan")
+
+	resp := sendUpdate(s, "127.0.0.1:5000", "home.lan", []dnsmessage.Resource{meta("nas2.home.lan", dnsmessage.TypeANY, dnsmessage.ClassNONE)}, []dnsmessage.Resource{aRecord("nas2.home.lan", "192.168.1.30")})
+	if resp.RCode != dnsmessage.RCodeSuccess || resp.Opcode != dnsmessage.OpcodeUpdate || resp.ID != 9 {
+		t.Fatalf("Expected the update to succeed, got %+v", resp)
+	}
+	if got := s.LocalData.answer(question("nas2.home.lan", dnsmessage.TypeA)); len(got.Answers) != 1 {
+		t.Errorf("Expected the added record to be answered, got %+v", got)
+	}
+	if got := zoneSerialOf(t, s.LocalData, "home.lan"); got != serial+1 {
+		t.Errorf("Expected the serial to be incremented to %d, got %d", serial+1, got)
+	}
+
+	// Deleting the A RRset of www keeps its AAAA record
+	resp = sendUpdate(s, "127.0.0.1:5000", "home.lan", nil, []dnsmessage.Resource{meta("www.home.lan", dnsmessage.TypeA, dnsmessage.ClassANY)})
+	if resp.RCode != dnsmessage.RCodeSuccess {
+		t.Fatalf("Expected the deletion to succeed, got %s", resp.RCode)
+	}
+	if got := s.LocalData.answer(question("www.home.lan", dnsmessage.TypeA)); got.RCode != dnsmessage.RCodeSuccess || len(got.Answers) != 0 {
+		t.Errorf("Expected NODATA for the deleted RRset, got %+v", got)
+	}
+	// Deleting a single record, then every RRset of the name
+	deleteAAAA := dnsmessage.Resource{Name: "www.home.lan", Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassNONE, Data: &dnsmessage.AAAA{Addr: netip.MustParseAddr("fd00::10")}}
+	sendUpdate(s, "127.0.0.1:5000", "home.lan", nil, []dnsmessage.Resource{deleteAAAA, meta("mail.home.lan", dnsmessage.TypeANY, dnsmessage.ClassANY)})
+	for _, name := range []string{"www.home.lan", "mail.home.lan"} {
+		if got := s.LocalData.answer(question(name, dnsmessage.TypeANY)); got.RCode != dnsmessage.RCodeNameError {
+			t.Errorf("Expected %s to be gone, got %+v", name, got)
+		}
+	}
+
+	// The SOA and NS records of the apex are not deleted with the rest of it
+	sendUpdate(s, "127.0.0.1:5000", "home.lan", nil, []dnsmessage.Resource{meta("home.lan", dnsmessage.TypeANY, dnsmessage.ClassANY)})
+	if got := s.LocalData.answer(question("home.lan", dnsmessage.TypeANY)); len(got.Answers) != 2 {
+		t.Errorf("Expected the apex to keep its SOA and NS records, got %+v", got)
+	}
+}
+
+func TestUpdateRejections(t *testing.T) {
+	s := newUpdateTestServer(t)
+	add := []dnsmessage.Resource{aRecord("nas2.home.lan", "192.168.1.30")}
+	tests := []struct {
+		name          string
+		client, zone  string
+		prerequisites []dnsmessage.Resource
+		updates       []dnsmessage.Resource
+		rcode         dnsmessage.RCode
+	}{
+		{"client outside of the ACL", "192.0.2.1:5000", "home.lan", nil, add, dnsmessage.RCodeRefused},
+		{"zone not served", "127.0.0.1:5000", "example.com", nil, add, dnsmessage.RCodeNotAuth},
+		{"name outside of the zone", "127.0.0.1:5000", "home.lan", nil, []dnsmessage.Resource{aRecord("nas.example.com", "192.0.2.1")}, dnsmessage.RCodeNotZone},
+		{"name in use", "127.0.0.1:5000", "home.lan", []dnsmessage.Resource{meta("www.home.lan", dnsmessage.TypeANY, dnsmessage.ClassNONE)}, add, dnsmessage.RCodeYXDomain},
+		{"name not in use", "127.0.0.1:5000", "home.lan", []dnsmessage.Resource{meta("nope.home.lan", dnsmessage.TypeANY, dnsmessage.ClassANY)}, add, dnsmessage.RCodeNameError},
+		{"RRset exists", "127.0.0.1:5000", "home.lan", []dnsmessage.Resource{meta("www.home.lan", dnsmessage.TypeA, dnsmessage.ClassNONE)}, add, dnsmessage.RCodeYXRRSet},
+		{"RRset missing", "127.0.0.1:5000", "home.lan", []dnsmessage.Resource{meta("www.home.lan", dnsmessage.TypeMX, dnsmessage.ClassANY)}, add, dnsmessage.RCodeNXRRSet},
+		{"RRset differs", "127.0.0.1:5000", "home.lan", []dnsmessage.Resource{{Name: "www.home.lan", Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, Data: &dnsmessage.A{Addr: netip.MustParseAddr("192.168.1.99")}}}, add, dnsmessage.RCodeNXRRSet},
+		{"deletion with a TTL", "127.0.0.1:5000", "home.lan", nil, []dnsmessage.Resource{{Name: "www.home.lan", Type: dnsmessage.TypeA, Class: dnsmessage.ClassANY, TTL: 60}}, dnsmessage.RCodeFormatError},
+	}
+	for _, tt := range tests {
+		if resp := sendUpdate(s, tt.client, tt.zone, tt.prerequisites, tt.updates); resp.RCode != tt.rcode {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.rcode, resp.RCode)
+		}
+	}
+	if got := s.LocalData.answer(question("nas2.home.lan", dnsmessage.TypeA)); got.RCode != dnsmessage.RCodeNameError {
+		t.Errorf("Expected no rejected update to be applied, got %+v", got)
+	}
+
+	// A matching RRset lets the update through
+	matching := []dnsmessage.Resource{{Name: "www.home.lan", Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, Data: &dnsmessage.A{Addr: netip.MustParseAddr("192.168.1.10")}}}
+	if resp := sendUpdate(s, "127.0.0.1:5000", "home.lan", matching, add); resp.RCode != dnsmessage.RCodeSuccess {
+		t.Errorf("Expected the update with a matching RRset to succeed, got %s", resp.RCode)
+	}
+}
+
+func TestUpdateCNAMEConflicts(t *testing.T) {
+	s := newUpdateTestServer(t)
+	cname := cnameRecord("www.home.lan", "elsewhere.example.com")
+	sendUpdate(s, "127.0.0.1:5000", "home.lan", nil, []dnsmessage.Resource{cname, cnameRecord("alias.home.lan", "www.home.lan"), aRecord("alias.home.lan", "192.168.1.40")})
+	if got := s.LocalData.answer(question("www.home.lan", dnsmessage.TypeCNAME)); len(got.Answers) != 0 {
+		t.Errorf("Expected no CNAME next to the records of www, got %+v", got)
+	}
+	if got := s.LocalData.answer(question("alias.home.lan", dnsmessage.TypeANY)); len(got.Answers) != 1 || got.Answers[0].Type != dnsmessage.TypeCNAME {
+		t.Errorf("Expected the CNAME of alias alone, got %+v", got)
+	}
+}
+
+func TestUpdatePersists(t *testing.T) {
+	s := newUpdateTestServer(t)
+	s.PersistUpdates = true
+	if resp := sendUpdate(s, "127.0.0.1:5000", "home.lan", nil, []dnsmessage.Resource{aRecord("nas2.home.lan", "192.168.1.30")}); resp.RCode != dnsmessage.RCodeSuccess {
+		t.Fatalf("Expected the update to succeed, got %s", resp.RCode)
+	}
+	records, err := loadZoneFile(s.LocalData.files["home.lan"], "home.lan")
+	if err != nil {
+		t.Fatalf("Expected the rewritten zone file to load, got %v", err)
+	}
+	reloaded := NewLocalData()
+	if err := reloaded.AddZone("home.lan", records); err != nil {
+		t.Fatal(err)
+	}
+	if got := reloaded.answer(question("nas2.home.lan", dnsmessage.TypeA)); len(got.Answers) != 1 {
+		t.Errorf("Expected the added record in the zone file, got %+v", got)
+	}
+	if got := zoneSerialOf(t, reloaded, "home.lan"); got != zoneSerialOf(t, s.LocalData, "home.lan") {
+		t.Errorf("Expected the incremented serial in the zone file, got %d", got)
+	}
+	if got := reloaded.answer(question("txt.home.lan", dnsmessage.TypeTXT)); len(got.Answers) != 1 || len(got.Answers[0].Data.(*dnsmessage.TXT).Text) != 2 {
+		t.Errorf("Expected the TXT strings to survive the rewrite, got %+v", got)
+	}
+}
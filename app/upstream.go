@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+const (
+	// defaultUpstreamTimeout is how long to wait for an upstream answer per attempt
+	defaultUpstreamTimeout = 2 * time.Second
+	// defaultUpstreamAttempts bounds the attempts per query across all upstreams
+	defaultUpstreamAttempts = 3
+)
+
+var errNoUpstreams = errors.New("no upstream resolvers configured")
+
+// Upstream is a resolver queries are forwarded to
+type Upstream struct {
+	Addr   string
+	Health *UpstreamHealth
+	// Budget caps the traffic sent to the upstream, nil is unlimited
+	Budget *Budget
+	// Cookie is sent along with queries carrying an OPT record, nil sends
+	// no DNS cookie
+	Cookie *upstreamCookie
+	// Encrypted carries the queries over TLS or HTTPS, nil sends them over
+	// plain UDP and TCP
+	Encrypted *EncryptedTransport
+}
+
+// Forwarder sends queries to the healthy upstreams, moving on to the next one
+// when an attempt fails
+type Forwarder struct {
+	Upstreams []*Upstream
+	// Timeout applies to each attempt separately
+	Timeout time.Duration
+	// Attempts is the total number of tries across upstreams before giving up
+	Attempts int
+}
+
+// NewForwarder creates a forwarder from a comma separated list of <ip>:<port>
+// addresses and tls:// and https:// upstreams, see newEncryptedTransport
+func NewForwarder(addrs string) (*Forwarder, error) {
+	f := &Forwarder{Timeout: defaultUpstreamTimeout, Attempts: defaultUpstreamAttempts}
+	for _, addr := range splitList(addrs) {
+		u := &Upstream{Addr: addr, Health: newUpstreamHealth()}
+		if strings.Contains(addr, "://") {
+			var err error
+			if u.Encrypted, err = newEncryptedTransport(addr); err != nil {
+				return nil, fmt.Errorf("invalid upstream %q: %w", addr, err)
+			}
+		} else if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid upstream %q: %w", addr, err)
+		}
+		f.Upstreams = append(f.Upstreams, u)
+	}
+	if len(f.Upstreams) == 0 {
+		return nil, errNoUpstreams
+	}
+	return f, nil
+}
+
+// candidates returns the upstreams in the order they should be tried: alive ones
+// as configured, followed by dead ones by how soon they come back
+func (f *Forwarder) candidates() []*Upstream {
+	alive := make([]*Upstream, 0, len(f.Upstreams))
+	var dead []*Upstream
+	for _, u := range f.Upstreams {
+		if u.Health.Alive() {
+			alive = append(alive, u)
+		} else {
+			dead = append(dead, u)
+		}
+	}
+	sort.SliceStable(dead, func(i, j int) bool {
+		return dead[i].Health.DeadUntil().Before(dead[j].Health.DeadUntil())
+	})
+	return append(alive, dead...)
+}
+
+// Exchange forwards the query and returns the upstream response. Failed attempts
+// and SERVFAIL answers move on to the next upstream, truncated UDP answers are
+// retried over TCP with the same upstream. Encrypted upstreams ignore the
+// network and use their transport. Upstreams over their budget are
+// skipped without using up an attempt. An error is only returned once all
+// attempts failed, or wrapping errBudgetExhausted once no upstream has budget
+// left; if every upstream answered SERVFAIL the last such answer is returned
+// instead.
+func (f *Forwarder) Exchange(ctx context.Context, query *dnsmessage.Message) (*dnsmessage.Message, error) {
+	if len(f.Upstreams) == 0 {
+		return nil, errNoUpstreams
+	}
+	candidates := f.candidates()
+	attempts := max(f.Attempts, 1)
+
+	var lastErr error
+	var lastServFail *dnsmessage.Message
+	overBudget := 0
+	for i, tried := 0, 0; tried < attempts; i++ {
+		if err := contextErr(ctx); err != nil {
+			return nil, err
+		}
+		u := candidates[i%len(candidates)]
+
+		resp, err := u.exchange(ctx, query, f.Timeout, "udp")
+		if errors.Is(err, errOverBudget) {
+			// Spill over to the next upstream, unless none has budget left
+			if overBudget++; overBudget == len(candidates) {
+				if lastServFail != nil {
+					return lastServFail, nil
+				}
+				return nil, fmt.Errorf("%w after %d attempts", errBudgetExhausted, tried)
+			}
+			continue
+		}
+		overBudget = 0
+		tried++
+		if err == nil && resp.Truncated {
+			resp, err = u.exchange(ctx, query, f.Timeout, "tcp")
+		}
+		if err != nil {
+			lastErr = fmt.Errorf("upstream %s: %w", u.Addr, err)
+			continue
+		}
+		if resp.RCode == dnsmessage.RCodeServerFailure {
+			lastServFail = resp
+			continue
+		}
+		source := "upstream " + u.Addr
+		if nsid, ok := nsidOf(resp); ok {
+			source += " nsid " + nsid
+		}
+		provenanceOf(ctx).note(source, resp)
+		return resp, nil
+	}
+	if lastServFail != nil {
+		return lastServFail, nil
+	}
+	return nil, fmt.Errorf("all %d attempts failed, last error: %w", attempts, lastErr)
+}
+
+// exchange sends query to the upstream. An answer with BADCOOKIE carries the
+// server cookie to use, the query is sent again once with it.
+func (u *Upstream) exchange(ctx context.Context, query *dnsmessage.Message, timeout time.Duration, network string) (*dnsmessage.Message, error) {
+	resp, err := u.exchangeOnce(ctx, query, timeout, network)
+	if err == nil && u.Cookie != nil && extendedRCode(resp) == dnsmessage.RCodeBadCookie {
+		return u.exchangeOnce(ctx, query, timeout, network)
+	}
+	return resp, err
+}
+
+func (u *Upstream) exchangeOnce(ctx context.Context, query *dnsmessage.Message, timeout time.Duration, network string) (*dnsmessage.Message, error) {
+	if !u.Budget.Allow() {
+		budgetMetrics.Add(u.Addr+".over", 1)
+		return nil, errOverBudget
+	}
+	attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// Every attempt gets its own transaction ID and, by dialing a new socket, its
+	// own ephemeral source port, so a spoofed answer has to guess both
+	attempt := *u.Cookie.add(query)
+	attempt.ID = newQueryID()
+
+	resp, n, err := u.send(attemptCtx, &attempt, network)
+	u.Budget.Charge(n)
+	if err != nil && contextErr(ctx) != nil {
+		// The query was given up on, the upstream is not to blame
+		return nil, fmt.Errorf("%w: %w", contextErr(ctx), err)
+	}
+	if err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, context.DeadlineExceeded) {
+			queryMetrics.Add("upstream_timeouts", 1)
+		} else {
+			queryMetrics.Add("upstream_errors", 1)
+		}
+		u.markError(err)
+		return nil, err
+	}
+	if err := u.Cookie.update(resp); err != nil {
+		u.markError(err)
+		return nil, err
+	}
+	u.Health.MarkSuccess()
+	resp.ID = query.ID
+	harmonizeTTLs(resp.Answers, u.Addr)
+	harmonizeTTLs(resp.Authorities, u.Addr)
+	harmonizeTTLs(resp.Additionals, u.Addr)
+	return resp, nil
+}
+
+// send exchanges query with the upstream over network, or over its encrypted
+// transport falling back to network when that fails and fallback is allowed
+func (u *Upstream) send(ctx context.Context, query *dnsmessage.Message, network string) (*dnsmessage.Message, int, error) {
+	if u.Encrypted == nil {
+		return exchangePlain(ctx, nil, network, u.Addr, query)
+	}
+	resp, n, err := u.Encrypted.exchange(ctx, query)
+	if err == nil || !u.Encrypted.Fallback || ctx.Err() != nil {
+		return resp, n, err
+	}
+	encryptedMetrics.Add(u.Addr+".fallback", 1)
+	log.Printf("Upstream %s failed, falling back to plain DNS at %s: %v", u.Addr, u.Encrypted.plain, err)
+	resp, sent, err := exchangePlain(ctx, u.Encrypted.Resolver, network, u.Encrypted.plain, query)
+	if err == nil && resp.Truncated && network == "udp" {
+		var more int
+		resp, more, err = exchangePlain(ctx, u.Encrypted.Resolver, "tcp", u.Encrypted.plain, query)
+		sent += more
+	}
+	return resp, n + sent, err
+}
+
+// exchangePlain exchanges query with addr over a new UDP or TCP connection,
+// looking up the host of addr with resolver, the system resolver when nil
+func exchangePlain(ctx context.Context, resolver *net.Resolver, network, addr string, query *dnsmessage.Message) (*dnsmessage.Message, int, error) {
+	// A connected socket is required for the kernel to report ICMP errors back to us,
+	// an unconnected one silently drops them and we would wait for the whole timeout
+	d := net.Dialer{Resolver: resolver}
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return exchangeConn(conn, query)
+}
+
+// newQueryID returns an unpredictable transaction ID for an outgoing query
+func newQueryID() uint16 {
+	var b [2]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint16(b[:])
+}
+
+func (u *Upstream) markError(err error) {
+	if isUnreachable(err) {
+		u.Health.MarkUnreachable(err)
+		return
+	}
+	u.Health.MarkFailure(err)
+}
+
+// isUnreachable reports whether err was caused by an ICMP destination unreachable
+// message (port, host or network) received on a connected socket
+func isUnreachable(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EHOSTUNREACH) ||
+		errors.Is(err, syscall.ENETUNREACH)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+// answerA replies to every query with a single A record
+func answerA(ip string) func(*dnsmessage.Message) *dnsmessage.Message {
+	return func(q *dnsmessage.Message) *dnsmessage.Message {
+		return &dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: q.ID, Response: true, RecursionAvailable: true},
+			Questions: q.Questions,
+			Answers: []dnsmessage.Resource{{
+				Name: q.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60,
+				Data: &dnsmessage.A{Addr: netip.MustParseAddr(ip)},
+			}},
+		}
+	}
+}
+
+// closedUDPAddr returns a localhost address nothing is listening on
+func closedUDPAddr(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+	return addr
+}
+
+func testQuery(name string) *dnsmessage.Message {
+	return &dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 1234, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+}
+
+func TestForwarderFailsFastOnPortUnreachable(t *testing.T) {
+	f, err := NewForwarder(closedUDPAddr(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Timeout = 5 * time.Second
+
+	start := time.Now()
+	_, err = f.Exchange(context.Background(), testQuery("example.com"))
+	if err == nil {
+		t.Fatal("Expected an error from a closed port")
+	}
+	if !isUnreachable(err) {
+		t.Fatalf("Expected an ICMP unreachable error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Exchange took %s, expected it to fail fast", elapsed)
+	}
+	if f.Upstreams[0].Health.Alive() {
+		t.Error("Expected upstream to be marked dead after ICMP port unreachable")
+	}
+}
+
+func TestForwarderSkipsDeadUpstream(t *testing.T) {
+	good := dnstest.StartUDPServer(t, answerA("192.0.2.1")).Addr
+	f, err := NewForwarder(closedUDPAddr(t) + "," + good)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first exchange discovers the dead upstream and retries with the next one
+	resp, err := f.Exchange(context.Background(), testQuery("example.com"))
+	if err != nil {
+		t.Fatalf("Expected the exchange to fall back to the healthy upstream: %v", err)
+	}
+	if len(resp.Answers) != 1 || resp.Answers[0].Data.String() != "192.0.2.1" {
+		t.Errorf("Unexpected answers: %+v", resp.Answers)
+	}
+	if f.Upstreams[0].Health.Alive() {
+		t.Error("Expected the closed upstream to be marked dead")
+	}
+	if got := f.candidates()[0]; got != f.Upstreams[1] {
+		t.Errorf("Expected the healthy upstream to be tried first, got %s", got.Addr)
+	}
+}
+
+func TestForwarderRetriesAfterTimeout(t *testing.T) {
+	silent := dnstest.StartUDPServer(t, func(*dnsmessage.Message) *dnsmessage.Message { return nil }).Addr
+	good := dnstest.StartUDPServer(t, answerA("192.0.2.2")).Addr
+	f, err := NewForwarder(silent + "," + good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Timeout = 100 * time.Millisecond
+
+	resp, err := f.Exchange(context.Background(), testQuery("example.com"))
+	if err != nil {
+		t.Fatalf("Expected the retry to succeed: %v", err)
+	}
+	if resp.Answers[0].Data.String() != "192.0.2.2" {
+		t.Errorf("Unexpected answer %s", resp.Answers[0])
+	}
+}
+
+func TestForwarderGivesUpAfterAttempts(t *testing.T) {
+	var queries atomic.Int32
+	servfail := dnstest.StartUDPServer(t, func(q *dnsmessage.Message) *dnsmessage.Message {
+		queries.Add(1)
+		return &dnsmessage.Message{Header: dnsmessage.Header{ID: q.ID, Response: true, RCode: dnsmessage.RCodeServerFailure}, Questions: q.Questions}
+	}).Addr
+	f, err := NewForwarder(servfail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Attempts = 2
+
+	resp, err := f.Exchange(context.Background(), testQuery("example.com"))
+	if err != nil || resp.RCode != dnsmessage.RCodeServerFailure {
+		t.Fatalf("Expected the upstream SERVFAIL to be returned, got %v %v", resp, err)
+	}
+	if n := queries.Load(); n != 2 {
+		t.Errorf("Expected 2 attempts, got %d", n)
+	}
+
+	f, err = NewForwarder(closedUDPAddr(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Exchange(context.Background(), testQuery("example.com")); err == nil {
+		t.Error("Expected an error once every attempt failed")
+	}
+}
+
+func TestForwarderFallsBackToTCPOnTruncation(t *testing.T) {
+	addr := dnstest.StartUDPServer(t, func(q *dnsmessage.Message) *dnsmessage.Message {
+		return &dnsmessage.Message{Header: dnsmessage.Header{ID: q.ID, Response: true, Truncated: true}, Questions: q.Questions}
+	}).Addr
+	dnstest.StartTCPServerOn(t, addr, answerA("192.0.2.3"))
+
+	f, err := NewForwarder(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := f.Exchange(context.Background(), testQuery("example.com"))
+	if err != nil {
+		t.Fatalf("Exchange failed: %v", err)
+	}
+	if resp.Truncated || len(resp.Answers) != 1 || resp.Answers[0].Data.String() != "192.0.2.3" {
+		t.Errorf("Expected the full answer over TCP, got %s", resp)
+	}
+}
+
+func TestForwarderRejectsMismatchedResponses(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 65535)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var query dnsmessage.Message
+		if err := query.Unpack(buf[:n]); err != nil {
+			return
+		}
+
+		// Spoofed answers with a guessed ID, wrong name, type or class, followed by the real one
+		spoofed := []func(*dnsmessage.Message){
+			func(m *dnsmessage.Message) { m.ID++ },
+			func(m *dnsmessage.Message) { m.Questions[0].Name = "evil.example" },
+			func(m *dnsmessage.Message) { m.Questions[0].Type = dnsmessage.TypeAAAA },
+			func(m *dnsmessage.Message) { m.Questions[0].Class = dnsmessage.ClassCHAOS },
+			func(m *dnsmessage.Message) { m.Questions = nil },
+		}
+		for _, spoof := range spoofed {
+			resp := answerA("203.0.113.66")(&query)
+			resp.Questions = append([]dnsmessage.Question(nil), query.Questions...)
+			spoof(resp)
+			packed, _ := resp.Pack()
+			conn.WriteTo(packed, addr)
+		}
+		// Case differences in the echoed name are fine
+		resp := answerA("192.0.2.4")(&query)
+		resp.Questions = []dnsmessage.Question{query.Questions[0]}
+		resp.Questions[0].Name = "EXAMPLE.com."
+		packed, _ := resp.Pack()
+		conn.WriteTo(packed, addr)
+	}()
+
+	f, err := NewForwarder(conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := f.Exchange(context.Background(), testQuery("example.com"))
+	if err != nil {
+		t.Fatalf("Exchange failed: %v", err)
+	}
+	if len(resp.Answers) != 1 || resp.Answers[0].Data.String() != "192.0.2.4" {
+		t.Errorf("Expected only the genuine answer to be accepted, got %s", resp)
+	}
+	if resp.ID != testQuery("example.com").ID {
+		t.Errorf("Expected the response to carry the caller's ID, got %d", resp.ID)
+	}
+}
+
+func TestNewQueryIDIsRandom(t *testing.T) {
+	seen := make(map[uint16]bool)
+	for i := 0; i < 100; i++ {
+		seen[newQueryID()] = true
+	}
+	// 100 draws from 65536 values almost never collide more than a few times
+	if len(seen) < 95 {
+		t.Errorf("Expected mostly distinct query IDs, got %d distinct out of 100", len(seen))
+	}
+}
+
+func TestUpstreamHealthBackoff(t *testing.T) {
+	now := time.Unix(1000, 0)
+	h := newUpstreamHealth()
+	h.now = func() time.Time { return now }
+
+	timeout := errors.New("timeout")
+	for i := 0; i < maxConsecutiveFailures-1; i++ {
+		h.MarkFailure(timeout)
+	}
+	if !h.Alive() {
+		t.Fatal("Upstream should stay alive below the failure threshold")
+	}
+	h.MarkFailure(timeout)
+	if h.Alive() {
+		t.Fatal("Upstream should be dead after consecutive failures")
+	}
+	if got := h.DeadUntil().Sub(now); got != minDeadTime {
+		t.Errorf("Expected first backoff of %s, got %s", minDeadTime, got)
+	}
+
+	now = now.Add(minDeadTime)
+	if !h.Alive() {
+		t.Fatal("Upstream should be retried after the backoff")
+	}
+	h.MarkUnreachable(timeout)
+	if got := h.DeadUntil().Sub(now); got != 2*minDeadTime {
+		t.Errorf("Expected doubled backoff, got %s", got)
+	}
+
+	h.MarkSuccess()
+	if !h.Alive() || h.failures != 0 {
+		t.Error("Success should reset the health state")
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+const (
+	// dotPort is the port of DNS over TLS (https://www.rfc-editor.org/rfc/rfc7858#section-3.1)
+	dotPort = "853"
+	// dohContentType is the media type of DNS over HTTPS messages
+	// (https://www.rfc-editor.org/rfc/rfc8484#section-6)
+	dohContentType = "application/dns-message"
+	// encryptedIdleConns bounds the idle connections kept per upstream
+	encryptedIdleConns = 4
+	// dotIdleTimeout is how long idle DNS over TLS connections are reused,
+	// servers close them soon after (https://www.rfc-editor.org/rfc/rfc7766#section-6.2.3)
+	dotIdleTimeout = 10 * time.Second
+)
+
+// encryptedMetrics counts the connections to encrypted upstreams, new and
+// resumed TLS sessions and the fallbacks to plain DNS, by upstream
+var encryptedMetrics = expvar.NewMap("upstream_encrypted")
+
+// EncryptedTransport carries the queries of an upstream over DNS over TLS
+// (RFC 7858) or DNS over HTTPS (RFC 8484), so they leave the network
+// encrypted. Connections are pooled and TLS sessions resumed to spare
+// handshakes. When Fallback is set, queries the encrypted connection fails
+// for go over plain DNS to port 53 of the same host.
+type EncryptedTransport struct {
+	// Scheme is tls or https
+	Scheme string
+	// Fallback sends queries over plain DNS when the encrypted transport fails
+	Fallback bool
+	// Resolver looks up the host of the upstream and of its fallback, nil
+	// leaves it to the system resolver. It is set before the first query.
+	Resolver *net.Resolver
+
+	// spec is the upstream as configured, the key of its metrics
+	spec string
+	// addr is the address DNS over TLS connects to
+	addr string
+	// url is the URL DNS over HTTPS queries are posted to
+	url string
+	// plain is the address of the fallback
+	plain     string
+	tlsConfig *tls.Config
+	client    *http.Client
+
+	mu   sync.Mutex
+	idle []idleConn
+}
+
+type idleConn struct {
+	conn  *tls.Conn
+	since time.Time
+}
+
+// newEncryptedTransport creates the transport of an upstream given as
+// tls://<host>[:<port>][#<server name>] or as https:// URL. The server name
+// verified defaults to the host, an IP address is verified against the IP
+// addresses of the certificate then.
+func newEncryptedTransport(spec string) (*EncryptedTransport, error) {
+	e := &EncryptedTransport{spec: spec, tlsConfig: &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// Resumed sessions spare the full handshake on new connections
+		ClientSessionCache: tls.NewLRUClientSessionCache(8),
+	}}
+	scheme, rest, _ := strings.Cut(spec, "://")
+	var host string
+	switch scheme {
+	case "tls":
+		e.Scheme = "tls"
+		hostport, name, _ := strings.Cut(rest, "#")
+		if strings.ContainsAny(hostport, "/?") {
+			return nil, fmt.Errorf("expected tls://<host>[:<port>][#<server name>], got %q", spec)
+		}
+		var port string
+		var err error
+		if host, port, err = net.SplitHostPort(hostport); err != nil {
+			host, port = strings.Trim(hostport, "[]"), dotPort
+		}
+		if host == "" {
+			return nil, fmt.Errorf("no host in %q", spec)
+		}
+		e.addr = net.JoinHostPort(host, port)
+		e.tlsConfig.ServerName = host
+		if name != "" {
+			e.tlsConfig.ServerName = name
+		}
+	case "https":
+		e.Scheme = "https"
+		u, err := url.Parse(spec)
+		if err != nil {
+			return nil, err
+		}
+		if u.Hostname() == "" {
+			return nil, fmt.Errorf("no host in %q", spec)
+		}
+		if u.Path == "" {
+			u.Path = "/dns-query"
+		}
+		host, e.url = u.Hostname(), u.String()
+		e.tlsConfig.ServerName = host
+		e.tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+		e.client = &http.Client{Transport: &http.Transport{
+			// Dialing TLS itself counts the connections and resumptions
+			DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return e.dialTLS(ctx, network, addr)
+			},
+			ForceAttemptHTTP2:   true,
+			MaxIdleConnsPerHost: encryptedIdleConns,
+			IdleConnTimeout:     90 * time.Second,
+		}}
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q, expected tls:// or https://", scheme)
+	}
+	e.plain = net.JoinHostPort(host, "53")
+	return e, nil
+}
+
+// newBootstrapResolver creates a resolver asking the servers, given as
+// <ip>:<port>, in turn instead of the system resolver. Upstreams given by
+// host name are looked up with it, the system resolver may well be this
+// server.
+func newBootstrapResolver(spec string) (*net.Resolver, error) {
+	servers := splitList(spec)
+	for _, server := range servers {
+		if _, err := netip.ParseAddrPort(server); err != nil {
+			return nil, fmt.Errorf("expected <ip>:<port>, got %q", server)
+		}
+	}
+	if len(servers) == 0 {
+		return nil, nil
+	}
+	var next atomic.Uint32
+	return &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, servers[int(next.Add(1)-1)%len(servers)])
+	}}, nil
+}
+
+// exchange sends query over the encrypted transport, returning the bytes
+// sent and received like exchangeConn
+func (e *EncryptedTransport) exchange(ctx context.Context, query *dnsmessage.Message) (*dnsmessage.Message, int, error) {
+	if e.Scheme == "https" {
+		return e.exchangeHTTPS(ctx, query)
+	}
+	conn, reused, err := e.conn(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, n, err := e.exchangeTLS(ctx, conn, query)
+	if err != nil && reused {
+		// The server may have closed the idle connection meanwhile
+		var sent int
+		if conn, _, err = e.dial(ctx); err != nil {
+			return nil, n, err
+		}
+		resp, sent, err = e.exchangeTLS(ctx, conn, query)
+		n += sent
+	}
+	return resp, n, err
+}
+
+// exchangeTLS exchanges query over conn, which goes back to the pool after
+// an answer and is closed otherwise
+func (e *EncryptedTransport) exchangeTLS(ctx context.Context, conn *tls.Conn, query *dnsmessage.Message) (*dnsmessage.Message, int, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	resp, n, err := exchangeConn(conn, query)
+	if err != nil {
+		conn.Close()
+		return nil, n, err
+	}
+	e.release(conn)
+	return resp, n, nil
+}
+
+// conn returns a pooled connection, or a new one when none is idle, and
+// whether it was pooled
+func (e *EncryptedTransport) conn(ctx context.Context) (*tls.Conn, bool, error) {
+	e.mu.Lock()
+	for len(e.idle) > 0 {
+		last := e.idle[len(e.idle)-1]
+		e.idle = e.idle[:len(e.idle)-1]
+		if time.Since(last.since) < dotIdleTimeout {
+			e.mu.Unlock()
+			return last.conn, true, nil
+		}
+		last.conn.Close()
+	}
+	e.mu.Unlock()
+	return e.dial(ctx)
+}
+
+func (e *EncryptedTransport) dial(ctx context.Context) (*tls.Conn, bool, error) {
+	conn, err := e.dialTLS(ctx, "tcp", e.addr)
+	if err != nil {
+		return nil, false, err
+	}
+	return conn, false, nil
+}
+
+// dialTLS connects to addr, counting the connection and whether its TLS
+// session was resumed
+func (e *EncryptedTransport) dialTLS(ctx context.Context, network, addr string) (*tls.Conn, error) {
+	d := tls.Dialer{NetDialer: &net.Dialer{Resolver: e.Resolver}, Config: e.tlsConfig}
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := conn.(*tls.Conn)
+	encryptedMetrics.Add(e.spec+".connections", 1)
+	if tlsConn.ConnectionState().DidResume {
+		encryptedMetrics.Add(e.spec+".resumed", 1)
+	}
+	return tlsConn, nil
+}
+
+// release puts conn back into the pool, closing it when the pool is full
+func (e *EncryptedTransport) release(conn *tls.Conn) {
+	conn.SetDeadline(time.Time{})
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.idle) >= encryptedIdleConns {
+		conn.Close()
+		return
+	}
+	e.idle = append(e.idle, idleConn{conn: conn, since: time.Now()})
+}
+
+// Close closes the idle connections
+func (e *EncryptedTransport) Close() {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	for _, c := range e.idle {
+		c.conn.Close()
+	}
+	e.idle = nil
+	e.mu.Unlock()
+	if e.client != nil {
+		e.client.CloseIdleConnections()
+	}
+}
+
+// exchangeHTTPS posts query to the DNS over HTTPS URL. The ID is 0 so HTTP
+// caches can share the answer (https://www.rfc-editor.org/rfc/rfc8484#section-4.1).
+func (e *EncryptedTransport) exchangeHTTPS(ctx context.Context, query *dnsmessage.Message) (*dnsmessage.Message, int, error) {
+	attempt := *query
+	attempt.ID = 0
+	packed, err := attempt.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+	httpResp, err := e.client.Do(req)
+	if err != nil {
+		return nil, len(packed), err
+	}
+	defer httpResp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(httpResp.Body, 0xFFFF+1))
+	n := len(packed) + len(body)
+	if err != nil {
+		return nil, n, err
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, n, fmt.Errorf("HTTP status %s", httpResp.Status)
+	}
+	if len(body) > 0xFFFF {
+		return nil, n, errMessageTooLarge
+	}
+	var resp dnsmessage.Message
+	if err := resp.Unpack(body); err != nil {
+		return nil, n, err
+	}
+	if !isResponseTo(&resp, &attempt) {
+		return nil, n, errors.New("the answer doesn't match the query")
+	}
+	resp.ID = query.ID
+	return &resp, n, nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+// startFakeDoH serves handler over DNS over HTTPS and returns its URL and the
+// certificate pool trusting it
+func startFakeDoH(t *testing.T, handler func(*dnsmessage.Message) *dnsmessage.Message) (*httptest.Server, *x509.CertPool) {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var query dnsmessage.Message
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != dohContentType || query.Unpack(body) != nil {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		if query.ID != 0 {
+			http.Error(w, "expected ID 0", http.StatusBadRequest)
+			return
+		}
+		packed, _ := handler(&query).Pack()
+		w.Header().Set("Content-Type", dohContentType)
+		w.Write(packed)
+	}))
+	t.Cleanup(srv.Close)
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	return srv, pool
+}
+
+// startFakeDoT serves handler over DNS over TLS with the certificate of a
+// test HTTPS server and returns its address, the pool trusting it and the
+// number of connections accepted
+func startFakeDoT(t *testing.T, handler func(*dnsmessage.Message) *dnsmessage.Message) (string, *x509.CertPool, *atomic.Int32) {
+	t.Helper()
+	https, pool := startFakeDoH(t, handler)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: https.TLS.Certificates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	var conns atomic.Int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns.Add(1)
+			go func() {
+				defer conn.Close()
+				for {
+					data, err := readTCPMessage(conn)
+					if err != nil {
+						return
+					}
+					var query dnsmessage.Message
+					if query.Unpack(data) != nil {
+						return
+					}
+					packed, _ := handler(&query).Pack()
+					writeTCPMessage(conn, packed)
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), pool, &conns
+}
+
+func newEncryptedForwarder(t *testing.T, spec string, pool *x509.CertPool) *Forwarder {
+	t.Helper()
+	f, err := NewForwarder(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Upstreams[0].Encrypted.tlsConfig.RootCAs = pool
+	return f
+}
+
+func TestForwarderOverTLS(t *testing.T) {
+	addr, pool, conns := startFakeDoT(t, answerA("192.0.2.1"))
+	f := newEncryptedForwarder(t, "tls://"+addr, pool)
+	for i := 0; i < 3; i++ {
+		resp, err := f.Exchange(context.Background(), testQuery("www.example.com"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.ID != 1234 || len(resp.Answers) != 1 {
+			t.Fatalf("Unexpected answer %v", resp)
+		}
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("Expected the connection to be reused, got %d connections", n)
+	}
+
+	// A connection the server closed is replaced
+	f.Upstreams[0].Encrypted.idle[0].conn.Close()
+	if _, err := f.Exchange(context.Background(), testQuery("www.example.com")); err != nil {
+		t.Errorf("Expected a new connection after the pooled one was closed, got %v", err)
+	}
+}
+
+func TestForwarderOverHTTPS(t *testing.T) {
+	srv, pool := startFakeDoH(t, answerA("192.0.2.2"))
+	f := newEncryptedForwarder(t, srv.URL+"/dns-query", pool)
+	resp, err := f.Exchange(context.Background(), testQuery("www.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ID != 1234 || len(resp.Answers) != 1 || resp.Answers[0].Data.String() != "192.0.2.2" {
+		t.Errorf("Unexpected answer %v", resp)
+	}
+
+	// The certificate is verified
+	f = newEncryptedForwarder(t, srv.URL, x509.NewCertPool())
+	f.Upstreams[0].Encrypted.Fallback = false
+	if _, err := f.Exchange(context.Background(), testQuery("www.example.com")); err == nil {
+		t.Error("Expected an untrusted certificate to fail")
+	}
+}
+
+func TestEncryptedFallback(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().String()
+	l.Close()
+
+	f := newEncryptedForwarder(t, "tls://"+closed, nil)
+	f.Attempts = 1
+	f.Upstreams[0].Encrypted.plain = dnstest.StartUDPServer(t, answerA("192.0.2.3")).Addr
+	if _, err := f.Exchange(context.Background(), testQuery("www.example.com")); err == nil {
+		t.Error("Expected no fallback to plain DNS unless enabled")
+	}
+	f.Upstreams[0].Encrypted.Fallback = true
+	resp, err := f.Exchange(context.Background(), testQuery("www.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answers) != 1 || resp.Answers[0].Data.String() != "192.0.2.3" {
+		t.Errorf("Expected the plain DNS answer, got %v", resp)
+	}
+}
+
+func TestNewEncryptedTransport(t *testing.T) {
+	for spec, want := range map[string]string{
+		"tls://1.1.1.1":                      "1.1.1.1:853 1.1.1.1 1.1.1.1:53",
+		"tls://1.1.1.1:8853#one.one.one.one": "1.1.1.1:8853 one.one.one.one 1.1.1.1:53",
+		"tls://[2606:4700::1111]":            "[2606:4700::1111]:853 2606:4700::1111 [2606:4700::1111]:53",
+		"https://dns.google":                 "https://dns.google/dns-query dns.google dns.google:53",
+		"https://9.9.9.9:5053/query":         "https://9.9.9.9:5053/query 9.9.9.9 9.9.9.9:53",
+	} {
+		e, err := newEncryptedTransport(spec)
+		if err != nil {
+			t.Errorf("%s: %v", spec, err)
+			continue
+		}
+		target := e.addr
+		if e.Scheme == "https" {
+			target = e.url
+		}
+		if got := strings.Join([]string{target, e.tlsConfig.ServerName, e.plain}, " "); got != want {
+			t.Errorf("Expected %s to give %s, got %s", spec, want, got)
+		}
+	}
+	for _, spec := range []string{"quic://1.1.1.1", "tls://", "tls://1.1.1.1/dns-query", "https:///dns-query"} {
+		if _, err := newEncryptedTransport(spec); err == nil {
+			t.Errorf("Expected %s to be rejected", spec)
+		}
+	}
+}
+
+func TestEncryptedBootstrap(t *testing.T) {
+	addr, pool, _ := startFakeDoT(t, answerA("192.0.2.4"))
+	_, port, _ := net.SplitHostPort(addr)
+	// The test certificate is valid for example.com, which the bootstrap
+	// resolver has at the address of the server
+	bootstrap := dnstest.StartUDPServer(t, func(query *dnsmessage.Message) *dnsmessage.Message {
+		resp := &dnsmessage.Message{Header: dnsmessage.Header{ID: query.ID, Response: true}, Questions: query.Questions}
+		if q := query.Questions[0]; q.Type == dnsmessage.TypeA && canonicalName(q.Name) == "example.com" {
+			resp.Answers = []dnsmessage.Resource{aRecord(q.Name, "127.0.0.1")}
+		}
+		return resp
+	}).Addr
+	f := newEncryptedForwarder(t, "tls://example.com:"+port, pool)
+	var err error
+	if f.Upstreams[0].Encrypted.Resolver, err = newBootstrapResolver(bootstrap); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := f.Exchange(context.Background(), testQuery("www.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answers) != 1 || resp.Answers[0].Data.String() != "192.0.2.4" {
+		t.Errorf("Expected the answer over TLS, got %v", resp)
+	}
+
+	for _, spec := range []string{"dns.example:53", "192.0.2.53"} {
+		if _, err := newBootstrapResolver(spec); err == nil {
+			t.Errorf("Expected the bootstrap resolver %q to be rejected", spec)
+		}
+	}
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// keyCacheTTL is how long the validated keys of a zone, or the proof that it
+// is unsigned, are trusted before they are fetched again
+const keyCacheTTL = 10 * time.Minute
+
+var dnssecMetrics = expvar.NewMap("dnssec")
+
+// Validator checks the DNSSEC signatures of upstream answers, following the
+// chain of DS and DNSKEY records down from the trust anchors
+// (https://www.rfc-editor.org/rfc/rfc4035#section-5)
+type Validator struct {
+	// anchors hold the DS and DNSKEY records trusted without validation, by zone
+	anchors map[string][]dnsmessage.Resource
+	// exchange asks the upstreams a question with the DO bit set
+	exchange func(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error)
+	now      func() time.Time
+
+	mu    sync.Mutex
+	zones map[string]*zoneKeys
+}
+
+// zoneKeys are the validated keys of a zone
+type zoneKeys struct {
+	// keys is nil for a zone proven to be unsigned
+	keys    []*dnsmessage.DNSKEY
+	expires time.Time
+}
+
+// loadTrustAnchors reads the DS and DNSKEY records of a master file, such as
+// the root anchors published by IANA in that format
+func loadTrustAnchors(path string) ([]dnsmessage.Resource, error) {
+	records, err := loadZoneFile(path, dnsmessage.Root)
+	if err != nil {
+		return nil, err
+	}
+	var anchors []dnsmessage.Resource
+	for _, rr := range records {
+		if rr.Type == dnsmessage.TypeDS || rr.Type == dnsmessage.TypeDNSKEY {
+			anchors = append(anchors, rr)
+		}
+	}
+	if len(anchors) == 0 {
+		return nil, fmt.Errorf("%s: no DS or DNSKEY records", path)
+	}
+	return anchors, nil
+}
+
+// NewValidator creates a validator trusting the DS and DNSKEY records anchors,
+// exchange sends its queries for DS and DNSKEY records upstream
+func NewValidator(anchors []dnsmessage.Resource, exchange func(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error)) *Validator {
+	v := &Validator{anchors: make(map[string][]dnsmessage.Resource), exchange: exchange, now: time.Now, zones: make(map[string]*zoneKeys)}
+	for _, rr := range anchors {
+		zone := canonicalName(rr.Name)
+		v.anchors[zone] = append(v.anchors[zone], rr)
+	}
+	return v
+}
+
+// anchorOf returns the closest trust anchor name is under, "" without one
+func (v *Validator) anchorOf(name string) string {
+	for {
+		if _, ok := v.anchors[name]; ok {
+			return name
+		}
+		if name == dnsmessage.Root {
+			return ""
+		}
+		name = parentName(name)
+	}
+}
+
+type checkingDisabledKey struct{}
+
+// withCheckingDisabled returns a context answering a query with the CD bit,
+// from a client checking the signatures itself: answers failing validation
+// are passed on to it instead of failing the query
+// (https://www.rfc-editor.org/rfc/rfc4035#section-3.2.2)
+func withCheckingDisabled(ctx context.Context) context.Context {
+	return context.WithValue(ctx, checkingDisabledKey{}, true)
+}
+
+// checkingDisabled reports whether ctx answers a query with the CD bit
+func checkingDisabled(ctx context.Context) bool {
+	disabled, _ := ctx.Value(checkingDisabledKey{}).(bool)
+	return disabled
+}
+
+// validate checks resp, the upstream answer to question. Secure answers get
+// the AD bit, insecure ones are returned as they are and bogus ones are an error.
+func (v *Validator) validate(ctx context.Context, question dnsmessage.Question, resp *dnsmessage.Message) (*dnsmessage.Message, error) {
+	resp.AuthenticData = false
+	if resp.RCode != dnsmessage.RCodeSuccess && resp.RCode != dnsmessage.RCodeNameError || v.anchorOf(question.Name) == "" {
+		return resp, nil
+	}
+	// Authority records besides the proofs, like the NS records of a
+	// referral, are not signed and not needed by the client
+	var authorities []dnsmessage.Resource
+	for _, rr := range resp.Authorities {
+		if t := coveredType(rr); t == dnsmessage.TypeSOA || t == dnsmessage.TypeNSEC || t == dnsmessage.TypeNSEC3 {
+			authorities = append(authorities, rr)
+		}
+	}
+	resp.Authorities = authorities
+
+	secure, err := v.check(ctx, question, resp)
+	if err != nil {
+		dnssecMetrics.Add("bogus", 1)
+		return nil, fmt.Errorf("DNSSEC validation of %s failed: %w", dnsmessage.FQDN(question.Name), err)
+	}
+	if !secure {
+		dnssecMetrics.Add("insecure", 1)
+		return resp, nil
+	}
+	dnssecMetrics.Add("secure", 1)
+	resp.AuthenticData = true
+	now := v.now()
+	capSignedTTLs(resp.Answers, now)
+	capSignedTTLs(resp.Authorities, now)
+	return resp, nil
+}
+
+// check validates every RRset of the answer and authority sections, and the
+// denial of existence of negative answers and wildcard expansions
+func (v *Validator) check(ctx context.Context, question dnsmessage.Question, resp *dnsmessage.Message) (bool, error) {
+	d := &denial{}
+	// wildcards maps the owners of RRsets expanded from a wildcard to the
+	// name the wildcard is at
+	wildcards := make(map[string]string)
+	for _, section := range [][]dnsmessage.Resource{resp.Answers, resp.Authorities} {
+		for _, set := range signedRRsets(section) {
+			secure, err := v.checkRRset(ctx, set)
+			if err != nil || !secure {
+				return false, err
+			}
+			// Records owned by a wildcard itself are signed without its label
+			// too, only the names it expands to are missing labels
+			owner := set.Name
+			if isWildcard(owner) {
+				owner = parentName(owner)
+			}
+			if labels := int(set.sigs[0].Labels); labels < labelCount(owner) {
+				ce := set.Name
+				for labelCount(ce) > labels {
+					ce = parentName(ce)
+				}
+				wildcards[set.Name] = ce
+			}
+			switch set.Type {
+			case dnsmessage.TypeNSEC:
+				d.nsec = append(d.nsec, set.records...)
+			case dnsmessage.TypeNSEC3:
+				d.nsec3 = append(d.nsec3, set.records...)
+			}
+		}
+	}
+
+	proofs := []proof{}
+	for name, ce := range wildcards {
+		proofs = append(proofs, d.wildcardExpansion(name, ce))
+	}
+	end, _, _ := followCNAMEs(resp.Answers, question.Name)
+	switch {
+	case resp.RCode == dnsmessage.RCodeNameError:
+		proofs = append(proofs, d.nameError(end))
+	case question.Type == dnsmessage.TypeCNAME || question.Type == dnsmessage.TypeANY:
+		if len(resp.Answers) == 0 {
+			proofs = append(proofs, d.noData(canonicalName(question.Name), question.Type))
+		}
+	case !hasRecords(resp.Answers, end, question.Type):
+		proofs = append(proofs, d.noData(end, question.Type))
+	}
+	secure := true
+	for _, p := range proofs {
+		switch p {
+		case proofOptOut:
+			secure = false
+		case proofMissing:
+			// Negative answers from an unsigned zone come without proof
+			keys, err := v.keysFor(ctx, end)
+			if err != nil {
+				return false, err
+			}
+			if keys != nil {
+				return false, fmt.Errorf("no proof of the denial of existence of %s", dnsmessage.FQDN(end))
+			}
+			secure = false
+		}
+	}
+	return secure, nil
+}
+
+// checkRRset validates an RRset of a response: it is secure when signed by the
+// keys of its zone and insecure when the zone is proven unsigned
+func (v *Validator) checkRRset(ctx context.Context, set *signedRRset) (bool, error) {
+	if len(set.sigs) == 0 {
+		keys, err := v.keysFor(ctx, set.Name)
+		if err != nil {
+			return false, err
+		}
+		if keys != nil {
+			return false, fmt.Errorf("%s %s is not signed", dnsmessage.FQDN(set.Name), set.Type)
+		}
+		return false, nil
+	}
+	signer := canonicalName(set.sigs[0].SignerName)
+	// DS records are signed by the parent zone, everything else by the zone
+	// the owner is in (https://www.rfc-editor.org/rfc/rfc4035#section-5.3.1)
+	if !isSubdomain(set.Name, signer) || set.Type == dnsmessage.TypeDS && set.Name == signer {
+		return false, fmt.Errorf("%s %s is signed by %s", dnsmessage.FQDN(set.Name), set.Type, dnsmessage.FQDN(signer))
+	}
+	keys, err := v.keysFor(ctx, signer)
+	if err != nil || keys == nil {
+		return false, err
+	}
+	return true, v.verify(set, signer, keys)
+}
+
+// verify checks that one of the signatures of set by zone verifies with keys
+func (v *Validator) verify(set *signedRRset, zone string, keys []*dnsmessage.DNSKEY) error {
+	now := v.now()
+	err := errors.New("no signature by a key of " + dnsmessage.FQDN(zone))
+	for _, sig := range set.sigs {
+		if canonicalName(sig.SignerName) != zone {
+			continue
+		}
+		if !signatureValid(sig, now) {
+			err = errors.New("signature is expired or not valid yet")
+			continue
+		}
+		for _, key := range keys {
+			if key.Algorithm != sig.Algorithm || key.KeyTag() != sig.KeyTag {
+				continue
+			}
+			data, derr := dnsmessage.SignedData(sig, set.records)
+			if derr != nil {
+				return derr
+			}
+			if err = verifySignature(key, sig, data); err == nil {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%s %s: %w", dnsmessage.FQDN(set.Name), set.Type, err)
+}
+
+// keysFor returns the validated keys of the zone name is in. Names that are not
+// the apex of a zone get the keys of their parent zone. It returns nil for
+// names in unsigned zones and those under no trust anchor.
+func (v *Validator) keysFor(ctx context.Context, name string) ([]*dnsmessage.DNSKEY, error) {
+	name = canonicalName(name)
+	if v.anchorOf(name) == "" {
+		return nil, nil
+	}
+	now := v.now()
+	v.mu.Lock()
+	zk, ok := v.zones[name]
+	v.mu.Unlock()
+	if ok && now.Before(zk.expires) {
+		return zk.keys, nil
+	}
+
+	keys, err := v.fetchKeys(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	v.mu.Lock()
+	v.zones[name] = &zoneKeys{keys: keys, expires: now.Add(keyCacheTTL)}
+	v.mu.Unlock()
+	return keys, nil
+}
+
+// fetchKeys looks up the DS records of name to find out whether it is a signed
+// zone, an unsigned one or not a zone of its own, see keysFor
+func (v *Validator) fetchKeys(ctx context.Context, name string) ([]*dnsmessage.DNSKEY, error) {
+	if anchors, ok := v.anchors[name]; ok {
+		return v.zoneKeys(ctx, name, anchors)
+	}
+	resp, err := v.exchange(ctx, dnsmessage.Question{Name: name, Type: dnsmessage.TypeDS, Class: dnsmessage.ClassINET})
+	if err != nil {
+		return nil, err
+	}
+	if resp.RCode != dnsmessage.RCodeSuccess && resp.RCode != dnsmessage.RCodeNameError {
+		return nil, fmt.Errorf("DS query for %s answered %s", dnsmessage.FQDN(name), resp.RCode)
+	}
+	parent := v.parentZone(name, resp)
+	parentKeys, err := v.keysFor(ctx, parent)
+	if err != nil || parentKeys == nil {
+		return nil, err
+	}
+
+	for _, set := range signedRRsets(resp.Answers) {
+		if set.Type == dnsmessage.TypeDS && set.Name == name {
+			if err := v.verify(set, parent, parentKeys); err != nil {
+				return nil, err
+			}
+			return v.zoneKeys(ctx, name, set.records)
+		}
+	}
+
+	// Without DS records name is either an unsigned delegation, which the
+	// parent has to prove, or no zone cut at all. Unproven it is taken to be
+	// part of the parent zone, failing the validation if it is a zone after
+	// all rather than letting its answers through unchecked.
+	d := &denial{}
+	for _, set := range signedRRsets(resp.Authorities) {
+		if set.Type != dnsmessage.TypeNSEC && set.Type != dnsmessage.TypeNSEC3 || len(set.sigs) == 0 || canonicalName(set.sigs[0].SignerName) != parent {
+			continue
+		}
+		if err := v.verify(set, parent, parentKeys); err != nil {
+			return nil, err
+		}
+		if set.Type == dnsmessage.TypeNSEC {
+			d.nsec = append(d.nsec, set.records...)
+		} else {
+			d.nsec3 = append(d.nsec3, set.records...)
+		}
+	}
+	if d.insecureDelegation(name) {
+		return nil, nil
+	}
+	return parentKeys, nil
+}
+
+// parentZone returns the zone above name, as told by the signers and the SOA
+// record of the answer to its DS query or else its parent name. The zone has
+// to be under the same trust anchor as name.
+func (v *Validator) parentZone(name string, resp *dnsmessage.Message) string {
+	anchor := v.anchorOf(name)
+	for _, section := range [][]dnsmessage.Resource{resp.Answers, resp.Authorities} {
+		for _, rr := range section {
+			var zone string
+			switch data := rr.Data.(type) {
+			case *dnsmessage.RRSIG:
+				zone = data.SignerName
+			case *dnsmessage.SOA:
+				zone = rr.Name
+			default:
+				continue
+			}
+			if zone = canonicalName(zone); zone != name && isSubdomain(name, zone) && isSubdomain(zone, anchor) {
+				return zone
+			}
+		}
+	}
+	return parentName(name)
+}
+
+// zoneKeys fetches the DNSKEY records of zone and validates them with trusted,
+// the DS records of the parent zone or DNSKEY trust anchors. A zone only
+// trusted with algorithms or digests this validator does not support is
+// treated as unsigned (https://www.rfc-editor.org/rfc/rfc4035#section-5.2).
+func (v *Validator) zoneKeys(ctx context.Context, zone string, trusted []dnsmessage.Resource) ([]*dnsmessage.DNSKEY, error) {
+	supported := false
+	for _, rr := range trusted {
+		switch data := rr.Data.(type) {
+		case *dnsmessage.DS:
+			supported = supported || supportedAlgorithm(data.Algorithm) && supportedDigest(data.DigestType)
+		case *dnsmessage.DNSKEY:
+			supported = supported || supportedAlgorithm(data.Algorithm)
+		}
+	}
+	if !supported {
+		return nil, nil
+	}
+
+	resp, err := v.exchange(ctx, dnsmessage.Question{Name: zone, Type: dnsmessage.TypeDNSKEY, Class: dnsmessage.ClassINET})
+	if err != nil {
+		return nil, err
+	}
+	var set *signedRRset
+	for _, s := range signedRRsets(resp.Answers) {
+		if s.Type == dnsmessage.TypeDNSKEY && s.Name == zone {
+			set = s
+		}
+	}
+	if set == nil {
+		return nil, fmt.Errorf("no DNSKEY records for %s", dnsmessage.FQDN(zone))
+	}
+	var keys, entry []*dnsmessage.DNSKEY
+	for _, rr := range set.records {
+		key := rr.Data.(*dnsmessage.DNSKEY)
+		if key.Protocol != 3 || key.Flags&dnsmessage.FlagZoneKey == 0 || key.Flags&dnsmessage.FlagRevoked != 0 {
+			continue
+		}
+		keys = append(keys, key)
+		if trustedKey(zone, key, trusted) {
+			entry = append(entry, key)
+		}
+	}
+	if len(entry) == 0 {
+		return nil, fmt.Errorf("no DNSKEY of %s matches its DS records", dnsmessage.FQDN(zone))
+	}
+	// The DNSKEY RRset is signed by a key the parent vouches for, which then
+	// vouches for the other keys of the zone
+	if err := v.verify(set, zone, entry); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func supportedDigest(digestType uint8) bool {
+	switch digestType {
+	case dnsmessage.DigestSHA1, dnsmessage.DigestSHA256, dnsmessage.DigestSHA384:
+		return true
+	}
+	return false
+}
+
+// trustedKey reports whether key of zone is among or hashes to one of the
+// trusted DNSKEY and DS records
+func trustedKey(zone string, key *dnsmessage.DNSKEY, trusted []dnsmessage.Resource) bool {
+	for _, rr := range trusted {
+		switch data := rr.Data.(type) {
+		case *dnsmessage.DNSKEY:
+			if data.Algorithm == key.Algorithm && bytes.Equal(data.PublicKey, key.PublicKey) {
+				return true
+			}
+		case *dnsmessage.DS:
+			if data.KeyTag != key.KeyTag() || data.Algorithm != key.Algorithm {
+				continue
+			}
+			if ds, err := key.ToDS(zone, data.DigestType); err == nil && bytes.Equal(ds.Digest, data.Digest) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// signedRRset is an RRset of a response with the signatures covering it
+type signedRRset struct {
+	rrsetKey
+	records []dnsmessage.Resource
+	sigs    []*dnsmessage.RRSIG
+}
+
+// signedRRsets groups the records of a section into RRsets, in the order they
+// first appear. Signatures without the RRset they cover are left out.
+func signedRRsets(section []dnsmessage.Resource) []*signedRRset {
+	var sets []*signedRRset
+	index := make(map[rrsetKey]*signedRRset)
+	get := func(key rrsetKey) *signedRRset {
+		set, ok := index[key]
+		if !ok {
+			set = &signedRRset{rrsetKey: key}
+			index[key] = set
+			sets = append(sets, set)
+		}
+		return set
+	}
+	for i := range section {
+		rr := &section[i]
+		if rr.Type == dnsmessage.TypeOPT {
+			continue
+		}
+		key := rrsetKey{Name: canonicalName(rr.Name), Type: coveredType(*rr), Class: rr.Class}
+		if sig, ok := rr.Data.(*dnsmessage.RRSIG); ok {
+			get(key).sigs = append(get(key).sigs, sig)
+			continue
+		}
+		get(key).records = append(get(key).records, *rr)
+	}
+	complete := sets[:0]
+	for _, set := range sets {
+		if len(set.records) > 0 {
+			complete = append(complete, set)
+		}
+	}
+	return complete
+}
+
+// coveredType is the type of rr, or the type an RRSIG record covers
+func coveredType(rr dnsmessage.Resource) dnsmessage.Type {
+	if sig, ok := rr.Data.(*dnsmessage.RRSIG); ok {
+		return sig.TypeCovered
+	}
+	return rr.Type
+}
+
+// capSignedTTLs lowers the TTL of signed records to the original TTL of their
+// signature and the time left until it expires
+// (https://www.rfc-editor.org/rfc/rfc4035#section-5.3.3)
+func capSignedTTLs(section []dnsmessage.Resource, now time.Time) {
+	limits := make(map[rrsetKey]uint32)
+	for _, rr := range section {
+		sig, ok := rr.Data.(*dnsmessage.RRSIG)
+		if !ok {
+			continue
+		}
+		key := rrsetKey{Name: canonicalName(rr.Name), Type: sig.TypeCovered, Class: rr.Class}
+		limit := min(sig.OriginalTTL, sig.Expiration-uint32(now.Unix()))
+		if l, ok := limits[key]; !ok || limit < l {
+			limits[key] = limit
+		}
+	}
+	for i := range section {
+		key := rrsetKey{Name: canonicalName(section[i].Name), Type: coveredType(section[i]), Class: section[i].Class}
+		if limit, ok := limits[key]; ok {
+			section[i].TTL = min(section[i].TTL, limit)
+		}
+	}
+}
+
+// isDNSSECType reports whether records of type t are only sent to clients
+// asking for DNSSEC records (https://www.rfc-editor.org/rfc/rfc4035#section-3.2.1)
+func isDNSSECType(t dnsmessage.Type) bool {
+	return t == dnsmessage.TypeRRSIG || t == dnsmessage.TypeNSEC || t == dnsmessage.TypeNSEC3
+}
+
+// stripDNSSEC removes the DNSSEC records from a section, except those of type keep
+func stripDNSSEC(section []dnsmessage.Resource, keep dnsmessage.Type) []dnsmessage.Resource {
+	var kept []dnsmessage.Resource
+	for _, rr := range section {
+		if !isDNSSECType(rr.Type) || rr.Type == keep {
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
+
+// insecureDelegation reports whether the denial proves name to be the
+// delegation of an unsigned zone, a zone cut without DS records
+// (https://www.rfc-editor.org/rfc/rfc4035#section-5.2, https://www.rfc-editor.org/rfc/rfc5155#section-8.9)
+func (d *denial) insecureDelegation(name string) bool {
+	delegation := func(types []dnsmessage.Type) bool {
+		return dnsmessage.HasType(types, dnsmessage.TypeNS) && !dnsmessage.HasType(types, dnsmessage.TypeDS) && !dnsmessage.HasType(types, dnsmessage.TypeSOA)
+	}
+	for _, rr := range d.nsec {
+		if canonicalName(rr.Name) == name {
+			return delegation(rr.Data.(*dnsmessage.NSEC).Types)
+		}
+	}
+	if len(d.nsec3) == 0 {
+		return false
+	}
+	if rr, ok := d.nsec3Matching(name); ok {
+		return delegation(rr.Data.(*dnsmessage.NSEC3).Types)
+	}
+	if _, covering, ok := d.closestEncloser(name); ok {
+		return covering.Data.(*dnsmessage.NSEC3).OptOut()
+	}
+	return d.nsec3Limits() == proofOptOut
+}
+
+// queryDNSSEC asks the upstreams a question with the DO bit set, for the DS
+// and DNSKEY lookups of the validator
+func (s *Server) queryDNSSEC(ctx context.Context, question dnsmessage.Question) (*dnsmessage.Message, error) {
+	query := &dnsmessage.Message{
+		Header:      dnsmessage.Header{ID: newQueryID(), RecursionDesired: true, CheckingDisabled: true},
+		Questions:   []dnsmessage.Question{question},
+		Additionals: []dnsmessage.Resource{newOPT(ednsUDPSize, true)},
+	}
+	return s.exchange(ctx, question, query)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+// testSigner signs the RRsets of a zone with an Ed25519 key
+type testSigner struct {
+	zone string
+	key  *dnsmessage.DNSKEY
+	priv ed25519.PrivateKey
+}
+
+func newTestSigner(t *testing.T, zone string) *testSigner {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := &dnsmessage.DNSKEY{Flags: dnsmessage.FlagZoneKey | dnsmessage.FlagSecureEntry, Protocol: 3, Algorithm: dnsmessage.AlgorithmED25519, PublicKey: pub}
+	return &testSigner{zone: zone, key: key, priv: priv}
+}
+
+func (s *testSigner) dnskey() dnsmessage.Resource {
+	return dnsmessage.Resource{Name: s.zone, Type: dnsmessage.TypeDNSKEY, Class: dnsmessage.ClassINET, TTL: 3600, Data: s.key}
+}
+
+func (s *testSigner) ds(t *testing.T) dnsmessage.Resource {
+	t.Helper()
+	ds, err := s.key.ToDS(s.zone, dnsmessage.DigestSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dnsmessage.Resource{Name: s.zone, Type: dnsmessage.TypeDS, Class: dnsmessage.ClassINET, TTL: 3600, Data: ds}
+}
+
+// sign returns rrset followed by its signature
+func (s *testSigner) sign(t *testing.T, rrset ...dnsmessage.Resource) []dnsmessage.Resource {
+	t.Helper()
+	return s.signWildcard(t, labelCount(canonicalName(rrset[0].Name)), rrset...)
+}
+
+// signWildcard signs rrset as expanded from the wildcard with the given
+// number of labels
+func (s *testSigner) signWildcard(t *testing.T, labels int, rrset ...dnsmessage.Resource) []dnsmessage.Resource {
+	t.Helper()
+	now := uint32(time.Now().Unix())
+	sig := &dnsmessage.RRSIG{
+		TypeCovered: rrset[0].Type, Algorithm: s.key.Algorithm, Labels: uint8(labels), OriginalTTL: rrset[0].TTL,
+		Expiration: now + 3600, Inception: now - 3600, KeyTag: s.key.KeyTag(), SignerName: s.zone,
+	}
+	data, err := dnsmessage.SignedData(sig, rrset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig.Signature = ed25519.Sign(s.priv, data)
+	return append(rrset, dnsmessage.Resource{Name: rrset[0].Name, Type: dnsmessage.TypeRRSIG, Class: dnsmessage.ClassINET, TTL: rrset[0].TTL, Data: sig})
+}
+
+func nsecRecord(name, next string, types ...dnsmessage.Type) dnsmessage.Resource {
+	return dnsmessage.Resource{Name: name, Type: dnsmessage.TypeNSEC, Class: dnsmessage.ClassINET, TTL: 300, Data: &dnsmessage.NSEC{NextDomain: next, Types: types}}
+}
+
+// newSignedUpstream answers for a signed root, the signed zone example below
+// it and insecure.example delegated without DS records. It returns the DS
+// record of the root as trust anchor.
+func newSignedUpstream(t *testing.T) (func(dnsmessage.Question) *dnsmessage.Message, dnsmessage.Resource) {
+	t.Helper()
+	root, example := newTestSigner(t, dnsmessage.Root), newTestSigner(t, "example")
+	soa := example.sign(t, soaRecord("example", 300, 300))
+	apex := example.sign(t, nsecRecord("example", "forged.example", dnsmessage.TypeSOA, dnsmessage.TypeNS, dnsmessage.TypeDNSKEY, dnsmessage.TypeRRSIG, dnsmessage.TypeNSEC))
+	forged := example.sign(t, aRecord("forged.example", "192.0.2.1"))
+	forged[0] = aRecord("forged.example", "192.0.2.66")
+
+	type answer struct {
+		rcode       dnsmessage.RCode
+		answers     []dnsmessage.Resource
+		authorities []dnsmessage.Resource
+	}
+	answers := map[dnsmessage.Question]answer{
+		question(".", dnsmessage.TypeDNSKEY):                {answers: root.sign(t, root.dnskey())},
+		question("example", dnsmessage.TypeDS):              {answers: root.sign(t, example.ds(t))},
+		question("example", dnsmessage.TypeDNSKEY):          {answers: example.sign(t, example.dnskey())},
+		question("www.example", dnsmessage.TypeA):           {answers: example.sign(t, aRecord("www.example", "192.0.2.1"))},
+		question("forged.example", dnsmessage.TypeA):        {answers: forged},
+		question("unsigned.example", dnsmessage.TypeA):      {answers: []dnsmessage.Resource{aRecord("unsigned.example", "192.0.2.2")}},
+		question("unsigned.example", dnsmessage.TypeDS):     {authorities: append(soa, example.sign(t, nsecRecord("unsigned.example", "www.example", dnsmessage.TypeA, dnsmessage.TypeRRSIG, dnsmessage.TypeNSEC))...)},
+		question("insecure.example", dnsmessage.TypeDS):     {authorities: append(soa, example.sign(t, nsecRecord("insecure.example", "unsigned.example", dnsmessage.TypeNS, dnsmessage.TypeRRSIG, dnsmessage.TypeNSEC))...)},
+		question("www.insecure.example", dnsmessage.TypeA):  {answers: []dnsmessage.Resource{aRecord("www.insecure.example", "192.0.2.3")}},
+		question("www.insecure.example", dnsmessage.TypeDS): {authorities: []dnsmessage.Resource{soaRecord("insecure.example", 300, 300)}},
+		question("nx.example", dnsmessage.TypeA): {rcode: dnsmessage.RCodeNameError, authorities: append(append(soa, apex...),
+			example.sign(t, nsecRecord("insecure.example", "unsigned.example", dnsmessage.TypeNS, dnsmessage.TypeRRSIG, dnsmessage.TypeNSEC))...)},
+		question("nxbogus.example", dnsmessage.TypeA): {rcode: dnsmessage.RCodeNameError, authorities: soa},
+		question("www.example", dnsmessage.TypeAAAA):  {authorities: append(soa, example.sign(t, nsecRecord("www.example", "example", dnsmessage.TypeA, dnsmessage.TypeRRSIG, dnsmessage.TypeNSEC))...)},
+		question("any.example", dnsmessage.TypeA):     {answers: example.signWildcard(t, 1, aRecord("any.example", "192.0.2.4")), authorities: apex},
+	}
+	handler := func(q dnsmessage.Question) *dnsmessage.Message {
+		resp := &dnsmessage.Message{Header: dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeNameError}, Questions: []dnsmessage.Question{q}}
+		q.Name = canonicalName(q.Name)
+		if a, ok := answers[q]; ok {
+			resp.RCode, resp.Answers, resp.Authorities = a.rcode, a.answers, a.authorities
+		}
+		return resp
+	}
+	return handler, root.ds(t)
+}
+
+// newTestValidator returns a validator for the zones of newSignedUpstream
+// and the upstream
+func newTestValidator(t *testing.T) (*Validator, func(dnsmessage.Question) *dnsmessage.Message) {
+	t.Helper()
+	upstream, anchor := newSignedUpstream(t)
+	exchange := func(_ context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+		return upstream(q), nil
+	}
+	return NewValidator([]dnsmessage.Resource{anchor}, exchange), upstream
+}
+
+func TestValidatorSecureAnswers(t *testing.T) {
+	v, upstream := newTestValidator(t)
+	tests := []struct {
+		name string
+		q    dnsmessage.Question
+	}{
+		{"signed answer", question("www.example", dnsmessage.TypeA)},
+		{"NXDOMAIN", question("nx.example", dnsmessage.TypeA)},
+		{"NODATA", question("www.example", dnsmessage.TypeAAAA)},
+		{"wildcard answer", question("any.example", dnsmessage.TypeA)},
+	}
+	for _, tt := range tests {
+		resp, err := v.validate(context.Background(), tt.q, upstream(tt.q))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !resp.AuthenticData {
+			t.Errorf("%s: expected the answer to be secure", tt.name)
+		}
+	}
+}
+
+func TestValidatorBogusAnswers(t *testing.T) {
+	v, upstream := newTestValidator(t)
+	tests := []struct {
+		name string
+		q    dnsmessage.Question
+	}{
+		{"wrong signature", question("forged.example", dnsmessage.TypeA)},
+		{"unsigned answer in a signed zone", question("unsigned.example", dnsmessage.TypeA)},
+		{"NXDOMAIN without proof", question("nxbogus.example", dnsmessage.TypeA)},
+	}
+	for _, tt := range tests {
+		if resp, err := v.validate(context.Background(), tt.q, upstream(tt.q)); err == nil {
+			t.Errorf("%s: expected the answer to be bogus, got %+v", tt.name, resp)
+		}
+	}
+
+	// Without the NSEC record the wildcard answer lacks the proof that the
+	// name does not exist itself
+	q := question("any.example", dnsmessage.TypeA)
+	resp := upstream(q)
+	resp.Authorities = nil
+	if _, err := v.validate(context.Background(), q, resp); err == nil {
+		t.Error("Expected a wildcard answer without proof to be bogus")
+	}
+}
+
+func TestValidatorInsecureAnswers(t *testing.T) {
+	v, upstream := newTestValidator(t)
+	q := question("www.insecure.example", dnsmessage.TypeA)
+	resp, err := v.validate(context.Background(), q, upstream(q))
+	if err != nil {
+		t.Fatalf("Expected the answer of an unsigned delegation to pass, got %v", err)
+	}
+	if resp.AuthenticData || len(resp.Answers) != 1 {
+		t.Errorf("Expected an insecure answer, got %+v", resp)
+	}
+
+	// Names under no trust anchor are not checked at all
+	v.anchors = map[string][]dnsmessage.Resource{"other": nil}
+	q = question("forged.example", dnsmessage.TypeA)
+	if resp, err := v.validate(context.Background(), q, upstream(q)); err != nil || resp.AuthenticData {
+		t.Errorf("Expected an unchecked answer, got %+v, %v", resp, err)
+	}
+}
+
+func TestValidatingServer(t *testing.T) {
+	upstream, anchor := newSignedUpstream(t)
+	var upstreamQueries []*dnsmessage.Message
+	var mu sync.Mutex
+	addr := dnstest.StartUDPServer(t, func(query *dnsmessage.Message) *dnsmessage.Message {
+		mu.Lock()
+		upstreamQueries = append(upstreamQueries, query)
+		mu.Unlock()
+		resp := upstream(query.Questions[0])
+		resp.ID = query.ID
+		return resp
+	}).Addr
+	s := newTestServer(t, addr)
+	s.Validator = NewValidator([]dnsmessage.Resource{anchor}, s.queryDNSSEC)
+
+	query := testQuery("www.example")
+	query.Additionals = []dnsmessage.Resource{newOPT(4096, true)}
+	reply := handle(s, query)
+	if reply.RCode != dnsmessage.RCodeSuccess || !reply.AuthenticData || len(reply.Answers) != 2 {
+		t.Fatalf("Expected a validated answer with its signature, got %+v", reply)
+	}
+	if opt := optRecord(reply); opt == nil || !dnssecOK(reply) {
+		t.Errorf("Expected an OPT record with the DO bit, got %+v", reply.Additionals)
+	}
+	mu.Lock()
+	for _, q := range upstreamQueries {
+		if !dnssecOK(q) || !q.CheckingDisabled {
+			t.Errorf("Expected upstream queries with the DO and CD bits, got %+v", q)
+		}
+	}
+	mu.Unlock()
+
+	// Clients not asking for DNSSEC get neither signatures nor the AD bit
+	// (answered from the cache now)
+	reply = handle(s, testQuery("www.example"))
+	if reply.AuthenticData || len(reply.Answers) != 1 || reply.Answers[0].Type != dnsmessage.TypeA {
+		t.Errorf("Expected the plain answer, got %+v", reply)
+	}
+	query = testQuery("www.example")
+	query.AuthenticData = true
+	if reply = handle(s, query); !reply.AuthenticData || len(reply.Answers) != 1 {
+		t.Errorf("Expected the AD bit without signatures, got %+v", reply)
+	}
+
+	if reply = handle(s, testQuery("forged.example")); reply.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf("Expected SERVFAIL for a bogus answer, got %+v", reply)
+	}
+	// Clients checking the signatures themselves get it, not authenticated
+	query = testQuery("forged.example")
+	query.CheckingDisabled = true
+	if reply = handle(s, query); reply.RCode != dnsmessage.RCodeSuccess || reply.AuthenticData || len(reply.Answers) == 0 {
+		t.Errorf("Expected the unvalidated answer with checking disabled, got %+v", reply)
+	}
+	// which isn't cached for the others
+	if reply = handle(s, testQuery("forged.example")); reply.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf("Expected SERVFAIL for a bogus answer after one with checking disabled, got %+v", reply)
+	}
+}
+
+func TestLoadTrustAnchors(t *testing.T) {
+	_, anchor := newSignedUpstream(t)
+	path := filepath.Join(t.TempDir(), "root-anchors.txt")
+	content := "; root trust anchor\n" + anchor.String() + "\n. 3600 IN NS a.root-servers.net.\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	anchors, err := loadTrustAnchors(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(anchors) != 1 || anchors[0].Data.String() != anchor.Data.String() {
+		t.Errorf("Expected only the DS record, got %+v", anchors)
+	}
+
+	if err := os.WriteFile(path, []byte(". 3600 IN NS a.root-servers.net.\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadTrustAnchors(path); err == nil || !strings.Contains(err.Error(), "no DS or DNSKEY") {
+		t.Errorf("Expected a file without anchors to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// The build information, injected by release.sh with
+// -ldflags "-X main.version=... -X main.commit=... -X main.date=..."
+var (
+	version = "dev"
+	commit  = ""
+	date    = ""
+)
+
+func init() {
+	expvar.Publish("build", expvar.Func(func() any {
+		return map[string]string{"version": version, "commit": buildCommit(), "date": date, "go": runtime.Version()}
+	}))
+}
+
+// buildCommit returns the injected commit, or the one recorded by the Go
+// toolchain when building from a module checkout
+func buildCommit() string {
+	if commit != "" {
+		return commit
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" && len(s.Value) >= 12 {
+				return s.Value[:12]
+			}
+		}
+	}
+	return ""
+}
+
+// versionString describes the build, e.g. "v1.2.0 (commit 0123abcd4567, built 2024-05-01T10:00:00Z, go1.22.3)"
+func versionString() string {
+	details := []string{}
+	if c := buildCommit(); c != "" {
+		details = append(details, "commit "+c)
+	}
+	if date != "" {
+		details = append(details, "built "+date)
+	}
+	details = append(details, runtime.Version())
+	return fmt.Sprintf("%s (%s)", version, strings.Join(details, ", "))
+}
+
+// Chaos answers the CHAOS class TXT queries servers are conventionally asked
+// what they run and which instance they are
+// (https://www.rfc-editor.org/rfc/rfc4892#section-2). Names with an empty
+// string are refused.
+type Chaos struct {
+	// Version answers version.bind and version.server
+	Version string
+	// Hostname answers hostname.bind
+	Hostname string
+	// ID answers id.server
+	ID string
+}
+
+// answer returns the answer to a CHAOS query for one of the names of c, nil
+// for other questions
+func (c *Chaos) answer(question dnsmessage.Question) *dnsmessage.Message {
+	if c == nil || question.Class != dnsmessage.ClassCHAOS {
+		return nil
+	}
+	var text string
+	switch canonicalName(question.Name) {
+	case "version.bind", "version.server":
+		text = c.Version
+	case "hostname.bind":
+		text = c.Hostname
+	case "id.server":
+		text = c.ID
+	default:
+		return nil
+	}
+	if text == "" {
+		return &dnsmessage.Message{Header: dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeRefused}}
+	}
+	resp := &dnsmessage.Message{Header: dnsmessage.Header{Response: true, Authoritative: true}}
+	if question.Type == dnsmessage.TypeTXT || question.Type == dnsmessage.TypeANY {
+		resp.Answers = []dnsmessage.Resource{{
+			Name: question.Name, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassCHAOS,
+			Data: &dnsmessage.TXT{Text: []string{text}},
+		}}
+	}
+	return resp
+}
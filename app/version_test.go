@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+func TestVersionBind(t *testing.T) {
+	s := newTestServer(t, closedUDPAddr(t))
+	s.Chaos = &Chaos{Version: version, Hostname: "ns1"}
+	chaos := func(name string) *dnsmessage.Message {
+		q := testQuery(name)
+		q.Questions[0].Type, q.Questions[0].Class = dnsmessage.TypeTXT, dnsmessage.ClassCHAOS
+		return s.Handle(context.Background(), &QueryContext{Transport: "udp", Query: q})
+	}
+	for name, want := range map[string]string{"VERSION.BIND": version, "version.server": version, "hostname.bind": "ns1"} {
+		resp := chaos(name)
+		if resp.RCode != dnsmessage.RCodeSuccess || len(resp.Answers) != 1 || resp.Answers[0].Data.(*dnsmessage.TXT).Text[0] != want {
+			t.Errorf("%s: expected %q in a CH TXT record, got %+v", name, want, resp)
+		}
+	}
+	if resp := chaos("id.server"); resp.RCode != dnsmessage.RCodeRefused {
+		t.Errorf("Expected id.server without an answer to be refused, got %+v", resp)
+	}
+	if got := versionString(); !strings.HasPrefix(got, version+" (") {
+		t.Errorf("Expected the version string to start with the version, got %q", got)
+	}
+}
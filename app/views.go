@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// viewSettings are the settings a [view.<name>] table of the config file may
+// hold: the clients of the view and the settings it answers them with
+// instead of the top-level ones
+var viewSettings = []string{"clients", "zone", "hosts", "blocklist", "route", "resolver"}
+
+// View answers the clients in its networks from other zone data, blocklists
+// and forwarding rules than the rest, for split-horizon DNS where internal
+// clients see internal records. Views are defined by [view.<name>] tables of
+// the config file:
+//
+//	[view.internal]
+//	clients = ["10.0.0.0/8", "192.168.0.0/16"]
+//	zone = "corp.example=/etc/dns/internal/corp.example.zone"
+//	blocklist = []
+//
+// Settings a view doesn't set are the top-level ones, each view has a cache
+// of its own so answers don't leak between views.
+type View struct {
+	Name     string
+	Networks []netip.Prefix
+	// Server answers the queries of the view, sharing the runtime modes and
+	// secondary zones of the top-level server
+	Server *Server
+}
+
+// extractViews removes the view-<name>-<setting> keys of the view tables from
+// config file values and returns them as settings by view name
+func extractViews(values map[string]string) (map[string]map[string]string, error) {
+	views := make(map[string]map[string]string)
+	for key, value := range values {
+		rest, ok := strings.CutPrefix(key, "view-")
+		if !ok {
+			continue
+		}
+		setting := ""
+		for _, s := range viewSettings {
+			if strings.HasSuffix(rest, "-"+s) && len(rest) > len(s)+1 {
+				setting = s
+			}
+		}
+		if setting == "" {
+			return nil, fmt.Errorf("unknown view setting %q, views may set %s", key, strings.Join(viewSettings, ", "))
+		}
+		name := strings.TrimSuffix(rest, "-"+setting)
+		if views[name] == nil {
+			views[name] = make(map[string]string)
+		}
+		views[name][setting] = value
+		delete(values, key)
+	}
+	if len(views) == 0 {
+		return nil, nil
+	}
+	return views, nil
+}
+
+// buildViews creates the views of o by name, taking the state of the views of
+// the same name in prev over like buildServer
+func buildViews(o *options, prev *Server) ([]*View, error) {
+	names := make([]string, 0, len(o.Views))
+	for name := range o.Views {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var views []*View
+	for _, name := range names {
+		v, err := buildView(o, name, o.Views[name], prev.view(name))
+		if err != nil {
+			return nil, fmt.Errorf("view %s: %w", name, err)
+		}
+		views = append(views, v)
+	}
+	return views, nil
+}
+
+// buildView creates a view from the top-level options and its settings
+func buildView(o *options, name string, settings map[string]string, prev *Server) (*View, error) {
+	clients, ok := settings["clients"]
+	if !ok {
+		return nil, errors.New("no clients")
+	}
+	networks, err := parsePrefixes(clients)
+	if err != nil {
+		return nil, fmt.Errorf("invalid clients: %w", err)
+	}
+	if len(networks) == 0 {
+		return nil, errors.New("no clients")
+	}
+	for i := range networks {
+		networks[i] = networks[i].Masked()
+	}
+	vo := *o
+	// The mirror, the transfers of secondary zones and the notifications of
+	// secondaries are the top-level ones
+	vo.Views, vo.Secondaries, vo.Mirror, vo.Notify = nil, "", "", ""
+	for setting, value := range settings {
+		switch setting {
+		case "zone":
+			vo.Zones = value
+		case "hosts":
+			vo.Hosts = value
+		case "blocklist":
+			vo.Blocklists = value
+		case "route":
+			vo.Routes = value
+		case "resolver":
+			// Views forward even when the top-level server iterates
+			vo.Resolver, vo.Iterate = value, o.Iterate && value == ""
+		}
+	}
+	s, err := buildServer(&vo, prev)
+	if err != nil {
+		return nil, err
+	}
+	return &View{Name: name, Networks: networks, Server: s}, nil
+}
+
+// view returns the server of the view called name, or nil
+func (s *Server) view(name string) *Server {
+	if s == nil {
+		return nil
+	}
+	for _, v := range s.Views {
+		if v.Name == name {
+			return v.Server
+		}
+	}
+	return nil
+}
+
+// viewFor returns the server answering client: that of the view with the
+// most specific network holding it, or s itself
+func (s *Server) viewFor(client netip.Addr) *Server {
+	client = client.Unmap()
+	best, bits := s, -1
+	for _, v := range s.Views {
+		for _, network := range v.Networks {
+			if network.Bits() > bits && network.Contains(client) {
+				best, bits = v.Server, network.Bits()
+			}
+		}
+	}
+	return best
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/internal/dnstest"
+)
+
+func TestViews(t *testing.T) {
+	upstream := dnstest.StartUDPServer(t, answerA("192.0.2.1")).Addr
+	path := writeConfig(t, t.TempDir(), `resolver = "`+upstream+`"
+
+[view.lan]
+clients = ["10.0.0.0/8", "fd00::/8"]
+
+[view.lan-guests]
+clients = "10.99.0.0/16"
+resolver = "`+closedUDPAddr(t)+`"
+`)
+	opts, err := loadOptions([]string{"-config", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(opts.Views) != 2 || opts.Views["lan-guests"]["clients"] != "10.99.0.0/16" {
+		t.Fatalf("Expected the lan and lan-guests views, got %v", opts.Views)
+	}
+	s, err := buildServer(opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for client, want := range map[string]*Server{
+		"192.0.2.7":       s,
+		"10.1.2.3":        s.view("lan"),
+		"::ffff:10.1.2.3": s.view("lan"),
+		"fd00::1":         s.view("lan"),
+		"10.99.1.2":       s.view("lan-guests"),
+	} {
+		if got := s.viewFor(netip.MustParseAddr(client)); got != want || got == nil {
+			t.Errorf("Expected %s to be answered by %p, got %p", client, want, got)
+		}
+	}
+	if s.view("lan").Cache == s.Cache || s.view("lan").Modes != s.Modes {
+		t.Error("Expected views to have their own cache and share the modes")
+	}
+
+	// Reloads keep the caches of the views
+	cache := s.view("lan").Cache
+	next, err := buildServer(opts, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.view("lan").Cache != cache {
+		t.Error("Expected the cache of the view to survive a reload")
+	}
+
+	for _, config := range []string{
+		"[view.lan]\nzone = \"\"\n",
+		"[view.lan]\nclients = \"10.0.0.0/8\"\nrate = 5\n",
+	} {
+		path := writeConfig(t, t.TempDir(), `resolver = "`+upstream+"\"\n"+config)
+		opts, err := loadOptions([]string{"-config", path})
+		if err == nil {
+			_, err = buildServer(opts, nil)
+		}
+		if err == nil || !strings.Contains(err.Error(), "view") {
+			t.Errorf("Expected %q to be rejected, got %v", config, err)
+		}
+	}
+}
+
+func TestReloadClosesRemovedViews(t *testing.T) {
+	upstream := dnstest.StartUDPServer(t, answerA("192.0.2.1")).Addr
+	dir := t.TempDir()
+	path := writeConfig(t, dir, `resolver = "`+upstream+`"
+
+[view.lan]
+clients = "10.0.0.0/8"
+`)
+	args := []string{"-config", path}
+	opts, err := loadOptions(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := buildServer(opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.active().Cache.Close()
+	reload := reloader(s, args, opts)
+	cache := s.view("lan").Cache
+
+	// The view is kept, so is its cache
+	if err := reload(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-cache.done:
+		t.Fatal("Expected the cache of a kept view to stay open")
+	default:
+	}
+
+	writeConfig(t, dir, `resolver = "`+upstream+"\"\n")
+	if err := reload(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-cache.done:
+	default:
+		t.Error("Expected the cache of the removed view to be closed")
+	}
+}
+
+func TestCloseReplacedViews(t *testing.T) {
+	// viewServer has a cache with a janitor and an encrypted upstream with
+	// an idle connection, whose peer sees it closed
+	viewServer := func() (*Server, net.Conn) {
+		cache := NewCache(10)
+		cache.startJanitor(time.Hour)
+		local, peer := net.Pipe()
+		t.Cleanup(func() { local.Close(); peer.Close() })
+		e := &EncryptedTransport{idle: []idleConn{{conn: tls.Client(local, &tls.Config{}), since: time.Now()}}}
+		return &Server{Forwarder: &Forwarder{Upstreams: []*Upstream{{Addr: "192.0.2.53:853", Encrypted: e}}}, Cache: cache}, peer
+	}
+	closed := func(peer net.Conn) bool {
+		peer.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, err := peer.Read(make([]byte, 1))
+		return errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe)
+	}
+	kept, keptPeer := viewServer()
+	removed, removedPeer := viewServer()
+	prev := &Server{Forwarder: &Forwarder{}, Views: []*View{{Name: "kept", Server: kept}, {Name: "removed", Server: removed}}}
+	next := &Server{Forwarder: &Forwarder{}, Views: []*View{{Name: "kept", Server: kept}}}
+	closeReplaced(prev, next)
+
+	select {
+	case <-kept.Cache.done:
+		t.Error("Expected the cache of the kept view to stay open")
+	default:
+	}
+	select {
+	case <-removed.Cache.done:
+	default:
+		t.Error("Expected the cache of the removed view to be closed")
+	}
+	if closed(keptPeer) {
+		t.Error("Expected the upstream connection of the kept view to stay open")
+	}
+	if !closed(removedPeer) {
+		t.Error("Expected the upstream connection of the removed view to be closed")
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// transferTimeout bounds a whole zone transfer, from connecting to the last message
+const transferTimeout = time.Minute
+
+// zoneDiff is a single change of an incremental transfer, the zone at serial
+// From becomes the zone at serial To
+type zoneDiff struct {
+	From, To uint32
+	Deleted  []dnsmessage.Resource
+	Added    []dnsmessage.Resource
+}
+
+// transfer is the outcome of an AXFR or IXFR
+type transfer struct {
+	// SOA is the SOA record of the zone as transferred
+	SOA dnsmessage.Resource
+	// Records is the complete zone, the SOA first, for a full transfer
+	Records []dnsmessage.Resource
+	// Diffs are the changes of an incremental transfer, oldest first
+	Diffs []zoneDiff
+	// UpToDate is set when an IXFR found nothing newer than the serial sent
+	UpToDate bool
+}
+
+// requestTransfer transfers the zone origin from the server at addr over TCP.
+// qtype is TypeAXFR or TypeIXFR, the latter with current, the SOA record held
+// (https://www.rfc-editor.org/rfc/rfc5936, https://www.rfc-editor.org/rfc/rfc1995).
+// With a key the request is signed and so must be the responses.
+func requestTransfer(ctx context.Context, addr, origin string, qtype dnsmessage.Type, current *dnsmessage.Resource, key *tsigKey) (*transfer, error) {
+	ctx, cancel := context.WithTimeout(ctx, transferTimeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	query := &dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: newQueryID()},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.FQDN(origin), Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	if qtype == dnsmessage.TypeIXFR && current != nil {
+		query.Authorities = []dnsmessage.Resource{*current}
+	}
+	var stream *tsigStream
+	if key != nil {
+		stream = &tsigStream{key: key}
+		if err := stream.sign(query); err != nil {
+			return nil, err
+		}
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeTCPMessage(conn, packed); err != nil {
+		return nil, err
+	}
+
+	var p transferParser
+	for first := true; !p.done; first = false {
+		data, err := readTCPMessage(conn)
+		if err != nil {
+			return nil, fmt.Errorf("reading transfer of %s: %w", dnsmessage.FQDN(origin), err)
+		}
+		if stream != nil {
+			if err := stream.verify(data); err != nil {
+				return nil, fmt.Errorf("transfer of %s: %w", dnsmessage.FQDN(origin), err)
+			}
+		}
+		var resp dnsmessage.Message
+		if err := resp.Unpack(data); err != nil {
+			return nil, fmt.Errorf("reading transfer of %s: %w", dnsmessage.FQDN(origin), err)
+		}
+		// Only the first message has to repeat the question
+		if resp.ID != query.ID || !resp.Response || (first && !isResponseTo(&resp, query)) {
+			return nil, fmt.Errorf("unexpected message in transfer of %s", dnsmessage.FQDN(origin))
+		}
+		if resp.RCode != dnsmessage.RCodeSuccess {
+			return nil, fmt.Errorf("transfer of %s refused with %s", dnsmessage.FQDN(origin), resp.RCode)
+		}
+		for _, rr := range resp.Answers {
+			if err := p.add(rr); err != nil {
+				return nil, fmt.Errorf("transfer of %s: %w", dnsmessage.FQDN(origin), err)
+			}
+		}
+		// A lone SOA answers an IXFR when the zone did not change, in a
+		// message of its own (https://www.rfc-editor.org/rfc/rfc1995#section-4)
+		if first && qtype == dnsmessage.TypeIXFR && len(p.records) == 1 && len(resp.Answers) == 1 {
+			return &transfer{SOA: p.records[0], UpToDate: true}, nil
+		}
+	}
+	if stream != nil {
+		if err := stream.done(); err != nil {
+			return nil, fmt.Errorf("transfer of %s: %w", dnsmessage.FQDN(origin), err)
+		}
+	}
+	return p.result()
+}
+
+// transferParser splits the records of a transfer into the full zone or the
+// diffs, both start and end with the SOA record of the transferred serial.
+// An incremental transfer has the SOA of the old serial second and then a SOA
+// before the deleted and before the added records of every diff.
+type transferParser struct {
+	records []dnsmessage.Resource
+	serial  uint32
+	// soas counts the SOA records seen, adding tells whether the records
+	// after the last one were added or deleted
+	soas   int
+	adding bool
+	done   bool
+}
+
+func (p *transferParser) add(rr dnsmessage.Resource) error {
+	if p.done {
+		return errors.New("records after the closing SOA")
+	}
+	soa, isSOA := rr.Data.(*dnsmessage.SOA)
+	if len(p.records) == 0 {
+		if !isSOA {
+			return errors.New("first record is not a SOA")
+		}
+		p.serial = soa.Serial
+	}
+	p.records = append(p.records, rr)
+	if !isSOA {
+		return nil
+	}
+	p.soas++
+	switch {
+	case p.soas == 1:
+	case len(p.records) == 2 && soa.Serial != p.serial:
+		// Incremental, this SOA opens the deleted records of the first diff
+		p.adding = false
+	case len(p.records) == 2 || !p.incremental():
+		// The SOA closing a full transfer
+		p.done = true
+	case p.adding && soa.Serial == p.serial:
+		p.done = true
+	default:
+		p.adding = !p.adding
+	}
+	return nil
+}
+
+// incremental reports whether the records are those of an incremental transfer
+func (p *transferParser) incremental() bool {
+	if len(p.records) < 2 {
+		return false
+	}
+	soa, ok := p.records[1].Data.(*dnsmessage.SOA)
+	return ok && soa.Serial != p.serial
+}
+
+func (p *transferParser) result() (*transfer, error) {
+	t := &transfer{SOA: p.records[0]}
+	if !p.incremental() {
+		t.Records = p.records[:len(p.records)-1]
+		return t, nil
+	}
+	var diff *zoneDiff
+	adding := false
+	for _, rr := range p.records[1 : len(p.records)-1] {
+		soa, isSOA := rr.Data.(*dnsmessage.SOA)
+		switch {
+		case !isSOA && adding:
+			diff.Added = append(diff.Added, rr)
+		case !isSOA:
+			diff.Deleted = append(diff.Deleted, rr)
+		case diff == nil || adding:
+			if diff != nil {
+				t.Diffs = append(t.Diffs, *diff)
+			}
+			diff = &zoneDiff{From: soa.Serial, Deleted: []dnsmessage.Resource{rr}}
+			adding = false
+		default:
+			diff.To = soa.Serial
+			diff.Added = append(diff.Added, rr)
+			adding = true
+		}
+	}
+	t.Diffs = append(t.Diffs, *diff)
+	return t, nil
+}
+
+// applyDiffs returns the records of a zone after the diffs, the SOA records
+// of the diffs replace the one of the zone
+func applyDiffs(records []dnsmessage.Resource, diffs []zoneDiff) ([]dnsmessage.Resource, error) {
+	records = append([]dnsmessage.Resource(nil), records...)
+	for _, diff := range diffs {
+		current, ok := zoneSerial(records)
+		if !ok || current != diff.From {
+			return nil, fmt.Errorf("diff from serial %d does not apply to serial %d", diff.From, current)
+		}
+		for _, rr := range diff.Deleted {
+			kept := records[:0]
+			for _, r := range records {
+				// The SOA is replaced whatever the other fields of the old one
+				sameSOA := rr.Type == dnsmessage.TypeSOA && r.Type == dnsmessage.TypeSOA
+				if !sameSOA && !containsRecord([]dnsmessage.Resource{rr}, r) {
+					kept = append(kept, r)
+				}
+			}
+			records = kept
+		}
+		for _, rr := range diff.Added {
+			if !containsRecord(records, rr) {
+				records = append(records, rr)
+			}
+		}
+	}
+	return records, nil
+}
+
+// zoneSerial returns the serial of the SOA record in records
+func zoneSerial(records []dnsmessage.Resource) (uint32, bool) {
+	for _, rr := range records {
+		if soa, ok := rr.Data.(*dnsmessage.SOA); ok {
+			return soa.Serial, true
+		}
+	}
+	return 0, false
+}
+
+// serialNewer reports whether serial a is newer than b in serial number
+// arithmetic (https://www.rfc-editor.org/rfc/rfc1982#section-3.2)
+func serialNewer(a, b uint32) bool {
+	return a != b && a-b < 1<<31
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+const xfrUsage = "usage: xfr <zone> @<primary>[:port] [--tsig [<algorithm>:]<name>:<secret>] [--ixfr <zone file>] [-o <file>]"
+
+// xfrOptions are the arguments of the xfr subcommand
+type xfrOptions struct {
+	Zone    string
+	Primary string
+	// Key signs the transfer, nil for unsigned ones
+	Key *tsigKey
+	// Current is the zone file holding the copy an IXFR is requested from
+	Current string
+	Output  string
+}
+
+// parseXfrArgs parses the zone and @primary in any order, and the options
+// with their value as the next argument or after a =
+func parseXfrArgs(args []string) (*xfrOptions, error) {
+	opts := &xfrOptions{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if strings.HasPrefix(arg, "@") {
+			opts.Primary = serverAddr(strings.TrimPrefix(arg, "@"))
+			continue
+		}
+		if !strings.HasPrefix(arg, "-") {
+			if opts.Zone != "" {
+				return nil, fmt.Errorf("unexpected argument %q", arg)
+			}
+			opts.Zone = canonicalName(arg)
+			continue
+		}
+		option, value, ok := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !ok {
+			if i++; i == len(args) {
+				return nil, fmt.Errorf("option %s needs a value", arg)
+			}
+			value = args[i]
+		}
+		switch option {
+		case "tsig":
+			keys, err := NewTSIGKeys(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid TSIG key: %w", err)
+			}
+			for _, key := range keys.keys {
+				opts.Key = key
+			}
+		case "ixfr":
+			opts.Current = value
+		case "o":
+			opts.Output = value
+		default:
+			return nil, fmt.Errorf("unknown option %q", arg)
+		}
+	}
+	if opts.Zone == "" || opts.Primary == "" {
+		return nil, errors.New(xfrUsage)
+	}
+	return opts, nil
+}
+
+// runXfr implements the xfr subcommand. It transfers a zone from its primary
+// and writes it in the master file format, to standard output by default. With
+// --ixfr only the changes since the copy in the zone file are transferred and
+// applied to it.
+func runXfr(args []string, stdout io.Writer) error {
+	opts, err := parseXfrArgs(args)
+	if err != nil {
+		return err
+	}
+	qtype := dnsmessage.TypeAXFR
+	var current []dnsmessage.Resource
+	var soa *dnsmessage.Resource
+	if opts.Current != "" {
+		if current, err = loadZoneFile(opts.Current, opts.Zone); err != nil {
+			return err
+		}
+		for i, rr := range current {
+			if rr.Type == dnsmessage.TypeSOA && canonicalName(rr.Name) == opts.Zone {
+				soa = &current[i]
+			}
+		}
+		if soa == nil {
+			return fmt.Errorf("%s: zone %s has no SOA record", opts.Current, dnsmessage.FQDN(opts.Zone))
+		}
+		qtype = dnsmessage.TypeIXFR
+	}
+
+	t, err := requestTransfer(context.Background(), opts.Primary, opts.Zone, qtype, soa, opts.Key)
+	if err != nil {
+		return err
+	}
+	records := t.Records
+	switch {
+	case t.UpToDate:
+		records = current
+	case t.Diffs != nil:
+		if records, err = applyDiffs(current, t.Diffs); err != nil {
+			return fmt.Errorf("transfer of %s: %w", dnsmessage.FQDN(opts.Zone), err)
+		}
+	}
+	serial, _ := zoneSerial(records)
+	content := formatZone(opts.Zone, records, fmt.Sprintf("serial %d transferred from %s with %s on %s", serial, opts.Primary, qtype, time.Now().UTC().Format(time.RFC3339)))
+
+	if opts.Output == "" || opts.Output == "-" {
+		_, err = io.WriteString(stdout, content)
+		return err
+	}
+	return os.WriteFile(opts.Output, []byte(content), 0o644)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+func TestRunXfr(t *testing.T) {
+	p := &fakePrimary{versions: [][]dnsmessage.Resource{
+		{serialSOA(1), aRecord("www.example.com", "192.0.2.1"), aRecord("ftp.example.com", "192.0.2.3")},
+	}}
+	addr := startFakePrimary(t, p)
+
+	var out bytes.Buffer
+	if err := runXfr([]string{"example.com", "@" + addr}, &out); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"$ORIGIN example.com.", "www.example.com.\t300\tIN\tA\t192.0.2.1", "ftp.example.com.\t300\tIN\tA\t192.0.2.3"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Output is missing %q:\n%s", want, out.String())
+		}
+	}
+
+	// The written zone is where the next transfer picks up from
+	path := filepath.Join(t.TempDir(), "example.com.zone")
+	if err := runXfr([]string{"@" + addr, "example.com", "-o", path}, &out); err != nil {
+		t.Fatal(err)
+	}
+	p.mu.Lock()
+	p.versions = append(p.versions, []dnsmessage.Resource{serialSOA(2), aRecord("www.example.com", "192.0.2.1"), aRecord("mail.example.com", "192.0.2.5")})
+	p.mu.Unlock()
+	if err := runXfr([]string{"example.com", "@" + addr, "--ixfr", path, "-o=" + path}, &out); err != nil {
+		t.Fatal(err)
+	}
+	records, err := loadZoneFile(path, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial, _ := zoneSerial(records); serial != 2 || len(records) != 3 || !containsRecord(records, aRecord("mail.example.com", "192.0.2.5")) {
+		t.Errorf("Expected serial 2 with the diff applied, got %v", records)
+	}
+	p.mu.Lock()
+	if got := p.requests[len(p.requests)-1]; got != dnsmessage.TypeIXFR {
+		t.Errorf("Expected an IXFR, got %s", got)
+	}
+	p.mu.Unlock()
+
+	// The fake primary doesn't sign its answers
+	if err := runXfr([]string{"example.com", "@" + addr, "--tsig", "test-key:c2VjcmV0"}, &out); err == nil {
+		t.Error("Expected an unsigned answer to a signed transfer to fail")
+	}
+}
+
+func TestParseXfrArgs(t *testing.T) {
+	opts, err := parseXfrArgs([]string{"Example.COM.", "@192.0.2.1", "--tsig=hmac-sha512:xfr-key:c2VjcmV0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Zone != "example.com" || opts.Primary != "192.0.2.1:53" || opts.Key == nil || opts.Key.Name != "xfr-key" {
+		t.Errorf("Unexpected options %+v", opts)
+	}
+	for _, args := range [][]string{{"example.com"}, {"@192.0.2.1"}, {"example.com", "@192.0.2.1", "--tsig"}, {"example.com", "@192.0.2.1", "--bogus=1"}, {"a", "b", "@192.0.2.1"}} {
+		if _, err := parseXfrArgs(args); err == nil {
+			t.Errorf("Expected %q to be rejected", args)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// parseYAML parses the subset of YAML the scenarios are written in into
+// map[string]any, []any and string values: block mappings and sequences
+// nested by indentation, sequence items starting a mapping ("- key: value"),
+// plain, single and double quoted scalars, flow sequences of scalars
+// ([a, b]), literal blocks (|) and # comments. Anchors, tags, flow mappings
+// and multiple documents are not supported.
+func parseYAML(src, name string) (map[string]any, error) {
+	p := &yamlParser{name: name}
+	for i, raw := range strings.Split(strings.ReplaceAll(src, "\t", "    "), "\n") {
+		text := strings.TrimRight(raw, " \r")
+		indent := len(text) - len(strings.TrimLeft(text, " "))
+		p.lines = append(p.lines, yamlLine{num: i + 1, indent: indent, raw: text, text: stripYAMLComment(text[indent:])})
+	}
+	p.skipBlank()
+	if p.pos == len(p.lines) {
+		return map[string]any{}, nil
+	}
+	if p.lines[p.pos].indent != 0 || yamlSequenceItem(p.lines[p.pos].text) {
+		return nil, p.errorf("expected a mapping at the top level")
+	}
+	doc, err := p.mapping(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.skipBlank(); p.pos < len(p.lines) {
+		return nil, p.errorf("unexpected indentation")
+	}
+	return doc, nil
+}
+
+type yamlLine struct {
+	num    int
+	indent int
+	// raw is the line as written, for literal blocks
+	raw string
+	// text is the line without indentation and comment
+	text string
+}
+
+type yamlParser struct {
+	name  string
+	lines []yamlLine
+	pos   int
+}
+
+// yamlKey matches the key of a mapping entry and what follows it
+var yamlKey = regexp.MustCompile(`^([A-Za-z0-9_.-]+):(?:\s+(.*))?$`)
+
+func (p *yamlParser) errorf(format string, args ...any) error {
+	line := len(p.lines)
+	if p.pos < len(p.lines) {
+		line = p.lines[p.pos].num
+	}
+	return fmt.Errorf("%s:%d: %s", p.name, line, fmt.Sprintf(format, args...))
+}
+
+// skipBlank moves past empty and comment only lines
+func (p *yamlParser) skipBlank() {
+	for p.pos < len(p.lines) && p.lines[p.pos].text == "" {
+		p.pos++
+	}
+}
+
+// block parses the mapping or sequence starting at the current line
+func (p *yamlParser) block(indent int) (any, error) {
+	if yamlSequenceItem(p.lines[p.pos].text) {
+		return p.sequence(indent)
+	}
+	return p.mapping(indent)
+}
+
+// mapping parses the entries at indent
+func (p *yamlParser) mapping(indent int) (map[string]any, error) {
+	m := make(map[string]any)
+	for p.skipBlank(); p.pos < len(p.lines) && p.lines[p.pos].indent == indent && !yamlSequenceItem(p.lines[p.pos].text); p.skipBlank() {
+		match := yamlKey.FindStringSubmatch(p.lines[p.pos].text)
+		if match == nil {
+			return nil, p.errorf("expected key: value, got %q", p.lines[p.pos].text)
+		}
+		key, rest := match[1], match[2]
+		if _, dup := m[key]; dup {
+			return nil, p.errorf("duplicate key %s", key)
+		}
+		p.pos++
+		value, err := p.value(indent, rest, true)
+		if err != nil {
+			return nil, err
+		}
+		m[key] = value
+	}
+	return m, nil
+}
+
+// sequence parses the items at indent
+func (p *yamlParser) sequence(indent int) ([]any, error) {
+	var items []any
+	for p.skipBlank(); p.pos < len(p.lines) && p.lines[p.pos].indent == indent && yamlSequenceItem(p.lines[p.pos].text); p.skipBlank() {
+		line := &p.lines[p.pos]
+		rest := strings.TrimSpace(strings.TrimPrefix(line.text, "-"))
+		if yamlKey.MatchString(rest) {
+			// The item is a mapping, its first entry on the line of the dash
+			offset := len(line.text) - len(strings.TrimLeft(line.text[1:], " "))
+			line.indent, line.text = indent+offset, rest
+			item, err := p.mapping(line.indent)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+			continue
+		}
+		p.pos++
+		item, err := p.value(indent, rest, false)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// value parses what follows a key or dash at indent: rest itself, a literal
+// block or the nested block on the following lines. Mapping values may be
+// sequences at the indentation of their key.
+func (p *yamlParser) value(indent int, rest string, inMapping bool) (any, error) {
+	switch {
+	case rest == "|":
+		return p.literal(indent), nil
+	case rest != "":
+		return yamlScalar(rest)
+	}
+	p.skipBlank()
+	if p.pos == len(p.lines) {
+		return "", nil
+	}
+	next := p.lines[p.pos]
+	if next.indent > indent || inMapping && next.indent == indent && yamlSequenceItem(next.text) {
+		return p.block(next.indent)
+	}
+	return "", nil
+}
+
+// literal returns the lines indented deeper than indent as written, less
+// the indentation of the first one
+func (p *yamlParser) literal(indent int) string {
+	var sb strings.Builder
+	base := -1
+	for ; p.pos < len(p.lines); p.pos++ {
+		line := p.lines[p.pos]
+		if strings.TrimSpace(line.raw) == "" {
+			sb.WriteString("\n")
+			continue
+		}
+		if line.indent <= indent {
+			break
+		}
+		if base < 0 {
+			base = line.indent
+		}
+		sb.WriteString(line.raw[min(base, line.indent):])
+		sb.WriteString("\n")
+	}
+	return strings.TrimRight(sb.String(), "\n") + "\n"
+}
+
+func yamlSequenceItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// yamlScalar parses a scalar or a flow sequence of scalars
+func yamlScalar(s string) (any, error) {
+	if !strings.HasPrefix(s, "[") {
+		return yamlString(s)
+	}
+	if !strings.HasSuffix(s, "]") {
+		return nil, fmt.Errorf("unterminated flow sequence %s", s)
+	}
+	items := []any{}
+	for _, item := range splitYAMLFlow(s[1 : len(s)-1]) {
+		value, err := yamlString(item)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, value)
+	}
+	return items, nil
+}
+
+func yamlString(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		return strconv.Unquote(s)
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return "", fmt.Errorf("unterminated string %s", s)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	}
+	return s, nil
+}
+
+// splitYAMLFlow splits the items of a flow sequence at the commas outside quotes
+func splitYAMLFlow(s string) []string {
+	var items []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			items = append(items, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	if last := strings.TrimSpace(s[start:]); last != "" || len(items) > 0 {
+		items = append(items, last)
+	}
+	return items
+}
+
+// stripYAMLComment removes a # comment, which starts the line or follows a
+// space outside quotes
+func stripYAMLComment(text string) string {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			if i == 0 || text[i-1] == ' ' || text[i-1] == '[' || text[i-1] == '-' {
+				quote = c
+			}
+		case c == '#' && (i == 0 || text[i-1] == ' '):
+			return strings.TrimRight(text[:i], " ")
+		}
+	}
+	return text
+}
+
+func TestParseYAML(t *testing.T) {
+	doc, err := parseYAML(`# a scenario
+name: "quoted: name" # comment
+empty:
+list:
+- one
+- 'two # not a comment'
+nested:
+  flow: [a, "b, c", 'd']
+  items:
+    - query: www.example A
+      expect:
+        rcode: NOERROR
+    - plain
+zone: |
+  $TTL 1h
+  @ SOA ns hostmaster 1 2 3 4 5 ; a zone comment
+
+    indented
+after: done
+`, "test.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"name":  "quoted: name",
+		"empty": "",
+		"list":  []any{"one", "two # not a comment"},
+		"nested": map[string]any{
+			"flow": []any{"a", "b, c", "d"},
+			"items": []any{
+				map[string]any{"query": "www.example A", "expect": map[string]any{"rcode": "NOERROR"}},
+				"plain",
+			},
+		},
+		"zone":  "$TTL 1h\n@ SOA ns hostmaster 1 2 3 4 5 ; a zone comment\n\n  indented\n",
+		"after": "done",
+	}
+	if got, want := fmt.Sprintf("%#v", doc), fmt.Sprintf("%#v", want); got != want {
+		t.Errorf("Expected\n%s\ngot\n%s", want, got)
+	}
+
+	for _, src := range []string{
+		"- top level sequence\n",
+		"key\n",
+		"a: 1\na: 2\n",
+		"a:\n  b: 1\n c: 2\n",
+		"a: [unterminated\n",
+		"a: \"unterminated\n",
+	} {
+		if _, err := parseYAML(src, "test.yaml"); err == nil {
+			t.Errorf("Expected %q to be rejected", src)
+		}
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+// maxIncludeDepth bounds nested $INCLUDE directives, which rules out loops
+const maxIncludeDepth = 8
+
+// zoneFileExt is the extension of the zone files read from a directory
+const zoneFileExt = ".zone"
+
+// loadZoneFile reads the records of the zone origin from a master file
+func loadZoneFile(path, origin string) ([]dnsmessage.Resource, error) {
+	records, _, err := loadZoneFileSources(path, origin)
+	return records, err
+}
+
+// loadZoneFileSources reads a master file like loadZoneFile, along with the
+// <file>:<line> each record was read from
+func loadZoneFileSources(path, origin string) ([]dnsmessage.Resource, []string, error) {
+	l := &zoneLoad{}
+	if err := l.include(path, canonicalName(origin), nil, 0); err != nil {
+		return nil, nil, err
+	}
+	return l.records, l.sources, nil
+}
+
+// zoneLoad collects the records read from master files, where they were read
+// and the files read, including those of $INCLUDE directives
+type zoneLoad struct {
+	records []dnsmessage.Resource
+	sources []string
+	files   []string
+	// minimum is the MINIMUM field of the last SOA record read, the TTL of
+	// records without one in files without $TTL
+	minimum *uint32
+}
+
+// loadZoneFiles reads the zone origin from a list of master files and
+// directories separated like PATH entries, directories standing for their
+// *.zone files in lexical order. The files are read in order and an RRset of
+// a later file replaces the one of the same name and type defined before,
+// signatures included, so files can override what others define.
+func loadZoneFiles(list, origin string) (*zoneLoad, error) {
+	var paths []string
+	for _, path := range filepath.SplitList(list) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			paths = append(paths, path)
+			continue
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if !e.IsDir() && filepath.Ext(e.Name()) == zoneFileExt {
+				paths = append(paths, filepath.Join(path, e.Name()))
+			}
+		}
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("%s: no zone files", list)
+	}
+
+	zone := &zoneLoad{}
+	for _, path := range paths {
+		part := &zoneLoad{}
+		if err := part.include(path, canonicalName(origin), nil, 0); err != nil {
+			return nil, err
+		}
+		overridden := make(map[rrsetKey]bool)
+		for i := range part.records {
+			rr := part.records[i]
+			rr.Name = canonicalName(rr.Name)
+			overridden[ttlKeyOf(&rr)] = true
+		}
+		var records []dnsmessage.Resource
+		var sources []string
+		for i := range zone.records {
+			rr := zone.records[i]
+			rr.Name = canonicalName(rr.Name)
+			if !overridden[ttlKeyOf(&rr)] {
+				records = append(records, zone.records[i])
+				sources = append(sources, zone.sources[i])
+			}
+		}
+		zone.records = append(records, part.records...)
+		zone.sources = append(sources, part.sources...)
+		zone.files = append(zone.files, part.files...)
+	}
+	return zone, nil
+}
+
+// include reads the master file path into l, see parse
+func (l *zoneLoad) include(path, origin string, defaultTTL *uint32, depth int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	l.files = append(l.files, path)
+	return l.parse(f, path, origin, defaultTTL, depth)
+}
+
+// parseZone reads records in the master file format
+// (https://www.rfc-editor.org/rfc/rfc1035#section-5): $ORIGIN, $TTL and
+// $INCLUDE directives, owners left out to repeat the previous one, "@" for the
+// origin, names relative to it, parentheses continuing an entry over several
+// lines and ; comments. TTL and class may be given in either order, the TTL
+// defaults to $TTL, or else the MINIMUM of the SOA record or else the previous
+// record's TTL, the class to IN.
+func parseZone(r io.Reader, name, origin string) ([]dnsmessage.Resource, error) {
+	records, _, err := parseZoneSources(r, name, origin)
+	return records, err
+}
+
+// parseZoneSources parses a master file like parseZone, the <name>:<line> of
+// the entry of each record is returned along with it
+func parseZoneSources(r io.Reader, name, origin string) ([]dnsmessage.Resource, []string, error) {
+	l := &zoneLoad{}
+	if err := l.parse(r, name, canonicalName(origin), nil, 0); err != nil {
+		return nil, nil, err
+	}
+	return l.records, l.sources, nil
+}
+
+// parse reads the master file name from r into l, starting out with the
+// $TTL defaultTTL when it is set. Files named by $INCLUDE are relative to the
+// directory of name, they start out with the origin of the directive or else
+// the current one and with the current $TTL. They leave the origin, owner and
+// $TTL of the including file alone
+// (https://www.rfc-editor.org/rfc/rfc1035#section-5.1).
+func (l *zoneLoad) parse(r io.Reader, name, origin string, defaultTTL *uint32, depth int) error {
+	var (
+		owner   string
+		lastTTL uint32
+		haveTTL bool
+	)
+	z := &zoneScanner{scanner: bufio.NewScanner(r)}
+	for {
+		fields, indented, err := z.next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", name, z.line, err)
+		}
+
+		if !indented && strings.HasPrefix(fields[0], "$") {
+			directive := strings.ToUpper(fields[0])
+			if len(fields) != 2 && (directive != "$INCLUDE" || len(fields) != 3) {
+				return fmt.Errorf("%s:%d: %s expects one argument", name, z.line, fields[0])
+			}
+			switch directive {
+			case "$ORIGIN":
+				origin = canonicalName(dnsmessage.JoinName(fields[1], origin))
+			case "$TTL":
+				ttl, ok := parseZoneTTL(fields[1])
+				if !ok {
+					return fmt.Errorf("%s:%d: invalid TTL %q", name, z.line, fields[1])
+				}
+				defaultTTL = &ttl
+			case "$INCLUDE":
+				if depth >= maxIncludeDepth {
+					return fmt.Errorf("%s:%d: $INCLUDE nested more than %d deep", name, z.line, maxIncludeDepth)
+				}
+				path := fields[1]
+				if !filepath.IsAbs(path) {
+					path = filepath.Join(filepath.Dir(name), path)
+				}
+				includeOrigin := origin
+				if len(fields) == 3 {
+					includeOrigin = canonicalName(dnsmessage.JoinName(fields[2], origin))
+				}
+				if err := l.include(path, includeOrigin, defaultTTL, depth+1); err != nil {
+					return fmt.Errorf("%s:%d: %w", name, z.line, err)
+				}
+			default:
+				return fmt.Errorf("%s:%d: unsupported directive %s", name, z.line, fields[0])
+			}
+			continue
+		}
+
+		if !indented {
+			// Owner names are checked strictly, Unicode ones become A-labels
+			if owner, err = dnsmessage.CanonicalName(dnsmessage.JoinName(fields[0], origin)); err != nil {
+				return fmt.Errorf("%s:%d: invalid owner %q: %w", name, z.line, fields[0], err)
+			}
+			fields = fields[1:]
+		} else if owner == "" {
+			return fmt.Errorf("%s:%d: record without owner name", name, z.line)
+		}
+		rr := dnsmessage.Resource{Name: owner, Class: dnsmessage.ClassINET}
+		explicitTTL := false
+		for i := 0; i < 2 && len(fields) > 0; i++ {
+			if ttl, ok := parseZoneTTL(fields[0]); ok && !explicitTTL {
+				rr.TTL, explicitTTL = ttl, true
+			} else if class, err := dnsmessage.ParseClass(fields[0]); err == nil {
+				rr.Class = class
+			} else {
+				break
+			}
+			fields = fields[1:]
+		}
+		if len(fields) == 0 {
+			return fmt.Errorf("%s:%d: record without type", name, z.line)
+		}
+		if rr.Type, err = dnsmessage.ParseType(fields[0]); err != nil {
+			return fmt.Errorf("%s:%d: %w", name, z.line, err)
+		}
+		if rr.Data, err = dnsmessage.ParseRDataIn(rr.Type, strings.Join(fields[1:], " "), origin); err != nil {
+			return fmt.Errorf("%s:%d: %w", name, z.line, err)
+		}
+		if soa, ok := rr.Data.(*dnsmessage.SOA); ok {
+			minimum := soa.Minimum
+			l.minimum = &minimum
+		}
+		switch {
+		case explicitTTL:
+		case defaultTTL != nil:
+			rr.TTL = *defaultTTL
+		case l.minimum != nil:
+			// The meaning of MINIMUM before $TTL existed
+			// (https://www.rfc-editor.org/rfc/rfc2308#section-4)
+			rr.TTL = *l.minimum
+		case haveTTL:
+			rr.TTL = lastTTL
+		default:
+			return fmt.Errorf("%s:%d: record without TTL, no $TTL and no SOA", name, z.line)
+		}
+		lastTTL, haveTTL = rr.TTL, true
+		l.records = append(l.records, rr)
+		l.sources = append(l.sources, fmt.Sprintf("%s:%d", name, z.line))
+	}
+}
+
+// parseZoneTTL parses a TTL in seconds or with BIND style units, like 1h30m
+func parseZoneTTL(s string) (uint32, bool) {
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(n), true
+	}
+	units := map[byte]uint64{'s': 1, 'm': 60, 'h': 3600, 'd': 86400, 'w': 604800}
+	var total uint64
+	for s != "" {
+		digits := 0
+		for digits < len(s) && s[digits] >= '0' && s[digits] <= '9' {
+			digits++
+		}
+		if digits == 0 || digits == len(s) {
+			return 0, false
+		}
+		unit, ok := units[s[digits]|0x20]
+		if !ok {
+			return 0, false
+		}
+		n, err := strconv.ParseUint(s[:digits], 10, 32)
+		if err != nil {
+			return 0, false
+		}
+		if total += n * unit; total > 1<<32-1 {
+			return 0, false
+		}
+		s = s[digits+1:]
+	}
+	return uint32(total), true
+}
+
+// zoneScanner splits a master file into entries
+type zoneScanner struct {
+	scanner *bufio.Scanner
+	// line is the line the current entry starts on
+	line int
+	read int
+}
+
+// next returns the fields of the next entry and whether it started with
+// whitespace, meaning it has no owner name. Quoted strings are kept as one
+// field with their quotes, parentheses are dropped.
+func (z *zoneScanner) next() (fields []string, indented bool, err error) {
+	depth := 0
+	for z.scanner.Scan() {
+		z.read++
+		text := z.scanner.Text()
+		if depth == 0 {
+			z.line = z.read
+			indented = text != "" && (text[0] == ' ' || text[0] == '\t')
+		}
+
+		var field strings.Builder
+		inField, quoted := false, false
+		flush := func() {
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		}
+	scan:
+		for i := 0; i < len(text); i++ {
+			c := text[i]
+			switch {
+			case quoted:
+				field.WriteByte(c)
+				if c == '\\' && i+1 < len(text) {
+					i++
+					field.WriteByte(text[i])
+				} else if c == '"' {
+					quoted = false
+				}
+			case c == '\\' && i+1 < len(text):
+				field.WriteByte(c)
+				field.WriteByte(text[i+1])
+				inField = true
+				i++
+			case c == '"':
+				field.WriteByte(c)
+				inField, quoted = true, true
+			case c == ';':
+				break scan
+			case c == '(' || c == ')':
+				flush()
+				if c == '(' {
+					depth++
+				} else if depth--; depth < 0 {
+					return nil, false, errors.New("unbalanced parentheses")
+				}
+			case c == ' ' || c == '\t':
+				flush()
+			default:
+				field.WriteByte(c)
+				inField = true
+			}
+		}
+		if quoted {
+			return nil, false, errors.New("unterminated string")
+		}
+		flush()
+		if depth == 0 && len(fields) > 0 {
+			return fields, indented, nil
+		}
+	}
+	if err := z.scanner.Err(); err != nil {
+		return nil, false, err
+	}
+	if depth > 0 {
+		return nil, false, errors.New("unbalanced parentheses")
+	}
+	return nil, false, io.EOF
+}
+
+// formatZone writes the records of zone in the master file format, the SOA
+// record first and the others sorted by name and type, below a comment line
+// describing where they come from
+func formatZone(zone string, records []dnsmessage.Resource, comment string) string {
+	records = append([]dnsmessage.Resource(nil), records...)
+	sort.SliceStable(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if (a.Type == dnsmessage.TypeSOA) != (b.Type == dnsmessage.TypeSOA) {
+			return a.Type == dnsmessage.TypeSOA
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Type < b.Type
+	})
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "; Zone %s, %s\n", dnsmessage.FQDN(zone), comment)
+	fmt.Fprintf(&sb, "$ORIGIN %s\n", dnsmessage.FQDN(zone))
+	for _, rr := range records {
+		sb.WriteString(rr.String())
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnsmessage"
+)
+
+const testZone = `$TTL 1h
+@	IN SOA ns1 hostmaster (
+		2024050101 ; serial
+		3600 600 86400 300 )
+	IN NS	ns1
+ns1	300 IN A 192.168.1.2
+www	A	192.168.1.10
+	AAAA	fd00::10
+mail	IN 1d MX 10 mail.example.net.
+txt	TXT	"hello; world" "(not a paren)"
+`
+
+const testReverseZone = `$TTL 1h
+@	SOA	ns1.home.lan. hostmaster.home.lan. 1 3600 600 86400 300
+2	PTR	ns1.home.lan.
+`
+
+func TestParseZone(t *testing.T) {
+	records, err := parseZone(strings.NewReader(testZone+"$ORIGIN 1.168.192.in-addr.arpa.\n2 PTR ns1.home.lan.\n"), "home.lan.zone", "home.lan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"home.lan.	3600	IN	SOA	ns1.home.lan. hostmaster.home.lan. 2024050101 3600 600 86400 300",
+		"home.lan.	3600	IN	NS	ns1.home.lan.",
+		"ns1.home.lan.	300	IN	A	192.168.1.2",
+		"www.home.lan.	3600	IN	A	192.168.1.10",
+		"www.home.lan.	3600	IN	AAAA	fd00::10",
+		"mail.home.lan.	86400	IN	MX	10 mail.example.net.",
+		`txt.home.lan.	3600	IN	TXT	"hello; world" "(not a paren)"`,
+		"2.1.168.192.in-addr.arpa.	3600	IN	PTR	ns1.home.lan.",
+	}
+	if len(records) != len(want) {
+		t.Fatalf("Expected %d records, got %d: %v", len(want), len(records), records)
+	}
+	for i, rr := range records {
+		if got := rr.String(); got != want[i] {
+			t.Errorf("Record %d: expected %q, got %q", i, want[i], got)
+		}
+	}
+}
+
+func TestParseZoneTTLDefaults(t *testing.T) {
+	records, err := parseZone(strings.NewReader("a 120 A 192.0.2.1\nb A 192.0.2.2\n"), "test", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records[1].TTL != 120 {
+		t.Errorf("Expected the previous TTL without $TTL, got %d", records[1].TTL)
+	}
+	// Without $TTL the MINIMUM of the SOA is the default, the SOA included
+	records, err = parseZone(strings.NewReader("@ SOA ns hostmaster 1 3600 600 86400 900\na 120 A 192.0.2.1\nb A 192.0.2.2\n"), "test", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records[0].TTL != 900 || records[2].TTL != 900 {
+		t.Errorf("Expected the SOA MINIMUM as default TTL without $TTL, got %d and %d", records[0].TTL, records[2].TTL)
+	}
+	records, err = parseZone(strings.NewReader("$TTL 60\n@ SOA ns hostmaster 1 3600 600 86400 900\nb A 192.0.2.2\n"), "test", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records[0].TTL != 60 || records[1].TTL != 60 {
+		t.Errorf("Expected $TTL to win over the SOA MINIMUM, got %d and %d", records[0].TTL, records[1].TTL)
+	}
+	if ttl, ok := parseZoneTTL("1h30m"); !ok || ttl != 5400 {
+		t.Errorf("Expected 1h30m to be 5400 seconds, got %d, %v", ttl, ok)
+	}
+}
+
+func TestParseZoneErrors(t *testing.T) {
+	for _, zone := range []string{
+		"a A 192.0.2.1\n",
+		"\tA 192.0.2.1\n",
+		"$TTL 60\na A not-an-address\n",
+		"$TTL 60\na BOGUS data\n",
+		"$TTL 60\na TXT \"unterminated\n",
+		"$TTL 60\n@ SOA ns hostmaster ( 1 2 3 4 5\n",
+		"$INCLUDE other.zone\n",
+	} {
+		if _, err := parseZone(strings.NewReader(zone), "test", "example.com"); err == nil {
+			t.Errorf("Expected %q to be rejected", zone)
+		}
+	}
+}
+
+func TestParseZoneRelativeNames(t *testing.T) {
+	records, err := parseZone(strings.NewReader("$TTL 60\nalias CNAME www\nabs CNAME www.example.net.\n"), "test", "example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := records[0].Data.(*dnsmessage.CNAME).Target; got != "www.example.com" {
+		t.Errorf("Expected relative target to be qualified, got %s", got)
+	}
+	if got := records[1].Data.(*dnsmessage.CNAME).Target; got != "www.example.net" {
+		t.Errorf("Expected absolute target to stay, got %s", got)
+	}
+}
+
+func TestParseZoneUnicodeNames(t *testing.T) {
+	records, err := parseZone(strings.NewReader("$TTL 60\nBücher A 192.0.2.1\n"), "test", "example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := records[0].Name; got != "xn--bcher-kva.example.com" {
+		t.Errorf("Expected the owner as A-label, got %s", got)
+	}
+	if _, err := parseZone(strings.NewReader("$TTL 60\nnul\\000 A 192.0.2.1\n"), "test", "example.com."); err == nil {
+		t.Error("Expected an owner with a NUL byte to be rejected")
+	}
+}
+
+// writeZoneFiles writes files by their path below a new directory, returning it
+func writeZoneFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestParseZoneInclude(t *testing.T) {
+	dir := writeZoneFiles(t, map[string]string{
+		"home.lan.zone":     testZone + "$INCLUDE hosts/office.zone office\n$INCLUDE hosts/lab.zone\nafter A 192.168.1.99\n",
+		"hosts/office.zone": "$TTL 5m\nprinter A 192.168.2.10\n",
+		"hosts/lab.zone":    "$ORIGIN lab.home.lan.\nbench A 192.168.3.10\n",
+		"loop.zone":         "$INCLUDE loop.zone\n",
+	})
+	records, sources, err := loadZoneFileSources(filepath.Join(dir, "home.lan.zone"), "home.lan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"printer.office.home.lan.\t300\tIN\tA\t192.168.2.10": filepath.Join(dir, "hosts/office.zone") + ":2",
+		"bench.lab.home.lan.\t3600\tIN\tA\t192.168.3.10":     filepath.Join(dir, "hosts/lab.zone") + ":2",
+		// The including file keeps its origin and TTL
+		"after.home.lan.\t3600\tIN\tA\t192.168.1.99": filepath.Join(dir, "home.lan.zone") + ":13",
+	}
+	for i, rr := range records {
+		if source, ok := want[rr.String()]; ok {
+			if sources[i] != source {
+				t.Errorf("Expected %s to come from %s, got %s", rr, source, sources[i])
+			}
+			delete(want, rr.String())
+		}
+	}
+	for rr := range want {
+		t.Errorf("Missing %s", rr)
+	}
+
+	if _, err := loadZoneFile(filepath.Join(dir, "loop.zone"), "home.lan"); err == nil || !strings.Contains(err.Error(), "nested") {
+		t.Errorf("Expected an $INCLUDE loop to be rejected, got %v", err)
+	}
+}
+
+func TestLoadZoneFiles(t *testing.T) {
+	dir := writeZoneFiles(t, map[string]string{
+		"base.zone":          testZone,
+		"teams/10-web.zone":  "$TTL 60\nwww A 192.168.1.20\napi A 192.168.1.21\n",
+		"teams/20-mail.zone": "$TTL 60\nmail MX 5 mx.home.lan.\nmx A 192.168.1.25\n",
+		"teams/README":       "not a zone file",
+	})
+	zone, err := loadZoneFiles(filepath.Join(dir, "base.zone")+string(filepath.ListSeparator)+filepath.Join(dir, "teams"), "home.lan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zone.files) != 3 {
+		t.Errorf("Expected the base file and the two team files, got %v", zone.files)
+	}
+	got := make(map[string]bool)
+	for _, rr := range zone.records {
+		got[rr.String()] = true
+	}
+	for _, rr := range []string{
+		"www.home.lan.\t60\tIN\tA\t192.168.1.20",
+		"www.home.lan.\t3600\tIN\tAAAA\tfd00::10",
+		"api.home.lan.\t60\tIN\tA\t192.168.1.21",
+		"mail.home.lan.\t60\tIN\tMX\t5 mx.home.lan.",
+		"ns1.home.lan.\t300\tIN\tA\t192.168.1.2",
+	} {
+		if !got[rr] {
+			t.Errorf("Missing %s in %v", rr, zone.records)
+		}
+	}
+	for _, rr := range []string{"www.home.lan.\t3600\tIN\tA\t192.168.1.10", "mail.home.lan.\t86400\tIN\tMX\t10 mail.example.net."} {
+		if got[rr] {
+			t.Errorf("Expected %s to be overridden by a later file", rr)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+#!/bin/sh
+#
+# Builds static release binaries with the version information embedded.
+#
+# Usage: ./release.sh [version]
+#
+# The version defaults to the output of `git describe`. The binaries end up in
+# dist/, one per platform, next to a SHA256SUMS file. Routers and Raspberry Pis
+# are the main targets, hence the ARM and MIPS builds.
+
+set -e # Exit early if any commands fail
+
+cd "$(dirname "$0")"
+
+VERSION=${1:-$(git describe --tags --always --dirty)}
+COMMIT=$(git rev-parse --short=12 HEAD)
+DATE=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+LDFLAGS="-s -w -X main.version=$VERSION -X main.commit=$COMMIT -X main.date=$DATE"
+
+rm -rf dist
+mkdir -p dist
+
+# <GOOS>/<GOARCH>[/<GOARM or GOMIPS>]
+for platform in linux/amd64 linux/arm64 linux/arm/7 linux/arm/6 linux/mips/softfloat linux/mipsle/softfloat darwin/arm64; do
+  os=$(echo "$platform" | cut -d/ -f1)
+  arch=$(echo "$platform" | cut -d/ -f2)
+  variant=$(echo "$platform" | cut -d/ -f3)
+  name="dns-server-$VERSION-$os-$arch"
+  goarm=""
+  gomips=""
+  case "$arch" in
+  arm)
+    goarm=$variant
+    name="$name"v"$variant"
+    ;;
+  mips | mipsle) gomips=$variant ;;
+  esac
+
+  echo "Building $name"
+  # CGO_ENABLED=0 makes the binaries static, they run on any libc
+  CGO_ENABLED=0 GOOS=$os GOARCH=$arch GOARM=$goarm GOMIPS=$gomips \
+    go build -trimpath -ldflags "$LDFLAGS" -o "dist/$name" ./app
+done
+
+(cd dist && sha256sum dns-server-* >SHA256SUMS)